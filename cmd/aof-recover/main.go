@@ -0,0 +1,65 @@
+// aof-recover reports the commands a point in time recovery of the append only file skips and,
+// with -apply, truncates the file like the server started with -recover-until or -recover-ops.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+
+	dir := flag.String("dir", "appendonlydir", "directory of the append only files")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "base name of the append only files")
+	until := flag.String("until", "", "keep the commands up to this time, like 10:42 or 2006-01-02T15:04:05Z07:00")
+	ops := flag.Int64("ops", 0, "keep only the first commands appended after the base")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "file with the AES key of encrypted files, "+envelope.KeyEnv+" is used when empty")
+	apply := flag.Bool("apply", false, "truncate the append only file, the originals are kept with the .pre-recovery suffix")
+	flag.Parse()
+
+	if *until == "" && *ops == 0 {
+		log.Fatalf("ERR -until or -ops is required")
+	}
+	limit := aof.Limit{Ops: *ops}
+	if *until != "" {
+		t, err := aof.ParseTime(*until, time.Now())
+		if err != nil {
+			log.Fatalf("ERR %v", err)
+		}
+		limit.Until = t
+	}
+
+	key, err := envelope.LoadKey(*encryptionKeyFile)
+	if err != nil {
+		log.Fatalf("ERR %v", err)
+	}
+	manifest, err := aof.LoadManifest(*dir, *appendFilename)
+	if err != nil {
+		log.Fatalf("ERR reading the manifest: %v", err)
+	}
+	cut, err := aof.FindCut(*dir, manifest, limit, key)
+	if err != nil {
+		log.Fatalf("ERR %v", err)
+	}
+	for _, skipped := range cut.Skipped {
+		fmt.Printf("skip %v\n", skipped)
+	}
+	fmt.Printf("%d commands replayed, %d commands skipped\n", cut.Replayed, len(cut.Skipped))
+	if cut.File == "" {
+		return
+	}
+	if !*apply {
+		fmt.Printf("run with -apply to truncate %s at %d bytes\n", cut.File, cut.Size)
+		return
+	}
+	if err := cut.Apply(*dir, manifest, key); err != nil {
+		log.Fatalf("ERR truncating the append only file: %v", err)
+	}
+	fmt.Printf("truncated %s at %d bytes\n", cut.File, cut.Size)
+}
@@ -0,0 +1,36 @@
+// reshard moves hash slots from a master of a cluster to another while the cluster keeps serving
+// its clients, like redis-cli --cluster reshard.
+package main
+
+import (
+	"flag"
+	"github.com/rilopez/redis-wire-protocol/internal/reshard"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+
+	from := flag.String("from", "", "address of the master giving the slots, like 127.0.0.1:7000")
+	to := flag.String("to", "", "address of the master receiving the slots")
+	slotList := flag.String("slots", "", "slots to move, like 0-99,200")
+	batch := flag.Int("batch", 10, "number of keys moved by each MIGRATE")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of MIGRATE")
+	replace := flag.Bool("replace", false, "overwrite the keys existing on the target")
+	flag.Parse()
+
+	if *from == "" || *to == "" || *slotList == "" {
+		log.Fatalf("ERR -from, -to and -slots are required")
+	}
+	slots, err := reshard.ParseSlots(*slotList)
+	if err != nil {
+		log.Fatalf("ERR %v", err)
+	}
+	opts := reshard.Options{Batch: *batch, Timeout: *timeout, Replace: *replace, Logf: log.Printf}
+	if err := reshard.Reshard(*from, *to, slots, opts); err != nil {
+		log.Fatalf("ERR %v", err)
+	}
+	log.Printf("moved %d slots from %s to %s", len(slots), *from, *to)
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
 	"github.com/rilopez/redis-wire-protocol/internal/server"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -16,12 +20,39 @@ func main() {
 
 	serverPort := flag.Uint("port", 6379, "port number to listen for TCP connections of clients implementing the redis protocol")
 	serverMaxClients := flag.Uint("max-clients", 100_000, "Max number of clients accepted by the server ")
+	netpollGoroutines := flag.Int("netpoll", 0, "serve the clients from this number of I/O goroutines with epoll instead of a goroutine per client, Linux only, 0 disables it")
+	busyScriptTimeout := flag.Duration("busy-script-timeout", 5*time.Second, "time a script can run before other clients receive BUSY errors")
+	notifyKeyspaceEvents := flag.String("notify-keyspace-events", "", "keyspace notification classes published, like KEA")
+	dir := flag.String("dir", ".", "directory of the RDB file")
+	dbFilename := flag.String("dbfilename", "", "name of the RDB file, like dump.rdb, empty disables the RDB snapshots")
+	appendOnly := flag.Bool("appendonly", false, "log every write command to the append only file")
+	appendDirname := flag.String("appenddirname", "appendonlydir", "directory of the append only files, inside dir")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "base name of the append only files")
+	appendFsync := flag.String("appendfsync", "everysec", "fsync policy of the append only file: always, everysec or no")
+	aofTimestamps := flag.Bool("aof-timestamp-enabled", false, "annotate the append only file with the time of the commands")
+	recoverUntil := flag.String("recover-until", "", "replay the append only file up to this time, like 10:42 or 2006-01-02T15:04:05Z07:00")
+	recoverOps := flag.Int64("recover-ops", 0, "replay only the first commands appended to the append only file after its base")
+	compression := flag.String("compression", "none", "compression of the RDB and append only files: none or gzip")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "file with the AES key, in hex or base64, encrypting the RDB and append only files, "+envelope.KeyEnv+" is used when empty")
+	replicaOf := flag.String("replicaof", "", "start as a replica of the master at \"<host> <port>\"")
+	clusterEnabled := flag.Bool("cluster-enabled", false, "start in cluster mode")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "configuration file of the cluster, inside dir")
+	clusterNodeTimeout := flag.Duration("cluster-node-timeout", 15*time.Second, "time a node of the cluster can be unreachable before it is considered failing")
+	raftEnabled := flag.Bool("raft-enabled", false, "commit the write commands through a raft log replicated to the members")
+	raftDir := flag.String("raft-dir", "raft", "directory of the raft log, inside dir")
+	activeActive := flag.Bool("active-active", false, "accept writes on every peer and replicate the values as CRDTs")
+	activeActivePeers := flag.String("active-active-peers", "", "comma separated host:port of the other masters in active-active mode")
+	sentinelEnabled := flag.Bool("sentinel", false, "start in sentinel mode, monitoring masters and failing them over")
+	sentinelMonitor := flag.String("sentinel-monitor", "", "masters monitored in sentinel mode, \"<name> <host> <port> <quorum>\" separated by ;")
+	sentinelDownAfter := flag.Duration("sentinel-down-after", 30*time.Second, "time a monitored instance can be unreachable before it is considered down")
+	sentinelFailoverTimeout := flag.Duration("sentinel-failover-timeout", 3*time.Minute, "time a failover can take before it is aborted")
+	save := flag.String("save", "3600 1 300 100 60 10000", "save the RDB file, once -dbfilename is set, after <seconds> if there were at least <changes>, empty disables it")
 
 	flag.Parse()
 	ready := make(chan bool)
 	quit := make(chan bool)
 	events := make(chan string)
-	osSignal := make(chan os.Signal)
+	osSignal := make(chan os.Signal, 1)
 	signal.Notify(osSignal, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-osSignal
@@ -39,13 +70,77 @@ func main() {
 					fmt.Println("Bye")
 					return
 				}
-			default:
-
 			}
 		}
 	}()
 
-	server.Start(*serverPort, *serverMaxClients, ready, quit, events)
+	key, err := envelope.LoadKey(*encryptionKeyFile)
+	if err != nil {
+		log.Fatalf("ERR %v", err)
+	}
+	opts := []server.Option{
+		server.WithBusyScriptTimeout(*busyScriptTimeout),
+		server.WithNotifyKeyspaceEvents(*notifyKeyspaceEvents),
+		server.WithRDB(*dir, *dbFilename),
+		server.WithSaveRules(*save),
+		server.WithEnvelope(*compression, key),
+	}
+	if *netpollGoroutines > 0 {
+		opts = append(opts, server.WithNetpoll(*netpollGoroutines))
+	}
+	if *appendOnly {
+		opts = append(opts, server.WithAppendOnly(*appendDirname, *appendFilename, *appendFsync),
+			server.WithAOFTimestamps(*aofTimestamps))
+	}
+	if *recoverUntil != "" || *recoverOps != 0 {
+		limit := aof.Limit{Ops: *recoverOps}
+		if *recoverUntil != "" {
+			until, err := aof.ParseTime(*recoverUntil, time.Now())
+			if err != nil {
+				log.Fatalf("ERR %v", err)
+			}
+			limit.Until = until
+		}
+		opts = append(opts, server.WithRecovery(limit))
+	}
+	if *replicaOf != "" {
+		var host string
+		var port int
+		if _, err := fmt.Sscanf(*replicaOf, "%s %d", &host, &port); err != nil {
+			log.Fatalf("ERR invalid -replicaof %q, expected \"<host> <port>\"", *replicaOf)
+		}
+		opts = append(opts, server.WithReplicaOf(host, port))
+	}
+	if *clusterEnabled {
+		opts = append(opts, server.WithCluster(*clusterConfigFile), server.WithClusterNodeTimeout(*clusterNodeTimeout))
+	}
+	if *raftEnabled {
+		opts = append(opts, server.WithRaft(*raftDir))
+	}
+	if *activeActive {
+		var peers []string
+		for _, peer := range strings.Split(*activeActivePeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		opts = append(opts, server.WithActiveActive(peers))
+	}
+	if *sentinelEnabled {
+		opts = append(opts, server.WithSentinel(*sentinelDownAfter, *sentinelFailoverTimeout))
+		for _, monitor := range strings.Split(*sentinelMonitor, ";") {
+			if monitor = strings.TrimSpace(monitor); monitor == "" {
+				continue
+			}
+			var name, host string
+			var port, quorum int
+			if _, err := fmt.Sscanf(monitor, "%s %s %d %d", &name, &host, &port, &quorum); err != nil {
+				log.Fatalf("ERR invalid -sentinel-monitor %q, expected \"<name> <host> <port> <quorum>\"", monitor)
+			}
+			opts = append(opts, server.WithSentinelMonitor(name, host, port, quorum))
+		}
+	}
+	server.Start(*serverPort, *serverMaxClients, ready, quit, events, opts...)
 	close(events)
 	close(quit)
 	close(ready)
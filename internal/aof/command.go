@@ -0,0 +1,190 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTruncated is returned by Replay when the file ends in the middle of a command, like after a
+// crash while the command was written
+var ErrTruncated = errors.New("unexpected end of file")
+
+// timestampAnnotation precedes the unix time of the commands following it, like redis with
+// aof-timestamp-enabled
+const timestampAnnotation = "#TS:"
+
+// AppendCommand appends args encoded as a RESP array of bulk strings, the format clients send
+// commands in
+func AppendCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Entry is a command read from an append only file
+type Entry struct {
+	Args []string
+	// Time is the time of the last timestamp annotation read, zero when there was none
+	Time time.Time
+	// Offset is the position of the command in the file
+	Offset int64
+}
+
+// Replay reads the commands of r calling fn for each of them, annotation lines starting with #
+// are skipped once their timestamp is read. It returns the number of bytes of the complete
+// commands read, when the last command is truncated the error is ErrTruncated and the file can be
+// recovered truncating it to that size.
+func Replay(r io.Reader, fn func(e Entry) error) (int64, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	var valid int64
+	var at time.Time
+	for {
+		line, err := cr.readLine()
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err == nil && strings.HasPrefix(line, "#") {
+			if at, err = parseAnnotation(line, at); err != nil {
+				return valid, fmt.Errorf("bad annotation at offset %d: %w", valid, err)
+			}
+			valid = cr.n
+			continue
+		}
+		var args []string
+		if err == nil {
+			args, err = readArgs(cr, line)
+		}
+		if err == io.ErrUnexpectedEOF {
+			return valid, ErrTruncated
+		}
+		if err != nil {
+			return valid, fmt.Errorf("bad file format reading the append only file at offset %d: %w", valid, err)
+		}
+		if err := fn(Entry{Args: args, Time: at, Offset: valid}); err != nil {
+			return valid, err
+		}
+		valid = cr.n
+	}
+}
+
+// parseAnnotation returns the time of a #TS:<unix seconds> annotation, other annotations keep the
+// time of the previous one
+func parseAnnotation(line string, at time.Time) (time.Time, error) {
+	if !strings.HasPrefix(line, timestampAnnotation) {
+		return at, nil
+	}
+	seconds, err := strconv.ParseInt(line[len(timestampAnnotation):], 10, 64)
+	if err != nil {
+		return at, fmt.Errorf("invalid timestamp %q", line)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func readArgs(r *countingReader, line string) ([]string, error) {
+	if len(line) < 2 || line[0] != '*' {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid array length %q", line)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, fmt.Errorf("expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk string length %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// ReplayFile replays the commands of the file at path like Replay, enveloped files are decoded
+// with key. The size returned is the size of the file up to the last complete command, for an
+// enveloped file up to the last complete frame as a frame holds whole commands.
+func ReplayFile(path string, key *envelope.Key, fn func(e Entry) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := envelope.NewReader(f, key)
+	if err != nil {
+		return 0, err
+	}
+	valid, err := Replay(r, fn)
+	if r.Header() == nil {
+		return valid, err
+	}
+	if errors.Is(err, ErrTruncated) {
+		return r.Valid(), fmt.Errorf("command cut in a complete frame: %w", envelope.ErrCorrupted)
+	}
+	if err == nil && r.Truncated() {
+		return r.Valid(), ErrTruncated
+	}
+	return r.Valid(), err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader counts the bytes read to find the end of the last complete command
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// readLine reads a line terminated by CRLF, a line without it at the end of the file is truncated
+func (r *countingReader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	r.n += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
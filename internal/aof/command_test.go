@@ -0,0 +1,44 @@
+package aof
+
+import (
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	buf := AppendCommand(nil, []string{"SET", "key", "a\r\nb"})
+	buf = AppendCommand(buf, []string{"DEL", "key"})
+
+	var replayed []string
+	valid, err := Replay(strings.NewReader(string(buf)), func(e Entry) error {
+		replayed = append(replayed, fmt.Sprint(e.Args))
+		return nil
+	})
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, valid, int64(len(buf)))
+	common.AssertEquals(t, fmt.Sprint(replayed), "[[SET key a\r\nb] [DEL key]]")
+}
+
+func TestReplayTruncated(t *testing.T) {
+	complete := AppendCommand(nil, []string{"SET", "key", "value"})
+	full := AppendCommand(complete, []string{"SET", "other", "value"})
+	for size := len(complete) + 1; size < len(full); size++ {
+		calls := 0
+		valid, err := Replay(strings.NewReader(string(full[:size])), func(e Entry) error {
+			calls++
+			return nil
+		})
+		common.AssertEquals(t, err, ErrTruncated)
+		common.AssertEquals(t, valid, int64(len(complete)))
+		common.AssertEquals(t, calls, 1)
+	}
+}
+
+func TestReplayBadFormat(t *testing.T) {
+	_, err := Replay(strings.NewReader("+OK\r\n"), func(e Entry) error { return nil })
+	if err == nil || err == ErrTruncated {
+		t.Errorf("want format error, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Package aof implements the redis 7 multi part append only file: a base file with the keyspace at
+// the time of the last rewrite, incremental files with the write commands executed since then and
+// a manifest listing them.
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileType is the role of a file listed in the manifest
+type FileType byte
+
+const (
+	// TypeBase is the file created by the last rewrite, an RDB snapshot or commands
+	TypeBase FileType = 'b'
+	// TypeHistory files were replaced by a rewrite and can be deleted
+	TypeHistory FileType = 'h'
+	// TypeIncr files have the commands appended after the base was written
+	TypeIncr FileType = 'i'
+)
+
+// File is an entry of the manifest
+type File struct {
+	Name string
+	Seq  int
+	Type FileType
+}
+
+// Manifest tracks the files of the append only file, it is rewritten atomically so a crash in the
+// middle of a rewrite always leaves a consistent set of files
+type Manifest struct {
+	// Name is the appendfilename, the files are named <name>.<seq>.<base.rdb|incr.aof>
+	Name    string
+	Base    *File
+	Incrs   []File
+	History []File
+}
+
+// ManifestName returns the name of the manifest file for the appendfilename name
+func ManifestName(name string) string {
+	return name + ".manifest"
+}
+
+// BaseName returns the name of the base file with sequence seq
+func BaseName(name string, seq int) string {
+	return fmt.Sprintf("%s.%d.base.rdb", name, seq)
+}
+
+// IncrName returns the name of the incremental file with sequence seq
+func IncrName(name string, seq int) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
+
+// NextIncr adds a new incremental file to the manifest and returns it
+func (m *Manifest) NextIncr() File {
+	seq := 1
+	if n := len(m.Incrs); n > 0 {
+		seq = m.Incrs[n-1].Seq + 1
+	}
+	incr := File{Name: IncrName(m.Name, seq), Seq: seq, Type: TypeIncr}
+	m.Incrs = append(m.Incrs, incr)
+	return incr
+}
+
+// NextBase returns the base file written by the next rewrite
+func (m *Manifest) NextBase() File {
+	seq := 1
+	if m.Base != nil {
+		seq = m.Base.Seq + 1
+	}
+	return File{Name: BaseName(m.Name, seq), Seq: seq, Type: TypeBase}
+}
+
+// Rewritten replaces the base with base and the incremental files written before the rewrite
+// started, the first keep incremental files, which move to the history
+func (m *Manifest) Rewritten(base File, keep []File) {
+	if m.Base != nil {
+		m.History = append(m.History, File{Name: m.Base.Name, Seq: m.Base.Seq, Type: TypeHistory})
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, f := range keep {
+		kept[f.Name] = true
+	}
+	incrs := make([]File, 0, len(keep))
+	for _, f := range m.Incrs {
+		if kept[f.Name] {
+			incrs = append(incrs, f)
+		} else {
+			m.History = append(m.History, File{Name: f.Name, Seq: f.Seq, Type: TypeHistory})
+		}
+	}
+	m.Base = &base
+	m.Incrs = incrs
+}
+
+// Write encodes the manifest, one line per file like
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+func (m *Manifest) Write(w io.Writer) error {
+	files := make([]File, 0, 1+len(m.History)+len(m.Incrs))
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	files = append(files, m.History...)
+	files = append(files, m.Incrs...)
+	for _, f := range files {
+		if _, err := fmt.Fprintf(w, "file %s seq %d type %c\n", f.Name, f.Seq, f.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseManifest reads a manifest written by Write or by redis
+func ParseManifest(name string, r io.Reader) (*Manifest, error) {
+	m := &Manifest{Name: name}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f, err := parseManifestLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %w", line, err)
+		}
+		switch f.Type {
+		case TypeBase:
+			if m.Base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: found a second base file", line)
+			}
+			m.Base = &f
+		case TypeHistory:
+			m.History = append(m.History, f)
+		case TypeIncr:
+			if n := len(m.Incrs); n > 0 && m.Incrs[n-1].Seq >= f.Seq {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: incr files out of order", line)
+			}
+			m.Incrs = append(m.Incrs, f)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseManifestLine(line string) (File, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return File{}, fmt.Errorf("invalid number of fields")
+	}
+	var f File
+	for i := 0; i < len(fields); i += 2 {
+		switch value := fields[i+1]; fields[i] {
+		case "file":
+			f.Name = value
+		case "seq":
+			seq, err := strconv.Atoi(value)
+			if err != nil || seq < 0 {
+				return File{}, fmt.Errorf("invalid seq %s", value)
+			}
+			f.Seq = seq
+		case "type":
+			if len(value) != 1 {
+				return File{}, fmt.Errorf("invalid type %s", value)
+			}
+			f.Type = FileType(value[0])
+			if f.Type != TypeBase && f.Type != TypeHistory && f.Type != TypeIncr {
+				return File{}, fmt.Errorf("unknown type %s", value)
+			}
+		}
+	}
+	if f.Name == "" || f.Type == 0 {
+		return File{}, fmt.Errorf("missing file name or type")
+	}
+	if strings.ContainsAny(f.Name, "/\\") {
+		return File{}, fmt.Errorf("file name %s must not contain a path", f.Name)
+	}
+	return f, nil
+}
+
+// Save replaces the manifest file in dir atomically, writing a temporary file renamed once it is
+// synced
+func (m *Manifest) Save(dir string) (err error) {
+	path := filepath.Join(dir, ManifestName(m.Name))
+	tmp := filepath.Join(dir, "temp-"+ManifestName(m.Name))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	if err = m.Write(f); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadManifest reads the manifest of the append only files named name in dir
+func LoadManifest(dir string, name string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestName(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseManifest(name, f)
+}
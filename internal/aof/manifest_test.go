@@ -0,0 +1,46 @@
+package aof
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"strings"
+	"testing"
+)
+
+func TestManifestRewrite(t *testing.T) {
+	m := &Manifest{Name: "appendonly.aof"}
+	first := m.NextIncr()
+	common.AssertEquals(t, first.Name, "appendonly.aof.1.incr.aof")
+
+	// a rewrite opens a new incr file before writing the new base
+	second := m.NextIncr()
+	m.Rewritten(m.NextBase(), []File{second})
+
+	var sb strings.Builder
+	common.ExpectNoError(t, m.Write(&sb))
+	common.AssertEquals(t, sb.String(), "file appendonly.aof.1.base.rdb seq 1 type b\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type h\n"+
+		"file appendonly.aof.2.incr.aof seq 2 type i\n")
+
+	parsed, err := ParseManifest("appendonly.aof", strings.NewReader(sb.String()))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, *parsed.Base, File{Name: "appendonly.aof.1.base.rdb", Seq: 1, Type: TypeBase})
+	common.AssertEquals(t, len(parsed.History), 1)
+	common.AssertEquals(t, parsed.Incrs[0], second)
+	common.AssertEquals(t, parsed.NextBase().Name, "appendonly.aof.2.base.rdb")
+	common.AssertEquals(t, parsed.NextIncr().Name, "appendonly.aof.3.incr.aof")
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []string{
+		"file a seq 1 type x\n",
+		"file a seq 1\n",
+		"file ../a seq 1 type i\n",
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+	}
+	for _, manifest := range tests {
+		if _, err := ParseManifest("appendonly.aof", strings.NewReader(manifest)); err == nil {
+			t.Errorf("want error parsing %q", manifest)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupSuffix is added to the files modified or left out by Cut.Apply
+const backupSuffix = ".pre-recovery"
+
+// Limit selects the commands replayed by a point in time recovery
+type Limit struct {
+	// Until skips the commands annotated with a later time, zero for no limit
+	Until time.Time
+	// Ops replays only the first Ops commands appended after the base, 0 for no limit
+	Ops int64
+}
+
+func (l Limit) exceeded(op int64, at time.Time) bool {
+	return (l.Ops > 0 && op > l.Ops) || (!l.Until.IsZero() && at.After(l.Until))
+}
+
+// ParseTime parses the time of a recovery: unix seconds, RFC 3339 or a local date and time like
+// "2006-01-02 15:04:05". A time of the day like "10:42" is today's.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			year, month, day := now.Date()
+			return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid recovery time %q", value)
+}
+
+// Skipped is a command left out by a point in time recovery
+type Skipped struct {
+	File string
+	// Op is the number of the command, counting from the first command appended after the base
+	Op int64
+	// Time is the time of the command annotation, zero when it had none
+	Time time.Time
+	Args []string
+}
+
+func (s Skipped) String() string {
+	at := "-"
+	if !s.Time.IsZero() {
+		at = s.Time.Format(time.RFC3339)
+	}
+	args := make([]string, 0, len(s.Args))
+	for _, arg := range s.Args {
+		args = append(args, strconv.Quote(arg))
+	}
+	return fmt.Sprintf("op %d at %s in %s: %s", s.Op, at, s.File, strings.Join(args, " "))
+}
+
+// Cut is where the replay of a point in time recovery stops
+type Cut struct {
+	// File is the incr file where the replay stops, empty when no command is skipped
+	File string
+	// Size is the number of bytes of File replayed, decoded bytes for an enveloped file
+	Size int64
+	// Replayed is the number of commands kept
+	Replayed int64
+	Skipped  []Skipped
+}
+
+// FindCut reads the incr files of the manifest in dir and finds the first command past limit.
+// The commands of a MULTI/EXEC block are kept or skipped together. Enveloped files are decoded
+// with key.
+func FindCut(dir string, m *Manifest, limit Limit, key *envelope.Key) (*Cut, error) {
+	if m.Base != nil && !limit.Until.IsZero() && strings.HasSuffix(m.Base.Name, ".rdb") {
+		created, err := baseCreationTime(filepath.Join(dir, m.Base.Name), key)
+		if err != nil {
+			return nil, err
+		}
+		if created.After(limit.Until) {
+			return nil, fmt.Errorf("the base %s was written at %s, after the recovery time, "+
+				"the older commands were compacted by a rewrite", m.Base.Name, created.Format(time.RFC3339))
+		}
+	}
+
+	cut := &Cut{}
+	var op int64
+	annotated := false
+	for i, incr := range m.Incrs {
+		// tx has the commands of the MULTI/EXEC block being read, they are kept or skipped together
+		var tx []Skipped
+		var txOffset int64
+		inMulti := false
+		keep := func(entries []Skipped, offset int64) {
+			for _, e := range entries {
+				if cut.File == "" && limit.exceeded(e.Op, e.Time) {
+					cut.File, cut.Size = incr.Name, offset
+				}
+			}
+			if cut.File != "" {
+				cut.Skipped = append(cut.Skipped, entries...)
+			} else {
+				cut.Replayed += int64(len(entries))
+			}
+		}
+		_, err := ReplayFile(filepath.Join(dir, incr.Name), key, func(e Entry) error {
+			annotated = annotated || !e.Time.IsZero()
+			switch strings.ToUpper(e.Args[0]) {
+			case "MULTI":
+				inMulti, txOffset = true, e.Offset
+				return nil
+			case "EXEC":
+				keep(tx, txOffset)
+				inMulti, tx = false, nil
+				return nil
+			}
+			op++
+			skipped := Skipped{File: incr.Name, Op: op, Time: e.Time, Args: e.Args}
+			if inMulti {
+				tx = append(tx, skipped)
+			} else {
+				keep([]Skipped{skipped}, e.Offset)
+			}
+			return nil
+		})
+		if err != nil && !(errors.Is(err, ErrTruncated) && i == len(m.Incrs)-1) {
+			return nil, fmt.Errorf("reading %s: %w", incr.Name, err)
+		}
+	}
+	if !limit.Until.IsZero() && op > 0 && !annotated {
+		return nil, fmt.Errorf("the append only file has no timestamp annotations, " +
+			"enable aof-timestamp-enabled to recover to a point in time")
+	}
+	return cut, nil
+}
+
+func baseCreationTime(path string, key *envelope.Key) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	r, err := envelope.NewReader(f, key)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return rdb.CreationTime(r)
+}
+
+// Apply truncates the append only file at the cut. The original of the truncated file and the
+// incr files after it are kept with the .pre-recovery suffix, the manifest stops listing them.
+// An enveloped file is decoded with key and its commands up to the cut encoded again.
+func (c *Cut) Apply(dir string, m *Manifest, key *envelope.Key) error {
+	if c.File == "" {
+		return nil
+	}
+	index := -1
+	for i, incr := range m.Incrs {
+		if incr.Name == c.File {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("%s is not in the manifest", c.File)
+	}
+
+	path := filepath.Join(dir, c.File)
+	if err := copyFile(path, path+backupSuffix); err != nil {
+		return err
+	}
+	if err := truncate(path, c.Size, key); err != nil {
+		return err
+	}
+	later := m.Incrs[index+1:]
+	m.Incrs = m.Incrs[:index+1]
+	// the manifest is saved before moving the later files, a crash in between leaves them unused
+	// and CreateWriter never appends to them
+	if err := m.Save(dir); err != nil {
+		return err
+	}
+	for _, incr := range later {
+		path := filepath.Join(dir, incr.Name)
+		if err := os.Rename(path, path+backupSuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate keeps the first size decoded bytes of the file at path
+func truncate(path string, size int64, key *envelope.Key) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := envelope.NewReader(f, key)
+	if err != nil {
+		return err
+	}
+	h := r.Header()
+	if h == nil {
+		return os.Truncate(path, size)
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		} else {
+			_ = os.Remove(tmp)
+		}
+	}()
+	opts := envelope.Options{Compression: h.Compression}
+	if h.Encrypted {
+		opts.Key = key
+	}
+	w, err := envelope.NewWriter(out, opts)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(w, r, size); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func copyFile(from, to string) (err error) {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,166 @@
+package aof
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeAOF writes an incr file with a command per second starting at start, the DEL and the SET
+// of the third second are a transaction
+func writeAOF(t *testing.T, dir string, start time.Time, opts envelope.Options) *Manifest {
+	m := &Manifest{Name: "appendonly.aof"}
+	incr := m.NextIncr()
+	path := filepath.Join(dir, incr.Name)
+	w, err := CreateWriter(path, opts)
+	common.ExpectNoError(t, err)
+	w.AppendTimestamp(start)
+	w.Append([]string{"SET", "a", "1"})
+	w.AppendTimestamp(start.Add(time.Second))
+	w.Append([]string{"SET", "b", "2"})
+	w.AppendTimestamp(start.Add(2 * time.Second))
+	w.Append([]string{"MULTI"})
+	w.Append([]string{"DEL", "a"})
+	w.Append([]string{"SET", "c", "3"})
+	w.Append([]string{"EXEC"})
+	common.ExpectNoError(t, w.Close())
+	common.ExpectNoError(t, m.Save(dir))
+	return m
+}
+
+func TestFindCutUntil(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1_700_000_000, 0)
+	m := writeAOF(t, dir, start, envelope.Options{})
+
+	cut, err := FindCut(dir, m, Limit{Until: start.Add(time.Second)}, nil)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, cut.File, "appendonly.aof.1.incr.aof")
+	common.AssertEquals(t, cut.Replayed, int64(2))
+	common.AssertEquals(t, len(cut.Skipped), 2)
+	common.AssertEquals(t, fmt.Sprint(cut.Skipped[0]),
+		fmt.Sprintf(`op 3 at %s in appendonly.aof.1.incr.aof: "DEL" "a"`, start.Add(2*time.Second).Format(time.RFC3339)))
+
+	common.ExpectNoError(t, cut.Apply(dir, m, nil))
+	var replayed []string
+	f, err := os.Open(filepath.Join(dir, "appendonly.aof.1.incr.aof"))
+	common.ExpectNoError(t, err)
+	defer f.Close()
+	_, err = Replay(f, func(e Entry) error {
+		replayed = append(replayed, fmt.Sprint(e.Args))
+		return nil
+	})
+	common.ExpectNoError(t, err)
+	// the annotation of the skipped transaction is left at the end of the file
+	common.AssertEquals(t, fmt.Sprint(replayed), "[[SET a 1] [SET b 2]]")
+	_, err = os.Stat(filepath.Join(dir, "appendonly.aof.1.incr.aof.pre-recovery"))
+	common.ExpectNoError(t, err)
+}
+
+func TestFindCutOps(t *testing.T) {
+	dir := t.TempDir()
+	m := writeAOF(t, dir, time.Unix(1_700_000_000, 0), envelope.Options{})
+
+	// the limit falls inside the transaction, it is skipped as a whole
+	cut, err := FindCut(dir, m, Limit{Ops: 3}, nil)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, cut.Replayed, int64(2))
+	common.AssertEquals(t, len(cut.Skipped), 2)
+
+	cut, err = FindCut(dir, m, Limit{Ops: 4}, nil)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, cut.File, "")
+	common.AssertEquals(t, cut.Replayed, int64(4))
+}
+
+func TestFindCutWithoutTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	m := &Manifest{Name: "appendonly.aof"}
+	w, err := CreateWriter(filepath.Join(dir, m.NextIncr().Name), envelope.Options{})
+	common.ExpectNoError(t, err)
+	w.Append([]string{"SET", "a", "1"})
+	common.ExpectNoError(t, w.Close())
+
+	if _, err := FindCut(dir, m, Limit{Until: time.Now()}, nil); err == nil {
+		t.Errorf("want error recovering to a time without annotations")
+	}
+}
+
+func TestFindCutEnveloped(t *testing.T) {
+	dir := t.TempDir()
+	key, err := envelope.NewKey(bytes.Repeat([]byte{7}, 32))
+	common.ExpectNoError(t, err)
+	opts := envelope.Options{Compression: envelope.CompressionGzip, Key: key}
+	start := time.Unix(1_700_000_000, 0)
+	m := writeAOF(t, dir, start, opts)
+
+	if _, err := FindCut(dir, m, Limit{Ops: 2}, nil); err == nil {
+		t.Errorf("want error reading an encrypted file without the key")
+	}
+	cut, err := FindCut(dir, m, Limit{Ops: 2}, key)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, cut.Replayed, int64(2))
+	common.ExpectNoError(t, cut.Apply(dir, m, key))
+
+	path := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+	var replayed []string
+	_, err = ReplayFile(path, key, func(e Entry) error {
+		replayed = append(replayed, fmt.Sprint(e.Args))
+		return nil
+	})
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(replayed), "[[SET a 1] [SET b 2]]")
+
+	// the recovered file keeps being appended with the same options
+	w, err := OpenWriter(path, opts)
+	common.ExpectNoError(t, err)
+	w.Append([]string{"SET", "d", "4"})
+	common.ExpectNoError(t, w.Close())
+	if _, err := OpenWriter(path, envelope.Options{}); !errors.Is(err, ErrEnvelopeChanged) {
+		t.Errorf("want ErrEnvelopeChanged opening the file without the envelope, got %v", err)
+	}
+
+	// a frame cut by a crash is dropped as a whole
+	info, err := os.Stat(path)
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, os.Truncate(path, info.Size()-3))
+	replayed = nil
+	valid, err := ReplayFile(path, key, func(e Entry) error {
+		replayed = append(replayed, fmt.Sprint(e.Args))
+		return nil
+	})
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("want ErrTruncated, got %v", err)
+	}
+	common.AssertEquals(t, fmt.Sprint(replayed), "[[SET a 1] [SET b 2]]")
+	common.ExpectNoError(t, os.Truncate(path, valid))
+	_, err = ReplayFile(path, key, func(e Entry) error { return nil })
+	common.ExpectNoError(t, err)
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2023, 5, 17, 18, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"1700000000":                time.Unix(1_700_000_000, 0),
+		"2023-05-16T10:42:00Z":      time.Date(2023, 5, 16, 10, 42, 0, 0, time.UTC),
+		"2023-05-16T10:42:00+02:00": time.Date(2023, 5, 16, 8, 42, 0, 0, time.UTC),
+		"2023-05-16 10:42:30":       time.Date(2023, 5, 16, 10, 42, 30, 0, time.UTC),
+		"10:42":                     time.Date(2023, 5, 17, 10, 42, 0, 0, time.UTC),
+	}
+	for value, want := range tests {
+		got, err := ParseTime(value, now)
+		common.ExpectNoError(t, err)
+		if !got.Equal(want) {
+			t.Errorf("ParseTime(%q) = %v, want %v", value, got, want)
+		}
+	}
+	if _, err := ParseTime("yesterday", now); err == nil {
+		t.Errorf("want error parsing an invalid time")
+	}
+}
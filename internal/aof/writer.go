@@ -0,0 +1,244 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FsyncPolicy selects when the appended commands are flushed to disk
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs after every write, commands are durable once replied
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec syncs in background once per second, a crash loses at most a second of writes
+	FsyncEverySec
+	// FsyncNo leaves the flushing to the operating system
+	FsyncNo
+)
+
+// ParseFsyncPolicy parses the appendfsync setting
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	switch strings.ToLower(value) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, fmt.Errorf("invalid appendfsync %q, want always, everysec or no", value)
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	}
+	return "no"
+}
+
+// ErrEnvelopeChanged is returned by OpenWriter when the file was written with other compression
+// or encryption options, the commands must be appended to a new incr file
+var ErrEnvelopeChanged = errors.New("the file was written with other compression or encryption options")
+
+// Writer appends commands to an incremental file. Commands are buffered with Append and written
+// with Flush, which the server calls before replying to the client, like redis does before going
+// back to the event loop. In an enveloped file every Flush writes a frame.
+type Writer struct {
+	f *os.File
+	// env encodes the commands of an enveloped file, nil for plain files
+	env      *envelope.Writer
+	buf      []byte
+	lastSync time.Time
+	// lastTimestamp is the unix time of the last timestamp annotation
+	lastTimestamp int64
+	// unsynced is set when commands were written after the last fsync
+	unsynced bool
+	// syncing is set while the background fsync of the everysec policy runs
+	syncing int32
+	syncs   sync.WaitGroup
+	// written counts the bytes written to the file, synced the bytes known to be on disk, it is
+	// updated by the background fsync
+	written int64
+	synced  int64
+}
+
+// OpenWriter opens path to append commands, the file is created when it does not exist. It
+// returns ErrEnvelopeChanged when the file was written with options other than opts.
+func OpenWriter(path string, opts envelope.Options) (*Writer, error) {
+	header, err := readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w := &Writer{f: f}
+	switch {
+	case info.Size() == 0 && opts.Enabled():
+		w.env, err = envelope.NewWriter(f, opts)
+	case header != nil && header.Matches(opts):
+		w.env, err = envelope.AppendWriter(f, *header, opts)
+	case header != nil || (info.Size() > 0 && opts.Enabled()):
+		err = ErrEnvelopeChanged
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// CreateWriter creates the new incr file path, it fails when the file exists to never mix the
+// commands of two incr files
+func CreateWriter(path string, opts envelope.Options) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f}
+	if opts.Enabled() {
+		if w.env, err = envelope.NewWriter(f, opts); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// readHeader returns the header of the enveloped file path, nil for plain or missing files
+func readHeader(path string) (*envelope.Header, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := envelope.ReadHeader(bufio.NewReader(f))
+	if err == envelope.ErrNotEnveloped {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &header, nil
+}
+
+// Append buffers the command args
+func (w *Writer) Append(args []string) {
+	w.buf = AppendCommand(w.buf, args)
+}
+
+// AppendTimestamp buffers a timestamp annotation when the second changed since the last one, the
+// commands appended after it were executed at now
+func (w *Writer) AppendTimestamp(now time.Time) {
+	if now.Unix() == w.lastTimestamp {
+		return
+	}
+	w.lastTimestamp = now.Unix()
+	w.buf = append(w.buf, timestampAnnotation...)
+	w.buf = strconv.AppendInt(w.buf, w.lastTimestamp, 10)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// Flush writes the buffered commands and syncs them according to policy
+func (w *Writer) Flush(policy FsyncPolicy, now time.Time) error {
+	if len(w.buf) > 0 {
+		err := w.write(w.buf)
+		w.buf = w.buf[:0]
+		if err != nil {
+			return err
+		}
+		switch policy {
+		case FsyncAlways:
+			w.lastSync = now
+			return w.sync(w.written)
+		case FsyncNo:
+			// the kernel decides when the bytes reach the disk, they never get more synced
+			atomic.StoreInt64(&w.synced, w.written)
+		default:
+			w.unsynced = true
+		}
+	}
+	if policy == FsyncEverySec && w.unsynced && now.Sub(w.lastSync) >= time.Second &&
+		atomic.CompareAndSwapInt32(&w.syncing, 0, 1) {
+		w.lastSync = now
+		w.unsynced = false
+		w.syncs.Add(1)
+		written := w.written
+		go func() {
+			defer w.syncs.Done()
+			defer atomic.StoreInt32(&w.syncing, 0)
+			_ = w.sync(written)
+		}()
+	}
+	return nil
+}
+
+// Close writes the buffered commands and syncs the file before closing it
+func (w *Writer) Close() error {
+	w.syncs.Wait()
+	if len(w.buf) > 0 {
+		if err := w.write(w.buf); err != nil {
+			_ = w.f.Close()
+			return err
+		}
+	}
+	if err := w.sync(w.written); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// sync fsyncs the file, the first written bytes are then on disk
+func (w *Writer) sync(written int64) error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.synced, written)
+	return nil
+}
+
+// Written returns the number of bytes written to the file, the timestamp annotations and the
+// envelope are counted before being encoded
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+// Synced returns the number of the bytes written that are known to be on disk, Synced reaches
+// Written once the fsync policy synced them
+func (w *Writer) Synced() int64 {
+	return atomic.LoadInt64(&w.synced)
+}
+
+func (w *Writer) write(p []byte) (err error) {
+	if w.env != nil {
+		err = w.env.WriteFrame(p)
+	} else {
+		_, err = w.f.Write(p)
+	}
+	if err == nil {
+		w.written += int64(len(p))
+	}
+	return err
+}
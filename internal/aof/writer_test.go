@@ -0,0 +1,43 @@
+package aof
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterSynced(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	set := []string{"SET", "k", "v"}
+	size := int64(len(AppendCommand(nil, set)))
+
+	w, err := CreateWriter(filepath.Join(dir, "always.aof"), envelope.Options{})
+	common.ExpectNoError(t, err)
+	w.Append(set)
+	common.ExpectNoError(t, w.Flush(FsyncAlways, now))
+	common.AssertEquals(t, w.Written(), size)
+	common.AssertEquals(t, w.Synced(), size)
+	common.ExpectNoError(t, w.Close())
+
+	w, err = CreateWriter(filepath.Join(dir, "everysec.aof"), envelope.Options{})
+	common.ExpectNoError(t, err)
+	w.Append(set)
+	common.ExpectNoError(t, w.Flush(FsyncEverySec, now))
+	w.syncs.Wait()
+	common.AssertEquals(t, w.Written(), size)
+	common.AssertEquals(t, w.Synced(), size)
+	// the next fsync is a second after the last one
+	w.Append(set)
+	common.ExpectNoError(t, w.Flush(FsyncEverySec, now.Add(time.Millisecond)))
+	w.syncs.Wait()
+	common.AssertEquals(t, w.Synced(), size)
+	common.ExpectNoError(t, w.Flush(FsyncEverySec, now.Add(time.Second)))
+	w.syncs.Wait()
+	common.AssertEquals(t, w.Synced(), 2*size)
+	w.Append(set)
+	common.ExpectNoError(t, w.Close())
+	common.AssertEquals(t, w.Synced(), 3*size)
+}
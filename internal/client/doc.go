@@ -2,5 +2,12 @@
 
 Main exported symbols
    - Worker
+
+A Worker executes the commands read from the connection that its Executor accepts, it sends the
+rest to the server, and writes back their responses. The commands are parsed from a reusable input
+buffer, the ones the RawExecutor accepts are executed from their arguments still in that buffer
+and their replies appended to a reusable output buffer, without allocating.
+Messages the server pushes asynchronously, like the ones received by Pub/Sub subscribers, are
+written by a dedicated goroutine as they arrive, never in the middle of a response.
 */
 package client
@@ -8,14 +8,23 @@ import (
 	"io"
 	"log"
 	"net"
-	"net/textproto"
 	"sync"
 	"time"
 
 	"github.com/rilopez/redis-wire-protocol/internal/common"
 )
 
-const idleTimeout = 20 * time.Millisecond
+// readBufferSize is the initial size of the input buffer of a worker, it grows for the commands
+// that do not fit and shrinks back once they are executed
+const readBufferSize = 4096
+
+// Executor executes a command in the worker goroutine, it returns false when the command has to
+// be sent to the server instead
+type Executor func(cmd common.Command) (response string, executed bool)
+
+// RawExecutor executes a command from the arguments parsed by the worker, still pointing to its
+// input buffer, and appends the reply to out. It returns false when the command has to be parsed.
+type RawExecutor func(args [][]byte, out []byte) ([]byte, bool)
 
 // Worker is used to handle a client connection
 type Worker struct {
@@ -23,12 +32,16 @@ type Worker struct {
 	conn     net.Conn
 	request  chan<- common.Command
 	response <-chan string
-	quit     <-chan bool
-	now      func() time.Time
+	// push receives the messages the server sends without a request, like Pub/Sub messages
+	push       <-chan string
+	execute    Executor
+	executeRaw RawExecutor
+	quit       <-chan bool
+	now        func() time.Time
 }
 
 // NewWorker allocates a Worker
-func NewWorker(conn net.Conn, ID uint, request chan<- common.Command, response <-chan string, now func() time.Time, quit <-chan bool) (*Worker, error) {
+func NewWorker(conn net.Conn, ID uint, request chan<- common.Command, response <-chan string, push <-chan string, execute Executor, executeRaw RawExecutor, now func() time.Time, quit <-chan bool) (*Worker, error) {
 	if conn == nil {
 		return nil, fmt.Errorf("conn can not be nil")
 	}
@@ -38,6 +51,15 @@ func NewWorker(conn net.Conn, ID uint, request chan<- common.Command, response <
 	if response == nil {
 		return nil, fmt.Errorf("response chan can not be nil")
 	}
+	if push == nil {
+		return nil, fmt.Errorf("push chan can not be nil")
+	}
+	if execute == nil {
+		return nil, fmt.Errorf("execute function can not be nil")
+	}
+	if executeRaw == nil {
+		return nil, fmt.Errorf("executeRaw function can not be nil")
+	}
 	if quit == nil {
 		return nil, fmt.Errorf("quit chan can not be nil")
 	}
@@ -46,78 +68,213 @@ func NewWorker(conn net.Conn, ID uint, request chan<- common.Command, response <
 	}
 
 	client := &Worker{
-		ID:       ID,
-		conn:     conn,
-		request:  request,
-		response: response,
-		quit:     quit,
-		now:      now,
+		ID:         ID,
+		conn:       conn,
+		request:    request,
+		response:   response,
+		push:       push,
+		execute:    execute,
+		executeRaw: executeRaw,
+		quit:       quit,
+		now:        now,
 	}
 	return client, nil
 }
 
-func (c *Worker) receiveCommandsLoop() {
-	reader := bufio.NewReader(c.conn)
-	writer := bufio.NewWriter(c.conn)
-	tp := textproto.NewReader(reader)
-	for {
-		if err := c.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
-			log.Fatal(err)
+// receiveCommandsLoop reads the commands into its input buffer and executes them. The replies of
+// the commands executed from their raw arguments are collected in a buffer handed to the writing
+// loop once the pipelined commands received are executed, or before a command with a string
+// response, so the replies keep the order of the commands.
+func (c *Worker) receiveCommandsLoop(out chan<- string, raw chan<- []byte, written <-chan []byte) {
+	in := make([]byte, readBufferSize)
+	start, end := 0, 0
+	args := resp.GetRawArgs()
+	defer resp.PutRawArgs(args)
+	replies := make([]byte, 0, readBufferSize)
+	flushReplies := func() {
+		if len(replies) > 0 {
+			raw <- replies
+			replies = (<-written)[:0]
 		}
-		cmd, err := c.readCommand(tp)
-		if err != nil {
+	}
 
-			select {
-			case <-c.quit:
-				log.Printf("worker with ID %d got quick signal stopping reading loop ", c.ID)
+	for {
+		n, err := args.Parse(in[start:end])
+		if err == nil && n == 0 {
+			flushReplies()
+			if in, start, end, err = c.read(in, start, end); err != nil {
+				c.logReadError(err)
 				return
-			default:
-				if errTimeout, ok := err.(net.Error); ok && errTimeout.Timeout() {
-					continue
-				} else {
-					if errors.Is(err, io.EOF) {
-						log.Printf("ERR  client connection EOF ")
-					} else {
-						log.Printf("ERR  readCommand :%v ", err)
-					}
-					return
-				}
 			}
-		} else {
-			c.request <- cmd
-			if cmd.CMD == common.CLIENT && cmd.Arguments.(common.CLIENTArguments).Subcommand == common.ClientSubcommandKILL {
-				log.Printf("worker got a CLIENT KILL cmd, stopping reading loop ")
-				return
+			continue
+		}
+		if err != nil {
+			// the replies of the commands parsed before are written first
+			flushReplies()
+			if resp.IsProtocolError(err) {
+				out <- resp.Error(err)
 			}
-			_, err := writer.WriteString(<-c.response)
-			if err != nil {
+			c.logReadError(err)
+			return
+		}
+		start += n
+		var executed bool
+		if replies, executed = c.executeRaw(args.Args, replies); executed {
+			continue
+		}
+		flushReplies()
+
+		cmd, err := c.readCommand(args.Strings())
+		var cmdErr *resp.CommandError
+		if errors.As(err, &cmdErr) {
+			// the command was read completely, let the server reply with the error
+			cmd.Err = cmdErr
+			err = nil
+		}
+		if err != nil {
+			c.logReadError(err)
+			return
+		}
+		if response, executed := c.execute(cmd); executed {
+			out <- response
+			continue
+		}
+		c.request <- cmd
+		if clientArgs, ok := cmd.Arguments.(common.CLIENTArguments); ok && clientArgs.Subcommand == common.ClientSubcommandKILL {
+			log.Printf("worker got a CLIENT KILL cmd, stopping reading loop ")
+			return
+		}
+		if !cmd.ExpectsReply() {
+			// after PSYNC the server writes the replication stream, the replica only sends
+			// REPLCONF ACK
+			continue
+		}
+		out <- <-c.response
+	}
+}
+
+// read moves the bytes not consumed yet, in[start:end], to the start of the buffer and reads more
+// after them. The buffer doubles when it is full and shrinks back once it is empty.
+func (c *Worker) read(in []byte, start, end int) ([]byte, int, int, error) {
+	switch {
+	case start == end && len(in) > readBufferSize:
+		in = make([]byte, readBufferSize)
+		start, end = 0, 0
+	case start > 0:
+		end = copy(in, in[start:end])
+		start = 0
+	}
+	if end == len(in) {
+		in = append(in, make([]byte, len(in))...)
+	}
+	n, err := c.conn.Read(in[end:])
+	if n > 0 {
+		// the error is returned again by the next read, once the bytes received are executed
+		err = nil
+	}
+	return in, start, end + n, err
+}
+
+func (c *Worker) logReadError(err error) {
+	select {
+	case <-c.quit:
+		log.Printf("worker with ID %d got quit signal stopping reading loop ", c.ID)
+	default:
+		if errors.Is(err, io.EOF) {
+			log.Printf("ERR  client connection EOF ")
+		} else {
+			log.Printf("ERR  readCommand :%v ", err)
+		}
+	}
+}
+
+// writeLoop writes the responses read by the reading loop and the messages pushed by the server
+// as they arrive. The quit signal closes the connection, which stops the reading loop blocked on
+// it, the loop returns once the reading loop is done.
+func (c *Worker) writeLoop(out <-chan string, raw <-chan []byte, written chan<- []byte, done <-chan struct{}) {
+	writer := bufio.NewWriter(c.conn)
+	quit := c.quit
+	for {
+		select {
+		case msg := <-c.push:
+			c.write(writer, msg)
+			c.writePushes(writer)
+		case response := <-out:
+			// messages pushed while the command was executed go before its response
+			c.writePushes(writer)
+			c.write(writer, response)
+		case replies := <-raw:
+			c.writePushes(writer)
+			if _, err := writer.Write(replies); err != nil {
 				log.Printf("ERR writing to connection %v ", err)
 			}
-			err = writer.Flush()
-			if err != nil {
-				log.Printf("ERR trying to flush response %v ", err)
+			// the reading loop reuses the buffer
+			written <- replies
+		case <-quit:
+			quit = nil
+			// the server closes the connection of a slow client itself
+			if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("ERR trying to close the connection %v", err)
 			}
+			continue
+		case <-done:
+			return
+		}
+		c.flush(writer)
+	}
+}
+
+func (c *Worker) write(writer *bufio.Writer, msg string) {
+	if _, err := writer.WriteString(msg); err != nil {
+		log.Printf("ERR writing to connection %v ", err)
+	}
+}
 
+// writePushes writes the pending pushed messages without waiting for new ones
+func (c *Worker) writePushes(writer *bufio.Writer) {
+	for {
+		select {
+		case msg := <-c.push:
+			c.write(writer, msg)
+		default:
+			return
 		}
 	}
 }
 
-func (c *Worker) readCommand(reader *textproto.Reader) (common.Command, error) {
-	cmd, data, err := resp.DeserializeCMD(reader)
+func (c *Worker) flush(writer *bufio.Writer) {
+	if err := writer.Flush(); err != nil {
+		log.Printf("ERR trying to flush response %v ", err)
+	}
+}
+
+func (c *Worker) readCommand(args []string) (common.Command, error) {
+	cmd, data, err := resp.ParseCommand(args)
 
 	return common.Command{
 		CMD:       cmd,
 		ClientID:  c.ID,
 		Arguments: data,
+		Args:      args,
 	}, err
 }
 
+// Read runs the reading loop and the writing loop of the connection until the client disconnects
+// or the server closes the quit channel
 func (c *Worker) Read(wg *sync.WaitGroup) {
+	out := make(chan string)
+	raw := make(chan []byte)
+	written := make(chan []byte)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c.writeLoop(out, raw, written, done)
+	}()
 	defer func() {
-		err := c.conn.Close()
-		if err != nil {
-			log.Printf("ERR trying to close the connection %v", err)
-		}
+		close(done)
+		<-stopped
+		_ = c.conn.Close()
 
 		c.request <- common.Command{
 			CMD:       common.CLIENT,
@@ -127,5 +284,5 @@ func (c *Worker) Read(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	c.receiveCommandsLoop()
+	c.receiveCommandsLoop(out, raw, written)
 }
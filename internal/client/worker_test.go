@@ -1,8 +1,13 @@
 package client
 
 import (
+	"bufio"
 	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -11,11 +16,121 @@ func TestNewWorker(t *testing.T) {
 	quit := make(<-chan bool)
 	request := make(chan<- common.Command)
 	response := make(<-chan string)
-	worker, err := NewWorker(conn, 123, request, response, common.FrozenInTime, quit)
+	push := make(<-chan string)
+	execute := func(cmd common.Command) (string, bool) { return "", false }
+	executeRaw := func(args [][]byte, out []byte) ([]byte, bool) { return out, false }
+	worker, err := NewWorker(conn, 123, request, response, push, execute, executeRaw, common.FrozenInTime, quit)
 	common.ExpectNoError(t, err)
 	common.AssertEquals(t, worker.ID, uint(123))
 	common.AssertEquals(t, worker.quit, quit)
 	common.AssertEquals(t, worker.request, request)
 	common.AssertEquals(t, worker.response, response)
+	common.AssertEquals(t, worker.push, push)
+	if _, executed := worker.execute(common.Command{}); executed {
+		t.Errorf("want the command sent to the server")
+	}
+	if _, executed := worker.executeRaw(nil, nil); executed {
+		t.Errorf("want the command parsed")
+	}
 	common.AssertEquals(t, worker.now().String(), common.FrozenInTime().String())
 }
+
+// TestWorkerPipeline pipelines commands executed from their raw arguments and commands sent to the
+// server, the replies keep the order of the commands
+func TestWorkerPipeline(t *testing.T) {
+	server, client := net.Pipe()
+	request := make(chan common.Command)
+	response := make(chan string)
+	quit := make(chan bool)
+	execute := func(cmd common.Command) (string, bool) { return "", false }
+	executeRaw := func(args [][]byte, out []byte) ([]byte, bool) {
+		if string(args[0]) != "GET" {
+			return out, false
+		}
+		return append(append(append(out, '+'), args[1]...), "\r\n"...), true
+	}
+	worker, err := NewWorker(server, 1, request, response, make(chan string), execute, executeRaw, common.FrozenInTime, quit)
+	common.ExpectNoError(t, err)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go worker.Read(&wg)
+	go func() {
+		for cmd := range request {
+			if cmd.CMD == common.CLIENT {
+				continue
+			}
+			response <- "+" + cmd.Args[1] + "\r\n"
+		}
+	}()
+
+	// a value larger than the input buffer makes it grow
+	large := string(make([]byte, 3*readBufferSize))
+	go func() {
+		_, _ = io.WriteString(client, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$4\r\nECHO\r\n$1\r\nb\r\n"+
+			"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n*2\r\n$3\r\nGET\r\n$1\r\nd\r\n"+
+			"*2\r\n$4\r\nECHO\r\n$12288\r\n"+large+"\r\n*2\r\n$3\r\nGET\r\n$1\r\ne\r\n")
+	}()
+	reader := bufio.NewReader(client)
+	for _, want := range []string{"+a\r\n", "+b\r\n", "+c\r\n", "+d\r\n", "+" + large + "\r\n", "+e\r\n"} {
+		got, err := reader.ReadString('\n')
+		common.ExpectNoError(t, err)
+		if got != want {
+			t.Fatalf("reply %q, want %q", got, want)
+		}
+	}
+
+	close(quit)
+	wg.Wait()
+	close(request)
+	_ = client.Close()
+}
+
+// TestWorkerProtocolError pipelines commands executed from their raw arguments before a malformed
+// command, their replies are written before the connection is closed
+func TestWorkerProtocolError(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		invalid string
+		want    []string
+	}{
+		{name: "malformed", invalid: "*1\r\nPING\r\n", want: []string{"+OK\r\n", "+v\r\n"}},
+		{name: "too big inline", invalid: "*" + strings.Repeat("1", resp.MaxInlineLen+1),
+			want: []string{"+OK\r\n", "+v\r\n", resp.Error(resp.ErrTooBigInline)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			request := make(chan common.Command, 1)
+			quit := make(chan bool)
+			execute := func(cmd common.Command) (string, bool) { return "", false }
+			executeRaw := func(args [][]byte, out []byte) ([]byte, bool) {
+				switch string(args[0]) {
+				case "SET":
+					return append(out, "+OK\r\n"...), true
+				case "GET":
+					return append(out, "+v\r\n"...), true
+				}
+				return out, false
+			}
+			worker, err := NewWorker(server, 1, request, make(chan string), make(chan string), execute, executeRaw, common.FrozenInTime, quit)
+			common.ExpectNoError(t, err)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go worker.Read(&wg)
+
+			go func() {
+				_, _ = io.WriteString(client, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"+tt.invalid)
+			}()
+			reader := bufio.NewReader(client)
+			for _, want := range tt.want {
+				got, err := reader.ReadString('\n')
+				common.ExpectNoError(t, err)
+				common.AssertEquals(t, got, want)
+			}
+			_, err = reader.ReadByte()
+			common.AssertEquals(t, err, io.EOF)
+			wg.Wait()
+			common.AssertEquals(t, (<-request).CMD, common.CLIENT)
+			_ = client.Close()
+		})
+	}
+}
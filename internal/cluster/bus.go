@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/frame"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"math/rand"
+)
+
+// MessageType is the type of the messages exchanged by the nodes on the cluster bus
+type MessageType uint8
+
+const (
+	// MsgPing is sent periodically to every node, it is answered with MsgPong. MsgMeet is a ping
+	// that makes the receiver add the sender to its nodes.
+	MsgPing MessageType = iota
+	MsgPong
+	MsgMeet
+	// MsgFail tells every node that FailID is failing
+	MsgFail
+	// MsgAuthRequest is sent by a replica to the masters asking their vote to replace its master,
+	// they answer with MsgAuthAck when they vote for it
+	MsgAuthRequest
+	MsgAuthAck
+	// MsgMFStart is sent by a replica to its master to start a manual failover
+	MsgMFStart
+	// MsgPublish carries a message published on the sender to the subscribers of the receiver
+	MsgPublish
+)
+
+var messageTypeNames = []string{"ping", "pong", "meet", "fail", "auth-req", "auth-ack", "mfstart", "publish"}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// MessageFlags qualify a message
+type MessageFlags uint8
+
+const (
+	// MsgFlagForceAck asks the masters to vote for the replica even if its master is not failing
+	MsgFlagForceAck MessageFlags = 1 << iota
+	// MsgFlagPaused is set by a master that paused its clients for a manual failover
+	MsgFlagPaused
+)
+
+// Slots is a bitmap of hash slots
+type Slots [common.NumSlots / 8]byte
+
+// Set adds slot to the bitmap
+func (s *Slots) Set(slot int) {
+	s[slot/8] |= 1 << (slot % 8)
+}
+
+// Has returns true when slot is in the bitmap
+func (s *Slots) Has(slot int) bool {
+	return s[slot/8]&(1<<(slot%8)) != 0
+}
+
+// Gossip is what the sender of a message knows about another node
+type Gossip struct {
+	ID           string
+	Host         string
+	Port         int
+	BusPort      int
+	Flags        Flags
+	PingSent     int64
+	PongReceived int64
+}
+
+// Message is a message of the cluster bus. Every message describes its sender: its address, its
+// role, its epochs and the slots it serves, for replicas the slots of their master.
+type Message struct {
+	Type   MessageType
+	Sender string
+	// Host is empty when the receiver must use the address of the connection
+	Host     string
+	Port     int
+	BusPort  int
+	Flags    Flags
+	MasterID string
+	// CurrentEpoch & ConfigEpoch are the epochs of the sender, ConfigEpoch is the epoch of the
+	// master for replicas
+	CurrentEpoch uint64
+	ConfigEpoch  uint64
+	ReplOffset   int64
+	MFlags       MessageFlags
+	Slots        Slots
+	// Gossip is sent with pings and pongs
+	Gossip []Gossip
+	// FailID is the node failing of MsgFail
+	FailID string
+	// Channel & Payload are the message of MsgPublish
+	Channel string
+	Payload string
+}
+
+// NewMessage returns a message of type t describing Myself
+func (s *State) NewMessage(t MessageType) *Message {
+	myself := s.Myself
+	m := &Message{
+		Type:         t,
+		Sender:       myself.ID,
+		Port:         myself.Port,
+		BusPort:      myself.BusPort,
+		Flags:        myself.Flags &^ FlagMyself,
+		MasterID:     myself.MasterID,
+		CurrentEpoch: s.CurrentEpoch,
+		ConfigEpoch:  myself.ConfigEpoch,
+		Slots:        s.SlotsOf(myself),
+	}
+	if master, ok := s.Nodes[myself.MasterID]; ok {
+		m.ConfigEpoch = master.ConfigEpoch
+		m.Slots = s.SlotsOf(master)
+	}
+	return m
+}
+
+// GossipFor returns what to tell to the node to about count random nodes, and about every node
+// flagged PFAIL so the masters learn about failures quickly
+func (s *State) GossipFor(to *Node, count int) []Gossip {
+	candidates := make([]*Node, 0, len(s.Nodes))
+	for _, n := range s.sortedNodes() {
+		if n != s.Myself && n != to && n.Flags&(FlagHandshake|FlagNoAddr) == 0 {
+			candidates = append(candidates, n)
+		}
+	}
+	gossip := make([]Gossip, 0, count)
+	picked := make(map[*Node]bool, count)
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(gossip) == count {
+			break
+		}
+		gossip = append(gossip, gossipAbout(candidates[i]))
+		picked[candidates[i]] = true
+	}
+	for _, n := range candidates {
+		if !picked[n] && n.Flags&FlagPFail != 0 {
+			gossip = append(gossip, gossipAbout(n))
+		}
+	}
+	return gossip
+}
+
+func gossipAbout(n *Node) Gossip {
+	return Gossip{
+		ID:           n.ID,
+		Host:         n.Host,
+		Port:         n.Port,
+		BusPort:      n.BusPort,
+		Flags:        n.Flags &^ FlagMyself,
+		PingSent:     n.PingSent,
+		PongReceived: n.PongReceived,
+	}
+}
+
+// messageFormat frames the messages, their size is bounded by the gossip and by the channel & the
+// payload of MsgPublish
+var messageFormat = frame.Format{
+	Signature: "RCmb",
+	MaxSize:   1<<20 + 2*resp.MaxBulkLen,
+	Err:       errInvalidMessage,
+}
+
+var errInvalidMessage = errors.New("invalid cluster bus message")
+
+// WriteMessage writes m to w, prefixed by a signature and its length
+func WriteMessage(w io.Writer, m *Message) error {
+	e := messageFormat.NewEncoder(128 + len(m.Slots) + 64*len(m.Gossip) + len(m.Channel) + len(m.Payload))
+	e.Uint8(uint8(m.Type))
+	e.String(m.Sender)
+	e.String(m.Host)
+	e.Uint16(uint16(m.Port))
+	e.Uint16(uint16(m.BusPort))
+	e.Uint16(uint16(m.Flags))
+	e.String(m.MasterID)
+	e.Uint64(m.CurrentEpoch)
+	e.Uint64(m.ConfigEpoch)
+	e.Uint64(uint64(m.ReplOffset))
+	e.Uint8(uint8(m.MFlags))
+	e.Raw(m.Slots[:])
+	e.String(m.FailID)
+	e.Uint16(uint16(len(m.Gossip)))
+	for _, g := range m.Gossip {
+		e.String(g.ID)
+		e.String(g.Host)
+		e.Uint16(uint16(g.Port))
+		e.Uint16(uint16(g.BusPort))
+		e.Uint16(uint16(g.Flags))
+		e.Uint64(uint64(g.PingSent))
+		e.Uint64(uint64(g.PongReceived))
+	}
+	if m.Type == MsgPublish {
+		e.Bytes([]byte(m.Channel))
+		e.Bytes([]byte(m.Payload))
+	}
+	return messageFormat.Write(w, e)
+}
+
+// ReadMessage reads a message written by WriteMessage
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	d, err := messageFormat.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	m.Type = MessageType(d.Uint8())
+	m.Sender = d.String()
+	m.Host = d.String()
+	m.Port = int(d.Uint16())
+	m.BusPort = int(d.Uint16())
+	m.Flags = Flags(d.Uint16())
+	m.MasterID = d.String()
+	m.CurrentEpoch = d.Uint64()
+	m.ConfigEpoch = d.Uint64()
+	m.ReplOffset = int64(d.Uint64())
+	m.MFlags = MessageFlags(d.Uint8())
+	copy(m.Slots[:], d.Raw(len(m.Slots)))
+	m.FailID = d.String()
+	if n := int(d.Uint16()); n > 0 {
+		m.Gossip = make([]Gossip, 0, n)
+		for i := 0; i < n && d.Err() == nil; i++ {
+			g := Gossip{}
+			g.ID = d.String()
+			g.Host = d.String()
+			g.Port = int(d.Uint16())
+			g.BusPort = int(d.Uint16())
+			g.Flags = Flags(d.Uint16())
+			g.PingSent = int64(d.Uint64())
+			g.PongReceived = int64(d.Uint64())
+			m.Gossip = append(m.Gossip, g)
+		}
+	}
+	if m.Type == MsgPublish {
+		m.Channel = string(d.Bytes())
+		m.Payload = string(d.Bytes())
+	}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
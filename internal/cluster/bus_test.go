@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	config := idA + " 127.0.0.1:7000@17000 myself,slave " + idB + " 0 0 0 connected\n" +
+		idB + " 127.0.0.1:7001@17001 master - 0 0 3 connected 0-99 16383\n" +
+		idC + " 127.0.0.1:7002@17002 master,fail? - 1700000000000 0 2 connected 100-16382\n" +
+		"vars currentEpoch 5 lastVoteEpoch 0\n"
+	s, err := Parse(strings.NewReader(config))
+	common.ExpectNoError(t, err)
+
+	m := s.NewMessage(MsgPing)
+	// replicas advertise the slots & the config epoch of their master
+	common.AssertEquals(t, m.Flags, FlagReplica)
+	common.AssertEquals(t, m.MasterID, idB)
+	common.AssertEquals(t, m.ConfigEpoch, uint64(3))
+	common.AssertEquals(t, m.CurrentEpoch, uint64(5))
+	common.AssertEquals(t, m.Slots.Has(99), true)
+	common.AssertEquals(t, m.Slots.Has(100), false)
+	common.AssertEquals(t, m.Slots.Has(16383), true)
+	// the node flagged PFAIL is always gossiped about
+	m.Gossip = s.GossipFor(s.Nodes[idB], 0)
+	common.AssertEquals(t, len(m.Gossip), 1)
+	common.AssertEquals(t, m.Gossip[0].ID, idC)
+	common.AssertEquals(t, m.Gossip[0].Flags, FlagMaster|FlagPFail)
+	m.ReplOffset = 42
+	m.MFlags = MsgFlagForceAck
+
+	var buf bytes.Buffer
+	common.ExpectNoError(t, WriteMessage(&buf, m))
+	common.ExpectNoError(t, WriteMessage(&buf, &Message{Type: MsgFail, Sender: idB, FailID: idC}))
+	common.ExpectNoError(t, WriteMessage(&buf, &Message{Type: MsgPublish, Sender: idB, Channel: "news", Payload: "hello"}))
+	r := bufio.NewReader(&buf)
+	read, err := ReadMessage(r)
+	common.ExpectNoError(t, err)
+	if !reflect.DeepEqual(read, m) {
+		t.Errorf("want %+v, got %+v", m, read)
+	}
+	read, err = ReadMessage(r)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, read.Type, MsgFail)
+	common.AssertEquals(t, read.FailID, idC)
+	read, err = ReadMessage(r)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, read.Channel, "news")
+	common.AssertEquals(t, read.Payload, "hello")
+	_, err = ReadMessage(r)
+	common.AssertEquals(t, err, io.EOF)
+}
+
+func TestReadInvalidMessage(t *testing.T) {
+	var buf bytes.Buffer
+	common.ExpectNoError(t, WriteMessage(&buf, &Message{Type: MsgPong, Sender: idA}))
+	valid := buf.Bytes()
+
+	_, err := ReadMessage(bufio.NewReader(bytes.NewReader(append([]byte("XXXX"), valid[4:]...))))
+	if !errors.Is(err, errInvalidMessage) {
+		t.Errorf("want errInvalidMessage for a bad signature, got %v", err)
+	}
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(valid[:len(valid)-1])))
+	common.AssertEquals(t, err, io.ErrUnexpectedEOF)
+	// a length shorter than the fields
+	short := append([]byte{}, valid...)
+	short[7] = 20
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(short)))
+	if !errors.Is(err, errInvalidMessage) {
+		t.Errorf("want errInvalidMessage for a truncated message, got %v", err)
+	}
+}
+
+func TestFailureReports(t *testing.T) {
+	n := &Node{ID: idA}
+	n.AddFailureReport(idB, 1000)
+	n.AddFailureReport(idC, 1500)
+	common.AssertEquals(t, n.FailureReports(2000, 1000), 2)
+	// the report of B expires, C reports again
+	n.AddFailureReport(idC, 2400)
+	common.AssertEquals(t, n.FailureReports(2400, 1000), 1)
+	n.RemoveFailureReport(idC)
+	common.AssertEquals(t, n.FailureReports(2400, 1000), 0)
+}
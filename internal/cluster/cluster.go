@@ -0,0 +1,351 @@
+// Package cluster keeps the configuration of a redis cluster: the nodes, the hash slots served
+// by every master and the epochs. The configuration is saved in the nodes.conf format of redis.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flags are the roles and states of a node, listed in CLUSTER NODES and nodes.conf
+type Flags uint16
+
+const (
+	FlagMyself Flags = 1 << iota
+	FlagMaster
+	FlagReplica
+	// FlagPFail is set when a node does not reply to this node, FlagFail once the majority of the
+	// masters agree
+	FlagPFail
+	FlagFail
+	FlagHandshake
+	FlagNoAddr
+	FlagNoFailover
+)
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagMyself, "myself"},
+	{FlagMaster, "master"},
+	{FlagReplica, "slave"},
+	{FlagPFail, "fail?"},
+	{FlagFail, "fail"},
+	{FlagHandshake, "handshake"},
+	{FlagNoAddr, "noaddr"},
+	{FlagNoFailover, "nofailover"},
+}
+
+func (f Flags) String() string {
+	names := make([]string, 0, len(flagNames))
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+// Node is a member of the cluster
+type Node struct {
+	// ID is 40 random hex characters, it never changes
+	ID      string
+	Host    string
+	Port    int
+	BusPort int
+	Flags   Flags
+	// MasterID is the ID of the master of a replica, empty for masters
+	MasterID string
+	// PingSent is the unix time in milliseconds of the ping waiting for a pong, 0 when none is.
+	// PongReceived is the unix time in milliseconds of the last pong.
+	PingSent     int64
+	PongReceived int64
+	// ConfigEpoch versions the slots claimed by a master, the highest epoch wins a conflict
+	ConfigEpoch uint64
+	Connected   bool
+	// FailTime is the unix time in milliseconds the node was flagged FAIL
+	FailTime int64
+	// VotedTime is the unix time in milliseconds of the last failover vote for a replica of this
+	// master
+	VotedTime int64
+	// ReplOffset is the replication offset of the node in its last message
+	ReplOffset int64
+
+	// failReports maps the masters reporting the node as failing to the time of their last report
+	failReports map[string]int64
+}
+
+// Addr returns the address of the clients port
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// IsMaster returns true unless the node is a replica
+func (n *Node) IsMaster() bool {
+	return n.Flags&FlagReplica == 0
+}
+
+// AddFailureReport records that the master reporter sees n failing
+func (n *Node) AddFailureReport(reporter string, now int64) {
+	if n.failReports == nil {
+		n.failReports = make(map[string]int64)
+	}
+	n.failReports[reporter] = now
+}
+
+// RemoveFailureReport forgets the report of reporter, it sees n working again
+func (n *Node) RemoveFailureReport(reporter string) {
+	delete(n.failReports, reporter)
+}
+
+// FailureReports returns the number of reports younger than validity milliseconds, the older
+// reports are removed
+func (n *Node) FailureReports(now int64, validity int64) int {
+	for reporter, reported := range n.failReports {
+		if now-reported > validity {
+			delete(n.failReports, reporter)
+		}
+	}
+	return len(n.failReports)
+}
+
+// NewNodeID returns a random node ID
+func NewNodeID() string {
+	var id [20]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// SlotRange is an interval of hash slots, End included
+type SlotRange struct {
+	Start int
+	End   int
+}
+
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return strconv.Itoa(r.Start) + "-" + strconv.Itoa(r.End)
+}
+
+// State is the configuration of the cluster as seen by the node Myself
+type State struct {
+	Myself *Node
+	Nodes  map[string]*Node
+	// CurrentEpoch is the highest epoch seen, LastVoteEpoch the epoch of the last failover vote
+	CurrentEpoch  uint64
+	LastVoteEpoch uint64
+
+	// owners maps every slot to the master serving it, nil when unassigned
+	owners [common.NumSlots]*Node
+	// migrating & importing map the slots moving from Myself to another node and to Myself from
+	// another node
+	migrating map[int]*Node
+	importing map[int]*Node
+}
+
+// New returns the configuration of a cluster of a single master without slots
+func New(myself *Node) *State {
+	myself.Flags |= FlagMyself
+	if myself.MasterID == "" {
+		myself.Flags |= FlagMaster
+	}
+	myself.Connected = true
+	s := &State{
+		Myself:    myself,
+		Nodes:     make(map[string]*Node),
+		migrating: make(map[int]*Node),
+		importing: make(map[int]*Node),
+	}
+	s.Nodes[myself.ID] = myself
+	return s
+}
+
+// AddNode adds n, or replaces the node with its ID
+func (s *State) AddNode(n *Node) {
+	s.Nodes[n.ID] = n
+}
+
+// RemoveNode removes n, its slots are unassigned and the failure reports it sent are forgotten
+func (s *State) RemoveNode(n *Node) {
+	s.DelNodeSlots(n)
+	for _, other := range s.Nodes {
+		other.RemoveFailureReport(n.ID)
+	}
+	delete(s.Nodes, n.ID)
+}
+
+// DelNodeSlots unassigns the slots of n and returns how many it had
+func (s *State) DelNodeSlots(n *Node) int {
+	deleted := 0
+	for slot, owner := range s.owners {
+		if owner == n {
+			s.owners[slot] = nil
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// SlotsOf returns the slots served by n as a bitmap
+func (s *State) SlotsOf(n *Node) Slots {
+	var slots Slots
+	for slot, owner := range s.owners {
+		if owner == n {
+			slots.Set(slot)
+		}
+	}
+	return slots
+}
+
+// CountSlots returns the number of slots served by n
+func (s *State) CountSlots(n *Node) int {
+	count := 0
+	for _, owner := range s.owners {
+		if owner == n {
+			count++
+		}
+	}
+	return count
+}
+
+// Size returns the number of masters serving slots, a majority of them is needed to flag a node
+// as failing or to elect a replica
+func (s *State) Size() int {
+	size := 0
+	for _, n := range s.Nodes {
+		if n.IsMaster() && s.CountSlots(n) > 0 {
+			size++
+		}
+	}
+	return size
+}
+
+// Owner returns the master serving slot, nil when the slot is unassigned
+func (s *State) Owner(slot int) *Node {
+	return s.owners[slot]
+}
+
+// SetOwner assigns slot to the master n, a nil n unassigns it
+func (s *State) SetOwner(slot int, n *Node) {
+	s.owners[slot] = n
+}
+
+// Migrating returns the node slot is moving to, nil when it is not
+func (s *State) Migrating(slot int) *Node {
+	return s.migrating[slot]
+}
+
+// Importing returns the node slot is moving from, nil when it is not
+func (s *State) Importing(slot int) *Node {
+	return s.importing[slot]
+}
+
+// SetMigrating marks slot as moving to n, a nil n clears it
+func (s *State) SetMigrating(slot int, n *Node) {
+	if n == nil {
+		delete(s.migrating, slot)
+		return
+	}
+	s.migrating[slot] = n
+}
+
+// SetImporting marks slot as moving from n, a nil n clears it
+func (s *State) SetImporting(slot int, n *Node) {
+	if n == nil {
+		delete(s.importing, slot)
+		return
+	}
+	s.importing[slot] = n
+}
+
+// Serves returns true when Myself serves slot, or is a replica of its master
+func (s *State) Serves(slot int) bool {
+	owner := s.owners[slot]
+	return owner != nil && (owner == s.Myself || owner.ID == s.Myself.MasterID)
+}
+
+// Covered returns true when every slot is assigned
+func (s *State) Covered() bool {
+	for _, owner := range s.owners {
+		if owner == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// AssignedSlots returns the number of slots assigned
+func (s *State) AssignedSlots() int {
+	assigned := 0
+	for _, owner := range s.owners {
+		if owner != nil {
+			assigned++
+		}
+	}
+	return assigned
+}
+
+// SlotRanges returns the slots served by n as ranges
+func (s *State) SlotRanges(n *Node) []SlotRange {
+	var ranges []SlotRange
+	for slot, owner := range s.owners {
+		if owner != n {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == slot-1 {
+			ranges[last].End = slot
+			continue
+		}
+		ranges = append(ranges, SlotRange{Start: slot, End: slot})
+	}
+	return ranges
+}
+
+// Replicas returns the replicas of master sorted by ID
+func (s *State) Replicas(master *Node) []*Node {
+	var replicas []*Node
+	for _, n := range s.Nodes {
+		if n.MasterID == master.ID {
+			replicas = append(replicas, n)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].ID < replicas[j].ID })
+	return replicas
+}
+
+// Masters returns the masters sorted by ID
+func (s *State) Masters() []*Node {
+	var masters []*Node
+	for _, n := range s.Nodes {
+		if n.IsMaster() {
+			masters = append(masters, n)
+		}
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].ID < masters[j].ID })
+	return masters
+}
+
+// sortedNodes returns Myself followed by the rest of the nodes sorted by ID
+func (s *State) sortedNodes() []*Node {
+	nodes := make([]*Node, 0, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if n != s.Myself {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return append([]*Node{s.Myself}, nodes...)
+}
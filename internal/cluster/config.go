@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NodeLine returns the line of n in CLUSTER NODES and nodes.conf:
+//
+//	<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+//
+// The slots moving from or to Myself are listed in its line as [slot->-id] and [slot-<-id].
+func (s *State) NodeLine(n *Node) string {
+	var sb strings.Builder
+	master := n.MasterID
+	if master == "" {
+		master = "-"
+	}
+	link := "connected"
+	if !n.Connected {
+		link = "disconnected"
+	}
+	sb.WriteString(fmt.Sprintf("%s %s@%d %s %s %d %d %d %s", n.ID, n.Addr(), n.BusPort, n.Flags, master,
+		n.PingSent, n.PongReceived, n.ConfigEpoch, link))
+	for _, r := range s.SlotRanges(n) {
+		sb.WriteString(" ")
+		sb.WriteString(r.String())
+	}
+	if n == s.Myself {
+		for slot := 0; slot < common.NumSlots; slot++ {
+			if to := s.migrating[slot]; to != nil {
+				sb.WriteString(fmt.Sprintf(" [%d->-%s]", slot, to.ID))
+			}
+			if from := s.importing[slot]; from != nil {
+				sb.WriteString(fmt.Sprintf(" [%d-<-%s]", slot, from.ID))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// NodesText returns the CLUSTER NODES text, a line per node
+func (s *State) NodesText() string {
+	var sb strings.Builder
+	for _, n := range s.sortedNodes() {
+		sb.WriteString(s.NodeLine(n))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Write writes the configuration in the nodes.conf format, without the nodes in handshake
+func (s *State) Write(w io.Writer) error {
+	for _, n := range s.sortedNodes() {
+		if n.Flags&FlagHandshake != 0 {
+			continue
+		}
+		if _, err := io.WriteString(w, s.NodeLine(n)+"\n"); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "vars currentEpoch %d lastVoteEpoch %d\n", s.CurrentEpoch, s.LastVoteEpoch)
+	return err
+}
+
+// Save replaces the configuration file at path, the file is written to a temporary file renamed
+// once complete
+func (s *State) Save(path string) (err error) {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(path)))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = s.Write(w); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads the configuration file at path
+func Load(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse reads a configuration in the nodes.conf format, it must have a node flagged myself
+func Parse(r io.Reader) (*State, error) {
+	s := &State{Nodes: make(map[string]*Node), migrating: make(map[int]*Node), importing: make(map[int]*Node)}
+	// the migrating & importing slots are resolved once every node is known
+	var movingSlots []movingSlot
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			if err := s.parseVars(fields[1:]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("line %d: want at least 8 fields, got %d", line, len(fields))
+		}
+		n, err := parseNode(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if n.Flags&FlagMyself != 0 {
+			if s.Myself != nil {
+				return nil, fmt.Errorf("line %d: more than one node flagged myself", line)
+			}
+			s.Myself = n
+		}
+		s.Nodes[n.ID] = n
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				m, err := parseMovingSlot(field)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				movingSlots = append(movingSlots, m)
+				continue
+			}
+			r, err := parseSlotRange(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			for slot := r.Start; slot <= r.End; slot++ {
+				s.owners[slot] = n
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.Myself == nil {
+		return nil, errors.New("no node flagged myself")
+	}
+	for _, m := range movingSlots {
+		n, ok := s.Nodes[m.id]
+		if !ok {
+			return nil, fmt.Errorf("slot %d moving to unknown node %s", m.slot, m.id)
+		}
+		if m.importing {
+			s.importing[m.slot] = n
+		} else {
+			s.migrating[m.slot] = n
+		}
+	}
+	return s, nil
+}
+
+func (s *State) parseVars(fields []string) error {
+	if len(fields)%2 != 0 {
+		return errors.New("vars must be name & value pairs")
+	}
+	for i := 0; i < len(fields); i += 2 {
+		value, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", fields[i], fields[i+1])
+		}
+		switch fields[i] {
+		case "currentEpoch":
+			s.CurrentEpoch = value
+		case "lastVoteEpoch":
+			s.LastVoteEpoch = value
+		}
+	}
+	return nil
+}
+
+func parseNode(fields []string) (*Node, error) {
+	n := &Node{ID: fields[0], Connected: fields[7] == "connected"}
+	if len(n.ID) != 40 {
+		return nil, fmt.Errorf("invalid node ID %q", n.ID)
+	}
+	addr := fields[1]
+	if i := strings.IndexByte(addr, ','); i >= 0 {
+		// the hostname is not used
+		addr = addr[:i]
+	}
+	at := strings.LastIndexByte(addr, '@')
+	colon := strings.LastIndexByte(addr, ':')
+	if at < 0 || colon < 0 || colon > at {
+		return nil, fmt.Errorf("invalid address %q", fields[1])
+	}
+	var err error
+	n.Host = strings.Trim(addr[:colon], "[]")
+	if n.Port, err = strconv.Atoi(addr[colon+1 : at]); err != nil {
+		return nil, fmt.Errorf("invalid address %q", fields[1])
+	}
+	if n.BusPort, err = strconv.Atoi(addr[at+1:]); err != nil {
+		return nil, fmt.Errorf("invalid address %q", fields[1])
+	}
+	for _, name := range strings.Split(fields[2], ",") {
+		found := name == "noflags"
+		for _, fn := range flagNames {
+			if fn.name == name {
+				n.Flags |= fn.flag
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	if fields[3] != "-" {
+		n.MasterID = fields[3]
+	}
+	if n.PingSent, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid ping-sent %q", fields[4])
+	}
+	if n.PongReceived, err = strconv.ParseInt(fields[5], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid pong-recv %q", fields[5])
+	}
+	if n.ConfigEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid config-epoch %q", fields[6])
+	}
+	return n, nil
+}
+
+// parseSlotRange parses a slot, like 42, or a range, like 0-5460
+func parseSlotRange(field string) (SlotRange, error) {
+	start, end := field, field
+	if i := strings.IndexByte(field, '-'); i >= 0 {
+		start, end = field[:i], field[i+1:]
+	}
+	r := SlotRange{}
+	var err1, err2 error
+	r.Start, err1 = strconv.Atoi(start)
+	r.End, err2 = strconv.Atoi(end)
+	if err1 != nil || err2 != nil || r.Start < 0 || r.End >= common.NumSlots || r.Start > r.End {
+		return r, fmt.Errorf("invalid slot range %q", field)
+	}
+	return r, nil
+}
+
+// movingSlot is a slot migrating to or importing from the node id
+type movingSlot struct {
+	slot      int
+	id        string
+	importing bool
+}
+
+// parseMovingSlot parses [slot->-id] and [slot-<-id]
+func parseMovingSlot(field string) (m movingSlot, err error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")
+	sep := "->-"
+	if strings.Contains(inner, "-<-") {
+		sep, m.importing = "-<-", true
+	}
+	parts := strings.SplitN(inner, sep, 2)
+	if len(parts) != 2 {
+		return m, fmt.Errorf("invalid moving slot %q", field)
+	}
+	m.id = parts[1]
+	if m.slot, err = strconv.Atoi(parts[0]); err != nil || m.slot < 0 || m.slot >= common.NumSlots {
+		return m, fmt.Errorf("invalid moving slot %q", field)
+	}
+	return m, nil
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	idA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	idB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	idC = "cccccccccccccccccccccccccccccccccccccccc"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	config := idA + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-8191 [8192-<-" + idB + "]\n" +
+		idB + " 127.0.0.1:7001@17001 master - 0 1700000000000 2 connected 8192-16383\n" +
+		idC + " 127.0.0.1:7002@17002 slave " + idA + " 0 1700000000000 1 disconnected\n" +
+		"vars currentEpoch 2 lastVoteEpoch 1\n"
+
+	s, err := Parse(strings.NewReader(config))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, s.Myself.ID, idA)
+	common.AssertEquals(t, s.Owner(0), s.Myself)
+	common.AssertEquals(t, s.Owner(16383).ID, idB)
+	common.AssertEquals(t, s.Importing(8192).ID, idB)
+	common.AssertEquals(t, s.Nodes[idC].MasterID, idA)
+	common.AssertEquals(t, s.Nodes[idC].Connected, false)
+	common.AssertEquals(t, s.CurrentEpoch, uint64(2))
+	common.AssertEquals(t, s.Covered(), true)
+	common.AssertEquals(t, s.Serves(100), true)
+	common.AssertEquals(t, s.Serves(9000), false)
+
+	path := filepath.Join(t.TempDir(), "nodes.conf")
+	common.ExpectNoError(t, s.Save(path))
+	loaded, err := Load(path)
+	common.ExpectNoError(t, err)
+	var sb strings.Builder
+	common.ExpectNoError(t, loaded.Write(&sb))
+	common.AssertEquals(t, sb.String(), config)
+}
+
+func TestConfigErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"no myself":      idA + " 127.0.0.1:7000@17000 master - 0 0 1 connected 0-100\n",
+		"two myself":     idA + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected\n" + idB + " 127.0.0.1:7001@17001 myself,master - 0 0 1 connected\n",
+		"bad range":      idA + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 100-16384\n",
+		"bad address":    idA + " 127.0.0.1@17000 myself,master - 0 0 1 connected\n",
+		"unknown flag":   idA + " 127.0.0.1:7000@17000 myself,boss - 0 0 1 connected\n",
+		"unknown moving": idA + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected [5->-" + idB + "]\n",
+	} {
+		if _, err := Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	s := New(&Node{ID: idA, Host: "127.0.0.1", Port: 7000, BusPort: 17000})
+	for _, slot := range []int{0, 1, 2, 5, 16383} {
+		s.SetOwner(slot, s.Myself)
+	}
+	var ranges []string
+	for _, r := range s.SlotRanges(s.Myself) {
+		ranges = append(ranges, r.String())
+	}
+	common.AssertEquals(t, strings.Join(ranges, " "), "0-2 5 16383")
+	common.AssertEquals(t, s.AssignedSlots(), 5)
+	common.AssertEquals(t, s.Covered(), false)
+}
@@ -1,6 +1,9 @@
 package common
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // CommandID command id type
 type CommandID int
@@ -24,8 +27,157 @@ const (
 	//  https://redis.io/commands/client-info
 	//  https://redis.io/commands/client-id
 	CLIENT
+	// MULTI https://redis.io/commands/multi
+	MULTI
+	// EXEC https://redis.io/commands/exec
+	EXEC
+	// DISCARD https://redis.io/commands/discard
+	DISCARD
+	// WATCH https://redis.io/commands/watch
+	WATCH
+	// UNWATCH https://redis.io/commands/unwatch
+	UNWATCH
+	// EVAL
+	//  https://redis.io/commands/eval
+	//  https://redis.io/commands/eval_ro
+	EVAL
+	// EVALSHA
+	//  https://redis.io/commands/evalsha
+	//  https://redis.io/commands/evalsha_ro
+	EVALSHA
+	// SCRIPT
+	//  https://redis.io/commands/script-load
+	//  https://redis.io/commands/script-exists
+	//  https://redis.io/commands/script-flush
+	//  https://redis.io/commands/script-kill
+	SCRIPT
+	// FUNCTION
+	//  https://redis.io/commands/function-load
+	//  https://redis.io/commands/function-list
+	//  https://redis.io/commands/function-delete
+	//  https://redis.io/commands/function-dump
+	//  https://redis.io/commands/function-restore
+	//  https://redis.io/commands/function-flush
+	//  https://redis.io/commands/function-kill
+	FUNCTION
+	// FCALL
+	//  https://redis.io/commands/fcall
+	//  https://redis.io/commands/fcall_ro
+	FCALL
+	// PING https://redis.io/commands/ping
+	PING
+	// SUBSCRIBE https://redis.io/commands/subscribe
+	SUBSCRIBE
+	// UNSUBSCRIBE https://redis.io/commands/unsubscribe
+	UNSUBSCRIBE
+	// PSUBSCRIBE https://redis.io/commands/psubscribe
+	PSUBSCRIBE
+	// PUNSUBSCRIBE https://redis.io/commands/punsubscribe
+	PUNSUBSCRIBE
+	// PUBLISH https://redis.io/commands/publish
+	PUBLISH
+	// PUBSUB
+	//  https://redis.io/commands/pubsub-channels
+	//  https://redis.io/commands/pubsub-numsub
+	//  https://redis.io/commands/pubsub-numpat
+	//  https://redis.io/commands/pubsub-shardchannels
+	//  https://redis.io/commands/pubsub-shardnumsub
+	PUBSUB
+	// SSUBSCRIBE https://redis.io/commands/ssubscribe
+	SSUBSCRIBE
+	// SUNSUBSCRIBE https://redis.io/commands/sunsubscribe
+	SUNSUBSCRIBE
+	// SPUBLISH https://redis.io/commands/spublish
+	SPUBLISH
+	// CONFIG
+	//  https://redis.io/commands/config-get
+	//  https://redis.io/commands/config-set
+	CONFIG
+	// HELLO https://redis.io/commands/hello
+	HELLO
+	// SAVE https://redis.io/commands/save
+	SAVE
+	// BGSAVE https://redis.io/commands/bgsave
+	BGSAVE
+	// LASTSAVE https://redis.io/commands/lastsave
+	LASTSAVE
+	// BGREWRITEAOF https://redis.io/commands/bgrewriteaof
+	BGREWRITEAOF
+	// SCAN https://redis.io/commands/scan
+	SCAN
+	// REPLICAOF
+	//  https://redis.io/commands/replicaof
+	//  https://redis.io/commands/slaveof
+	REPLICAOF
+	// REPLCONF is sent by replicas to configure the replication and acknowledge the stream
+	REPLCONF
+	// PSYNC https://redis.io/commands/psync
+	PSYNC
+	// ROLE https://redis.io/commands/role
+	ROLE
+	// WAIT https://redis.io/commands/wait
+	WAIT
+	// WAITAOF https://redis.io/commands/waitaof
+	WAITAOF
+	// CLUSTER https://redis.io/commands/cluster
+	CLUSTER
+	// ASKING https://redis.io/commands/asking
+	ASKING
+	// COMMAND
+	//  https://redis.io/commands/command
+	//  https://redis.io/commands/command-count
+	COMMAND
+	// DUMP https://redis.io/commands/dump
+	DUMP
+	// RESTORE
+	//  https://redis.io/commands/restore
+	//  https://redis.io/commands/restore-asking
+	RESTORE
+	// MIGRATE https://redis.io/commands/migrate
+	MIGRATE
+	// RAFT manages the members of the raft cluster in raft mode
+	RAFT
+	// INCRBY
+	//  https://redis.io/commands/incr
+	//  https://redis.io/commands/incrby
+	//  https://redis.io/commands/decr
+	//  https://redis.io/commands/decrby
+	INCRBY
+	// CRDT merges the values sent by the peers in active-active mode
+	CRDT
+	// SENTINEL https://redis.io/docs/management/sentinel/#sentinel-commands
+	SENTINEL
 )
 
+// IsWrite returns true for the commands that modify the keyspace
+func (id CommandID) IsWrite() bool {
+	switch id {
+	case SET, DEL, RESTORE, MIGRATE, INCRBY:
+		return true
+	}
+	return false
+}
+
+// ExpectsReply returns false for the commands the server never replies to: REPLCONF ACK and
+// PSYNC, after which the server writes the replication stream to the connection
+func (cmd Command) ExpectsReply() bool {
+	if cmd.Err != nil {
+		return true
+	}
+	switch cmd.CMD {
+	case PSYNC:
+		return false
+	case CRDT:
+		// the peers stream their values without waiting for replies
+		crdtArgs, ok := cmd.Arguments.(CRDTArguments)
+		return !ok || crdtArgs.Subcommand != CrdtSubcommandMERGE
+	case REPLCONF:
+		replconfArgs, ok := cmd.Arguments.(REPLCONFArguments)
+		return !ok || len(replconfArgs.Args) == 0 || !strings.EqualFold(replconfArgs.Args[0], "ACK")
+	}
+	return true
+}
+
 type ClientSubcommand string
 
 const (
@@ -33,11 +185,127 @@ const (
 	ClientSubcommandINFO ClientSubcommand = "INFO"
 	ClientSubcommandLIST ClientSubcommand = "LIST"
 	ClientSubcommandKILL ClientSubcommand = "KILL"
+	// ClientSubcommandTRACKING, ClientSubcommandCACHING & ClientSubcommandGETREDIR control client
+	// side caching https://redis.io/docs/manual/client-side-caching/
+	ClientSubcommandTRACKING ClientSubcommand = "TRACKING"
+	ClientSubcommandCACHING  ClientSubcommand = "CACHING"
+	ClientSubcommandGETREDIR ClientSubcommand = "GETREDIR"
+)
+
+type ScriptSubcommand string
+
+const (
+	ScriptSubcommandLOAD   ScriptSubcommand = "LOAD"
+	ScriptSubcommandEXISTS ScriptSubcommand = "EXISTS"
+	ScriptSubcommandFLUSH  ScriptSubcommand = "FLUSH"
+	ScriptSubcommandKILL   ScriptSubcommand = "KILL"
+)
+
+type FunctionSubcommand string
+
+const (
+	FunctionSubcommandLOAD    FunctionSubcommand = "LOAD"
+	FunctionSubcommandLIST    FunctionSubcommand = "LIST"
+	FunctionSubcommandDELETE  FunctionSubcommand = "DELETE"
+	FunctionSubcommandDUMP    FunctionSubcommand = "DUMP"
+	FunctionSubcommandRESTORE FunctionSubcommand = "RESTORE"
+	FunctionSubcommandFLUSH   FunctionSubcommand = "FLUSH"
+	FunctionSubcommandKILL    FunctionSubcommand = "KILL"
+)
+
+type PubSubSubcommand string
+
+const (
+	PubSubSubcommandCHANNELS PubSubSubcommand = "CHANNELS"
+	PubSubSubcommandNUMSUB   PubSubSubcommand = "NUMSUB"
+	PubSubSubcommandNUMPAT   PubSubSubcommand = "NUMPAT"
+	// PubSubSubcommandSHARDCHANNELS & PubSubSubcommandSHARDNUMSUB report the sharded channels
+	PubSubSubcommandSHARDCHANNELS PubSubSubcommand = "SHARDCHANNELS"
+	PubSubSubcommandSHARDNUMSUB   PubSubSubcommand = "SHARDNUMSUB"
+)
+
+type ConfigSubcommand string
+
+const (
+	ConfigSubcommandGET ConfigSubcommand = "GET"
+	ConfigSubcommandSET ConfigSubcommand = "SET"
+)
+
+type ClusterSubcommand string
+
+const (
+	ClusterSubcommandINFO            ClusterSubcommand = "INFO"
+	ClusterSubcommandMYID            ClusterSubcommand = "MYID"
+	ClusterSubcommandNODES           ClusterSubcommand = "NODES"
+	ClusterSubcommandSLOTS           ClusterSubcommand = "SLOTS"
+	ClusterSubcommandSHARDS          ClusterSubcommand = "SHARDS"
+	ClusterSubcommandKEYSLOT         ClusterSubcommand = "KEYSLOT"
+	ClusterSubcommandCOUNTKEYSINSLOT ClusterSubcommand = "COUNTKEYSINSLOT"
+	ClusterSubcommandGETKEYSINSLOT   ClusterSubcommand = "GETKEYSINSLOT"
+	ClusterSubcommandADDSLOTS        ClusterSubcommand = "ADDSLOTS"
+	ClusterSubcommandADDSLOTSRANGE   ClusterSubcommand = "ADDSLOTSRANGE"
+	ClusterSubcommandDELSLOTS        ClusterSubcommand = "DELSLOTS"
+	ClusterSubcommandDELSLOTSRANGE   ClusterSubcommand = "DELSLOTSRANGE"
+	ClusterSubcommandSAVECONFIG      ClusterSubcommand = "SAVECONFIG"
+	// ClusterSubcommandMEET, ClusterSubcommandREPLICATE, ClusterSubcommandFAILOVER &
+	// ClusterSubcommandCOUNTFAILUREREPORTS manage the nodes connected by the cluster bus
+	ClusterSubcommandMEET                ClusterSubcommand = "MEET"
+	ClusterSubcommandREPLICATE           ClusterSubcommand = "REPLICATE"
+	ClusterSubcommandFAILOVER            ClusterSubcommand = "FAILOVER"
+	ClusterSubcommandCOUNTFAILUREREPORTS ClusterSubcommand = "COUNT-FAILURE-REPORTS"
+	// ClusterSubcommandSETSLOT opens a slot for a migration, or assigns it to its new owner
+	ClusterSubcommandSETSLOT ClusterSubcommand = "SETSLOT"
+)
+
+type RaftSubcommand string
+
+const (
+	RaftSubcommandINIT    RaftSubcommand = "INIT"
+	RaftSubcommandADD     RaftSubcommand = "ADD"
+	RaftSubcommandREMOVE  RaftSubcommand = "REMOVE"
+	RaftSubcommandINFO    RaftSubcommand = "INFO"
+	RaftSubcommandMYID    RaftSubcommand = "MYID"
+	RaftSubcommandMEMBERS RaftSubcommand = "MEMBERS"
+)
+
+type CrdtSubcommand string
+
+const (
+	CrdtSubcommandMERGE CrdtSubcommand = "MERGE"
+	CrdtSubcommandPEERS CrdtSubcommand = "PEERS"
+)
+
+type SentinelSubcommand string
+
+const (
+	SentinelSubcommandMASTERS    SentinelSubcommand = "MASTERS"
+	SentinelSubcommandMASTER     SentinelSubcommand = "MASTER"
+	SentinelSubcommandREPLICAS   SentinelSubcommand = "REPLICAS"
+	SentinelSubcommandSENTINELS  SentinelSubcommand = "SENTINELS"
+	SentinelSubcommandMYID       SentinelSubcommand = "MYID"
+	SentinelSubcommandCKQUORUM   SentinelSubcommand = "CKQUORUM"
+	SentinelSubcommandMONITOR    SentinelSubcommand = "MONITOR"
+	SentinelSubcommandREMOVE     SentinelSubcommand = "REMOVE"
+	SentinelSubcommandSET        SentinelSubcommand = "SET"
+	SentinelSubcommandFAILOVER   SentinelSubcommand = "FAILOVER"
+	SentinelSubcommandMASTERADDR SentinelSubcommand = "GET-MASTER-ADDR-BY-NAME"
+	// SentinelSubcommandISMASTERDOWN is sent by the sentinels to each other, to agree that a master
+	// is down and to elect the leader of its failover
+	SentinelSubcommandISMASTERDOWN SentinelSubcommand = "IS-MASTER-DOWN-BY-ADDR"
+)
+
+type CommandSubcommand string
+
+const (
+	// CommandSubcommandALL is COMMAND without subcommand, it lists every command
+	CommandSubcommandALL   CommandSubcommand = ""
+	CommandSubcommandCOUNT CommandSubcommand = "COUNT"
 )
 
 func (sub ClientSubcommand) IsValid() error {
 	switch sub {
-	case ClientSubcommandID, ClientSubcommandINFO, ClientSubcommandLIST, ClientSubcommandKILL:
+	case ClientSubcommandID, ClientSubcommandINFO, ClientSubcommandLIST, ClientSubcommandKILL,
+		ClientSubcommandTRACKING, ClientSubcommandCACHING, ClientSubcommandGETREDIR:
 		return nil
 	}
 	return fmt.Errorf("%s is an invalid client subcommand", sub)
@@ -49,6 +317,10 @@ type Command struct {
 	CMD       CommandID
 	ClientID  uint
 	Arguments CommandArguments
+	// Err is set when the command was recognized but its arguments are invalid
+	Err error
+	// Args are the strings of the command as sent by the client, the raft mode replicates them
+	Args []string
 }
 
 type CommandArguments interface{}
@@ -74,8 +346,219 @@ type GETArguments struct {
 
 type CLIENTArguments struct {
 	Subcommand ClientSubcommand
+	// Tracking holds the CLIENT TRACKING options
+	Tracking TrackingOptions
+	// Caching is the CLIENT CACHING yes|no argument
+	Caching bool
+}
+
+// TrackingOptions are the arguments of CLIENT TRACKING ON|OFF
+type TrackingOptions struct {
+	On bool
+	// Redirect is the ID of the client receiving the invalidation messages, 0 when not redirected
+	Redirect uint
+	// Prefixes limit the keys notified in BCAST mode
+	Prefixes []string
+	BCAST    bool
+	OptIn    bool
+	OptOut   bool
+	NoLoop   bool
 }
 
 type DELArguments struct {
 	Keys []string
 }
+
+type WATCHArguments struct {
+	Keys []string
+}
+
+type EVALArguments struct {
+	// Script is the script source for EVAL, the SHA1 digest for EVALSHA and the function name
+	// for FCALL
+	Script string
+	Keys   []string
+	Args   []string
+	// ReadOnly is set by EVAL_RO, EVALSHA_RO & FCALL_RO, the script can not call write commands
+	ReadOnly bool
+}
+
+type SCRIPTArguments struct {
+	Subcommand ScriptSubcommand
+	Args       []string
+}
+
+type FUNCTIONArguments struct {
+	Subcommand FunctionSubcommand
+	// Code is the library code for LOAD and the payload for RESTORE
+	Code string
+	// Name is the library name for DELETE
+	Name string
+	// Replace is set by LOAD REPLACE
+	Replace bool
+	// Pattern filters the libraries listed by LIST LIBRARYNAME
+	Pattern string
+	// WithCode is set by LIST WITHCODE
+	WithCode bool
+	// Policy is the RESTORE policy: FLUSH, APPEND or REPLACE
+	Policy string
+}
+
+type PINGArguments struct {
+	// Message is echoed back, it is nil when PING is called without arguments
+	Message *string
+}
+
+// SUBSCRIBEArguments are the channels of SUBSCRIBE, UNSUBSCRIBE, SSUBSCRIBE & SUNSUBSCRIBE or the
+// patterns of PSUBSCRIBE & PUNSUBSCRIBE
+type SUBSCRIBEArguments struct {
+	Channels []string
+}
+
+type PUBLISHArguments struct {
+	Channel string
+	Message string
+}
+
+type PUBSUBArguments struct {
+	Subcommand PubSubSubcommand
+	Args       []string
+}
+
+type SCANArguments struct {
+	Cursor uint64
+	// Match is the glob pattern of the keys returned, empty for every key
+	Match string
+	Count int
+	// Type filters the keys by type, empty for every type
+	Type string
+}
+
+type REPLICAOFArguments struct {
+	Host string
+	Port int
+	// NoOne is set by REPLICAOF NO ONE, the replica becomes a master
+	NoOne bool
+}
+
+type REPLCONFArguments struct {
+	// Args are option & value pairs, like listening-port 6380 or ACK 1234
+	Args []string
+}
+
+type PSYNCArguments struct {
+	// ReplID is the replication ID the replica has the stream of, "?" for a full resync
+	ReplID string
+	// Offset is the offset of the next byte of the stream the replica wants
+	Offset int64
+}
+
+type WAITArguments struct {
+	// NumLocal is the number of local fsyncs WAITAOF waits for, 0 or 1
+	NumLocal    int
+	NumReplicas int
+	// Timeout in milliseconds, 0 waits forever
+	Timeout int64
+}
+
+type CONFIGArguments struct {
+	Subcommand ConfigSubcommand
+	// Args are the parameter patterns of GET or the parameter & value pairs of SET
+	Args []string
+}
+
+type CLUSTERArguments struct {
+	Subcommand ClusterSubcommand
+	// Slots are the slots of ADDSLOTS & DELSLOTS, the RANGE variants expanded, or the slot of
+	// COUNTKEYSINSLOT, GETKEYSINSLOT & SETSLOT
+	Slots []int
+	// Key is the key of KEYSLOT
+	Key string
+	// Count is the maximum number of keys returned by GETKEYSINSLOT
+	Count int
+	// NodeID is the node of REPLICATE, COUNT-FAILURE-REPORTS & SETSLOT
+	NodeID string
+	// Host, Port & BusPort are the address of the node of MEET
+	Host    string
+	Port    int
+	BusPort int
+	// Option is FORCE or TAKEOVER for FAILOVER, empty without option, and IMPORTING, MIGRATING,
+	// NODE or STABLE for SETSLOT
+	Option string
+}
+
+type DUMPArguments struct {
+	Key string
+}
+
+type RESTOREArguments struct {
+	Key string
+	// TTL in milliseconds, 0 for keys without expiration
+	TTL     int64
+	Payload string
+	Replace bool
+	// Asking is set by RESTORE-ASKING, sent by MIGRATE to the node importing the slot of the key
+	Asking bool
+}
+
+type MIGRATEArguments struct {
+	Host string
+	Port int
+	// Keys is the key argument, or the keys of the KEYS option
+	Keys          []string
+	DestinationDB int
+	// Timeout in milliseconds of the connection & of every reply of the target
+	Timeout int64
+	Copy    bool
+	Replace bool
+	// Username is set by AUTH2, Password by AUTH & AUTH2
+	Username string
+	Password string
+}
+
+type RAFTArguments struct {
+	Subcommand RaftSubcommand
+	// NodeID is the member of ADD & REMOVE
+	NodeID string
+	// Addr is the host:port of the clients of the member of ADD
+	Addr string
+}
+
+// INCRBYArguments are the arguments of INCR, DECR, INCRBY & DECRBY, Delta is negated for the
+// decrements
+type INCRBYArguments struct {
+	Key   string
+	Delta int64
+}
+
+type CRDTArguments struct {
+	Subcommand CrdtSubcommand
+	// Key & Payload are the key and the encoded value of MERGE
+	Key     string
+	Payload string
+}
+
+type SENTINELArguments struct {
+	Subcommand SentinelSubcommand
+	// Name is the name of the master, every subcommand but MASTERS & MYID has one
+	Name string
+	// Host & Port are the address of MONITOR and IS-MASTER-DOWN-BY-ADDR
+	Host string
+	Port int
+	// Quorum is the number of sentinels of MONITOR that must agree the master is down
+	Quorum int
+	// Epoch & RunID are the current epoch and the run ID, or *, of IS-MASTER-DOWN-BY-ADDR
+	Epoch uint64
+	RunID string
+	// Options are the option value pairs of SET
+	Options []string
+}
+
+type COMMANDArguments struct {
+	Subcommand CommandSubcommand
+}
+
+type HELLOArguments struct {
+	// ProtoVer is the requested RESP version, 0 when HELLO is called without arguments
+	ProtoVer int
+}
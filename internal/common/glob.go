@@ -0,0 +1,90 @@
+package common
+
+// GlobMatch reports whether str matches the glob-style pattern used by redis commands like KEYS
+// and PSUBSCRIBE. It supports *, ?, [abc], [^abc], [a-z] and \ to escape special characters.
+func GlobMatch(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if GlobMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], str[0])
+			if !matched {
+				return false
+			}
+			pattern = rest
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+// matchClass matches ch against a [...] class, pattern starts after the opening bracket.
+// It returns the pattern following the closing bracket.
+func matchClass(pattern string, ch byte) (bool, string) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			if pattern[1] == ch {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			if ch >= start && ch <= end {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == ch {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		// skip the closing bracket
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
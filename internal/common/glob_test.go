@@ -0,0 +1,33 @@
+package common
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{pattern: "*", str: "anything", want: true},
+		{pattern: "news.*", str: "news.tech", want: true},
+		{pattern: "news.*", str: "weather", want: false},
+		{pattern: "h?llo", str: "hello", want: true},
+		{pattern: "h?llo", str: "hllo", want: false},
+		{pattern: "h[ae]llo", str: "hallo", want: true},
+		{pattern: "h[ae]llo", str: "hillo", want: false},
+		{pattern: "h[^e]llo", str: "hallo", want: true},
+		{pattern: "h[^e]llo", str: "hello", want: false},
+		{pattern: "h[a-c]llo", str: "hbllo", want: true},
+		{pattern: "h\\*llo", str: "h*llo", want: true},
+		{pattern: "h\\*llo", str: "hello", want: false},
+		{pattern: "*:*:end", str: "a:b:end", want: true},
+		{pattern: "", str: "", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.str, func(t *testing.T) {
+			if got := GlobMatch(tt.pattern, tt.str); got != tt.want {
+				t.Errorf("GlobMatch(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package common
+
+import "strings"
+
+// NumSlots is the number of hash slots keys and sharded channels are mapped to
+const NumSlots = 16384
+
+// crc16Table is the lookup table of the CRC16 XMODEM variant used by redis cluster
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC16 returns the CRC16 XMODEM checksum of data
+func CRC16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. When the key contains a non empty hash tag, like
+// {user1000}.followers, only the tag is hashed so related keys share the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16(key) % NumSlots)
+}
@@ -0,0 +1,27 @@
+package common
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	AssertEquals(t, CRC16("123456789"), uint16(0x31c3))
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "{user1000}.following", want: KeySlot("user1000")},
+		{key: "{user1000}.followers", want: KeySlot("user1000")},
+		{key: "foo{}{bar}", want: KeySlot("foo{}{bar}")},
+		{key: "foo{{bar}}zap", want: KeySlot("{bar")},
+		{key: "foo{bar}{zap}", want: KeySlot("bar")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			AssertEquals(t, KeySlot(tt.key), tt.want)
+		})
+	}
+}
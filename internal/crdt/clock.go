@@ -0,0 +1,60 @@
+// Package crdt implements the conflict free replicated data types of the active-active mode:
+// last writer wins registers ordered by hybrid logical clocks, PN-counters and observed-remove
+// sets. The replicas of a value apply their local updates then exchange their states, merging
+// the states in any order, any number of times, converges to the same value on every replica.
+package crdt
+
+import (
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading: the wall clock in milliseconds, a logical counter
+// ordering the events of the same millisecond and the node that took it, which breaks the ties
+// between nodes. The timestamps of a node are unique.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// Less orders the timestamps by wall clock, logical counter then node
+func (t Timestamp) Less(o Timestamp) bool {
+	if t.Wall != o.Wall {
+		return t.Wall < o.Wall
+	}
+	if t.Logical != o.Logical {
+		return t.Logical < o.Logical
+	}
+	return t.Node < o.Node
+}
+
+// Clock is the hybrid logical clock of a node. Its timestamps follow the wall clock and the
+// timestamps it observed from the other nodes, so a write always wins over the writes its node
+// already knew about even when the wall clocks of the nodes drift apart.
+type Clock struct {
+	node string
+	now  func() time.Time
+	last Timestamp
+}
+
+func NewClock(node string, now func() time.Time) *Clock {
+	return &Clock{node: node, now: now, last: Timestamp{Node: node}}
+}
+
+// Now returns a timestamp greater than every timestamp returned or observed before
+func (c *Clock) Now() Timestamp {
+	wall := c.now().UnixNano() / int64(time.Millisecond)
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall, Node: c.node}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Observe advances the clock past a timestamp of another node
+func (c *Clock) Observe(t Timestamp) {
+	if t.Wall > c.last.Wall || (t.Wall == c.last.Wall && t.Logical > c.last.Logical) {
+		c.last = Timestamp{Wall: t.Wall, Logical: t.Logical, Node: c.node}
+	}
+}
@@ -0,0 +1,128 @@
+package crdt
+
+import (
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fixedClock(node string, t *time.Time) *Clock {
+	return NewClock(node, func() time.Time { return *t })
+}
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := fixedClock("a", &now)
+	first := a.Now()
+	second := a.Now()
+	common.AssertEquals(t, first.Less(second), true)
+	common.AssertEquals(t, second.Logical, uint32(1))
+
+	// b is behind, its next timestamp follows the one it observed
+	past := now.Add(-time.Minute)
+	b := fixedClock("b", &past)
+	b.Observe(second)
+	third := b.Now()
+	common.AssertEquals(t, second.Less(third), true)
+	common.AssertEquals(t, third.Node, "b")
+
+	now = now.Add(time.Millisecond)
+	common.AssertEquals(t, a.Now(), Timestamp{Wall: third.Wall + 1, Node: "a"})
+}
+
+// mergeAll merges the values in order into the zero value
+func mergeAll(values ...Value) Value {
+	var v Value
+	for _, o := range values {
+		v.Merge(o)
+	}
+	return v
+}
+
+func assertValue(t *testing.T, v Value, want string, exists bool) {
+	t.Helper()
+	got, ok := v.Get()
+	if got != want || ok != exists {
+		t.Errorf("want %q %v, got %q %v", want, exists, got, ok)
+	}
+}
+
+func TestValueConverges(t *testing.T) {
+	ts := func(wall int64, node string) Timestamp { return Timestamp{Wall: wall, Node: node} }
+	set := Set("10", ts(1, "a"))
+	incrA := set
+	incrA.Increment("a", 5)
+	incrB := set
+	incrB.Increment("b", -2)
+	laterSet := Set("x", ts(2, "b"))
+	del := Deleted(ts(3, "a"))
+
+	for _, order := range [][]Value{
+		{set, incrA, incrB},
+		{incrB, incrA, set},
+		{incrA, incrB, incrB, set, incrA},
+	} {
+		assertValue(t, mergeAll(order...), "13", true)
+	}
+	// the later SET wins over the concurrent increments
+	assertValue(t, mergeAll(incrA, laterSet, incrB), "x", true)
+	assertValue(t, mergeAll(laterSet, del, incrA), "", false)
+
+	// the increments of a missing key start from 0
+	var a, b Value
+	a.Increment("a", 1)
+	b.Increment("b", 1)
+	assertValue(t, mergeAll(a, b), "2", true)
+	assertValue(t, Value{}, "", false)
+
+	// merging an older value changes nothing
+	v := mergeAll(laterSet)
+	common.AssertEquals(t, v.Merge(set), false)
+	common.AssertEquals(t, v.Merge(laterSet), false)
+	common.AssertEquals(t, v.Merge(del), true)
+}
+
+func TestValueEncoding(t *testing.T) {
+	v := Set("value", Timestamp{Wall: 1700000000000, Logical: 3, Node: "a"})
+	v.Increment("a", 7)
+	v.Increment("b", -4)
+	for _, want := range []Value{v, Deleted(Timestamp{Wall: 1, Node: "b"}), {}} {
+		got, err := DecodeValue(want.Encode())
+		common.ExpectNoError(t, err)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+	encoded := v.Encode()
+	for _, invalid := range [][]byte{nil, {2}, encoded[:len(encoded)-1], append(encoded, 0)} {
+		if _, err := DecodeValue(invalid); !errors.Is(err, errInvalidValue) {
+			t.Errorf("want an invalid value error for %v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestORSet(t *testing.T) {
+	a, b := NewORSet(), NewORSet()
+	a.Add("x", Timestamp{Wall: 1, Node: "a"})
+	b.Merge(a)
+	common.AssertEquals(t, b.Contains("x"), true)
+
+	// b removes x while a adds it again, the concurrent addition stays
+	b.Remove("x")
+	a.Add("x", Timestamp{Wall: 2, Node: "a"})
+	a.Add("y", Timestamp{Wall: 3, Node: "a"})
+	common.AssertEquals(t, a.Merge(b), true)
+	common.AssertEquals(t, b.Merge(a), true)
+	common.AssertEquals(t, strings.Join(a.Elements(), " "), "x y")
+	common.AssertEquals(t, strings.Join(b.Elements(), " "), "x y")
+
+	// a removal of every observed addition removes the element on both
+	a.Remove("x")
+	b.Merge(a)
+	common.AssertEquals(t, b.Contains("x"), false)
+	common.AssertEquals(t, b.Merge(a), false)
+	common.AssertEquals(t, strings.Join(b.Elements(), " "), "y")
+}
@@ -0,0 +1,149 @@
+package crdt
+
+import (
+	"sort"
+)
+
+// Register is a last writer wins register, a deleted value is kept as a register that is not
+// Present so the deletion wins over the older writes
+type Register struct {
+	TS      Timestamp
+	Value   string
+	Present bool
+}
+
+// Merge keeps the register with the greatest timestamp, it returns true when r changed
+func (r *Register) Merge(o Register) bool {
+	if !r.TS.Less(o.TS) {
+		return false
+	}
+	*r = o
+	return true
+}
+
+// PN is the sum of the increments and of the decrements of a node
+type PN struct {
+	P uint64
+	N uint64
+}
+
+// PNCounter is a counter incremented and decremented by any node, every node counts its own
+// increments and decrements and the merge keeps the greatest counts of each node
+type PNCounter map[string]PN
+
+// Increment adds delta, positive or negative, to the counts of node
+func (c PNCounter) Increment(node string, delta int64) {
+	pn := c[node]
+	if delta >= 0 {
+		pn.P += uint64(delta)
+	} else {
+		pn.N += uint64(-delta)
+	}
+	c[node] = pn
+}
+
+// Value returns the sum of the increments minus the sum of the decrements
+func (c PNCounter) Value() int64 {
+	var value uint64
+	for _, pn := range c {
+		value += pn.P - pn.N
+	}
+	return int64(value)
+}
+
+// Merge keeps the greatest counts of every node, it returns true when c changed
+func (c PNCounter) Merge(o PNCounter) bool {
+	changed := false
+	for node, pn := range o {
+		mine := c[node]
+		if pn.P > mine.P {
+			mine.P, changed = pn.P, true
+		}
+		if pn.N > mine.N {
+			mine.N, changed = pn.N, true
+		}
+		c[node] = mine
+	}
+	return changed
+}
+
+// ORSet is an observed-remove set: every addition is tagged with a unique timestamp and a removal
+// only removes the tags it observed, so an element added concurrently with its removal stays
+type ORSet struct {
+	adds    map[string]map[Timestamp]struct{}
+	removed map[Timestamp]struct{}
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{
+		adds:    make(map[string]map[Timestamp]struct{}),
+		removed: make(map[Timestamp]struct{}),
+	}
+}
+
+// Add adds element with the unique tag
+func (s *ORSet) Add(element string, tag Timestamp) {
+	tags, ok := s.adds[element]
+	if !ok {
+		tags = make(map[Timestamp]struct{})
+		s.adds[element] = tags
+	}
+	tags[tag] = struct{}{}
+}
+
+// Remove removes element as observed by this replica
+func (s *ORSet) Remove(element string) {
+	for tag := range s.adds[element] {
+		s.removed[tag] = struct{}{}
+	}
+	delete(s.adds, element)
+}
+
+// Contains returns true when an addition of element was not removed
+func (s *ORSet) Contains(element string) bool {
+	return len(s.adds[element]) > 0
+}
+
+// Elements returns the elements of the set in order
+func (s *ORSet) Elements() []string {
+	elements := make([]string, 0, len(s.adds))
+	for element := range s.adds {
+		elements = append(elements, element)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// Merge adds the additions of o that this replica did not remove and removes the tags o removed,
+// it returns true when s changed
+func (s *ORSet) Merge(o *ORSet) bool {
+	changed := false
+	for tag := range o.removed {
+		if _, ok := s.removed[tag]; !ok {
+			s.removed[tag] = struct{}{}
+			changed = true
+		}
+	}
+	for element, tags := range o.adds {
+		for tag := range tags {
+			if _, removed := s.removed[tag]; removed {
+				continue
+			}
+			if _, ok := s.adds[element][tag]; !ok {
+				s.Add(element, tag)
+				changed = true
+			}
+		}
+	}
+	for element, tags := range s.adds {
+		for tag := range tags {
+			if _, removed := s.removed[tag]; removed {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.adds, element)
+		}
+	}
+	return changed
+}
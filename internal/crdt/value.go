@@ -0,0 +1,193 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// valueVersion is the first byte of the encoded values
+const valueVersion = 1
+
+var errInvalidValue = errors.New("invalid CRDT value")
+
+// Value is the replicated state of a key: the register of the last SET or DEL and the counter of
+// the increments applied on top of its value by INCRBY. The value with the greatest register
+// wins, the increments concurrent with a SET or a DEL are lost like in a last writer wins
+// register, and the counters of the same register are merged so the concurrent increments add up.
+// The zero Value is a key that was never written.
+type Value struct {
+	Register Register
+	Counter  PNCounter
+}
+
+// Set returns the value of a SET at ts
+func Set(value string, ts Timestamp) Value {
+	return Value{Register: Register{TS: ts, Value: value, Present: true}}
+}
+
+// Deleted returns the value of a DEL at ts
+func Deleted(ts Timestamp) Value {
+	return Value{Register: Register{TS: ts}}
+}
+
+// Increment adds delta to the counter of node
+func (v *Value) Increment(node string, delta int64) {
+	if v.Counter == nil {
+		v.Counter = make(PNCounter)
+	}
+	v.Counter.Increment(node, delta)
+}
+
+// Get returns the string of the value, false when the key does not exist
+func (v Value) Get() (string, bool) {
+	if len(v.Counter) == 0 {
+		return v.Register.Value, v.Register.Present
+	}
+	var base int64
+	if v.Register.Present {
+		// the increments are only applied to integers
+		base, _ = strconv.ParseInt(v.Register.Value, 10, 64)
+	}
+	return strconv.FormatInt(base+v.Counter.Value(), 10), true
+}
+
+// Merge merges o into v, it returns true when v changed
+func (v *Value) Merge(o Value) bool {
+	if v.Register.TS.Less(o.Register.TS) {
+		v.Register = o.Register
+		v.Counter = nil
+		if len(o.Counter) > 0 {
+			v.Counter = make(PNCounter, len(o.Counter))
+			v.Counter.Merge(o.Counter)
+		}
+		return true
+	}
+	if v.Register.TS != o.Register.TS || len(o.Counter) == 0 {
+		return false
+	}
+	if v.Counter == nil {
+		v.Counter = make(PNCounter, len(o.Counter))
+	}
+	return v.Counter.Merge(o.Counter)
+}
+
+// Encode serializes v to exchange it between the nodes
+func (v Value) Encode() []byte {
+	buf := []byte{valueVersion}
+	buf = appendTimestamp(buf, v.Register.TS)
+	if v.Register.Present {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = appendString(buf, v.Register.Value)
+	nodes := make([]string, 0, len(v.Counter))
+	for node := range v.Counter {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	buf = appendUvarint(buf, uint64(len(nodes)))
+	for _, node := range nodes {
+		buf = appendString(buf, node)
+		buf = appendUvarint(buf, v.Counter[node].P)
+		buf = appendUvarint(buf, v.Counter[node].N)
+	}
+	return buf
+}
+
+// DecodeValue deserializes a value serialized by Encode
+func DecodeValue(data []byte) (Value, error) {
+	if len(data) == 0 || data[0] != valueVersion {
+		return Value{}, fmt.Errorf("%w: unknown version", errInvalidValue)
+	}
+	d := decoder{buf: data[1:]}
+	var v Value
+	v.Register.TS = d.timestamp()
+	v.Register.Present = d.byte() == 1
+	v.Register.Value = d.string()
+	if n := d.uvarint(); n > 0 && d.err == nil {
+		if n > uint64(len(d.buf)) {
+			return Value{}, fmt.Errorf("%w: truncated", errInvalidValue)
+		}
+		v.Counter = make(PNCounter, n)
+		for i := uint64(0); i < n; i++ {
+			node := d.string()
+			v.Counter[node] = PN{P: d.uvarint(), N: d.uvarint()}
+		}
+	}
+	if d.err != nil {
+		return Value{}, d.err
+	}
+	if len(d.buf) != 0 {
+		return Value{}, fmt.Errorf("%w: %d trailing bytes", errInvalidValue, len(d.buf))
+	}
+	return v, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendTimestamp(buf []byte, ts Timestamp) []byte {
+	buf = appendUvarint(buf, uint64(ts.Wall))
+	buf = appendUvarint(buf, uint64(ts.Logical))
+	return appendString(buf, ts.Node)
+}
+
+// decoder reads the fields of a value, the first error is kept and the next reads return zeros
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) == 0 {
+		d.err = fmt.Errorf("%w: truncated", errInvalidValue)
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: invalid varint", errInvalidValue)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: truncated", errInvalidValue)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) timestamp() Timestamp {
+	return Timestamp{Wall: int64(d.uvarint()), Logical: uint32(d.uvarint()), Node: d.string()}
+}
@@ -0,0 +1,438 @@
+// Package envelope encodes the snapshot and append only files with optional compression and
+// AES-GCM encryption. An enveloped file starts with a header recording the scheme, the ID of the
+// key and a random file ID, followed by frames that are compressed, encrypted and checksummed
+// independently, so the append only file keeps being appended frame by frame. A wrong key or a
+// corrupted file is detected when the file is read.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Compression is the algorithm used to compress the frames
+type Compression byte
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+)
+
+const (
+	encryptionNone   = 0
+	encryptionAESGCM = 1
+
+	magic   = "RWPENV"
+	version = 1
+	// frameSize is the plain size of the frames written by Writer.Write
+	frameSize = 64 * 1024
+	// maxFrameSize bounds the frames written by Writer.WriteFrame, like redis proto-max-bulk-len
+	maxFrameSize = 512 * 1024 * 1024
+	fileIDSize   = 16
+	frameHeader  = 8
+)
+
+var (
+	// ErrNotEnveloped is returned by ReadHeader for plain files
+	ErrNotEnveloped = errors.New("not an enveloped file")
+	// ErrCorrupted is returned when a checksum does not match
+	ErrCorrupted = errors.New("checksum mismatch, the file is corrupted")
+	// ErrAuthentication is returned when a frame can not be decrypted
+	ErrAuthentication = errors.New("frame authentication failed, wrong key or tampered file")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ParseCompression parses none or gzip
+func ParseCompression(value string) (Compression, error) {
+	switch strings.ToLower(value) {
+	case "", "none", "no":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	}
+	return 0, fmt.Errorf("invalid compression %q, want none or gzip", value)
+}
+
+func (c Compression) String() string {
+	if c == CompressionGzip {
+		return "gzip"
+	}
+	return "none"
+}
+
+// Key is an AES key, its ID is a fingerprint recorded in the files it encrypts
+type Key struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// NewKey creates a key from 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+func NewKey(secret []byte) (*Key, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(secret)
+	return &Key{ID: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// ParseKey parses a key encoded in hex or base64
+func ParseKey(text string) (*Key, error) {
+	text = strings.TrimSpace(text)
+	secret, err := hex.DecodeString(text)
+	if err != nil {
+		if secret, err = base64.StdEncoding.DecodeString(text); err != nil {
+			return nil, errors.New("the encryption key must be encoded in hex or base64")
+		}
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// KeyEnv is the environment variable LoadKey reads the key from when no key file is given
+const KeyEnv = "REDIS_ENCRYPTION_KEY"
+
+// LoadKey reads the key from the file path or, when path is empty, from the KeyEnv environment
+// variable. It returns nil when neither is set.
+func LoadKey(path string) (*Key, error) {
+	if path != "" {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKey(string(text))
+	}
+	if text := os.Getenv(KeyEnv); text != "" {
+		return ParseKey(text)
+	}
+	return nil, nil
+}
+
+// Options selects how files are written, the zero value writes plain files
+type Options struct {
+	Compression Compression
+	// Key encrypts the files when it is not nil, it is also the key used to decrypt them
+	Key *Key
+}
+
+// Enabled returns true when the files are enveloped
+func (o Options) Enabled() bool {
+	return o.Compression != CompressionNone || o.Key != nil
+}
+
+// Header describes an enveloped file
+type Header struct {
+	Compression Compression
+	Encrypted   bool
+	// KeyID is the ID of the key the file is encrypted with
+	KeyID  string
+	fileID []byte
+	size   int
+}
+
+// Matches returns true when new frames written with o can be appended to the file
+func (h Header) Matches(o Options) bool {
+	if h.Compression != o.Compression || h.Encrypted != (o.Key != nil) {
+		return false
+	}
+	return o.Key == nil || o.Key.ID == h.KeyID
+}
+
+func (h Header) encode() []byte {
+	buf := []byte(magic)
+	buf = append(buf, version, byte(h.Compression))
+	if h.Encrypted {
+		buf = append(buf, encryptionAESGCM)
+	} else {
+		buf = append(buf, encryptionNone)
+	}
+	buf = append(buf, byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = append(buf, h.fileID...)
+	return appendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// ReadHeader reads the header of an enveloped file, it returns ErrNotEnveloped for plain files
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	prefix, err := r.Peek(len(magic))
+	if err != nil || string(prefix) != magic {
+		return Header{}, ErrNotEnveloped
+	}
+	fixed := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return Header{}, fmt.Errorf("reading the file header: %w", err)
+	}
+	rest := make([]byte, int(fixed[len(magic)+3])+fileIDSize+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return Header{}, fmt.Errorf("reading the file header: %w", err)
+	}
+	raw := append(fixed, rest...)
+	if crc32.Checksum(raw[:len(raw)-4], crcTable) != binary.BigEndian.Uint32(raw[len(raw)-4:]) {
+		return Header{}, fmt.Errorf("file header: %w", ErrCorrupted)
+	}
+	scheme := fixed[len(magic):]
+	if scheme[0] != version {
+		return Header{}, fmt.Errorf("unsupported envelope version %d", scheme[0])
+	}
+	if Compression(scheme[1]) > CompressionGzip || scheme[2] > encryptionAESGCM {
+		return Header{}, fmt.Errorf("unsupported scheme in the file header")
+	}
+	keyIDSize := int(scheme[3])
+	return Header{
+		Compression: Compression(scheme[1]),
+		Encrypted:   scheme[2] == encryptionAESGCM,
+		KeyID:       string(rest[:keyIDSize]),
+		fileID:      rest[keyIDSize : keyIDSize+fileIDSize],
+		size:        len(raw),
+	}, nil
+}
+
+// Writer encodes the data written to it in frames, a frame is written every 64KiB and by Flush.
+// WriteFrame writes its data as a single frame.
+type Writer struct {
+	w      io.Writer
+	opts   Options
+	fileID []byte
+	buf    []byte
+}
+
+// NewWriter writes the header of a new file and returns a writer for its frames
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	fileID := make([]byte, fileIDSize)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, err
+	}
+	h := Header{Compression: opts.Compression, Encrypted: opts.Key != nil, fileID: fileID}
+	if opts.Key != nil {
+		h.KeyID = opts.Key.ID
+	}
+	if _, err := w.Write(h.encode()); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, opts: opts, fileID: fileID}, nil
+}
+
+// AppendWriter returns a writer appending frames to an existing file with header h, the header
+// must match opts
+func AppendWriter(w io.Writer, h Header, opts Options) (*Writer, error) {
+	if !h.Matches(opts) {
+		return nil, errors.New("the file was written with other compression or encryption options")
+	}
+	return &Writer{w: w, opts: opts, fileID: h.fileID}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := frameSize - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+		if len(w.buf) == frameSize {
+			if err := w.Flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the buffered data as a frame
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeFrame(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// WriteFrame writes the buffered data and then p as a single frame, a reader gets all of p or,
+// when the file is cut in the middle of the frame, none of it
+func (w *Writer) WriteFrame(p []byte) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(p) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(p), maxFrameSize)
+	}
+	return w.writeFrame(p)
+}
+
+func (w *Writer) writeFrame(p []byte) error {
+	frame, err := w.seal(p)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(frame)
+	return err
+}
+
+func (w *Writer) seal(plain []byte) ([]byte, error) {
+	payload := plain
+	if w.opts.Compression == CompressionGzip {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(plain); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = compressed.Bytes()
+	}
+	if w.opts.Key != nil {
+		aead := w.opts.Key.aead
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		payload = aead.Seal(nonce, nonce, payload, w.fileID)
+	}
+	frame := make([]byte, frameHeader, frameHeader+len(payload)+4)
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(plain)))
+	frame = append(frame, payload...)
+	return appendUint32(frame, crc32.Checksum(payload, crcTable)), nil
+}
+
+// Reader decodes an enveloped file or reads a plain file as is
+type Reader struct {
+	r      *bufio.Reader
+	header *Header
+	key    *Key
+	plain  []byte
+	// valid is the size of the file up to the last complete frame
+	valid     int64
+	truncated bool
+}
+
+// NewReader returns a reader of the plain content of r, key decrypts encrypted files
+func NewReader(r io.Reader, key *Key) (*Reader, error) {
+	br := bufio.NewReader(r)
+	h, err := ReadHeader(br)
+	if err == ErrNotEnveloped {
+		return &Reader{r: br}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Encrypted && key == nil {
+		return nil, fmt.Errorf("the file is encrypted with the key %s, no encryption key is configured", h.KeyID)
+	}
+	if h.Encrypted && key.ID != h.KeyID {
+		return nil, fmt.Errorf("the file is encrypted with the key %s, the configured key is %s", h.KeyID, key.ID)
+	}
+	return &Reader{r: br, header: &h, key: key, valid: int64(h.size)}, nil
+}
+
+// Header returns the header of the file, nil for plain files
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+// Truncated returns true when the file ended in the middle of a frame, Valid is then the size of
+// the complete frames
+func (r *Reader) Truncated() bool {
+	return r.truncated
+}
+
+// Valid returns the size of the file up to the last complete frame read
+func (r *Reader) Valid() int64 {
+	return r.valid
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.header == nil {
+		return r.r.Read(p)
+	}
+	for len(r.plain) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decodes the next frame, a frame cut by the end of the file ends the file like io.EOF
+func (r *Reader) next() error {
+	head := make([]byte, frameHeader)
+	if n, err := io.ReadFull(r.r, head); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		r.truncated = n > 0 || err == io.ErrUnexpectedEOF
+		return io.EOF
+	}
+	payloadSize := binary.BigEndian.Uint32(head)
+	plainSize := binary.BigEndian.Uint32(head[4:])
+	if plainSize > maxFrameSize || payloadSize > maxFrameSize+1<<20 {
+		return fmt.Errorf("frame at offset %d: %w", r.valid, ErrCorrupted)
+	}
+	frame := make([]byte, payloadSize+4)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		r.truncated = true
+		return io.EOF
+	}
+	payload := frame[:payloadSize]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(frame[payloadSize:]) {
+		return fmt.Errorf("frame at offset %d: %w", r.valid, ErrCorrupted)
+	}
+	if r.header.Encrypted {
+		aead := r.key.aead
+		if len(payload) < aead.NonceSize() {
+			return fmt.Errorf("frame at offset %d: %w", r.valid, ErrCorrupted)
+		}
+		var err error
+		payload, err = aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], r.header.fileID)
+		if err != nil {
+			return fmt.Errorf("frame at offset %d: %w", r.valid, ErrAuthentication)
+		}
+	}
+	if r.header.Compression == CompressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("frame at offset %d: %w", r.valid, err)
+		}
+		if payload, err = ioutil.ReadAll(zr); err != nil {
+			return fmt.Errorf("frame at offset %d: %w", r.valid, err)
+		}
+	}
+	if len(payload) != int(plainSize) {
+		return fmt.Errorf("frame at offset %d: %w", r.valid, ErrCorrupted)
+	}
+	r.valid += int64(frameHeader) + int64(len(frame))
+	r.plain = payload
+	return nil
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
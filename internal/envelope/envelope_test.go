@@ -0,0 +1,162 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, seed byte) *Key {
+	t.Helper()
+	key, err := NewKey(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatalf("NewKey() error = %v", err)
+	}
+	return key
+}
+
+func encode(t *testing.T, opts Options, chunks ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	for _, chunk := range chunks {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decode(payload []byte, key *Key) (string, *Reader, error) {
+	r, err := NewReader(bytes.NewReader(payload), key)
+	if err != nil {
+		return "", nil, err
+	}
+	plain, err := ioutil.ReadAll(r)
+	return string(plain), r, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t, 1)
+	large := strings.Repeat("0123456789", 20_000)
+	for _, opts := range []Options{
+		{},
+		{Compression: CompressionGzip},
+		{Key: key},
+		{Compression: CompressionGzip, Key: key},
+	} {
+		payload := encode(t, opts, "*1\r\n$4\r\nPING\r\n", large)
+		plain, r, err := decode(payload, key)
+		if err != nil {
+			t.Fatalf("%v: decode error = %v", opts, err)
+		}
+		if plain != "*1\r\n$4\r\nPING\r\n"+large {
+			t.Errorf("%v: decoded %d bytes, want %d", opts, len(plain), len(large)+14)
+		}
+		if r.Truncated() || r.Valid() != int64(len(payload)) {
+			t.Errorf("%v: Valid() = %d, Truncated() = %v, want %d", opts, r.Valid(), r.Truncated(), len(payload))
+		}
+		if opts.Key != nil && bytes.Contains(payload, []byte("PING")) {
+			t.Errorf("%v: the encrypted file contains plain text", opts)
+		}
+	}
+}
+
+func TestPlainFiles(t *testing.T) {
+	plain, r, err := decode([]byte("REDIS0011..."), nil)
+	if err != nil || plain != "REDIS0011..." || r.Header() != nil {
+		t.Errorf("decode() = %q, %v, want the plain file as is", plain, err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	payload := encode(t, Options{Key: testKey(t, 1)}, "secret")
+	if _, _, err := decode(payload, testKey(t, 2)); err == nil || !strings.Contains(err.Error(), "the configured key is") {
+		t.Errorf("want a key mismatch error, got %v", err)
+	}
+	if _, _, err := decode(payload, nil); err == nil || !strings.Contains(err.Error(), "no encryption key") {
+		t.Errorf("want a missing key error, got %v", err)
+	}
+
+	// a different key claiming the ID of the right one fails authentication
+	forged := testKey(t, 2)
+	forged.ID = testKey(t, 1).ID
+	if _, _, err := decode(payload, forged); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("want ErrAuthentication, got %v", err)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	for _, opts := range []Options{{}, {Compression: CompressionGzip}, {Key: testKey(t, 1)}} {
+		payload := encode(t, opts, "some data")
+		for _, offset := range []int{7, len(payload) - 6} {
+			corrupted := append([]byte(nil), payload...)
+			corrupted[offset] ^= 0xff
+			if _, _, err := decode(corrupted, opts.Key); !errors.Is(err, ErrCorrupted) {
+				t.Errorf("%v: byte %d flipped, want ErrCorrupted, got %v", opts, offset, err)
+			}
+		}
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	key := testKey(t, 1)
+	payload := encode(t, Options{Key: key}, "first", "second")
+	complete := len(encode(t, Options{Key: key}, "first"))
+	for _, cut := range []int{len(payload) - 1, complete + 3} {
+		plain, r, err := decode(payload[:cut], key)
+		if err != nil || plain != "first" {
+			t.Errorf("cut at %d: decode() = %q, %v, want the first frame", cut, plain, err)
+			continue
+		}
+		if !r.Truncated() || r.Valid() != int64(complete) {
+			t.Errorf("cut at %d: Valid() = %d, Truncated() = %v, want %d", cut, r.Valid(), r.Truncated(), complete)
+		}
+	}
+}
+
+func TestAppendWriter(t *testing.T) {
+	key := testKey(t, 1)
+	opts := Options{Compression: CompressionGzip, Key: key}
+	payload := encode(t, opts, "first")
+	r, err := NewReader(bytes.NewReader(payload), key)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if _, err := AppendWriter(&bytes.Buffer{}, *r.Header(), Options{Key: key}); err == nil {
+		t.Errorf("want error appending with other options")
+	}
+	buf := bytes.NewBuffer(payload)
+	w, err := AppendWriter(buf, *r.Header(), opts)
+	if err != nil {
+		t.Fatalf("AppendWriter() error = %v", err)
+	}
+	_, _ = w.Write([]byte(" second"))
+	_ = w.Flush()
+	if plain, _, err := decode(buf.Bytes(), key); err != nil || plain != "first second" {
+		t.Errorf("decode() = %q, %v, want both frames", plain, err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	hexKey := strings.Repeat("ab", 32)
+	key, err := ParseKey(hexKey + "\n")
+	if err != nil {
+		t.Fatalf("ParseKey() error = %v", err)
+	}
+	b64, err := ParseKey("q6urq6urq6urq6urq6urqw==")
+	if err != nil || b64.ID == key.ID {
+		t.Errorf("ParseKey(base64) = %v, %v, want a 16 bytes key", b64, err)
+	}
+	if _, err := ParseKey("abcd"); err == nil {
+		t.Errorf("want error for a short key")
+	}
+}
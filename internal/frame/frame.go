@@ -0,0 +1,228 @@
+// Package frame encodes the messages the servers exchange on the cluster bus and on the raft
+// transport. A frame starts with the signature of its protocol and its length, followed by fields
+// in big endian and strings prefixed by their length.
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxPrealloc bounds the memory allocated for a frame before its bytes are received, a length
+// corrupted or sent by a peer that stops writing does not allocate MaxSize
+const maxPrealloc = 64 << 10
+
+// Format is the signature & the maximum size of the frames of a protocol, the errors of its frames
+// wrap Err
+type Format struct {
+	Signature string
+	MaxSize   int
+	Err       error
+}
+
+// headerSize is the size of the signature & the length of a frame
+func (f Format) headerSize() int {
+	return len(f.Signature) + 4
+}
+
+// NewEncoder returns an encoder starting with the header of a frame, capacity is the expected size
+// of the fields
+func (f Format) NewEncoder(capacity int) *Encoder {
+	e := &Encoder{buf: make([]byte, 0, f.headerSize()+capacity)}
+	e.buf = append(e.buf, f.Signature...)
+	e.Uint32(0)
+	return e
+}
+
+// Write sets the length of the frame encoded by e and writes it to w
+func (f Format) Write(w io.Writer, e *Encoder) error {
+	if len(e.buf) > f.MaxSize {
+		return fmt.Errorf("%w: %d bytes", f.Err, len(e.buf))
+	}
+	binary.BigEndian.PutUint32(e.buf[len(f.Signature):], uint32(len(e.buf)))
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// Read reads a frame written by Write, the decoder returned reads its fields. The memory allocated
+// follows the bytes received.
+func (f Format) Read(r *bufio.Reader) (*Decoder, error) {
+	header := make([]byte, f.headerSize())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(f.Signature)]) != f.Signature {
+		return nil, fmt.Errorf("%w: bad signature %q", f.Err, header[:len(f.Signature)])
+	}
+	size := int(binary.BigEndian.Uint32(header[len(f.Signature):]))
+	if size < len(header) || size > f.MaxSize {
+		return nil, fmt.Errorf("%w: bad length %d", f.Err, size)
+	}
+	size -= len(header)
+	if size <= maxPrealloc {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return f.NewDecoder(buf), nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPrealloc)
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f.NewDecoder(buf.Bytes()), nil
+}
+
+// NewDecoder returns a decoder of the fields in buf, encoded without the header of a frame
+func (f Format) NewDecoder(buf []byte) *Decoder {
+	return &Decoder{buf: buf, invalid: f.Err}
+}
+
+// Encoder appends the fields of a frame, the zero value encodes fields without a header
+type Encoder struct {
+	buf []byte
+}
+
+// Append returns an encoder appending the fields to buf
+func Append(buf []byte) *Encoder {
+	return &Encoder{buf: buf}
+}
+
+// Data returns the bytes encoded
+func (e *Encoder) Data() []byte {
+	return e.buf
+}
+
+func (e *Encoder) Uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *Encoder) Bool(v bool) {
+	if v {
+		e.Uint8(1)
+	} else {
+		e.Uint8(0)
+	}
+}
+
+func (e *Encoder) Uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *Encoder) Uint32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *Encoder) Uint64(v uint64) {
+	e.Uint32(uint32(v >> 32))
+	e.Uint32(uint32(v))
+}
+
+// String appends s prefixed by its length on 16 bits
+func (e *Encoder) String(s string) {
+	e.Uint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// Bytes appends b prefixed by its length on 32 bits
+func (e *Encoder) Bytes(b []byte) {
+	e.Uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// Raw appends b as is, its length is known by the decoder
+func (e *Encoder) Raw(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+// Decoder reads the fields of a frame, the first error is kept and the next reads return zeros
+type Decoder struct {
+	buf     []byte
+	err     error
+	invalid error
+}
+
+// Err returns the first error met
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Len returns the number of bytes not read yet
+func (d *Decoder) Len() int {
+	return len(d.buf)
+}
+
+// Finish returns the first error met, or an error when bytes are left after the last field
+func (d *Decoder) Finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", d.invalid, len(d.buf))
+	}
+	return d.err
+}
+
+// Raw returns the next n bytes, they are part of the buffer of the frame
+func (d *Decoder) Raw(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = fmt.Errorf("%w: truncated", d.invalid)
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *Decoder) Uint8() uint8 {
+	if b := d.Raw(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *Decoder) Bool() bool {
+	return d.Uint8() != 0
+}
+
+func (d *Decoder) Uint16() uint16 {
+	if b := d.Raw(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uint32() uint32 {
+	if b := d.Raw(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uint64() uint64 {
+	if b := d.Raw(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// String reads a string written by Encoder.String
+func (d *Decoder) String() string {
+	return string(d.Raw(int(d.Uint16())))
+}
+
+// Bytes reads a copy of the bytes written by Encoder.Bytes, the buffer of the frame is not kept
+func (d *Decoder) Bytes() []byte {
+	b := d.Raw(int(d.Uint32()))
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,65 @@
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"testing"
+)
+
+var (
+	errInvalid = errors.New("invalid test frame")
+	testFormat = Format{Signature: "TEST", MaxSize: 1 << 30, Err: errInvalid}
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	e := testFormat.NewEncoder(0)
+	e.Uint8(1)
+	e.Bool(true)
+	e.Uint16(2)
+	e.Uint32(3)
+	e.Uint64(4)
+	e.String("five")
+	e.Bytes([]byte("six"))
+	e.Raw([]byte("7"))
+	common.ExpectNoError(t, testFormat.Write(&buf, e))
+
+	d, err := testFormat.Read(bufio.NewReader(&buf))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, d.Uint8(), uint8(1))
+	common.AssertEquals(t, d.Bool(), true)
+	common.AssertEquals(t, d.Uint16(), uint16(2))
+	common.AssertEquals(t, d.Uint32(), uint32(3))
+	common.AssertEquals(t, d.Uint64(), uint64(4))
+	common.AssertEquals(t, d.String(), "five")
+	common.AssertEquals(t, string(d.Bytes()), "six")
+	common.AssertEquals(t, string(d.Raw(1)), "7")
+	common.ExpectNoError(t, d.Finish())
+
+	// the reads past the end return zeros and keep the error
+	common.AssertEquals(t, d.Uint64(), uint64(0))
+	common.AssertEquals(t, errors.Is(d.Err(), errInvalid), true)
+}
+
+// TestReadLargeFrame reads the fields of a frame larger than the memory allocated before its bytes
+// are received, a truncated one fails without allocating its length
+func TestReadLargeFrame(t *testing.T) {
+	var buf bytes.Buffer
+	e := testFormat.NewEncoder(0)
+	e.Bytes(bytes.Repeat([]byte("x"), 3*maxPrealloc))
+	common.ExpectNoError(t, testFormat.Write(&buf, e))
+	d, err := testFormat.Read(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, len(d.Bytes()), 3*maxPrealloc)
+	common.ExpectNoError(t, d.Finish())
+
+	header := []byte{'T', 'E', 'S', 'T', 0x3f, 0xff, 0xff, 0xff}
+	_, err = testFormat.Read(bufio.NewReader(bytes.NewReader(append(header, "fields"...))))
+	common.AssertEquals(t, err, io.ErrUnexpectedEOF)
+
+	_, err = testFormat.Read(bufio.NewReader(bytes.NewReader([]byte{'T', 'E', 'S', 'T', 0x7f, 0xff, 0xff, 0xff})))
+	common.AssertEquals(t, errors.Is(err, errInvalid), true)
+}
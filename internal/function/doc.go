@@ -0,0 +1,17 @@
+/*
+Package function implements the libraries of server side functions managed with FUNCTION LOAD
+and invoked with FCALL.
+
+The first line of the library code selects the engine and the library name:
+
+	#!lua name=mylib
+	redis.register_function('myfunc', function(keys, args) return redis.call('GET', keys[1]) end)
+
+	#!go name=mylib
+
+Lua libraries are executed by the script package. Go libraries are compiled into the server:
+embedders register them with the WithGoLibrary option of the public server package and they
+become available once loaded with the "#!go name=<library>" code, which is also what gets
+persisted with the dataset.
+*/
+package function
@@ -0,0 +1,86 @@
+package function
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+)
+
+// RestorePolicy selects how FUNCTION RESTORE handles the libraries already loaded
+type RestorePolicy string
+
+const (
+	// RestoreAppend fails if a restored library already exists
+	RestoreAppend RestorePolicy = "APPEND"
+	// RestoreReplace replaces the existing libraries with the restored ones
+	RestoreReplace RestorePolicy = "REPLACE"
+	// RestoreFlush deletes every library before restoring
+	RestoreFlush RestorePolicy = "FLUSH"
+)
+
+// Dump serializes the code of every library with the redis FUNCTION DUMP format
+func (r *Registry) Dump() []byte {
+	var buf bytes.Buffer
+	e := rdb.NewEncoder(&buf)
+	for _, lib := range r.Libraries() {
+		_ = e.WriteByte(rdb.OpcodeFunction2)
+		e.WriteString(lib.Code)
+	}
+	e.WriteDumpFooter()
+	return buf.Bytes()
+}
+
+// decodeDump validates the payload footer and returns the code of the dumped libraries
+func decodeDump(payload []byte) ([]string, error) {
+	body, err := rdb.DumpBody(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ERR payload version or checksum are wrong")
+	}
+
+	var codes []string
+	d := rdb.NewDecoder(bytes.NewReader(body))
+	for {
+		opcode, err := d.ReadByte()
+		if err != nil {
+			// the body was fully consumed
+			return codes, nil
+		}
+		if opcode != rdb.OpcodeFunction2 {
+			return nil, fmt.Errorf("ERR given type is not a function")
+		}
+		code, err := d.ReadString()
+		if err != nil {
+			return nil, fmt.Errorf("ERR can not read data from given payload")
+		}
+		codes = append(codes, code)
+	}
+}
+
+// Restore loads the libraries of a payload created by Dump, the registry is not modified if any
+// library fails to load
+func (r *Registry) Restore(payload []byte, policy RestorePolicy) error {
+	codes, err := decodeDump(payload)
+	if err != nil {
+		return err
+	}
+
+	restored := NewRegistry()
+	if policy != RestoreFlush {
+		for _, lib := range r.Libraries() {
+			_ = restored.add(lib, false)
+		}
+	}
+	for _, code := range codes {
+		lib, err := newLibrary(code, r.goLibraries)
+		if err != nil {
+			return err
+		}
+		if err := restored.add(lib, policy == RestoreReplace); err != nil {
+			return err
+		}
+	}
+	r.libraries = restored.libraries
+	r.functions = restored.functions
+	return nil
+}
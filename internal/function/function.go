@@ -0,0 +1,223 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rilopez/redis-wire-protocol/internal/script"
+)
+
+const (
+	EngineLua = "LUA"
+	EngineGo  = "GO"
+)
+
+// Caller executes a command issued by a function, it returns the RESP encoded reply
+type Caller = script.Caller
+
+// Function is a function exposed by a library
+type Function struct {
+	Name        string
+	Description string
+	// NoWrites functions can be called with FCALL_RO and can not execute write commands
+	NoWrites bool
+	Call     func(ctx context.Context, call Caller, keys, args []string) (string, error)
+}
+
+// Library is a set of functions loaded together with FUNCTION LOAD
+type Library struct {
+	Name   string
+	Engine string
+	Code   string
+	// Functions are sorted by name
+	Functions []*Function
+}
+
+// goLibraries are the libraries implemented in Go that can be loaded, by name
+type goLibraries map[string][]*Function
+
+func (g goLibraries) load(name string) ([]*Function, error) {
+	functions, exists := g[name]
+	if !exists {
+		return nil, fmt.Errorf("ERR Go library '%s' is not registered in this server", name)
+	}
+	return functions, nil
+}
+
+func loadLuaLibrary(code string) ([]*Function, error) {
+	luaFunctions, err := script.LoadLibrary(code)
+	if err != nil {
+		return nil, err
+	}
+	functions := make([]*Function, 0, len(luaFunctions))
+	for _, f := range luaFunctions {
+		luaFunction := f
+		functions = append(functions, &Function{
+			Name:     f.Name,
+			NoWrites: f.NoWrites,
+			Call: func(ctx context.Context, call Caller, keys, args []string) (string, error) {
+				return luaFunction.Call(ctx, keys, args, call)
+			},
+		})
+	}
+	return functions, nil
+}
+
+// parseMetadata reads the engine and library name from the shebang line
+func parseMetadata(code string) (engine string, name string, err error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", fmt.Errorf("ERR Missing library metadata")
+	}
+	shebang := code[2:]
+	if i := strings.IndexByte(shebang, '\n'); i >= 0 {
+		shebang = shebang[:i]
+	}
+	parts := strings.Fields(shebang)
+	if len(parts) == 0 {
+		return "", "", fmt.Errorf("ERR Missing library metadata")
+	}
+	engine = strings.ToUpper(parts[0])
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = strings.TrimPrefix(part, "name=")
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("ERR Library name was not given")
+	}
+	return engine, name, nil
+}
+
+// newLibrary creates a library from its code, the code of a Go library names one of goLibs
+func newLibrary(code string, goLibs goLibraries) (*Library, error) {
+	engine, name, err := parseMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	var functions []*Function
+	switch engine {
+	case EngineLua:
+		functions, err = loadLuaLibrary(code)
+	case EngineGo:
+		functions, err = goLibs.load(name)
+	default:
+		return nil, fmt.Errorf("ERR Engine '%s' not found", strings.ToLower(engine))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*Function, len(functions))
+	copy(sorted, functions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return &Library{Name: name, Engine: engine, Code: code, Functions: sorted}, nil
+}
+
+// Registry keeps the loaded libraries and indexes their functions by name
+type Registry struct {
+	libraries   map[string]*Library
+	functions   map[string]*Function
+	goLibraries goLibraries
+}
+
+// NewRegistry allocates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		libraries:   make(map[string]*Library),
+		functions:   make(map[string]*Function),
+		goLibraries: make(goLibraries),
+	}
+}
+
+// RegisterGoLibrary makes a library implemented in Go available to Load with the code
+// "#!go name=<name>". It panics if the library is registered twice.
+func (r *Registry) RegisterGoLibrary(name string, functions ...*Function) {
+	if _, exists := r.goLibraries[name]; exists {
+		panic(fmt.Sprintf("go library %s registered twice", name))
+	}
+	r.goLibraries[name] = functions
+}
+
+// Load creates a library from code and adds it, an existing library with the same name is only
+// replaced when replace is true
+func (r *Registry) Load(code string, replace bool) (*Library, error) {
+	lib, err := newLibrary(code, r.goLibraries)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.add(lib, replace); err != nil {
+		return nil, err
+	}
+	return lib, nil
+}
+
+func (r *Registry) add(lib *Library, replace bool) error {
+	old, exists := r.libraries[lib.Name]
+	if exists && !replace {
+		return fmt.Errorf("ERR Library '%s' already exists", lib.Name)
+	}
+	for _, f := range lib.Functions {
+		if owner, taken := r.functions[f.Name]; taken && (old == nil || !old.has(owner)) {
+			return fmt.Errorf("ERR Function %s already exists", f.Name)
+		}
+	}
+	if exists {
+		r.remove(old)
+	}
+	r.libraries[lib.Name] = lib
+	for _, f := range lib.Functions {
+		r.functions[f.Name] = f
+	}
+	return nil
+}
+
+func (l *Library) has(f *Function) bool {
+	for _, libFunction := range l.Functions {
+		if libFunction == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) remove(lib *Library) {
+	for _, f := range lib.Functions {
+		delete(r.functions, f.Name)
+	}
+	delete(r.libraries, lib.Name)
+}
+
+// Delete removes the library name
+func (r *Registry) Delete(name string) error {
+	lib, exists := r.libraries[name]
+	if !exists {
+		return fmt.Errorf("ERR Library not found")
+	}
+	r.remove(lib)
+	return nil
+}
+
+// Flush removes every library
+func (r *Registry) Flush() {
+	r.libraries = make(map[string]*Library)
+	r.functions = make(map[string]*Function)
+}
+
+// Function returns the function name from any library
+func (r *Registry) Function(name string) (*Function, bool) {
+	f, exists := r.functions[name]
+	return f, exists
+}
+
+// Libraries returns the loaded libraries sorted by name
+func (r *Registry) Libraries() []*Library {
+	libraries := make([]*Library, 0, len(r.libraries))
+	for _, lib := range r.libraries {
+		libraries = append(libraries, lib)
+	}
+	sort.Slice(libraries, func(i, j int) bool { return libraries[i].Name < libraries[j].Name })
+	return libraries
+}
@@ -0,0 +1,157 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"strings"
+	"testing"
+)
+
+const luaLibrary = `#!lua name=mylib
+local function echo(keys, args)
+  return args[1]
+end
+redis.register_function('echo', echo)
+redis.register_function{function_name='first_key', callback=function(keys) return keys[1] end, flags={'no-writes'}}
+`
+
+// newRegistry allocates a Registry with the Go library golib registered
+func newRegistry() *Registry {
+	r := NewRegistry()
+	r.RegisterGoLibrary("golib", &Function{
+		Name:     "hello",
+		NoWrites: true,
+		Call: func(ctx context.Context, call Caller, keys, args []string) (string, error) {
+			greeting := "hello " + args[0]
+			return resp.BulkString(&greeting), nil
+		},
+	})
+	return r
+}
+
+func noCalls(args []string) (string, error) {
+	panic("unexpected call")
+}
+
+func TestLoadAndCall(t *testing.T) {
+	r := newRegistry()
+	lib, err := r.Load(luaLibrary, false)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if lib.Name != "mylib" || lib.Engine != EngineLua || len(lib.Functions) != 2 {
+		t.Fatalf("unexpected library %+v", lib)
+	}
+	if _, err := r.Load(luaLibrary, false); err == nil || err.Error() != "ERR Library 'mylib' already exists" {
+		t.Errorf("want library exists error, got %v", err)
+	}
+	if _, err := r.Load(luaLibrary, true); err != nil {
+		t.Errorf("Load() with replace error = %v", err)
+	}
+
+	echo, ok := r.Function("echo")
+	if !ok {
+		t.Fatalf("function echo not found")
+	}
+	got, err := echo.Call(context.Background(), noCalls, nil, []string{"hi"})
+	if err != nil || got != "$2\r\nhi\r\n" {
+		t.Errorf("echo() = %q, %v", got, err)
+	}
+	firstKey, _ := r.Function("first_key")
+	if !firstKey.NoWrites {
+		t.Errorf("first_key should have the no-writes flag")
+	}
+
+	if _, err := r.Load("#!go name=golib", false); err != nil {
+		t.Fatalf("Load() go library error = %v", err)
+	}
+	hello, _ := r.Function("hello")
+	got, err = hello.Call(context.Background(), noCalls, nil, []string{"world"})
+	if err != nil || got != "$11\r\nhello world\r\n" {
+		t.Errorf("hello() = %q, %v", got, err)
+	}
+
+	if err := r.Delete("mylib"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, ok := r.Function("echo"); ok {
+		t.Errorf("echo should be deleted with its library")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		wantErr string
+	}{
+		{name: "missing metadata", code: "return 1", wantErr: "ERR Missing library metadata"},
+		{name: "unknown engine", code: "#!python name=x", wantErr: "ERR Engine 'python' not found"},
+		{name: "missing name", code: "#!lua\nreturn 1", wantErr: "ERR Library name was not given"},
+		{name: "no functions", code: "#!lua name=x\nlocal a = 1", wantErr: "ERR No functions registered"},
+		{name: "unregistered go library", code: "#!go name=missing", wantErr: "ERR Go library 'missing' is not registered"},
+		{name: "redis.call while loading", code: "#!lua name=x\nredis.call('GET', 'x')", wantErr: "can not be used while loading a library"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRegistry().Load(tt.code, false)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	r := newRegistry()
+	if _, err := r.Load(luaLibrary, false); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if _, err := r.Load("#!go name=golib", false); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	payload := r.Dump()
+
+	restored := newRegistry()
+	if err := restored.Restore(payload, RestoreAppend); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if len(restored.Libraries()) != 2 {
+		t.Errorf("want 2 libraries restored, got %d", len(restored.Libraries()))
+	}
+	if err := restored.Restore(payload, RestoreAppend); err == nil {
+		t.Errorf("want error restoring existing libraries with APPEND")
+	}
+	if err := restored.Restore(payload, RestoreReplace); err != nil {
+		t.Errorf("Restore() with REPLACE error = %v", err)
+	}
+	if err := restored.Restore(payload, RestoreFlush); err != nil {
+		t.Errorf("Restore() with FLUSH error = %v", err)
+	}
+
+	payload[0] ^= 0xff
+	if err := restored.Restore(payload, RestoreFlush); err == nil || err.Error() != "ERR payload version or checksum are wrong" {
+		t.Errorf("want checksum error, got %v", err)
+	}
+}
+
+// TestRestoreOversizedLength restores payloads with a valid checksum declaring a library code
+// longer than the payload, they fail without allocating the declared length
+func TestRestoreOversizedLength(t *testing.T) {
+	for _, length := range []uint64{1 << 20, 1 << 62, 1<<64 - 1} {
+		var buf bytes.Buffer
+		e := rdb.NewEncoder(&buf)
+		_ = e.WriteByte(rdb.OpcodeFunction2)
+		e.WriteLength(length)
+		_, _ = e.Write([]byte(luaLibrary))
+		e.WriteDumpFooter()
+
+		r := NewRegistry()
+		err := r.Restore(buf.Bytes(), RestoreAppend)
+		if err == nil || err.Error() != "ERR can not read data from given payload" {
+			t.Errorf("Restore() with a code of %d bytes error = %v", length, err)
+		}
+	}
+}
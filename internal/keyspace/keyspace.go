@@ -0,0 +1,537 @@
+// Package keyspace implements the string keyspace as a hash array mapped trie with copy-on-write
+// snapshots. Taking a snapshot is O(1): it keeps the root of the trie and starts a new generation.
+// The writes after it copy the nodes of older generations on their path, once per snapshot, and
+// modify the nodes of the current generation in place. A snapshot never changes, it can be read
+// from other goroutines while the keyspace keeps changing.
+//
+// The root level of the trie is split in Shards shards, each with its own lock, so the keys of
+// different shards can be read and written in parallel. Goroutines that lock several shards lock
+// them in increasing order, which keeps them from deadlocking.
+package keyspace
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"hash/maphash"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	bitsPerLevel = 5
+	hashBits     = 64
+	// Shards is the number of shards, one for every slot of the root level of the trie
+	Shards = 1 << bitsPerLevel
+)
+
+// node is an inner node of the trie, slots has an element for every bit set in bitmap in the
+// order of the bits
+type node struct {
+	gen    uint64
+	bitmap uint32
+	slots  []slot
+}
+
+// slot holds either a leaf or a child node
+type slot struct {
+	leaf  *leaf
+	child *node
+}
+
+// leaf keeps the entries of a hash, more than one on collisions. Like the nodes, the leaves of the
+// current generation are modified in place and the older ones are copied.
+type leaf struct {
+	gen     uint64
+	hash    uint64
+	entries []entry
+}
+
+type entry struct {
+	key   string
+	value string
+}
+
+// Keyspace is a map of string keys to string values. Get, Set & Delete can be called from several
+// goroutines when they hold the locks of the shards of their keys, the other methods need the
+// keyspace for themselves. The snapshots are safe for concurrent use.
+type Keyspace struct {
+	len    int64
+	shards [Shards]shard
+	gen    uint64
+	hasher hasher
+	// slots indexes the keys by hash slot once IndexSlots is called, for the cluster mode
+	slots []map[string]struct{}
+}
+
+// shard is the subtrie below a slot of the root level, root is a node at depth 1
+type shard struct {
+	mux  sync.Mutex
+	root *node
+}
+
+// ShardSet is a set of shards, the bit i stands for the shard i
+type ShardSet uint32
+
+// New returns an empty Keyspace
+func New() *Keyspace {
+	k := &Keyspace{hasher: hasher{seed: maphash.MakeSeed()}}
+	for i := range k.shards {
+		k.shards[i].root = &node{}
+	}
+	return k
+}
+
+// ShardsOf returns the set of the shards of keys
+func (k *Keyspace) ShardsOf(keys ...string) ShardSet {
+	var set ShardSet
+	for _, key := range keys {
+		set |= 1 << index(k.hasher.hash(key), 0)
+	}
+	return set
+}
+
+// Lock locks the shards of set in increasing order
+func (k *Keyspace) Lock(set ShardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		k.shards[bits.TrailingZeros32(uint32(s))].mux.Lock()
+	}
+}
+
+// Unlock unlocks the shards of set
+func (k *Keyspace) Unlock(set ShardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		k.shards[bits.TrailingZeros32(uint32(s))].mux.Unlock()
+	}
+}
+
+// Len returns the number of keys
+func (k *Keyspace) Len() int {
+	return int(atomic.LoadInt64(&k.len))
+}
+
+// Get returns the value of key
+func (k *Keyspace) Get(key string) (string, bool) {
+	hash := k.hasher.hash(key)
+	return get(k.shards[index(hash, 0)].root, hash, key)
+}
+
+// Set sets key to value and returns its previous value
+func (k *Keyspace) Set(key, value string) (prev string, existed bool) {
+	hash := k.hasher.hash(key)
+	s := &k.shards[index(hash, 0)]
+	s.root, prev, existed = k.insert(s.root, 1, hash, entry{key, value})
+	if !existed {
+		atomic.AddInt64(&k.len, 1)
+		if k.slots != nil {
+			k.slotKeys(key)[key] = struct{}{}
+		}
+	}
+	return prev, existed
+}
+
+// Delete removes key and returns true when it existed
+func (k *Keyspace) Delete(key string) bool {
+	hash := k.hasher.hash(key)
+	s := &k.shards[index(hash, 0)]
+	root, existed := k.remove(s.root, 1, hash, key)
+	if root == nil {
+		root = &node{gen: k.gen}
+	}
+	s.root = root
+	if existed {
+		atomic.AddInt64(&k.len, -1)
+		if k.slots != nil {
+			delete(k.slotKeys(key), key)
+		}
+	}
+	return existed
+}
+
+// IndexSlots indexes the keys by hash slot, the keys set after it are indexed too. The index is
+// shared by the shards, Set & Delete need the keyspace for themselves once it is created.
+func (k *Keyspace) IndexSlots() {
+	if k.slots != nil {
+		return
+	}
+	k.slots = make([]map[string]struct{}, common.NumSlots)
+	_ = k.ForEach(func(key, _ string) error {
+		k.slotKeys(key)[key] = struct{}{}
+		return nil
+	})
+}
+
+func (k *Keyspace) slotKeys(key string) map[string]struct{} {
+	slot := common.KeySlot(key)
+	if k.slots[slot] == nil {
+		k.slots[slot] = make(map[string]struct{})
+	}
+	return k.slots[slot]
+}
+
+// CountKeysInSlot returns the number of keys in the hash slot, the slots must be indexed
+func (k *Keyspace) CountKeysInSlot(slot int) int {
+	return len(k.slots[slot])
+}
+
+// KeysInSlot returns up to count keys of the hash slot, the slots must be indexed
+func (k *Keyspace) KeysInSlot(slot int, count int) []string {
+	if n := len(k.slots[slot]); count > n {
+		count = n
+	}
+	keys := make([]string, 0, count)
+	for key := range k.slots[slot] {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ForEach calls fn for every key in hash order, it stops at the first error. The keyspace must
+// not be modified by fn.
+func (k *Keyspace) ForEach(fn func(key, value string) error) error {
+	return forEachShard(k.roots(), fn)
+}
+
+// Scan returns at least count keys, when there are enough, with a hash equal or greater than
+// cursor and the cursor to continue, 0 once every key was returned. A key present during the
+// whole iteration is returned at least once, like the redis SCAN guarantees.
+func (k *Keyspace) Scan(cursor uint64, count int) (uint64, []string) {
+	return scan(k.roots(), cursor, count)
+}
+
+// Snapshot returns the keyspace at this instant, the next writes copy the nodes they modify
+func (k *Keyspace) Snapshot() *Snapshot {
+	k.gen++
+	return &Snapshot{roots: k.roots(), len: k.Len(), hasher: k.hasher}
+}
+
+func (k *Keyspace) roots() [Shards]*node {
+	var roots [Shards]*node
+	for i := range k.shards {
+		roots[i] = k.shards[i].root
+	}
+	return roots
+}
+
+// Snapshot is an immutable view of the keyspace, safe for concurrent use
+type Snapshot struct {
+	roots  [Shards]*node
+	len    int
+	hasher hasher
+}
+
+// Len returns the number of keys
+func (s *Snapshot) Len() int {
+	return s.len
+}
+
+// Get returns the value key had when the snapshot was taken
+func (s *Snapshot) Get(key string) (string, bool) {
+	hash := s.hasher.hash(key)
+	return get(s.roots[index(hash, 0)], hash, key)
+}
+
+// ForEach calls fn for every key in hash order, it stops at the first error
+func (s *Snapshot) ForEach(fn func(key, value string) error) error {
+	return forEachShard(s.roots, fn)
+}
+
+// Scan works like Keyspace.Scan on the keys of the snapshot
+func (s *Snapshot) Scan(cursor uint64, count int) (uint64, []string) {
+	return scan(s.roots, cursor, count)
+}
+
+// hasher hashes the keys with a direct call, unlike a function value, so the keys looked up do not
+// escape. collisions limits the hashes to that many values when it is not 0, for the tests.
+type hasher struct {
+	seed       maphash.Seed
+	collisions uint64
+}
+
+func (h hasher) hash(key string) uint64 {
+	var mh maphash.Hash
+	mh.SetSeed(h.seed)
+	_, _ = mh.WriteString(key)
+	if h.collisions != 0 {
+		return ^uint64(0) - mh.Sum64()%h.collisions
+	}
+	return mh.Sum64()
+}
+
+// index returns the slot of hash at depth, the levels consume the hash from its most significant
+// bits so the slots are in hash order
+func index(hash uint64, depth int) uint {
+	remaining := hashBits - bitsPerLevel*depth
+	if remaining >= bitsPerLevel {
+		return uint(hash>>(remaining-bitsPerLevel)) & (1<<bitsPerLevel - 1)
+	}
+	return uint(hash) & (1<<remaining - 1)
+}
+
+func (n *node) position(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+// writable returns n when it belongs to the current generation or a copy of it
+func (k *Keyspace) writable(n *node) *node {
+	if n.gen == k.gen {
+		return n
+	}
+	slots := make([]slot, len(n.slots), len(n.slots)+1)
+	copy(slots, n.slots)
+	return &node{gen: k.gen, bitmap: n.bitmap, slots: slots}
+}
+
+// get looks key up in the root of a shard
+func get(n *node, hash uint64, key string) (string, bool) {
+	for depth := 1; ; depth++ {
+		bit := uint32(1) << index(hash, depth)
+		if n.bitmap&bit == 0 {
+			return "", false
+		}
+		s := n.slots[n.position(bit)]
+		if s.child != nil {
+			n = s.child
+			continue
+		}
+		if s.leaf.hash != hash {
+			return "", false
+		}
+		for _, e := range s.leaf.entries {
+			if e.key == key {
+				return e.value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// insert adds e, with the given hash, to the subtrie n
+func (k *Keyspace) insert(n *node, depth int, hash uint64, e entry) (*node, string, bool) {
+	n = k.writable(n)
+	bit := uint32(1) << index(hash, depth)
+	pos := n.position(bit)
+	if n.bitmap&bit == 0 {
+		n.slots = append(n.slots, slot{})
+		copy(n.slots[pos+1:], n.slots[pos:])
+		n.slots[pos] = slot{leaf: k.newLeaf(hash, e)}
+		n.bitmap |= bit
+		return n, "", false
+	}
+	s := n.slots[pos]
+	if s.child != nil {
+		child, prev, existed := k.insert(s.child, depth+1, hash, e)
+		n.slots[pos].child = child
+		return n, prev, existed
+	}
+	if s.leaf.hash == hash {
+		merged, prev, existed := k.with(s.leaf, e)
+		n.slots[pos].leaf = merged
+		return n, prev, existed
+	}
+	n.slots[pos] = slot{child: k.split(depth+1, s.leaf, k.newLeaf(hash, e))}
+	return n, "", false
+}
+
+func (k *Keyspace) newLeaf(hash uint64, e entry) *leaf {
+	return &leaf{gen: k.gen, hash: hash, entries: []entry{e}}
+}
+
+// split returns a node at depth with the leaves a & b, which have different hashes
+func (k *Keyspace) split(depth int, a, b *leaf) *node {
+	n := &node{gen: k.gen}
+	ia, ib := index(a.hash, depth), index(b.hash, depth)
+	if ia == ib {
+		n.bitmap = 1 << ia
+		n.slots = []slot{{child: k.split(depth+1, a, b)}}
+		return n
+	}
+	if ia > ib {
+		a, b, ia, ib = b, a, ib, ia
+	}
+	n.bitmap = 1<<ia | 1<<ib
+	n.slots = []slot{{leaf: a}, {leaf: b}}
+	return n
+}
+
+// with adds e to l or replaces the entry with the same key, l is copied unless it belongs to the
+// current generation
+func (k *Keyspace) with(l *leaf, e entry) (*leaf, string, bool) {
+	if l.gen == k.gen {
+		for i := range l.entries {
+			if l.entries[i].key == e.key {
+				prev := l.entries[i].value
+				l.entries[i].value = e.value
+				return l, prev, true
+			}
+		}
+		l.entries = append(l.entries, e)
+		return l, "", false
+	}
+	entries := make([]entry, 0, len(l.entries)+1)
+	var prev string
+	existed := false
+	for _, old := range l.entries {
+		if old.key == e.key {
+			prev, existed = old.value, true
+			continue
+		}
+		entries = append(entries, old)
+	}
+	return &leaf{gen: k.gen, hash: l.hash, entries: append(entries, e)}, prev, existed
+}
+
+// remove deletes key from the subtrie n, it returns nil when n ends empty
+func (k *Keyspace) remove(n *node, depth int, hash uint64, key string) (*node, bool) {
+	bit := uint32(1) << index(hash, depth)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	pos := n.position(bit)
+	s := n.slots[pos]
+	var replacement slot
+	if s.child != nil {
+		child, existed := k.remove(s.child, depth+1, hash, key)
+		if !existed {
+			return n, false
+		}
+		if child != nil && len(child.slots) == 1 && child.slots[0].leaf != nil {
+			// a node with a single leaf is replaced by the leaf
+			replacement = child.slots[0]
+		} else if child != nil {
+			replacement = slot{child: child}
+		}
+	} else {
+		if s.leaf.hash != hash {
+			return n, false
+		}
+		entries := make([]entry, 0, len(s.leaf.entries))
+		for _, e := range s.leaf.entries {
+			if e.key != key {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) == len(s.leaf.entries) {
+			return n, false
+		}
+		if len(entries) > 0 {
+			replacement = slot{leaf: &leaf{gen: k.gen, hash: hash, entries: entries}}
+		}
+	}
+
+	n = k.writable(n)
+	if replacement.leaf != nil || replacement.child != nil {
+		n.slots[pos] = replacement
+		return n, true
+	}
+	n.slots = append(n.slots[:pos], n.slots[pos+1:]...)
+	n.bitmap &^= bit
+	if len(n.slots) == 0 {
+		return nil, true
+	}
+	return n, true
+}
+
+func forEachShard(roots [Shards]*node, fn func(key, value string) error) error {
+	for _, root := range roots {
+		if err := forEach(root, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEach(n *node, fn func(key, value string) error) error {
+	for _, s := range n.slots {
+		if s.child != nil {
+			if err := forEach(s.child, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, e := range s.leaf.entries {
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan collects the keys with a hash >= cursor in hash order, it stops after a leaf once it has
+// count keys. The shards are the slots of the root level, in hash order too.
+func scan(roots [Shards]*node, cursor uint64, count int) (uint64, []string) {
+	var keys []string
+	var last *leaf
+	var walk func(n *node, depth int, prefix uint64) bool
+	walk = func(n *node, depth int, prefix uint64) bool {
+		for _, s := range n.slots {
+			var idx uint
+			if s.leaf != nil {
+				idx = index(s.leaf.hash, depth)
+			} else {
+				idx = childIndex(s.child, depth)
+			}
+			low, high := subtrieRange(prefix, depth, idx)
+			if high < cursor {
+				continue
+			}
+			if s.child != nil {
+				if walk(s.child, depth+1, low) {
+					return true
+				}
+				continue
+			}
+			if s.leaf.hash < cursor {
+				continue
+			}
+			for _, e := range s.leaf.entries {
+				keys = append(keys, e.key)
+			}
+			last = s.leaf
+			if len(keys) >= count {
+				return true
+			}
+		}
+		return false
+	}
+	for i, root := range roots {
+		low, high := subtrieRange(0, 0, uint(i))
+		if high < cursor {
+			continue
+		}
+		if walk(root, 1, low) {
+			if last.hash == ^uint64(0) {
+				return 0, keys
+			}
+			return last.hash + 1, keys
+		}
+	}
+	return 0, keys
+}
+
+// childIndex returns the slot of child in its parent at depth from any leaf below it
+func childIndex(child *node, depth int) uint {
+	for {
+		s := child.slots[0]
+		if s.leaf != nil {
+			return index(s.leaf.hash, depth)
+		}
+		child = s.child
+	}
+}
+
+// subtrieRange returns the lowest & highest hashes stored below the slot idx of the node at
+// depth whose hashes start with prefix
+func subtrieRange(prefix uint64, depth int, idx uint) (uint64, uint64) {
+	remaining := hashBits - bitsPerLevel*depth
+	width := bitsPerLevel
+	if remaining < bitsPerLevel {
+		width = remaining
+	}
+	shift := uint(remaining - width)
+	low := prefix | uint64(idx)<<shift
+	return low, low | (uint64(1)<<shift - 1)
+}
@@ -0,0 +1,235 @@
+package keyspace
+
+import (
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func contents(t *testing.T, forEach func(fn func(key, value string) error) error) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	err := forEach(func(key, value string) error {
+		if _, dup := m[key]; dup {
+			t.Errorf("key %s returned twice", key)
+		}
+		m[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach() error = %v", err)
+	}
+	return m
+}
+
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// testKeyspace checks the keyspace against a map, the snapshots taken while it changes must keep
+// the contents of the map at the time they were taken
+func testKeyspace(t *testing.T, k *Keyspace, keys int, ops int) {
+	r := rand.New(rand.NewSource(1))
+	model := make(map[string]string)
+	type taken struct {
+		snapshot *Snapshot
+		model    map[string]string
+	}
+	var snapshots []taken
+	for i := 0; i < ops; i++ {
+		key := "key:" + strconv.Itoa(r.Intn(keys))
+		switch op := r.Intn(10); {
+		case op < 6:
+			value := strconv.Itoa(i)
+			prev, existed := k.Set(key, value)
+			want, wantExisted := model[key]
+			if prev != want || existed != wantExisted {
+				t.Fatalf("Set(%s) = %q, %v, want %q, %v", key, prev, existed, want, wantExisted)
+			}
+			model[key] = value
+		case op < 9:
+			_, want := model[key]
+			if got := k.Delete(key); got != want {
+				t.Fatalf("Delete(%s) = %v, want %v", key, got, want)
+			}
+			delete(model, key)
+		default:
+			copied := make(map[string]string, len(model))
+			for k, v := range model {
+				copied[k] = v
+			}
+			snapshots = append(snapshots, taken{snapshot: k.Snapshot(), model: copied})
+		}
+		value, exists := k.Get(key)
+		if want, wantExists := model[key]; value != want || exists != wantExists {
+			t.Fatalf("Get(%s) = %q, %v, want %q, %v", key, value, exists, want, wantExists)
+		}
+	}
+	if k.Len() != len(model) {
+		t.Errorf("Len() = %d, want %d", k.Len(), len(model))
+	}
+	if got := contents(t, k.ForEach); !equalMaps(got, model) {
+		t.Errorf("ForEach() = %v, want %v", got, model)
+	}
+	for i, s := range snapshots {
+		if s.snapshot.Len() != len(s.model) {
+			t.Errorf("snapshot %d Len() = %d, want %d", i, s.snapshot.Len(), len(s.model))
+		}
+		if got := contents(t, s.snapshot.ForEach); !equalMaps(got, s.model) {
+			t.Errorf("snapshot %d changed after it was taken", i)
+		}
+	}
+}
+
+func TestKeyspace(t *testing.T) {
+	testKeyspace(t, New(), 500, 20_000)
+}
+
+func TestKeyspaceCollisions(t *testing.T) {
+	k := New()
+	// 4 hashes for all the keys, every leaf has collisions & the trie is as deep as it gets
+	k.hasher.collisions = 4
+	testKeyspace(t, k, 50, 5_000)
+}
+
+func TestScan(t *testing.T) {
+	k := New()
+	for i := 0; i < 1000; i++ {
+		k.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+	// keys deleted & added during the scan may be returned or not, the rest must be returned
+	seen := make(map[string]bool)
+	var cursor uint64
+	var keys []string
+	for i := 0; ; i++ {
+		cursor, keys = k.Scan(cursor, 10)
+		for _, key := range keys {
+			seen[key] = true
+		}
+		k.Delete(fmt.Sprintf("key:%d", 900+i))
+		k.Set(fmt.Sprintf("new:%d", i), "v")
+		if cursor == 0 {
+			break
+		}
+		if len(keys) < 10 {
+			t.Errorf("Scan() returned %d keys before the end, want 10 or more", len(keys))
+		}
+	}
+	for i := 0; i < 900; i++ {
+		if !seen[fmt.Sprintf("key:%d", i)] {
+			t.Errorf("key:%d not returned by Scan", i)
+		}
+	}
+}
+
+func TestSnapshotConcurrentReads(t *testing.T) {
+	k := New()
+	for i := 0; i < 10_000; i++ {
+		k.Set(strconv.Itoa(i), "old")
+	}
+	snapshot := k.Snapshot()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var values []string
+	go func() {
+		defer wg.Done()
+		_ = snapshot.ForEach(func(key, value string) error {
+			values = append(values, value)
+			return nil
+		})
+	}()
+	for i := 0; i < 10_000; i++ {
+		k.Set(strconv.Itoa(i), "new")
+		k.Delete(strconv.Itoa(i / 2))
+	}
+	wg.Wait()
+
+	sort.Strings(values)
+	if len(values) != 10_000 || values[0] != "old" || values[len(values)-1] != "old" {
+		t.Errorf("snapshot read values written after it was taken")
+	}
+	if value, _ := snapshot.Get("1"); value != "old" {
+		t.Errorf("snapshot Get() = %s, want old", value)
+	}
+}
+
+// TestShardLocks moves units between random pairs of keys from several goroutines, the total must
+// not change and the goroutines locking the same shards in opposite orders must not deadlock
+func TestShardLocks(t *testing.T) {
+	const keys, goroutines, moves = 100, 8, 2_000
+	k := New()
+	for i := 0; i < keys; i++ {
+		k.Set(strconv.Itoa(i), "100")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < moves; i++ {
+				from, to := strconv.Itoa(r.Intn(keys)), strconv.Itoa(r.Intn(keys))
+				set := k.ShardsOf(from, to)
+				k.Lock(set)
+				a, _ := k.Get(from)
+				n, _ := strconv.Atoi(a)
+				k.Set(from, strconv.Itoa(n-1))
+				b, _ := k.Get(to)
+				m, _ := strconv.Atoi(b)
+				k.Set(to, strconv.Itoa(m+1))
+				k.Unlock(set)
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	total := 0
+	_ = k.ForEach(func(key, value string) error {
+		n, _ := strconv.Atoi(value)
+		total += n
+		return nil
+	})
+	if total != keys*100 || k.Len() != keys {
+		t.Errorf("total = %d with %d keys, want %d with %d keys", total, k.Len(), keys*100, keys)
+	}
+}
+
+func TestSlotIndex(t *testing.T) {
+	k := New()
+	k.Set("{user1}.name", "a")
+	k.IndexSlots()
+	k.Set("{user1}.email", "b")
+	k.Set("{user1}.email", "c")
+	k.Set("other", "d")
+	slot := common.KeySlot("user1")
+	if got := k.CountKeysInSlot(slot); got != 2 {
+		t.Errorf("CountKeysInSlot() = %d, want 2", got)
+	}
+	keys := k.KeysInSlot(slot, 10)
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[{user1}.email {user1}.name]" {
+		t.Errorf("KeysInSlot() = %v", keys)
+	}
+	if got := len(k.KeysInSlot(slot, 1)); got != 1 {
+		t.Errorf("KeysInSlot(count 1) returned %d keys", got)
+	}
+	k.Delete("{user1}.name")
+	k.Delete("missing")
+	if got := k.CountKeysInSlot(slot); got != 1 {
+		t.Errorf("CountKeysInSlot() after Delete = %d, want 1", got)
+	}
+}
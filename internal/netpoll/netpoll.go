@@ -0,0 +1,26 @@
+// Package netpoll serves TCP connections without a goroutine per connection. A Poller accepts the
+// connections of a port and spreads them over a few I/O goroutines, each one waiting for all its
+// connections with its own epoll instance. The bytes read are handed to a Handler, which consumes
+// the complete requests and writes the responses to the connection. The per-connection input &
+// output buffers are only allocated while they hold bytes and are reused by the other connections
+// once empty, an idle connection costs its file descriptor and a few words.
+//
+// It is only implemented on Linux, Listen fails on the other systems.
+package netpoll
+
+import "errors"
+
+// ErrClosed is returned by the writes on a closed connection
+var ErrClosed = errors.New("netpoll: use of closed connection")
+
+// Handler processes the connections of a Poller. Its methods are called from the I/O goroutine of
+// the connection, the connections of an I/O goroutine wait while they run.
+type Handler interface {
+	// Open is called for every accepted connection, the connection is closed when it fails
+	Open(c *Conn) error
+	// Data is called with the bytes received and not consumed yet, it returns how many it consumed.
+	// in is only valid during the call.
+	Data(c *Conn, in []byte) int
+	// Closed is called once the connection is closed, by the peer or with Close
+	Closed(c *Conn)
+}
@@ -0,0 +1,626 @@
+package netpoll
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// readBufferSize is the size of the buffer every I/O goroutine reads into
+	readBufferSize = 64 << 10
+	// bufferSize is the initial capacity of the per-connection buffers, the ones that grew over
+	// maxReusedBufferSize are not reused
+	bufferSize          = 4 << 10
+	maxReusedBufferSize = 64 << 10
+	maxEvents           = 256
+	// epollExclusive wakes a single I/O goroutine for a new connection, available since Linux 4.5
+	epollExclusive = 1 << 28
+)
+
+var (
+	buffers = sync.Pool{New: func() interface{} {
+		return &buffer{b: make([]byte, 0, bufferSize)}
+	}}
+	wakeByte = []byte{1}
+)
+
+// buffer is a pooled input or output buffer, the pool keeps pointers so putting a buffer back does
+// not allocate
+type buffer struct {
+	b []byte
+}
+
+func getBuffer() *buffer {
+	return buffers.Get().(*buffer)
+}
+
+func putBuffer(buf *buffer) {
+	if cap(buf.b) > maxReusedBufferSize {
+		return
+	}
+	buf.b = buf.b[:0]
+	buffers.Put(buf)
+}
+
+// Poller accepts the connections of a port and serves them from a few I/O goroutines
+type Poller struct {
+	listenFD int
+	handler  Handler
+	loops    []*ioLoop
+	// listening counts the I/O goroutines still polling the listener, the last one closes it
+	listening int32
+}
+
+// Listen opens a listener on port and starts ioGoroutines goroutines serving its connections with
+// handler. wg is done once they stopped after Close.
+func Listen(port uint, ioGoroutines int, handler Handler, wg *sync.WaitGroup) (*Poller, error) {
+	if ioGoroutines < 1 {
+		return nil, fmt.Errorf("netpoll: %d I/O goroutines", ioGoroutines)
+	}
+	fd, err := listenSocket(port)
+	if err != nil {
+		return nil, err
+	}
+	p := &Poller{listenFD: fd, handler: handler, listening: int32(ioGoroutines)}
+	for i := 0; i < ioGoroutines; i++ {
+		l, err := newLoop(p)
+		if err != nil {
+			for _, l := range p.loops {
+				l.closeFDs()
+			}
+			_ = syscall.Close(fd)
+			return nil, err
+		}
+		p.loops = append(p.loops, l)
+	}
+	wg.Add(len(p.loops))
+	for _, l := range p.loops {
+		go l.run(wg)
+	}
+	return p, nil
+}
+
+// listenSocket opens a non-blocking listener on every address, IPv4 and IPv6 when available
+func listenSocket(port uint) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	var sa syscall.Sockaddr = &syscall.SockaddrInet6{Port: int(port)}
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	} else {
+		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+		sa = &syscall.SockaddrInet4{Port: int(port)}
+	}
+	if err != nil {
+		return -1, fmt.Errorf("netpoll: socket: %w", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("netpoll: setsockopt: %w", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("netpoll: bind port %d: %w", port, err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		_ = syscall.Close(fd)
+		return -1, fmt.Errorf("netpoll: listen: %w", err)
+	}
+	return fd, nil
+}
+
+// Close stops accepting connections and closes the open ones, the handler gets their Closed
+// calls. It does not wait for the I/O goroutines.
+func (p *Poller) Close() {
+	for _, l := range p.loops {
+		l.mux.Lock()
+		l.stopping = true
+		wake := l.sleeping
+		l.sleeping = false
+		l.mux.Unlock()
+		if wake {
+			l.wake()
+		}
+	}
+}
+
+// Conn is a connection served by a Poller. Write, Close & Resume can be called from any goroutine,
+// Pause only from the Handler.
+type Conn struct {
+	// Context keeps the state of the handler for the connection
+	Context    interface{}
+	fd         int
+	loop       *ioLoop
+	remoteAddr string
+	// open is set once Handler.Open accepted the connection
+	open bool
+	// in keeps the bytes received and not consumed, paused & writing select the epoll events. They
+	// are only used by the I/O goroutine.
+	in      *buffer
+	paused  bool
+	writing bool
+
+	mux sync.Mutex
+	// flushed is signaled when out is sent or the connection is closed
+	flushed *sync.Cond
+	out     *buffer
+	// queued is set while the connection is in the pending list of its I/O goroutine
+	queued  bool
+	resume  bool
+	closing bool
+	closed  bool
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// Write queues p to be sent by the I/O goroutine, it never blocks
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return 0, ErrClosed
+	}
+	if c.out == nil {
+		c.out = getBuffer()
+	}
+	c.out.b = append(c.out.b, p...)
+	c.enqueueLocked()
+	return len(p), nil
+}
+
+// WriteString is Write for strings
+func (c *Conn) WriteString(s string) (int, error) {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return 0, ErrClosed
+	}
+	if c.out == nil {
+		c.out = getBuffer()
+	}
+	c.out.b = append(c.out.b, s...)
+	c.enqueueLocked()
+	return len(s), nil
+}
+
+// Append calls appendTo with the output buffer and keeps what it returns, the bytes it appended are
+// sent like the ones written. It runs holding the lock of the connection, so it must not block and
+// must not keep the buffer.
+func (c *Conn) Append(appendTo func(out []byte) []byte) error {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return ErrClosed
+	}
+	if c.out == nil {
+		c.out = getBuffer()
+	}
+	c.out.b = appendTo(c.out.b)
+	c.enqueueLocked()
+	return nil
+}
+
+// Buffered returns the number of bytes written and not sent yet
+func (c *Conn) Buffered() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.out == nil {
+		return 0
+	}
+	return len(c.out.b)
+}
+
+// Flush waits until the bytes written are sent, it must not be called from the Handler. It does
+// not wait once Close was called.
+func (c *Conn) Flush() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for c.out != nil && !c.closed && !c.closing {
+		c.flushed.Wait()
+	}
+	if c.closed || c.closing {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close closes the connection once the bytes written are sent, when the peer reads them
+func (c *Conn) Close() error {
+	c.mux.Lock()
+	c.closing = true
+	c.enqueueLocked()
+	return nil
+}
+
+// Pause stops handing the bytes received to the Handler until Resume
+func (c *Conn) Pause() {
+	c.paused = true
+	c.loop.updateEvents(c)
+}
+
+// Resume hands the bytes received to the Handler again
+func (c *Conn) Resume() {
+	c.mux.Lock()
+	c.resume = true
+	c.enqueueLocked()
+}
+
+// enqueueLocked adds the connection to the pending list of its I/O goroutine and unlocks mux
+func (c *Conn) enqueueLocked() {
+	queued := c.queued
+	c.queued = true
+	c.mux.Unlock()
+	if !queued {
+		c.loop.enqueue(c)
+	}
+}
+
+// ioLoop is an I/O goroutine with its epoll instance, wakeR is polled too so other goroutines can
+// wake it writing to wakeW. The epoll instance is itself polled by the runtime through epoll, the
+// I/O goroutine waits for its events like the goroutines reading from a net.Conn instead of keeping
+// a thread, and its P, blocked in epoll_wait.
+type ioLoop struct {
+	poller       *Poller
+	epfd         int
+	epoll        *os.File
+	rawEpoll     syscall.RawConn
+	wakeR, wakeW int
+	// conns, buf & the results of epoll_wait are only used by the I/O goroutine
+	conns     map[int]*Conn
+	buf       []byte
+	events    []syscall.EpollEvent
+	ready     int
+	pollErr   error
+	pollReady func(fd uintptr) bool
+
+	mux sync.Mutex
+	// pending are the connections with bytes to send or changes to apply
+	pending  []*Conn
+	spare    []*Conn
+	sleeping bool
+	stopping bool
+	stopped  bool
+}
+
+func newLoop(p *Poller) (*ioLoop, error) {
+	l := &ioLoop{poller: p, epfd: -1, wakeR: -1, wakeW: -1, conns: make(map[int]*Conn)}
+	var err error
+	if l.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, fmt.Errorf("netpoll: epoll_create1: %w", err)
+	}
+	// os.NewFile adds the descriptors in non-blocking mode to the poller of the runtime
+	if err := syscall.SetNonblock(l.epfd, true); err != nil {
+		l.closeFDs()
+		return nil, fmt.Errorf("netpoll: epoll non-blocking: %w", err)
+	}
+	l.epoll = os.NewFile(uintptr(l.epfd), "epoll")
+	if l.rawEpoll, err = l.epoll.SyscallConn(); err != nil {
+		l.closeFDs()
+		return nil, fmt.Errorf("netpoll: epoll: %w", err)
+	}
+	l.events = make([]syscall.EpollEvent, maxEvents)
+	// the method value is kept, one made for every wait would be allocated
+	l.pollReady = l.pollEvents
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		l.closeFDs()
+		return nil, fmt.Errorf("netpoll: pipe2: %w", err)
+	}
+	l.wakeR, l.wakeW = wake[0], wake[1]
+	if err := l.ctl(syscall.EPOLL_CTL_ADD, l.wakeR, syscall.EPOLLIN); err != nil {
+		l.closeFDs()
+		return nil, err
+	}
+	if err := l.ctl(syscall.EPOLL_CTL_ADD, p.listenFD, syscall.EPOLLIN|epollExclusive); err != nil {
+		if err = l.ctl(syscall.EPOLL_CTL_ADD, p.listenFD, syscall.EPOLLIN); err != nil {
+			l.closeFDs()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *ioLoop) ctl(op int, fd int, events uint32) error {
+	if err := syscall.EpollCtl(l.epfd, op, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)}); err != nil {
+		return fmt.Errorf("netpoll: epoll_ctl: %w", err)
+	}
+	return nil
+}
+
+func (l *ioLoop) closeFDs() {
+	if l.epoll != nil {
+		_ = l.epoll.Close()
+	} else if l.epfd >= 0 {
+		_ = syscall.Close(l.epfd)
+	}
+	for _, fd := range []int{l.wakeR, l.wakeW} {
+		if fd >= 0 {
+			_ = syscall.Close(fd)
+		}
+	}
+}
+
+// poll returns the number of events in l.events, waiting for them when block is set
+func (l *ioLoop) poll(block bool) (int, error) {
+	if !block {
+		l.pollEvents(0)
+	} else if err := l.rawEpoll.Read(l.pollReady); err != nil {
+		return 0, err
+	}
+	return l.ready, l.pollErr
+}
+
+// pollEvents gets the events without waiting, it returns false when the runtime has to wait until
+// the epoll instance is readable
+func (l *ioLoop) pollEvents(uintptr) bool {
+	l.ready, l.pollErr = syscall.EpollWait(l.epfd, l.events, 0)
+	return l.ready > 0 || l.pollErr != nil
+}
+
+func (l *ioLoop) wake() {
+	if _, err := syscall.Write(l.wakeW, wakeByte); err != nil && err != syscall.EAGAIN {
+		log.Printf("ERR netpoll: waking an I/O goroutine: %v", err)
+	}
+}
+
+func (l *ioLoop) enqueue(c *Conn) {
+	l.mux.Lock()
+	if l.stopped {
+		l.mux.Unlock()
+		return
+	}
+	l.pending = append(l.pending, c)
+	wake := l.sleeping
+	l.sleeping = false
+	l.mux.Unlock()
+	if wake {
+		l.wake()
+	}
+}
+
+func (l *ioLoop) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	l.buf = make([]byte, readBufferSize)
+	for {
+		l.mux.Lock()
+		pending, stopping := l.pending, l.stopping
+		l.pending, l.spare = l.spare[:0], pending
+		l.sleeping = len(pending) == 0 && !stopping
+		l.mux.Unlock()
+		if stopping {
+			l.stop()
+			return
+		}
+		for i, c := range pending {
+			l.process(c)
+			pending[i] = nil
+		}
+
+		// the connections with changes do not wait for the events of the others
+		n, err := l.poll(len(pending) == 0)
+		l.mux.Lock()
+		l.sleeping = false
+		l.mux.Unlock()
+		if err != nil {
+			if err != syscall.EINTR {
+				log.Printf("ERR netpoll: epoll_wait: %v", err)
+			}
+			continue
+		}
+		for _, ev := range l.events[:n] {
+			switch fd := int(ev.Fd); fd {
+			case l.wakeR:
+				for {
+					if _, err := syscall.Read(l.wakeR, l.buf); err != nil {
+						break
+					}
+				}
+			case l.poller.listenFD:
+				l.accept()
+			default:
+				if c := l.conns[fd]; c != nil {
+					l.handleEvents(c, ev.Events)
+				}
+			}
+		}
+	}
+}
+
+func (l *ioLoop) handleEvents(c *Conn, events uint32) {
+	if events&syscall.EPOLLOUT != 0 && !l.flush(c) {
+		l.close(c)
+		return
+	}
+	switch {
+	case events&syscall.EPOLLIN != 0 && !c.paused:
+		l.read(c)
+	case events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0:
+		l.close(c)
+	}
+}
+
+func (l *ioLoop) accept() {
+	fd, sa, err := syscall.Accept4(l.poller.listenFD, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+	if err != nil {
+		if err != syscall.EAGAIN && err != syscall.ECONNABORTED && err != syscall.EINTR {
+			log.Printf("ERR netpoll: accept: %v", err)
+		}
+		return
+	}
+	_ = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	c := &Conn{fd: fd, loop: l, remoteAddr: remoteAddr(sa)}
+	c.flushed = sync.NewCond(&c.mux)
+	if err := l.ctl(syscall.EPOLL_CTL_ADD, fd, syscall.EPOLLIN); err != nil {
+		log.Printf("ERR %v", err)
+		_ = syscall.Close(fd)
+		return
+	}
+	// the connection is registered first, the handler can close it as soon as it is open
+	l.conns[fd] = c
+	if err := l.poller.handler.Open(c); err != nil {
+		l.close(c)
+		return
+	}
+	c.open = true
+}
+
+func remoteAddr(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	case *syscall.SockaddrInet6:
+		return (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	}
+	return "unknown"
+}
+
+// process applies the changes made by other goroutines to c
+func (l *ioLoop) process(c *Conn) {
+	if l.conns[c.fd] != c {
+		return
+	}
+	c.mux.Lock()
+	resume, closing := c.resume, c.closing
+	c.queued, c.resume = false, false
+	c.mux.Unlock()
+	if !l.flush(c) || closing {
+		l.close(c)
+		return
+	}
+	if resume && c.paused {
+		c.paused = false
+		l.updateEvents(c)
+		if c.in != nil {
+			l.handle(c, nil)
+		}
+	}
+}
+
+func (l *ioLoop) updateEvents(c *Conn) {
+	var events uint32
+	if !c.paused {
+		events |= syscall.EPOLLIN
+	}
+	if c.writing {
+		events |= syscall.EPOLLOUT
+	}
+	if err := l.ctl(syscall.EPOLL_CTL_MOD, c.fd, events); err != nil {
+		log.Printf("ERR %v", err)
+	}
+}
+
+func (l *ioLoop) read(c *Conn) {
+	n, err := syscall.Read(c.fd, l.buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if n <= 0 || err != nil {
+		l.close(c)
+		return
+	}
+	l.handle(c, l.buf[:n])
+}
+
+// handle hands the bytes kept in c.in followed by received to the handler and keeps the rest
+func (l *ioLoop) handle(c *Conn, received []byte) {
+	in := received
+	if c.in != nil {
+		c.in.b = append(c.in.b, received...)
+		in = c.in.b
+	}
+	rest := in[l.poller.handler.Data(c, in):]
+	switch {
+	case c.in == nil && len(rest) > 0:
+		c.in = getBuffer()
+		c.in.b = append(c.in.b, rest...)
+	case c.in != nil && len(rest) == 0:
+		putBuffer(c.in)
+		c.in = nil
+	case c.in != nil:
+		c.in.b = c.in.b[:copy(c.in.b, rest)]
+	}
+	if l.conns[c.fd] == c && !l.flush(c) {
+		l.close(c)
+	}
+}
+
+// flush sends as much output as the socket takes, it returns false when the connection failed. The
+// output buffer goes back to the pool once empty.
+func (l *ioLoop) flush(c *Conn) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for c.out != nil && len(c.out.b) > 0 {
+		n, err := syscall.Write(c.fd, c.out.b)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			if !c.writing {
+				c.writing = true
+				l.updateEvents(c)
+			}
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		c.out.b = c.out.b[:copy(c.out.b, c.out.b[n:])]
+	}
+	if c.out != nil {
+		putBuffer(c.out)
+		c.out = nil
+	}
+	if c.writing {
+		c.writing = false
+		l.updateEvents(c)
+	}
+	c.flushed.Broadcast()
+	return true
+}
+
+func (l *ioLoop) close(c *Conn) {
+	if l.conns[c.fd] != c {
+		return
+	}
+	delete(l.conns, c.fd)
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, &syscall.EpollEvent{})
+	_ = syscall.Close(c.fd)
+	c.mux.Lock()
+	c.closed = true
+	if c.out != nil {
+		putBuffer(c.out)
+		c.out = nil
+	}
+	c.flushed.Broadcast()
+	c.mux.Unlock()
+	if c.in != nil {
+		putBuffer(c.in)
+		c.in = nil
+	}
+	if c.open {
+		l.poller.handler.Closed(c)
+	}
+}
+
+// stop closes the connections of the I/O goroutine and its file descriptors
+func (l *ioLoop) stop() {
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, l.poller.listenFD, &syscall.EpollEvent{})
+	if atomic.AddInt32(&l.poller.listening, -1) == 0 {
+		_ = syscall.Close(l.poller.listenFD)
+	}
+	for _, c := range l.conns {
+		l.close(c)
+	}
+	l.mux.Lock()
+	l.stopped = true
+	l.pending = nil
+	l.mux.Unlock()
+	l.closeFDs()
+}
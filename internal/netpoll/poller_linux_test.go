@@ -0,0 +1,130 @@
+package netpoll
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineHandler echoes every line, "wait" pauses the connection until a goroutine writes "resumed"
+type lineHandler struct {
+	mux    sync.Mutex
+	opened int
+	closed int
+}
+
+func (h *lineHandler) Open(c *Conn) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.opened++
+	return nil
+}
+
+func (h *lineHandler) Data(c *Conn, in []byte) int {
+	consumed := 0
+	for {
+		i := bytes.IndexByte(in[consumed:], '\n')
+		if i < 0 {
+			return consumed
+		}
+		line := in[consumed : consumed+i+1]
+		consumed += i + 1
+		switch string(line) {
+		case "wait\n":
+			c.Pause()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				_, _ = c.WriteString("resumed\n")
+				c.Resume()
+			}()
+			return consumed
+		case "quit\n":
+			_ = c.Close()
+			return consumed
+		}
+		_ = c.Append(func(out []byte) []byte { return append(out, line...) })
+	}
+}
+
+func (h *lineHandler) Closed(c *Conn) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.closed++
+}
+
+func (h *lineHandler) counts() (int, int) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.opened, h.closed
+}
+
+func TestPoller(t *testing.T) {
+	h := &lineHandler{}
+	var wg sync.WaitGroup
+	p, err := Listen(10_054, 2, h, &wg)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", "localhost:10054")
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		reader := bufio.NewReader(conn)
+		// the lines after wait are only handled once the connection is resumed, a line split
+		// over several writes is kept until it is complete
+		if _, err := fmt.Fprintf(conn, "a%d\nwait\nb%d\nc", i, i); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		time.Sleep(time.Millisecond)
+		if _, err := fmt.Fprintf(conn, "%d\n", i); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		for _, want := range []string{fmt.Sprintf("a%d\n", i), "resumed\n", fmt.Sprintf("b%d\n", i), fmt.Sprintf("c%d\n", i)} {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if got, err := reader.ReadString('\n'); err != nil || got != want {
+				t.Fatalf("conn %d read %q, %v, want %q", i, got, err, want)
+			}
+		}
+	}
+
+	// a large response is sent as the peer reads it
+	large := bytes.Repeat([]byte("x"), 1<<20)
+	if _, err := conns[0].Write(append(large, '\n')); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	got := make([]byte, len(large)+1)
+	_ = conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(conns[0]).Read(got[:1]); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if _, err := conns[1].Write([]byte("quit\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	_ = conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conns[1].Read(got); n != 0 || err == nil {
+		t.Errorf("Read() after quit = %d, %v, want EOF", n, err)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	p.Close()
+	wg.Wait()
+	if opened, closed := h.counts(); opened != 4 || closed != 4 {
+		t.Errorf("opened %d & closed %d connections, want 4", opened, closed)
+	}
+	if _, err := net.Dial("tcp", "localhost:10054"); err == nil {
+		t.Errorf("Dial() after Close succeeded")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package netpoll
+
+import (
+	"errors"
+	"sync"
+)
+
+// Poller is only implemented on Linux
+type Poller struct{}
+
+// Listen fails, netpoll is only implemented on Linux
+func Listen(port uint, ioGoroutines int, handler Handler, wg *sync.WaitGroup) (*Poller, error) {
+	return nil, errors.New("netpoll: only supported on linux")
+}
+
+// Close does nothing
+func (p *Poller) Close() {}
+
+// Conn is only implemented on Linux
+type Conn struct {
+	Context interface{}
+}
+
+func (c *Conn) RemoteAddr() string                            { return "" }
+func (c *Conn) Write(p []byte) (int, error)                   { return 0, ErrClosed }
+func (c *Conn) WriteString(s string) (int, error)             { return 0, ErrClosed }
+func (c *Conn) Append(appendTo func(out []byte) []byte) error { return ErrClosed }
+func (c *Conn) Buffered() int                                 { return 0 }
+func (c *Conn) Flush() error                                  { return ErrClosed }
+func (c *Conn) Close() error                                  { return nil }
+func (c *Conn) Pause()                                        {}
+func (c *Conn) Resume()                                       {}
@@ -0,0 +1,240 @@
+package raft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/frame"
+	"io"
+)
+
+// EntryType is the type of the entries of the log
+type EntryType uint8
+
+const (
+	// EntryCommand holds a command of the owner of the node
+	EntryCommand EntryType = iota
+	// EntryConfig holds the members of the cluster, a node uses the last configuration of its log
+	// as soon as it is appended
+	EntryConfig
+	// EntryNoop is appended by a new leader to commit the entries of the previous terms
+	EntryNoop
+)
+
+// Entry is an entry of the replicated log
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Member is a voting member of the cluster, Addr is the address its owner gives to the clients
+type Member struct {
+	ID   string
+	Addr string
+}
+
+// Config is the list of the members of the cluster
+type Config []Member
+
+// Member returns the member id, false when it is not a member
+func (c Config) Member(id string) (Member, bool) {
+	for _, m := range c {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// Snapshot replaces the entries of the log up to Index, Data is the state of the owner after
+// applying them
+type Snapshot struct {
+	Index  uint64
+	Term   uint64
+	Config Config
+	Data   []byte
+}
+
+// MessageType is the type of the messages exchanged by the nodes
+type MessageType uint8
+
+const (
+	// MsgVote is sent by a candidate to the other members, they answer with MsgVoteResp
+	MsgVote MessageType = iota + 1
+	MsgVoteResp
+	// MsgApp is sent by the leader with the entries a follower misses, or none as an heartbeat.
+	// The followers answer with MsgAppResp.
+	MsgApp
+	MsgAppResp
+	// MsgSnap is sent by the leader to a follower missing entries already compacted, it is
+	// answered with MsgAppResp
+	MsgSnap
+)
+
+var messageTypeNames = []string{"", "vote", "vote-resp", "app", "app-resp", "snap"}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) && t != 0 {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// Message is exchanged by the nodes of the cluster
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	// Addr is the address of the sender, a new member learns the address of its leader from it
+	Addr string
+	Term uint64
+	// LogTerm & Index are the last entry of the candidate in MsgVote and the entry preceding
+	// Entries in MsgApp. In MsgAppResp Index is the last entry matching the leader, or the
+	// rejected entry when Reject is set and RejectHint is then the last entry of the follower.
+	LogTerm    uint64
+	Index      uint64
+	Commit     uint64
+	Entries    []Entry
+	Reject     bool
+	RejectHint uint64
+	// Snapshot is set in MsgSnap
+	Snapshot *Snapshot
+}
+
+// messageFormat frames the messages, maxMessageSize limits the memory used by a corrupted message,
+// a snapshot is sent in a single message
+var messageFormat = frame.Format{
+	Signature: "RAFT",
+	MaxSize:   512 << 20,
+	Err:       errInvalidMessage,
+}
+
+var errInvalidMessage = errors.New("invalid raft message")
+
+// WriteMessage writes m to w, prefixed by a signature and its length
+func WriteMessage(w io.Writer, m *Message) error {
+	e := messageFormat.NewEncoder(128)
+	e.Uint8(uint8(m.Type))
+	e.String(m.From)
+	e.String(m.To)
+	e.String(m.Addr)
+	e.Uint64(m.Term)
+	e.Uint64(m.LogTerm)
+	e.Uint64(m.Index)
+	e.Uint64(m.Commit)
+	e.Bool(m.Reject)
+	e.Uint64(m.RejectHint)
+	e.Uint32(uint32(len(m.Entries)))
+	for _, entry := range m.Entries {
+		encodeEntry(e, entry)
+	}
+	e.Bool(m.Snapshot != nil)
+	if m.Snapshot != nil {
+		encodeSnapshot(e, *m.Snapshot)
+	}
+	return messageFormat.Write(w, e)
+}
+
+// ReadMessage reads a message written by WriteMessage
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	d, err := messageFormat.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	m.Type = MessageType(d.Uint8())
+	m.From = d.String()
+	m.To = d.String()
+	m.Addr = d.String()
+	m.Term = d.Uint64()
+	m.LogTerm = d.Uint64()
+	m.Index = d.Uint64()
+	m.Commit = d.Uint64()
+	m.Reject = d.Bool()
+	m.RejectHint = d.Uint64()
+	if n := int(d.Uint32()); n > 0 && n <= d.Len() {
+		m.Entries = make([]Entry, 0, n)
+		for i := 0; i < n && d.Err() == nil; i++ {
+			m.Entries = append(m.Entries, decodeEntry(d))
+		}
+	} else if n > 0 {
+		return nil, fmt.Errorf("%w: bad number of entries %d", errInvalidMessage, n)
+	}
+	if d.Bool() {
+		snapshot := decodeSnapshot(d)
+		m.Snapshot = &snapshot
+	}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func encodeEntry(e *frame.Encoder, entry Entry) {
+	e.Uint64(entry.Index)
+	e.Uint64(entry.Term)
+	e.Uint8(uint8(entry.Type))
+	e.Bytes(entry.Data)
+}
+
+func encodeConfig(e *frame.Encoder, c Config) {
+	e.Uint16(uint16(len(c)))
+	for _, m := range c {
+		e.String(m.ID)
+		e.String(m.Addr)
+	}
+}
+
+func encodeSnapshot(e *frame.Encoder, s Snapshot) {
+	e.Uint64(s.Index)
+	e.Uint64(s.Term)
+	encodeConfig(e, s.Config)
+	e.Bytes(s.Data)
+}
+
+func decodeEntry(d *frame.Decoder) Entry {
+	var e Entry
+	e.Index = d.Uint64()
+	e.Term = d.Uint64()
+	e.Type = EntryType(d.Uint8())
+	e.Data = d.Bytes()
+	return e
+}
+
+func decodeConfig(d *frame.Decoder) Config {
+	n := int(d.Uint16())
+	if n == 0 {
+		return nil
+	}
+	c := make(Config, 0, n)
+	for i := 0; i < n && d.Err() == nil; i++ {
+		c = append(c, Member{ID: d.String(), Addr: d.String()})
+	}
+	return c
+}
+
+func decodeSnapshot(d *frame.Decoder) Snapshot {
+	var s Snapshot
+	s.Index = d.Uint64()
+	s.Term = d.Uint64()
+	s.Config = decodeConfig(d)
+	s.Data = d.Bytes()
+	return s
+}
+
+// EncodeConfig serializes c, the data of the entries EntryConfig
+func EncodeConfig(c Config) []byte {
+	e := &frame.Encoder{}
+	encodeConfig(e, c)
+	return e.Data()
+}
+
+// DecodeConfig parses the data of an entry EntryConfig
+func DecodeConfig(data []byte) (Config, error) {
+	d := messageFormat.NewDecoder(data)
+	c := decodeConfig(d)
+	return c, d.Finish()
+}
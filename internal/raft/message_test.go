@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	config := Config{{ID: "a", Addr: "127.0.0.1:7000"}, {ID: "b", Addr: "127.0.0.1:7001"}}
+	app := &Message{
+		Type: MsgApp, From: "a", To: "b", Addr: "127.0.0.1:7000",
+		Term: 3, LogTerm: 2, Index: 10, Commit: 9,
+		Entries: []Entry{
+			{Index: 11, Term: 3, Type: EntryNoop},
+			{Index: 12, Term: 3, Type: EntryCommand, Data: []byte("SET k v")},
+			{Index: 13, Term: 3, Type: EntryConfig, Data: EncodeConfig(config)},
+		},
+	}
+	snap := &Message{
+		Type: MsgSnap, From: "a", To: "c", Term: 3,
+		Snapshot: &Snapshot{Index: 9, Term: 2, Config: config, Data: []byte("REDIS")},
+	}
+	resp := &Message{Type: MsgAppResp, From: "b", To: "a", Term: 3, Index: 8, Reject: true}
+
+	var buf bytes.Buffer
+	for _, m := range []*Message{app, snap, resp} {
+		common.ExpectNoError(t, WriteMessage(&buf, m))
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range []*Message{app, snap, resp} {
+		got, err := ReadMessage(r)
+		common.ExpectNoError(t, err)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+	_, err := ReadMessage(r)
+	common.AssertEquals(t, err, io.EOF)
+
+	decoded, err := DecodeConfig(app.Entries[2].Data)
+	common.ExpectNoError(t, err)
+	if !reflect.DeepEqual(decoded, config) {
+		t.Errorf("want %v, got %v", config, decoded)
+	}
+}
+
+func TestReadInvalidMessage(t *testing.T) {
+	var buf bytes.Buffer
+	common.ExpectNoError(t, WriteMessage(&buf, &Message{Type: MsgVote, From: "a", To: "b", Term: 1}))
+	valid := buf.Bytes()
+
+	badSignature := append([]byte("RAFX"), valid[4:]...)
+	_, err := ReadMessage(bufio.NewReader(bytes.NewReader(badSignature)))
+	common.AssertEquals(t, errors.Is(err, errInvalidMessage), true)
+
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(valid[:len(valid)-3])))
+	common.AssertEquals(t, err, io.ErrUnexpectedEOF)
+
+	// a length covering less than the fields
+	short := append([]byte{}, valid...)
+	short[7] = 12
+	_, err = ReadMessage(bufio.NewReader(bytes.NewReader(short)))
+	common.AssertEquals(t, errors.Is(err, errInvalidMessage), true)
+}
@@ -0,0 +1,737 @@
+// Package raft implements the consensus algorithm of the Raft paper: leader election, log
+// replication, log compaction with snapshots and membership changes of one member at a time.
+//
+// A Node is a state machine driven by its owner, it does no I/O but saving its state. Tick
+// advances its clock, Step delivers the messages of the other nodes and Propose appends a command
+// on the leader. After each call the owner sends the messages returned by Messages, installs the
+// snapshot returned by PendingSnapshot then applies the entries returned by CommittedEntries.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// DefaultElectionTicks is the number of ticks without leader before a follower starts an
+	// election, it is randomized between once and twice this number
+	DefaultElectionTicks = 10
+	// heartbeatTicks is the number of ticks between the heartbeats of the leader
+	heartbeatTicks = 1
+	// maxEntriesPerMessage limits the size of the appends sent to a follower
+	maxEntriesPerMessage = 64
+)
+
+var (
+	// ErrNotLeader is returned by the proposals made to a node that is not the leader
+	ErrNotLeader = errors.New("not the leader")
+	// ErrConfigInProgress is returned while the last membership change is not committed
+	ErrConfigInProgress = errors.New("a membership change is in progress")
+	// ErrBootstrapped is returned by Bootstrap when the node already has a log
+	ErrBootstrapped = errors.New("the node already has a log")
+)
+
+// Role is the role of a node in its current term
+type Role uint8
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("unknown(%d)", r)
+}
+
+// progress is what the leader knows about the log of a follower
+type progress struct {
+	// match is the last entry known to match the leader, next the next entry to send
+	match uint64
+	next  uint64
+	// active is set when the follower answered since the last quorum check of the leader
+	active bool
+}
+
+// Node is a member of a raft cluster, or a node waiting to be added to one
+type Node struct {
+	id      string
+	addr    string
+	storage *Storage
+
+	role       Role
+	term       uint64
+	vote       string
+	leader     string
+	leaderAddr string
+
+	// snapshot replaces the entries up to its index, entries follow it
+	snapshot Snapshot
+	entries  []Entry
+	// config is the last configuration of the log, added at configIndex
+	config      Config
+	configIndex uint64
+	commit      uint64
+	applied     uint64
+
+	// progress of the followers and votes of the members, on the leader and the candidates
+	progress map[string]*progress
+	votes    map[string]bool
+
+	electionTicks     int
+	randomizedTimeout int
+	electionElapsed   int
+	heartbeatElapsed  int
+
+	msgs            []Message
+	pendingSnapshot *Snapshot
+}
+
+// NewNode returns a follower with the state loaded from storage, addr is the address of its owner.
+// The node is not a member of a cluster until Bootstrap is called or a leader adds it.
+func NewNode(id, addr string, storage *Storage, state State, electionTicks int) *Node {
+	if electionTicks <= 0 {
+		electionTicks = DefaultElectionTicks
+	}
+	n := &Node{
+		id:            id,
+		addr:          addr,
+		storage:       storage,
+		term:          state.Term,
+		vote:          state.Vote,
+		snapshot:      state.Snapshot,
+		entries:       state.Entries,
+		commit:        state.Snapshot.Index,
+		applied:       state.Snapshot.Index,
+		electionTicks: electionTicks,
+	}
+	if state.Snapshot.Index > 0 {
+		n.pendingSnapshot = &state.Snapshot
+	}
+	n.refreshConfig()
+	n.resetTimeout()
+	return n
+}
+
+// Bootstrap creates a cluster with this node as its only member, it becomes the leader
+func (n *Node) Bootstrap() error {
+	if n.lastIndex() > 0 || n.term > 0 {
+		return ErrBootstrapped
+	}
+	n.term = 1
+	if err := n.saveState(); err != nil {
+		return err
+	}
+	entry := Entry{Index: 1, Term: 1, Type: EntryConfig, Data: EncodeConfig(Config{{ID: n.id, Addr: n.addr}})}
+	if err := n.appendEntries([]Entry{entry}); err != nil {
+		return err
+	}
+	return n.campaign()
+}
+
+// Status describes the node
+type Status struct {
+	ID            string
+	Role          Role
+	Term          uint64
+	Leader        string
+	LeaderAddr    string
+	Commit        uint64
+	Applied       uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Config        Config
+}
+
+func (n *Node) Status() Status {
+	return Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		LeaderAddr:    n.LeaderAddr(),
+		Commit:        n.commit,
+		Applied:       n.applied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snapshot.Index,
+		Config:        append(Config{}, n.config...),
+	}
+}
+
+// IsLeader returns true when the node is the leader and committed an entry of its term, so it
+// applied every entry committed by the previous leaders and can serve reads. The leader steps down
+// when it does not hear from the majority during an election timeout.
+func (n *Node) IsLeader() bool {
+	if n.role != Leader {
+		return false
+	}
+	term, _ := n.termAt(n.commit)
+	return term == n.term
+}
+
+// LeaderAddr returns the address of the leader, empty when it is unknown
+func (n *Node) LeaderAddr() string {
+	if n.leader == "" {
+		return ""
+	}
+	if n.leader == n.id {
+		return n.addr
+	}
+	if n.leaderAddr != "" {
+		return n.leaderAddr
+	}
+	m, _ := n.config.Member(n.leader)
+	return m.Addr
+}
+
+// Messages returns the messages to send since the last call
+func (n *Node) Messages() []Message {
+	msgs := n.msgs
+	n.msgs = nil
+	return msgs
+}
+
+// PendingSnapshot returns the snapshot the owner must install before applying the next entries,
+// nil when there is none
+func (n *Node) PendingSnapshot() *Snapshot {
+	s := n.pendingSnapshot
+	n.pendingSnapshot = nil
+	return s
+}
+
+// CommittedEntries returns the entries committed since the last call, they are applied in order
+func (n *Node) CommittedEntries() []Entry {
+	if n.applied >= n.commit {
+		return nil
+	}
+	committed := append([]Entry{}, n.slice(n.applied+1, n.commit+1)...)
+	n.applied = n.commit
+	return committed
+}
+
+// Tick advances the clock of the node, the followers start an election when they did not hear
+// from the leader for the election timeout and the leader sends heartbeats. The leader steps down
+// when the majority did not answer during an election timeout.
+func (n *Node) Tick() error {
+	n.electionElapsed++
+	if n.role != Leader {
+		if n.electionElapsed >= n.randomizedTimeout {
+			return n.campaign()
+		}
+		return nil
+	}
+
+	n.heartbeatElapsed++
+	if n.heartbeatElapsed >= heartbeatTicks {
+		n.heartbeatElapsed = 0
+		n.broadcastAppend()
+	}
+	if n.electionElapsed >= n.electionTicks {
+		n.electionElapsed = 0
+		active := 0
+		if _, ok := n.config.Member(n.id); ok {
+			active++
+		}
+		for id, pr := range n.progress {
+			if _, ok := n.config.Member(id); ok && pr.active {
+				active++
+			}
+			pr.active = false
+		}
+		if active < n.quorum() {
+			return n.becomeFollower(n.term, "")
+		}
+	}
+	return nil
+}
+
+// Propose appends a command to the log of the leader, it returns the index and the term of its
+// entry. The command is committed once the entry at this index with this term is committed.
+func (n *Node) Propose(data []byte) (uint64, uint64, error) {
+	if n.role != Leader {
+		return 0, 0, ErrNotLeader
+	}
+	index := n.lastIndex() + 1
+	if err := n.appendEntries([]Entry{{Index: index, Term: n.term, Type: EntryCommand, Data: data}}); err != nil {
+		return 0, 0, err
+	}
+	n.broadcastAppend()
+	return index, n.term, nil
+}
+
+// AddMember adds m to the members, the change is effective once its entry is appended. A change
+// is rejected until the previous one is committed.
+func (n *Node) AddMember(m Member) (uint64, error) {
+	if _, ok := n.config.Member(m.ID); ok {
+		return 0, fmt.Errorf("%s is already a member", m.ID)
+	}
+	return n.changeConfig(append(append(Config{}, n.config...), m))
+}
+
+// RemoveMember removes the member id, a leader removing itself steps down once the change is
+// committed
+func (n *Node) RemoveMember(id string) (uint64, error) {
+	if _, ok := n.config.Member(id); !ok {
+		return 0, fmt.Errorf("%s is not a member", id)
+	}
+	config := make(Config, 0, len(n.config))
+	for _, m := range n.config {
+		if m.ID != id {
+			config = append(config, m)
+		}
+	}
+	return n.changeConfig(config)
+}
+
+func (n *Node) changeConfig(config Config) (uint64, error) {
+	if n.role != Leader {
+		return 0, ErrNotLeader
+	}
+	// the leader must have committed an entry of its term, see the Raft dissertation errata
+	if term, _ := n.termAt(n.commit); n.configIndex > n.commit || term != n.term {
+		return 0, ErrConfigInProgress
+	}
+	index := n.lastIndex() + 1
+	entry := Entry{Index: index, Term: n.term, Type: EntryConfig, Data: EncodeConfig(config)}
+	if err := n.appendEntries([]Entry{entry}); err != nil {
+		return 0, err
+	}
+	n.broadcastAppend()
+	return index, nil
+}
+
+// Compact replaces the entries up to index, already applied, by a snapshot with data
+func (n *Node) Compact(index uint64, data []byte) error {
+	if index > n.applied || index <= n.snapshot.Index {
+		return fmt.Errorf("can not compact the log at %d, applied %d, snapshot %d", index, n.applied, n.snapshot.Index)
+	}
+	term, _ := n.termAt(index)
+	snapshot := Snapshot{Index: index, Term: term, Config: n.configAt(index), Data: data}
+	remaining := append([]Entry{}, n.slice(index+1, n.lastIndex()+1)...)
+	if err := n.storage.SaveSnapshot(snapshot, n.term, n.vote, remaining); err != nil {
+		return err
+	}
+	n.snapshot, n.entries = snapshot, remaining
+	return nil
+}
+
+// Step processes a message of another node
+func (n *Node) Step(m Message) error {
+	switch {
+	case m.Term > n.term:
+		if m.Type == MsgVote && n.leader != "" && n.electionElapsed < n.electionTicks {
+			// the leader is alive, a removed or partitioned node must not disrupt the cluster
+			return nil
+		}
+		leader := ""
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			leader = m.From
+		}
+		if err := n.becomeFollower(m.Term, leader); err != nil {
+			return err
+		}
+	case m.Term < n.term:
+		// the stale leader or candidate learns the current term from the reply
+		switch m.Type {
+		case MsgApp, MsgSnap:
+			n.send(Message{Type: MsgAppResp, To: m.From, Index: m.Index, Reject: true, RejectHint: n.lastIndex()})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return nil
+	}
+
+	switch m.Type {
+	case MsgVote:
+		return n.handleVote(m)
+	case MsgVoteResp:
+		if n.role == Candidate {
+			n.votes[m.From] = !m.Reject
+			return n.countVotes()
+		}
+	case MsgApp, MsgSnap:
+		if n.role != Follower {
+			if err := n.becomeFollower(m.Term, m.From); err != nil {
+				return err
+			}
+		}
+		n.leader, n.leaderAddr = m.From, m.Addr
+		n.electionElapsed = 0
+		if m.Type == MsgSnap {
+			return n.handleSnapshot(m)
+		}
+		return n.handleAppend(m)
+	case MsgAppResp:
+		if n.role == Leader {
+			return n.handleAppendResponse(m)
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleVote(m Message) error {
+	canVote := n.vote == m.From || (n.vote == "" && n.leader == "")
+	upToDate := m.LogTerm > n.lastTerm() || (m.LogTerm == n.lastTerm() && m.Index >= n.lastIndex())
+	if !canVote || !upToDate {
+		n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		return nil
+	}
+	n.vote = m.From
+	if err := n.saveState(); err != nil {
+		return err
+	}
+	n.electionElapsed = 0
+	n.send(Message{Type: MsgVoteResp, To: m.From})
+	return nil
+}
+
+func (n *Node) countVotes() error {
+	granted, rejected := 0, 0
+	for _, m := range n.config {
+		if vote, ok := n.votes[m.ID]; ok && vote {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum():
+		return n.becomeLeader()
+	case rejected >= n.quorum():
+		return n.becomeFollower(n.term, "")
+	}
+	return nil
+}
+
+// handleAppend appends the entries of the leader following the entry at m.Index, the entries
+// conflicting with them are removed
+func (n *Node) handleAppend(m Message) error {
+	if m.Index < n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: n.commit})
+		return nil
+	}
+	if term, ok := n.termAt(m.Index); !ok || term != m.LogTerm {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: m.Index, Reject: true, RejectHint: n.lastIndex()})
+		return nil
+	}
+
+	var added []Entry
+	for i, e := range m.Entries {
+		term, ok := n.termAt(e.Index)
+		if !ok || term != e.Term {
+			added = m.Entries[i:]
+			break
+		}
+	}
+	if err := n.appendEntries(added); err != nil {
+		return err
+	}
+	last := m.Index + uint64(len(m.Entries))
+	if m.Commit > n.commit {
+		n.commit = min(m.Commit, last)
+	}
+	n.send(Message{Type: MsgAppResp, To: m.From, Index: last})
+	return nil
+}
+
+// handleSnapshot replaces the log by the snapshot of the leader, the entries following it are
+// kept when the log contains its last entry
+func (n *Node) handleSnapshot(m Message) error {
+	s := *m.Snapshot
+	if s.Index <= n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: n.commit})
+		return nil
+	}
+	var remaining []Entry
+	if term, ok := n.termAt(s.Index); ok && term == s.Term {
+		remaining = append(remaining, n.slice(s.Index+1, n.lastIndex()+1)...)
+	}
+	if err := n.storage.SaveSnapshot(s, n.term, n.vote, remaining); err != nil {
+		return err
+	}
+	n.snapshot, n.entries = s, remaining
+	n.commit, n.applied = s.Index, s.Index
+	n.pendingSnapshot = &s
+	n.refreshConfig()
+	n.send(Message{Type: MsgAppResp, To: m.From, Index: s.Index})
+	return nil
+}
+
+func (n *Node) handleAppendResponse(m Message) error {
+	pr, ok := n.progress[m.From]
+	if !ok {
+		return nil
+	}
+	pr.active = true
+	if m.Reject {
+		if m.Index < pr.match || m.Index >= pr.next {
+			// the answer to an append sent before a previous rejection
+			return nil
+		}
+		// the follower does not have the entry at m.Index, the entries preceding it are sent
+		pr.next = max(pr.match+1, min(m.Index, m.RejectHint+1))
+		n.sendAppend(m.From)
+		return nil
+	}
+	if m.Index > pr.match {
+		pr.match = m.Index
+	}
+	if pr.next <= m.Index {
+		pr.next = m.Index + 1
+	}
+	if err := n.maybeCommit(); err != nil {
+		return err
+	}
+	if n.role == Leader && pr.next <= n.lastIndex() {
+		n.sendAppend(m.From)
+	}
+	return nil
+}
+
+// maybeCommit commits the entries of the current term stored by the majority of the members
+func (n *Node) maybeCommit() error {
+	matches := make([]uint64, 0, len(n.config))
+	for _, m := range n.config {
+		if m.ID == n.id {
+			matches = append(matches, n.lastIndex())
+		} else if pr, ok := n.progress[m.ID]; ok {
+			matches = append(matches, pr.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if term, _ := n.termAt(index); index <= n.commit || term != n.term {
+		return nil
+	}
+	n.commit = index
+	if _, ok := n.config.Member(n.id); !ok && n.commit >= n.configIndex {
+		// the configuration removing this leader is committed
+		return n.becomeFollower(n.term, "")
+	}
+	return nil
+}
+
+func (n *Node) campaign() error {
+	if _, ok := n.config.Member(n.id); !ok {
+		n.electionElapsed = 0
+		return nil
+	}
+	n.role = Candidate
+	n.term++
+	n.vote = n.id
+	n.leader, n.leaderAddr = "", ""
+	if err := n.saveState(); err != nil {
+		return err
+	}
+	n.electionElapsed = 0
+	n.resetTimeout()
+	n.votes = map[string]bool{n.id: true}
+	if len(n.config) == 1 {
+		return n.becomeLeader()
+	}
+	for _, m := range n.config {
+		if m.ID != n.id {
+			n.send(Message{Type: MsgVote, To: m.ID, Index: n.lastIndex(), LogTerm: n.lastTerm()})
+		}
+	}
+	return nil
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) error {
+	if term != n.term {
+		n.term, n.vote = term, ""
+		if err := n.saveState(); err != nil {
+			return err
+		}
+	}
+	n.role = Follower
+	n.leader, n.leaderAddr = leader, ""
+	n.progress, n.votes = nil, nil
+	n.electionElapsed = 0
+	n.resetTimeout()
+	return nil
+}
+
+// becomeLeader appends an empty entry, committing it commits the entries of the previous terms
+func (n *Node) becomeLeader() error {
+	n.role = Leader
+	n.leader, n.leaderAddr = n.id, ""
+	n.votes = nil
+	n.electionElapsed, n.heartbeatElapsed = 0, 0
+	n.progress = make(map[string]*progress)
+	n.refreshProgress()
+	if err := n.appendEntries([]Entry{{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}}); err != nil {
+		return err
+	}
+	n.broadcastAppend()
+	return nil
+}
+
+// appendEntries saves entries, they replace the entries of the log from the index of the first
+// one
+func (n *Node) appendEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := n.storage.Append(entries); err != nil {
+		return err
+	}
+	first := entries[0].Index
+	truncated := first <= n.lastIndex()
+	n.entries = append(n.entries[:first-n.snapshot.Index-1], entries...)
+	hasConfig := truncated && first <= n.configIndex
+	for _, e := range entries {
+		hasConfig = hasConfig || e.Type == EntryConfig
+	}
+	if hasConfig {
+		n.refreshConfig()
+	}
+	if n.role == Leader {
+		return n.maybeCommit()
+	}
+	return nil
+}
+
+func (n *Node) broadcastAppend() {
+	for id := range n.progress {
+		n.sendAppend(id)
+	}
+}
+
+// sendAppend sends the entries the follower misses, or the snapshot when they were compacted.
+// The next entries are sent without waiting for the answer, a lost message is detected by the
+// follower that rejects the next one.
+func (n *Node) sendAppend(to string) {
+	pr := n.progress[to]
+	if pr.next <= n.snapshot.Index {
+		snapshot := n.snapshot
+		n.send(Message{Type: MsgSnap, To: to, Snapshot: &snapshot})
+		pr.next = snapshot.Index + 1
+		return
+	}
+	prev := pr.next - 1
+	prevTerm, _ := n.termAt(prev)
+	// the owner sends the messages from other goroutines, the log may be truncated meanwhile
+	entries := append([]Entry(nil), n.slice(pr.next, min(n.lastIndex()+1, pr.next+maxEntriesPerMessage))...)
+	n.send(Message{Type: MsgApp, To: to, Index: prev, LogTerm: prevTerm, Entries: entries, Commit: n.commit})
+	pr.next += uint64(len(entries))
+}
+
+func (n *Node) send(m Message) {
+	m.From, m.Addr, m.Term = n.id, n.addr, n.term
+	n.msgs = append(n.msgs, m)
+}
+
+// refreshConfig uses the last configuration of the log and, on the leader, tracks the progress of
+// its members
+func (n *Node) refreshConfig() {
+	n.config, n.configIndex = n.snapshot.Config, n.snapshot.Index
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if e := n.entries[i]; e.Type == EntryConfig {
+			if config, err := DecodeConfig(e.Data); err == nil {
+				n.config, n.configIndex = config, e.Index
+			}
+			break
+		}
+	}
+	if n.role == Leader {
+		n.refreshProgress()
+	}
+}
+
+func (n *Node) refreshProgress() {
+	for _, m := range n.config {
+		if _, ok := n.progress[m.ID]; !ok && m.ID != n.id {
+			n.progress[m.ID] = &progress{next: n.lastIndex() + 1, active: true}
+		}
+	}
+	for id := range n.progress {
+		if _, ok := n.config.Member(id); !ok {
+			delete(n.progress, id)
+		}
+	}
+}
+
+// configAt returns the configuration used at index
+func (n *Node) configAt(index uint64) Config {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if e := n.entries[i]; e.Index <= index && e.Type == EntryConfig {
+			if config, err := DecodeConfig(e.Data); err == nil {
+				return config
+			}
+		}
+	}
+	return n.snapshot.Config
+}
+
+func (n *Node) quorum() int {
+	return len(n.config)/2 + 1
+}
+
+func (n *Node) saveState() error {
+	return n.storage.SaveState(n.term, n.vote)
+}
+
+func (n *Node) resetTimeout() {
+	n.randomizedTimeout = n.electionTicks + rand.Intn(n.electionTicks)
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Index
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	term, _ := n.termAt(n.lastIndex())
+	return term
+}
+
+// termAt returns the term of the entry at index, false when it is compacted or not in the log
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snapshot.Index:
+		return n.snapshot.Term, true
+	case index < n.snapshot.Index || index > n.lastIndex():
+		return 0, false
+	}
+	return n.entries[index-n.snapshot.Index-1].Term, true
+}
+
+// slice returns the entries from lo to hi excluded, they must follow the snapshot
+func (n *Node) slice(lo, hi uint64) []Entry {
+	if lo >= hi {
+		return nil
+	}
+	return n.entries[lo-n.snapshot.Index-1 : hi-n.snapshot.Index-1]
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
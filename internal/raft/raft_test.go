@@ -0,0 +1,313 @@
+package raft
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// network delivers the messages of in memory nodes, the isolated nodes neither send nor receive
+type network struct {
+	t        *testing.T
+	nodes    map[string]*Node
+	storages map[string]*Storage
+	dirs     map[string]string
+	isolated map[string]bool
+	// applied are the commands applied by each node
+	applied map[string][]string
+}
+
+func newNetwork(t *testing.T) *network {
+	nw := &network{
+		t:        t,
+		nodes:    make(map[string]*Node),
+		storages: make(map[string]*Storage),
+		dirs:     make(map[string]string),
+		isolated: make(map[string]bool),
+		applied:  make(map[string][]string),
+	}
+	t.Cleanup(func() {
+		for _, s := range nw.storages {
+			s.Close()
+		}
+	})
+	return nw
+}
+
+// start starts the node id, with the state it saved when it was already started
+func (nw *network) start(id string) *Node {
+	dir, ok := nw.dirs[id]
+	if !ok {
+		dir = nw.t.TempDir()
+		nw.dirs[id] = dir
+	}
+	s, state, err := OpenStorage(dir)
+	if err != nil {
+		nw.t.Fatal(err)
+	}
+	nw.storages[id] = s
+	n := NewNode(id, id+":6379", s, state, 0)
+	nw.nodes[id] = n
+	nw.applied[id] = nil
+	nw.apply(id)
+	return n
+}
+
+func (nw *network) stop(id string) {
+	nw.storages[id].Close()
+	delete(nw.storages, id)
+	delete(nw.nodes, id)
+}
+
+// cluster starts the nodes ids, the first one creates the cluster and adds the others
+func (nw *network) cluster(ids ...string) {
+	for _, id := range ids {
+		nw.start(id)
+	}
+	common.ExpectNoError(nw.t, nw.nodes[ids[0]].Bootstrap())
+	for _, id := range ids[1:] {
+		nw.settle()
+		_, err := nw.leader().AddMember(Member{ID: id, Addr: id + ":6379"})
+		common.ExpectNoError(nw.t, err)
+	}
+	nw.settle()
+}
+
+// deliver sends the messages until there are none left
+func (nw *network) deliver() {
+	for {
+		for id := range nw.nodes {
+			nw.apply(id)
+		}
+		var msgs []Message
+		for id, n := range nw.nodes {
+			for _, m := range n.Messages() {
+				if !nw.isolated[id] && !nw.isolated[m.To] {
+					msgs = append(msgs, m)
+				}
+			}
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		for _, m := range msgs {
+			if n, ok := nw.nodes[m.To]; ok {
+				common.ExpectNoError(nw.t, n.Step(m))
+			}
+		}
+	}
+}
+
+func (nw *network) apply(id string) {
+	n := nw.nodes[id]
+	if s := n.PendingSnapshot(); s != nil {
+		nw.applied[id] = strings.Fields(string(s.Data))
+	}
+	for _, e := range n.CommittedEntries() {
+		if e.Type == EntryCommand {
+			nw.applied[id] = append(nw.applied[id], string(e.Data))
+		}
+	}
+}
+
+// tick advances the clocks of the nodes n times
+func (nw *network) tick(n int) {
+	for i := 0; i < n; i++ {
+		for _, node := range nw.nodes {
+			common.ExpectNoError(nw.t, node.Tick())
+		}
+		nw.deliver()
+	}
+}
+
+// settle ticks until a leader committed its entries and the members it reaches applied them
+func (nw *network) settle() {
+	nw.deliver()
+	for i := 0; i < 50*DefaultElectionTicks && !nw.settled(); i++ {
+		nw.tick(1)
+	}
+}
+
+func (nw *network) settled() bool {
+	var leader *Node
+	for id, n := range nw.nodes {
+		if !nw.isolated[id] && n.role == Leader && (leader == nil || n.term > leader.term) {
+			leader = n
+		}
+	}
+	if leader == nil || leader.commit != leader.lastIndex() {
+		return false
+	}
+	for _, m := range leader.config {
+		if n, ok := nw.nodes[m.ID]; ok && !nw.isolated[m.ID] && (n.term != leader.term || n.applied != leader.commit) {
+			return false
+		}
+	}
+	return true
+}
+
+// leader returns the leader with the greatest term
+func (nw *network) leader() *Node {
+	var leader *Node
+	for _, n := range nw.nodes {
+		if n.role == Leader && (leader == nil || n.term > leader.term) {
+			leader = n
+		}
+	}
+	if leader == nil {
+		nw.t.Fatal("no leader")
+	}
+	return leader
+}
+
+func (nw *network) propose(commands ...string) {
+	for _, c := range commands {
+		_, _, err := nw.leader().Propose([]byte(c))
+		common.ExpectNoError(nw.t, err)
+	}
+	nw.settle()
+}
+
+func (nw *network) assertApplied(want []string, ids ...string) {
+	nw.t.Helper()
+	for _, id := range ids {
+		if !reflect.DeepEqual(nw.applied[id], want) {
+			nw.t.Errorf("%s applied %v, want %v", id, nw.applied[id], want)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a", "b", "c")
+	leader := nw.leader()
+	common.AssertEquals(t, leader.id, "a")
+	common.AssertEquals(t, len(leader.Status().Config), 3)
+	for _, id := range []string{"b", "c"} {
+		common.AssertEquals(t, nw.nodes[id].Status().LeaderAddr, "a:6379")
+		common.AssertEquals(t, nw.nodes[id].Status().Role, Follower)
+	}
+
+	nw.propose("x", "y")
+	nw.assertApplied([]string{"x", "y"}, "a", "b", "c")
+
+	_, _, err := nw.nodes["b"].Propose([]byte("z"))
+	common.AssertEquals(t, err, ErrNotLeader)
+}
+
+func TestLeaderFailure(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a", "b", "c")
+	nw.propose("x")
+
+	nw.isolated["a"] = true
+	// the isolated leader appends an entry it can not commit
+	_, _, err := nw.nodes["a"].Propose([]byte("lost"))
+	common.ExpectNoError(t, err)
+	nw.settle()
+	// it steps down when the followers do not answer
+	nw.tick(DefaultElectionTicks)
+	if nw.nodes["a"].role == Leader {
+		t.Errorf("the isolated leader did not step down")
+	}
+	leader := nw.leader()
+	if leader.id == "a" || leader.term < 3 {
+		t.Fatalf("want a new leader, got %s in term %d", leader.id, leader.term)
+	}
+	nw.propose("y")
+	nw.assertApplied([]string{"x", "y"}, "b", "c")
+	nw.assertApplied([]string{"x"}, "a")
+
+	// the old leader rejoins, its uncommitted entry is replaced
+	nw.isolated["a"] = false
+	nw.settle()
+	nw.assertApplied([]string{"x", "y"}, "a")
+	common.AssertEquals(t, nw.leader(), leader)
+}
+
+func TestRestart(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a", "b", "c")
+	nw.propose("x", "y")
+
+	for _, id := range []string{"a", "b", "c"} {
+		nw.stop(id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		n := nw.start(id)
+		common.AssertEquals(t, len(n.Status().Config), 3)
+	}
+	nw.settle()
+	nw.propose("z")
+	nw.assertApplied([]string{"x", "y", "z"}, "a", "b", "c")
+}
+
+func TestSnapshot(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a", "b", "c")
+	nw.isolated["c"] = true
+	nw.propose("x", "y")
+	leader := nw.leader()
+	common.ExpectNoError(t, leader.Compact(leader.applied, []byte(strings.Join(nw.applied[leader.id], " "))))
+	common.AssertEquals(t, leader.Status().SnapshotIndex, leader.applied)
+
+	// c misses entries that were compacted, it installs the snapshot
+	nw.isolated["c"] = false
+	nw.propose("z")
+	nw.assertApplied([]string{"x", "y", "z"}, "a", "b", "c")
+	common.AssertEquals(t, nw.nodes["c"].Status().SnapshotIndex, leader.snapshot.Index)
+
+	// the snapshot & the entries following it are reloaded
+	nw.stop("c")
+	nw.start("c")
+	nw.assertApplied([]string{"x", "y"}, "c")
+	nw.settle()
+	nw.assertApplied([]string{"x", "y", "z"}, "c")
+}
+
+func TestMembership(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a", "b", "c", "d", "e")
+	nw.propose("x")
+	nw.assertApplied([]string{"x"}, "a", "b", "c", "d", "e")
+
+	leader := nw.leader()
+	_, err := leader.AddMember(Member{ID: "b", Addr: "b:6379"})
+	if err == nil {
+		t.Errorf("expected an error adding a member twice")
+	}
+	_, err = leader.RemoveMember("e")
+	common.ExpectNoError(t, err)
+	_, err = leader.RemoveMember("d")
+	common.AssertEquals(t, err, ErrConfigInProgress)
+	nw.settle()
+	common.AssertEquals(t, len(leader.Status().Config), 4)
+
+	// the leader removes itself, the others elect a new leader
+	_, err = leader.RemoveMember(leader.id)
+	common.ExpectNoError(t, err)
+	nw.settle()
+	common.AssertEquals(t, leader.role, Follower)
+	newLeader := nw.leader()
+	if newLeader == leader {
+		t.Fatalf("the removed leader is still the leader")
+	}
+	common.AssertEquals(t, len(newLeader.Status().Config), 3)
+	nw.stop(leader.id)
+	nw.stop("e")
+	nw.propose("y")
+	for _, id := range []string{"b", "c", "d"} {
+		if id != leader.id {
+			nw.assertApplied([]string{"x", "y"}, id)
+		}
+	}
+}
+
+func TestBootstrapTwice(t *testing.T) {
+	nw := newNetwork(t)
+	nw.cluster("a")
+	common.AssertEquals(t, nw.nodes["a"].Bootstrap(), ErrBootstrapped)
+	nw.propose("x")
+	nw.assertApplied([]string{"x"}, "a")
+}
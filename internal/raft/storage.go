@@ -0,0 +1,267 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/frame"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logFileName      = "raft.log"
+	snapshotFileName = "raft.snapshot"
+
+	recordState    uint8 = 'S'
+	recordEntry    uint8 = 'E'
+	recordSnapshot uint8 = 'P'
+	// recordHeaderSize is the type & the length of a record, recordFooterSize its CRC32
+	recordHeaderSize = 5
+	recordFooterSize = 4
+)
+
+var errCorrupted = errors.New("corrupted raft storage")
+
+// State is what a node saved before it stopped
+type State struct {
+	Term     uint64
+	Vote     string
+	Snapshot Snapshot
+	// Entries follow the snapshot
+	Entries []Entry
+}
+
+// Storage saves the state of a node in a directory: the term and the vote, the entries of the log
+// and the last snapshot. The log is an append only file of records, an entry replaces the entries
+// with the same index or a greater one. The file is rewritten when a snapshot compacts the log.
+type Storage struct {
+	dir  string
+	file *os.File
+}
+
+// OpenStorage opens the storage of dir, it is created when it does not exist. A record truncated
+// at the end of the log, written when the node crashed, is removed.
+func OpenStorage(dir string) (*Storage, State, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, State{}, err
+	}
+	s := &Storage{dir: dir}
+	var state State
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err == nil {
+		if state.Snapshot, err = decodeSnapshotFile(snapshot); err != nil {
+			return nil, State{}, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, State{}, err
+	}
+
+	path := filepath.Join(dir, logFileName)
+	if s.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, State{}, err
+	}
+	valid, err := readLog(s.file, &state)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("!!! Warning: short read while loading %s, truncating it to %d bytes", path, valid)
+		if err = s.file.Truncate(valid); err != nil {
+			err = fmt.Errorf("failed truncating %s: %w", path, err)
+		}
+	}
+	if err == nil {
+		_, err = s.file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		s.file.Close()
+		return nil, State{}, err
+	}
+	return s, state, nil
+}
+
+// readLog replays the records of f into state and returns the size of the complete records
+func readLog(f *os.File, state *State) (int64, error) {
+	r := bufio.NewReader(f)
+	valid := int64(0)
+	for {
+		recordType, payload, err := readRecord(r)
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		d := messageFormat.NewDecoder(payload)
+		switch recordType {
+		case recordState:
+			state.Term = d.Uint64()
+			state.Vote = d.String()
+			err = d.Err()
+		case recordEntry:
+			e := decodeEntry(d)
+			if err = d.Err(); err == nil {
+				err = addEntry(state, e)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown record %q", errCorrupted, recordType)
+		}
+		if err != nil {
+			return valid, err
+		}
+		valid += int64(recordHeaderSize + len(payload) + recordFooterSize)
+	}
+}
+
+// addEntry appends e to the entries of state, replacing the ones it conflicts with
+func addEntry(state *State, e Entry) error {
+	if e.Index <= state.Snapshot.Index {
+		// written before the snapshot compacted the log
+		return nil
+	}
+	last := state.Snapshot.Index
+	if n := len(state.Entries); n > 0 {
+		last = state.Entries[n-1].Index
+	}
+	if e.Index > last+1 {
+		return fmt.Errorf("%w: entry %d follows entry %d", errCorrupted, e.Index, last)
+	}
+	state.Entries = append(state.Entries[:e.Index-state.Snapshot.Index-1], e)
+	return nil
+}
+
+func readRecord(r *bufio.Reader) (uint8, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || n == 0 {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > uint32(messageFormat.MaxSize) {
+		return 0, nil, fmt.Errorf("%w: record of %d bytes", errCorrupted, size)
+	}
+	buf := make([]byte, int(size)+recordFooterSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	payload := buf[:size]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[size:]) {
+		return 0, nil, fmt.Errorf("%w: bad checksum", errCorrupted)
+	}
+	return header[0], payload, nil
+}
+
+func appendRecord(buf []byte, recordType uint8, payload []byte) []byte {
+	e := frame.Append(buf)
+	e.Uint8(recordType)
+	e.Bytes(payload)
+	e.Uint32(crc32.ChecksumIEEE(payload))
+	return e.Data()
+}
+
+func stateRecord(buf []byte, term uint64, vote string) []byte {
+	e := &frame.Encoder{}
+	e.Uint64(term)
+	e.String(vote)
+	return appendRecord(buf, recordState, e.Data())
+}
+
+func entryRecords(buf []byte, entries []Entry) []byte {
+	for _, entry := range entries {
+		e := &frame.Encoder{}
+		encodeEntry(e, entry)
+		buf = appendRecord(buf, recordEntry, e.Data())
+	}
+	return buf
+}
+
+// write appends buf to the log and syncs it, the node must not reply before its state is on disk
+func (s *Storage) write(buf []byte) error {
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// SaveState saves the current term and the vote of the node in this term
+func (s *Storage) SaveState(term uint64, vote string) error {
+	return s.write(stateRecord(nil, term, vote))
+}
+
+// Append saves entries, they replace the entries with the same indexes and the following ones
+func (s *Storage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.write(entryRecords(nil, entries))
+}
+
+// SaveSnapshot saves snapshot and rewrites the log with the state and the entries following the
+// snapshot
+func (s *Storage) SaveSnapshot(snapshot Snapshot, term uint64, vote string, entries []Entry) error {
+	e := &frame.Encoder{}
+	encodeSnapshot(e, snapshot)
+	if err := writeFileSync(filepath.Join(s.dir, snapshotFileName), appendRecord(nil, recordSnapshot, e.Data())); err != nil {
+		return err
+	}
+	buf := entryRecords(stateRecord(nil, term, vote), entries)
+	path := filepath.Join(s.dir, logFileName)
+	if err := writeFileSync(path, buf); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+// writeFileSync replaces path by a file with data, the file is synced before it is renamed
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func decodeSnapshotFile(data []byte) (Snapshot, error) {
+	recordType, payload, err := readRecord(bufio.NewReader(bytes.NewReader(data)))
+	if err == nil && recordType != recordSnapshot {
+		err = fmt.Errorf("unknown record %q", recordType)
+	}
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("%w: snapshot: %v", errCorrupted, err)
+	}
+	d := messageFormat.NewDecoder(payload)
+	snapshot := decodeSnapshot(d)
+	return snapshot, d.Err()
+}
+
+// Close closes the log
+func (s *Storage) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func entries(term uint64, from, to uint64) []Entry {
+	var es []Entry
+	for i := from; i <= to; i++ {
+		es = append(es, Entry{Index: i, Term: term, Data: []byte{byte(i)}})
+	}
+	return es
+}
+
+func TestStorageReload(t *testing.T) {
+	dir := t.TempDir()
+	s, state, err := OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	if !reflect.DeepEqual(state, State{}) {
+		t.Fatalf("want an empty state, got %+v", state)
+	}
+	common.ExpectNoError(t, s.SaveState(1, "a"))
+	common.ExpectNoError(t, s.Append(entries(1, 1, 5)))
+	// a new leader overwrites the entries from 4
+	common.ExpectNoError(t, s.SaveState(2, ""))
+	common.ExpectNoError(t, s.Append(entries(2, 4, 6)))
+	common.ExpectNoError(t, s.Close())
+
+	s, state, err = OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, state.Term, uint64(2))
+	common.AssertEquals(t, state.Vote, "")
+	want := append(entries(1, 1, 3), entries(2, 4, 6)...)
+	if !reflect.DeepEqual(state.Entries, want) {
+		t.Errorf("want %v, got %v", want, state.Entries)
+	}
+
+	snapshot := Snapshot{Index: 4, Term: 2, Config: Config{{ID: "a", Addr: "127.0.0.1:7000"}}, Data: []byte("data")}
+	common.ExpectNoError(t, s.SaveSnapshot(snapshot, 2, "b", state.Entries[4:]))
+	common.ExpectNoError(t, s.Append(entries(2, 7, 7)))
+	common.ExpectNoError(t, s.Close())
+
+	s, state, err = OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	defer s.Close()
+	if !reflect.DeepEqual(state.Snapshot, snapshot) {
+		t.Errorf("want %+v, got %+v", snapshot, state.Snapshot)
+	}
+	common.AssertEquals(t, state.Vote, "b")
+	if want := entries(2, 5, 7); !reflect.DeepEqual(state.Entries, want) {
+		t.Errorf("want %v, got %v", want, state.Entries)
+	}
+}
+
+func TestStorageTruncatedLog(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, s.SaveState(1, "a"))
+	common.ExpectNoError(t, s.Append(entries(1, 1, 3)))
+	common.ExpectNoError(t, s.Close())
+
+	path := filepath.Join(dir, logFileName)
+	info, err := os.Stat(path)
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, os.Truncate(path, info.Size()-2))
+
+	s, state, err := OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	if want := entries(1, 1, 2); !reflect.DeepEqual(state.Entries, want) {
+		t.Errorf("want %v, got %v", want, state.Entries)
+	}
+	// the next records follow the last complete one
+	common.ExpectNoError(t, s.Append(entries(1, 3, 3)))
+	common.ExpectNoError(t, s.Close())
+	s, state, err = OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	defer s.Close()
+	common.AssertEquals(t, len(state.Entries), 3)
+}
+
+func TestStorageCorruptedLog(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := OpenStorage(dir)
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, s.Append(entries(1, 1, 2)))
+	common.ExpectNoError(t, s.Close())
+
+	path := filepath.Join(dir, logFileName)
+	data, err := os.ReadFile(path)
+	common.ExpectNoError(t, err)
+	data[recordHeaderSize+2] ^= 0xff
+	common.ExpectNoError(t, os.WriteFile(path, data, 0644))
+	if _, _, err := OpenStorage(dir); err == nil {
+		t.Errorf("expected an error opening a corrupted log")
+	}
+}
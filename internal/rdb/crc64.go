@@ -0,0 +1,17 @@
+package rdb
+
+import "hash/crc64"
+
+// jonesPolynomial is the reversed form of the Jones polynomial 0xad93d23594c935a9 used by redis
+const jonesPolynomial = 0x95ac9329ac4bc9b5
+
+var jonesTable = crc64.MakeTable(jonesPolynomial)
+
+// CRC64 updates crc with data using the same CRC-64/Jones variant as redis, start with crc 0.
+// hash/crc64 can not be used directly because it inverts the crc before and after each update.
+func CRC64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = jonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
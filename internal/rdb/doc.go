@@ -0,0 +1,6 @@
+/*
+Package rdb implements the primitives of the redis RDB serialization format: length & string
+encodings and the CRC64 checksum. They are shared by FUNCTION DUMP payloads and snapshots so
+payloads can be exchanged with real redis servers.
+*/
+package rdb
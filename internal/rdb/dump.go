@@ -0,0 +1,75 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrDumpPayload is returned when a DUMP payload is truncated, from a newer version or corrupted
+	ErrDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+	// ErrDumpType is returned when a DUMP payload holds a value of a type that is not supported
+	ErrDumpType = errors.New("ERR Bad data format")
+)
+
+// dumpFooterSize is the size of the RDB version & the CRC64 ending every payload
+const dumpFooterSize = 10
+
+// Dump serializes a string value with the redis DUMP format: the value type, the value, the RDB
+// version and the CRC64 of the preceding bytes
+func Dump(value string) []byte {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	_ = e.WriteByte(typeString)
+	e.WriteString(value)
+	e.WriteDumpFooter()
+	return buf.Bytes()
+}
+
+// WriteDumpFooter ends a DUMP payload with the RDB version and the CRC64 of the bytes written
+// before it
+func (e *Encoder) WriteDumpFooter() {
+	version := make([]byte, 2)
+	binary.LittleEndian.PutUint16(version, Version)
+	_, _ = e.Write(version)
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, e.CRC())
+	_, _ = e.Write(crc)
+}
+
+// DumpBody checks the RDB version and the CRC64 ending a DUMP payload, it returns the serialized
+// content before them
+func DumpBody(payload []byte) ([]byte, error) {
+	if len(payload) < dumpFooterSize {
+		return nil, ErrDumpPayload
+	}
+	version := binary.LittleEndian.Uint16(payload[len(payload)-dumpFooterSize:])
+	crc := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if version > Version || CRC64(0, payload[:len(payload)-8]) != crc {
+		return nil, ErrDumpPayload
+	}
+	return payload[:len(payload)-dumpFooterSize], nil
+}
+
+// Restore returns the string value of a payload created by Dump, or by a redis server
+func Restore(payload []byte) (string, error) {
+	body, err := DumpBody(payload)
+	if err != nil {
+		return "", err
+	}
+	d := NewDecoder(bytes.NewReader(body))
+	valueType, err := d.ReadByte()
+	if err != nil || valueType != typeString {
+		return "", ErrDumpType
+	}
+	value, err := d.ReadString()
+	if err != nil {
+		return "", ErrDumpType
+	}
+	if _, err := d.ReadByte(); err == nil {
+		// trailing bytes after the value
+		return "", ErrDumpType
+	}
+	return value, nil
+}
@@ -0,0 +1,104 @@
+package rdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	for _, value := range []string{"", "bar", "12345", strings.Repeat("z", 1000)} {
+		got, err := Restore(Dump(value))
+		if err != nil {
+			t.Fatalf("Restore() error = %v", err)
+		}
+		if got != value {
+			t.Errorf("Restore() = %q, want %q", got, value)
+		}
+	}
+
+	// the string type, the value, the RDB version then the checksum, like redis
+	payload := Dump("bar")
+	if want := []byte("\x00\x03bar\x0b\x00"); !bytes.HasPrefix(payload, want) || len(payload) != len(want)+8 {
+		t.Errorf("Dump() = %q, want %q followed by the checksum", payload, want)
+	}
+}
+
+func TestRestoreInvalidPayload(t *testing.T) {
+	payload := Dump("value")
+	corrupted := append([]byte{}, payload...)
+	corrupted[2] ^= 0xff
+	newer := append([]byte{}, payload...)
+	newer[len(newer)-10] = Version + 1
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{"truncated", payload[:5], ErrDumpPayload},
+		{"corrupted", corrupted, ErrDumpPayload},
+		{"newer version", newer, ErrDumpPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Restore(tt.payload); err != tt.want {
+				t.Errorf("Restore() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestRestoreOversizedLength restores payloads with a valid checksum declaring strings longer than
+// their content, they fail without allocating the declared length
+func TestRestoreOversizedLength(t *testing.T) {
+	payload := func(write func(e *Encoder)) []byte {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		_ = e.WriteByte(typeString)
+		write(e)
+		e.WriteDumpFooter()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name  string
+		write func(e *Encoder)
+	}{
+		{"64 bit length", func(e *Encoder) {
+			e.WriteLength(1 << 62)
+			_, _ = e.Write([]byte("value"))
+		}},
+		{"out of int64 range", func(e *Encoder) {
+			e.WriteLength(1<<64 - 1)
+		}},
+		{"truncated long string", func(e *Encoder) {
+			e.WriteLength(1 << 20)
+			_, _ = e.Write([]byte(strings.Repeat("x", 1000)))
+		}},
+		{"LZF compressed length", func(e *Encoder) {
+			_ = e.WriteByte(lenEncoded<<6 | encodingLZF)
+			e.WriteLength(1 << 62)
+			e.WriteLength(10)
+		}},
+		{"LZF uncompressed length", func(e *Encoder) {
+			_ = e.WriteByte(lenEncoded<<6 | encodingLZF)
+			e.WriteLength(5)
+			e.WriteLength(1 << 62)
+			_, _ = e.Write([]byte{0x00, 'a', 0xe0, 0x00, 0x00})
+		}},
+		{"LZF output longer than declared", func(e *Encoder) {
+			_ = e.WriteByte(lenEncoded<<6 | encodingLZF)
+			e.WriteLength(5)
+			e.WriteLength(4)
+			_, _ = e.Write([]byte{0x00, 'a', 0xe0, 0x00, 0x00})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Restore(payload(tt.write)); err != ErrDumpType {
+				t.Errorf("Restore() error = %v, want %v", err, ErrDumpType)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	// lenEncoded marks a special string encoding in the two most significant bits
+	lenEncoded = 3
+
+	encodingInt8  = 0
+	encodingInt16 = 1
+	encodingInt32 = 2
+	encodingLZF   = 3
+
+	// maxPrealloc bounds the memory allocated for a length read from the input before its bytes are
+	// received, the buffer of a longer string grows with the bytes read so a corrupted length fails
+	// with a truncated input instead of allocating it
+	maxPrealloc = 64 << 10
+)
+
+// ErrChecksum is returned when a payload checksum does not match its content
+var ErrChecksum = errors.New("rdb checksum mismatch")
+
+// Encoder writes RDB primitives and keeps the CRC64 of everything written
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+// NewEncoder allocates an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Err returns the first error found while writing
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+// CRC returns the checksum of the bytes written so far
+func (e *Encoder) CRC() uint64 {
+	return e.crc
+}
+
+// Write writes raw bytes
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.crc = CRC64(e.crc, p)
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+// WriteByte writes a single byte like an opcode or a value type
+func (e *Encoder) WriteByte(b byte) error {
+	_, err := e.Write([]byte{b})
+	return err
+}
+
+// WriteLength writes a length with the variable size RDB encoding
+func (e *Encoder) WriteLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		_ = e.WriteByte(byte(length) | len6Bit<<6)
+	case length < 1<<14:
+		_, _ = e.Write([]byte{byte(length>>8) | len14Bit<<6, byte(length)})
+	case length <= 0xffffffff:
+		buf := make([]byte, 5)
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		_, _ = e.Write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+		_, _ = e.Write(buf)
+	}
+}
+
+// WriteString writes a string, small integers are stored with the integer encodings like redis does
+func (e *Encoder) WriteString(s string) {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			e.writeInteger(n)
+			return
+		}
+	}
+	e.WriteLength(uint64(len(s)))
+	_, _ = e.Write([]byte(s))
+}
+
+func (e *Encoder) writeInteger(n int64) {
+	switch {
+	case n >= -1<<7 && n < 1<<7:
+		_, _ = e.Write([]byte{lenEncoded<<6 | encodingInt8, byte(n)})
+	case n >= -1<<15 && n < 1<<15:
+		buf := []byte{lenEncoded<<6 | encodingInt16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+		_, _ = e.Write(buf)
+	default:
+		buf := []byte{lenEncoded<<6 | encodingInt32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+		_, _ = e.Write(buf)
+	}
+}
+
+// Decoder reads RDB primitives and keeps the CRC64 of everything read
+type Decoder struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+// NewDecoder allocates a Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// CRC returns the checksum of the bytes read so far
+func (d *Decoder) CRC() uint64 {
+	return d.crc
+}
+
+// ReadFull reads exactly len(p) bytes
+func (d *Decoder) ReadFull(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return err
+	}
+	d.crc = CRC64(d.crc, p)
+	return nil
+}
+
+// readBytes reads length bytes, the allocation follows the bytes actually read
+func (d *Decoder) readBytes(length uint64) ([]byte, error) {
+	if length <= maxPrealloc {
+		buf := make([]byte, length)
+		return buf, d.ReadFull(buf)
+	}
+	if length > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPrealloc)
+	if _, err := io.CopyN(&buf, d.r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d.crc = CRC64(d.crc, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// ReadByte reads a single byte
+func (d *Decoder) ReadByte() (byte, error) {
+	buf := make([]byte, 1)
+	if err := d.ReadFull(buf); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// readLength returns the length or, when encoded is true, the special string encoding
+func (d *Decoder) readLength() (length uint64, encoded bool, err error) {
+	first, err := d.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case len6Bit:
+		return uint64(first & 0x3f), false, nil
+	case len14Bit:
+		next, err := d.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(next), false, nil
+	case lenEncoded:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case len32Bit:
+		buf := make([]byte, 4)
+		if err := d.ReadFull(buf); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf := make([]byte, 8)
+		if err := d.ReadFull(buf); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %x", first)
+}
+
+// ReadLength reads a length written by WriteLength
+func (d *Decoder) ReadLength() (uint64, error) {
+	length, encoded, err := d.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d reading a length", length)
+	}
+	return length, nil
+}
+
+// ReadString reads a string in any of the encodings used by redis
+func (d *Decoder) ReadString() (string, error) {
+	length, encoded, err := d.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := d.readBytes(length)
+		if err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	switch length {
+	case encodingInt8:
+		b, err := d.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b))), nil
+	case encodingInt16:
+		buf := make([]byte, 2)
+		if err := d.ReadFull(buf); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case encodingInt32:
+		buf := make([]byte, 4)
+		if err := d.ReadFull(buf); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case encodingLZF:
+		compressedLen, err := d.ReadLength()
+		if err != nil {
+			return "", err
+		}
+		uncompressedLen, err := d.ReadLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := d.readBytes(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		if uncompressedLen > math.MaxInt32 {
+			return "", fmt.Errorf("invalid LZF length %d", uncompressedLen)
+		}
+		return lzfDecompress(compressed, int(uncompressedLen))
+	}
+	return "", fmt.Errorf("unknown string encoding %d", length)
+}
+
+// lzfDecompress expands the LZF compressed strings redis writes when rdbcompression is enabled,
+// the output never grows past outLen
+func lzfDecompress(in []byte, outLen int) (string, error) {
+	preallocated := outLen
+	if preallocated > maxPrealloc {
+		preallocated = maxPrealloc
+	}
+	out := make([]byte, 0, preallocated)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run of ctrl+1 bytes
+			ctrl++
+			if i+ctrl > len(in) || len(out)+ctrl > outLen {
+				return "", errors.New("invalid LZF literal run")
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return "", errors.New("invalid LZF back reference")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return "", errors.New("invalid LZF back reference")
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - 1 - int(in[i])
+		i++
+		if ref < 0 {
+			return "", errors.New("invalid LZF back reference offset")
+		}
+		if len(out)+length+2 > outLen {
+			return "", errors.New("invalid LZF back reference length")
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return "", fmt.Errorf("invalid LZF length %d expecting %d", len(out), outLen)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,50 @@
+package rdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	// check value from the redis crc64.c test
+	got := CRC64(0, []byte("123456789"))
+	if got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("CRC64() = %x, want e9c6d914c4b8d9ca", got)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	tests := []string{"", "a", "12", "-100", "40000", "-2147483648", "007", strings.Repeat("x", 100), strings.Repeat("y", 20000)}
+	for _, s := range tests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.WriteString(s)
+		if e.Err() != nil {
+			t.Fatalf("WriteString(%q) error = %v", s, e.Err())
+		}
+		d := NewDecoder(&buf)
+		got, err := d.ReadString()
+		if err != nil {
+			t.Fatalf("ReadString() error = %v", err)
+		}
+		if got != s {
+			t.Errorf("ReadString() = %q, want %q", got, s)
+		}
+		if d.CRC() != e.CRC() {
+			t.Errorf("decoder CRC %x differs from encoder CRC %x", d.CRC(), e.CRC())
+		}
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	// "aaaaaaaaaa" compressed by lzf: a literal 'a' followed by a back reference of length 9 at offset 0
+	compressed := []byte{0x00, 'a', 0xe0, 0x00, 0x00}
+	got, err := lzfDecompress(compressed, 10)
+	if err != nil {
+		t.Fatalf("lzfDecompress() error = %v", err)
+	}
+	if got != "aaaaaaaaaa" {
+		t.Errorf("lzfDecompress() = %q", got)
+	}
+}
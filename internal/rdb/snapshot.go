@@ -0,0 +1,259 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Version is the RDB format version written in the file header, redis 7.2 and newer load it
+const Version = 11
+
+// RedisVersion is the redis version matching Version, written in the redis-ver field of the
+// snapshots and reported by HELLO
+const RedisVersion = "7.2.0"
+
+// OpcodeFunction2 precedes the code of a function library in snapshots and FUNCTION DUMP payloads
+const OpcodeFunction2 = 245
+
+const (
+	typeString = 0
+
+	opcodeFunctionPreGA = 246
+	opcodeModuleAux     = 247
+	opcodeIdle          = 248
+	opcodeFreq          = 249
+	opcodeAux           = 250
+	opcodeResizeDB      = 251
+	opcodeExpireTimeMS  = 252
+	opcodeExpireTime    = 253
+	opcodeSelectDB      = 254
+	opcodeEOF           = 255
+)
+
+// Dataset is the keyspace written to a snapshot
+type Dataset interface {
+	// Len returns the number of keys
+	Len() int
+	// ForEach calls fn for every key and its value, it stops at the first error
+	ForEach(fn func(key, value string) error) error
+}
+
+// Save writes a snapshot with the keys of data and the code of the function libraries, the file
+// ends with the CRC64 checksum of its content
+func Save(w io.Writer, data Dataset, functions []string, now time.Time) error {
+	e := NewEncoder(w)
+	_, _ = e.Write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	aux := [][2]string{
+		{"redis-ver", RedisVersion},
+		{"redis-bits", strconv.Itoa(32 << (^uint(0) >> 63))},
+		{"ctime", strconv.FormatInt(now.Unix(), 10)},
+		{"aof-base", "0"},
+	}
+	for _, field := range aux {
+		_ = e.WriteByte(opcodeAux)
+		e.WriteString(field[0])
+		e.WriteString(field[1])
+	}
+	for _, code := range functions {
+		_ = e.WriteByte(OpcodeFunction2)
+		e.WriteString(code)
+	}
+
+	_ = e.WriteByte(opcodeSelectDB)
+	e.WriteLength(0)
+	_ = e.WriteByte(opcodeResizeDB)
+	e.WriteLength(uint64(data.Len()))
+	e.WriteLength(0)
+	err := data.ForEach(func(key, value string) error {
+		_ = e.WriteByte(typeString)
+		e.WriteString(key)
+		e.WriteString(value)
+		return e.Err()
+	})
+	if err != nil {
+		return err
+	}
+	_ = e.WriteByte(opcodeEOF)
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, e.CRC())
+	if e.Err() != nil {
+		return e.Err()
+	}
+	_, err = w.Write(checksum)
+	return err
+}
+
+// Loader receives the content of a snapshot
+type Loader struct {
+	// Set is called for every key, expired is true when the key had an expire time that already
+	// passed
+	Set func(key, value string, expired bool)
+	// Function is called with the code of every function library
+	Function func(code string) error
+	// Aux is called for the auxiliary fields, like redis-ver and ctime, when it is not nil
+	Aux func(key, value string)
+}
+
+// Load reads a snapshot written by Save or by redis. Only string keys are supported, the
+// expire times are reported to the loader but not kept.
+func Load(r io.Reader, loader Loader, now time.Time) error {
+	d := NewDecoder(r)
+	version, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+
+	var expireAt *time.Time
+	for {
+		opcode, err := d.ReadByte()
+		if err != nil {
+			return fmt.Errorf("short read loading RDB: %w", err)
+		}
+		switch opcode {
+		case opcodeEOF:
+			return d.verifyChecksum(version)
+		case opcodeAux:
+			key, err := d.ReadString()
+			if err != nil {
+				return err
+			}
+			value, err := d.ReadString()
+			if err != nil {
+				return err
+			}
+			if loader.Aux != nil {
+				loader.Aux(key, value)
+			}
+		case opcodeSelectDB:
+			db, err := d.ReadLength()
+			if err != nil {
+				return err
+			}
+			if db != 0 {
+				return fmt.Errorf("only db 0 is supported, found db %d", db)
+			}
+		case opcodeResizeDB:
+			for i := 0; i < 2; i++ {
+				if _, err := d.ReadLength(); err != nil {
+					return err
+				}
+			}
+		case opcodeExpireTime, opcodeExpireTimeMS:
+			size := 4
+			if opcode == opcodeExpireTimeMS {
+				size = 8
+			}
+			buf := make([]byte, 8)
+			if err := d.ReadFull(buf[:size]); err != nil {
+				return err
+			}
+			var at time.Time
+			if opcode == opcodeExpireTimeMS {
+				at = time.Unix(0, int64(binary.LittleEndian.Uint64(buf))*int64(time.Millisecond))
+			} else {
+				at = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			}
+			expireAt = &at
+		case opcodeIdle:
+			if _, err := d.ReadLength(); err != nil {
+				return err
+			}
+		case opcodeFreq:
+			if _, err := d.ReadByte(); err != nil {
+				return err
+			}
+		case OpcodeFunction2:
+			code, err := d.ReadString()
+			if err != nil {
+				return err
+			}
+			if err := loader.Function(code); err != nil {
+				return fmt.Errorf("loading function library: %w", err)
+			}
+		case opcodeFunctionPreGA, opcodeModuleAux:
+			return fmt.Errorf("unsupported RDB opcode %d", opcode)
+		case typeString:
+			key, err := d.ReadString()
+			if err != nil {
+				return err
+			}
+			value, err := d.ReadString()
+			if err != nil {
+				return err
+			}
+			loader.Set(key, value, expireAt != nil && !expireAt.After(now))
+			expireAt = nil
+		default:
+			return fmt.Errorf("unsupported RDB value type %d", opcode)
+		}
+	}
+}
+
+// CreationTime returns the ctime auxiliary field, the time the snapshot was written, reading only
+// the beginning of the file
+func CreationTime(r io.Reader) (time.Time, error) {
+	d := NewDecoder(r)
+	if _, err := d.readHeader(); err != nil {
+		return time.Time{}, err
+	}
+	for {
+		opcode, err := d.ReadByte()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("short read loading RDB: %w", err)
+		}
+		if opcode != opcodeAux {
+			return time.Time{}, fmt.Errorf("the RDB file has no ctime field")
+		}
+		key, err := d.ReadString()
+		if err != nil {
+			return time.Time{}, err
+		}
+		value, err := d.ReadString()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if key == "ctime" {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid ctime %q", value)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+}
+
+func (d *Decoder) readHeader() (int, error) {
+	header := make([]byte, 9)
+	if err := d.ReadFull(header); err != nil {
+		return 0, fmt.Errorf("reading RDB header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return 0, fmt.Errorf("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > Version {
+		return 0, fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+	return version, nil
+}
+
+// verifyChecksum reads the checksum following the EOF opcode, a zero checksum means the file was
+// written with checksums disabled
+func (d *Decoder) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+	expected := d.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return fmt.Errorf("reading RDB checksum: %w", err)
+	}
+	if checksum := binary.LittleEndian.Uint64(buf); checksum != 0 && checksum != expected {
+		return ErrChecksum
+	}
+	return nil
+}
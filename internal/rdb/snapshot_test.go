@@ -0,0 +1,127 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mapDataset map[string]string
+
+func (m mapDataset) Len() int {
+	return len(m)
+}
+
+func (m mapDataset) ForEach(fn func(key, value string) error) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadMap(t *testing.T, payload []byte) (mapDataset, []string, error) {
+	t.Helper()
+	data := make(mapDataset)
+	var functions []string
+	err := Load(bytes.NewReader(payload), Loader{
+		Set: func(key, value string, expired bool) {
+			if !expired {
+				data[key] = value
+			}
+		},
+		Function: func(code string) error {
+			functions = append(functions, code)
+			return nil
+		},
+	}, time.Unix(1_700_000_000, 0))
+	return data, functions, err
+}
+
+func TestSaveLoad(t *testing.T) {
+	data := mapDataset{"a": "1", "counter": "12345", "text": "hello\r\nworld"}
+	functions := []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"}
+	var buf bytes.Buffer
+	if err := Save(&buf, data, functions, time.Unix(1_700_000_000, 0)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, loadedFunctions, err := loadMap(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, data) {
+		t.Errorf("Load() data = %v, want %v", loaded, data)
+	}
+	if !reflect.DeepEqual(loadedFunctions, functions) {
+		t.Errorf("Load() functions = %v, want %v", loadedFunctions, functions)
+	}
+
+	ctime, err := CreationTime(bytes.NewReader(buf.Bytes()))
+	if err != nil || !ctime.Equal(time.Unix(1_700_000_000, 0)) {
+		t.Errorf("CreationTime() = %v, %v, want %v", ctime, err, time.Unix(1_700_000_000, 0))
+	}
+
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)-12] ^= 0xff
+	if _, _, err := loadMap(t, corrupted); err == nil {
+		t.Errorf("want error loading a corrupted snapshot")
+	}
+	truncated := buf.Bytes()[:buf.Len()-20]
+	if _, _, err := loadMap(t, truncated); err == nil {
+		t.Errorf("want error loading a truncated snapshot")
+	}
+}
+
+func TestLoadExpireTimes(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	_, _ = e.Write([]byte("REDIS0009"))
+	_ = e.WriteByte(opcodeSelectDB)
+	e.WriteLength(0)
+	for _, key := range []struct {
+		name     string
+		expireAt int64
+	}{{"expired", 1_600_000_000_000}, {"alive", 1_800_000_000_000}} {
+		_ = e.WriteByte(opcodeExpireTimeMS)
+		ms := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ms, uint64(key.expireAt))
+		_, _ = e.Write(ms)
+		_ = e.WriteByte(typeString)
+		e.WriteString(key.name)
+		e.WriteString("v")
+	}
+	_ = e.WriteByte(opcodeEOF)
+	// checksums disabled
+	buf.Write(make([]byte, 8))
+
+	loaded, _, err := loadMap(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, mapDataset{"alive": "v"}) {
+		t.Errorf("Load() = %v, want only the alive key", loaded)
+	}
+}
+
+func TestLoadChecksumMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Save(&buf, mapDataset{"a": "1"}, nil, time.Now()); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	payload := buf.Bytes()
+	payload[len(payload)-1] ^= 0xff
+	if _, _, err := loadMap(t, payload); !errors.Is(err, ErrChecksum) {
+		t.Errorf("want ErrChecksum, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Package replication implements the pieces of the master-replica replication that do not depend
+// on the server: the backlog of the replication stream, the output buffer streaming it to a
+// replica and the handshake a replica runs against its master.
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewID returns a random replication ID of 40 hex characters, like redis
+func NewID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Backlog keeps the last bytes of the replication stream in a ring buffer so a replica that lost
+// its connection can continue from its offset with PSYNC. Offsets count the bytes of the stream,
+// the first byte has offset 1 like redis.
+type Backlog struct {
+	buf []byte
+	// next is the index of buf the next byte is written to
+	next    int
+	histlen int
+	offset  int64
+}
+
+// NewBacklog creates a backlog of size bytes, offset is the offset of the last byte of the stream
+// already sent
+func NewBacklog(size int, offset int64) *Backlog {
+	return &Backlog{buf: make([]byte, size), offset: offset}
+}
+
+// Append adds p to the stream
+func (b *Backlog) Append(p []byte) {
+	b.offset += int64(len(p))
+	if len(p) >= len(b.buf) {
+		copy(b.buf, p[len(p)-len(b.buf):])
+		b.next, b.histlen = 0, len(b.buf)
+		return
+	}
+	n := copy(b.buf[b.next:], p)
+	copy(b.buf, p[n:])
+	b.next = (b.next + len(p)) % len(b.buf)
+	b.histlen += len(p)
+	if b.histlen > len(b.buf) {
+		b.histlen = len(b.buf)
+	}
+}
+
+// Offset returns the offset of the last byte of the stream
+func (b *Backlog) Offset() int64 {
+	return b.offset
+}
+
+// FirstByte returns the offset of the first byte kept
+func (b *Backlog) FirstByte() int64 {
+	return b.offset - int64(b.histlen) + 1
+}
+
+// Size returns the capacity of the backlog
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// HistLen returns the number of bytes kept
+func (b *Backlog) HistLen() int {
+	return b.histlen
+}
+
+// Since returns the bytes of the stream from offset on, false when they are no longer kept
+func (b *Backlog) Since(offset int64) ([]byte, bool) {
+	if offset < b.FirstByte() || offset > b.offset+1 {
+		return nil, false
+	}
+	n := int(b.offset - offset + 1)
+	out := make([]byte, n)
+	start := (b.next - n + len(b.buf)) % len(b.buf)
+	copied := copy(out, b.buf[start:])
+	if copied < n {
+		copy(out[copied:], b.buf[:n-copied])
+	}
+	return out, true
+}
@@ -0,0 +1,42 @@
+package replication
+
+import (
+	"testing"
+)
+
+func TestBacklog(t *testing.T) {
+	b := NewBacklog(8, 100)
+	if _, ok := b.Since(101); !ok {
+		t.Errorf("want an empty stream at the next offset")
+	}
+	b.Append([]byte("abcde"))
+	if got, ok := b.Since(103); !ok || string(got) != "cde" {
+		t.Errorf("Since(103) = %q, %v, want cde", got, ok)
+	}
+	b.Append([]byte("fghij"))
+	if b.Offset() != 110 || b.FirstByte() != 103 || b.HistLen() != 8 {
+		t.Errorf("Offset() = %d, FirstByte() = %d, HistLen() = %d, want 110, 103, 8", b.Offset(), b.FirstByte(), b.HistLen())
+	}
+	if got, ok := b.Since(103); !ok || string(got) != "cdefghij" {
+		t.Errorf("Since(103) = %q, %v, want cdefghij wrapping around", got, ok)
+	}
+	if got, ok := b.Since(111); !ok || len(got) != 0 {
+		t.Errorf("Since(111) = %q, %v, want nothing", got, ok)
+	}
+	for _, offset := range []int64{102, 112} {
+		if _, ok := b.Since(offset); ok {
+			t.Errorf("Since(%d) want false, the offset is out of the backlog", offset)
+		}
+	}
+	b.Append([]byte("0123456789"))
+	if got, ok := b.Since(b.FirstByte()); !ok || string(got) != "23456789" {
+		t.Errorf("Since(first byte) = %q, %v, want the last 8 bytes", got, ok)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	if len(id) != 40 || id == NewID() {
+		t.Errorf("NewID() = %q, want 40 random hex characters", id)
+	}
+}
@@ -0,0 +1,113 @@
+package replication
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Sync is the reply of the master to PSYNC
+type Sync struct {
+	// FullResync is set when the master sends a snapshot, the stream continues from Offset.
+	// Otherwise the stream continues from the offset sent with PSYNC.
+	FullResync bool
+	// ID is the replication ID of the master
+	ID     string
+	Offset int64
+	// RDB is the snapshot of a full resynchronization
+	RDB []byte
+}
+
+// Handshake runs the replica side of the replication handshake: PING, REPLCONF and PSYNC with the
+// replication ID and the offset of the next byte the replica wants, "?" and -1 ask for a full
+// resynchronization. r buffers the connection, the replication stream follows in it.
+func Handshake(w io.Writer, r *bufio.Reader, listeningPort uint, id string, offset int64) (Sync, error) {
+	if _, err := command(w, r, "PING"); err != nil {
+		return Sync{}, err
+	}
+	if _, err := command(w, r, "REPLCONF", "listening-port", strconv.FormatUint(uint64(listeningPort), 10)); err != nil {
+		return Sync{}, err
+	}
+	if _, err := command(w, r, "REPLCONF", "capa", "psync2"); err != nil {
+		return Sync{}, err
+	}
+	reply, err := command(w, r, "PSYNC", id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return Sync{}, err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		sync := Sync{FullResync: true, ID: fields[1]}
+		if sync.Offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return Sync{}, fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
+		}
+		sync.RDB, err = readSnapshot(r)
+		return sync, err
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		sync := Sync{ID: id}
+		if len(fields) > 1 {
+			sync.ID = fields[1]
+		}
+		return sync, nil
+	}
+	return Sync{}, fmt.Errorf("unexpected reply to PSYNC: %q", reply)
+}
+
+// command sends args and returns the simple string reply
+func command(w io.Writer, r *bufio.Reader, args ...string) (string, error) {
+	if _, err := w.Write(aof.AppendCommand(nil, args)); err != nil {
+		return "", err
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+"):
+		return line[1:], nil
+	case strings.HasPrefix(line, "-"):
+		return "", fmt.Errorf("%s replied: %s", args[0], line[1:])
+	}
+	return "", fmt.Errorf("unexpected reply to %s: %q", args[0], line)
+}
+
+// readSnapshot reads the RDB payload sent as $<length> followed by the bytes, without CRLF
+func readSnapshot(r *bufio.Reader) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("expecting the snapshot length, got %q", line)
+	}
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid snapshot length %q", line)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readLine reads a line skipping the empty lines masters send to keep the connection alive
+func readLine(r *bufio.Reader) (string, error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("connection closed by the master")
+			}
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			return line, nil
+		}
+	}
+}
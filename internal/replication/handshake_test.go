@@ -0,0 +1,84 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeMaster replies to the handshake with the replies and returns the commands received
+func fakeMaster(t *testing.T, conn net.Conn, replies ...string) chan []string {
+	received := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var commands []string
+		r := bufio.NewReader(conn)
+		for _, reply := range replies {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Errorf("reading the command: %v", err)
+				break
+			}
+			args := make([]string, 0)
+			var n int
+			fmt.Sscanf(line, "*%d", &n)
+			for i := 0; i < n; i++ {
+				_, _ = r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args = append(args, strings.TrimSpace(arg))
+			}
+			commands = append(commands, strings.Join(args, " "))
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				t.Errorf("writing the reply: %v", err)
+			}
+		}
+		received <- commands
+	}()
+	return received
+}
+
+func TestHandshakeFullResync(t *testing.T) {
+	replica, master := net.Pipe()
+	defer replica.Close()
+	stream := string(aof.AppendCommand(nil, []string{"SET", "a", "1"}))
+	received := fakeMaster(t, master, "+PONG\r\n", "+OK\r\n", "+OK\r\n",
+		"+FULLRESYNC 0123 42\r\n\n$7\r\nREDIS00"+stream)
+
+	r := bufio.NewReader(replica)
+	sync, err := Handshake(replica, r, 6380, "?", -1)
+	if err != nil {
+		t.Fatalf("Handshake() error = %v", err)
+	}
+	if !sync.FullResync || sync.ID != "0123" || sync.Offset != 42 || string(sync.RDB) != "REDIS00" {
+		t.Errorf("Handshake() = %+v, want a full resync at 42", sync)
+	}
+	commands := <-received
+	want := "[PING REPLCONF listening-port 6380 REPLCONF capa psync2 PSYNC ? -1]"
+	if fmt.Sprint(commands) != want {
+		t.Errorf("commands = %v, want %s", commands, want)
+	}
+	rest := make([]byte, len(stream))
+	if _, err := r.Read(rest); err != nil || string(rest) != stream {
+		t.Errorf("stream = %q, %v, want the SET after the snapshot", rest, err)
+	}
+}
+
+func TestHandshakeContinue(t *testing.T) {
+	replica, master := net.Pipe()
+	defer replica.Close()
+	fakeMaster(t, master, "+PONG\r\n", "+OK\r\n", "+OK\r\n", "+CONTINUE 4567\r\n")
+	sync, err := Handshake(replica, bufio.NewReader(replica), 6380, "0123", 43)
+	if err != nil || sync.FullResync || sync.ID != "4567" {
+		t.Errorf("Handshake() = %+v, %v, want a partial resync with the new ID", sync, err)
+	}
+
+	replica, master = net.Pipe()
+	defer replica.Close()
+	fakeMaster(t, master, "-NOAUTH Authentication required.\r\n")
+	if _, err := Handshake(replica, bufio.NewReader(replica), 6380, "?", -1); err == nil {
+		t.Errorf("want the error of the master")
+	}
+}
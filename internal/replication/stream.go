@@ -0,0 +1,117 @@
+package replication
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrOutputLimit is returned by Stream.Write when a replica does not keep up with the stream
+var ErrOutputLimit = errors.New("replica output buffer limit reached")
+
+// Stream writes the replication stream to a replica from its own goroutine, the server appends to
+// it without waiting for the network. The buffered bytes are bounded by a limit, a replica
+// exceeding it must be disconnected and resync.
+type Stream struct {
+	w     io.Writer
+	limit int
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	synced bool
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+// NewStream starts streaming to w. sync, when not nil, writes the beginning of the stream, like
+// the snapshot of a full resynchronization, before the bytes written to the stream.
+func NewStream(w io.Writer, limit int, sync func(w io.Writer) error) *Stream {
+	s := &Stream{w: w, limit: limit, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.run(sync)
+	return s
+}
+
+func (s *Stream) run(sync func(w io.Writer) error) {
+	defer close(s.done)
+	if sync != nil {
+		if err := sync(s.w); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	s.mu.Lock()
+	s.synced = true
+	s.mu.Unlock()
+	for range s.wake {
+		s.mu.Lock()
+		buf, closed := s.buf, s.closed
+		s.buf = nil
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		if _, err := s.w.Write(buf); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.buf = nil
+	s.mu.Unlock()
+}
+
+// Synced returns true once the beginning of the stream was written
+func (s *Stream) Synced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.synced
+}
+
+// Write appends p to the stream. It fails once the stream failed writing or the buffered bytes
+// exceed the limit.
+func (s *Stream) Write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.buf)+len(p) > s.limit {
+		s.err = ErrOutputLimit
+		s.buf = nil
+		return s.err
+	}
+	s.buf = append(s.buf, p...)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops the stream and waits for its goroutine, the writer must be closed first when the
+// goroutine can be blocked writing to it
+func (s *Stream) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	<-s.done
+}
@@ -0,0 +1,69 @@
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStream(t *testing.T) {
+	out := &syncBuffer{}
+	started := make(chan struct{})
+	s := NewStream(out, 1024, func(w io.Writer) error {
+		<-started
+		_, err := w.Write([]byte("snapshot;"))
+		return err
+	})
+	// the bytes written during the sync are sent after it
+	if err := s.Write([]byte("a;")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	close(started)
+	if err := s.Write([]byte("b;")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for out.String() != "snapshot;a;b;" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if out.String() != "snapshot;a;b;" {
+		t.Errorf("stream = %q, want snapshot;a;b;", out.String())
+	}
+	s.Close()
+}
+
+func TestStreamLimit(t *testing.T) {
+	block := make(chan struct{})
+	s := NewStream(&syncBuffer{}, 4, func(w io.Writer) error {
+		<-block
+		return nil
+	})
+	if err := s.Write([]byte("1234")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write([]byte("5")); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("want ErrOutputLimit, got %v", err)
+	}
+	close(block)
+	s.Close()
+}
@@ -0,0 +1,188 @@
+// Package reshard moves hash slots from a master of a cluster to another while the cluster serves
+// its clients, like redis-cli --cluster reshard. A slot is opened with CLUSTER SETSLOT IMPORTING
+// and MIGRATING, its keys are moved in batches with MIGRATE and it is assigned to the target with
+// CLUSTER SETSLOT NODE. Meanwhile the clients are redirected with ASK to the target for the keys
+// already moved.
+package reshard
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandDeadlineMult bounds a command with its timeout, MIGRATE waits up to Timeout to connect
+// to the target, to send the keys and to read every reply
+const commandDeadlineMult = 4
+
+// Options tune the moves of the keys
+type Options struct {
+	// Batch is the number of keys moved by each MIGRATE
+	Batch int
+	// Timeout is the timeout of MIGRATE
+	Timeout time.Duration
+	// Replace overwrites the keys existing on the target, without it the move fails on them
+	Replace bool
+	// Logf reports the progress, nothing is reported when nil
+	Logf func(format string, args ...interface{})
+}
+
+// Reshard moves slots from the master listening on the address from to the master listening on
+// to. The slots are moved one at a time, a failure leaves the current slot open so the move can
+// be resumed by running Reshard again.
+func Reshard(from, to string, slots []int, opts Options) error {
+	if opts.Batch <= 0 {
+		opts.Batch = 10
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	src, err := dial(from, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer src.conn.Close()
+	dst, err := dial(to, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer dst.conn.Close()
+	if src.id == dst.id {
+		return fmt.Errorf("%s and %s are the same node", from, to)
+	}
+
+	for _, slot := range slots {
+		moved, err := moveSlot(src, dst, slot, opts)
+		if err != nil {
+			return fmt.Errorf("moving slot %d: %w", slot, err)
+		}
+		if opts.Logf != nil {
+			opts.Logf("moved slot %d from %s to %s with %d keys", slot, from, to, moved)
+		}
+	}
+	return nil
+}
+
+// moveSlot moves slot from src to dst and returns the number of keys moved
+func moveSlot(src, dst *node, slot int, opts Options) (int, error) {
+	s := strconv.Itoa(slot)
+	if _, err := dst.do("CLUSTER", "SETSLOT", s, "IMPORTING", src.id); err != nil {
+		return 0, err
+	}
+	if _, err := src.do("CLUSTER", "SETSLOT", s, "MIGRATING", dst.id); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	timeout := strconv.FormatInt(opts.Timeout.Milliseconds(), 10)
+	for {
+		reply, err := src.do("CLUSTER", "GETKEYSINSLOT", s, strconv.Itoa(opts.Batch))
+		if err != nil {
+			return moved, err
+		}
+		if len(reply.Elems) == 0 {
+			break
+		}
+		args := []string{"MIGRATE", dst.host, strconv.Itoa(dst.port), "", "0", timeout}
+		if opts.Replace {
+			args = append(args, "REPLACE")
+		}
+		args = append(args, "KEYS")
+		for _, key := range reply.Elems {
+			args = append(args, key.Str)
+		}
+		if _, err := src.do(args...); err != nil {
+			return moved, err
+		}
+		moved += len(reply.Elems)
+	}
+
+	// the target first, so it serves the slot before the source redirects the clients to it
+	if _, err := dst.do("CLUSTER", "SETSLOT", s, "NODE", dst.id); err != nil {
+		return moved, err
+	}
+	if _, err := src.do("CLUSTER", "SETSLOT", s, "NODE", dst.id); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+// node is a connection to a master of the cluster
+type node struct {
+	conn    net.Conn
+	reader  *textproto.Reader
+	timeout time.Duration
+	host    string
+	port    int
+	id      string
+}
+
+func dial(addr string, timeout time.Duration) (*node, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{host: host, timeout: timeout}
+	if n.port, err = strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+	if n.conn, err = net.DialTimeout("tcp", addr, timeout); err != nil {
+		return nil, err
+	}
+	n.reader = textproto.NewReader(bufio.NewReader(n.conn))
+	reply, err := n.do("CLUSTER", "MYID")
+	if err != nil {
+		n.conn.Close()
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	n.id = reply.Str
+	return n, nil
+}
+
+// do sends a command and returns its reply, an error reply is returned as an error
+func (n *node) do(args ...string) (resp.Reply, error) {
+	_ = n.conn.SetDeadline(time.Now().Add(commandDeadlineMult * n.timeout))
+	if _, err := n.conn.Write(aof.AppendCommand(nil, args)); err != nil {
+		return resp.Reply{}, err
+	}
+	reply, err := resp.ReadReply(n.reader)
+	if err != nil {
+		return resp.Reply{}, err
+	}
+	if reply.Kind == resp.KindError {
+		return reply, fmt.Errorf("%s replied: %s", args[0], reply.Str)
+	}
+	return reply, nil
+}
+
+// ParseSlots parses a comma separated list of slots and ranges of slots, like 0-99,200
+func ParseSlots(list string) ([]int, error) {
+	var slots []int
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot %q", part)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid slot range %q", part)
+			}
+		}
+		if start < 0 || end >= common.NumSlots || start > end {
+			return nil, fmt.Errorf("invalid slot range %q", part)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
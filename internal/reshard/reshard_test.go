@@ -0,0 +1,33 @@
+package reshard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSlots(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []int
+		wantErr bool
+	}{
+		{"5", []int{5}, false},
+		{"0-3,10", []int{0, 1, 2, 3, 10}, false},
+		{"16383", []int{16383}, false},
+		{"16384", nil, true},
+		{"3-1", nil, true},
+		{"a-b", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := ParseSlots(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSlots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSlots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,57 @@
 package resp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"math"
+	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// MaxBulkLen is the longest bulk string accepted from the clients, the proto-max-bulk-len of redis
+const MaxBulkLen = 512 << 20
+
+// MaxInlineLen is the longest line accepted without its line ending, like the headers of arrays &
+// bulk strings, the PROTO_INLINE_MAX_SIZE of redis
+const MaxInlineLen = 64 << 10
+
+var (
+	// ErrInvalidBulkLength is returned when a client declares a bulk string longer than MaxBulkLen,
+	// like redis the client gets it as a reply before the connection is closed
+	ErrInvalidBulkLength = errors.New("ERR Protocol error: invalid bulk length")
+	// ErrInvalidMultibulkLength is returned for arrays with more elements than an int32 holds
+	ErrInvalidMultibulkLength = errors.New("ERR Protocol error: invalid multibulk length")
+	// ErrTooBigInline is returned for a line longer than MaxInlineLen
+	ErrTooBigInline = errors.New("ERR Protocol error: too big inline request")
+)
+
+// IsProtocolError reports whether err is a protocol error the client gets as a reply before its
+// connection is closed
+func IsProtocolError(err error) bool {
+	return errors.Is(err, ErrInvalidBulkLength) || errors.Is(err, ErrTooBigInline)
+}
+
+// CommandError is returned by DeserializeCMD when the RESP array was read
+// successfully and names a supported command, but its arguments are invalid.
+// The connection can keep being used after this error.
+type CommandError struct {
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
 /*
 DeserializeCMD implements a very simple & limited RESP parser following this assumptions
  - supports only SET,GET, DEL commands
@@ -15,43 +59,211 @@ DeserializeCMD implements a very simple & limited RESP parser following this ass
 return an error if  it does not find SET, GET ,DEL at the beginning of the left trimmed string
 */
 func DeserializeCMD(reader *textproto.Reader) (common.CommandID, common.CommandArguments, error) {
-	arrayHeaderLine, err := reader.ReadLine()
+	bulkStringArray, err := ReadArray(reader)
 	if err != nil {
 		return common.UNKNOWN, nil, err
 	}
+	return bulkStringArrayToCommand(bulkStringArray, err)
+}
+
+// ReadArray reads an array of bulk strings, the form of the commands sent by the clients
+func ReadArray(reader *textproto.Reader) ([]string, error) {
+	arrayHeaderLine, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
 	if arrayHeaderLine[0] != '*' {
-		return common.UNKNOWN, nil, fmt.Errorf("expecting first byte to be *, got %c", arrayHeaderLine[0])
+		return nil, fmt.Errorf("expecting first byte to be *, got %c", arrayHeaderLine[0])
 	}
 	numItems, err := strconv.Atoi(arrayHeaderLine[1:])
 	if err != nil {
-		return common.UNKNOWN, nil, fmt.Errorf("invalid array size characters %s", arrayHeaderLine[1:])
+		return nil, fmt.Errorf("invalid array size characters %s", arrayHeaderLine[1:])
 	}
 	var bulkStringArray []string
 
 	for i := 0; i < numItems; i++ {
 		stringHeaderLine, err := reader.ReadLine()
 		if err != nil {
-			return common.UNKNOWN, nil, err
+			return nil, err
 		}
 		if stringHeaderLine[0] != '$' {
-			return common.UNKNOWN, nil, fmt.Errorf("expecting first byte to be $, got %c", stringHeaderLine[0])
+			return nil, fmt.Errorf("expecting first byte to be $, got %c", stringHeaderLine[0])
 		}
 		numBytes, err := strconv.Atoi(stringHeaderLine[1:])
-		str, err := reader.ReadLine()
+		if err != nil || numBytes < 0 {
+			return nil, fmt.Errorf("invalid string size characters %s", stringHeaderLine[1:])
+		}
+		if numBytes > MaxBulkLen {
+			return nil, ErrInvalidBulkLength
+		}
+		// bulk strings are read by length so they can contain line breaks, e.g. scripts
+		buf := make([]byte, numBytes)
+		if _, err := io.ReadFull(reader.R, buf); err != nil {
+			return nil, err
+		}
+		rest, err := reader.ReadLine()
 		if err != nil {
-			return common.UNKNOWN, nil, err
+			return nil, err
 		}
-		if len(str) != numBytes {
-			return common.UNKNOWN, nil, fmt.Errorf("invalid string bytes len %d expecting %d ", len(str), numBytes)
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("invalid string bytes len %d expecting %d ", numBytes+len(rest), numBytes)
 		}
-		bulkStringArray = append(bulkStringArray, str)
+		bulkStringArray = append(bulkStringArray, string(buf))
 	}
 
 	if bulkStringArray == nil || len(bulkStringArray) == 0 {
-		return common.UNKNOWN, nil, fmt.Errorf("no command read")
+		return nil, fmt.Errorf("no command read")
 	}
+	return bulkStringArray, nil
+}
 
-	return bulkStringArrayToCommand(bulkStringArray, err)
+// RawArgs holds the arguments of a command as slices of the buffer they were parsed from, they are
+// only valid until the buffer changes. They are reused with GetRawArgs & PutRawArgs.
+type RawArgs struct {
+	Args [][]byte
+}
+
+var rawArgsPool = sync.Pool{New: func() interface{} {
+	return &RawArgs{Args: make([][]byte, 0, 8)}
+}}
+
+// GetRawArgs returns RawArgs from the pool
+func GetRawArgs() *RawArgs {
+	return rawArgsPool.Get().(*RawArgs)
+}
+
+// PutRawArgs returns args to the pool, they must not be used after
+func PutRawArgs(args *RawArgs) {
+	for i := range args.Args {
+		args.Args[i] = nil
+	}
+	args.Args = args.Args[:0]
+	rawArgsPool.Put(args)
+}
+
+// ParseArray parses the array of bulk strings at the start of buf like ReadArray, it returns the
+// number of bytes used, 0 when buf does not hold a whole array yet
+func ParseArray(buf []byte) ([]string, int, error) {
+	args := GetRawArgs()
+	defer PutRawArgs(args)
+	n, err := args.Parse(buf)
+	if n == 0 || err != nil {
+		return nil, 0, err
+	}
+	return args.Strings(), n, nil
+}
+
+// Parse parses the array of bulk strings at the start of buf like ParseArray without copying the
+// arguments
+func (a *RawArgs) Parse(buf []byte) (int, error) {
+	a.Args = a.Args[:0]
+	arrayHeaderLine, pos, ok := parseLine(buf, 0)
+	if !ok {
+		return 0, lineTooLong(buf, pos)
+	}
+	if len(arrayHeaderLine) == 0 || arrayHeaderLine[0] != '*' {
+		return 0, fmt.Errorf("expecting first byte to be *, got %q", arrayHeaderLine)
+	}
+	numItems, ok := parseSize(arrayHeaderLine[1:])
+	if !ok {
+		return 0, fmt.Errorf("invalid array size characters %s", arrayHeaderLine[1:])
+	}
+	if numItems <= 0 {
+		return 0, fmt.Errorf("no command read")
+	}
+
+	for i := 0; i < numItems; i++ {
+		var stringHeaderLine []byte
+		if stringHeaderLine, pos, ok = parseLine(buf, pos); !ok {
+			return 0, lineTooLong(buf, pos)
+		}
+		if len(stringHeaderLine) == 0 || stringHeaderLine[0] != '$' {
+			return 0, fmt.Errorf("expecting first byte to be $, got %q", stringHeaderLine)
+		}
+		numBytes, ok := parseSize(stringHeaderLine[1:])
+		if !ok || numBytes < 0 {
+			return 0, fmt.Errorf("invalid string size characters %s", stringHeaderLine[1:])
+		}
+		if numBytes > MaxBulkLen {
+			return 0, ErrInvalidBulkLength
+		}
+		if len(buf)-pos < numBytes {
+			return 0, nil
+		}
+		value := buf[pos : pos+numBytes : pos+numBytes]
+		var rest []byte
+		if rest, pos, ok = parseLine(buf, pos+numBytes); !ok {
+			return 0, lineTooLong(buf, pos)
+		}
+		if len(rest) != 0 {
+			return 0, fmt.Errorf("invalid string bytes len %d expecting %d ", numBytes+len(rest), numBytes)
+		}
+		a.Args = append(a.Args, value)
+	}
+	return pos, nil
+}
+
+// Strings returns copies of the arguments
+func (a *RawArgs) Strings() []string {
+	args := make([]string, len(a.Args))
+	for i, arg := range a.Args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+// parseSize parses the size of an array or a bulk string like strconv.Atoi without converting it
+// to a string first
+func parseSize(b []byte) (int, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative || len(b) > 0 && b[0] == '+' {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	if negative {
+		return -n, true
+	}
+	return n, true
+}
+
+// parseLine returns the line starting at pos without its \r\n or \n ending, like
+// textproto.Reader.ReadLine, and the position after it. ok is false when the line is incomplete.
+func parseLine(buf []byte, pos int) (line []byte, next int, ok bool) {
+	end := bytes.IndexByte(buf[pos:], '\n')
+	if end < 0 {
+		return nil, pos, false
+	}
+	line = buf[pos : pos+end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, pos + end + 1, true
+}
+
+// lineTooLong returns ErrTooBigInline when the incomplete line starting at pos is already longer
+// than MaxInlineLen, the buffers of the clients do not grow while waiting for its end
+func lineTooLong(buf []byte, pos int) error {
+	if len(buf)-pos > MaxInlineLen {
+		return ErrTooBigInline
+	}
+	return nil
+}
+
+// ParseCommand converts the strings of a command, like the ones sent by scripts, to a command
+func ParseCommand(args []string) (common.CommandID, common.CommandArguments, error) {
+	if len(args) == 0 {
+		return common.UNKNOWN, nil, fmt.Errorf("no command read")
+	}
+	return bulkStringArrayToCommand(args, nil)
 }
 
 func bulkStringArrayToCommand(bulkStringArray []string, err error) (common.CommandID, common.CommandArguments, error) {
@@ -75,11 +287,150 @@ func bulkStringArrayToCommand(bulkStringArray []string, err error) (common.Comma
 	case "CLIENT":
 		cmd = common.CLIENT
 		cmdArgs, err = parseCLIENTArguments(args)
+	case "MULTI":
+		cmd = common.MULTI
+		err = parseNoArguments("MULTI", args)
+	case "EXEC":
+		cmd = common.EXEC
+		err = parseNoArguments("EXEC", args)
+	case "DISCARD":
+		cmd = common.DISCARD
+		err = parseNoArguments("DISCARD", args)
+	case "WATCH":
+		cmd = common.WATCH
+		cmdArgs, err = parseWATCHArguments(args)
+	case "UNWATCH":
+		cmd = common.UNWATCH
+		err = parseNoArguments("UNWATCH", args)
+	case "EVAL", "EVAL_RO":
+		cmd = common.EVAL
+		cmdArgs, err = parseEVALArguments(args, strings.HasSuffix(strings.ToUpper(cmdStr), "_RO"))
+	case "EVALSHA", "EVALSHA_RO":
+		cmd = common.EVALSHA
+		cmdArgs, err = parseEVALArguments(args, strings.HasSuffix(strings.ToUpper(cmdStr), "_RO"))
+	case "SCRIPT":
+		cmd = common.SCRIPT
+		cmdArgs, err = parseSCRIPTArguments(args)
+	case "FUNCTION":
+		cmd = common.FUNCTION
+		cmdArgs, err = parseFUNCTIONArguments(args)
+	case "FCALL", "FCALL_RO":
+		cmd = common.FCALL
+		cmdArgs, err = parseEVALArguments(args, strings.HasSuffix(strings.ToUpper(cmdStr), "_RO"))
+	case "PING":
+		cmd = common.PING
+		cmdArgs, err = parsePINGArguments(args)
+	case "SUBSCRIBE":
+		cmd = common.SUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("SUBSCRIBE", args, false)
+	case "UNSUBSCRIBE":
+		cmd = common.UNSUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("UNSUBSCRIBE", args, true)
+	case "PSUBSCRIBE":
+		cmd = common.PSUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("PSUBSCRIBE", args, false)
+	case "PUNSUBSCRIBE":
+		cmd = common.PUNSUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("PUNSUBSCRIBE", args, true)
+	case "PUBLISH":
+		cmd = common.PUBLISH
+		cmdArgs, err = parsePUBLISHArguments(args)
+	case "PUBSUB":
+		cmd = common.PUBSUB
+		cmdArgs, err = parsePUBSUBArguments(args)
+	case "SSUBSCRIBE":
+		cmd = common.SSUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("SSUBSCRIBE", args, false)
+	case "SUNSUBSCRIBE":
+		cmd = common.SUNSUBSCRIBE
+		cmdArgs, err = parseSUBSCRIBEArguments("SUNSUBSCRIBE", args, true)
+	case "SPUBLISH":
+		cmd = common.SPUBLISH
+		cmdArgs, err = parsePUBLISHArguments(args)
+	case "CONFIG":
+		cmd = common.CONFIG
+		cmdArgs, err = parseCONFIGArguments(args)
+	case "HELLO":
+		cmd = common.HELLO
+		cmdArgs, err = parseHELLOArguments(args)
+	case "SAVE":
+		cmd = common.SAVE
+		err = parseNoArguments("SAVE", args)
+	case "BGSAVE":
+		cmd = common.BGSAVE
+		err = parseNoArguments("BGSAVE", args)
+	case "LASTSAVE":
+		cmd = common.LASTSAVE
+		err = parseNoArguments("LASTSAVE", args)
+	case "SCAN":
+		cmd = common.SCAN
+		cmdArgs, err = parseSCANArguments(args)
+	case "BGREWRITEAOF":
+		cmd = common.BGREWRITEAOF
+		err = parseNoArguments("BGREWRITEAOF", args)
+	case "REPLICAOF", "SLAVEOF":
+		cmd = common.REPLICAOF
+		cmdArgs, err = parseREPLICAOFArguments(args)
+	case "REPLCONF":
+		cmd = common.REPLCONF
+		cmdArgs, err = parseREPLCONFArguments(args)
+	case "PSYNC":
+		cmd = common.PSYNC
+		cmdArgs, err = parsePSYNCArguments(args)
+	case "ROLE":
+		cmd = common.ROLE
+		err = parseNoArguments("ROLE", args)
+	case "WAIT":
+		cmd = common.WAIT
+		cmdArgs, err = parseWAITArguments(args)
+	case "WAITAOF":
+		cmd = common.WAITAOF
+		cmdArgs, err = parseWAITAOFArguments(args)
+	case "CLUSTER":
+		cmd = common.CLUSTER
+		cmdArgs, err = parseCLUSTERArguments(args)
+	case "ASKING":
+		cmd = common.ASKING
+		err = parseNoArguments("ASKING", args)
+	case "COMMAND":
+		cmd = common.COMMAND
+		cmdArgs, err = parseCOMMANDArguments(args)
+	case "DUMP":
+		cmd = common.DUMP
+		cmdArgs, err = parseDUMPArguments(args)
+	case "RESTORE", "RESTORE-ASKING":
+		cmd = common.RESTORE
+		cmdArgs, err = parseRESTOREArguments(args, strings.EqualFold(cmdStr, "RESTORE-ASKING"))
+	case "MIGRATE":
+		cmd = common.MIGRATE
+		cmdArgs, err = parseMIGRATEArguments(args)
+	case "RAFT":
+		cmd = common.RAFT
+		cmdArgs, err = parseRAFTArguments(args)
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		cmd = common.INCRBY
+		cmdArgs, err = parseINCRBYArguments(strings.ToUpper(cmdStr), args)
+	case "CRDT":
+		cmd = common.CRDT
+		cmdArgs, err = parseCRDTArguments(args)
+	case "SENTINEL":
+		cmd = common.SENTINEL
+		cmdArgs, err = parseSENTINELArguments(args)
 	default:
 		return common.UNKNOWN, bulkStringArray, nil
 	}
 
-	return cmd, cmdArgs, err
+	if err != nil {
+		return cmd, nil, &CommandError{Err: err}
+	}
+	return cmd, cmdArgs, nil
+}
+
+func parseNoArguments(cmdName string, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("invalid number of args for %s command : %v", cmdName, args)
+	}
+	return nil
 }
 
 func parseSETArguments(args []string) (cmdArgs common.CommandArguments, err error) {
@@ -123,14 +474,83 @@ func parseGETArguments(args []string) (cmdArgs common.CommandArguments, err erro
 }
 
 func parseCLIENTArguments(args []string) (cmdArgs common.CommandArguments, err error) {
-	if len(args) != 1 {
+	if len(args) == 0 {
 		return nil, fmt.Errorf("invalid number of args for CLIENT command : %v", args)
 	}
 	subCMD := common.ClientSubcommand(strings.ToUpper(args[0]))
 	if err := subCMD.IsValid(); err != nil {
 		return nil, err
 	}
-	return common.CLIENTArguments{Subcommand: subCMD}, nil
+	clientArgs := common.CLIENTArguments{Subcommand: subCMD}
+	args = args[1:]
+	switch subCMD {
+	case common.ClientSubcommandTRACKING:
+		clientArgs.Tracking, err = parseTrackingOptions(args)
+		if err != nil {
+			return nil, err
+		}
+	case common.ClientSubcommandCACHING:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid number of args for CLIENT CACHING command : %v", args)
+		}
+		switch strings.ToUpper(args[0]) {
+		case "YES":
+			clientArgs.Caching = true
+		case "NO":
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	default:
+		if len(args) != 0 {
+			return nil, fmt.Errorf("invalid number of args for CLIENT %s command : %v", subCMD, args)
+		}
+	}
+	return clientArgs, nil
+}
+
+// parseTrackingOptions parses ON|OFF [REDIRECT client-id] [PREFIX prefix ...] [BCAST] [OPTIN]
+// [OPTOUT] [NOLOOP]
+func parseTrackingOptions(args []string) (common.TrackingOptions, error) {
+	var opts common.TrackingOptions
+	if len(args) == 0 {
+		return opts, fmt.Errorf("invalid number of args for CLIENT TRACKING command : %v", args)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		opts.On = true
+	case "OFF":
+	default:
+		return opts, fmt.Errorf("ERR syntax error")
+	}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT", "PREFIX":
+			if i+1 == len(args) {
+				return opts, fmt.Errorf("ERR syntax error")
+			}
+			if strings.ToUpper(args[i]) == "PREFIX" {
+				opts.Prefixes = append(opts.Prefixes, args[i+1])
+			} else {
+				id, err := strconv.ParseUint(args[i+1], 10, 64)
+				if err != nil || id == 0 {
+					return opts, fmt.Errorf("ERR Invalid client ID")
+				}
+				opts.Redirect = uint(id)
+			}
+			i++
+		case "BCAST":
+			opts.BCAST = true
+		case "OPTIN":
+			opts.OptIn = true
+		case "OPTOUT":
+			opts.OptOut = true
+		case "NOLOOP":
+			opts.NoLoop = true
+		default:
+			return opts, fmt.Errorf("ERR syntax error")
+		}
+	}
+	return opts, nil
 }
 
 func parseDELArguments(args []string) (cmdArgs common.CommandArguments, err error) {
@@ -140,3 +560,702 @@ func parseDELArguments(args []string) (cmdArgs common.CommandArguments, err erro
 
 	return common.DELArguments{Keys: args}, nil
 }
+
+func parseSCANArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'scan' command")
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ERR invalid cursor")
+	}
+	scanArgs := common.SCANArguments{Cursor: cursor, Count: 10}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			scanArgs.Match = args[i+1]
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+			scanArgs.Count = count
+		case "TYPE":
+			scanArgs.Type = strings.ToLower(args[i+1])
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+	return scanArgs, nil
+}
+
+func parseWATCHArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid number of args for WATCH command: %v", args)
+	}
+
+	return common.WATCHArguments{Keys: args}, nil
+}
+
+func parseEVALArguments(args []string, readOnly bool) (cmdArgs common.CommandArguments, err error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid number of args for EVAL command : %v", args)
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if numKeys > len(args)-2 {
+		return nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+
+	return common.EVALArguments{
+		Script:   args[0],
+		Keys:     args[2 : 2+numKeys],
+		Args:     args[2+numKeys:],
+		ReadOnly: readOnly,
+	}, nil
+}
+
+func parseSCRIPTArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid number of args for SCRIPT command : %v", args)
+	}
+	subCMD := common.ScriptSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	switch subCMD {
+	case common.ScriptSubcommandLOAD:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid number of args for SCRIPT LOAD command : %v", args)
+		}
+	case common.ScriptSubcommandEXISTS:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("invalid number of args for SCRIPT EXISTS command : %v", args)
+		}
+	case common.ScriptSubcommandFLUSH:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("invalid number of args for SCRIPT FLUSH command : %v", args)
+		}
+		if len(args) == 1 {
+			mode := strings.ToUpper(args[0])
+			if mode != "ASYNC" && mode != "SYNC" {
+				return nil, fmt.Errorf("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+	case common.ScriptSubcommandKILL:
+		if len(args) != 0 {
+			return nil, fmt.Errorf("invalid number of args for SCRIPT KILL command : %v", args)
+		}
+	default:
+		return nil, fmt.Errorf("%s is an invalid script subcommand", subCMD)
+	}
+	return common.SCRIPTArguments{Subcommand: subCMD, Args: args}, nil
+}
+
+func parseFUNCTIONArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid number of args for FUNCTION command : %v", args)
+	}
+	fnArgs := common.FUNCTIONArguments{Subcommand: common.FunctionSubcommand(strings.ToUpper(args[0]))}
+	args = args[1:]
+	switch fnArgs.Subcommand {
+	case common.FunctionSubcommandLOAD:
+		if len(args) == 2 && strings.ToUpper(args[0]) == "REPLACE" {
+			fnArgs.Replace = true
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid number of args for FUNCTION LOAD command : %v", args)
+		}
+		fnArgs.Code = args[0]
+	case common.FunctionSubcommandLIST:
+		for i := 0; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHCODE":
+				fnArgs.WithCode = true
+			case "LIBRARYNAME":
+				if i+1 == len(args) {
+					return nil, fmt.Errorf("ERR library name argument was not given")
+				}
+				i++
+				fnArgs.Pattern = args[i]
+			default:
+				return nil, fmt.Errorf("ERR Unknown argument %s", args[i])
+			}
+		}
+	case common.FunctionSubcommandDELETE:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid number of args for FUNCTION DELETE command : %v", args)
+		}
+		fnArgs.Name = args[0]
+	case common.FunctionSubcommandRESTORE:
+		if len(args) != 1 && len(args) != 2 {
+			return nil, fmt.Errorf("invalid number of args for FUNCTION RESTORE command : %v", args)
+		}
+		fnArgs.Code = args[0]
+		fnArgs.Policy = "APPEND"
+		if len(args) == 2 {
+			fnArgs.Policy = strings.ToUpper(args[1])
+			if fnArgs.Policy != "APPEND" && fnArgs.Policy != "REPLACE" && fnArgs.Policy != "FLUSH" {
+				return nil, fmt.Errorf("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+	case common.FunctionSubcommandFLUSH:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("invalid number of args for FUNCTION FLUSH command : %v", args)
+		}
+		if len(args) == 1 {
+			mode := strings.ToUpper(args[0])
+			if mode != "ASYNC" && mode != "SYNC" {
+				return nil, fmt.Errorf("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+	case common.FunctionSubcommandDUMP, common.FunctionSubcommandKILL:
+		if len(args) != 0 {
+			return nil, fmt.Errorf("invalid number of args for FUNCTION %s command : %v", fnArgs.Subcommand, args)
+		}
+	default:
+		return nil, fmt.Errorf("%s is an invalid function subcommand", fnArgs.Subcommand)
+	}
+	return fnArgs, nil
+}
+
+func parsePINGArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	switch len(args) {
+	case 0:
+		return common.PINGArguments{}, nil
+	case 1:
+		return common.PINGArguments{Message: &args[0]}, nil
+	}
+	return nil, fmt.Errorf("invalid number of args for PING command : %v", args)
+}
+
+// parseSUBSCRIBEArguments parses the channels or patterns of the subscribe commands, the
+// unsubscribe commands can be called without arguments to unsubscribe from everything
+func parseSUBSCRIBEArguments(cmdName string, args []string, allowEmpty bool) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 && !allowEmpty {
+		return nil, fmt.Errorf("invalid number of args for %s command : %v", cmdName, args)
+	}
+	return common.SUBSCRIBEArguments{Channels: args}, nil
+}
+
+func parsePUBLISHArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("invalid number of args for PUBLISH command : %v", args)
+	}
+	return common.PUBLISHArguments{Channel: args[0], Message: args[1]}, nil
+}
+
+func parsePUBSUBArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid number of args for PUBSUB command : %v", args)
+	}
+	subCMD := common.PubSubSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	switch subCMD {
+	case common.PubSubSubcommandCHANNELS, common.PubSubSubcommandSHARDCHANNELS:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("invalid number of args for PUBSUB %s command : %v", subCMD, args)
+		}
+	case common.PubSubSubcommandNUMSUB, common.PubSubSubcommandSHARDNUMSUB:
+	case common.PubSubSubcommandNUMPAT:
+		if len(args) != 0 {
+			return nil, fmt.Errorf("invalid number of args for PUBSUB NUMPAT command : %v", args)
+		}
+	default:
+		return nil, fmt.Errorf("%s is an invalid pubsub subcommand", subCMD)
+	}
+	return common.PUBSUBArguments{Subcommand: subCMD, Args: args}, nil
+}
+
+func parseCONFIGArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid number of args for CONFIG command : %v", args)
+	}
+	subCMD := common.ConfigSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	switch subCMD {
+	case common.ConfigSubcommandGET:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("invalid number of args for CONFIG GET command : %v", args)
+		}
+	case common.ConfigSubcommandSET:
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, fmt.Errorf("invalid number of args for CONFIG SET command : %v", args)
+		}
+	default:
+		return nil, fmt.Errorf("%s is an invalid config subcommand", subCMD)
+	}
+	return common.CONFIGArguments{Subcommand: subCMD, Args: args}, nil
+}
+
+func parseCOMMANDArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return common.COMMANDArguments{Subcommand: common.CommandSubcommandALL}, nil
+	}
+	subCMD := common.CommandSubcommand(strings.ToUpper(args[0]))
+	if subCMD != common.CommandSubcommandCOUNT {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try COMMAND HELP.", args[0])
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'command|count' command")
+	}
+	return common.COMMANDArguments{Subcommand: subCMD}, nil
+}
+
+func parseDUMPArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'dump' command")
+	}
+	return common.DUMPArguments{Key: args[0]}, nil
+}
+
+// parseRESTOREArguments parses RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds]
+// [FREQ frequency], IDLETIME & FREQ are ignored without eviction policies
+func parseRESTOREArguments(args []string, asking bool) (cmdArgs common.CommandArguments, err error) {
+	if len(args) < 3 {
+		if asking {
+			return nil, fmt.Errorf("ERR wrong number of arguments for 'restore-asking' command")
+		}
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'restore' command")
+	}
+	restoreArgs := common.RESTOREArguments{Key: args[0], Payload: args[2], Asking: asking}
+	if restoreArgs.TTL, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if restoreArgs.TTL < 0 {
+		return nil, fmt.Errorf("ERR Invalid TTL value, must be >= 0")
+	}
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			restoreArgs.Replace = true
+		case "ABSTTL":
+		case "IDLETIME", "FREQ":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+			if n, err := strconv.ParseInt(args[i+1], 10, 64); err != nil || n < 0 {
+				return nil, fmt.Errorf("ERR Invalid %s value, must be >= 0", strings.ToUpper(args[i]))
+			}
+			i++
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+	return restoreArgs, nil
+}
+
+// parseMIGRATEArguments parses MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password | AUTH2 username password] [KEYS key [key ...]]
+func parseMIGRATEArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) < 5 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'migrate' command")
+	}
+	migrateArgs := common.MIGRATEArguments{Host: args[0]}
+	if migrateArgs.Port, err = strconv.Atoi(args[1]); err != nil || migrateArgs.Port <= 0 || migrateArgs.Port > 65535 {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if migrateArgs.DestinationDB, err = strconv.Atoi(args[3]); err != nil || migrateArgs.DestinationDB < 0 {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if migrateArgs.Timeout, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	keysOption := false
+	for i := 5; i < len(args) && !keysOption; i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			migrateArgs.Copy = true
+		case "REPLACE":
+			migrateArgs.Replace = true
+		case "AUTH":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+			migrateArgs.Password = args[i+1]
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+			migrateArgs.Username, migrateArgs.Password = args[i+1], args[i+2]
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return nil, fmt.Errorf("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			migrateArgs.Keys = args[i+1:]
+			keysOption = true
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+	if !keysOption {
+		migrateArgs.Keys = []string{args[2]}
+	}
+	return migrateArgs, nil
+}
+
+func parseRAFTArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'raft' command")
+	}
+	subCMD := common.RaftSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	raftArgs := common.RAFTArguments{Subcommand: subCMD}
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'raft|%s' command", strings.ToLower(string(subCMD)))
+	switch subCMD {
+	case common.RaftSubcommandINIT, common.RaftSubcommandINFO, common.RaftSubcommandMYID, common.RaftSubcommandMEMBERS:
+		if len(args) != 0 {
+			return nil, wrongArgs
+		}
+	case common.RaftSubcommandADD:
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+		if _, port, err := net.SplitHostPort(args[1]); err != nil || !isPort(port) {
+			return nil, fmt.Errorf("ERR Invalid node address specified: %s", args[1])
+		}
+		raftArgs.NodeID, raftArgs.Addr = args[0], args[1]
+	case common.RaftSubcommandREMOVE:
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		raftArgs.NodeID = args[0]
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try RAFT HELP.", subCMD)
+	}
+	return raftArgs, nil
+}
+
+// parseINCRBYArguments parses INCR key, DECR key, INCRBY key increment & DECRBY key decrement
+func parseINCRBYArguments(name string, args []string) (cmdArgs common.CommandArguments, err error) {
+	byDelta := name == "INCRBY" || name == "DECRBY"
+	if (byDelta && len(args) != 2) || (!byDelta && len(args) != 1) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	}
+	incrArgs := common.INCRBYArguments{Key: args[0], Delta: 1}
+	if byDelta {
+		if incrArgs.Delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+	}
+	if name == "DECR" || name == "DECRBY" {
+		if incrArgs.Delta == math.MinInt64 {
+			return nil, fmt.Errorf("ERR decrement would overflow")
+		}
+		incrArgs.Delta = -incrArgs.Delta
+	}
+	return incrArgs, nil
+}
+
+func parseCRDTArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'crdt' command")
+	}
+	subCMD := common.CrdtSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'crdt|%s' command", strings.ToLower(string(subCMD)))
+	switch subCMD {
+	case common.CrdtSubcommandMERGE:
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+		return common.CRDTArguments{Subcommand: subCMD, Key: args[0], Payload: args[1]}, nil
+	case common.CrdtSubcommandPEERS:
+		if len(args) != 0 {
+			return nil, wrongArgs
+		}
+		return common.CRDTArguments{Subcommand: subCMD}, nil
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try CRDT HELP.", subCMD)
+}
+
+func parseSENTINELArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'sentinel' command")
+	}
+	subCMD := common.SentinelSubcommand(strings.ToUpper(args[0]))
+	if subCMD == "SLAVES" {
+		subCMD = common.SentinelSubcommandREPLICAS
+	}
+	args = args[1:]
+	sentinelArgs := common.SENTINELArguments{Subcommand: subCMD}
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'sentinel|%s' command", strings.ToLower(string(subCMD)))
+	switch subCMD {
+	case common.SentinelSubcommandMASTERS, common.SentinelSubcommandMYID:
+		if len(args) != 0 {
+			return nil, wrongArgs
+		}
+	case common.SentinelSubcommandMASTER, common.SentinelSubcommandREPLICAS, common.SentinelSubcommandSENTINELS,
+		common.SentinelSubcommandCKQUORUM, common.SentinelSubcommandREMOVE, common.SentinelSubcommandFAILOVER,
+		common.SentinelSubcommandMASTERADDR:
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		sentinelArgs.Name = args[0]
+	case common.SentinelSubcommandMONITOR:
+		if len(args) != 4 {
+			return nil, wrongArgs
+		}
+		if !isPort(args[2]) {
+			return nil, fmt.Errorf("ERR Invalid port number")
+		}
+		quorum, err := strconv.Atoi(args[3])
+		if err != nil || quorum <= 0 {
+			return nil, fmt.Errorf("ERR Quorum must be 1 or greater.")
+		}
+		sentinelArgs.Name, sentinelArgs.Host, sentinelArgs.Quorum = args[0], args[1], quorum
+		sentinelArgs.Port, _ = strconv.Atoi(args[2])
+	case common.SentinelSubcommandSET:
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, wrongArgs
+		}
+		sentinelArgs.Name, sentinelArgs.Options = args[0], args[1:]
+	case common.SentinelSubcommandISMASTERDOWN:
+		if len(args) != 4 {
+			return nil, wrongArgs
+		}
+		if !isPort(args[1]) {
+			return nil, fmt.Errorf("ERR Invalid port number")
+		}
+		epoch, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		sentinelArgs.Host, sentinelArgs.Epoch, sentinelArgs.RunID = args[0], epoch, args[3]
+		sentinelArgs.Port, _ = strconv.Atoi(args[1])
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", subCMD)
+	}
+	return sentinelArgs, nil
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port <= 65535
+}
+
+func parseREPLICAOFArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'replicaof' command")
+	}
+	if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+		return common.REPLICAOFArguments{NoOne: true}, nil
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("ERR Invalid master port")
+	}
+	return common.REPLICAOFArguments{Host: args[0], Port: port}, nil
+}
+
+func parseREPLCONFArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("ERR syntax error")
+	}
+	return common.REPLCONFArguments{Args: args}, nil
+}
+
+func parsePSYNCArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'psync' command")
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	return common.PSYNCArguments{ReplID: args[0], Offset: offset}, nil
+}
+
+func parseWAITArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'wait' command")
+	}
+	numReplicas, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return common.WAITArguments{NumReplicas: numReplicas, Timeout: timeout}, nil
+}
+
+func parseWAITAOFArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'waitaof' command")
+	}
+	numLocal, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	numReplicas, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(args[2])
+	if err != nil {
+		return nil, err
+	}
+	return common.WAITArguments{NumLocal: numLocal, NumReplicas: numReplicas, Timeout: timeout}, nil
+}
+
+func parseWaitTimeout(arg string) (int64, error) {
+	timeout, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("ERR timeout is negative")
+	}
+	return timeout, nil
+}
+
+func parseCLUSTERArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'cluster' command")
+	}
+	subCMD := common.ClusterSubcommand(strings.ToUpper(args[0]))
+	args = args[1:]
+	clusterArgs := common.CLUSTERArguments{Subcommand: subCMD}
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(string(subCMD)))
+	switch subCMD {
+	case common.ClusterSubcommandINFO, common.ClusterSubcommandMYID, common.ClusterSubcommandNODES,
+		common.ClusterSubcommandSLOTS, common.ClusterSubcommandSHARDS, common.ClusterSubcommandSAVECONFIG:
+		if len(args) != 0 {
+			return nil, wrongArgs
+		}
+	case common.ClusterSubcommandKEYSLOT:
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		clusterArgs.Key = args[0]
+	case common.ClusterSubcommandCOUNTKEYSINSLOT, common.ClusterSubcommandGETKEYSINSLOT:
+		want := 1
+		if subCMD == common.ClusterSubcommandGETKEYSINSLOT {
+			want = 2
+		}
+		if len(args) != want {
+			return nil, wrongArgs
+		}
+		if clusterArgs.Slots, err = parseSlots(args[:1]); err != nil {
+			return nil, err
+		}
+		if want == 2 {
+			if clusterArgs.Count, err = strconv.Atoi(args[1]); err != nil || clusterArgs.Count < 0 {
+				return nil, fmt.Errorf("ERR Invalid number of keys")
+			}
+		}
+	case common.ClusterSubcommandADDSLOTS, common.ClusterSubcommandDELSLOTS:
+		if len(args) == 0 {
+			return nil, wrongArgs
+		}
+		if clusterArgs.Slots, err = parseSlots(args); err != nil {
+			return nil, err
+		}
+	case common.ClusterSubcommandADDSLOTSRANGE, common.ClusterSubcommandDELSLOTSRANGE:
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, wrongArgs
+		}
+		bounds, err := parseSlots(args)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(bounds); i += 2 {
+			if bounds[i] > bounds[i+1] {
+				return nil, fmt.Errorf("ERR start slot number %d is greater than end slot number %d", bounds[i], bounds[i+1])
+			}
+			for slot := bounds[i]; slot <= bounds[i+1]; slot++ {
+				clusterArgs.Slots = append(clusterArgs.Slots, slot)
+			}
+		}
+	case common.ClusterSubcommandMEET:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, wrongArgs
+		}
+		clusterArgs.Host = args[0]
+		if clusterArgs.Port, err = strconv.Atoi(args[1]); err != nil || clusterArgs.Port <= 0 || clusterArgs.Port > 65535 {
+			return nil, fmt.Errorf("ERR Invalid base port specified: %s", args[1])
+		}
+		clusterArgs.BusPort = clusterArgs.Port + 10000
+		if len(args) == 3 {
+			if clusterArgs.BusPort, err = strconv.Atoi(args[2]); err != nil || clusterArgs.BusPort <= 0 || clusterArgs.BusPort > 65535 {
+				return nil, fmt.Errorf("ERR Invalid bus port specified: %s", args[2])
+			}
+		}
+	case common.ClusterSubcommandREPLICATE, common.ClusterSubcommandCOUNTFAILUREREPORTS:
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		clusterArgs.NodeID = args[0]
+	case common.ClusterSubcommandSETSLOT:
+		if len(args) < 2 {
+			return nil, wrongArgs
+		}
+		if clusterArgs.Slots, err = parseSlots(args[:1]); err != nil {
+			return nil, err
+		}
+		clusterArgs.Option = strings.ToUpper(args[1])
+		switch clusterArgs.Option {
+		case "STABLE":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+			}
+		case "IMPORTING", "MIGRATING", "NODE":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+			}
+			clusterArgs.NodeID = args[2]
+		default:
+			return nil, fmt.Errorf("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		}
+	case common.ClusterSubcommandFAILOVER:
+		if len(args) > 1 {
+			return nil, wrongArgs
+		}
+		if len(args) == 1 {
+			clusterArgs.Option = strings.ToUpper(args[0])
+			if clusterArgs.Option != "FORCE" && clusterArgs.Option != "TAKEOVER" {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", subCMD)
+	}
+	return clusterArgs, nil
+}
+
+func parseSlots(args []string) ([]int, error) {
+	slots := make([]int, 0, len(args))
+	for _, arg := range args {
+		slot, err := strconv.Atoi(arg)
+		if err != nil || slot < 0 || slot >= common.NumSlots {
+			return nil, fmt.Errorf("ERR Invalid or out of range slot")
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+func parseHELLOArguments(args []string) (cmdArgs common.CommandArguments, err error) {
+	if len(args) == 0 {
+		return common.HELLOArguments{}, nil
+	}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[1])
+	}
+	protoVer, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("ERR Protocol version is not an integer or out of range")
+	}
+	return common.HELLOArguments{ProtoVer: protoVer}, nil
+}
@@ -2,6 +2,7 @@ package resp
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/rilopez/redis-wire-protocol/internal/common"
 	"net/textproto"
 	"reflect"
@@ -40,6 +41,16 @@ func TestDeserialize(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:    "SET with line breaks",
+			args:    args{serializedCMD: "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$4\r\na\r\nb\r\n"},
+			wantCMD: common.SET,
+			wantCMDArgs: common.SETArguments{
+				Key:   "foo",
+				Value: "a\r\nb",
+			},
+			wantErr: false,
+		},
 		{
 			name:    "GET",
 			args:    args{serializedCMD: "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"},
@@ -86,6 +97,448 @@ func TestDeserialize(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:        "MULTI",
+			args:        args{serializedCMD: "*1\r\n$5\r\nMULTI\r\n"},
+			wantCMD:     common.MULTI,
+			wantCMDArgs: nil,
+			wantErr:     false,
+		},
+		{
+			name:        "EXEC with arguments",
+			args:        args{serializedCMD: "*2\r\n$4\r\nEXEC\r\n$3\r\nfoo\r\n"},
+			wantCMD:     common.EXEC,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:    "WATCH",
+			args:    args{serializedCMD: "*3\r\n$5\r\nWATCH\r\n$4\r\nkey1\r\n$4\r\nkey2\r\n"},
+			wantCMD: common.WATCH,
+			wantCMDArgs: common.WATCHArguments{
+				Keys: []string{"key1", "key2"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "EVAL",
+			args:    args{serializedCMD: "*5\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n1\r\n$3\r\nkey\r\n$3\r\narg\r\n"},
+			wantCMD: common.EVAL,
+			wantCMDArgs: common.EVALArguments{
+				Script: "return 1",
+				Keys:   []string{"key"},
+				Args:   []string{"arg"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "EVALSHA_RO",
+			args:    args{serializedCMD: "*3\r\n$10\r\nEVALSHA_RO\r\n$3\r\nabc\r\n$1\r\n0\r\n"},
+			wantCMD: common.EVALSHA,
+			wantCMDArgs: common.EVALArguments{
+				Script:   "abc",
+				Keys:     []string{},
+				Args:     []string{},
+				ReadOnly: true,
+			},
+			wantErr: false,
+		},
+		{
+			name:        "EVAL with too many keys",
+			args:        args{serializedCMD: "*3\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n2\r\n"},
+			wantCMD:     common.EVAL,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:    "SCRIPT LOAD",
+			args:    args{serializedCMD: "*3\r\n$6\r\nSCRIPT\r\n$4\r\nload\r\n$8\r\nreturn 1\r\n"},
+			wantCMD: common.SCRIPT,
+			wantCMDArgs: common.SCRIPTArguments{
+				Subcommand: common.ScriptSubcommandLOAD,
+				Args:       []string{"return 1"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "FCALL_RO",
+			args:    args{serializedCMD: "*4\r\n$8\r\nFCALL_RO\r\n$4\r\nmyfn\r\n$1\r\n1\r\n$3\r\nkey\r\n"},
+			wantCMD: common.FCALL,
+			wantCMDArgs: common.EVALArguments{
+				Script:   "myfn",
+				Keys:     []string{"key"},
+				Args:     []string{},
+				ReadOnly: true,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "FUNCTION LOAD REPLACE",
+			args:    args{serializedCMD: "*4\r\n$8\r\nFUNCTION\r\n$4\r\nLOAD\r\n$7\r\nreplace\r\n$4\r\ncode\r\n"},
+			wantCMD: common.FUNCTION,
+			wantCMDArgs: common.FUNCTIONArguments{
+				Subcommand: common.FunctionSubcommandLOAD,
+				Code:       "code",
+				Replace:    true,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "FUNCTION LIST",
+			args:    args{serializedCMD: "*5\r\n$8\r\nFUNCTION\r\n$4\r\nLIST\r\n$8\r\nWITHCODE\r\n$11\r\nLIBRARYNAME\r\n$2\r\nm*\r\n"},
+			wantCMD: common.FUNCTION,
+			wantCMDArgs: common.FUNCTIONArguments{
+				Subcommand: common.FunctionSubcommandLIST,
+				Pattern:    "m*",
+				WithCode:   true,
+			},
+			wantErr: false,
+		},
+		{
+			name:        "FUNCTION RESTORE invalid policy",
+			args:        args{serializedCMD: "*4\r\n$8\r\nFUNCTION\r\n$7\r\nRESTORE\r\n$1\r\nx\r\n$3\r\nBAD\r\n"},
+			wantCMD:     common.FUNCTION,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "UNSUBSCRIBE without channels",
+			args:        args{serializedCMD: "*1\r\n$11\r\nUNSUBSCRIBE\r\n"},
+			wantCMD:     common.UNSUBSCRIBE,
+			wantCMDArgs: common.SUBSCRIBEArguments{Channels: []string{}},
+			wantErr:     false,
+		},
+		{
+			name:        "SUBSCRIBE without channels",
+			args:        args{serializedCMD: "*1\r\n$9\r\nSUBSCRIBE\r\n"},
+			wantCMD:     common.SUBSCRIBE,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "PUBLISH",
+			args:        args{serializedCMD: "*3\r\n$7\r\nPUBLISH\r\n$4\r\nnews\r\n$5\r\nhello\r\n"},
+			wantCMD:     common.PUBLISH,
+			wantCMDArgs: common.PUBLISHArguments{Channel: "news", Message: "hello"},
+			wantErr:     false,
+		},
+		{
+			name:    "PUBSUB NUMSUB",
+			args:    args{serializedCMD: "*3\r\n$6\r\nPUBSUB\r\n$6\r\nnumsub\r\n$4\r\nnews\r\n"},
+			wantCMD: common.PUBSUB,
+			wantCMDArgs: common.PUBSUBArguments{
+				Subcommand: common.PubSubSubcommandNUMSUB,
+				Args:       []string{"news"},
+			},
+			wantErr: false,
+		},
+		{
+			name:        "SPUBLISH",
+			args:        args{serializedCMD: "*3\r\n$8\r\nSPUBLISH\r\n$4\r\nnews\r\n$5\r\nhello\r\n"},
+			wantCMD:     common.SPUBLISH,
+			wantCMDArgs: common.PUBLISHArguments{Channel: "news", Message: "hello"},
+			wantErr:     false,
+		},
+		{
+			name:    "PUBSUB SHARDCHANNELS",
+			args:    args{serializedCMD: "*3\r\n$6\r\nPUBSUB\r\n$13\r\nshardchannels\r\n$1\r\n*\r\n"},
+			wantCMD: common.PUBSUB,
+			wantCMDArgs: common.PUBSUBArguments{
+				Subcommand: common.PubSubSubcommandSHARDCHANNELS,
+				Args:       []string{"*"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "CONFIG SET",
+			args:    args{serializedCMD: "*4\r\n$6\r\nCONFIG\r\n$3\r\nset\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nKEA\r\n"},
+			wantCMD: common.CONFIG,
+			wantCMDArgs: common.CONFIGArguments{
+				Subcommand: common.ConfigSubcommandSET,
+				Args:       []string{"notify-keyspace-events", "KEA"},
+			},
+			wantErr: false,
+		},
+		{
+			name:        "CONFIG SET without value",
+			args:        args{serializedCMD: "*3\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$22\r\nnotify-keyspace-events\r\n"},
+			wantCMD:     common.CONFIG,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:    "CLIENT TRACKING",
+			args:    args{serializedCMD: "*8\r\n$6\r\nCLIENT\r\n$8\r\ntracking\r\n$2\r\non\r\n$5\r\nBCAST\r\n$6\r\nPREFIX\r\n$5\r\nuser:\r\n$8\r\nREDIRECT\r\n$1\r\n7\r\n"},
+			wantCMD: common.CLIENT,
+			wantCMDArgs: common.CLIENTArguments{
+				Subcommand: common.ClientSubcommandTRACKING,
+				Tracking: common.TrackingOptions{
+					On:       true,
+					Redirect: 7,
+					Prefixes: []string{"user:"},
+					BCAST:    true,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "CLIENT CACHING",
+			args:    args{serializedCMD: "*3\r\n$6\r\nCLIENT\r\n$7\r\nCACHING\r\n$3\r\nyes\r\n"},
+			wantCMD: common.CLIENT,
+			wantCMDArgs: common.CLIENTArguments{
+				Subcommand: common.ClientSubcommandCACHING,
+				Caching:    true,
+			},
+			wantErr: false,
+		},
+		{
+			name:        "HELLO",
+			args:        args{serializedCMD: "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"},
+			wantCMD:     common.HELLO,
+			wantCMDArgs: common.HELLOArguments{ProtoVer: 3},
+			wantErr:     false,
+		},
+		{
+			name:        "SCAN",
+			args:        args{serializedCMD: "*6\r\n$4\r\nSCAN\r\n$2\r\n17\r\n$5\r\nmatch\r\n$6\r\nuser:*\r\n$5\r\nCOUNT\r\n$3\r\n100\r\n"},
+			wantCMD:     common.SCAN,
+			wantCMDArgs: common.SCANArguments{Cursor: 17, Match: "user:*", Count: 100},
+			wantErr:     false,
+		},
+		{
+			name:        "SCAN invalid cursor",
+			args:        args{serializedCMD: "*2\r\n$4\r\nSCAN\r\n$2\r\n-1\r\n"},
+			wantCMD:     common.SCAN,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "SLAVEOF",
+			args:        args{serializedCMD: "*3\r\n$7\r\nSLAVEOF\r\n$9\r\nlocalhost\r\n$4\r\n6379\r\n"},
+			wantCMD:     common.REPLICAOF,
+			wantCMDArgs: common.REPLICAOFArguments{Host: "localhost", Port: 6379},
+			wantErr:     false,
+		},
+		{
+			name:        "REPLICAOF NO ONE",
+			args:        args{serializedCMD: "*3\r\n$9\r\nREPLICAOF\r\n$2\r\nno\r\n$3\r\none\r\n"},
+			wantCMD:     common.REPLICAOF,
+			wantCMDArgs: common.REPLICAOFArguments{NoOne: true},
+			wantErr:     false,
+		},
+		{
+			name:        "REPLICAOF invalid port",
+			args:        args{serializedCMD: "*3\r\n$9\r\nREPLICAOF\r\n$9\r\nlocalhost\r\n$3\r\nabc\r\n"},
+			wantCMD:     common.REPLICAOF,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "CLUSTER ADDSLOTSRANGE",
+			args:        args{serializedCMD: "*6\r\n$7\r\nCLUSTER\r\n$13\r\naddslotsrange\r\n$1\r\n0\r\n$1\r\n2\r\n$2\r\n10\r\n$2\r\n10\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: common.CLUSTERArguments{Subcommand: common.ClusterSubcommandADDSLOTSRANGE, Slots: []int{0, 1, 2, 10}},
+			wantErr:     false,
+		},
+		{
+			name:        "CLUSTER GETKEYSINSLOT",
+			args:        args{serializedCMD: "*4\r\n$7\r\nCLUSTER\r\n$13\r\nGETKEYSINSLOT\r\n$3\r\n100\r\n$2\r\n10\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: common.CLUSTERArguments{Subcommand: common.ClusterSubcommandGETKEYSINSLOT, Slots: []int{100}, Count: 10},
+			wantErr:     false,
+		},
+		{
+			name:        "CLUSTER ADDSLOTS out of range",
+			args:        args{serializedCMD: "*3\r\n$7\r\nCLUSTER\r\n$8\r\nADDSLOTS\r\n$5\r\n16384\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "CLUSTER MEET",
+			args:        args{serializedCMD: "*4\r\n$7\r\nCLUSTER\r\n$4\r\nMEET\r\n$9\r\n127.0.0.1\r\n$4\r\n7001\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: common.CLUSTERArguments{Subcommand: common.ClusterSubcommandMEET, Host: "127.0.0.1", Port: 7001, BusPort: 17001},
+			wantErr:     false,
+		},
+		{
+			name:        "CLUSTER FAILOVER TAKEOVER",
+			args:        args{serializedCMD: "*3\r\n$7\r\nCLUSTER\r\n$8\r\nFAILOVER\r\n$8\r\ntakeover\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: common.CLUSTERArguments{Subcommand: common.ClusterSubcommandFAILOVER, Option: "TAKEOVER"},
+			wantErr:     false,
+		},
+		{
+			name:        "CLUSTER SETSLOT MIGRATING",
+			args:        args{serializedCMD: "*5\r\n$7\r\nCLUSTER\r\n$7\r\nSETSLOT\r\n$2\r\n42\r\n$9\r\nmigrating\r\n$3\r\nabc\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: common.CLUSTERArguments{Subcommand: common.ClusterSubcommandSETSLOT, Slots: []int{42}, Option: "MIGRATING", NodeID: "abc"},
+			wantErr:     false,
+		},
+		{
+			name:        "CLUSTER SETSLOT STABLE with node",
+			args:        args{serializedCMD: "*5\r\n$7\r\nCLUSTER\r\n$7\r\nSETSLOT\r\n$2\r\n42\r\n$6\r\nSTABLE\r\n$3\r\nabc\r\n"},
+			wantCMD:     common.CLUSTER,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "RESTORE-ASKING REPLACE",
+			args:        args{serializedCMD: "*5\r\n$14\r\nRESTORE-ASKING\r\n$3\r\nfoo\r\n$1\r\n0\r\n$3\r\nbar\r\n$7\r\nREPLACE\r\n"},
+			wantCMD:     common.RESTORE,
+			wantCMDArgs: common.RESTOREArguments{Key: "foo", Payload: "bar", Replace: true, Asking: true},
+			wantErr:     false,
+		},
+		{
+			name:        "RESTORE negative TTL",
+			args:        args{serializedCMD: "*4\r\n$7\r\nRESTORE\r\n$3\r\nfoo\r\n$2\r\n-1\r\n$3\r\nbar\r\n"},
+			wantCMD:     common.RESTORE,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "MIGRATE KEYS",
+			args:        args{serializedCMD: "*11\r\n$7\r\nMIGRATE\r\n$9\r\n127.0.0.1\r\n$4\r\n7001\r\n$0\r\n\r\n$1\r\n0\r\n$4\r\n5000\r\n$4\r\nCOPY\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n$4\r\nKEYS\r\n$1\r\na\r\n"},
+			wantCMD:     common.MIGRATE,
+			wantCMDArgs: common.MIGRATEArguments{Host: "127.0.0.1", Port: 7001, Keys: []string{"a"}, Timeout: 5000, Copy: true, Password: "secret"},
+			wantErr:     false,
+		},
+		{
+			name:        "MIGRATE KEYS with a key",
+			args:        args{serializedCMD: "*8\r\n$7\r\nMIGRATE\r\n$9\r\n127.0.0.1\r\n$4\r\n7001\r\n$1\r\nb\r\n$1\r\n0\r\n$4\r\n5000\r\n$4\r\nKEYS\r\n$1\r\na\r\n"},
+			wantCMD:     common.MIGRATE,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "RAFT ADD",
+			args:        args{serializedCMD: "*4\r\n$4\r\nRAFT\r\n$3\r\nadd\r\n$3\r\nabc\r\n$14\r\n127.0.0.1:7001\r\n"},
+			wantCMD:     common.RAFT,
+			wantCMDArgs: common.RAFTArguments{Subcommand: common.RaftSubcommandADD, NodeID: "abc", Addr: "127.0.0.1:7001"},
+			wantErr:     false,
+		},
+		{
+			name:        "RAFT ADD without port",
+			args:        args{serializedCMD: "*4\r\n$4\r\nRAFT\r\n$3\r\nADD\r\n$3\r\nabc\r\n$9\r\n127.0.0.1\r\n"},
+			wantCMD:     common.RAFT,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "INCR",
+			args:        args{serializedCMD: "*2\r\n$4\r\nINCR\r\n$1\r\na\r\n"},
+			wantCMD:     common.INCRBY,
+			wantCMDArgs: common.INCRBYArguments{Key: "a", Delta: 1},
+			wantErr:     false,
+		},
+		{
+			name:        "DECRBY",
+			args:        args{serializedCMD: "*3\r\n$6\r\ndecrby\r\n$1\r\na\r\n$2\r\n10\r\n"},
+			wantCMD:     common.INCRBY,
+			wantCMDArgs: common.INCRBYArguments{Key: "a", Delta: -10},
+			wantErr:     false,
+		},
+		{
+			name:        "INCRBY not an integer",
+			args:        args{serializedCMD: "*3\r\n$6\r\nINCRBY\r\n$1\r\na\r\n$1\r\nx\r\n"},
+			wantCMD:     common.INCRBY,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "CRDT MERGE",
+			args:        args{serializedCMD: "*4\r\n$4\r\nCRDT\r\n$5\r\nmerge\r\n$1\r\na\r\n$3\r\nxyz\r\n"},
+			wantCMD:     common.CRDT,
+			wantCMDArgs: common.CRDTArguments{Subcommand: common.CrdtSubcommandMERGE, Key: "a", Payload: "xyz"},
+			wantErr:     false,
+		},
+		{
+			name:        "CRDT MERGE without payload",
+			args:        args{serializedCMD: "*3\r\n$4\r\nCRDT\r\n$5\r\nMERGE\r\n$1\r\na\r\n"},
+			wantCMD:     common.CRDT,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "SENTINEL GET-MASTER-ADDR-BY-NAME",
+			args:        args{serializedCMD: "*3\r\n$8\r\nsentinel\r\n$23\r\nget-master-addr-by-name\r\n$8\r\nmymaster\r\n"},
+			wantCMD:     common.SENTINEL,
+			wantCMDArgs: common.SENTINELArguments{Subcommand: common.SentinelSubcommandMASTERADDR, Name: "mymaster"},
+			wantErr:     false,
+		},
+		{
+			name:        "SENTINEL SLAVES",
+			args:        args{serializedCMD: "*3\r\n$8\r\nSENTINEL\r\n$6\r\nSLAVES\r\n$8\r\nmymaster\r\n"},
+			wantCMD:     common.SENTINEL,
+			wantCMDArgs: common.SENTINELArguments{Subcommand: common.SentinelSubcommandREPLICAS, Name: "mymaster"},
+			wantErr:     false,
+		},
+		{
+			name: "SENTINEL IS-MASTER-DOWN-BY-ADDR",
+			args: args{serializedCMD: "*6\r\n$8\r\nSENTINEL\r\n$22\r\nis-master-down-by-addr\r\n$9\r\n127.0.0.1\r\n" +
+				"$4\r\n6379\r\n$1\r\n3\r\n$1\r\n*\r\n"},
+			wantCMD: common.SENTINEL,
+			wantCMDArgs: common.SENTINELArguments{Subcommand: common.SentinelSubcommandISMASTERDOWN, Host: "127.0.0.1",
+				Port: 6379, Epoch: 3, RunID: "*"},
+			wantErr: false,
+		},
+		{
+			name: "SENTINEL MONITOR with an invalid quorum",
+			args: args{serializedCMD: "*6\r\n$8\r\nSENTINEL\r\n$7\r\nMONITOR\r\n$8\r\nmymaster\r\n$9\r\n127.0.0.1\r\n" +
+				"$4\r\n6379\r\n$1\r\n0\r\n"},
+			wantCMD:     common.SENTINEL,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "SENTINEL SET without value",
+			args:        args{serializedCMD: "*4\r\n$8\r\nSENTINEL\r\n$3\r\nSET\r\n$8\r\nmymaster\r\n$6\r\nquorum\r\n"},
+			wantCMD:     common.SENTINEL,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "COMMAND COUNT",
+			args:        args{serializedCMD: "*2\r\n$7\r\nCOMMAND\r\n$5\r\ncount\r\n"},
+			wantCMD:     common.COMMAND,
+			wantCMDArgs: common.COMMANDArguments{Subcommand: common.CommandSubcommandCOUNT},
+			wantErr:     false,
+		},
+		{
+			name:        "WAIT",
+			args:        args{serializedCMD: "*3\r\n$4\r\nWAIT\r\n$1\r\n2\r\n$3\r\n100\r\n"},
+			wantCMD:     common.WAIT,
+			wantCMDArgs: common.WAITArguments{NumReplicas: 2, Timeout: 100},
+			wantErr:     false,
+		},
+		{
+			name:        "WAITAOF",
+			args:        args{serializedCMD: "*4\r\n$7\r\nWAITAOF\r\n$1\r\n1\r\n$1\r\n0\r\n$1\r\n0\r\n"},
+			wantCMD:     common.WAITAOF,
+			wantCMDArgs: common.WAITArguments{NumLocal: 1},
+			wantErr:     false,
+		},
+		{
+			name:        "WAIT negative timeout",
+			args:        args{serializedCMD: "*3\r\n$4\r\nWAIT\r\n$1\r\n1\r\n$2\r\n-1\r\n"},
+			wantCMD:     common.WAIT,
+			wantCMDArgs: nil,
+			wantErr:     true,
+		},
+		{
+			name:        "PSYNC",
+			args:        args{serializedCMD: "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"},
+			wantCMD:     common.PSYNC,
+			wantCMDArgs: common.PSYNCArguments{ReplID: "?", Offset: -1},
+			wantErr:     false,
+		},
+		{
+			name:        "REPLCONF ACK",
+			args:        args{serializedCMD: "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$3\r\n120\r\n"},
+			wantCMD:     common.REPLCONF,
+			wantCMDArgs: common.REPLCONFArguments{Args: []string{"ACK", "120"}},
+			wantErr:     false,
+		},
 		{
 			name:        "CLIENT invalid subcommand",
 			args:        args{serializedCMD: "*2\r\n$6\r\nCLIENT\r\n$3\nABC\n"},
@@ -112,3 +565,123 @@ func TestDeserialize(t *testing.T) {
 		})
 	}
 }
+
+// TestBulkLengthLimit rejects a bulk string longer than MaxBulkLen from its header, before its
+// bytes are received or allocated
+func TestBulkLengthLimit(t *testing.T) {
+	for _, header := range []string{"*1\r\n$9999999999\r\n", fmt.Sprintf("*2\r\n$3\r\nSET\r\n$%d\r\n", MaxBulkLen+1)} {
+		if _, _, err := ParseArray([]byte(header)); err != ErrInvalidBulkLength {
+			t.Errorf("ParseArray(%q) error = %v, want %v", header, err, ErrInvalidBulkLength)
+		}
+		if _, _, err := DeserializeCMD(textproto.NewReader(bufio.NewReader(strings.NewReader(header)))); err != ErrInvalidBulkLength {
+			t.Errorf("DeserializeCMD(%q) error = %v, want %v", header, err, ErrInvalidBulkLength)
+		}
+	}
+	// the longest bulk string accepted waits for its bytes
+	header := fmt.Sprintf("*1\r\n$%d\r\n", MaxBulkLen)
+	if _, n, err := ParseArray([]byte(header)); n != 0 || err != nil {
+		t.Errorf("ParseArray(%q) = %d, %v, want an incomplete array", header, n, err)
+	}
+}
+
+func TestParseArray(t *testing.T) {
+	tests := []struct {
+		name     string
+		buf      string
+		wantArgs []string
+		wantN    int
+		wantErr  bool
+	}{
+		{name: "complete", buf: "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", wantArgs: []string{"GET", "k"}, wantN: 20},
+		{name: "followed by the next command", buf: "*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n", wantArgs: []string{"PING"}, wantN: 14},
+		{name: "line breaks inside a bulk string", buf: "*1\r\n$4\r\na\r\nb\r\n", wantArgs: []string{"a\r\nb"}, wantN: 14},
+		{name: "bare line feeds", buf: "*1\n$4\nPING\n", wantArgs: []string{"PING"}, wantN: 11},
+		{name: "empty", buf: ""},
+		{name: "incomplete header", buf: "*2\r"},
+		{name: "incomplete bulk string", buf: "*2\r\n$3\r\nGET\r\n$1\r\nk"},
+		{name: "missing element", buf: "*2\r\n$3\r\nGET\r\n"},
+		{name: "not an array", buf: "PING\r\n", wantErr: true},
+		{name: "not a bulk string", buf: "*1\r\n+PING\r\n", wantErr: true},
+		{name: "wrong length", buf: "*1\r\n$3\r\nPING\r\n", wantErr: true},
+		{name: "empty array", buf: "*0\r\n", wantErr: true},
+		{name: "invalid size", buf: "*1\r\n$x\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, n, err := ParseArray([]byte(tt.buf))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseArray() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != tt.wantN || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("ParseArray() = %q, %d, want %q, %d", args, n, tt.wantArgs, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestRawArgs(t *testing.T) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\nv1\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")
+	args := GetRawArgs()
+	n, err := args.Parse(buf)
+	if err != nil || n != 28 {
+		t.Fatalf("Parse() = %d, %v, want 28", n, err)
+	}
+	if !reflect.DeepEqual(args.Strings(), []string{"SET", "k", "v1"}) {
+		t.Errorf("Strings() = %q", args.Strings())
+	}
+	// the arguments are not copied
+	buf[len("*3\r\n$3\r\nSET\r\n$1\r\n")] = 'x'
+	if string(args.Args[1]) != "x" {
+		t.Errorf("Args[1] = %q, want the byte of the buffer", args.Args[1])
+	}
+	// the arguments of the previous command are replaced
+	if n, err = args.Parse(buf[n:]); err != nil || n != 20 || !reflect.DeepEqual(args.Strings(), []string{"GET", "k"}) {
+		t.Errorf("Parse() = %d, %v, %q", n, err, args.Strings())
+	}
+	PutRawArgs(args)
+}
+
+// TestInlineLengthLimit rejects a line longer than MaxInlineLen before its end is received
+func TestInlineLengthLimit(t *testing.T) {
+	long := strings.Repeat("1", MaxInlineLen)
+	for _, buf := range []string{"*" + long, "*1\r\n$" + long, "*1\r\n$1\r\na1" + long} {
+		if _, _, err := ParseArray([]byte(buf)); err != ErrTooBigInline {
+			t.Errorf("ParseArray() of a %d bytes line error = %v, want %v", len(buf), err, ErrTooBigInline)
+		}
+	}
+	// the longest line accepted waits for its end
+	if _, n, err := ParseArray([]byte("*" + long[1:])); n != 0 || err != nil {
+		t.Errorf("ParseArray() = %d, %v, want an incomplete array", n, err)
+	}
+}
+
+func BenchmarkParseRawArgs(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "GET", buf: []byte("*2\r\n$3\r\nGET\r\n$7\r\nkey:123\r\n")},
+		{name: "SET", buf: []byte("*3\r\n$3\r\nSET\r\n$7\r\nkey:123\r\n$16\r\n0123456789abcdef\r\n")},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				args := GetRawArgs()
+				if _, err := args.Parse(bm.buf); err != nil {
+					b.Fatal(err)
+				}
+				PutRawArgs(args)
+			}
+		})
+	}
+}
+
+func BenchmarkParseArray(b *testing.B) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$7\r\nkey:123\r\n$16\r\n0123456789abcdef\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseArray(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ReplyKind is the first byte of a RESP reply
+type ReplyKind byte
+
+const (
+	KindSimpleString ReplyKind = '+'
+	KindError        ReplyKind = '-'
+	KindInteger      ReplyKind = ':'
+	KindBulkString   ReplyKind = '$'
+	KindArray        ReplyKind = '*'
+	// KindPush & KindMap are only sent to RESP3 clients
+	KindPush ReplyKind = '>'
+	KindMap  ReplyKind = '%'
+)
+
+// Reply is a decoded RESP reply
+type Reply struct {
+	Kind ReplyKind
+	// Str holds simple strings, errors and bulk strings
+	Str string
+	Int int64
+	// Elems holds the array & push elements, maps keep every key followed by its value
+	Elems []Reply
+	// Nil is set for null bulk strings and null arrays
+	Nil bool
+}
+
+const (
+	// maxReplyDepth bounds the nesting of the arrays, pushes & maps of a reply
+	maxReplyDepth = 32
+	// maxPreallocElems bounds the elements allocated for an array before they are read
+	maxPreallocElems = 1024
+	// maxPreallocBytes bounds the bytes allocated for a bulk string before they are read
+	maxPreallocBytes = 64 << 10
+)
+
+// ReadReply reads one RESP reply, bulk strings are read by length so they can contain CRLF. The
+// replies are read from other servers, the lengths they declare are bounded like the ones of the
+// commands and the memory allocated follows the bytes actually received.
+func ReadReply(reader *textproto.Reader) (Reply, error) {
+	return readReply(reader.R, 0)
+}
+
+func readReply(r *bufio.Reader, depth int) (Reply, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(line) == 0 {
+		return Reply{}, fmt.Errorf("empty reply line")
+	}
+
+	reply := Reply{Kind: ReplyKind(line[0])}
+	switch reply.Kind {
+	case KindSimpleString, KindError:
+		reply.Str = line[1:]
+	case KindInteger:
+		if reply.Int, err = strconv.ParseInt(line[1:], 10, 64); err != nil {
+			return Reply{}, fmt.Errorf("invalid integer reply %s", line[1:])
+		}
+	case KindBulkString:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Reply{}, fmt.Errorf("invalid bulk string size %s", line[1:])
+		}
+		if size < 0 {
+			reply.Nil = true
+			return reply, nil
+		}
+		if size > MaxBulkLen {
+			return Reply{}, ErrInvalidBulkLength
+		}
+		if reply.Str, err = readBulk(r, size); err != nil {
+			return Reply{}, err
+		}
+	case KindArray, KindPush, KindMap:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Reply{}, fmt.Errorf("invalid array size %s", line[1:])
+		}
+		if size < 0 {
+			reply.Nil = true
+			return reply, nil
+		}
+		if size > math.MaxInt32 {
+			return Reply{}, ErrInvalidMultibulkLength
+		}
+		if depth == maxReplyDepth {
+			return Reply{}, fmt.Errorf("reply nested deeper than %d levels", maxReplyDepth)
+		}
+		if reply.Kind == KindMap {
+			size *= 2
+		}
+		preallocated := size
+		if preallocated > maxPreallocElems {
+			preallocated = maxPreallocElems
+		}
+		reply.Elems = make([]Reply, 0, preallocated)
+		for i := 0; i < size; i++ {
+			elem, err := readReply(r, depth+1)
+			if err != nil {
+				return Reply{}, err
+			}
+			reply.Elems = append(reply.Elems, elem)
+		}
+	default:
+		return Reply{}, fmt.Errorf("unknown reply type %c", line[0])
+	}
+	return reply, nil
+}
+
+// readLine reads a line without its \r\n or \n ending like textproto.Reader.ReadLine, lines longer
+// than MaxInlineLen are a protocol error
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxInlineLen {
+			return "", ErrTooBigInline
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return string(line), nil
+	}
+}
+
+// readBulk reads the size bytes of a bulk string followed by \r\n, the buffer grows with the bytes
+// received
+func readBulk(r *bufio.Reader, size int) (string, error) {
+	if size <= maxPreallocBytes {
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:size]), nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPreallocBytes)
+	if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(buf.Bytes()[:size]), nil
+}
+
+// ParseReply decodes a serialized reply like the ones returned by the serializer functions
+func ParseReply(serialized string) (Reply, error) {
+	return ReadReply(textproto.NewReader(bufio.NewReader(strings.NewReader(serialized))))
+}
+
+// Serialize encodes the reply back to RESP
+func (r Reply) Serialize() string {
+	switch r.Kind {
+	case KindSimpleString:
+		return SimpleString(r.Str)
+	case KindError:
+		return fmt.Sprintf("-%s\r\n", r.Str)
+	case KindInteger:
+		return fmt.Sprintf(":%d\r\n", r.Int)
+	case KindBulkString:
+		if r.Nil {
+			return BulkString(nil)
+		}
+		return BulkString(&r.Str)
+	case KindArray, KindPush, KindMap:
+		if r.Nil {
+			return NullArray()
+		}
+		replies := make([]string, 0, len(r.Elems))
+		for _, elem := range r.Elems {
+			replies = append(replies, elem.Serialize())
+		}
+		switch r.Kind {
+		case KindPush:
+			return Push(replies)
+		case KindMap:
+			return Map(replies)
+		}
+		return RawArray(replies)
+	}
+	return ""
+}
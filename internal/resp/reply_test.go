@@ -0,0 +1,77 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	value := "a\r\nb"
+	tests := []struct {
+		name       string
+		serialized string
+		want       Reply
+	}{
+		{name: "simple string", serialized: SimpleString("OK"), want: Reply{Kind: KindSimpleString, Str: "OK"}},
+		{name: "error", serialized: "-ERR boom\r\n", want: Reply{Kind: KindError, Str: "ERR boom"}},
+		{name: "integer", serialized: Integer(-12), want: Reply{Kind: KindInteger, Int: -12}},
+		{name: "bulk string with CRLF", serialized: BulkString(&value), want: Reply{Kind: KindBulkString, Str: value}},
+		{name: "null bulk string", serialized: BulkString(nil), want: Reply{Kind: KindBulkString, Nil: true}},
+		{name: "null array", serialized: NullArray(), want: Reply{Kind: KindArray, Nil: true}},
+		{name: "array", serialized: RawArray([]string{Integer(1), SimpleString("OK")}), want: Reply{Kind: KindArray, Elems: []Reply{
+			{Kind: KindInteger, Int: 1},
+			{Kind: KindSimpleString, Str: "OK"},
+		}}},
+		{name: "push", serialized: Push([]string{SimpleString("invalidate"), RawArray([]string{})}), want: Reply{Kind: KindPush, Elems: []Reply{
+			{Kind: KindSimpleString, Str: "invalidate"},
+			{Kind: KindArray, Elems: []Reply{}},
+		}}},
+		{name: "map", serialized: Map([]string{SimpleString("proto"), Integer(3)}), want: Reply{Kind: KindMap, Elems: []Reply{
+			{Kind: KindSimpleString, Str: "proto"},
+			{Kind: KindInteger, Int: 3},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReply(tt.serialized)
+			if err != nil {
+				t.Fatalf("ParseReply() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseReply() = %+v, want %+v", got, tt.want)
+			}
+			if serialized := got.Serialize(); serialized != tt.serialized {
+				t.Errorf("Serialize() = %q, want %q", serialized, tt.serialized)
+			}
+		})
+	}
+}
+
+func TestParseReplyOversized(t *testing.T) {
+	tests := []struct {
+		name       string
+		serialized string
+		wantErr    error
+	}{
+		{name: "bulk string longer than MaxBulkLen", serialized: "$536870913\r\n", wantErr: ErrInvalidBulkLength},
+		{name: "array larger than an int32", serialized: "*2147483648\r\n", wantErr: ErrInvalidMultibulkLength},
+		{name: "map larger than an int32", serialized: "%2147483648\r\n", wantErr: ErrInvalidMultibulkLength},
+		{name: "line longer than MaxInlineLen", serialized: "+" + strings.Repeat("a", MaxInlineLen) + "\r\n", wantErr: ErrTooBigInline},
+		{name: "unterminated bulk string", serialized: "$1000000\r\nabc", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated array", serialized: "*1000000000\r\n:1\r\n", wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseReply(tt.serialized); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseReply() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	nested := strings.Repeat("*1\r\n", maxReplyDepth+1) + ":1\r\n"
+	if _, err := ParseReply(nested); err == nil {
+		t.Errorf("ParseReply() of a reply nested %d levels succeeded", maxReplyDepth+1)
+	}
+}
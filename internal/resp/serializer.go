@@ -2,6 +2,7 @@ package resp
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -21,21 +22,88 @@ func Array(elements []interface{}) string {
 	return sb.String()
 }
 
+// RawArray serializes an array whose elements are already RESP encoded replies
+func RawArray(replies []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("*%d\r\n", len(replies)))
+	for _, reply := range replies {
+		sb.WriteString(reply)
+	}
+	return sb.String()
+}
+
+// Push serializes a RESP3 push message, like the client side caching invalidations. The elements
+// are already RESP encoded replies
+func Push(replies []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(">%d\r\n", len(replies)))
+	for _, reply := range replies {
+		sb.WriteString(reply)
+	}
+	return sb.String()
+}
+
+// Map serializes a RESP3 map, pairs holds every key followed by its value already RESP encoded
+func Map(pairs []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%%%d\r\n", len(pairs)/2))
+	for _, reply := range pairs {
+		sb.WriteString(reply)
+	}
+	return sb.String()
+}
+
+// NullArray is the RESP2 null reply used when an array is absent
+func NullArray() string {
+	return "*-1\r\n"
+}
+
 func Integer(v int) string {
-	return fmt.Sprintf(":%d\r\n", v)
+	return string(AppendInteger(make([]byte, 0, 24), int64(v)))
 }
 
 func BulkString(str *string) string {
 	if str == nil {
 		return "$-1\r\n"
 	}
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(*str), *str)
+	return string(AppendBulkString(make([]byte, 0, len(*str)+16), *str))
 }
 
 func SimpleString(str string) string {
-	return fmt.Sprintf("+%s\r\n", str)
+	return string(AppendSimpleString(make([]byte, 0, len(str)+3), str))
 }
 
 func Error(err error) string {
 	return fmt.Sprintf("-%s\r\n", err)
 }
+
+// The Append functions encode the replies at the end of dst, like strconv.AppendInt, so they can
+// be written to the output buffer of a connection without building a string first
+
+// AppendInteger appends the integer reply v to dst
+func AppendInteger(dst []byte, v int64) []byte {
+	dst = append(dst, ':')
+	dst = strconv.AppendInt(dst, v, 10)
+	return append(dst, '\r', '\n')
+}
+
+// AppendBulkString appends the bulk string str to dst
+func AppendBulkString(dst []byte, str string) []byte {
+	dst = append(dst, '$')
+	dst = strconv.AppendInt(dst, int64(len(str)), 10)
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, str...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendNullBulkString appends the null bulk string, the reply of the missing keys, to dst
+func AppendNullBulkString(dst []byte) []byte {
+	return append(dst, "$-1\r\n"...)
+}
+
+// AppendSimpleString appends the simple string str to dst
+func AppendSimpleString(dst []byte, str string) []byte {
+	dst = append(dst, '+')
+	dst = append(dst, str...)
+	return append(dst, '\r', '\n')
+}
@@ -57,3 +57,54 @@ func TestError(t *testing.T) {
 		t.Errorf("Error(): %v , want: %v", gotErr, wantErr)
 	}
 }
+
+func TestRawArray(t *testing.T) {
+	got := RawArray([]string{SimpleString("OK"), Integer(1), BulkString(nil)})
+
+	want := "*3\r\n+OK\r\n:1\r\n$-1\r\n"
+	if got != want {
+		t.Errorf("RawArray(): %q , want: %q", got, want)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	value := "a\r\nb"
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{name: "integer", got: AppendInteger([]byte("prefix"), -42), want: "prefix:-42\r\n"},
+		{name: "bulk string", got: AppendBulkString(nil, value), want: BulkString(&value)},
+		{name: "empty bulk string", got: AppendBulkString(nil, ""), want: "$0\r\n\r\n"},
+		{name: "null bulk string", got: AppendNullBulkString(nil), want: BulkString(nil)},
+		{name: "simple string", got: AppendSimpleString(nil, "OK"), want: SimpleString("OK")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if string(tt.got) != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkReply keeps the replies of the benchmarks from being optimized away
+var benchmarkReply string
+
+func BenchmarkBulkString(b *testing.B) {
+	value := "0123456789abcdef"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkReply = BulkString(&value)
+	}
+}
+
+func BenchmarkAppendBulkString(b *testing.B) {
+	value := "0123456789abcdef"
+	out := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out = AppendBulkString(out[:0], value)
+	}
+}
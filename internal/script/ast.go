@@ -0,0 +1,140 @@
+package script
+
+type expr interface{}
+
+type stmt interface{}
+
+type (
+	nilExpr   struct{}
+	trueExpr  struct{}
+	falseExpr struct{}
+
+	numberExpr struct {
+		value float64
+	}
+
+	stringExpr struct {
+		value string
+	}
+
+	nameExpr struct {
+		name string
+		line int
+	}
+
+	indexExpr struct {
+		object expr
+		key    expr
+		line   int
+	}
+
+	callExpr struct {
+		fn   expr
+		args []expr
+		line int
+	}
+
+	methodCallExpr struct {
+		object expr
+		method string
+		args   []expr
+		line   int
+	}
+
+	functionExpr struct {
+		params []string
+		body   []stmt
+		name   string
+	}
+
+	binaryExpr struct {
+		op    string
+		left  expr
+		right expr
+		line  int
+	}
+
+	unaryExpr struct {
+		op      string
+		operand expr
+		line    int
+	}
+
+	tableField struct {
+		// key is nil for positional fields
+		key   expr
+		value expr
+	}
+
+	tableExpr struct {
+		fields []tableField
+	}
+
+	// parenExpr truncates multiple results to a single value
+	parenExpr struct {
+		inner expr
+	}
+)
+
+type (
+	localStmt struct {
+		names  []string
+		values []expr
+	}
+
+	assignStmt struct {
+		targets []expr
+		values  []expr
+	}
+
+	callStmt struct {
+		call expr
+	}
+
+	doStmt struct {
+		body []stmt
+	}
+
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+
+	repeatStmt struct {
+		body []stmt
+		cond expr
+	}
+
+	ifStmt struct {
+		conds     []expr
+		blocks    [][]stmt
+		elseBlock []stmt
+	}
+
+	numericForStmt struct {
+		name  string
+		start expr
+		limit expr
+		step  expr
+		body  []stmt
+		line  int
+	}
+
+	genericForStmt struct {
+		names []string
+		exprs []expr
+		body  []stmt
+		line  int
+	}
+
+	localFunctionStmt struct {
+		name string
+		fn   *functionExpr
+	}
+
+	returnStmt struct {
+		values []expr
+	}
+
+	breakStmt struct{}
+)
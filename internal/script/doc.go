@@ -0,0 +1,19 @@
+/*
+Package script implements the server side scripting engine used by EVAL & EVALSHA.
+
+Scripts are written in a subset of Lua 5.1 executed by a small tree walking interpreter, so the
+server keeps depending only on the go std lib. The supported subset includes
+
+  - local variables, multiple assignment, closures and recursive local functions
+  - if/elseif/else, while, repeat/until, numeric and generic for loops, break & return
+  - tables, the # operator, string concatenation and arithmetic with string coercion
+  - assert, error, pcall, type, tonumber, tostring, next, pairs, ipairs, unpack, rawget, rawequal
+  - string.len/sub/upper/lower/rep/reverse/byte/char/format and plain string.find
+  - table.insert/remove/concat/getn/unpack and math.floor/ceil/abs/sqrt/exp/log/fmod/pow/min/max
+
+Variable arguments, metatables, coroutines and Lua patterns are not supported.
+
+Scripts interact with the server through the redis table: redis.call, redis.pcall,
+redis.error_reply, redis.status_reply, redis.sha1hex and redis.log.
+*/
+package script
@@ -0,0 +1,656 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInterrupted is returned when the script context is done, it can not be caught by pcall
+var ErrInterrupted = errors.New("script interrupted")
+
+// maxCallDepth limits the recursion of script functions
+const maxCallDepth = 200
+
+// interruptCheckInterval is the number of steps executed between context checks
+const interruptCheckInterval = 1000
+
+// Error is a Lua error raised by error() or by the runtime, Value keeps the error object
+type Error struct {
+	Value Value
+	// positioned is set once the script position has been prepended to a string Value
+	positioned bool
+}
+
+func (e *Error) Error() string {
+	if t, ok := e.Value.(*Table); ok {
+		if msg, ok := t.GetString("err").(string); ok {
+			return msg
+		}
+	}
+	return tostring(e.Value)
+}
+
+func runtimeErrorf(line int, format string, args ...interface{}) error {
+	return &Error{Value: fmt.Sprintf("user_script:%d: %s", line, fmt.Sprintf(format, args...)), positioned: true}
+}
+
+type scope struct {
+	vars   map[string]Value
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: make(map[string]Value), parent: parent}
+}
+
+func (s *scope) lookup(name string) (*scope, bool) {
+	for sc := s; sc != nil; sc = sc.parent {
+		if _, exists := sc.vars[name]; exists {
+			return sc, true
+		}
+	}
+	return nil, false
+}
+
+type flow int
+
+const (
+	flowNormal flow = iota
+	flowBreak
+	flowReturn
+)
+
+type interpreter struct {
+	ctx       context.Context
+	globals   *Table
+	steps     int
+	callDepth int
+	// allowGlobals permits scripts to create globals
+	allowGlobals bool
+	// caller runs the commands of redis.call, it is nil while a library is loading
+	caller Caller
+}
+
+func newInterpreter(ctx context.Context) *interpreter {
+	in := &interpreter{ctx: ctx, globals: NewTable()}
+	openBaseLib(in)
+	return in
+}
+
+func (in *interpreter) tick() error {
+	in.steps++
+	if in.steps%interruptCheckInterval == 0 && in.ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+func (in *interpreter) execBlock(stmts []stmt, env *scope) (flow, []Value, error) {
+	for _, st := range stmts {
+		if err := in.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+		fl, values, err := in.exec(st, env)
+		if err != nil || fl != flowNormal {
+			return fl, values, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interpreter) exec(st stmt, env *scope) (flow, []Value, error) {
+	switch s := st.(type) {
+	case *localStmt:
+		values, err := in.evalList(s.values, env)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, name := range s.names {
+			var v Value
+			if i < len(values) {
+				v = values[i]
+			}
+			env.vars[name] = v
+		}
+	case *localFunctionStmt:
+		// declared before the closure is created so the function can call itself
+		env.vars[s.name] = nil
+		env.vars[s.name] = &closure{fn: s.fn, env: env}
+	case *assignStmt:
+		return flowNormal, nil, in.assign(s, env)
+	case *callStmt:
+		_, err := in.evalMulti(s.call, env)
+		return flowNormal, nil, err
+	case *doStmt:
+		return in.execBlock(s.body, newScope(env))
+	case *whileStmt:
+		for {
+			cond, err := in.eval(s.cond, env)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if !truthy(cond) {
+				break
+			}
+			fl, values, err := in.execLoopBody(s.body, newScope(env))
+			if err != nil || fl == flowReturn {
+				return fl, values, err
+			}
+			if fl == flowBreak {
+				break
+			}
+		}
+	case *repeatStmt:
+		for {
+			bodyEnv := newScope(env)
+			fl, values, err := in.execLoopBody(s.body, bodyEnv)
+			if err != nil || fl == flowReturn {
+				return fl, values, err
+			}
+			if fl == flowBreak {
+				break
+			}
+			// the condition can refer to locals declared in the body
+			cond, err := in.eval(s.cond, bodyEnv)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if truthy(cond) {
+				break
+			}
+		}
+	case *ifStmt:
+		for i, condExpr := range s.conds {
+			cond, err := in.eval(condExpr, env)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if truthy(cond) {
+				return in.execBlock(s.blocks[i], newScope(env))
+			}
+		}
+		return in.execBlock(s.elseBlock, newScope(env))
+	case *numericForStmt:
+		return in.execNumericFor(s, env)
+	case *genericForStmt:
+		return in.execGenericFor(s, env)
+	case *returnStmt:
+		values, err := in.evalList(s.values, env)
+		return flowReturn, values, err
+	case *breakStmt:
+		return flowBreak, nil, nil
+	default:
+		return flowNormal, nil, fmt.Errorf("unknown statement %T", st)
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interpreter) execLoopBody(body []stmt, env *scope) (flow, []Value, error) {
+	if err := in.tick(); err != nil {
+		return flowNormal, nil, err
+	}
+	return in.execBlock(body, env)
+}
+
+func (in *interpreter) execNumericFor(s *numericForStmt, env *scope) (flow, []Value, error) {
+	start, err := in.evalNumber(s.start, env, s.line, "'for' initial value must be a number")
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	limit, err := in.evalNumber(s.limit, env, s.line, "'for' limit must be a number")
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	step := 1.0
+	if s.step != nil {
+		if step, err = in.evalNumber(s.step, env, s.line, "'for' step must be a number"); err != nil {
+			return flowNormal, nil, err
+		}
+	}
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		bodyEnv := newScope(env)
+		bodyEnv.vars[s.name] = i
+		fl, values, err := in.execLoopBody(s.body, bodyEnv)
+		if err != nil || fl == flowReturn {
+			return fl, values, err
+		}
+		if fl == flowBreak {
+			break
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interpreter) evalNumber(e expr, env *scope, line int, msg string) (float64, error) {
+	v, err := in.eval(e, env)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := toNumber(v)
+	if !ok {
+		return 0, runtimeErrorf(line, msg)
+	}
+	return n, nil
+}
+
+func (in *interpreter) execGenericFor(s *genericForStmt, env *scope) (flow, []Value, error) {
+	values, err := in.evalList(s.exprs, env)
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	var iterator, state, control Value
+	if len(values) > 0 {
+		iterator = values[0]
+	}
+	if len(values) > 1 {
+		state = values[1]
+	}
+	if len(values) > 2 {
+		control = values[2]
+	}
+	for {
+		results, err := in.call(iterator, []Value{state, control}, s.line)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		if len(results) == 0 || results[0] == nil {
+			break
+		}
+		control = results[0]
+		bodyEnv := newScope(env)
+		for i, name := range s.names {
+			var v Value
+			if i < len(results) {
+				v = results[i]
+			}
+			bodyEnv.vars[name] = v
+		}
+		fl, values, err := in.execLoopBody(s.body, bodyEnv)
+		if err != nil || fl == flowReturn {
+			return fl, values, err
+		}
+		if fl == flowBreak {
+			break
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (in *interpreter) assign(s *assignStmt, env *scope) error {
+	values, err := in.evalList(s.values, env)
+	if err != nil {
+		return err
+	}
+	for i, target := range s.targets {
+		var v Value
+		if i < len(values) {
+			v = values[i]
+		}
+		switch t := target.(type) {
+		case *nameExpr:
+			if sc, found := env.lookup(t.name); found {
+				sc.vars[t.name] = v
+				continue
+			}
+			if !in.allowGlobals && in.globals.Get(t.name) == nil {
+				return runtimeErrorf(t.line, "Script attempted to create global variable '%s'", t.name)
+			}
+			if err := in.globals.Set(t.name, v); err != nil {
+				return runtimeErrorf(t.line, "%v", err)
+			}
+		case *indexExpr:
+			object, err := in.eval(t.object, env)
+			if err != nil {
+				return err
+			}
+			key, err := in.eval(t.key, env)
+			if err != nil {
+				return err
+			}
+			table, ok := object.(*Table)
+			if !ok {
+				return runtimeErrorf(t.line, "attempt to index a %s value", typeName(object))
+			}
+			if table.readonly {
+				return runtimeErrorf(t.line, "Attempt to modify a readonly table")
+			}
+			if err := table.Set(key, v); err != nil {
+				return runtimeErrorf(t.line, "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// evalList evaluates expressions, only the last one can produce multiple values
+func (in *interpreter) evalList(exprs []expr, env *scope) ([]Value, error) {
+	var values []Value
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			multi, err := in.evalMulti(e, env)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, multi...)
+			break
+		}
+		v, err := in.eval(e, env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// evalMulti evaluates e keeping every value returned by function calls
+func (in *interpreter) evalMulti(e expr, env *scope) ([]Value, error) {
+	switch c := e.(type) {
+	case *callExpr:
+		fn, err := in.eval(c.fn, env)
+		if err != nil {
+			return nil, err
+		}
+		args, err := in.evalList(c.args, env)
+		if err != nil {
+			return nil, err
+		}
+		return in.call(fn, args, c.line)
+	case *methodCallExpr:
+		object, err := in.eval(c.object, env)
+		if err != nil {
+			return nil, err
+		}
+		fn, err := in.index(object, c.method, c.line)
+		if err != nil {
+			return nil, err
+		}
+		args, err := in.evalList(c.args, env)
+		if err != nil {
+			return nil, err
+		}
+		return in.call(fn, append([]Value{object}, args...), c.line)
+	}
+	v, err := in.eval(e, env)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{v}, nil
+}
+
+func (in *interpreter) eval(e expr, env *scope) (Value, error) {
+	switch x := e.(type) {
+	case *nilExpr:
+		return nil, nil
+	case *trueExpr:
+		return true, nil
+	case *falseExpr:
+		return false, nil
+	case *numberExpr:
+		return x.value, nil
+	case *stringExpr:
+		return x.value, nil
+	case *nameExpr:
+		if sc, found := env.lookup(x.name); found {
+			return sc.vars[x.name], nil
+		}
+		v := in.globals.Get(x.name)
+		if v == nil && !in.allowGlobals {
+			return nil, runtimeErrorf(x.line, "Script attempted to access nonexistent global variable '%s'", x.name)
+		}
+		return v, nil
+	case *indexExpr:
+		object, err := in.eval(x.object, env)
+		if err != nil {
+			return nil, err
+		}
+		key, err := in.eval(x.key, env)
+		if err != nil {
+			return nil, err
+		}
+		return in.index(object, key, x.line)
+	case *callExpr, *methodCallExpr:
+		values, err := in.evalMulti(e, env)
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		return values[0], nil
+	case *parenExpr:
+		return in.eval(x.inner, env)
+	case *functionExpr:
+		return &closure{fn: x, env: env}, nil
+	case *tableExpr:
+		return in.evalTable(x, env)
+	case *unaryExpr:
+		return in.evalUnary(x, env)
+	case *binaryExpr:
+		return in.evalBinary(x, env)
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func (in *interpreter) evalTable(x *tableExpr, env *scope) (Value, error) {
+	table := NewTable()
+	position := 1
+	for i, field := range x.fields {
+		if field.key != nil {
+			key, err := in.eval(field.key, env)
+			if err != nil {
+				return nil, err
+			}
+			value, err := in.eval(field.value, env)
+			if err != nil {
+				return nil, err
+			}
+			if err := table.Set(key, value); err != nil {
+				return nil, &Error{Value: err.Error()}
+			}
+			continue
+		}
+		var values []Value
+		if i == len(x.fields)-1 {
+			var err error
+			if values, err = in.evalMulti(field.value, env); err != nil {
+				return nil, err
+			}
+		} else {
+			v, err := in.eval(field.value, env)
+			if err != nil {
+				return nil, err
+			}
+			values = []Value{v}
+		}
+		for _, v := range values {
+			if err := table.Set(float64(position), v); err != nil {
+				return nil, &Error{Value: err.Error()}
+			}
+			position++
+		}
+	}
+	return table, nil
+}
+
+func (in *interpreter) index(object Value, key Value, line int) (Value, error) {
+	switch o := object.(type) {
+	case *Table:
+		return o.Get(key), nil
+	case string:
+		// strings share the string library as methods
+		if lib, ok := in.globals.Get("string").(*Table); ok {
+			return lib.Get(key), nil
+		}
+	}
+	return nil, runtimeErrorf(line, "attempt to index a %s value", typeName(object))
+}
+
+func (in *interpreter) evalUnary(x *unaryExpr, env *scope) (Value, error) {
+	operand, err := in.eval(x.operand, env)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "not":
+		return !truthy(operand), nil
+	case "-":
+		n, ok := toNumber(operand)
+		if !ok {
+			return nil, runtimeErrorf(x.line, "attempt to perform arithmetic on a %s value", typeName(operand))
+		}
+		return -n, nil
+	case "#":
+		switch o := operand.(type) {
+		case string:
+			return float64(len(o)), nil
+		case *Table:
+			return float64(o.Len()), nil
+		}
+		return nil, runtimeErrorf(x.line, "attempt to get length of a %s value", typeName(operand))
+	}
+	return nil, runtimeErrorf(x.line, "unknown operator %s", x.op)
+}
+
+func (in *interpreter) evalBinary(x *binaryExpr, env *scope) (Value, error) {
+	left, err := in.eval(x.left, env)
+	if err != nil {
+		return nil, err
+	}
+	// and & or short circuit
+	switch x.op {
+	case "and":
+		if !truthy(left) {
+			return left, nil
+		}
+		return in.eval(x.right, env)
+	case "or":
+		if truthy(left) {
+			return left, nil
+		}
+		return in.eval(x.right, env)
+	}
+
+	right, err := in.eval(x.right, env)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return left == right, nil
+	case "~=":
+		return left != right, nil
+	case "<", "<=", ">", ">=":
+		return compare(x.op, left, right, x.line)
+	case "..":
+		ls, lok := toString(left)
+		rs, rok := toString(right)
+		if !lok {
+			return nil, runtimeErrorf(x.line, "attempt to concatenate a %s value", typeName(left))
+		}
+		if !rok {
+			return nil, runtimeErrorf(x.line, "attempt to concatenate a %s value", typeName(right))
+		}
+		return ls + rs, nil
+	}
+
+	ln, lok := toNumber(left)
+	rn, rok := toNumber(right)
+	if !lok {
+		return nil, runtimeErrorf(x.line, "attempt to perform arithmetic on a %s value", typeName(left))
+	}
+	if !rok {
+		return nil, runtimeErrorf(x.line, "attempt to perform arithmetic on a %s value", typeName(right))
+	}
+	switch x.op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		return ln / rn, nil
+	case "%":
+		return ln - math.Floor(ln/rn)*rn, nil
+	case "^":
+		return math.Pow(ln, rn), nil
+	}
+	return nil, runtimeErrorf(x.line, "unknown operator %s", x.op)
+}
+
+func compare(op string, left, right Value, line int) (Value, error) {
+	var less, equal bool
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, compareError(left, right, line)
+		}
+		less, equal = l < r, l == r
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, compareError(left, right, line)
+		}
+		less, equal = l < r, l == r
+	default:
+		return nil, compareError(left, right, line)
+	}
+	switch op {
+	case "<":
+		return less, nil
+	case "<=":
+		return less || equal, nil
+	case ">":
+		return !less && !equal, nil
+	}
+	return !less, nil
+}
+
+func compareError(left, right Value, line int) error {
+	if typeName(left) == typeName(right) {
+		return runtimeErrorf(line, "attempt to compare two %s values", typeName(left))
+	}
+	return runtimeErrorf(line, "attempt to compare %s with %s", typeName(left), typeName(right))
+}
+
+// call invokes a Lua or Go function
+func (in *interpreter) call(fn Value, args []Value, line int) ([]Value, error) {
+	if err := in.tick(); err != nil {
+		return nil, err
+	}
+	switch f := fn.(type) {
+	case *GoFunction:
+		values, err := f.Fn(in, args)
+		if e, ok := err.(*Error); ok {
+			if msg, isString := e.Value.(string); isString && !e.positioned {
+				return nil, runtimeErrorf(line, "%s", msg)
+			}
+		}
+		return values, err
+	case *closure:
+		if in.callDepth >= maxCallDepth {
+			return nil, runtimeErrorf(line, "stack overflow")
+		}
+		in.callDepth++
+		defer func() { in.callDepth-- }()
+
+		env := newScope(f.env)
+		for i, param := range f.fn.params {
+			var v Value
+			if i < len(args) {
+				v = args[i]
+			}
+			env.vars[param] = v
+		}
+		fl, values, err := in.execBlock(f.fn.body, env)
+		if err != nil {
+			return nil, err
+		}
+		if fl == flowReturn {
+			return values, nil
+		}
+		return nil, nil
+	}
+	return nil, runtimeErrorf(line, "attempt to call a %s value", typeName(fn))
+}
@@ -0,0 +1,302 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenName
+	tokenNumber
+	tokenString
+	tokenKeyword
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// symbols sorted so the longest match is tried first
+var symbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func tokenize(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+	var tokens []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("user_script:%d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) skipSpacesAndComments() error {
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		switch {
+		case ch == '\n':
+			l.line++
+			l.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if level, ok := l.longBracketLevel(); ok {
+				if _, err := l.readLongBracket(level); err != nil {
+					return err
+				}
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpacesAndComments(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	ch := l.src[l.pos]
+	switch {
+	case isLetter(ch):
+		start := l.pos
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if keywords[word] {
+			return token{kind: tokenKeyword, text: word, line: l.line}, nil
+		}
+		return token{kind: tokenName, text: word, line: l.line}, nil
+	case isDigit(ch) || (ch == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1])):
+		return l.readNumber()
+	case ch == '"' || ch == '\'':
+		return l.readString(ch)
+	case ch == '[':
+		if level, ok := l.longBracketLevel(); ok {
+			str, err := l.readLongBracket(level)
+			if err != nil {
+				return token{}, err
+			}
+			return token{kind: tokenString, text: str, line: l.line}, nil
+		}
+	}
+
+	for _, sym := range symbols {
+		if strings.HasPrefix(l.src[l.pos:], sym) {
+			l.pos += len(sym)
+			return token{kind: tokenSymbol, text: sym, line: l.line}, nil
+		}
+	}
+	return token{}, l.errorf("unexpected symbol near '%c'", ch)
+}
+
+func (l *lexer) readNumber() (token, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && isHexDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	} else {
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+			l.pos++
+			if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+				l.pos++
+			}
+			for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+	text := l.src[start:l.pos]
+	num, ok := parseNumber(text)
+	if !ok {
+		return token{}, l.errorf("malformed number near '%s'", text)
+	}
+	return token{kind: tokenNumber, num: num, text: text, line: l.line}, nil
+}
+
+func (l *lexer) readString(quote byte) (token, error) {
+	l.pos++
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return token{}, l.errorf("unfinished string")
+		}
+		ch := l.src[l.pos]
+		if ch == quote {
+			l.pos++
+			return token{kind: tokenString, text: sb.String(), line: l.line}, nil
+		}
+		if ch != '\\' {
+			sb.WriteByte(ch)
+			l.pos++
+			continue
+		}
+		l.pos++
+		if l.pos >= len(l.src) {
+			return token{}, l.errorf("unfinished string")
+		}
+		esc := l.src[l.pos]
+		l.pos++
+		switch esc {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\n':
+			sb.WriteByte('\n')
+			l.line++
+		case '\\', '"', '\'':
+			sb.WriteByte(esc)
+		default:
+			if !isDigit(esc) {
+				return token{}, l.errorf("invalid escape sequence '\\%c'", esc)
+			}
+			start := l.pos - 1
+			for l.pos < len(l.src) && l.pos-start < 3 && isDigit(l.src[l.pos]) {
+				l.pos++
+			}
+			code, _ := strconv.Atoi(l.src[start:l.pos])
+			if code > 255 {
+				return token{}, l.errorf("escape sequence too large")
+			}
+			sb.WriteByte(byte(code))
+		}
+	}
+}
+
+// longBracketLevel checks if a long bracket like [[ or [==[ starts at the current position
+func (l *lexer) longBracketLevel() (int, bool) {
+	if l.pos >= len(l.src) || l.src[l.pos] != '[' {
+		return 0, false
+	}
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1, true
+	}
+	return 0, false
+}
+
+func (l *lexer) readLongBracket(level int) (string, error) {
+	l.pos += level + 2
+	// a newline right after the opening bracket is skipped
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+		l.line++
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+		l.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		return "", l.errorf("unfinished long string")
+	}
+	str := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(str, "\n")
+	l.pos += end + len(closing)
+	return str, nil
+}
+
+func isLetter(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// parseNumber converts a Lua numeral, it is also used to coerce strings in arithmetic
+func parseNumber(text string) (float64, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, false
+	}
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "0x") || strings.HasPrefix(lower, "-0x") {
+		neg := lower[0] == '-'
+		if neg {
+			lower = lower[1:]
+		}
+		n, err := strconv.ParseUint(lower[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if strings.ContainsAny(lower, "in") {
+		// reject inf and nan that strconv accepts but Lua does not
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,152 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// libraryLoadTimeout limits the time spent running the code of a library
+const libraryLoadTimeout = 500 * time.Millisecond
+
+// LibraryFunction is a function registered by a library with redis.register_function
+type LibraryFunction struct {
+	Name string
+	// NoWrites is set for functions registered with the no-writes flag
+	NoWrites bool
+	fn       *closure
+	in       *interpreter
+}
+
+// LoadLibrary runs the code of a library, the code must register at least one function with
+// redis.register_function. A leading shebang line with the library metadata is skipped.
+func LoadLibrary(code string) ([]*LibraryFunction, error) {
+	if strings.HasPrefix(code, "#!") {
+		// keep the line break so errors report the right line numbers
+		if i := strings.IndexByte(code, '\n'); i >= 0 {
+			code = code[i:]
+		} else {
+			code = ""
+		}
+	}
+	body, err := parse(code)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), libraryLoadTimeout)
+	defer cancel()
+	in := newInterpreter(ctx)
+	lib := openRedisLib(in)
+	var functions []*LibraryFunction
+	register(lib, "register_function", func(in *interpreter, args []Value) ([]Value, error) {
+		f, err := parseRegisterFunctionArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		for _, registered := range functions {
+			if registered.Name == f.Name {
+				return nil, &Error{Value: fmt.Sprintf("Function %s already exists", f.Name)}
+			}
+		}
+		f.in = in
+		functions = append(functions, f)
+		return nil, nil
+	})
+
+	if _, _, err := in.execBlock(body, newScope(nil)); err != nil {
+		return nil, fmt.Errorf("ERR Error registering functions: %v", err)
+	}
+	in.ctx = context.Background()
+	if len(functions) == 0 {
+		return nil, fmt.Errorf("ERR No functions registered")
+	}
+	return functions, nil
+}
+
+func parseRegisterFunctionArgs(args []Value) (*LibraryFunction, error) {
+	if len(args) == 2 {
+		name, ok := args[0].(string)
+		if !ok {
+			return nil, &Error{Value: "wrong argument given to redis.register_function, the function name must be a string"}
+		}
+		fn, ok := args[1].(*closure)
+		if !ok {
+			return nil, &Error{Value: "wrong argument given to redis.register_function, the callback must be a function"}
+		}
+		return newLibraryFunction(name, fn, nil)
+	}
+
+	t, ok := arg(args, 0).(*Table)
+	if len(args) != 1 || !ok {
+		return nil, &Error{Value: "wrong number of arguments to redis.register_function"}
+	}
+	name, ok := t.GetString("function_name").(string)
+	if !ok {
+		return nil, &Error{Value: "redis.register_function must get a function name argument"}
+	}
+	fn, ok := t.GetString("callback").(*closure)
+	if !ok {
+		return nil, &Error{Value: "redis.register_function must get a callback argument"}
+	}
+	var flags *Table
+	if f := t.GetString("flags"); f != nil {
+		if flags, ok = f.(*Table); !ok {
+			return nil, &Error{Value: "flags argument to redis.register_function must be a table representing function flags"}
+		}
+	}
+	return newLibraryFunction(name, fn, flags)
+}
+
+func newLibraryFunction(name string, fn *closure, flags *Table) (*LibraryFunction, error) {
+	if !isValidFunctionName(name) {
+		return nil, &Error{Value: "Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"}
+	}
+	f := &LibraryFunction{Name: name, fn: fn}
+	if flags != nil {
+		for i := 1; i <= flags.Len(); i++ {
+			switch flags.Get(float64(i)) {
+			case "no-writes":
+				f.NoWrites = true
+			case "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys":
+			default:
+				return nil, &Error{Value: fmt.Sprintf("unknown flag given: %v", tostring(flags.Get(float64(i))))}
+			}
+		}
+	}
+	return f, nil
+}
+
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isLetter(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Call invokes the function with the keys and args tables, the returned string is the RESP
+// encoded value returned by the function
+func (f *LibraryFunction) Call(ctx context.Context, keys, args []string, call Caller) (string, error) {
+	f.in.ctx = ctx
+	f.in.caller = call
+	defer func() {
+		f.in.ctx = context.Background()
+		f.in.caller = nil
+	}()
+
+	values, err := f.in.call(f.fn, []Value{stringsToArray(keys), stringsToArray(args)}, 0)
+	if err != nil {
+		return "", scriptError(err, f.Name)
+	}
+	var result Value
+	if len(values) > 0 {
+		result = values[0]
+	}
+	return ValueToReply(result)
+}
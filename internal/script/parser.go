@@ -0,0 +1,658 @@
+package script
+
+import (
+	"fmt"
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse builds the syntax tree of a chunk
+func parse(src string) ([]stmt, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	block, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("'<eof>' expected near '%s'", p.peek().text)
+	}
+	return block, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("user_script:%d: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) check(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokenSymbol || tok.kind == tokenKeyword) && tok.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.check(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("'%s' expected near '%s'", text, p.describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) expectName() (string, error) {
+	tok := p.peek()
+	if tok.kind != tokenName {
+		return "", p.errorf("<name> expected near '%s'", p.describe(tok))
+	}
+	p.advance()
+	return tok.text, nil
+}
+
+func (p *parser) describe(tok token) string {
+	if tok.kind == tokenEOF {
+		return "<eof>"
+	}
+	return tok.text
+}
+
+// blockEnds reports if the current token closes a block
+func (p *parser) blockEnds() bool {
+	tok := p.peek()
+	if tok.kind == tokenEOF {
+		return true
+	}
+	if tok.kind != tokenKeyword {
+		return false
+	}
+	switch tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() ([]stmt, error) {
+	var stmts []stmt
+	for !p.blockEnds() {
+		if p.check("return") {
+			p.advance()
+			var values []expr
+			if !p.blockEnds() && !p.check(";") {
+				var err error
+				if values, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			p.accept(";")
+			stmts = append(stmts, &returnStmt{values: values})
+			if !p.blockEnds() {
+				return nil, p.errorf("'end' expected near '%s'", p.describe(p.peek()))
+			}
+			break
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts, nil
+}
+
+func (p *parser) statement() (stmt, error) {
+	tok := p.peek()
+	if tok.kind == tokenSymbol && tok.text == ";" {
+		p.advance()
+		return nil, nil
+	}
+	if tok.kind == tokenKeyword {
+		switch tok.text {
+		case "local":
+			p.advance()
+			if p.accept("function") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				fn, err := p.functionBody(name, false)
+				if err != nil {
+					return nil, err
+				}
+				return &localFunctionStmt{name: name, fn: fn}, nil
+			}
+			return p.localStatement()
+		case "function":
+			p.advance()
+			return p.functionStatement()
+		case "if":
+			p.advance()
+			return p.ifStatement()
+		case "while":
+			p.advance()
+			cond, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("do"); err != nil {
+				return nil, err
+			}
+			body, err := p.blockUntil("end")
+			if err != nil {
+				return nil, err
+			}
+			return &whileStmt{cond: cond, body: body}, nil
+		case "repeat":
+			p.advance()
+			body, err := p.blockUntil("until")
+			if err != nil {
+				return nil, err
+			}
+			cond, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return &repeatStmt{body: body, cond: cond}, nil
+		case "for":
+			p.advance()
+			return p.forStatement(tok.line)
+		case "do":
+			p.advance()
+			body, err := p.blockUntil("end")
+			if err != nil {
+				return nil, err
+			}
+			return &doStmt{body: body}, nil
+		case "break":
+			p.advance()
+			return &breakStmt{}, nil
+		}
+	}
+	return p.exprStatement()
+}
+
+func (p *parser) blockUntil(closing string) ([]stmt, error) {
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(closing); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (p *parser) localStatement() (stmt, error) {
+	var names []string
+	for {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			break
+		}
+	}
+	var values []expr
+	if p.accept("=") {
+		var err error
+		if values, err = p.exprList(); err != nil {
+			return nil, err
+		}
+	}
+	return &localStmt{names: names, values: values}, nil
+}
+
+func (p *parser) functionStatement() (stmt, error) {
+	line := p.peek().line
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	fullName := name
+	var target expr = &nameExpr{name: name, line: line}
+	isMethod := false
+	for p.check(".") || p.check(":") {
+		isMethod = p.check(":")
+		p.advance()
+		key, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		fullName += "." + key
+		target = &indexExpr{object: target, key: &stringExpr{value: key}, line: line}
+		if isMethod {
+			break
+		}
+	}
+	fn, err := p.functionBody(fullName, isMethod)
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{targets: []expr{target}, values: []expr{fn}}, nil
+}
+
+func (p *parser) functionBody(name string, isMethod bool) (*functionExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var params []string
+	if isMethod {
+		params = append(params, "self")
+	}
+	if !p.check(")") {
+		for {
+			if p.check("...") {
+				return nil, p.errorf("variable arguments are not supported")
+			}
+			param, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, param)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.blockUntil("end")
+	if err != nil {
+		return nil, err
+	}
+	return &functionExpr{params: params, body: body, name: name}, nil
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	s := &ifStmt{}
+	for {
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.conds = append(s.conds, cond)
+		s.blocks = append(s.blocks, block)
+		if !p.accept("elseif") {
+			break
+		}
+	}
+	if p.accept("else") {
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.elseBlock = block
+	}
+	if err := p.expect("end"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *parser) forStatement(line int) (stmt, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("=") {
+		start, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		limit, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		var step expr
+		if p.accept(",") {
+			if step, err = p.expression(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.blockUntil("end")
+		if err != nil {
+			return nil, err
+		}
+		return &numericForStmt{name: name, start: start, limit: limit, step: step, body: body, line: line}, nil
+	}
+
+	names := []string{name}
+	for p.accept(",") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.blockUntil("end")
+	if err != nil {
+		return nil, err
+	}
+	return &genericForStmt{names: names, exprs: exprs, body: body, line: line}, nil
+}
+
+func (p *parser) exprStatement() (stmt, error) {
+	first, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.check("=") || p.check(",") {
+		targets := []expr{first}
+		for p.accept(",") {
+			target, err := p.suffixedExpr()
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				return nil, p.errorf("syntax error near '='")
+			}
+		}
+		values, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{targets: targets, values: values}, nil
+	}
+	switch first.(type) {
+	case *callExpr, *methodCallExpr:
+		return &callStmt{call: first}, nil
+	}
+	return nil, p.errorf("syntax error near '%s'", p.describe(p.peek()))
+}
+
+func (p *parser) exprList() ([]expr, error) {
+	var exprs []expr
+	for {
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// binary operators precedence, the right value is used for right associative operators
+var binaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expression() (expr, error) {
+	return p.subExpr(0)
+}
+
+func (p *parser) subExpr(limit int) (expr, error) {
+	var left expr
+	tok := p.peek()
+	if (tok.kind == tokenKeyword && tok.text == "not") || (tok.kind == tokenSymbol && (tok.text == "-" || tok.text == "#")) {
+		p.advance()
+		operand, err := p.subExpr(unaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &unaryExpr{op: tok.text, operand: operand, line: tok.line}
+	} else {
+		var err error
+		if left, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		tok := p.peek()
+		if tok.kind != tokenSymbol && tok.kind != tokenKeyword {
+			return left, nil
+		}
+		priority, isBinary := binaryPriority[tok.text]
+		if !isBinary || priority[0] <= limit {
+			return left, nil
+		}
+		p.advance()
+		right, err := p.subExpr(priority[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: tok.text, left: left, right: right, line: tok.line}
+	}
+}
+
+func (p *parser) simpleExpr() (expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenNumber:
+		p.advance()
+		return &numberExpr{value: tok.num}, nil
+	case tokenString:
+		p.advance()
+		return &stringExpr{value: tok.text}, nil
+	case tokenKeyword:
+		switch tok.text {
+		case "nil":
+			p.advance()
+			return &nilExpr{}, nil
+		case "true":
+			p.advance()
+			return &trueExpr{}, nil
+		case "false":
+			p.advance()
+			return &falseExpr{}, nil
+		case "function":
+			p.advance()
+			return p.functionBody("anonymous", false)
+		}
+	case tokenSymbol:
+		switch tok.text {
+		case "{":
+			return p.tableConstructor()
+		case "...":
+			return nil, p.errorf("variable arguments are not supported")
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() (expr, error) {
+	tok := p.peek()
+	if tok.kind == tokenName {
+		p.advance()
+		return &nameExpr{name: tok.text, line: tok.line}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &parenExpr{inner: inner}, nil
+	}
+	return nil, p.errorf("unexpected symbol near '%s'", p.describe(tok))
+}
+
+func (p *parser) suffixedExpr() (expr, error) {
+	e, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		switch {
+		case p.check("."):
+			p.advance()
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			e = &indexExpr{object: e, key: &stringExpr{value: name}, line: tok.line}
+		case p.check("["):
+			p.advance()
+			key, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &indexExpr{object: e, key: key, line: tok.line}
+		case p.check(":"):
+			p.advance()
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &methodCallExpr{object: e, method: name, args: args, line: tok.line}
+		case p.check("(") || p.check("{") || tok.kind == tokenString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, line: tok.line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) callArgs() ([]expr, error) {
+	tok := p.peek()
+	if tok.kind == tokenString {
+		p.advance()
+		return []expr{&stringExpr{value: tok.text}}, nil
+	}
+	if p.check("{") {
+		table, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+		return []expr{table}, nil
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.accept(")") {
+		return nil, nil
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func (p *parser) tableConstructor() (expr, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	table := &tableExpr{}
+	for !p.check("}") {
+		var field tableField
+		tok := p.peek()
+		switch {
+		case p.check("["):
+			p.advance()
+			key, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			field.key = key
+		case tok.kind == tokenName && p.tokens[p.pos+1].kind == tokenSymbol && p.tokens[p.pos+1].text == "=":
+			p.advance()
+			p.advance()
+			field.key = &stringExpr{value: tok.text}
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		field.value = value
+		table.fields = append(table.fields, field)
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
@@ -0,0 +1,250 @@
+package script
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+)
+
+// Caller executes a command issued by a script with redis.call or redis.pcall. It returns the
+// RESP encoded reply, error replies are returned as err.
+type Caller func(args []string) (reply string, err error)
+
+// Script is a compiled script ready to be executed
+type Script struct {
+	SHA    string
+	Source string
+	body   []stmt
+}
+
+// SHA1Hex returns the hex encoded SHA1 digest used to identify scripts
+func SHA1Hex(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compile parses source, the result can be executed many times
+func Compile(source string) (*Script, error) {
+	body, err := parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling script (new function): %v", err)
+	}
+	return &Script{SHA: SHA1Hex(source), Source: source, body: body}, nil
+}
+
+// Run executes the script with the KEYS and ARGV tables, the returned string is the RESP encoded
+// value returned by the script. Cancelling ctx interrupts the script with ErrInterrupted.
+func (s *Script) Run(ctx context.Context, keys, argv []string, call Caller) (string, error) {
+	in := newInterpreter(ctx)
+	in.caller = call
+	openRedisLib(in)
+	_ = in.globals.Set("KEYS", stringsToArray(keys))
+	_ = in.globals.Set("ARGV", stringsToArray(argv))
+
+	_, values, err := in.execBlock(s.body, newScope(nil))
+	if err != nil {
+		return "", scriptError(err, "f_"+s.SHA)
+	}
+	var result Value
+	if len(values) > 0 {
+		result = values[0]
+	}
+	return ValueToReply(result)
+}
+
+// scriptError converts errors raised by scripts to the error reply sent to clients
+func scriptError(err error, fnName string) error {
+	var luaErr *Error
+	if !errors.As(err, &luaErr) {
+		return err
+	}
+	if t, ok := luaErr.Value.(*Table); ok {
+		if msg, ok := t.GetString("err").(string); ok {
+			// errors raised by redis.call or error(redis.error_reply(...)) are sent as is
+			return errors.New(msg)
+		}
+	}
+	return fmt.Errorf("ERR Error running script (call to %s): @%s", fnName, tostring(luaErr.Value))
+}
+
+func stringsToArray(values []string) *Table {
+	array := make([]Value, 0, len(values))
+	for _, v := range values {
+		array = append(array, v)
+	}
+	return NewArray(array)
+}
+
+func errorTable(msg string) *Table {
+	t := NewTable()
+	_ = t.Set("err", msg)
+	return t
+}
+
+func statusTable(msg string) *Table {
+	t := NewTable()
+	_ = t.Set("ok", msg)
+	return t
+}
+
+func openRedisLib(in *interpreter) *Table {
+	lib := NewTable()
+	invoke := func(fnName string, args []Value) (Value, error) {
+		if in.caller == nil {
+			return nil, &Error{Value: errorTable(fmt.Sprintf("ERR %s can not be used while loading a library", fnName))}
+		}
+		if len(args) == 0 {
+			return nil, &Error{Value: errorTable(fmt.Sprintf("ERR Please specify at least one argument for %s()", fnName))}
+		}
+		cmdArgs := make([]string, 0, len(args))
+		for _, a := range args {
+			s, ok := toString(a)
+			if !ok {
+				return nil, &Error{Value: errorTable("ERR Lua redis lib command arguments must be strings or integers")}
+			}
+			cmdArgs = append(cmdArgs, s)
+		}
+		reply, err := in.caller(cmdArgs)
+		if err != nil {
+			return nil, &Error{Value: errorTable(err.Error())}
+		}
+		return ReplyToValue(reply)
+	}
+	register(lib, "call", func(in *interpreter, args []Value) ([]Value, error) {
+		v, err := invoke("redis.call", args)
+		if err != nil {
+			return nil, err
+		}
+		return []Value{v}, nil
+	})
+	register(lib, "pcall", func(in *interpreter, args []Value) ([]Value, error) {
+		v, err := invoke("redis.pcall", args)
+		if e, ok := err.(*Error); ok {
+			return []Value{e.Value}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []Value{v}, nil
+	})
+	register(lib, "error_reply", func(in *interpreter, args []Value) ([]Value, error) {
+		msg, err := checkString(args, 0, "error_reply")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{errorTable(strings.TrimPrefix(msg, "-"))}, nil
+	})
+	register(lib, "status_reply", func(in *interpreter, args []Value) ([]Value, error) {
+		msg, err := checkString(args, 0, "status_reply")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{statusTable(msg)}, nil
+	})
+	register(lib, "sha1hex", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "sha1hex")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{SHA1Hex(s)}, nil
+	})
+	register(lib, "log", func(in *interpreter, args []Value) ([]Value, error) {
+		if len(args) < 2 {
+			return nil, &Error{Value: "redis.log() requires two arguments or more."}
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, a := range args[1:] {
+			parts = append(parts, tostring(a))
+		}
+		log.Printf("script log: %s", strings.Join(parts, " "))
+		return nil, nil
+	})
+	_ = lib.Set("LOG_DEBUG", float64(0))
+	_ = lib.Set("LOG_VERBOSE", float64(1))
+	_ = lib.Set("LOG_NOTICE", float64(2))
+	_ = lib.Set("LOG_WARNING", float64(3))
+	lib.readonly = true
+	_ = in.globals.Set("redis", lib)
+	return lib
+}
+
+// ReplyToValue converts a RESP encoded reply to the Lua value returned by redis.call
+func ReplyToValue(serialized string) (Value, error) {
+	reply, err := resp.ParseReply(serialized)
+	if err != nil {
+		return nil, err
+	}
+	return replyToValue(reply), nil
+}
+
+func replyToValue(reply resp.Reply) Value {
+	switch reply.Kind {
+	case resp.KindSimpleString:
+		return statusTable(reply.Str)
+	case resp.KindError:
+		return errorTable(reply.Str)
+	case resp.KindInteger:
+		return float64(reply.Int)
+	case resp.KindBulkString:
+		if reply.Nil {
+			return false
+		}
+		return reply.Str
+	case resp.KindArray:
+		if reply.Nil {
+			return false
+		}
+		values := make([]Value, 0, len(reply.Elems))
+		for _, elem := range reply.Elems {
+			values = append(values, replyToValue(elem))
+		}
+		return NewArray(values)
+	}
+	return nil
+}
+
+// ValueToReply converts a value returned by a script to its RESP encoding, tables with an err
+// field are returned as errors
+func ValueToReply(v Value) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return resp.BulkString(nil), nil
+	case bool:
+		if x {
+			return resp.Integer(1), nil
+		}
+		return resp.BulkString(nil), nil
+	case float64:
+		return resp.Integer(int(math.Trunc(x))), nil
+	case string:
+		return resp.BulkString(&x), nil
+	case *Table:
+		if msg, ok := x.GetString("err").(string); ok {
+			return "", errors.New(msg)
+		}
+		if msg, ok := x.GetString("ok").(string); ok {
+			return resp.SimpleString(msg), nil
+		}
+		var replies []string
+		for i := 1; ; i++ {
+			elem := x.Get(float64(i))
+			if elem == nil {
+				break
+			}
+			reply, err := ValueToReply(elem)
+			if err != nil {
+				reply = resp.Error(err)
+			}
+			replies = append(replies, reply)
+		}
+		return resp.RawArray(replies), nil
+	}
+	return resp.BulkString(nil), nil
+}
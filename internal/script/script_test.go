@@ -0,0 +1,131 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCaller emulates GET/SET over a map
+func fakeCaller(db map[string]string) Caller {
+	return func(args []string) (string, error) {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			v, ok := db[args[1]]
+			if !ok {
+				return resp.BulkString(nil), nil
+			}
+			return resp.BulkString(&v), nil
+		case "SET":
+			db[args[1]] = args[2]
+			return resp.SimpleString("OK"), nil
+		}
+		return "", errors.New("ERR unknown command")
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		keys    []string
+		argv    []string
+		want    string
+		wantErr string
+	}{
+		{name: "integer", source: "return 1 + 2 * 3", want: ":7\r\n"},
+		{name: "float truncated", source: "return 7 / 2", want: ":3\r\n"},
+		{name: "string concat", source: "return 'a' .. 1 .. \"b\"", want: "$3\r\na1b\r\n"},
+		{name: "keys and argv", source: "return {KEYS[1], ARGV[2], #ARGV}", keys: []string{"k"}, argv: []string{"x", "y"},
+			want: "*3\r\n$1\r\nk\r\n$1\r\ny\r\n:2\r\n"},
+		{name: "nil", source: "return nil", want: "$-1\r\n"},
+		{name: "booleans", source: "return {true, false}", want: "*2\r\n:1\r\n$-1\r\n"},
+		{name: "status reply", source: "return redis.status_reply('PONG')", want: "+PONG\r\n"},
+		{name: "error reply", source: "return redis.error_reply('MY error')", wantErr: "MY error"},
+		{name: "redis.call", source: "redis.call('SET', KEYS[1], ARGV[1]); return redis.call('GET', KEYS[1])",
+			keys: []string{"x"}, argv: []string{"10"}, want: "$2\r\n10\r\n"},
+		{name: "redis.call status", source: "return redis.call('SET', 'x', 1)", want: "+OK\r\n"},
+		{name: "redis.call nil is false", source: "return redis.call('GET', 'missing') == false", want: ":1\r\n"},
+		{name: "redis.call error", source: "return redis.call('INCR', 'x')", wantErr: "ERR unknown command"},
+		{name: "redis.pcall error", source: "local r = redis.pcall('INCR', 'x'); return r.err", want: "$19\r\nERR unknown command\r\n"},
+		{name: "if elseif else", source: `
+local n = tonumber(ARGV[1])
+if n < 0 then
+  return 'negative'
+elseif n == 0 then
+  return 'zero'
+else
+  return 'positive'
+end`, argv: []string{"0"}, want: "$4\r\nzero\r\n"},
+		{name: "numeric for", source: "local s = 0 for i = 1, 10 do s = s + i end return s", want: ":55\r\n"},
+		{name: "numeric for with step", source: "local s = 0 for i = 10, 1, -2 do s = s + i end return s", want: ":30\r\n"},
+		{name: "while and break", source: "local i = 0 while true do i = i + 1 if i > 4 then break end end return i", want: ":5\r\n"},
+		{name: "repeat until", source: "local i = 0 repeat local j = i; i = i + 1 until j >= 2 return i", want: ":3\r\n"},
+		{name: "pairs", source: "local t = {a = 1, b = 2, 3} local s = 0 for k, v in pairs(t) do s = s + v end return s", want: ":6\r\n"},
+		{name: "ipairs", source: "local t = {} for i, v in ipairs({'a', 'b'}) do t[#t + 1] = v .. i end return t",
+			want: "*2\r\n$2\r\na1\r\n$2\r\nb2\r\n"},
+		{name: "local function recursion", source: "local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end return fib(15)",
+			want: ":610\r\n"},
+		{name: "closures", source: "local function counter() local c = 0 return function() c = c + 1 return c end end local f = counter() f() return f()",
+			want: ":2\r\n"},
+		{name: "multiple returns", source: "local function two() return 1, 2 end local a, b = two() return {a, b, two()}",
+			want: "*4\r\n:1\r\n:2\r\n:1\r\n:2\r\n"},
+		{name: "string methods", source: "local s = 'Hello' return {s:upper(), string.sub(s, 2, -2), s:len(), string.format('%s-%d', s, 42)}",
+			want: "*4\r\n$5\r\nHELLO\r\n$3\r\nell\r\n:5\r\n$8\r\nHello-42\r\n"},
+		{name: "table library", source: "local t = {1, 2} table.insert(t, 3) table.insert(t, 1, 0) table.remove(t) return table.concat(t, ',')",
+			want: "$5\r\n0,1,2\r\n"},
+		{name: "unpack", source: "local t = {'a', 'b'} return {unpack(t)}", want: "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{name: "pcall catches errors", source: "local ok, err = pcall(function() error('boom', 0) end) return {tostring(ok), err}",
+			want: "*2\r\n$5\r\nfalse\r\n$4\r\nboom\r\n"},
+		{name: "math", source: "return math.max(1, math.floor(3.7), math.min(10, 2))", want: ":3\r\n"},
+		{name: "long strings and comments", source: "--[[ comment\n]] return [[a\nb]] -- trailing", want: "$3\r\na\nb\r\n"},
+		{name: "global access error", source: "return foo", wantErr: "Script attempted to access nonexistent global variable 'foo'"},
+		{name: "global creation error", source: "foo = 1", wantErr: "Script attempted to create global variable 'foo'"},
+		{name: "arithmetic error", source: "return {} + 1", wantErr: "attempt to perform arithmetic on a table value"},
+		{name: "readonly library", source: "redis.call = nil", wantErr: "Attempt to modify a readonly table"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile(tt.source)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			got, err := s.Run(context.Background(), tt.keys, tt.argv, fakeCaller(map[string]string{}))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Run() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	_, err := Compile("return (")
+	if err == nil || !strings.HasPrefix(err.Error(), "ERR Error compiling script") {
+		t.Errorf("expecting compile error, got %v", err)
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	s, err := Compile("while true do end")
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Run(ctx, nil, nil, fakeCaller(map[string]string{}))
+	if !errors.Is(err, ErrInterrupted) {
+		t.Errorf("want ErrInterrupted, got %v", err)
+	}
+}
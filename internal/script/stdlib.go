@@ -0,0 +1,568 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func argError(n int, fnName string, msg string) error {
+	return &Error{Value: fmt.Sprintf("bad argument #%d to '%s' (%s)", n, fnName, msg)}
+}
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func checkTable(args []Value, i int, fnName string) (*Table, error) {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		return nil, argError(i+1, fnName, fmt.Sprintf("table expected, got %s", typeName(arg(args, i))))
+	}
+	return t, nil
+}
+
+func checkString(args []Value, i int, fnName string) (string, error) {
+	s, ok := toString(arg(args, i))
+	if !ok {
+		return "", argError(i+1, fnName, fmt.Sprintf("string expected, got %s", typeName(arg(args, i))))
+	}
+	return s, nil
+}
+
+func checkNumber(args []Value, i int, fnName string) (float64, error) {
+	n, ok := toNumber(arg(args, i))
+	if !ok {
+		return 0, argError(i+1, fnName, fmt.Sprintf("number expected, got %s", typeName(arg(args, i))))
+	}
+	return n, nil
+}
+
+// optNumber returns def when the argument is absent
+func optNumber(args []Value, i int, fnName string, def float64) (float64, error) {
+	if arg(args, i) == nil {
+		return def, nil
+	}
+	return checkNumber(args, i, fnName)
+}
+
+func register(t *Table, name string, fn func(in *interpreter, args []Value) ([]Value, error)) {
+	_ = t.Set(name, &GoFunction{Name: name, Fn: fn})
+}
+
+func openBaseLib(in *interpreter) {
+	g := in.globals
+	register(g, "assert", func(in *interpreter, args []Value) ([]Value, error) {
+		if !truthy(arg(args, 0)) {
+			if msg := arg(args, 1); msg != nil {
+				return nil, &Error{Value: msg}
+			}
+			return nil, &Error{Value: "assertion failed!"}
+		}
+		return args, nil
+	})
+	register(g, "error", func(in *interpreter, args []Value) ([]Value, error) {
+		level, _ := optNumber(args, 1, "error", 1)
+		// level 0 asks for the message without position information
+		return nil, &Error{Value: arg(args, 0), positioned: level == 0}
+	})
+	register(g, "pcall", func(in *interpreter, args []Value) ([]Value, error) {
+		if len(args) == 0 {
+			return nil, argError(1, "pcall", "value expected")
+		}
+		values, err := in.call(args[0], args[1:], 0)
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				return []Value{false, e.Value}, nil
+			}
+			return nil, err
+		}
+		return append([]Value{true}, values...), nil
+	})
+	register(g, "type", func(in *interpreter, args []Value) ([]Value, error) {
+		if len(args) == 0 {
+			return nil, argError(1, "type", "value expected")
+		}
+		return []Value{typeName(args[0])}, nil
+	})
+	register(g, "tostring", func(in *interpreter, args []Value) ([]Value, error) {
+		return []Value{tostring(arg(args, 0))}, nil
+	})
+	register(g, "tonumber", func(in *interpreter, args []Value) ([]Value, error) {
+		base, err := optNumber(args, 1, "tonumber", 10)
+		if err != nil {
+			return nil, err
+		}
+		if base == 10 {
+			if n, ok := toNumber(arg(args, 0)); ok {
+				return []Value{n}, nil
+			}
+			return []Value{nil}, nil
+		}
+		s, err := checkString(args, 0, "tonumber")
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), int(base), 64)
+		if err != nil {
+			return []Value{nil}, nil
+		}
+		return []Value{float64(n)}, nil
+	})
+	next := &GoFunction{Name: "next", Fn: func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "next")
+		if err != nil {
+			return nil, err
+		}
+		key, value, err := t.Next(arg(args, 1))
+		if err != nil {
+			return nil, &Error{Value: err.Error()}
+		}
+		if key == nil {
+			return []Value{nil}, nil
+		}
+		return []Value{key, value}, nil
+	}}
+	_ = g.Set("next", next)
+	register(g, "pairs", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "pairs")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{next, t, nil}, nil
+	})
+	ipairsIterator := &GoFunction{Name: "ipairs_iterator", Fn: func(in *interpreter, args []Value) ([]Value, error) {
+		t := args[0].(*Table)
+		i := args[1].(float64) + 1
+		v := t.Get(i)
+		if v == nil {
+			return []Value{nil}, nil
+		}
+		return []Value{i, v}, nil
+	}}
+	register(g, "ipairs", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "ipairs")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{ipairsIterator, t, float64(0)}, nil
+	})
+	unpack := func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "unpack")
+		if err != nil {
+			return nil, err
+		}
+		first, err := optNumber(args, 1, "unpack", 1)
+		if err != nil {
+			return nil, err
+		}
+		last, err := optNumber(args, 2, "unpack", float64(t.Len()))
+		if err != nil {
+			return nil, err
+		}
+		var values []Value
+		for i := first; i <= last; i++ {
+			values = append(values, t.Get(i))
+		}
+		return values, nil
+	}
+	register(g, "unpack", unpack)
+	register(g, "rawget", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "rawget")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{t.Get(arg(args, 1))}, nil
+	})
+	register(g, "rawequal", func(in *interpreter, args []Value) ([]Value, error) {
+		return []Value{arg(args, 0) == arg(args, 1)}, nil
+	})
+
+	openStringLib(in)
+	openTableLib(in, unpack)
+	openMathLib(in)
+}
+
+func openStringLib(in *interpreter) {
+	lib := NewTable()
+	register(lib, "len", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "len")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{float64(len(s))}, nil
+	})
+	register(lib, "upper", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "upper")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{strings.ToUpper(s)}, nil
+	})
+	register(lib, "lower", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "lower")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{strings.ToLower(s)}, nil
+	})
+	register(lib, "rep", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "rep")
+		if err != nil {
+			return nil, err
+		}
+		n, err := checkNumber(args, 1, "rep")
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return []Value{""}, nil
+		}
+		return []Value{strings.Repeat(s, int(n))}, nil
+	})
+	register(lib, "reverse", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "reverse")
+		if err != nil {
+			return nil, err
+		}
+		b := []byte(s)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []Value{string(b)}, nil
+	})
+	register(lib, "sub", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "sub")
+		if err != nil {
+			return nil, err
+		}
+		i, err := optNumber(args, 1, "sub", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := optNumber(args, 2, "sub", -1)
+		if err != nil {
+			return nil, err
+		}
+		start, end := stringRange(len(s), int(i), int(j))
+		if start > end {
+			return []Value{""}, nil
+		}
+		return []Value{s[start-1 : end]}, nil
+	})
+	register(lib, "byte", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "byte")
+		if err != nil {
+			return nil, err
+		}
+		i, err := optNumber(args, 1, "byte", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := optNumber(args, 2, "byte", i)
+		if err != nil {
+			return nil, err
+		}
+		start, end := stringRange(len(s), int(i), int(j))
+		var values []Value
+		for k := start; k <= end; k++ {
+			values = append(values, float64(s[k-1]))
+		}
+		return values, nil
+	})
+	register(lib, "char", func(in *interpreter, args []Value) ([]Value, error) {
+		b := make([]byte, 0, len(args))
+		for i := range args {
+			n, err := checkNumber(args, i, "char")
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > 255 {
+				return nil, argError(i+1, "char", "invalid value")
+			}
+			b = append(b, byte(n))
+		}
+		return []Value{string(b)}, nil
+	})
+	register(lib, "find", func(in *interpreter, args []Value) ([]Value, error) {
+		s, err := checkString(args, 0, "find")
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := checkString(args, 1, "find")
+		if err != nil {
+			return nil, err
+		}
+		init, err := optNumber(args, 2, "find", 1)
+		if err != nil {
+			return nil, err
+		}
+		if !truthy(arg(args, 3)) && strings.ContainsAny(pattern, "^$*+?.([%-") {
+			return nil, &Error{Value: "string.find patterns are not supported, use plain find"}
+		}
+		start, _ := stringRange(len(s), int(init), -1)
+		if start > len(s)+1 {
+			return []Value{nil}, nil
+		}
+		idx := strings.Index(s[start-1:], pattern)
+		if idx < 0 {
+			return []Value{nil}, nil
+		}
+		first := start + idx
+		return []Value{float64(first), float64(first + len(pattern) - 1)}, nil
+	})
+	register(lib, "format", func(in *interpreter, args []Value) ([]Value, error) {
+		format, err := checkString(args, 0, "format")
+		if err != nil {
+			return nil, err
+		}
+		s, err := formatString(format, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return []Value{s}, nil
+	})
+	lib.readonly = true
+	_ = in.globals.Set("string", lib)
+}
+
+// stringRange converts Lua string indexes, which can be negative, to a 1 based closed range
+func stringRange(length, i, j int) (int, int) {
+	if i < 0 {
+		i = length + i + 1
+	}
+	if j < 0 {
+		j = length + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > length {
+		j = length
+	}
+	return i, j
+}
+
+// formatString implements string.format for the %d %i %s %q %f %g %e %x %X %c and %% directives
+func formatString(format string, args []Value) (string, error) {
+	var sb strings.Builder
+	argIndex := 0
+	for i := 0; i < len(format); i++ {
+		ch := format[i]
+		if ch != '%' {
+			sb.WriteByte(ch)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return "", &Error{Value: "invalid option '%' to 'format'"}
+		}
+		if format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return "", &Error{Value: "invalid option to 'format'"}
+		}
+		spec := format[start:i]
+		verb := format[i]
+		argIndex++
+		if argIndex > len(args) {
+			return "", argError(argIndex+1, "format", "no value")
+		}
+		value := args[argIndex-1]
+		switch verb {
+		case 'd', 'i':
+			n, ok := toNumber(value)
+			if !ok {
+				return "", argError(argIndex+1, "format", "number expected")
+			}
+			sb.WriteString(fmt.Sprintf("%"+spec+"d", int64(n)))
+		case 'x', 'X', 'c':
+			n, ok := toNumber(value)
+			if !ok {
+				return "", argError(argIndex+1, "format", "number expected")
+			}
+			sb.WriteString(fmt.Sprintf("%"+spec+string(verb), int64(n)))
+		case 'f', 'g', 'e', 'G', 'E':
+			n, ok := toNumber(value)
+			if !ok {
+				return "", argError(argIndex+1, "format", "number expected")
+			}
+			sb.WriteString(fmt.Sprintf("%"+spec+string(verb), n))
+		case 's':
+			sb.WriteString(fmt.Sprintf("%"+spec+"s", tostring(value)))
+		case 'q':
+			s, ok := toString(value)
+			if !ok {
+				return "", argError(argIndex+1, "format", "string expected")
+			}
+			sb.WriteString(strconv.Quote(s))
+		default:
+			return "", &Error{Value: fmt.Sprintf("invalid option '%%%c' to 'format'", verb)}
+		}
+	}
+	return sb.String(), nil
+}
+
+func openTableLib(in *interpreter, unpack func(in *interpreter, args []Value) ([]Value, error)) {
+	lib := NewTable()
+	register(lib, "insert", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "insert")
+		if err != nil {
+			return nil, err
+		}
+		switch len(args) {
+		case 2:
+			return nil, t.Set(float64(t.Len()+1), args[1])
+		case 3:
+			pos, err := checkNumber(args, 1, "insert")
+			if err != nil {
+				return nil, err
+			}
+			for i := float64(t.Len()); i >= pos; i-- {
+				if err := t.Set(i+1, t.Get(i)); err != nil {
+					return nil, err
+				}
+			}
+			return nil, t.Set(pos, args[2])
+		}
+		return nil, &Error{Value: "wrong number of arguments to 'insert'"}
+	})
+	register(lib, "remove", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "remove")
+		if err != nil {
+			return nil, err
+		}
+		length := float64(t.Len())
+		if length == 0 {
+			return []Value{nil}, nil
+		}
+		pos, err := optNumber(args, 1, "remove", length)
+		if err != nil {
+			return nil, err
+		}
+		removed := t.Get(pos)
+		for i := pos; i < length; i++ {
+			if err := t.Set(i, t.Get(i+1)); err != nil {
+				return nil, err
+			}
+		}
+		if err := t.Set(length, nil); err != nil {
+			return nil, err
+		}
+		return []Value{removed}, nil
+	})
+	register(lib, "concat", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "concat")
+		if err != nil {
+			return nil, err
+		}
+		sep := ""
+		if arg(args, 1) != nil {
+			if sep, err = checkString(args, 1, "concat"); err != nil {
+				return nil, err
+			}
+		}
+		first, err := optNumber(args, 2, "concat", 1)
+		if err != nil {
+			return nil, err
+		}
+		last, err := optNumber(args, 3, "concat", float64(t.Len()))
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		for i := first; i <= last; i++ {
+			s, ok := toString(t.Get(i))
+			if !ok {
+				return nil, &Error{Value: fmt.Sprintf("invalid value (at index %d) in table for 'concat'", int(i))}
+			}
+			parts = append(parts, s)
+		}
+		return []Value{strings.Join(parts, sep)}, nil
+	})
+	register(lib, "getn", func(in *interpreter, args []Value) ([]Value, error) {
+		t, err := checkTable(args, 0, "getn")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{float64(t.Len())}, nil
+	})
+	register(lib, "unpack", unpack)
+	lib.readonly = true
+	_ = in.globals.Set("table", lib)
+}
+
+func openMathLib(in *interpreter) {
+	lib := NewTable()
+	unary := func(name string, fn func(float64) float64) {
+		register(lib, name, func(in *interpreter, args []Value) ([]Value, error) {
+			n, err := checkNumber(args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			return []Value{fn(n)}, nil
+		})
+	}
+	unary("floor", math.Floor)
+	unary("ceil", math.Ceil)
+	unary("abs", math.Abs)
+	unary("sqrt", math.Sqrt)
+	unary("exp", math.Exp)
+	unary("log", math.Log)
+	register(lib, "fmod", func(in *interpreter, args []Value) ([]Value, error) {
+		a, err := checkNumber(args, 0, "fmod")
+		if err != nil {
+			return nil, err
+		}
+		b, err := checkNumber(args, 1, "fmod")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{math.Mod(a, b)}, nil
+	})
+	register(lib, "pow", func(in *interpreter, args []Value) ([]Value, error) {
+		a, err := checkNumber(args, 0, "pow")
+		if err != nil {
+			return nil, err
+		}
+		b, err := checkNumber(args, 1, "pow")
+		if err != nil {
+			return nil, err
+		}
+		return []Value{math.Pow(a, b)}, nil
+	})
+	minMax := func(name string, better func(a, b float64) bool) {
+		register(lib, name, func(in *interpreter, args []Value) ([]Value, error) {
+			result, err := checkNumber(args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			for i := 1; i < len(args); i++ {
+				n, err := checkNumber(args, i, name)
+				if err != nil {
+					return nil, err
+				}
+				if better(n, result) {
+					result = n
+				}
+			}
+			return []Value{result}, nil
+		})
+	}
+	minMax("min", func(a, b float64) bool { return a < b })
+	minMax("max", func(a, b float64) bool { return a > b })
+	_ = lib.Set("huge", math.Inf(1))
+	_ = lib.Set("pi", math.Pi)
+	lib.readonly = true
+	_ = in.globals.Set("math", lib)
+}
@@ -0,0 +1,284 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Value is a Lua value: nil, bool, float64, string, *Table or a function
+type Value interface{}
+
+// GoFunction is a Lua function implemented in Go
+type GoFunction struct {
+	Name string
+	Fn   func(in *interpreter, args []Value) ([]Value, error)
+}
+
+// closure is a function defined by the script
+type closure struct {
+	fn  *functionExpr
+	env *scope
+}
+
+// Table is the Lua associative array, integer keys from 1 are kept in a slice
+type Table struct {
+	array []Value
+	hash  map[Value]Value
+	// keys keeps the hash insertion order so next() is deterministic
+	keys []Value
+	// readonly tables can not be modified by scripts
+	readonly bool
+}
+
+// NewTable allocates an empty table
+func NewTable() *Table {
+	return &Table{}
+}
+
+// NewArray allocates a table with values at the keys 1..len(values)
+func NewArray(values []Value) *Table {
+	t := &Table{array: make([]Value, 0, len(values))}
+	for _, v := range values {
+		t.array = append(t.array, v)
+	}
+	return t
+}
+
+func normalizeKey(key Value) Value {
+	if f, ok := key.(float64); ok && f == 0 {
+		return float64(0)
+	}
+	return key
+}
+
+// arrayIndex returns the zero based slice index for integer keys
+func arrayIndex(key Value) (int, bool) {
+	f, ok := key.(float64)
+	if !ok || f < 1 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f) - 1, true
+}
+
+// Get returns the value at key or nil
+func (t *Table) Get(key Value) Value {
+	if i, ok := arrayIndex(key); ok && i < len(t.array) {
+		return t.array[i]
+	}
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[normalizeKey(key)]
+}
+
+// GetString is a shortcut for string keys
+func (t *Table) GetString(key string) Value {
+	return t.Get(key)
+}
+
+// Set stores value at key, a nil value removes the key
+func (t *Table) Set(key Value, value Value) error {
+	switch k := key.(type) {
+	case nil:
+		return fmt.Errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			return fmt.Errorf("table index is NaN")
+		}
+	}
+
+	if i, ok := arrayIndex(key); ok {
+		if i < len(t.array) {
+			t.array[i] = value
+			if value == nil && i == len(t.array)-1 {
+				t.trimArray()
+			}
+			return nil
+		}
+		if i == len(t.array) && value != nil {
+			t.array = append(t.array, value)
+			t.delete(key)
+			t.migrateFromHash()
+			return nil
+		}
+	}
+
+	if value == nil {
+		t.delete(key)
+		return nil
+	}
+	if t.hash == nil {
+		t.hash = make(map[Value]Value)
+	}
+	key = normalizeKey(key)
+	if _, exists := t.hash[key]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.hash[key] = value
+	return nil
+}
+
+func (t *Table) delete(key Value) {
+	if t.hash == nil {
+		return
+	}
+	key = normalizeKey(key)
+	if _, exists := t.hash[key]; !exists {
+		return
+	}
+	delete(t.hash, key)
+	for i, k := range t.keys {
+		if k == key {
+			t.keys = append(t.keys[:i], t.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// migrateFromHash moves the integer keys following the array part into it
+func (t *Table) migrateFromHash() {
+	for t.hash != nil {
+		key := float64(len(t.array) + 1)
+		value, exists := t.hash[key]
+		if !exists {
+			return
+		}
+		t.delete(key)
+		t.array = append(t.array, value)
+	}
+}
+
+func (t *Table) trimArray() {
+	for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+		t.array = t.array[:len(t.array)-1]
+	}
+}
+
+// Len implements the # operator
+func (t *Table) Len() int {
+	return len(t.array)
+}
+
+// Next returns the key and value following key, a nil key starts the traversal
+func (t *Table) Next(key Value) (Value, Value, error) {
+	start := 0
+	if key != nil {
+		if i, ok := arrayIndex(key); ok && i < len(t.array) {
+			start = i + 1
+		} else {
+			key = normalizeKey(key)
+			for i, k := range t.keys {
+				if k == key {
+					if i+1 < len(t.keys) {
+						next := t.keys[i+1]
+						return next, t.hash[next], nil
+					}
+					return nil, nil, nil
+				}
+			}
+			return nil, nil, fmt.Errorf("invalid key to 'next'")
+		}
+	}
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], nil
+		}
+	}
+	if len(t.keys) > 0 {
+		return t.keys[0], t.hash[t.keys[0]], nil
+	}
+	return nil, nil, nil
+}
+
+// typeName returns the Lua type of v
+func typeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *closure, *GoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func truthy(v Value) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+// formatNumber mimics the %.14g format Lua uses to convert numbers to strings
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	if math.IsInf(f, 1) {
+		return "inf"
+	}
+	if math.IsInf(f, -1) {
+		return "-inf"
+	}
+	if math.IsNaN(f) {
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
+}
+
+// toString converts strings and numbers, ok is false for other types
+func toString(v Value) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return formatNumber(s), true
+	}
+	return "", false
+}
+
+// toNumber converts numbers and numeric strings, ok is false otherwise
+func toNumber(v Value) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		return parseNumber(n)
+	}
+	return 0, false
+}
+
+// tostring implements the tostring() conversion for any value
+func tostring(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatNumber(x)
+	case string:
+		return x
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	case *closure:
+		return fmt.Sprintf("function: %p", x)
+	case *GoFunction:
+		return fmt.Sprintf("function: builtin: %s", x.Name)
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,207 @@
+// Package sentinel implements the decisions of the sentinel mode that do not depend on the
+// network: parsing the INFO of the monitored instances, the hello messages the sentinels publish
+// to discover each other, the election of the sentinel leading a failover and the choice of the
+// replica it promotes.
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HelloChannel is the channel of the monitored instances where the sentinels publish their hello
+const HelloChannel = "__sentinel__:hello"
+
+var errInvalidHello = errors.New("invalid hello message")
+
+// Info is the replication state of an instance read from its INFO reply
+type Info struct {
+	// Role is master or slave
+	Role string
+	// MasterAddr is the host:port of the master of a replica, MasterLinkUp is set while the
+	// replica is connected to it
+	MasterAddr   string
+	MasterLinkUp bool
+	// ReplOffset is the replication offset processed by a replica
+	ReplOffset int64
+	// Replicas are the host:port of the replicas connected to a master
+	Replicas []string
+}
+
+// ParseInfo reads the replication fields of an INFO reply, the lines are key:value pairs and the
+// other lines are ignored
+func ParseInfo(info string) Info {
+	var i Info
+	var masterHost, masterPort string
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimRight(line, "\r")
+		sep := strings.IndexByte(line, ':')
+		if sep < 0 {
+			continue
+		}
+		key, value := line[:sep], line[sep+1:]
+		switch {
+		case key == "role":
+			i.Role = value
+		case key == "master_host":
+			masterHost = value
+		case key == "master_port":
+			masterPort = value
+		case key == "master_link_status":
+			i.MasterLinkUp = value == "up"
+		case key == "slave_repl_offset":
+			i.ReplOffset, _ = strconv.ParseInt(value, 10, 64)
+		case strings.HasPrefix(key, "slave") && isDigits(key[len("slave"):]):
+			// slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0
+			var ip, port string
+			for _, field := range strings.Split(value, ",") {
+				if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+					switch kv[0] {
+					case "ip":
+						ip = kv[1]
+					case "port":
+						port = kv[1]
+					}
+				}
+			}
+			if ip != "" && port != "" {
+				i.Replicas = append(i.Replicas, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+	if masterHost != "" {
+		i.MasterAddr = net.JoinHostPort(masterHost, masterPort)
+	}
+	return i
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Hello is published by every sentinel to the instances it monitors every few seconds: the
+// sentinels monitoring the same master learn about each other and about the last configuration
+// of the master, the one with the greatest configuration epoch
+type Hello struct {
+	// Addr is the host:port where the sentinel accepts connections
+	Addr         string
+	RunID        string
+	CurrentEpoch uint64
+	MasterName   string
+	MasterAddr   string
+	ConfigEpoch  uint64
+}
+
+// String formats the hello like redis: ip,port,runid,current_epoch,master_name,master_ip,
+// master_port,master_config_epoch
+func (h Hello) String() string {
+	host, port, _ := net.SplitHostPort(h.Addr)
+	masterHost, masterPort, _ := net.SplitHostPort(h.MasterAddr)
+	return strings.Join([]string{host, port, h.RunID, strconv.FormatUint(h.CurrentEpoch, 10),
+		h.MasterName, masterHost, masterPort, strconv.FormatUint(h.ConfigEpoch, 10)}, ",")
+}
+
+// ParseHello parses a hello formatted by String
+func ParseHello(msg string) (Hello, error) {
+	fields := strings.Split(msg, ",")
+	if len(fields) != 8 {
+		return Hello{}, fmt.Errorf("%w: %d fields", errInvalidHello, len(fields))
+	}
+	h := Hello{
+		Addr:       net.JoinHostPort(fields[0], fields[1]),
+		RunID:      fields[2],
+		MasterName: fields[4],
+		MasterAddr: net.JoinHostPort(fields[5], fields[6]),
+	}
+	var err error
+	if h.CurrentEpoch, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+		return Hello{}, fmt.Errorf("%w: current epoch %q", errInvalidHello, fields[3])
+	}
+	if h.ConfigEpoch, err = strconv.ParseUint(fields[7], 10, 64); err != nil {
+		return Hello{}, fmt.Errorf("%w: config epoch %q", errInvalidHello, fields[7])
+	}
+	for _, port := range []string{fields[1], fields[6]} {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return Hello{}, fmt.Errorf("%w: port %q", errInvalidHello, port)
+		}
+	}
+	if h.RunID == "" || h.MasterName == "" {
+		return Hello{}, fmt.Errorf("%w: empty run ID or master name", errInvalidHello)
+	}
+	return h, nil
+}
+
+// Vote is the leader a sentinel voted for in an epoch, like the leader and leader_epoch of redis.
+// A sentinel votes at most once per epoch, for the first sentinel asking.
+type Vote struct {
+	Leader string
+	Epoch  uint64
+}
+
+// Grant records the vote for runID asking in epoch, it returns the vote of the epoch, which is for
+// another sentinel when it asked first. currentEpoch is advanced to epoch.
+func (v *Vote) Grant(currentEpoch *uint64, epoch uint64, runID string) Vote {
+	if epoch > *currentEpoch {
+		*currentEpoch = epoch
+	}
+	if v.Epoch < epoch && *currentEpoch <= epoch {
+		v.Leader, v.Epoch = runID, epoch
+	}
+	return *v
+}
+
+// Winner returns the sentinel with the most votes of epoch when it reached the majority of the
+// voters and the quorum, an empty string otherwise. votes are the votes of the sentinels
+// including the one counting.
+func Winner(votes []Vote, epoch uint64, voters, quorum int) string {
+	counts := make(map[string]int)
+	winner, max := "", 0
+	for _, v := range votes {
+		if v.Leader == "" || v.Epoch != epoch {
+			continue
+		}
+		counts[v.Leader]++
+		// the ties are broken by run ID so every sentinel picks the same winner
+		if n := counts[v.Leader]; n > max || (n == max && v.Leader < winner) {
+			winner, max = v.Leader, n
+		}
+	}
+	if max < voters/2+1 || max < quorum {
+		return ""
+	}
+	return winner
+}
+
+// Candidate is a replica that can be promoted
+type Candidate struct {
+	Addr       string
+	ReplOffset int64
+}
+
+// SelectReplica returns the candidate that processed the most of the replication stream, the
+// ties are broken by address, false when there are no candidates
+func SelectReplica(candidates []Candidate) (Candidate, bool) {
+	if len(candidates) == 0 {
+		return Candidate{}, false
+	}
+	sorted := append([]Candidate(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ReplOffset != sorted[j].ReplOffset {
+			return sorted[i].ReplOffset > sorted[j].ReplOffset
+		}
+		return sorted[i].Addr < sorted[j].Addr
+	})
+	return sorted[0], true
+}
@@ -0,0 +1,72 @@
+package sentinel
+
+import (
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"strings"
+	"testing"
+)
+
+func TestParseInfo(t *testing.T) {
+	master := ParseInfo("NumCPU:8\n=== Replication === \nrole:master\nconnected_slaves:2\n" +
+		"slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0\n" +
+		"slave1:ip=::1,port=6381,state=wait_bgsave,offset=0,lag=1\nmaster_repl_offset:42\n")
+	common.AssertEquals(t, master.Role, "master")
+	common.AssertEquals(t, strings.Join(master.Replicas, " "), "127.0.0.1:6380 [::1]:6381")
+
+	replica := ParseInfo("# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\n" +
+		"master_link_status:up\r\nslave_repl_offset:1234\r\nslave_read_only:1\r\n")
+	common.AssertEquals(t, replica.Role, "slave")
+	common.AssertEquals(t, replica.MasterAddr, "127.0.0.1:6379")
+	common.AssertEquals(t, replica.MasterLinkUp, true)
+	common.AssertEquals(t, replica.ReplOffset, int64(1234))
+	common.AssertEquals(t, len(replica.Replicas), 0)
+}
+
+func TestHello(t *testing.T) {
+	h := Hello{Addr: "127.0.0.1:26379", RunID: "abc", CurrentEpoch: 3, MasterName: "mymaster",
+		MasterAddr: "127.0.0.1:6380", ConfigEpoch: 2}
+	common.AssertEquals(t, h.String(), "127.0.0.1,26379,abc,3,mymaster,127.0.0.1,6380,2")
+	parsed, err := ParseHello(h.String())
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, parsed, h)
+
+	for _, invalid := range []string{
+		"",
+		"127.0.0.1,26379,abc,3,mymaster,127.0.0.1,6380",
+		"127.0.0.1,26379,abc,x,mymaster,127.0.0.1,6380,2",
+		"127.0.0.1,0,abc,3,mymaster,127.0.0.1,6380,2",
+		"127.0.0.1,26379,,3,mymaster,127.0.0.1,6380,2",
+	} {
+		if _, err := ParseHello(invalid); !errors.Is(err, errInvalidHello) {
+			t.Errorf("want an invalid hello error for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestVote(t *testing.T) {
+	var v Vote
+	epoch := uint64(1)
+	common.AssertEquals(t, v.Grant(&epoch, 2, "a"), Vote{Leader: "a", Epoch: 2})
+	common.AssertEquals(t, epoch, uint64(2))
+	// one vote per epoch
+	common.AssertEquals(t, v.Grant(&epoch, 2, "b"), Vote{Leader: "a", Epoch: 2})
+	// no vote for an older epoch
+	common.AssertEquals(t, v.Grant(&epoch, 1, "b"), Vote{Leader: "a", Epoch: 2})
+	common.AssertEquals(t, v.Grant(&epoch, 3, "b"), Vote{Leader: "b", Epoch: 3})
+
+	votes := []Vote{{"a", 3}, {"a", 3}, {"b", 3}, {"b", 2}, {}}
+	common.AssertEquals(t, Winner(votes, 3, 5, 2), "")
+	common.AssertEquals(t, Winner(votes, 3, 3, 2), "a")
+	common.AssertEquals(t, Winner(votes, 3, 3, 3), "")
+	common.AssertEquals(t, Winner([]Vote{{"b", 3}, {"a", 3}}, 3, 2, 1), "")
+	common.AssertEquals(t, Winner([]Vote{{"b", 3}, {"a", 3}}, 3, 1, 1), "a")
+}
+
+func TestSelectReplica(t *testing.T) {
+	_, ok := SelectReplica(nil)
+	common.AssertEquals(t, ok, false)
+	best, ok := SelectReplica([]Candidate{{"b:1", 10}, {"c:1", 12}, {"a:1", 12}})
+	common.AssertEquals(t, ok, true)
+	common.AssertEquals(t, best, Candidate{"a:1", 12})
+}
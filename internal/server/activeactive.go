@@ -0,0 +1,373 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/crdt"
+	"github.com/rilopez/redis-wire-protocol/internal/replication"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peerLinkBufferSize is the number of writes queued per peer, a peer that does not keep up is
+	// disconnected and gets the whole dataset when it reconnects
+	peerLinkBufferSize = 1024
+	// peerRetryInterval is the time between the connection attempts to a peer
+	peerRetryInterval = time.Second
+)
+
+var (
+	errActiveActiveDisabled = errors.New("ERR This instance has active-active support disabled")
+	errActiveActiveMode     = errors.New("active-active mode is not compatible with cluster mode, raft mode or replication")
+	errReplicaofActive      = errors.New("ERR REPLICAOF not allowed in active-active mode.")
+)
+
+// WithActiveActive enables the multi-master mode: every instance accepts writes and replicates the
+// keys it changes to its peers, the other masters at host:port, as CRDTs
+func WithActiveActive(peers []string) Option {
+	return func(s *server) {
+		s.activeActive = &activeActive{peerAddrs: peers}
+	}
+}
+
+// activeActive is the state of the active-active mode. The strings are last writer wins registers
+// ordered by hybrid logical clocks and INCRBY increments PN-counters, see the crdt package. Every
+// write sends the CRDT value of its key to the peers with CRDT MERGE, a peer merges it and updates
+// its keyspace with the merged value. A peer reconnecting gets the values of every key, so the
+// writes made while the instances were apart converge once they reconnect.
+type activeActive struct {
+	id    string
+	clock *crdt.Clock
+	// values are the CRDT values of the keys, including the deleted ones
+	values    map[string]crdt.Value
+	peerAddrs []string
+	// peers are the links to the peers by address, they are only used by the server loop
+	peers map[string]*peerLink
+	// merging is set while the value of a peer is applied to the keyspace, it is not sent back
+	merging bool
+
+	events chan peerEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// peerLink writes the CRDT MERGE commands queued in out to a peer
+type peerLink struct {
+	addr string
+	out  chan []byte
+	done chan struct{}
+	// running is set while the goroutine of the link runs, connected once it is connected
+	running   bool
+	connected bool
+	retryAt   time.Time
+}
+
+// peerEvent is the connection or the failure of a link, done identifies the connection attempt
+type peerEvent struct {
+	link *peerLink
+	done <-chan struct{}
+	err  error
+}
+
+// startActiveActive creates the CRDT values of the keys loaded at startup and connects to the
+// peers. The loaded keys are older than any write of the peers.
+func (s *server) startActiveActive() {
+	a := s.activeActive
+	if a == nil {
+		return
+	}
+	a.id = replication.NewID()
+	a.clock = crdt.NewClock(a.id, s.now)
+	a.values = make(map[string]crdt.Value)
+	a.peers = make(map[string]*peerLink)
+	a.events = make(chan peerEvent)
+	a.done = make(chan struct{})
+	loaded := crdt.Timestamp{Node: a.id}
+	_ = s.db.ForEach(func(key, value string) error {
+		a.values[key] = crdt.Set(value, loaded)
+		return nil
+	})
+	s.setPeers(a.peerAddrs)
+	log.Printf("active-active node %s with %d keys, peers %v", a.id, len(a.values), a.peerAddrs)
+}
+
+// stopActiveActive closes the links to the peers and waits for their goroutines
+func (s *server) stopActiveActive() {
+	a := s.activeActive
+	if a == nil || a.done == nil {
+		return
+	}
+	close(a.done)
+	a.wg.Wait()
+}
+
+// peerEvents returns the channel of the links, nil when the active-active mode is disabled
+func (s *server) peerEvents() <-chan peerEvent {
+	if s.activeActive == nil {
+		return nil
+	}
+	return s.activeActive.events
+}
+
+// setPeers replaces the peers, the links to the removed peers are closed and the new ones are
+// connected by the next cron
+func (s *server) setPeers(addrs []string) {
+	a := s.activeActive
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+		if _, ok := a.peers[addr]; !ok {
+			a.peers[addr] = &peerLink{addr: addr}
+		}
+	}
+	for addr, l := range a.peers {
+		if !keep[addr] {
+			s.closePeerLink(l)
+			delete(a.peers, addr)
+		}
+	}
+	a.peerAddrs = addrs
+}
+
+func (s *server) closePeerLink(l *peerLink) {
+	if l.running {
+		close(l.done)
+	}
+	l.running, l.connected = false, false
+}
+
+// activeActiveCron connects the links that are not running
+func (s *server) activeActiveCron() {
+	a := s.activeActive
+	if a == nil {
+		return
+	}
+	now := s.now()
+	for _, l := range a.peers {
+		if l.running || now.Before(l.retryAt) {
+			continue
+		}
+		l.running, l.connected, l.retryAt = true, false, now.Add(peerRetryInterval)
+		l.out = make(chan []byte, peerLinkBufferSize)
+		l.done = make(chan struct{})
+		a.wg.Add(1)
+		go a.write(l, l.out, l.done)
+	}
+}
+
+func (a *activeActive) send(e peerEvent) {
+	select {
+	case a.events <- e:
+	case <-a.done:
+	}
+}
+
+// write connects to the peer then writes the commands queued until it fails or it is closed
+func (a *activeActive) write(l *peerLink, out <-chan []byte, done <-chan struct{}) {
+	defer a.wg.Done()
+	conn, err := net.DialTimeout("tcp", l.addr, clusterDialTimeout)
+	if err != nil {
+		a.send(peerEvent{link: l, done: done, err: err})
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	a.send(peerEvent{link: l, done: done})
+	for {
+		select {
+		case data := <-out:
+			_ = conn.SetWriteDeadline(time.Now().Add(defaultClusterNodeTimeout))
+			if _, err := conn.Write(data); err != nil {
+				a.send(peerEvent{link: l, done: done, err: err})
+				return
+			}
+		case <-done:
+			return
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// handlePeerEvent sends the values of every key to a peer connected, a link that failed is
+// connected again by the cron
+func (s *server) handlePeerEvent(e peerEvent) {
+	a := s.activeActive
+	l := e.link
+	if current, ok := a.peers[l.addr]; !ok || current != l || !l.running || e.done != l.done {
+		// the link was closed
+		return
+	}
+	if e.err != nil {
+		if l.connected {
+			log.Printf("ERR link to peer %s failed: %v", l.addr, e.err)
+		}
+		l.running, l.connected = false, false
+		return
+	}
+	log.Printf("connected to peer %s, sending %d keys", l.addr, len(a.values))
+	l.connected = true
+	keys := make([]string, 0, len(a.values))
+	for key := range a.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var data []byte
+	for _, key := range keys {
+		data = appendMerge(data, key, a.values[key])
+		if len(data) >= 64*1024 {
+			s.queuePeer(l, data)
+			data = nil
+		}
+	}
+	if len(data) > 0 {
+		s.queuePeer(l, data)
+	}
+}
+
+func appendMerge(buf []byte, key string, v crdt.Value) []byte {
+	return aof.AppendCommand(buf, []string{"CRDT", "MERGE", key, string(v.Encode())})
+}
+
+// queuePeer queues data to a connected peer, the link is closed when its queue is full
+func (s *server) queuePeer(l *peerLink, data []byte) {
+	if !l.connected {
+		return
+	}
+	select {
+	case l.out <- data:
+	default:
+		log.Printf("ERR the link to peer %s is full, reconnecting", l.addr)
+		s.closePeerLink(l)
+	}
+}
+
+// trackCRDT updates the CRDT value of the keys written by a command propagated and sends it to
+// the peers
+func (s *server) trackCRDT(args []string) {
+	a := s.activeActive
+	if a == nil || a.values == nil || a.merging || len(args) < 2 {
+		return
+	}
+	var keys []string
+	switch strings.ToUpper(args[0]) {
+	case "SET", "RESTORE":
+		key := args[1]
+		value, exists := s.db.Get(key)
+		if exists {
+			a.values[key] = crdt.Set(value, a.clock.Now())
+		} else {
+			a.values[key] = crdt.Deleted(a.clock.Now())
+		}
+		keys = []string{key}
+	case "DEL":
+		keys = args[1:]
+		for _, key := range keys {
+			a.values[key] = crdt.Deleted(a.clock.Now())
+		}
+	case "INCRBY":
+		if len(args) != 3 {
+			return
+		}
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return
+		}
+		key := args[1]
+		v := a.values[key]
+		v.Increment(a.id, delta)
+		a.values[key] = v
+		keys = []string{key}
+	default:
+		return
+	}
+	var data []byte
+	for _, key := range keys {
+		data = appendMerge(data, key, a.values[key])
+	}
+	for _, l := range a.peers {
+		s.queuePeer(l, data)
+	}
+}
+
+func (s *server) handleCRDT(args common.CommandArguments) (string, error) {
+	crdtArgs, ok := args.(common.CRDTArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid CRDT argments %v", args)
+	}
+	a := s.activeActive
+	if a == nil {
+		return "", errActiveActiveDisabled
+	}
+	switch crdtArgs.Subcommand {
+	case common.CrdtSubcommandMERGE:
+		return "", s.mergeCRDT(crdtArgs.Key, crdtArgs.Payload)
+	case common.CrdtSubcommandPEERS:
+		addrs := make([]string, 0, len(a.peers))
+		for addr := range a.peers {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		peers := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			state := "disconnected"
+			if a.peers[addr].connected {
+				state = "connected"
+			}
+			peers = append(peers, resp.Array([]interface{}{addr, state}))
+		}
+		return resp.RawArray(peers), nil
+	}
+	return "", fmt.Errorf("ERR unknown subcommand '%s'", crdtArgs.Subcommand)
+}
+
+// mergeCRDT merges the value of key sent by a peer and writes the merged value to the keyspace
+func (s *server) mergeCRDT(key, payload string) error {
+	a := s.activeActive
+	remote, err := crdt.DecodeValue([]byte(payload))
+	if err != nil {
+		log.Printf("ERR invalid value of %q from a peer: %v", key, err)
+		return err
+	}
+	a.clock.Observe(remote.Register.TS)
+	v := a.values[key]
+	if !v.Merge(remote) {
+		return nil
+	}
+	a.values[key] = v
+
+	value, exists := v.Get()
+	current, existed := s.db.Get(key)
+	if exists {
+		s.db.Set(key, value)
+	} else {
+		s.db.Delete(key)
+	}
+	if exists == existed && value == current {
+		return nil
+	}
+	a.merging = true
+	defer func() { a.merging = false }()
+	if exists {
+		s.propagate("SET", key, value)
+		s.touchKey(key, nil)
+		if !existed {
+			s.notifyKeyspaceEvent(notifyNew, "new", key)
+		}
+		s.notifyKeyspaceEvent(notifyString, "set", key)
+	} else {
+		s.propagate("DEL", key)
+		s.touchKey(key, nil)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	s.flushAOF()
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestActiveActive(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	ports := []uint{10_040, 10_041}
+
+	type instance struct {
+		rdb    *redis.Client
+		quit   chan bool
+		events chan string
+	}
+	instances := make([]*instance, len(ports))
+	for i, port := range ports {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 32)
+		// the instances start apart and take writes before they know each other
+		go Start(port, 10, ready, quit, events, WithRDB(t.TempDir(), ""), WithActiveActive(nil))
+		<-ready
+		instances[i] = &instance{
+			rdb:    redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}),
+			quit:   quit,
+			events: events,
+		}
+	}
+	a, b := instances[0].rdb, instances[1].rdb
+
+	common.AssertEquals(t, a.ConfigGet(ctx, "active-active").Val()[1], "yes")
+	common.AssertEquals(t, a.SlaveOf(ctx, "localhost", "10041").Err().Error(), errReplicaofActive.Error())
+
+	// the last SET wins
+	common.ExpectNoError(t, a.Set(ctx, "k", "from a", 0).Err())
+	time.Sleep(2 * time.Millisecond)
+	common.ExpectNoError(t, b.Set(ctx, "k", "from b", 0).Err())
+	// the increments of both add up
+	common.ExpectNoError(t, a.IncrBy(ctx, "n", 5).Err())
+	common.ExpectNoError(t, b.IncrBy(ctx, "n", 3).Err())
+	common.ExpectNoError(t, b.Decr(ctx, "n").Err())
+	// a DEL after a SET wins
+	common.ExpectNoError(t, b.Set(ctx, "d", "1", 0).Err())
+	time.Sleep(2 * time.Millisecond)
+	common.ExpectNoError(t, a.Set(ctx, "d", "2", 0).Err())
+	time.Sleep(2 * time.Millisecond)
+	common.AssertEquals(t, a.Del(ctx, "d").Val(), int64(1))
+
+	common.ExpectNoError(t, a.ConfigSet(ctx, "active-active-peers", "localhost:10041").Err())
+	common.ExpectNoError(t, b.ConfigSet(ctx, "active-active-peers", "localhost:10040").Err())
+	common.AssertEquals(t, a.ConfigGet(ctx, "active-active-peers").Val()[1], "localhost:10041")
+	common.AssertEquals(t, a.ConfigSet(ctx, "active-active-peers", "localhost").Err().Error(),
+		"ERR CONFIG SET failed (possibly related to argument 'active-active-peers') - invalid peer address localhost")
+
+	for _, rdb := range []*redis.Client{a, b} {
+		rdb := rdb
+		eventually(t, "the values to converge", func() bool {
+			return rdb.Get(ctx, "k").Val() == "from b" && rdb.Get(ctx, "n").Val() == "7" &&
+				rdb.Get(ctx, "d").Err() == redis.Nil
+		})
+	}
+	peers, err := a.Do(ctx, "CRDT", "PEERS").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(peers), "[[localhost:10041 connected]]")
+
+	// the writes of connected instances are replicated
+	common.ExpectNoError(t, a.Set(ctx, "live", "v", 0).Err())
+	common.ExpectNoError(t, b.Incr(ctx, "n").Err())
+	eventually(t, "the writes to replicate", func() bool {
+		return b.Get(ctx, "live").Val() == "v" && a.Get(ctx, "n").Val() == "8"
+	})
+	common.ExpectNoError(t, b.Del(ctx, "live").Err())
+	eventually(t, "the DEL to replicate", func() bool {
+		return a.Get(ctx, "live").Err() == redis.Nil
+	})
+
+	for _, i := range instances {
+		common.ExpectNoError(t, i.rdb.Close())
+		for quiet := false; !quiet; {
+			select {
+			case <-i.events:
+			case <-time.After(200 * time.Millisecond):
+				quiet = true
+			}
+		}
+		i.quit <- true
+		for event := range i.events {
+			if event == EventSuccessfulShutdown {
+				break
+			}
+		}
+	}
+}
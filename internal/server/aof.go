@@ -0,0 +1,476 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errAOFDisabled          = errors.New("ERR Append only file is not enabled")
+	errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+	errBgsaveDuringRewrite  = errors.New("ERR An AOF log rewriting in progress: can't BGSAVE right now.")
+)
+
+// appendOnly keeps the state of the append only file, see the aof package
+type appendOnly struct {
+	manifest *aof.Manifest
+	// writer appends to the last incr file of the manifest
+	writer *aof.Writer
+	// rewrite is not nil while a BGREWRITEAOF is in progress
+	rewrite *aofRewrite
+	// rewriteScheduled is set when BGREWRITEAOF waits for a BGSAVE to finish
+	rewriteScheduled bool
+	lastRewriteErr   error
+	lastWriteErr     error
+	// closedBytes counts the bytes written to the incr files closed, they are synced
+	closedBytes int64
+}
+
+// aofRewrite is a background rewrite writing a new base file, the incr files opened after the
+// rewrite started are kept by the new manifest
+type aofRewrite struct {
+	base aof.File
+	keep []aof.File
+	done chan error
+}
+
+// WithAppendOnly enables the append only file, the files are stored in dirname, inside the
+// directory of the RDB file. fsync is always, everysec or no.
+func WithAppendOnly(dirname string, filename string, fsync string) Option {
+	return func(s *server) {
+		policy, err := aof.ParseFsyncPolicy(fsync)
+		if err != nil {
+			log.Fatalf("ERR %v", err)
+		}
+		s.appendOnly = true
+		s.appendDirname = dirname
+		s.appendFilename = filename
+		s.appendFsync = policy
+	}
+}
+
+// WithAOFTimestamps annotates the append only file with the time of the commands, needed by the
+// point in time recovery
+func WithAOFTimestamps(enabled bool) Option {
+	return func(s *server) {
+		s.aofTimestamps = enabled
+	}
+}
+
+// WithRecovery replays the append only file up to limit at startup. The file is truncated at the
+// first skipped command, the originals are kept with the .pre-recovery suffix.
+func WithRecovery(limit aof.Limit) Option {
+	return func(s *server) {
+		s.recovery = &limit
+	}
+}
+
+func (s *server) aofDir() string {
+	return filepath.Join(s.rdbDir, s.appendDirname)
+}
+
+// loadData loads the keyspace at startup, the append only file takes precedence over the RDB file
+func (s *server) loadData() error {
+	if s.recovery != nil && !s.appendOnly {
+		return errors.New("point in time recovery requires the append only file")
+	}
+	if s.activeActive != nil && (s.clusterConfigFile != "" || s.raftDirname != "" || s.master != nil) {
+		return errActiveActiveMode
+	}
+	if s.sentinel != nil {
+		if s.clusterConfigFile != "" || s.raftDirname != "" || s.activeActive != nil || s.master != nil || s.appendOnly {
+			return errSentinelMode
+		}
+		// a sentinel keeps no keys
+		s.rdbFilename = ""
+		return nil
+	}
+	if err := s.loadCluster(); err != nil {
+		return err
+	}
+	if s.raftDirname != "" {
+		return s.loadRaft()
+	}
+	if !s.appendOnly {
+		return s.loadRDB()
+	}
+	return s.loadAOF()
+}
+
+// loadAOF replays the files of the manifest and opens its last incr file to append the new
+// commands. Without a manifest the RDB file is loaded and written as the first base.
+func (s *server) loadAOF() error {
+	if err := os.MkdirAll(s.aofDir(), 0755); err != nil {
+		return err
+	}
+	s.aof = &appendOnly{}
+	manifest, err := aof.LoadManifest(s.aofDir(), s.appendFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := s.loadRDB(); err != nil {
+			return err
+		}
+		return s.createAOF()
+	}
+	if err != nil {
+		return err
+	}
+	s.aof.manifest = manifest
+	if s.recovery != nil {
+		if err := s.recoverAOF(); err != nil {
+			return err
+		}
+	}
+
+	s.loading = true
+	defer func() { s.loading = false }()
+	if manifest.Base != nil {
+		path := filepath.Join(s.aofDir(), manifest.Base.Name)
+		if strings.HasSuffix(manifest.Base.Name, ".rdb") {
+			err = s.loadRDBFile(path)
+		} else {
+			err = s.replayAOFFile(path, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i, incr := range manifest.Incrs {
+		last := i == len(manifest.Incrs)-1
+		if err := s.replayAOFFile(filepath.Join(s.aofDir(), incr.Name), last); err != nil {
+			return err
+		}
+	}
+	s.dirty = 0
+
+	if len(manifest.History) > 0 {
+		s.deleteAOFHistory()
+	}
+	if len(manifest.Incrs) == 0 {
+		return s.openAOFIncr()
+	}
+	last := manifest.Incrs[len(manifest.Incrs)-1].Name
+	s.aof.writer, err = aof.OpenWriter(filepath.Join(s.aofDir(), last), s.fileEnvelope)
+	if errors.Is(err, aof.ErrEnvelopeChanged) {
+		log.Printf("%s was written with other compression or encryption options, opening a new incr file", last)
+		return s.openAOFIncr()
+	}
+	return err
+}
+
+// recoverAOF truncates the append only file at the recovery limit and logs every skipped command
+func (s *server) recoverAOF() error {
+	cut, err := aof.FindCut(s.aofDir(), s.aof.manifest, *s.recovery, s.fileEnvelope.Key)
+	if err != nil {
+		return fmt.Errorf("point in time recovery: %w", err)
+	}
+	for _, skipped := range cut.Skipped {
+		log.Printf("recovery skipped %v", skipped)
+	}
+	log.Printf("point in time recovery: %d commands replayed, %d commands skipped", cut.Replayed, len(cut.Skipped))
+	return cut.Apply(s.aofDir(), s.aof.manifest, s.fileEnvelope.Key)
+}
+
+// createAOF writes the keyspace loaded from the RDB file as the first base, the manifest is only
+// written once the base is complete
+func (s *server) createAOF() error {
+	s.aof.manifest = &aof.Manifest{Name: s.appendFilename}
+	base := s.aof.manifest.NextBase()
+	db, functions := s.snapshot()
+	if err := writeRDB(filepath.Join(s.aofDir(), base.Name), db, functions, s.now(), s.fileEnvelope); err != nil {
+		return err
+	}
+	s.aof.manifest.Base = &base
+	log.Printf("creating the append only file %s", s.aofDir())
+	return s.openAOFIncr()
+}
+
+// replayAOFFile executes the commands of path. When the last incr file ends with a truncated
+// command, written when the server crashed, the file is truncated to its last complete command.
+func (s *server) replayAOFFile(path string, last bool) error {
+	loader := &connectedClient{ID: 0, protocol: 2}
+	// tx buffers the commands between MULTI & EXEC, an incomplete transaction is discarded
+	var tx []common.Command
+	inMulti := false
+	commands := 0
+	valid, err := aof.ReplayFile(path, s.fileEnvelope.Key, func(e aof.Entry) error {
+		args := e.Args
+		cmdID, cmdArgs, err := resp.ParseCommand(args)
+		if err != nil {
+			return fmt.Errorf("invalid command %q in %s: %w", args[0], path, err)
+		}
+		switch cmdID {
+		case common.MULTI:
+			inMulti = true
+			return nil
+		case common.EXEC:
+			inMulti = false
+			for _, cmd := range tx {
+				if _, err := s.execute(cmd, loader); err != nil {
+					return fmt.Errorf("replaying %s: %w", path, err)
+				}
+			}
+			tx = tx[:0]
+			return nil
+		case common.UNKNOWN:
+			return fmt.Errorf("unknown command %q in %s", args[0], path)
+		}
+		commands++
+		cmd := common.Command{CMD: cmdID, ClientID: loader.ID, Arguments: cmdArgs}
+		if inMulti {
+			tx = append(tx, cmd)
+			return nil
+		}
+		_, err = s.execute(cmd, loader)
+		return err
+	})
+	if errors.Is(err, aof.ErrTruncated) && last {
+		log.Printf("!!! Warning: short read while loading %s, truncating it to %d bytes", path, valid)
+		if err := os.Truncate(path, valid); err != nil {
+			return fmt.Errorf("failed truncating %s: %w", path, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("loading %s: %w", path, err)
+	}
+	if inMulti {
+		log.Printf("!!! Warning: discarding the incomplete MULTI/EXEC transaction at the end of %s", path)
+	}
+	log.Printf("DB loaded from %s: %d commands", path, commands)
+	return nil
+}
+
+// propagate appends a command modifying the dataset to the append only file and the replication
+// stream. Commands executed by EXEC, scripts and functions are wrapped in MULTI/EXEC to be
+// replayed atomically.
+func (s *server) propagate(args ...string) {
+	if !s.loading {
+		s.trackCRDT(args)
+	}
+	if s.loading || (s.aof == nil && s.backlog == nil) {
+		return
+	}
+	if s.aof != nil && s.aofTimestamps && (s.atomicDepth == 0 || !s.atomicPropagated) {
+		// the annotation precedes MULTI, a recovery never splits a transaction
+		s.aof.writer.AppendTimestamp(s.now())
+	}
+	if s.atomicDepth > 0 && !s.atomicPropagated {
+		s.atomicPropagated = true
+		s.appendPropagated([]string{"MULTI"})
+	}
+	s.appendPropagated(args)
+}
+
+// appendPropagated appends a command to the append only file and the replication stream
+func (s *server) appendPropagated(args []string) {
+	if s.aof != nil {
+		s.aof.writer.Append(args)
+	}
+	s.feedCommand(args)
+}
+
+// beginAtomic & endAtomic delimit the commands executed as a unit by EXEC or a script
+func (s *server) beginAtomic() {
+	s.atomicDepth++
+}
+
+func (s *server) endAtomic() {
+	s.atomicDepth--
+	if s.atomicDepth == 0 && s.atomicPropagated {
+		s.atomicPropagated = false
+		s.appendPropagated([]string{"EXEC"})
+	}
+}
+
+// flushAOF writes the propagated commands, it is called before replying to the client
+func (s *server) flushAOF() {
+	if s.aof == nil || s.aof.writer == nil {
+		return
+	}
+	if err := s.aof.writer.Flush(s.appendFsync, s.now()); err != nil {
+		log.Printf("ERR writing the append only file: %v", err)
+		s.aof.lastWriteErr = err
+		return
+	}
+	s.aof.lastWriteErr = nil
+}
+
+// aofWritten & aofSynced count the bytes written to the append only file since the server started
+// and how many of them are on disk
+func (s *server) aofWritten() int64 {
+	if s.aof.writer == nil {
+		return s.aof.closedBytes
+	}
+	return s.aof.closedBytes + s.aof.writer.Written()
+}
+
+func (s *server) aofSynced() int64 {
+	if s.aof.writer == nil {
+		return s.aof.closedBytes
+	}
+	return s.aof.closedBytes + s.aof.writer.Synced()
+}
+
+// openAOFIncr adds a new incr file to the manifest, the next commands are appended to it
+func (s *server) openAOFIncr() error {
+	if s.aof.writer != nil {
+		if err := s.aof.writer.Close(); err != nil {
+			return err
+		}
+		s.aof.closedBytes += s.aof.writer.Written()
+		s.aof.writer = nil
+	}
+	incr := s.aof.manifest.NextIncr()
+	writer, err := aof.CreateWriter(filepath.Join(s.aofDir(), incr.Name), s.fileEnvelope)
+	if err != nil {
+		s.aof.manifest.Incrs = s.aof.manifest.Incrs[:len(s.aof.manifest.Incrs)-1]
+		return err
+	}
+	s.aof.writer = writer
+	return s.persistManifest()
+}
+
+// persistManifest replaces the manifest file atomically
+func (s *server) persistManifest() error {
+	return s.aof.manifest.Save(s.aofDir())
+}
+
+// deleteAOFHistory removes the files replaced by the last rewrite
+func (s *server) deleteAOFHistory() {
+	for _, f := range s.aof.manifest.History {
+		if err := os.Remove(filepath.Join(s.aofDir(), f.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERR removing the history AOF file %s: %v", f.Name, err)
+			return
+		}
+	}
+	s.aof.manifest.History = nil
+	if err := s.persistManifest(); err != nil {
+		log.Printf("ERR writing the AOF manifest: %v", err)
+	}
+}
+
+func (s *server) handleBGREWRITEAOF() (string, error) {
+	if s.aof == nil {
+		return "", errAOFDisabled
+	}
+	if s.aof.rewrite != nil {
+		return "", errAOFRewriteInProgress
+	}
+	if s.bgsave != nil {
+		s.aof.rewriteScheduled = true
+		return resp.SimpleString("Background append only file rewriting scheduled"), nil
+	}
+	if err := s.startAOFRewrite(); err != nil {
+		return "", fmt.Errorf("ERR Can't rewrite append only file in background: %v", err)
+	}
+	return resp.SimpleString("Background append only file rewriting started"), nil
+}
+
+// startAOFRewrite switches the new commands to a new incr file and writes the keyspace to a new
+// base file in background. The manifest only references the new base once it is complete.
+func (s *server) startAOFRewrite() error {
+	s.flushAOF()
+	if err := s.openAOFIncr(); err != nil {
+		return err
+	}
+	manifest := s.aof.manifest
+	rewrite := &aofRewrite{
+		base: manifest.NextBase(),
+		keep: []aof.File{manifest.Incrs[len(manifest.Incrs)-1]},
+		done: make(chan error, 1),
+	}
+	s.aof.rewrite = rewrite
+	s.aof.rewriteScheduled = false
+	db, functions := s.snapshot()
+	path, now, opts := filepath.Join(s.aofDir(), rewrite.base.Name), s.now(), s.fileEnvelope
+	go func() {
+		rewrite.done <- writeRDB(path, db, functions, now, opts)
+	}()
+	log.Printf("background append only file rewriting started")
+	return nil
+}
+
+// aofRewriteDone returns the channel receiving the result of the rewrite, nil when there is none
+// in progress
+func (s *server) aofRewriteDone() <-chan error {
+	if s.aof == nil || s.aof.rewrite == nil {
+		return nil
+	}
+	return s.aof.rewrite.done
+}
+
+func (s *server) aofRewriteFinished(err error) error {
+	rewrite := s.aof.rewrite
+	s.aof.rewrite = nil
+	s.aof.lastRewriteErr = err
+	if err != nil {
+		log.Printf("ERR background append only file rewriting failed: %v", err)
+		return err
+	}
+	s.aof.manifest.Rewritten(rewrite.base, rewrite.keep)
+	if err := s.persistManifest(); err != nil {
+		log.Printf("ERR writing the AOF manifest: %v", err)
+		s.aof.lastRewriteErr = err
+		return err
+	}
+	s.deleteAOFHistory()
+	log.Printf("background AOF rewrite finished successfully")
+	return nil
+}
+
+// aofCron starts the scheduled rewrites and runs the background fsync of the everysec policy
+func (s *server) aofCron() {
+	if s.aof == nil {
+		return
+	}
+	s.flushAOF()
+	if s.aof.rewriteScheduled && s.aof.rewrite == nil && s.bgsave == nil {
+		if err := s.startAOFRewrite(); err != nil {
+			log.Printf("ERR starting the scheduled AOF rewrite: %v", err)
+		}
+	}
+}
+
+// closeAOF waits for the rewrite in progress and syncs the append only file before exiting
+func (s *server) closeAOF() {
+	if s.aof == nil {
+		return
+	}
+	if s.aof.rewrite != nil {
+		_ = s.aofRewriteFinished(<-s.aof.rewrite.done)
+	}
+	if err := s.aof.writer.Close(); err != nil {
+		log.Printf("ERR closing the append only file: %v", err)
+	}
+	s.aof.writer = nil
+}
+
+func (s *server) aofInfo(sb *strings.Builder) {
+	enabled, inProgress, scheduled := 0, 0, 0
+	rewriteStatus, writeStatus := "ok", "ok"
+	if s.aof != nil {
+		enabled = 1
+		if s.aof.rewrite != nil {
+			inProgress = 1
+		}
+		if s.aof.rewriteScheduled {
+			scheduled = 1
+		}
+		if s.aof.lastRewriteErr != nil {
+			rewriteStatus = "err"
+		}
+		if s.aof.lastWriteErr != nil {
+			writeStatus = "err"
+		}
+	}
+	sb.WriteString(fmt.Sprintf("aof_enabled:%d\n", enabled))
+	sb.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\n", inProgress))
+	sb.WriteString(fmt.Sprintf("aof_rewrite_scheduled:%d\n", scheduled))
+	sb.WriteString(fmt.Sprintf("aof_last_bgrewrite_status:%s\n", rewriteStatus))
+	sb.WriteString(fmt.Sprintf("aof_last_write_status:%s\n", writeStatus))
+}
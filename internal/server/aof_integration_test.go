@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendOnlyFile(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	port := uint(10_017)
+	ctx := context.Background()
+
+	start := func() (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 2)
+		go Start(port, 2, ready, quit, events, WithRDB(dir, "dump.rdb"),
+			WithAppendOnly("appendonlydir", "appendonly.aof", "always"))
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		common.AssertEquals(t, <-events, EventAfterDisconnect)
+		quit <- true
+		common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+	}
+
+	rdb, quit, events := start()
+	common.ExpectNoError(t, rdb.Set(ctx, "a", "1", 0).Err())
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "b", "2", 0)
+		pipe.Del(ctx, "a")
+		return nil
+	})
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, rdb.Eval(ctx, "return redis.call('SET', KEYS[1], ARGV[1])", []string{"c"}, "3").Err())
+	common.ExpectNoError(t, rdb.Do(ctx, "FUNCTION", "LOAD",
+		"#!lua name=mylib\nredis.register_function('hello', function() return 'hi' end)").Err())
+
+	incr, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof"))
+	common.ExpectNoError(t, err)
+	// the transaction & the script are replayed atomically
+	common.AssertEquals(t, strings.Count(string(incr), "*1\r\n$5\r\nMULTI\r\n"), 2)
+	common.AssertEquals(t, strings.Count(string(incr), "*1\r\n$4\r\nEXEC\r\n"), 2)
+
+	common.AssertEquals(t, rdb.Do(ctx, "BGREWRITEAOF").Val(), "Background append only file rewriting started")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := rdb.Info(ctx).Result()
+		common.ExpectNoError(t, err)
+		if strings.Contains(info, "aof_rewrite_in_progress:0\n") {
+			common.AssertEquals(t, strings.Contains(info, "aof_last_bgrewrite_status:ok\n"), true)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want the AOF rewrite to finish, got %s", info)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	common.ExpectNoError(t, rdb.Set(ctx, "d", "4", 0).Err())
+	stop(rdb, quit, events)
+
+	aofDir := filepath.Join(dir, "appendonlydir")
+	entries, err := os.ReadDir(aofDir)
+	common.ExpectNoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	common.AssertEquals(t, fmt.Sprint(names),
+		"[appendonly.aof.2.base.rdb appendonly.aof.2.incr.aof appendonly.aof.manifest]")
+	incr, err = os.ReadFile(filepath.Join(aofDir, "appendonly.aof.2.incr.aof"))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, string(incr), "*3\r\n$3\r\nSET\r\n$1\r\nd\r\n$1\r\n4\r\n")
+
+	// a crash while appending leaves a truncated command at the end of the file
+	f, err := os.OpenFile(filepath.Join(aofDir, "appendonly.aof.2.incr.aof"), os.O_APPEND|os.O_WRONLY, 0644)
+	common.ExpectNoError(t, err)
+	_, err = f.WriteString("*3\r\n$3\r\nSET\r\n$1\r\ne\r\n$1")
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, f.Close())
+
+	rdb, quit, events = start()
+	for key, want := range map[string]string{"b": "2", "c": "3", "d": "4"} {
+		common.AssertEquals(t, rdb.Get(ctx, key).Val(), want)
+	}
+	common.AssertEquals(t, rdb.Get(ctx, "a").Err(), redis.Nil)
+	common.AssertEquals(t, rdb.Get(ctx, "e").Err(), redis.Nil)
+	common.AssertEquals(t, rdb.Do(ctx, "FCALL", "hello", 0).Val(), "hi")
+	stop(rdb, quit, events)
+
+	incr, err = os.ReadFile(filepath.Join(aofDir, "appendonly.aof.2.incr.aof"))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, string(incr), "*3\r\n$3\r\nSET\r\n$1\r\nd\r\n$1\r\n4\r\n")
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// busTransport connects the server to the other nodes on the port of the server + 10000, it
+// carries the messages of the cluster bus or of raft. Every node has an outbound link the messages
+// to it are queued in, the messages received on the inbound connections are forwarded to the
+// server loop.
+type busTransport struct {
+	listener net.Listener
+	events   chan busEvent
+	done     chan struct{}
+	wg       sync.WaitGroup
+	// links are the outbound links by node ID, they are only used by the server loop
+	links map[string]*busLink
+	// readMessage & writeMessage frame the messages, a write waits up to writeTimeout
+	readMessage  func(r *bufio.Reader) (interface{}, error)
+	writeMessage func(w io.Writer, m interface{}) error
+	writeTimeout time.Duration
+
+	mu sync.Mutex
+	// conns are the connections open, closed when the transport stops
+	conns map[net.Conn]struct{}
+}
+
+// busLink writes the messages queued in out to a node
+type busLink struct {
+	id   string
+	addr string
+	out  chan interface{}
+	done chan struct{}
+}
+
+// busEvent is a message received or the failure of an outbound link
+type busEvent struct {
+	msg interface{}
+	// host is the address of the sender
+	host string
+	link *busLink
+	err  error
+}
+
+// listenBus starts the transport named name at port
+func listenBus(name string, port int, writeTimeout time.Duration,
+	readMessage func(r *bufio.Reader) (interface{}, error), writeMessage func(w io.Writer, m interface{}) error) (*busTransport, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("ERR Failed to start the %s at :%d, %v", name, port, err)
+	}
+	t := &busTransport{
+		listener:     ln,
+		events:       make(chan busEvent),
+		done:         make(chan struct{}),
+		links:        make(map[string]*busLink),
+		readMessage:  readMessage,
+		writeMessage: writeMessage,
+		writeTimeout: writeTimeout,
+		conns:        make(map[net.Conn]struct{}),
+	}
+	log.Printf("%s listening at :%d", name, port)
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// stop closes the listener & the connections and waits for their goroutines
+func (t *busTransport) stop() {
+	close(t.done)
+	_ = t.listener.Close()
+	t.mu.Lock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+func (t *busTransport) accept() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			// the listener is closed when the transport stops
+			return
+		}
+		if !t.track(conn) {
+			return
+		}
+		t.wg.Add(1)
+		go t.read(conn)
+	}
+}
+
+// track adds conn to the connections closed when the transport stops, it returns false when the
+// transport is already stopped
+func (t *busTransport) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		_ = conn.Close()
+		return false
+	default:
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *busTransport) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (t *busTransport) send(e busEvent) bool {
+	select {
+	case t.events <- e:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// read forwards the messages of an inbound connection to the server loop
+func (t *busTransport) read(conn net.Conn) {
+	defer t.wg.Done()
+	defer t.untrack(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	r := bufio.NewReader(conn)
+	for {
+		m, err := t.readMessage(r)
+		if err != nil {
+			return
+		}
+		if !t.send(busEvent{msg: m, host: host}) {
+			return
+		}
+	}
+}
+
+// queue queues m to the node id at addr, the message is dropped when the link is full
+func (t *busTransport) queue(id, addr string, m interface{}) {
+	select {
+	case t.link(id, addr).out <- m:
+	default:
+	}
+}
+
+// link returns the outbound link to the node id, it is connected the first time and again when the
+// address of the node changes
+func (t *busTransport) link(id, addr string) *busLink {
+	if l, ok := t.links[id]; ok && l.addr == addr {
+		return l
+	}
+	t.closeLink(id)
+	l := &busLink{
+		id:   id,
+		addr: addr,
+		out:  make(chan interface{}, clusterLinkBufferSize),
+		done: make(chan struct{}),
+	}
+	t.links[id] = l
+	t.wg.Add(1)
+	go t.write(l)
+	return l
+}
+
+// closeLink stops the outbound link to the node id
+func (t *busTransport) closeLink(id string) {
+	if l, ok := t.links[id]; ok {
+		close(l.done)
+		delete(t.links, id)
+	}
+}
+
+// linkFailed forgets the link of a failure event, it returns false when the node already has
+// another link
+func (t *busTransport) linkFailed(l *busLink) bool {
+	if current, ok := t.links[l.id]; !ok || current != l {
+		return false
+	}
+	delete(t.links, l.id)
+	return true
+}
+
+// write sends the messages queued in the link until it fails or it is closed
+func (t *busTransport) write(l *busLink) {
+	defer t.wg.Done()
+	conn, err := net.DialTimeout("tcp", l.addr, clusterDialTimeout)
+	if err != nil {
+		t.send(busEvent{link: l, err: err})
+		return
+	}
+	if !t.track(conn) {
+		return
+	}
+	defer t.untrack(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		select {
+		case m := <-l.out:
+			_ = conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+			err = t.writeMessage(w, m)
+			if err == nil && len(l.out) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				t.send(busEvent{link: l, err: err})
+				return
+			}
+		case <-l.done:
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
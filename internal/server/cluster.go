@@ -0,0 +1,540 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/cluster"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/keyspace"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// clusterBusPortOffset is added to the clients port to get the port of the cluster bus
+const clusterBusPortOffset = 10000
+
+var (
+	errClusterDisabled  = errors.New("ERR This instance has cluster support disabled")
+	errClusterDown      = errors.New("CLUSTERDOWN The cluster is down")
+	errSlotNotServed    = errors.New("CLUSTERDOWN Hash slot not served")
+	errTryAgain         = errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+	errScriptCrossSlot  = errors.New("ERR Script attempted to access keys that do not hash to the same slot")
+	errScriptNonLocal   = errors.New("ERR Script attempted to access a non local key in a cluster node")
+	errReplicaofCluster = errors.New("ERR REPLICAOF not allowed in cluster mode.")
+)
+
+// WithCluster enables the cluster mode, the configuration of the cluster is kept in configFile,
+// like nodes.conf, inside the directory of the RDB file
+func WithCluster(configFile string) Option {
+	return func(s *server) {
+		s.clusterConfigFile = configFile
+		s.db.IndexSlots()
+	}
+}
+
+func (s *server) clusterConfigPath() string {
+	return filepath.Join(s.rdbDir, s.clusterConfigFile)
+}
+
+// newKeyspace returns an empty keyspace, indexed by slot in cluster mode
+func (s *server) newKeyspace() *keyspace.Keyspace {
+	db := keyspace.New()
+	if s.clusterConfigFile != "" {
+		db.IndexSlots()
+	}
+	return db
+}
+
+// loadCluster loads the cluster configuration, a new node without slots is created and saved
+// when the file does not exist
+func (s *server) loadCluster() error {
+	if s.clusterConfigFile == "" {
+		return nil
+	}
+	state, err := cluster.Load(s.clusterConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		state = cluster.New(&cluster.Node{ID: cluster.NewNodeID(), Host: "127.0.0.1"})
+		log.Printf("no cluster configuration found, I'm %s", state.Myself.ID)
+	} else if err != nil {
+		return err
+	}
+	myself := state.Myself
+	myself.Port, myself.BusPort = int(s.port), int(s.port)+clusterBusPortOffset
+	// the failures are detected again by the bus, a node FAIL stays failing until it is reachable
+	for _, n := range state.Nodes {
+		n.PingSent, n.Connected = 0, n == myself
+		n.Flags &^= cluster.FlagPFail
+	}
+	s.cluster = state
+	if myself.MasterID != "" {
+		if master, ok := state.Nodes[myself.MasterID]; ok && s.master == nil {
+			s.master = &masterLink{host: master.Host, port: master.Port, state: linkStateConnect}
+		}
+	}
+	return s.saveClusterConfig()
+}
+
+func (s *server) saveClusterConfig() error {
+	if err := s.cluster.Save(s.clusterConfigPath()); err != nil {
+		log.Printf("ERR saving the cluster configuration: %v", err)
+		return fmt.Errorf("ERR saving the cluster configuration: %v", err)
+	}
+	return nil
+}
+
+// routingKeys returns the keys, or sharded channels, that decide the node serving cmd
+func routingKeys(cmd common.Command) []string {
+	switch args := cmd.Arguments.(type) {
+	case common.SETArguments:
+		return []string{args.Key}
+	case common.GETArguments:
+		return []string{args.Key}
+	case common.DELArguments:
+		return args.Keys
+	case common.INCRBYArguments:
+		return []string{args.Key}
+	case common.WATCHArguments:
+		return args.Keys
+	case common.EVALArguments:
+		return args.Keys
+	case common.DUMPArguments:
+		return []string{args.Key}
+	case common.RESTOREArguments:
+		return []string{args.Key}
+	case common.MIGRATEArguments:
+		return args.Keys
+	case common.SUBSCRIBEArguments:
+		if cmd.CMD == common.SSUBSCRIBE || cmd.CMD == common.SUNSUBSCRIBE {
+			return args.Channels
+		}
+	case common.PUBLISHArguments:
+		if cmd.CMD == common.SPUBLISH {
+			return []string{args.Channel}
+		}
+	}
+	return nil
+}
+
+// keysSlot returns the slot of keys, errCrossSlot when they are not in the same slot
+func keysSlot(keys []string) (int, error) {
+	slot := common.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if common.KeySlot(key) != slot {
+			return 0, errCrossSlot
+		}
+	}
+	return slot, nil
+}
+
+// clusterRedirect returns the MOVED, ASK or CROSSSLOT error of a client command for keys this node
+// does not serve, nil when the command is executed here. The commands of a transaction must use
+// the same slot.
+func (s *server) clusterRedirect(cmd common.Command, c *connectedClient) error {
+	if s.cluster == nil || c.ID == 0 || cmd.Err != nil {
+		return nil
+	}
+	keys := routingKeys(cmd)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot, err := keysSlot(keys)
+	if err != nil {
+		return err
+	}
+	if c.multi != nil && isQueueable(cmd) {
+		if c.multi.slot >= 0 && c.multi.slot != slot {
+			return errCrossSlot
+		}
+		c.multi.slot = slot
+	}
+
+	state := s.cluster
+	if !s.clusterOK() {
+		return errClusterDown
+	}
+	owner := state.Owner(slot)
+	if owner == nil {
+		return errSlotNotServed
+	}
+	// like redis the keys of a slot being moved are migrated by whichever node has them
+	if cmd.CMD == common.MIGRATE && (state.Migrating(slot) != nil || state.Importing(slot) != nil) {
+		return nil
+	}
+	// like redis the replicas redirect the clients to their master
+	if owner == state.Myself {
+		if target := state.Migrating(slot); target != nil {
+			missing := 0
+			for _, key := range keys {
+				if _, exists := s.db.Get(key); !exists {
+					missing++
+				}
+			}
+			if missing == len(keys) {
+				return fmt.Errorf("ASK %d %s", slot, target.Addr())
+			}
+			if missing > 0 {
+				return errTryAgain
+			}
+		}
+		return nil
+	}
+	asking := c.asking
+	if restoreArgs, ok := cmd.Arguments.(common.RESTOREArguments); ok && restoreArgs.Asking {
+		asking = true
+	}
+	if state.Importing(slot) != nil && asking {
+		return nil
+	}
+	return fmt.Errorf("MOVED %d %s", slot, owner.Addr())
+}
+
+// clusterOK returns true when every slot is served by a master not flagged FAIL
+func (s *server) clusterOK() bool {
+	if !s.cluster.Covered() {
+		return false
+	}
+	for _, master := range s.cluster.Masters() {
+		if master.Flags&cluster.FlagFail != 0 && s.cluster.CountSlots(master) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkScriptKeys fails when a script accesses keys of another slot than its previous keys or of
+// a slot this node does not serve
+func (s *server) checkScriptKeys(cmd common.Command) error {
+	if s.cluster == nil {
+		return nil
+	}
+	keys := routingKeys(cmd)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot, err := keysSlot(keys)
+	if err != nil || (s.runningScript.slot >= 0 && s.runningScript.slot != slot) {
+		return errScriptCrossSlot
+	}
+	if s.cluster.Owner(slot) != s.cluster.Myself {
+		return errScriptNonLocal
+	}
+	s.runningScript.slot = slot
+	return nil
+}
+
+func (s *server) handleASKING(c *connectedClient) (string, error) {
+	if s.cluster == nil {
+		return "", errClusterDisabled
+	}
+	c.asking = true
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) handleCLUSTER(args common.CommandArguments) (string, error) {
+	clusterArgs, ok := args.(common.CLUSTERArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid CLUSTER argments %v", args)
+	}
+	if s.cluster == nil {
+		return "", errClusterDisabled
+	}
+	state := s.cluster
+	switch clusterArgs.Subcommand {
+	case common.ClusterSubcommandINFO:
+		info := s.clusterInfo()
+		return resp.BulkString(&info), nil
+	case common.ClusterSubcommandMYID:
+		return resp.BulkString(&state.Myself.ID), nil
+	case common.ClusterSubcommandNODES:
+		nodes := state.NodesText()
+		return resp.BulkString(&nodes), nil
+	case common.ClusterSubcommandSLOTS:
+		return s.clusterSlots(), nil
+	case common.ClusterSubcommandSHARDS:
+		return s.clusterShards(), nil
+	case common.ClusterSubcommandKEYSLOT:
+		return resp.Integer(common.KeySlot(clusterArgs.Key)), nil
+	case common.ClusterSubcommandCOUNTKEYSINSLOT:
+		count := s.db.CountKeysInSlot(clusterArgs.Slots[0])
+		return resp.Integer(count), nil
+	case common.ClusterSubcommandGETKEYSINSLOT:
+		keys := s.db.KeysInSlot(clusterArgs.Slots[0], clusterArgs.Count)
+		elements := make([]interface{}, len(keys))
+		for i, key := range keys {
+			elements[i] = key
+		}
+		return resp.Array(elements), nil
+	case common.ClusterSubcommandADDSLOTS, common.ClusterSubcommandADDSLOTSRANGE:
+		return s.addSlots(clusterArgs.Slots)
+	case common.ClusterSubcommandDELSLOTS, common.ClusterSubcommandDELSLOTSRANGE:
+		return s.delSlots(clusterArgs.Slots)
+	case common.ClusterSubcommandSAVECONFIG:
+		if err := s.saveClusterConfig(); err != nil {
+			return "", err
+		}
+		return resp.SimpleString("OK"), nil
+	case common.ClusterSubcommandMEET:
+		return s.clusterMeet(clusterArgs.Host, clusterArgs.Port, clusterArgs.BusPort)
+	case common.ClusterSubcommandREPLICATE:
+		return s.clusterReplicate(clusterArgs.NodeID)
+	case common.ClusterSubcommandFAILOVER:
+		return s.clusterFailoverCMD(clusterArgs.Option)
+	case common.ClusterSubcommandSETSLOT:
+		return s.clusterSetSlot(clusterArgs.Slots[0], clusterArgs.Option, clusterArgs.NodeID)
+	case common.ClusterSubcommandCOUNTFAILUREREPORTS:
+		n, ok := state.Nodes[clusterArgs.NodeID]
+		if !ok {
+			return "", fmt.Errorf("ERR Unknown node %s", clusterArgs.NodeID)
+		}
+		return resp.Integer(n.FailureReports(millis(s.now()), clusterFailReportValidityMult*s.clusterNodeTimeout.Milliseconds())), nil
+	default:
+		return "-ERR", fmt.Errorf("unsupported CLUSTER subcommand %v", args)
+	}
+}
+
+// clusterReplicate turns this node into a replica of the master nodeID, a master must not have
+// slots nor keys
+func (s *server) clusterReplicate(nodeID string) (string, error) {
+	state := s.cluster
+	master, ok := state.Nodes[nodeID]
+	if !ok {
+		return "", fmt.Errorf("ERR Unknown node %s", nodeID)
+	}
+	if master == state.Myself {
+		return "", errors.New("ERR Can't replicate myself")
+	}
+	if !master.IsMaster() {
+		return "", errors.New("ERR I can only replicate a master, not a replica.")
+	}
+	if state.Myself.IsMaster() {
+		size := s.db.Len()
+		if state.CountSlots(state.Myself) > 0 || size > 0 {
+			return "", errors.New("ERR To set a master the node must be empty and without assigned slots.")
+		}
+	}
+	s.clusterSetMaster(master)
+	return resp.SimpleString("OK"), nil
+}
+
+// clusterSetSlot opens slot for a migration, closes it or assigns it to the node nodeID. The
+// importing node takes a new config epoch when the slot is assigned to it, so the other nodes
+// accept the new owner.
+func (s *server) clusterSetSlot(slot int, action string, nodeID string) (string, error) {
+	state := s.cluster
+	myself := state.Myself
+	if !myself.IsMaster() {
+		return "", errors.New("ERR Please use SETSLOT only with masters.")
+	}
+	var n *cluster.Node
+	if action != "STABLE" {
+		var ok bool
+		if n, ok = state.Nodes[nodeID]; !ok {
+			if action == "NODE" {
+				return "", fmt.Errorf("ERR Unknown node %s", nodeID)
+			}
+			return "", fmt.Errorf("ERR I don't know about node %s", nodeID)
+		}
+		if !n.IsMaster() {
+			return "", errors.New("ERR Target node is not a master")
+		}
+	}
+
+	switch action {
+	case "MIGRATING":
+		if state.Owner(slot) != myself {
+			return "", fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		state.SetMigrating(slot, n)
+	case "IMPORTING":
+		if state.Owner(slot) == myself {
+			return "", fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		state.SetImporting(slot, n)
+	case "STABLE":
+		state.SetMigrating(slot, nil)
+		state.SetImporting(slot, nil)
+	case "NODE":
+		if state.Owner(slot) == myself && n != myself {
+			count := s.db.CountKeysInSlot(slot)
+			if count > 0 {
+				return "", fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+			}
+		}
+		if n != myself {
+			state.SetMigrating(slot, nil)
+		}
+		if n == myself && state.Importing(slot) != nil {
+			state.SetImporting(slot, nil)
+			state.CurrentEpoch++
+			myself.ConfigEpoch = state.CurrentEpoch
+			log.Printf("slot %d imported, my config epoch is now %d", slot, myself.ConfigEpoch)
+		}
+		state.SetOwner(slot, n)
+	}
+	if err := s.saveClusterConfig(); err != nil {
+		return "", err
+	}
+	if action == "NODE" {
+		s.broadcast(state.NewMessage(cluster.MsgPong))
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+// addSlots assigns the unassigned slots to this node, none is assigned when one of them is not
+func (s *server) addSlots(slots []int) (string, error) {
+	state := s.cluster
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if state.Owner(slot) != nil {
+			return "", fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+		if seen[slot] {
+			return "", fmt.Errorf("ERR Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		state.SetOwner(slot, state.Myself)
+		state.SetImporting(slot, nil)
+	}
+	if err := s.saveClusterConfig(); err != nil {
+		return "", err
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+// delSlots unassigns the slots, none is unassigned when one of them is not assigned
+func (s *server) delSlots(slots []int) (string, error) {
+	state := s.cluster
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if state.Owner(slot) == nil {
+			return "", fmt.Errorf("ERR Slot %d is already unassigned", slot)
+		}
+		if seen[slot] {
+			return "", fmt.Errorf("ERR Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		state.SetOwner(slot, nil)
+		state.SetMigrating(slot, nil)
+		state.SetImporting(slot, nil)
+	}
+	if err := s.saveClusterConfig(); err != nil {
+		return "", err
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) clusterInfo() string {
+	state := s.cluster
+	status := "ok"
+	if !s.clusterOK() {
+		status = "fail"
+	}
+	myEpoch := state.Myself.ConfigEpoch
+	if master, ok := state.Nodes[state.Myself.MasterID]; ok {
+		myEpoch = master.ConfigEpoch
+	}
+	assigned := state.AssignedSlots()
+	pfail, fail := 0, 0
+	for _, master := range state.Masters() {
+		if master.Flags&cluster.FlagFail != 0 {
+			fail += state.CountSlots(master)
+		} else if master.Flags&cluster.FlagPFail != 0 {
+			pfail += state.CountSlots(master)
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("cluster_enabled:1\r\n")
+	sb.WriteString(fmt.Sprintf("cluster_state:%s\r\n", status))
+	sb.WriteString(fmt.Sprintf("cluster_slots_assigned:%d\r\n", assigned))
+	sb.WriteString(fmt.Sprintf("cluster_slots_ok:%d\r\n", assigned-pfail-fail))
+	sb.WriteString(fmt.Sprintf("cluster_slots_pfail:%d\r\n", pfail))
+	sb.WriteString(fmt.Sprintf("cluster_slots_fail:%d\r\n", fail))
+	sb.WriteString(fmt.Sprintf("cluster_known_nodes:%d\r\n", len(state.Nodes)))
+	sb.WriteString(fmt.Sprintf("cluster_size:%d\r\n", state.Size()))
+	sb.WriteString(fmt.Sprintf("cluster_current_epoch:%d\r\n", state.CurrentEpoch))
+	sb.WriteString(fmt.Sprintf("cluster_my_epoch:%d\r\n", myEpoch))
+	return sb.String()
+}
+
+// clusterSlots replies a slot range per element: start, end, the master and its replicas as
+// [ip, port, id]
+func (s *server) clusterSlots() string {
+	state := s.cluster
+	type slotRange struct {
+		cluster.SlotRange
+		master *cluster.Node
+	}
+	var ranges []slotRange
+	for _, master := range state.Masters() {
+		for _, r := range state.SlotRanges(master) {
+			ranges = append(ranges, slotRange{r, master})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	replies := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		reply := []string{resp.Integer(r.Start), resp.Integer(r.End), nodeAddrReply(r.master)}
+		for _, replica := range state.Replicas(r.master) {
+			reply = append(reply, nodeAddrReply(replica))
+		}
+		replies = append(replies, resp.RawArray(reply))
+	}
+	return resp.RawArray(replies)
+}
+
+func nodeAddrReply(n *cluster.Node) string {
+	return resp.Array([]interface{}{n.Host, n.Port, n.ID})
+}
+
+// clusterShards replies a shard per master: its slots and its nodes as name & value pairs
+func (s *server) clusterShards() string {
+	state := s.cluster
+	shards := make([]string, 0)
+	for _, master := range state.Masters() {
+		var slots []string
+		for _, r := range state.SlotRanges(master) {
+			slots = append(slots, resp.Integer(r.Start), resp.Integer(r.End))
+		}
+		nodes := []string{s.shardNodeReply(master)}
+		for _, replica := range state.Replicas(master) {
+			nodes = append(nodes, s.shardNodeReply(replica))
+		}
+		shards = append(shards, resp.RawArray([]string{
+			resp.BulkString(strPtr("slots")), resp.RawArray(slots),
+			resp.BulkString(strPtr("nodes")), resp.RawArray(nodes),
+		}))
+	}
+	return resp.RawArray(shards)
+}
+
+func (s *server) shardNodeReply(n *cluster.Node) string {
+	role, health := "master", "online"
+	if !n.IsMaster() {
+		role = "replica"
+	}
+	if n.Flags&cluster.FlagFail != 0 {
+		health = "failed"
+	}
+	offset := 0
+	if n == s.cluster.Myself {
+		offset = int(s.replOffset)
+	}
+	return resp.Array([]interface{}{
+		"id", n.ID,
+		"port", n.Port,
+		"ip", n.Host,
+		"endpoint", n.Host,
+		"role", role,
+		"replication-offset", offset,
+		"health", health,
+	})
+}
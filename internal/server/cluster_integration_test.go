@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/reshard"
+	"go.uber.org/goleak"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNode is a server started by startTestNode with a client connected to it
+type testNode struct {
+	rdb     *redis.Client
+	quit    chan bool
+	events  chan string
+	stopped bool
+}
+
+// startTestNode starts a server on port with opts, options configures its client when it is not nil
+func startTestNode(port uint, options *redis.Options, opts ...Option) *testNode {
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 32)
+	go Start(port, 10, ready, quit, events, opts...)
+	<-ready
+	if options == nil {
+		options = &redis.Options{}
+	}
+	options.Addr = fmt.Sprintf("localhost:%d", port)
+	return &testNode{rdb: redis.NewClient(options), quit: quit, events: events}
+}
+
+// stopTestNodes closes the clients of the nodes and shuts them down, the nodes already stopped are
+// skipped
+func stopTestNodes(t *testing.T, nodes ...*testNode) {
+	var running []*testNode
+	for _, n := range nodes {
+		if !n.stopped {
+			common.ExpectNoError(t, n.rdb.Close())
+			running = append(running, n)
+		}
+	}
+	for _, n := range running {
+		// the connections of the clients must be disconnected before the shutdown
+		for quiet := false; !quiet; {
+			select {
+			case <-n.events:
+			case <-time.After(200 * time.Millisecond):
+				quiet = true
+			}
+		}
+		n.quit <- true
+	}
+	for _, n := range running {
+		for event := range n.events {
+			if event == EventSuccessfulShutdown {
+				break
+			}
+		}
+		n.stopped = true
+	}
+}
+
+func TestCluster(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	ports := []uint{10_025, 10_026, 10_027}
+	ids := []string{
+		strings.Repeat("a", 40),
+		strings.Repeat("b", 40),
+		strings.Repeat("c", 40),
+	}
+	ranges := []string{"0-5460", "5461-10922", "10923-16383"}
+	owner := func(slot int) int {
+		switch {
+		case slot <= 5460:
+			return 0
+		case slot <= 10922:
+			return 1
+		}
+		return 2
+	}
+	// the slot of "moving" migrates from its owner to the next node
+	movingSlot := common.KeySlot("moving")
+	from := owner(movingSlot)
+	to := (from + 1) % len(ports)
+
+	nodesConf := func(myself int) string {
+		var sb strings.Builder
+		for i, id := range ids {
+			flags := "master"
+			if i == myself {
+				flags = "myself,master"
+			}
+			sb.WriteString(fmt.Sprintf("%s 127.0.0.1:%d@%d %s - 0 0 %d connected %s", id, ports[i],
+				ports[i]+clusterBusPortOffset, flags, i+1, ranges[i]))
+			if i == myself && i == from {
+				sb.WriteString(fmt.Sprintf(" [%d->-%s]", movingSlot, ids[to]))
+			}
+			if i == myself && i == to {
+				sb.WriteString(fmt.Sprintf(" [%d-<-%s]", movingSlot, ids[from]))
+			}
+			sb.WriteString("\n")
+		}
+		sb.WriteString("vars currentEpoch 3 lastVoteEpoch 0\n")
+		return sb.String()
+	}
+
+	nodes := make([]*testNode, len(ports))
+	dirs := make([]string, len(ports))
+	for i, port := range ports {
+		dir := t.TempDir()
+		dirs[i] = dir
+		common.ExpectNoError(t, os.WriteFile(filepath.Join(dir, "nodes.conf"), []byte(nodesConf(i)), 0644))
+		nodes[i] = startTestNode(port, nil, WithRDB(dir, ""), WithCluster("nodes.conf"))
+	}
+	defer stopTestNodes(t, nodes...)
+
+	info, err := nodes[0].rdb.Do(ctx, "CLUSTER", "INFO").Text()
+	common.ExpectNoError(t, err)
+	for _, want := range []string{"cluster_state:ok", "cluster_slots_assigned:16384", "cluster_known_nodes:3", "cluster_size:3"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("want %s in CLUSTER INFO %q", want, info)
+		}
+	}
+	myID, err := nodes[1].rdb.Do(ctx, "CLUSTER", "MYID").Text()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, myID, ids[1])
+
+	// PUBLISH reaches the subscribers of the other nodes through the cluster bus, the reply counts
+	// the local ones
+	sub := nodes[2].rdb.Subscribe(ctx, "news")
+	_, err = sub.Receive(ctx)
+	common.ExpectNoError(t, err)
+	receivers, err := nodes[0].rdb.Publish(ctx, "news", "hello").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, receivers, int64(0))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	msg, err := sub.ReceiveMessage(timeoutCtx)
+	cancel()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, msg.Channel, "news")
+	common.AssertEquals(t, msg.Payload, "hello")
+	common.ExpectNoError(t, sub.Close())
+
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{fmt.Sprintf("localhost:%d", ports[0])}})
+	keys := []string{"a", "b", "c", "d", "e", "f", "moving"}
+	for _, key := range keys {
+		common.ExpectNoError(t, clusterClient.Set(ctx, key, "value of "+key, 0).Err())
+	}
+	for _, key := range keys {
+		common.AssertEquals(t, clusterClient.Get(ctx, key).Val(), "value of "+key)
+	}
+	common.ExpectNoError(t, clusterClient.Close())
+
+	// "moving" was written to the importing node after ASK redirects
+	ask := nodes[from].rdb.Get(ctx, "moving").Err()
+	common.AssertEquals(t, fmt.Sprint(ask), fmt.Sprintf("ASK %d 127.0.0.1:%d", movingSlot, ports[to]))
+	moved := nodes[to].rdb.Get(ctx, "moving").Err()
+	common.AssertEquals(t, fmt.Sprint(moved), fmt.Sprintf("MOVED %d 127.0.0.1:%d", movingSlot, ports[from]))
+	conn := nodes[to].rdb.Conn(ctx)
+	common.ExpectNoError(t, conn.Process(ctx, redis.NewStatusCmd(ctx, "ASKING")))
+	common.AssertEquals(t, conn.Get(ctx, "moving").Val(), "value of moving")
+	common.ExpectNoError(t, conn.Close())
+
+	slot := common.KeySlot("a")
+	other := (owner(slot) + 1) % len(ports)
+	moved = nodes[other].rdb.Get(ctx, "a").Err()
+	common.AssertEquals(t, fmt.Sprint(moved), fmt.Sprintf("MOVED %d 127.0.0.1:%d", slot, ports[owner(slot)]))
+	crossSlot := nodes[owner(slot)].rdb.Del(ctx, "a", "b").Err()
+	common.AssertEquals(t, fmt.Sprint(crossSlot), errCrossSlot.Error())
+
+	keySlot, err := nodes[0].rdb.Do(ctx, "CLUSTER", "KEYSLOT", "a").Int()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, keySlot, slot)
+	count, err := nodes[owner(slot)].rdb.Do(ctx, "CLUSTER", "COUNTKEYSINSLOT", slot).Int()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, count, 1)
+	inSlot, err := nodes[owner(slot)].rdb.Do(ctx, "CLUSTER", "GETKEYSINSLOT", slot, 10).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(inSlot), "[a]")
+
+	// the slots given up are saved to nodes.conf
+	last := nodes[2].rdb
+	common.ExpectNoError(t, last.Do(ctx, "CLUSTER", "DELSLOTSRANGE", 16000, 16383).Err())
+	saved, err := os.ReadFile(filepath.Join(dirs[2], "nodes.conf"))
+	common.ExpectNoError(t, err)
+	if !strings.Contains(string(saved), "myself,master - 0 0 3 connected 10923-15999 ") {
+		t.Errorf("want the slots 10923-15999 in nodes.conf %q", saved)
+	}
+	info, err = last.Do(ctx, "CLUSTER", "INFO").Text()
+	common.ExpectNoError(t, err)
+	if !strings.Contains(info, "cluster_state:fail") {
+		t.Errorf("want cluster_state:fail in CLUSTER INFO %q", info)
+	}
+	if err := last.Get(ctx, "a").Err(); err == nil || !strings.HasPrefix(err.Error(), "CLUSTERDOWN") {
+		t.Errorf("want CLUSTERDOWN error, got %v", err)
+	}
+	err = last.Do(ctx, "CLUSTER", "ADDSLOTS", 16000, 16000).Err()
+	common.AssertEquals(t, fmt.Sprint(err), "ERR Slot 16000 specified multiple times")
+	common.ExpectNoError(t, last.Do(ctx, "CLUSTER", "ADDSLOTSRANGE", 16000, 16383).Err())
+	slots, err := last.Do(ctx, "CLUSTER", "SLOTS").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, len(slots.([]interface{})), 3)
+	nodesText, err := last.Do(ctx, "CLUSTER", "NODES").Text()
+	common.ExpectNoError(t, err)
+	if !strings.Contains(nodesText, ids[2]+" 127.0.0.1:10027@20027 myself,master - 0 0 3 connected 10923-16383") {
+		t.Errorf("unexpected CLUSTER NODES %q", nodesText)
+	}
+	common.AssertEquals(t, fmt.Sprint(last.Do(ctx, "HELLO").Val().([]interface{})[8:12]), "[mode cluster role master]")
+}
+
+func TestClusterFailover(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	ports := []uint{10_028, 10_029, 10_030, 10_031}
+	ranges := [][]interface{}{{0, 5460}, {5461, 10922}, {10923, 16383}}
+
+	nodes := make([]*testNode, len(ports))
+	for i, port := range ports {
+		nodes[i] = startTestNode(port, nil, WithRDB(t.TempDir(), ""), WithCluster("nodes.conf"),
+			WithClusterNodeTimeout(500*time.Millisecond))
+	}
+	defer stopTestNodes(t, nodes...)
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+		}
+	}
+	infoContains := func(n *testNode, want ...string) bool {
+		info, err := n.rdb.Do(ctx, "CLUSTER", "INFO").Text()
+		if err != nil {
+			return false
+		}
+		for _, w := range want {
+			if !strings.Contains(info, w) {
+				return false
+			}
+		}
+		return true
+	}
+	role := func(n *testNode) string {
+		r, err := n.rdb.Do(ctx, "ROLE").Result()
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprint(r)
+	}
+
+	a, b, c, d := nodes[0], nodes[1], nodes[2], nodes[3]
+	for i, r := range ranges {
+		common.ExpectNoError(t, nodes[i].rdb.Do(ctx, "CLUSTER", "ADDSLOTSRANGE", r[0], r[1]).Err())
+	}
+	for _, port := range ports[1:] {
+		common.ExpectNoError(t, a.rdb.Do(ctx, "CLUSTER", "MEET", "127.0.0.1", port).Err())
+	}
+	for i, n := range nodes {
+		waitFor(fmt.Sprintf("node %d to join the cluster", i), func() bool {
+			return infoContains(n, "cluster_known_nodes:4", "cluster_state:ok", "cluster_size:3")
+		})
+	}
+
+	idA, err := a.rdb.Do(ctx, "CLUSTER", "MYID").Text()
+	common.ExpectNoError(t, err)
+	err = a.rdb.Do(ctx, "CLUSTER", "REPLICATE", idA).Err()
+	common.AssertEquals(t, fmt.Sprint(err), "ERR Can't replicate myself")
+	err = d.rdb.Do(ctx, "CLUSTER", "FAILOVER").Err()
+	common.AssertEquals(t, fmt.Sprint(err), errFailoverNotReplica.Error())
+	common.ExpectNoError(t, d.rdb.Do(ctx, "CLUSTER", "REPLICATE", idA).Err())
+	waitFor("D to replicate A", func() bool {
+		return strings.HasPrefix(role(d), "[slave 127.0.0.1 10028 connected")
+	})
+	common.AssertEquals(t, fmt.Sprint(d.rdb.Do(ctx, "HELLO").Val().([]interface{})[8:12]), "[mode cluster role replica]")
+	common.AssertEquals(t, fmt.Sprint(a.rdb.Do(ctx, "HELLO").Val().([]interface{})[8:12]), "[mode cluster role master]")
+
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{fmt.Sprintf("localhost:%d", ports[1])}})
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, key := range keys {
+		common.ExpectNoError(t, clusterClient.Set(ctx, key, "value of "+key, 0).Err())
+	}
+	common.ExpectNoError(t, clusterClient.Close())
+
+	// the manual failover swaps the roles of A & D
+	common.ExpectNoError(t, d.rdb.Do(ctx, "CLUSTER", "FAILOVER").Err())
+	waitFor("D to be promoted by the manual failover", func() bool {
+		return strings.HasPrefix(role(d), "[master") && strings.HasPrefix(role(a), "[slave 127.0.0.1 10031")
+	})
+	key := keys[0]
+	for _, k := range keys {
+		if common.KeySlot(k) <= 5460 {
+			key = k
+		}
+	}
+	waitFor("B to learn the new master", func() bool {
+		err := b.rdb.Get(ctx, key).Err()
+		return fmt.Sprint(err) == fmt.Sprintf("MOVED %d 127.0.0.1:10031", common.KeySlot(key))
+	})
+	waitFor("A to be in sync with D", func() bool {
+		return strings.HasPrefix(role(a), "[slave 127.0.0.1 10031 connected")
+	})
+
+	// A replaces D once the masters agree it is failing
+	stopTestNodes(t, d)
+	waitFor("A to be promoted by the failover", func() bool {
+		return strings.HasPrefix(role(a), "[master") && infoContains(b, "cluster_state:ok") &&
+			infoContains(c, "cluster_state:ok")
+	})
+	reports, err := b.rdb.Do(ctx, "CLUSTER", "NODES").Text()
+	common.ExpectNoError(t, err)
+	if !strings.Contains(reports, "fail") {
+		t.Errorf("want D flagged failing in CLUSTER NODES %q", reports)
+	}
+	clusterClient = redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{fmt.Sprintf("localhost:%d", ports[2])}})
+	for _, key := range keys {
+		common.AssertEquals(t, clusterClient.Get(ctx, key).Val(), "value of "+key)
+	}
+	common.ExpectNoError(t, clusterClient.Close())
+}
+
+func TestClusterReshard(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	ports := []uint{10_032, 10_033, 10_034}
+	ranges := [][]interface{}{{0, 5460}, {5461, 10922}, {10923, 16383}}
+
+	nodes := make([]*testNode, len(ports))
+	for i, port := range ports {
+		nodes[i] = startTestNode(port, nil, WithRDB(t.TempDir(), ""), WithCluster("nodes.conf"),
+			WithClusterNodeTimeout(500*time.Millisecond))
+	}
+	defer stopTestNodes(t, nodes...)
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+		}
+	}
+
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	for i, r := range ranges {
+		common.ExpectNoError(t, nodes[i].rdb.Do(ctx, "CLUSTER", "ADDSLOTSRANGE", r[0], r[1]).Err())
+	}
+	for _, port := range ports[1:] {
+		common.ExpectNoError(t, a.rdb.Do(ctx, "CLUSTER", "MEET", "127.0.0.1", port).Err())
+	}
+	for i, n := range nodes {
+		waitFor(fmt.Sprintf("node %d to join the cluster", i), func() bool {
+			info, err := n.rdb.Do(ctx, "CLUSTER", "INFO").Text()
+			return err == nil && strings.Contains(info, "cluster_known_nodes:3") && strings.Contains(info, "cluster_state:ok")
+		})
+	}
+
+	// the keys of two slots of A are moved to B, a hash tag puts them in the same slot
+	var tags []string
+	for i := 0; len(tags) < 2; i++ {
+		if tag := fmt.Sprintf("{tag%d}", i); common.KeySlot(tag) <= 5460 {
+			tags = append(tags, tag)
+		}
+	}
+	var stable []string
+	for i := 0; len(stable) < 2; i++ {
+		key := fmt.Sprintf("stable%d", i)
+		if slot := common.KeySlot(key); slot <= 5460 && slot != common.KeySlot(tags[0]) && slot != common.KeySlot(tags[1]) {
+			stable = append(stable, key)
+		}
+	}
+	key, missing := stable[0], stable[1]
+
+	// DUMP & RESTORE
+	common.ExpectNoError(t, a.rdb.Set(ctx, key, "value", 0).Err())
+	payload, err := a.rdb.Dump(ctx, key).Result()
+	common.ExpectNoError(t, err)
+	err = a.rdb.Restore(ctx, key, 0, payload).Err()
+	common.AssertEquals(t, fmt.Sprint(err), errBusyKey.Error())
+	common.ExpectNoError(t, a.rdb.RestoreReplace(ctx, key, 0, payload).Err())
+	common.AssertEquals(t, a.rdb.Get(ctx, key).Val(), "value")
+	err = a.rdb.RestoreReplace(ctx, key, 0, "corrupted").Err()
+	common.AssertEquals(t, fmt.Sprint(err), "ERR DUMP payload version or checksum are wrong")
+	// a valid checksum with a string length of 2^62 bytes is rejected without allocating it
+	oversized := []byte{0, 0x81, 0x40, 0, 0, 0, 0, 0, 0, 0, rdb.Version, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(oversized[12:], rdb.CRC64(0, oversized[:12]))
+	err = a.rdb.RestoreReplace(ctx, key, 0, string(oversized)).Err()
+	common.AssertEquals(t, fmt.Sprint(err), rdb.ErrDumpType.Error())
+	err = a.rdb.Restore(ctx, missing, time.Minute, payload).Err()
+	common.AssertEquals(t, fmt.Sprint(err), errRestoreTTL.Error())
+
+	// MIGRATE of a missing key and of a key of a slot B does not import
+	common.AssertEquals(t, a.rdb.Migrate(ctx, "127.0.0.1", "10033", missing, 0, time.Second).Val(), "NOKEY")
+	err = a.rdb.Do(ctx, "MIGRATE", "127.0.0.1", 10033, key, 0, 1000, "COPY").Err()
+	common.AssertEquals(t, fmt.Sprint(err), fmt.Sprintf("ERR Target instance replied with error: MOVED %d 127.0.0.1:10032", common.KeySlot(key)))
+	common.AssertEquals(t, a.rdb.Get(ctx, key).Val(), "value")
+
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{fmt.Sprintf("localhost:%d", ports[2])}})
+	defer func() { common.ExpectNoError(t, clusterClient.Close()) }()
+	var keys []string
+	written := make(map[string]string)
+	for _, tag := range tags {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("%s:%d", tag, i)
+			keys = append(keys, key)
+			written[key] = "0"
+			common.ExpectNoError(t, clusterClient.Set(ctx, key, "0", 0).Err())
+		}
+	}
+
+	// a client keeps updating the keys, and adding new ones, during the resharding
+	stopWriter := make(chan bool)
+	writerDone := make(chan error, 1)
+	go func() {
+		for round := 1; ; round++ {
+			select {
+			case <-stopWriter:
+				writerDone <- nil
+				return
+			default:
+			}
+			for i, key := range append(keys, fmt.Sprintf("%s:new%d", tags[round%2], round)) {
+				if i%7 != round%7 && !strings.Contains(key, "new") {
+					continue
+				}
+				value := fmt.Sprint(round)
+				if err := clusterClient.Set(ctx, key, value, 0).Err(); err != nil {
+					writerDone <- fmt.Errorf("SET %s: %v", key, err)
+					return
+				}
+				written[key] = value
+				if got, err := clusterClient.Get(ctx, key).Result(); err != nil || got != value {
+					writerDone <- fmt.Errorf("GET %s = %q, %v want %q", key, got, err, value)
+					return
+				}
+			}
+		}
+	}()
+
+	slots := []int{common.KeySlot(tags[0]), common.KeySlot(tags[1])}
+	err = reshard.Reshard("127.0.0.1:10032", "127.0.0.1:10033", slots, reshard.Options{Batch: 7, Timeout: 5 * time.Second})
+	time.Sleep(200 * time.Millisecond)
+	close(stopWriter)
+	common.ExpectNoError(t, <-writerDone)
+	common.ExpectNoError(t, err)
+
+	for _, slot := range slots {
+		common.AssertEquals(t, a.rdb.Do(ctx, "CLUSTER", "COUNTKEYSINSLOT", slot).Val(), int64(0))
+		waitFor(fmt.Sprintf("C to learn the new owner of slot %d", slot), func() bool {
+			key := keys[0]
+			if slot != common.KeySlot(key) {
+				key = keys[len(keys)-1]
+			}
+			err := c.rdb.Get(ctx, key).Err()
+			return fmt.Sprint(err) == fmt.Sprintf("MOVED %d 127.0.0.1:10033", slot)
+		})
+	}
+	count := int64(0)
+	for _, slot := range slots {
+		n, err := b.rdb.Do(ctx, "CLUSTER", "COUNTKEYSINSLOT", slot).Int64()
+		common.ExpectNoError(t, err)
+		count += n
+	}
+	common.AssertEquals(t, count, int64(len(written)))
+	for key, value := range written {
+		common.AssertEquals(t, clusterClient.Get(ctx, key).Val(), value)
+	}
+	nodesText, err := b.rdb.Do(ctx, "CLUSTER", "NODES").Text()
+	common.ExpectNoError(t, err)
+	if strings.Contains(nodesText, "->-") || strings.Contains(nodesText, "-<-") {
+		t.Errorf("want the slots closed in CLUSTER NODES %q", nodesText)
+	}
+}
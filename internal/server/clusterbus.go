@@ -0,0 +1,469 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/cluster"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultClusterNodeTimeout = 15 * time.Second
+	// clusterGossipCount is the number of nodes described in the gossip section of pings & pongs
+	clusterGossipCount = 3
+	// the failure reports are valid for clusterFailReportValidityMult node timeouts, a node flagged
+	// FAIL that answers is cleared after clusterFailUndoTimeMult node timeouts
+	clusterFailReportValidityMult = 2
+	clusterFailUndoTimeMult       = 2
+	// clusterLinkBufferSize is the number of messages queued per link, the next ones are dropped
+	clusterLinkBufferSize = 64
+	// clusterDialTimeout bounds the connection of a link, the shutdown waits for it
+	clusterDialTimeout = time.Second
+)
+
+// WithClusterNodeTimeout sets how long a node can be unreachable before it is considered failing
+func WithClusterNodeTimeout(timeout time.Duration) Option {
+	return func(s *server) {
+		if timeout <= 0 {
+			log.Fatalf("ERR invalid cluster node timeout %v", timeout)
+		}
+		s.clusterNodeTimeout = timeout
+	}
+}
+
+// startClusterBus listens to the cluster bus port. Every node has an outbound link to every other
+// node, the server loop replies to a message through its outbound link to the sender.
+func (s *server) startClusterBus() error {
+	if s.cluster == nil {
+		return nil
+	}
+	bus, err := listenBus("cluster bus", s.cluster.Myself.BusPort, s.clusterNodeTimeout,
+		func(r *bufio.Reader) (interface{}, error) {
+			return cluster.ReadMessage(r)
+		},
+		func(w io.Writer, m interface{}) error {
+			return cluster.WriteMessage(w, m.(*cluster.Message))
+		})
+	if err != nil {
+		return err
+	}
+	s.bus = bus
+	return nil
+}
+
+// stopClusterBus closes the listener & the connections and waits for their goroutines
+func (s *server) stopClusterBus() {
+	if s.bus == nil {
+		return
+	}
+	s.bus.stop()
+	s.bus = nil
+}
+
+// busEvents returns the channel of the bus goroutines, nil when there is no bus
+func (s *server) busEvents() <-chan busEvent {
+	if s.bus == nil {
+		return nil
+	}
+	return s.bus.events
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// sendTo queues m to the node n, the message is dropped when the link is full
+func (s *server) sendTo(n *cluster.Node, m *cluster.Message) {
+	if s.bus == nil {
+		return
+	}
+	s.bus.queue(n.ID, net.JoinHostPort(n.Host, strconv.Itoa(n.BusPort)), m)
+}
+
+// broadcast sends m to every node but the ones in handshake
+func (s *server) broadcast(m *cluster.Message) {
+	for _, n := range s.cluster.Nodes {
+		if n != s.cluster.Myself && n.Flags&cluster.FlagHandshake == 0 {
+			s.sendTo(n, m)
+		}
+	}
+}
+
+// broadcastPublish sends a message published on this node to the other nodes, like redis every
+// subscriber of the cluster receives it. It is dropped for the nodes whose link is full.
+func (s *server) broadcastPublish(channel, message string) {
+	m := s.cluster.NewMessage(cluster.MsgPublish)
+	m.ReplOffset = s.replOffset
+	m.Channel, m.Payload = channel, message
+	s.broadcast(m)
+}
+
+// newBusMessage returns a message describing this node to n
+func (s *server) newBusMessage(t cluster.MessageType, n *cluster.Node) *cluster.Message {
+	m := s.cluster.NewMessage(t)
+	m.ReplOffset = s.replOffset
+	if s.clientsPaused() && s.pausedFor == n.ID {
+		m.MFlags |= cluster.MsgFlagPaused
+	}
+	return m
+}
+
+// sendPing sends a ping, a meet or a pong with gossip to n
+func (s *server) sendPing(n *cluster.Node, t cluster.MessageType) {
+	m := s.newBusMessage(t, n)
+	m.Gossip = s.cluster.GossipFor(n, clusterGossipCount)
+	if t != cluster.MsgPong && n.PingSent == 0 {
+		n.PingSent = millis(s.now())
+	}
+	s.sendTo(n, m)
+}
+
+func (s *server) handleBusEvent(e busEvent) {
+	if e.err != nil {
+		if s.bus.linkFailed(e.link) {
+			if n, ok := s.cluster.Nodes[e.link.id]; ok {
+				n.Connected = false
+			}
+		}
+		return
+	}
+	s.handleBusMessage(e.msg.(*cluster.Message), e.host)
+}
+
+// handleBusMessage updates the configuration with what the sender of m says about itself and
+// about the other nodes
+func (s *server) handleBusMessage(m *cluster.Message, host string) {
+	state := s.cluster
+	now := millis(s.now())
+	dirty := false
+	if m.Host != "" {
+		host = m.Host
+	}
+
+	sender := state.Nodes[m.Sender]
+	if sender == state.Myself {
+		return
+	}
+	if sender == nil {
+		sender = s.unknownSender(m, host)
+		if sender == nil {
+			return
+		}
+		dirty = true
+	}
+	if m.CurrentEpoch > state.CurrentEpoch {
+		state.CurrentEpoch = m.CurrentEpoch
+		dirty = true
+	}
+	sender.ReplOffset = m.ReplOffset
+
+	switch m.Type {
+	case cluster.MsgPing, cluster.MsgMeet:
+		s.sendPing(sender, cluster.MsgPong)
+	case cluster.MsgPong:
+		sender.PongReceived, sender.PingSent, sender.Connected = now, 0, true
+		if s.clearFailure(sender, now) {
+			dirty = true
+		}
+	case cluster.MsgFail:
+		if failing, ok := state.Nodes[m.FailID]; ok && failing != state.Myself && failing.Flags&cluster.FlagFail == 0 {
+			log.Printf("FAIL message received from %s about %s", sender.ID, failing.ID)
+			failing.Flags = failing.Flags&^cluster.FlagPFail | cluster.FlagFail
+			failing.FailTime = now
+			dirty = true
+		}
+	case cluster.MsgAuthRequest:
+		s.voteFailover(sender, m)
+	case cluster.MsgAuthAck:
+		s.countFailoverVote(sender, m)
+	case cluster.MsgMFStart:
+		// the replica can ask before the gossip told this master about it
+		if s.updateSenderRole(sender, m) {
+			dirty = true
+		}
+		s.pauseForManualFailover(sender)
+	case cluster.MsgPublish:
+		s.publish(m.Channel, m.Payload)
+	}
+
+	switch m.Type {
+	case cluster.MsgPing, cluster.MsgPong, cluster.MsgMeet:
+		if s.updateSenderRole(sender, m) {
+			dirty = true
+		}
+		if sender.IsMaster() && s.updateSlots(sender, m) {
+			dirty = true
+		}
+		if s.processGossip(sender, m, now) {
+			dirty = true
+		}
+		if m.MFlags&cluster.MsgFlagPaused != 0 && sender.ID == state.Myself.MasterID {
+			s.masterPaused(m.ReplOffset)
+		}
+	}
+	if dirty {
+		_ = s.saveClusterConfig()
+	}
+}
+
+// unknownSender adds the sender of a meet, or of the pong answering a meet of CLUSTER MEET, the
+// messages of the rest of the unknown nodes are ignored
+func (s *server) unknownSender(m *cluster.Message, host string) *cluster.Node {
+	state := s.cluster
+	switch m.Type {
+	case cluster.MsgMeet:
+	case cluster.MsgPong:
+		handshake := s.handshakeNode(host, m.Port)
+		if handshake == nil {
+			return nil
+		}
+		s.bus.closeLink(handshake.ID)
+		state.RemoveNode(handshake)
+	default:
+		return nil
+	}
+	n := &cluster.Node{
+		ID:      m.Sender,
+		Host:    host,
+		Port:    m.Port,
+		BusPort: m.BusPort,
+		Flags:   m.Flags & (cluster.FlagMaster | cluster.FlagReplica),
+	}
+	state.AddNode(n)
+	log.Printf("node %s at %s added to the cluster", n.ID, n.Addr())
+	return n
+}
+
+func (s *server) handshakeNode(host string, port int) *cluster.Node {
+	for _, n := range s.cluster.Nodes {
+		if n.Flags&cluster.FlagHandshake != 0 && n.Host == host && n.Port == port {
+			return n
+		}
+	}
+	return nil
+}
+
+// clearFailure clears the PFAIL flag of a node that answered, and its FAIL flag when no failover
+// is expected: it is a replica, a master without slots, or nobody replaced it for a while
+func (s *server) clearFailure(n *cluster.Node, now int64) bool {
+	if n.Flags&cluster.FlagPFail != 0 {
+		n.Flags &^= cluster.FlagPFail
+		return true
+	}
+	if n.Flags&cluster.FlagFail == 0 {
+		return false
+	}
+	undoTime := clusterFailUndoTimeMult * s.clusterNodeTimeout.Milliseconds()
+	if !n.IsMaster() || s.cluster.CountSlots(n) == 0 || now-n.FailTime > undoTime {
+		log.Printf("clear FAIL state for node %s: it is reachable again", n.ID)
+		n.Flags &^= cluster.FlagFail
+		return true
+	}
+	return false
+}
+
+// updateSenderRole records the master of the sender, a master turning into a replica loses its
+// slots to the masters claiming them
+func (s *server) updateSenderRole(sender *cluster.Node, m *cluster.Message) bool {
+	if m.MasterID == "" {
+		if sender.IsMaster() {
+			return false
+		}
+		log.Printf("node %s is now a master", sender.ID)
+		sender.Flags = sender.Flags&^cluster.FlagReplica | cluster.FlagMaster
+		sender.MasterID = ""
+		return true
+	}
+	if sender.IsMaster() {
+		log.Printf("node %s is now a replica of %s", sender.ID, m.MasterID)
+		s.cluster.DelNodeSlots(sender)
+		sender.Flags = sender.Flags&^cluster.FlagMaster | cluster.FlagReplica
+	} else if sender.MasterID == m.MasterID {
+		return false
+	}
+	sender.MasterID = m.MasterID
+	return true
+}
+
+// updateSlots assigns to the master sender the slots it claims with a greater config epoch than
+// their owner. When this node, or its master, lost its last slot to the sender it becomes a
+// replica of the sender.
+func (s *server) updateSlots(sender *cluster.Node, m *cluster.Message) bool {
+	state := s.cluster
+	myself := state.Myself
+	dirty := false
+	if sender.ConfigEpoch != m.ConfigEpoch {
+		sender.ConfigEpoch = m.ConfigEpoch
+		dirty = true
+	}
+	myMaster := myself
+	if !myself.IsMaster() {
+		myMaster = state.Nodes[myself.MasterID]
+	}
+	lost := 0
+	for slot := 0; slot < len(m.Slots)*8; slot++ {
+		if !m.Slots.Has(slot) {
+			continue
+		}
+		owner := state.Owner(slot)
+		if owner == sender || state.Importing(slot) != nil {
+			continue
+		}
+		if owner == nil || owner.ConfigEpoch < m.ConfigEpoch {
+			if owner != nil && owner == myMaster {
+				lost++
+			}
+			state.SetOwner(slot, sender)
+			dirty = true
+		}
+	}
+	if lost > 0 && myMaster != nil && state.CountSlots(myMaster) == 0 {
+		log.Printf("configuration change detected, reconfiguring myself as a replica of %s", sender.ID)
+		s.clusterSetMaster(sender)
+	}
+	if sender.IsMaster() && myself.IsMaster() && sender.ConfigEpoch == myself.ConfigEpoch && sender.ID > myself.ID {
+		// the node with the smaller ID takes a new epoch, so every master has its own
+		state.CurrentEpoch++
+		myself.ConfigEpoch = state.CurrentEpoch
+		log.Printf("config epoch collision with node %s, my config epoch is now %d", sender.ID, myself.ConfigEpoch)
+		dirty = true
+	}
+	return dirty
+}
+
+// processGossip adds the nodes the sender knows about and records the failure reports of masters
+func (s *server) processGossip(sender *cluster.Node, m *cluster.Message, now int64) bool {
+	state := s.cluster
+	dirty := false
+	for _, g := range m.Gossip {
+		if g.ID == state.Myself.ID {
+			continue
+		}
+		n, ok := state.Nodes[g.ID]
+		if !ok {
+			if g.Flags&(cluster.FlagHandshake|cluster.FlagNoAddr) == 0 && s.handshakeNode(g.Host, g.Port) == nil {
+				n = &cluster.Node{ID: g.ID, Host: g.Host, Port: g.Port, BusPort: g.BusPort,
+					Flags: g.Flags & (cluster.FlagMaster | cluster.FlagReplica)}
+				state.AddNode(n)
+				log.Printf("node %s at %s learned from %s", n.ID, n.Addr(), sender.ID)
+				dirty = true
+			}
+			continue
+		}
+		if !sender.IsMaster() {
+			continue
+		}
+		if g.Flags&(cluster.FlagPFail|cluster.FlagFail) != 0 {
+			n.AddFailureReport(sender.ID, now)
+			if s.markFailing(n, now) {
+				dirty = true
+			}
+		} else {
+			n.RemoveFailureReport(sender.ID)
+		}
+	}
+	return dirty
+}
+
+// markFailing flags FAIL a node flagged PFAIL by the majority of the masters and tells it to
+// every node
+func (s *server) markFailing(n *cluster.Node, now int64) bool {
+	state := s.cluster
+	if n.Flags&cluster.FlagPFail == 0 || n.Flags&cluster.FlagFail != 0 {
+		return false
+	}
+	reports := n.FailureReports(now, clusterFailReportValidityMult*s.clusterNodeTimeout.Milliseconds())
+	if state.Myself.IsMaster() {
+		reports++
+	}
+	if reports < state.Size()/2+1 {
+		return false
+	}
+	log.Printf("marking node %s as failing (quorum reached)", n.ID)
+	n.Flags = n.Flags&^cluster.FlagPFail | cluster.FlagFail
+	n.FailTime = now
+	m := s.cluster.NewMessage(cluster.MsgFail)
+	m.FailID = n.ID
+	s.broadcast(m)
+	return true
+}
+
+// clusterCron pings the nodes, flags PFAIL the ones not answering within the node timeout, and
+// runs the failovers
+func (s *server) clusterCron() {
+	if s.cluster == nil || s.bus == nil {
+		return
+	}
+	state := s.cluster
+	now := millis(s.now())
+	timeout := s.clusterNodeTimeout.Milliseconds()
+	pingPeriod := timeout / 2
+	if pingPeriod > 1000 {
+		pingPeriod = 1000
+	}
+	dirty := false
+	for _, n := range state.Nodes {
+		if n == state.Myself {
+			continue
+		}
+		// the links failing are connected again with a ping
+		_, linked := s.bus.links[n.ID]
+		if n.Flags&cluster.FlagHandshake != 0 {
+			if now-n.PongReceived > timeout {
+				log.Printf("handshake with node %s timed out", n.Addr())
+				s.bus.closeLink(n.ID)
+				state.RemoveNode(n)
+			} else if !linked {
+				s.sendPing(n, cluster.MsgMeet)
+			}
+			continue
+		}
+		if !linked || (n.PingSent == 0 && now-n.PongReceived > pingPeriod) {
+			// the nodes learned from gossip may not know this node yet, they are met until they answer
+			t := cluster.MsgPing
+			if n.PongReceived == 0 {
+				t = cluster.MsgMeet
+			}
+			s.sendPing(n, t)
+		}
+		if n.PingSent != 0 && now-n.PingSent > timeout && n.Flags&(cluster.FlagPFail|cluster.FlagFail) == 0 {
+			log.Printf("node %s is possibly failing", n.ID)
+			n.Flags |= cluster.FlagPFail
+			dirty = true
+		}
+	}
+	for _, n := range state.Nodes {
+		if s.markFailing(n, now) {
+			dirty = true
+		}
+	}
+	if dirty {
+		_ = s.saveClusterConfig()
+	}
+	s.failoverCron()
+}
+
+// clusterMeet starts a handshake with the node at host:port, it is added once it answers
+func (s *server) clusterMeet(host string, port int, busPort int) (string, error) {
+	if net.ParseIP(host) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return "", fmt.Errorf("ERR Invalid node address specified: %s:%d", host, port)
+	}
+	if s.handshakeNode(host, port) == nil {
+		n := &cluster.Node{
+			ID:           cluster.NewNodeID(),
+			Host:         host,
+			Port:         port,
+			BusPort:      busPort,
+			Flags:        cluster.FlagHandshake,
+			PongReceived: millis(s.now()),
+		}
+		s.cluster.AddNode(n)
+		s.sendPing(n, cluster.MsgMeet)
+	}
+	return resp.SimpleString("OK"), nil
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/cluster"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// clusterManualFailoverTimeout bounds a manual failover, the master pauses the writes of its
+	// clients for twice as long
+	clusterManualFailoverTimeout   = 5 * time.Second
+	clusterManualFailoverPauseMult = 2
+	// clusterMinAuthTimeout is the minimum time the replica waits for the votes of an election
+	clusterMinAuthTimeout = 2 * time.Second
+)
+
+var (
+	errFailoverNotReplica = errors.New("ERR You should send CLUSTER FAILOVER to a replica")
+	errFailoverNoMaster   = errors.New("ERR I'm a replica but my master is unknown to me")
+	errFailoverMasterDown = errors.New("ERR Master is down or failed, please use CLUSTER FAILOVER FORCE")
+)
+
+// clusterFailover is the election of a replica replacing its master, because the master is failing
+// or because of CLUSTER FAILOVER
+type clusterFailover struct {
+	// authTime is when the election starts, zero when none is scheduled
+	authTime time.Time
+	// authSent is set once the votes of the masters were requested for authEpoch, authCount is the
+	// number of votes received
+	authSent  bool
+	authEpoch uint64
+	authCount int
+	// manualEnd is the deadline of a manual failover, zero when none is in progress. Its election
+	// starts once the replica processed the stream of its paused master up to manualOffset, right
+	// away when forced.
+	manualEnd    time.Time
+	manualOffset int64
+	forced       bool
+}
+
+// failoverCron runs the election of a replica whose master is failing, or in a manual failover.
+// Like redis the start of the election is delayed by a random time and by the rank of the
+// replica, so the replica with the most data usually wins.
+func (s *server) failoverCron() {
+	state := s.cluster
+	myself := state.Myself
+	now := s.now()
+	f := &s.failover
+	if s.clientsPaused() && !now.Before(s.pausedUntil) {
+		log.Printf("manual failover pause expired")
+		s.resumeClients()
+	}
+	if myself.IsMaster() {
+		*f = clusterFailover{}
+		return
+	}
+	manual := !f.manualEnd.IsZero()
+	if manual && now.After(f.manualEnd) {
+		log.Printf("manual failover timed out")
+		*f = clusterFailover{}
+		return
+	}
+	master := state.Nodes[myself.MasterID]
+	if master == nil || state.CountSlots(master) == 0 || (!manual && master.Flags&cluster.FlagFail == 0) {
+		f.authTime = time.Time{}
+		return
+	}
+	if manual && !f.forced && (f.manualOffset < 0 || s.replOffset < f.manualOffset) {
+		return
+	}
+
+	authTimeout := 2 * s.clusterNodeTimeout
+	if authTimeout < clusterMinAuthTimeout {
+		authTimeout = clusterMinAuthTimeout
+	}
+	if f.authTime.IsZero() || now.Sub(f.authTime) > 2*authTimeout {
+		var delay time.Duration
+		if !manual {
+			rank := s.replicaRank(master)
+			delay = 500*time.Millisecond + time.Duration(rand.Int63n(int64(500*time.Millisecond))) +
+				time.Duration(rank)*time.Second
+			log.Printf("start of election delayed for %v (rank #%d, offset %d)", delay, rank, s.replOffset)
+		}
+		f.authTime, f.authSent, f.authCount = now.Add(delay), false, 0
+	}
+	if now.Before(f.authTime) || now.Sub(f.authTime) > authTimeout {
+		return
+	}
+	if !f.authSent {
+		state.CurrentEpoch++
+		f.authEpoch, f.authSent = state.CurrentEpoch, true
+		log.Printf("starting a failover election for epoch %d", f.authEpoch)
+		m := state.NewMessage(cluster.MsgAuthRequest)
+		if manual {
+			m.MFlags |= cluster.MsgFlagForceAck
+		}
+		s.broadcast(m)
+		_ = s.saveClusterConfig()
+		return
+	}
+	if f.authCount >= state.Size()/2+1 {
+		log.Printf("failover election won for epoch %d", f.authEpoch)
+		s.clusterPromote(f.authEpoch)
+	}
+}
+
+// replicaRank returns the number of replicas of master with a greater replication offset
+func (s *server) replicaRank(master *cluster.Node) int {
+	rank := 0
+	for _, n := range s.cluster.Replicas(master) {
+		if n != s.cluster.Myself && n.ReplOffset > s.replOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// voteFailover votes for the replica sender to replace its master, a master votes once per epoch
+// and once per failing master every two node timeouts
+func (s *server) voteFailover(sender *cluster.Node, m *cluster.Message) {
+	state := s.cluster
+	myself := state.Myself
+	now := millis(s.now())
+	if !myself.IsMaster() || state.CountSlots(myself) == 0 {
+		return
+	}
+	if m.CurrentEpoch < state.CurrentEpoch || state.LastVoteEpoch == state.CurrentEpoch {
+		return
+	}
+	master, ok := state.Nodes[sender.MasterID]
+	if sender.IsMaster() || !ok {
+		return
+	}
+	if master.Flags&cluster.FlagFail == 0 && m.MFlags&cluster.MsgFlagForceAck == 0 {
+		return
+	}
+	if now-master.VotedTime < 2*s.clusterNodeTimeout.Milliseconds() {
+		return
+	}
+	for slot := 0; slot < len(m.Slots)*8; slot++ {
+		// the slots must not be claimed by a more recent configuration than the one of the replica
+		if owner := state.Owner(slot); m.Slots.Has(slot) && owner != nil && owner.ConfigEpoch > m.ConfigEpoch {
+			return
+		}
+	}
+	state.LastVoteEpoch = state.CurrentEpoch
+	master.VotedTime = now
+	_ = s.saveClusterConfig()
+	log.Printf("failover auth granted to %s for epoch %d", sender.ID, state.CurrentEpoch)
+	s.sendTo(sender, state.NewMessage(cluster.MsgAuthAck))
+}
+
+func (s *server) countFailoverVote(sender *cluster.Node, m *cluster.Message) {
+	f := &s.failover
+	if f.authSent && sender.IsMaster() && s.cluster.CountSlots(sender) > 0 && m.CurrentEpoch >= f.authEpoch {
+		f.authCount++
+	}
+}
+
+// clusterPromote turns this replica into the master of the slots of its master, with epoch as
+// config epoch. The other nodes learn about it with the pongs broadcasted.
+func (s *server) clusterPromote(epoch uint64) {
+	state := s.cluster
+	myself := state.Myself
+	oldMaster := state.Nodes[myself.MasterID]
+	s.promote()
+	myself.Flags = myself.Flags&^cluster.FlagReplica | cluster.FlagMaster
+	myself.MasterID = ""
+	myself.ConfigEpoch = epoch
+	if oldMaster != nil {
+		for slot := 0; slot < common.NumSlots; slot++ {
+			if state.Owner(slot) == oldMaster {
+				state.SetOwner(slot, myself)
+			}
+		}
+	}
+	s.failover = clusterFailover{}
+	_ = s.saveClusterConfig()
+	for _, n := range state.Nodes {
+		if n != myself && n.Flags&cluster.FlagHandshake == 0 {
+			s.sendPing(n, cluster.MsgPong)
+		}
+	}
+}
+
+// clusterSetMaster turns this node into a replica of master, as a master it gives up its slots
+func (s *server) clusterSetMaster(master *cluster.Node) {
+	myself := s.cluster.Myself
+	if myself.IsMaster() {
+		s.cluster.DelNodeSlots(myself)
+		myself.Flags = myself.Flags&^cluster.FlagMaster | cluster.FlagReplica
+	}
+	myself.MasterID = master.ID
+	s.replicateFrom(master.Host, master.Port)
+	s.failover = clusterFailover{}
+	s.resumeClients()
+	_ = s.saveClusterConfig()
+}
+
+// clusterFailoverCMD starts the failover of CLUSTER FAILOVER. By default the replica asks its
+// master to pause its clients and waits for the end of its stream, FORCE starts the election
+// without the master, TAKEOVER promotes the replica without election.
+func (s *server) clusterFailoverCMD(option string) (string, error) {
+	state := s.cluster
+	myself := state.Myself
+	if myself.IsMaster() {
+		return "", errFailoverNotReplica
+	}
+	master, ok := state.Nodes[myself.MasterID]
+	if !ok {
+		return "", errFailoverNoMaster
+	}
+	switch option {
+	case "TAKEOVER":
+		log.Printf("taking over the master %s (user request)", master.ID)
+		state.CurrentEpoch++
+		s.clusterPromote(state.CurrentEpoch)
+	case "FORCE":
+		log.Printf("forced failover user request accepted")
+		s.failover = clusterFailover{manualEnd: s.now().Add(clusterManualFailoverTimeout), manualOffset: -1, forced: true}
+	default:
+		if master.Flags&cluster.FlagFail != 0 || s.master == nil || s.master.state != linkStateConnected {
+			return "", errFailoverMasterDown
+		}
+		log.Printf("manual failover user request accepted")
+		s.failover = clusterFailover{manualEnd: s.now().Add(clusterManualFailoverTimeout), manualOffset: -1}
+		s.sendTo(master, s.newBusMessage(cluster.MsgMFStart, master))
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+// pauseForManualFailover pauses the writes of the clients of this master until its replica
+// sender takes over, the replica learns the offset to reach with the next ping
+func (s *server) pauseForManualFailover(sender *cluster.Node) {
+	myself := s.cluster.Myself
+	if !myself.IsMaster() || sender.MasterID != myself.ID {
+		return
+	}
+	log.Printf("manual failover requested by replica %s", sender.ID)
+	s.pausedUntil = s.now().Add(clusterManualFailoverPauseMult * clusterManualFailoverTimeout)
+	s.pausedFor = sender.ID
+	s.sendPing(sender, cluster.MsgPing)
+}
+
+// masterPaused records the offset of the master paused for the manual failover of this replica
+func (s *server) masterPaused(offset int64) {
+	f := &s.failover
+	if f.manualEnd.IsZero() || f.forced {
+		return
+	}
+	if f.manualOffset < 0 {
+		log.Printf("received the replication offset %d of the paused master", offset)
+	}
+	f.manualOffset = offset
+}
+
+// clientsPaused returns true while the writes of the clients are paused for a manual failover
+func (s *server) clientsPaused() bool {
+	return !s.pausedUntil.IsZero()
+}
+
+// pauseCMD holds the write commands of the clients while they are paused, their workers wait for
+// the reply. The commands of a transaction are queued, its EXEC is held.
+func (s *server) pauseCMD(cmd common.Command, c *connectedClient) bool {
+	if !s.clientsPaused() || c.ID == 0 || (c.multi != nil && cmd.CMD != common.EXEC) {
+		return false
+	}
+	switch {
+	case cmd.CMD.IsWrite(), cmd.CMD == common.EXEC, cmd.CMD == common.EVAL, cmd.CMD == common.EVALSHA,
+		cmd.CMD == common.FCALL:
+		s.paused = append(s.paused, cmd)
+		return true
+	}
+	return false
+}
+
+// resumeClients ends the pause and executes the commands held, after a failover they get MOVED
+// redirections to the new master
+func (s *server) resumeClients() {
+	if !s.clientsPaused() {
+		return
+	}
+	s.pausedUntil, s.pausedFor = time.Time{}, ""
+	paused := s.paused
+	s.paused = nil
+	for _, cmd := range paused {
+		s.handleCMD(cmd, nil, "")
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+)
+
+// commandInfo describes a command in the COMMAND reply, cluster clients use the positions of the
+// keys to route the commands to the node serving them
+type commandInfo struct {
+	name string
+	// arity is the number of arguments, command name included, a negative arity is a minimum
+	arity int
+	flags []string
+	// firstKey, lastKey & step are the positions of the keys, lastKey is -1 when the keys go up
+	// to the last argument. They are 0 without keys, or when the keys are not at fixed positions.
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+var commandTable = []commandInfo{
+	{"get", 2, []string{"readonly", "fast"}, 1, 1, 1},
+	{"set", -3, []string{"write", "denyoom"}, 1, 1, 1},
+	{"del", -2, []string{"write"}, 1, -1, 1},
+	{"info", -1, []string{"loading", "stale"}, 0, 0, 0},
+	{"client", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"multi", 1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+	{"exec", 1, []string{"noscript", "loading", "stale"}, 0, 0, 0},
+	{"discard", 1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+	{"watch", -2, []string{"noscript", "loading", "stale", "fast"}, 1, -1, 1},
+	{"unwatch", 1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+	{"eval", -3, []string{"noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"eval_ro", -3, []string{"readonly", "noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"evalsha", -3, []string{"noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"evalsha_ro", -3, []string{"readonly", "noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"script", -2, []string{"noscript"}, 0, 0, 0},
+	{"function", -2, []string{"noscript"}, 0, 0, 0},
+	{"fcall", -3, []string{"noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"fcall_ro", -3, []string{"readonly", "noscript", "stale", "movablekeys"}, 0, 0, 0},
+	{"ping", -1, []string{"fast"}, 0, 0, 0},
+	{"subscribe", -2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"unsubscribe", -1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"psubscribe", -2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"punsubscribe", -1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"publish", 3, []string{"pubsub", "loading", "stale", "fast"}, 0, 0, 0},
+	{"pubsub", -2, []string{"pubsub", "loading", "stale"}, 0, 0, 0},
+	{"ssubscribe", -2, []string{"pubsub", "noscript", "loading", "stale"}, 1, -1, 1},
+	{"sunsubscribe", -1, []string{"pubsub", "noscript", "loading", "stale"}, 1, -1, 1},
+	{"spublish", 3, []string{"pubsub", "loading", "stale", "fast"}, 1, 1, 1},
+	{"config", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"hello", -1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+	{"save", 1, []string{"admin", "noscript"}, 0, 0, 0},
+	{"bgsave", -1, []string{"admin", "noscript"}, 0, 0, 0},
+	{"lastsave", 1, []string{"loading", "stale", "fast"}, 0, 0, 0},
+	{"bgrewriteaof", 1, []string{"admin", "noscript"}, 0, 0, 0},
+	{"scan", -2, []string{"readonly"}, 0, 0, 0},
+	{"replicaof", 3, []string{"admin", "noscript", "stale"}, 0, 0, 0},
+	{"slaveof", 3, []string{"admin", "noscript", "stale"}, 0, 0, 0},
+	{"replconf", -1, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"psync", -3, []string{"admin", "noscript"}, 0, 0, 0},
+	{"role", 1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+	{"wait", 3, []string{"noscript"}, 0, 0, 0},
+	{"waitaof", 4, []string{"noscript"}, 0, 0, 0},
+	{"cluster", -2, []string{}, 0, 0, 0},
+	{"asking", 1, []string{"fast"}, 0, 0, 0},
+	{"command", -1, []string{"loading", "stale"}, 0, 0, 0},
+	{"dump", 2, []string{"readonly"}, 1, 1, 1},
+	{"restore", -4, []string{"write", "denyoom"}, 1, 1, 1},
+	{"restore-asking", -4, []string{"write", "denyoom", "asking"}, 1, 1, 1},
+	{"migrate", -6, []string{"write", "movablekeys"}, 3, 3, 1},
+	{"raft", -2, []string{"noscript"}, 0, 0, 0},
+	{"incr", 2, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	{"decr", 2, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	{"incrby", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	{"decrby", 3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	{"crdt", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	{"sentinel", -2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+}
+
+func (s *server) handleCOMMAND(args common.CommandArguments) (string, error) {
+	commandArgs, ok := args.(common.COMMANDArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid COMMAND argments %v", args)
+	}
+	if commandArgs.Subcommand == common.CommandSubcommandCOUNT {
+		return resp.Integer(len(commandTable)), nil
+	}
+	commands := make([]string, 0, len(commandTable))
+	for _, info := range commandTable {
+		flags := make([]string, 0, len(info.flags))
+		for _, flag := range info.flags {
+			flags = append(flags, resp.SimpleString(flag))
+		}
+		name := info.name
+		commands = append(commands, resp.RawArray([]string{
+			resp.BulkString(&name),
+			resp.Integer(info.arity),
+			resp.RawArray(flags),
+			resp.Integer(info.firstKey),
+			resp.Integer(info.lastKey),
+			resp.Integer(info.step),
+		}))
+	}
+	return resp.RawArray(commands), nil
+}
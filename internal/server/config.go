@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configParam is a setting exposed by CONFIG GET & CONFIG SET
+type configParam struct {
+	name string
+	get  func(s *server) string
+	// set checks value and returns the change to apply, CONFIG SET applies the changes once every
+	// value is valid. It is nil for the parameters that can only be set at startup.
+	set func(s *server, value string) (func(), error)
+}
+
+var configParams = []configParam{
+	{
+		name: "busy-reply-threshold",
+		get: func(s *server) string {
+			return strconv.FormatInt(s.busyScriptTimeout.Milliseconds(), 10)
+		},
+		set: func(s *server, value string) (func(), error) {
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms < 0 {
+				return nil, fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			return func() { s.busyScriptTimeout = time.Duration(ms) * time.Millisecond }, nil
+		},
+	},
+	{
+		name: "notify-keyspace-events",
+		get: func(s *server) string {
+			return s.notifyKeyspaceEvents.String()
+		},
+		set: func(s *server, value string) (func(), error) {
+			events, err := parseKeyspaceEvents(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.notifyKeyspaceEvents = events }, nil
+		},
+	},
+	{
+		name: "save",
+		get: func(s *server) string {
+			return formatSaveRules(s.saveRules)
+		},
+		set: func(s *server, value string) (func(), error) {
+			rules, err := parseSaveRules(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.saveRules = rules }, nil
+		},
+	},
+	{
+		name: "appendonly",
+		get: func(s *server) string {
+			if s.appendOnly {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "appendfsync",
+		get: func(s *server) string {
+			return s.appendFsync.String()
+		},
+		set: func(s *server, value string) (func(), error) {
+			policy, err := aof.ParseFsyncPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.appendFsync = policy }, nil
+		},
+	},
+	{
+		name: "aof-timestamp-enabled",
+		get: func(s *server) string {
+			if s.aofTimestamps {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(s *server, value string) (func(), error) {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.aofTimestamps = enabled }, nil
+		},
+	},
+	{
+		name: "appenddirname",
+		get: func(s *server) string {
+			return s.appendDirname
+		},
+	},
+	{
+		name: "appendfilename",
+		get: func(s *server) string {
+			return s.appendFilename
+		},
+	},
+	{
+		name: "dir",
+		get: func(s *server) string {
+			return s.rdbDir
+		},
+	},
+	{
+		name: "dbfilename",
+		get: func(s *server) string {
+			return s.rdbFilename
+		},
+	},
+	{
+		name: "replica-read-only",
+		get: func(s *server) string {
+			if s.replicaReadOnly {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(s *server, value string) (func(), error) {
+			readOnly, err := parseYesNo(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { s.replicaReadOnly = readOnly }, nil
+		},
+	},
+	{
+		name: "repl-backlog-size",
+		get: func(s *server) string {
+			return strconv.Itoa(replBacklogSize)
+		},
+	},
+	{
+		name: "cluster-enabled",
+		get: func(s *server) string {
+			if s.cluster != nil {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "cluster-config-file",
+		get: func(s *server) string {
+			return s.clusterConfigFile
+		},
+	},
+	{
+		name: "cluster-node-timeout",
+		get: func(s *server) string {
+			return strconv.FormatInt(s.clusterNodeTimeout.Milliseconds(), 10)
+		},
+		set: func(s *server, value string) (func(), error) {
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			return func() { s.clusterNodeTimeout = time.Duration(ms) * time.Millisecond }, nil
+		},
+	},
+	{
+		name: "active-active",
+		get: func(s *server) string {
+			if s.activeActive != nil {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "active-active-peers",
+		get: func(s *server) string {
+			if s.activeActive == nil {
+				return ""
+			}
+			return strings.Join(s.activeActive.peerAddrs, " ")
+		},
+		set: func(s *server, value string) (func(), error) {
+			if s.activeActive == nil {
+				return nil, fmt.Errorf("active-active mode is disabled")
+			}
+			peers := strings.Fields(value)
+			for _, peer := range peers {
+				if _, _, err := net.SplitHostPort(peer); err != nil {
+					return nil, fmt.Errorf("invalid peer address %s", peer)
+				}
+			}
+			return func() { s.setPeers(peers) }, nil
+		},
+	},
+	{
+		name: "raft-enabled",
+		get: func(s *server) string {
+			if s.raft != nil {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "raft-dir",
+		get: func(s *server) string {
+			return s.raftDirname
+		},
+	},
+	{
+		name: "raft-snapshot-entries",
+		get: func(s *server) string {
+			return strconv.FormatUint(s.raftSnapshotEntries, 10)
+		},
+		set: func(s *server, value string) (func(), error) {
+			entries, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || entries == 0 {
+				return nil, fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			return func() { s.raftSnapshotEntries = entries }, nil
+		},
+	},
+}
+
+// parseYesNo parses the value of a boolean parameter
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func lookupConfigParam(name string) (configParam, bool) {
+	name = strings.ToLower(name)
+	if name == "lua-time-limit" {
+		// lua-time-limit is the old name of busy-reply-threshold
+		name = "busy-reply-threshold"
+	}
+	if name == "slave-read-only" {
+		name = "replica-read-only"
+	}
+	for _, param := range configParams {
+		if param.name == name {
+			return param, true
+		}
+	}
+	return configParam{}, false
+}
+
+func (s *server) handleCONFIG(args common.CommandArguments) (string, error) {
+	configArgs, ok := args.(common.CONFIGArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid CONFIG argments %v", args)
+	}
+	switch configArgs.Subcommand {
+	case common.ConfigSubcommandGET:
+		var values []interface{}
+		for _, param := range configParams {
+			for _, pattern := range configArgs.Args {
+				if common.GlobMatch(strings.ToLower(pattern), param.name) {
+					values = append(values, param.name, param.get(s))
+					break
+				}
+			}
+		}
+		return resp.Array(values), nil
+	case common.ConfigSubcommandSET:
+		// every value is checked before the first change is applied, like redis a failed CONFIG SET
+		// changes nothing
+		changes := make([]func(), 0, len(configArgs.Args)/2)
+		for i := 0; i < len(configArgs.Args); i += 2 {
+			param, exists := lookupConfigParam(configArgs.Args[i])
+			if !exists {
+				return "", fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", configArgs.Args[i])
+			}
+			if param.set == nil {
+				return "", fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", param.name)
+			}
+			change, err := param.set(s, configArgs.Args[i+1])
+			if err != nil {
+				return "", fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", param.name, err)
+			}
+			changes = append(changes, change)
+		}
+		for _, change := range changes {
+			change()
+		}
+		return resp.SimpleString("OK"), nil
+	default:
+		return "-ERR", fmt.Errorf("unsupported CONFIG subcommand %v", args)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/keyspace"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"sync/atomic"
+)
+
+// The workers execute GET, SET, DEL, INCRBY and the transactions made of them directly against
+// the keyspace, in parallel, as long as no feature needs to see every command in order: the
+// append only file, replication, cluster, raft, active-active & sentinel modes, WATCH, client
+// side caching, keyspace notifications, paused clients and scripts. A worker holds exclusive for
+// reading and locks the shards of the keys of its command, or of the whole transaction, in
+// increasing order. The event loop holds exclusive for writing while it handles an event, so it
+// has the keyspace and the rest of the server state for itself, and decides after every event
+// whether the workers can keep executing commands.
+
+// lockExclusive waits for the commands executed by the workers and stops the new ones until
+// unlockExclusive
+func (s *server) lockExclusive() {
+	s.exclusive.Lock()
+	s.dirty += int(atomic.SwapInt64(&s.directDirty, 0))
+}
+
+func (s *server) unlockExclusive() {
+	var direct int32
+	if s.directAllowed() {
+		direct = 1
+	}
+	atomic.StoreInt32(&s.direct, direct)
+	s.exclusive.Unlock()
+}
+
+// directAllowed returns true when the commands can skip the event loop
+func (s *server) directAllowed() bool {
+	return s.getState() == serverStateListening && !s.loading &&
+		s.aof == nil && s.backlog == nil && s.master == nil &&
+		s.cluster == nil && s.raft == nil && s.activeActive == nil && s.sentinel == nil &&
+		s.runningScript == nil && s.pausedUntil.IsZero() && !s.notifyKeyspaceEvents.publishing() &&
+		len(s.watchedKeys) == 0 && len(s.trackingTable) == 0 && len(s.trackingPrefixes) == 0
+}
+
+// isDirect returns true for the commands the workers can execute
+func isDirect(cmd common.Command) bool {
+	if cmd.Err != nil {
+		return false
+	}
+	switch cmd.CMD {
+	case common.GET, common.SET, common.DEL, common.INCRBY:
+		return true
+	}
+	return false
+}
+
+// executeDirect executes cmd from the worker of c, it returns false when cmd has to be sent to the
+// event loop
+func (s *server) executeDirect(c *connectedClient, cmd common.Command) (string, bool) {
+	if atomic.LoadInt32(&s.direct) == 0 {
+		return "", false
+	}
+	s.exclusive.RLock()
+	defer s.exclusive.RUnlock()
+	if !s.directFor(c) {
+		return "", false
+	}
+
+	var response string
+	switch {
+	case cmd.CMD == common.MULTI && c.multi == nil && cmd.Err == nil:
+		response, _ = s.handleMULTI(c)
+	case cmd.CMD == common.EXEC && c.multi != nil && isDirectTransaction(c.multi):
+		response = s.execDirect(c)
+	case cmd.CMD == common.DISCARD && c.multi != nil:
+		response, _ = s.handleDISCARD(c)
+	case !isDirect(cmd):
+		return "", false
+	case c.multi != nil:
+		response, _ = s.queueCMD(cmd, c)
+	default:
+		shards := s.db.ShardsOf(routingKeys(cmd)...)
+		s.db.Lock(shards)
+		response = s.runDirect(cmd)
+		s.db.Unlock(shards)
+	}
+	c.lastCMD = cmd.CMD
+	c.lastCMDEpoch = s.now().UnixNano()
+	return response, true
+}
+
+// directFor returns true when the commands of c can be executed directly, exclusive must be held
+// for reading. The event loop could have handled an event while the worker waited for it.
+func (s *server) directFor(c *connectedClient) bool {
+	return atomic.LoadInt32(&s.direct) == 1 && c.tracking == nil && c.replica == nil && c.numSubscriptions() == 0
+}
+
+// rawReply is the reply of a command executed from its raw arguments, it is appended to the output
+// buffer of the client instead of being built as a string
+type rawReply struct {
+	value  string
+	exists bool
+	ok     bool
+}
+
+func (r rawReply) appendTo(out []byte) []byte {
+	switch {
+	case r.ok:
+		return resp.AppendSimpleString(out, "OK")
+	case r.exists:
+		return resp.AppendBulkString(out, r.value)
+	}
+	return resp.AppendNullBulkString(out)
+}
+
+// executeRaw executes GET and SET without options from the arguments parsed by the worker or the
+// I/O goroutine of c, without copying them to a command. It returns false when the command has to
+// be parsed and executed like the others.
+func (s *server) executeRaw(c *connectedClient, args [][]byte) (rawReply, bool) {
+	var cmd common.CommandID
+	switch {
+	case len(args) == 2 && isCommandName(args[0], "get"):
+		cmd = common.GET
+	case len(args) == 3 && isCommandName(args[0], "set"):
+		cmd = common.SET
+	default:
+		return rawReply{}, false
+	}
+	if atomic.LoadInt32(&s.direct) == 0 {
+		return rawReply{}, false
+	}
+	s.exclusive.RLock()
+	defer s.exclusive.RUnlock()
+	if !s.directFor(c) || c.multi != nil {
+		return rawReply{}, false
+	}
+
+	var reply rawReply
+	shards := s.db.ShardsOf(string(args[1]))
+	s.db.Lock(shards)
+	if cmd == common.GET {
+		reply.value, reply.exists = s.db.Get(string(args[1]))
+	} else {
+		s.db.Set(string(args[1]), string(args[2]))
+		reply.ok = true
+	}
+	s.db.Unlock(shards)
+	if cmd == common.SET {
+		atomic.AddInt64(&s.directDirty, 1)
+	}
+	c.lastCMD = cmd
+	c.lastCMDEpoch = s.now().UnixNano()
+	return reply, true
+}
+
+// isCommandName compares the command name arg to the lower case name, ignoring the case of arg
+func isCommandName(arg []byte, name string) bool {
+	if len(arg) != len(name) {
+		return false
+	}
+	for i, b := range arg {
+		if b|0x20 != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isDirectTransaction returns true when EXEC can run tx in the worker
+func isDirectTransaction(tx *transaction) bool {
+	if tx.aborted {
+		return false
+	}
+	for _, cmd := range tx.commands {
+		if !isDirect(cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+// execDirect runs the transaction of c holding the locks of the shards of all its keys, no other
+// command touching them is interleaved
+func (s *server) execDirect(c *connectedClient) string {
+	tx := c.multi
+	c.multi = nil
+	var shards keyspace.ShardSet
+	for _, cmd := range tx.commands {
+		shards |= s.db.ShardsOf(routingKeys(cmd)...)
+	}
+	s.db.Lock(shards)
+	defer s.db.Unlock(shards)
+	replies := make([]string, 0, len(tx.commands))
+	for _, cmd := range tx.commands {
+		replies = append(replies, s.runDirect(cmd))
+	}
+	return resp.RawArray(replies)
+}
+
+// runDirect runs cmd against the keyspace, the shards of its keys must be locked
+func (s *server) runDirect(cmd common.Command) string {
+	var response string
+	var err error
+	changes := 0
+	switch args := cmd.Arguments.(type) {
+	case common.GETArguments:
+		if value, exists := s.db.Get(args.Key); exists {
+			response = resp.BulkString(&value)
+		} else {
+			response = resp.BulkString(nil)
+		}
+	case common.SETArguments:
+		var set bool
+		if response, set, _ = s.setKey(args); set {
+			changes = 1
+		}
+	case common.DELArguments:
+		changes = len(s.deleteKeys(args.Keys))
+		if changes > 0 {
+			response = resp.Integer(1)
+		} else {
+			response = resp.Integer(0)
+		}
+	case common.INCRBYArguments:
+		var current int64
+		if current, _, err = s.incrKey(args); err == nil {
+			changes = 1
+			response = resp.Integer(int(current))
+		}
+	}
+	if err != nil {
+		return resp.Error(err)
+	}
+	if changes > 0 {
+		atomic.AddInt64(&s.directDirty, int64(changes))
+	}
+	return response
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestParallelExecution runs counters and transfers between accounts from several clients, the
+// workers execute them in parallel against the sharded keyspace
+func TestParallelExecution(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const clients, rounds, accounts = 8, 200, 10
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, clients+1)
+	port := uint(10_053)
+
+	go Start(port, clients, ready, quit, events)
+	<-ready
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port), PoolSize: clients})
+	for i := 0; i < accounts; i++ {
+		common.ExpectNoError(t, rdb.Set(ctx, "account:"+strconv.Itoa(i), 100, 0).Err())
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				from, to := "account:"+strconv.Itoa((c+i)%accounts), "account:"+strconv.Itoa((c*7+i*3)%accounts)
+				_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.DecrBy(ctx, from, 5)
+					pipe.IncrBy(ctx, to, 5)
+					return nil
+				})
+				if err != nil {
+					t.Errorf("transfer: %v", err)
+					return
+				}
+				if err := rdb.Incr(ctx, "counter").Err(); err != nil {
+					t.Errorf("INCR: %v", err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	common.AssertEquals(t, rdb.Get(ctx, "counter").Val(), strconv.Itoa(clients*rounds))
+	total := 0
+	for i := 0; i < accounts; i++ {
+		n, err := rdb.Get(ctx, "account:"+strconv.Itoa(i)).Int()
+		common.ExpectNoError(t, err)
+		total += n
+	}
+	common.AssertEquals(t, total, accounts*100)
+	common.AssertEquals(t, rdb.Del(ctx, "counter", "missing").Val(), int64(1))
+
+	common.ExpectNoError(t, rdb.Close())
+	quit <- true
+	for event := range events {
+		if event == EventSuccessfulShutdown {
+			break
+		}
+	}
+}
+
+// BenchmarkWorker sends GET & SET one at a time to a worker, the allocations counted are the ones of
+// the server
+func BenchmarkWorker(b *testing.B) {
+	benchmarkGETSET(b, 10_057)
+}
+
+func benchmarkGETSET(b *testing.B, port uint, opts ...Option) {
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 16)
+	go Start(port, 10, ready, quit, events, opts...)
+	<-ready
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name    string
+		request string
+		reply   string
+	}{
+		{name: "SET", request: "*3\r\n$3\r\nSET\r\n$7\r\nkey:123\r\n$16\r\n0123456789abcdef\r\n", reply: "+OK\r\n"},
+		{name: "GET", request: "*2\r\n$3\r\nGET\r\n$7\r\nkey:123\r\n", reply: "$16\r\n0123456789abcdef\r\n"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			request := []byte(bm.request)
+			reply := make([]byte, len(bm.reply))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(request); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if string(reply) != bm.reply {
+				b.Errorf("reply %q, want %q", reply, bm.reply)
+			}
+		})
+	}
+
+	_ = conn.Close()
+	quit <- true
+	for event := range events {
+		if event == EventSuccessfulShutdown {
+			break
+		}
+	}
+}
@@ -3,10 +3,191 @@ Package server provides functionality for a  redis protocol  over TCP. The serve
 
 - SET key value [NX|XX] [GET]
 - GET key
+- INCR key, DECR key, INCRBY key increment & DECRBY key decrement
 - DEL key [key ...]
 - INFO
-- CLIENT [KILL | INFO | ID | LIST]
+- CLIENT [KILL | INFO | ID | LIST | GETREDIR]
+- CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+- CLIENT CACHING YES|NO
+- HELLO [protover]
+- MULTI
+- EXEC
+- DISCARD
+- WATCH key [key ...]
+- UNWATCH
+- EVAL script numkeys [key ...] [arg ...]
+- EVALSHA sha1 numkeys [key ...] [arg ...]
+- EVAL_RO & EVALSHA_RO
+- SCRIPT [LOAD | EXISTS | FLUSH | KILL]
+- FUNCTION [LOAD | LIST | DELETE | DUMP | RESTORE | FLUSH | KILL]
+- FCALL function numkeys [key ...] [arg ...]
+- FCALL_RO function numkeys [key ...] [arg ...]
+- PING [message]
+- SUBSCRIBE channel [channel ...]
+- UNSUBSCRIBE [channel [channel ...]]
+- PSUBSCRIBE pattern [pattern ...]
+- PUNSUBSCRIBE [pattern [pattern ...]]
+- PUBLISH channel message
+- PUBSUB [CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT | SHARDCHANNELS [pattern] | SHARDNUMSUB [channel ...]]
+- SSUBSCRIBE shardchannel [shardchannel ...]
+- SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+- SPUBLISH shardchannel message
+- CONFIG [GET parameter [parameter ...] | SET parameter value [parameter value ...]]
+- SAVE
+- BGSAVE
+- LASTSAVE
+- SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+- BGREWRITEAOF
+- REPLICAOF host port | NO ONE (alias SLAVEOF)
+- ROLE
+- WAIT numreplicas timeout
+- WAITAOF numlocal numreplicas timeout
+- CLUSTER INFO | MYID | NODES | SLOTS | SHARDS | KEYSLOT key | COUNTKEYSINSLOT slot |
+  GETKEYSINSLOT slot count | ADDSLOTS slot [slot ...] | ADDSLOTSRANGE start end [start end ...] |
+  DELSLOTS slot [slot ...] | DELSLOTSRANGE start end [start end ...] | SAVECONFIG |
+  MEET ip port [cluster-bus-port] | REPLICATE node-id | FAILOVER [FORCE | TAKEOVER] |
+  COUNT-FAILURE-REPORTS node-id | SETSLOT slot IMPORTING node-id | MIGRATING node-id | NODE node-id |
+  STABLE
+- ASKING
+- COMMAND [COUNT]
+- DUMP key
+- RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+- MIGRATE host port key | "" destination-db timeout [COPY] [REPLACE] [AUTH password |
+  AUTH2 username password] [KEYS key [key ...]]
+- RAFT INIT | ADD node-id host:port | REMOVE node-id | INFO | MYID | MEMBERS
+- CRDT MERGE key value | PEERS
+- SENTINEL MASTERS | MASTER name | REPLICAS name (alias SLAVES) | SENTINELS name | MYID |
+  GET-MASTER-ADDR-BY-NAME name | CKQUORUM name | MONITOR name ip port quorum | REMOVE name |
+  SET name option value [option value ...] | FAILOVER name | IS-MASTER-DOWN-BY-ADDR ip port epoch runid
 
+CONFIG supports the busy-reply-threshold (alias lua-time-limit), notify-keyspace-events, save,
+appendfsync, aof-timestamp-enabled, replica-read-only, cluster-node-timeout and
+raft-snapshot-entries and active-active-peers parameters, dir, dbfilename, appendonly,
+appenddirname, appendfilename, repl-backlog-size, cluster-enabled, cluster-config-file,
+raft-enabled, raft-dir and active-active are read only. Keyspace notifications are published to __keyspace@0__:<key> and
+__keyevent@0__:<event> for the classes enabled in notify-keyspace-events, like redis. K or E
+selects the channels, the classes without K or E publish nothing. CONFIG SET checks every value
+before applying the first one.
+
+Clients switching to RESP3 with HELLO 3 receive maps, Pub/Sub messages and CLIENT TRACKING
+invalidations as push messages, the rest of the replies keep their RESP2 types. RESP2 clients get
+their invalidations through a client subscribed to __redis__:invalidate with the REDIRECT option.
+
+Sharded channels are mapped to hash slots with the CRC16 of the channel name, like keys, the
+channels of a single SSUBSCRIBE or SUNSUBSCRIBE must belong to the same slot.
+
+The keyspace and the function libraries are saved to an RDB file, version 11, with SAVE, BGSAVE
+or when a save rule is met, and loaded at startup. BGSAVE takes a snapshot of the keyspace and
+writes it from a goroutine while the server keeps serving clients. The file is written to a
+temporary file renamed once it is complete.
+
+The keyspace is a hash array mapped trie, see the keyspace package. Its snapshots are copy-on-write:
+taking one is O(1) and the writes after it copy the few nodes on their path, so BGSAVE, the AOF
+rewrite and SCAN see a consistent keyspace without stopping the clients. SCAN returns the keys in
+hash order, the cursor is the hash of the next key.
+
+The trie is split in 32 shards with their own locks. The workers execute GET, SET, DEL, INCRBY and
+the transactions made only of them in parallel, locking the shards of the keys in increasing order,
+while no feature needs every command to go through the server goroutine: the AOF, replication,
+the cluster, raft, active-active and sentinel modes, WATCH, client tracking, keyspace
+notifications, paused clients and running scripts. The server goroutine stops them while it
+handles a command or an event, see direct.go. GET and SET without options are executed from the
+arguments still in the input buffer of the connection and their replies appended to its output
+buffer, the only allocations of a SET are the key and the value stored.
+
+With the append only file enabled the write commands are appended to it before replying, the
+commands of EXEC and scripts wrapped in MULTI/EXEC. Like redis 7 the AOF is made of a base file,
+an RDB snapshot, incremental files and a manifest listing them. BGREWRITEAOF opens a new
+incremental file and writes a new base in background, the manifest is replaced once the base is
+complete so a crash in the middle of a rewrite loses nothing. A truncated command at the end of
+the last incremental file is removed when the AOF is loaded.
+
+With aof-timestamp-enabled the commands are preceded by #TS:<unix time> annotations. Starting the
+server with WithRecovery replays the incremental files up to a time or a number of commands, the
+commands of a transaction are kept or skipped together. The skipped commands are logged and the
+AOF is truncated at the first of them, the original files are kept with the .pre-recovery suffix.
+cmd/aof-recover reports the skipped commands and truncates the AOF offline.
+
+WithEnvelope compresses the RDB and AOF files with gzip and encrypts them with AES-GCM, see the
+envelope package. The files start with a header recording the scheme and the ID of the key, a file
+encrypted with another key, or corrupted, fails to load instead of loading garbage. The files
+written before enabling them are still loaded, an incr file written with other options is not
+appended to, a new one is opened.
+
+REPLICAOF turns the server into a replica of another one. The replica connects, sends PSYNC with
+the replication ID and offset it has, and the master either continues the stream from its backlog
+or replies FULLRESYNC with an RDB snapshot of its keyspace. The write commands are then streamed to
+the replicas, by a goroutine per replica writing directly to its connection so a slow replica never
+blocks the server, and the replicas acknowledge the offset processed with REPLCONF ACK every
+second. Replicas reject the writes of their clients with READONLY unless replica-read-only is no,
+and keep the stream of their master in a backlog for their own replicas. REPLICAOF NO ONE promotes
+a replica keeping the former replication ID, so its replicas continue with a partial resync.
+
+WAIT and WAITAOF block the client until enough replicas acknowledged the offset of the stream at
+the time of the command, or have it in their append only file on disk, and for WAITAOF until the
+local append only file is fsynced. The worker of the client waits for the reply while the server
+keeps serving the other clients, the reply is sent when an acknowledgement arrives or the timeout
+expires. Replicas with the append only file enabled acknowledge the offset on disk with
+REPLCONF ACK <offset> FACK <offset>, with appendfsync no the writes count as on disk once written.
+
+In cluster mode the keys are split in 16384 hash slots served by the masters of the cluster, see
+the cluster package. The nodes, their slots and the slots migrating or importing are kept in
+cluster-config-file, in the nodes.conf format of redis, a new node without slots is created when
+it does not exist. A command with keys of a slot served by another master gets a MOVED error with
+its address, the keys of a command, a transaction or a script must belong to the same slot. While a
+slot is migrating the commands on missing keys get an ASK error, the node importing it serves them
+after ASKING.
+
+The nodes are connected by the cluster bus, on the port of the clients + 10000. CLUSTER MEET adds a
+node, the other nodes learn about it from the gossip sections of the pings. A node that does not
+reply for cluster-node-timeout is flagged PFAIL, then FAIL once the majority of the masters report
+it. The replicas of a failing master start an election, the first one voted by the majority of the
+masters replaces it with a greater config epoch. CLUSTER FAILOVER pauses the writes of the master
+until its replica processed its stream, FORCE skips the master and TAKEOVER skips the election.
+PUBLISH is sent on the bus to every node, the subscribers of the cluster receive the message while
+the reply counts the local ones. SPUBLISH stays on the node serving the slot of the channel.
+
+A slot is moved to another master while the clients keep running: CLUSTER SETSLOT IMPORTING on the
+target and MIGRATING on the source open it, MIGRATE sends its keys to the target as DUMP payloads
+with RESTORE-ASKING, then CLUSTER SETSLOT NODE on both assigns it to the target, which takes a new
+config epoch so the other nodes learn about it from its pings. cmd/reshard runs these steps for a
+list of slots. The DUMP payloads have the RDB version and a CRC64 like redis, the keys with a time
+to live cannot be restored.
+
+In raft mode the write commands, the scripts and the function changes are committed through a raft
+log replicated to 3 or 5 members before the leader executes them and replies, see the raft package.
+RAFT INIT creates the log on the first member, RAFT ADD and RAFT REMOVE on the leader change the
+members one at a time. The followers answer the commands with keys and the writes with a MOVED error
+to the leader, or TRYAGAIN while there is none. Every member executes the committed entries in
+order, EVALSHA is sent as EVAL and a transaction is discarded when the keys it watches changed
+before it was committed. The log is kept in raft-dir inside dir and compacted every
+raft-snapshot-entries entries into an RDB snapshot, the RDB file and the append only file are not
+loaded. The members talk on the port of the clients + 10000, the raft mode and the cluster mode are
+exclusive.
+
+In active-active mode every instance accepts writes and sends the keys it changes to the peers in
+active-active-peers as CRDTs, see the crdt package: SET and DEL are last writer wins registers
+ordered by hybrid logical clocks and INCRBY increments a PN-counter, so the concurrent increments
+add up. The peers merge the values with CRDT MERGE, the links send every key when they connect so
+the writes made while two instances were apart converge once they reconnect. The CRDT metadata is
+kept in memory, the keys loaded at startup are older than any write of the peers. The
+active-active mode excludes the cluster mode, the raft mode and the replication.
+
+In sentinel mode the server keeps no keys and monitors the masters given with SENTINEL MONITOR, see
+the sentinel package. It pings every instance, discovers the replicas from the INFO of the master
+and the other sentinels from the hellos they publish to __sentinel__:hello on the instances. A
+master not answering for down-after is subjectively down, objectively down once quorum sentinels
+agree. The sentinels then elect a leader in a new epoch, the leader promotes the replica with the
+greatest replication offset with REPLICAOF NO ONE, points the other replicas to it and publishes
++switch-master to its clients, the other sentinels adopt the configuration with the greater epoch
+from its hellos. A former master coming back is converted to a replica. The other commands are
+refused, the state of the sentinel is kept in memory and not written to a configuration file.
+
+
+With WithNetpoll the clients are served by a few I/O goroutines using epoll directly instead of a
+worker goroutine per client, see the netpoll package. The I/O goroutines parse the commands from
+reusable buffers, execute them directly or send them to the event loop, and wait for the reply
+before reading the next command of the client, so the commands behave the same in both modes.
 
 The TCP redis server uses goroutines to handle each connected
 client.  These channels are used to communicate the client data to the server server
@@ -16,6 +197,11 @@ client.  These channels are used to communicate the client data to the server se
 	    currently the server implements SET, GET & DEL commands
 
     connectedClient.response chan string
+        used to send the response of every command to the client worker
+
+    connectedClient.push chan string
+        buffered channel used to send messages to the client without a request, like the
+        messages published to the channels the client subscribed to
 
 */
 package server
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"go.uber.org/goleak"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryptedPersistence(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	port := uint(10_020)
+	ctx := context.Background()
+	key, err := envelope.NewKey(bytes.Repeat([]byte{42}, 32))
+	common.ExpectNoError(t, err)
+	otherKey, err := envelope.NewKey(bytes.Repeat([]byte{7}, 32))
+	common.ExpectNoError(t, err)
+
+	persistence := func(key *envelope.Key) []Option {
+		return []Option{WithRDB(dir, "dump.rdb"), WithAppendOnly("appendonlydir", "appendonly.aof", "always"),
+			WithEnvelope("gzip", key)}
+	}
+	start := func(opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 2)
+		go Start(port, 2, ready, quit, events, opts...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		common.AssertEquals(t, <-events, EventAfterDisconnect)
+		quit <- true
+		common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+	}
+	load := func(opts ...Option) error {
+		return newServer(time.Now, port, 1, nil, nil, nil, opts...).loadData()
+	}
+
+	rdb, quit, events := start(persistence(key)...)
+	common.ExpectNoError(t, rdb.Set(ctx, "card", "4111-1111-1111-1111", 0).Err())
+	common.ExpectNoError(t, rdb.Do(ctx, "SAVE").Err())
+	common.ExpectNoError(t, rdb.Set(ctx, "ssn", "078-05-1120", 0).Err())
+	stop(rdb, quit, events)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	common.ExpectNoError(t, err)
+	files = append(files, filepath.Join(dir, "dump.rdb"))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		common.ExpectNoError(t, err)
+		if bytes.Contains(data, []byte("4111")) || bytes.Contains(data, []byte("078-05")) {
+			t.Errorf("%s contains plain text values", path)
+		}
+	}
+
+	if err := load(persistence(otherKey)...); err == nil {
+		t.Errorf("want error loading the append only file with another key")
+	}
+	if err := load(WithRDB(dir, "dump.rdb")); err == nil {
+		t.Errorf("want error loading the RDB file without the key")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dump.rdb"))
+	common.ExpectNoError(t, err)
+	data[len(data)-10] ^= 0xff
+	common.ExpectNoError(t, os.WriteFile(filepath.Join(dir, "dump.rdb"), data, 0644))
+	if err := load(WithRDB(dir, "dump.rdb"), WithEnvelope("none", key)); !errors.Is(err, envelope.ErrCorrupted) {
+		t.Errorf("want ErrCorrupted loading a corrupted RDB file, got %v", err)
+	}
+
+	// the append only file is loaded with the key, the incr file written without compression is a
+	// new one
+	rdb, quit, events = start(WithRDB(dir, "dump.rdb"), WithAppendOnly("appendonlydir", "appendonly.aof", "always"),
+		WithEnvelope("none", key))
+	common.AssertEquals(t, rdb.Get(ctx, "card").Val(), "4111-1111-1111-1111")
+	common.AssertEquals(t, rdb.Get(ctx, "ssn").Val(), "078-05-1120")
+	common.ExpectNoError(t, rdb.Set(ctx, "pin", "1234", 0).Err())
+	stop(rdb, quit, events)
+
+	rdb, quit, events = start(WithRDB(dir, "dump.rdb"), WithAppendOnly("appendonlydir", "appendonly.aof", "always"),
+		WithEnvelope("none", key))
+	common.AssertEquals(t, rdb.Get(ctx, "pin").Val(), "1234")
+	common.AssertEquals(t, rdb.Do(ctx, "BGREWRITEAOF").Val(), "Background append only file rewriting started")
+	stop(rdb, quit, events)
+}
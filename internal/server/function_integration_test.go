@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"testing"
+)
+
+const counterLibrary = `#!lua name=counter
+local function incr(keys, args)
+  local next = tonumber(redis.call('GET', keys[1]) or 0) + tonumber(args[1])
+  redis.call('SET', keys[1], next)
+  return next
+end
+redis.register_function('incr', incr)
+redis.register_function{function_name='peek', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}}
+`
+
+func TestFunctions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_011)
+
+	go Start(port, 1, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+
+	name, err := rdb.Do(ctx, "FUNCTION", "LOAD", counterLibrary).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, name, "counter")
+	err = rdb.Do(ctx, "FUNCTION", "LOAD", counterLibrary).Err()
+	if err == nil || err.Error() != "ERR Library 'counter' already exists" {
+		t.Errorf("want library exists error, got %v", err)
+	}
+
+	val, err := rdb.Do(ctx, "FCALL", "incr", 1, "hits", 3).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, val, int64(3))
+	val, err = rdb.Do(ctx, "FCALL_RO", "peek", 1, "hits").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, val, "3")
+	err = rdb.Do(ctx, "FCALL_RO", "incr", 1, "hits", 1).Err()
+	if err == nil || err.Error() != "ERR Can not execute a script with write flag using *_ro command." {
+		t.Errorf("want write flag error, got %v", err)
+	}
+	err = rdb.Do(ctx, "FCALL", "missing", 0).Err()
+	if err == nil || err.Error() != "ERR Function not found" {
+		t.Errorf("want function not found error, got %v", err)
+	}
+
+	list, err := rdb.Do(ctx, "FUNCTION", "LIST", "LIBRARYNAME", "count*").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(list),
+		"[[library_name counter engine LUA functions [[name incr description <nil> flags []] [name peek description <nil> flags [no-writes]]]]]")
+
+	payload, err := rdb.Do(ctx, "FUNCTION", "DUMP").Text()
+	common.ExpectNoError(t, err)
+	common.ExpectNoError(t, rdb.Do(ctx, "FUNCTION", "DELETE", "counter").Err())
+	err = rdb.Do(ctx, "FCALL", "incr", 1, "hits", 1).Err()
+	if err == nil || err.Error() != "ERR Function not found" {
+		t.Errorf("want function not found error, got %v", err)
+	}
+	common.ExpectNoError(t, rdb.Do(ctx, "FUNCTION", "RESTORE", payload).Err())
+	val, err = rdb.Do(ctx, "FCALL", "incr", 1, "hits", 1).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, val, int64(4))
+
+	common.ExpectNoError(t, rdb.Do(ctx, "FUNCTION", "FLUSH").Err())
+	list, err = rdb.Do(ctx, "FUNCTION", "LIST").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(list), "[]")
+
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/function"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/script"
+)
+
+var (
+	errFunctionNotFound = errors.New("ERR Function not found")
+	errFunctionWriteRO  = errors.New("ERR Can not execute a script with write flag using *_ro command.")
+)
+
+// WithGoLibrary registers a library implemented in Go, it is loaded with FUNCTION LOAD and the
+// code "#!go name=<name>"
+func WithGoLibrary(name string, functions ...*function.Function) Option {
+	return func(s *server) {
+		s.functions.RegisterGoLibrary(name, functions...)
+	}
+}
+
+func (s *server) handleFCALL(args common.CommandArguments, c *connectedClient) (string, error) {
+	fcallArgs, ok := args.(common.EVALArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid FCALL argments %v", args)
+	}
+	f, exists := s.functions.Function(fcallArgs.Script)
+	if !exists {
+		return "", errFunctionNotFound
+	}
+	if fcallArgs.ReadOnly && !f.NoWrites {
+		return "", errFunctionWriteRO
+	}
+
+	run := func(ctx context.Context, call script.Caller) (string, error) {
+		return f.Call(ctx, call, fcallArgs.Keys, fcallArgs.Args)
+	}
+	return s.runScript("function "+f.Name, run, fcallArgs.ReadOnly || f.NoWrites, c)
+}
+
+func (s *server) handleFUNCTION(args common.CommandArguments) (string, error) {
+	fnArgs, ok := args.(common.FUNCTIONArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid FUNCTION argments %v", args)
+	}
+	switch fnArgs.Subcommand {
+	case common.FunctionSubcommandLOAD:
+		lib, err := s.functions.Load(fnArgs.Code, fnArgs.Replace)
+		if err != nil {
+			return "", err
+		}
+		s.dirty++
+		if fnArgs.Replace {
+			s.propagate("FUNCTION", "LOAD", "REPLACE", fnArgs.Code)
+		} else {
+			s.propagate("FUNCTION", "LOAD", fnArgs.Code)
+		}
+		return resp.BulkString(&lib.Name), nil
+	case common.FunctionSubcommandLIST:
+		return s.listFunctions(fnArgs.Pattern, fnArgs.WithCode), nil
+	case common.FunctionSubcommandDELETE:
+		if err := s.functions.Delete(fnArgs.Name); err != nil {
+			return "", err
+		}
+		s.dirty++
+		s.propagate("FUNCTION", "DELETE", fnArgs.Name)
+		return resp.SimpleString("OK"), nil
+	case common.FunctionSubcommandDUMP:
+		payload := string(s.functions.Dump())
+		return resp.BulkString(&payload), nil
+	case common.FunctionSubcommandRESTORE:
+		if err := s.functions.Restore([]byte(fnArgs.Code), function.RestorePolicy(fnArgs.Policy)); err != nil {
+			return "", err
+		}
+		s.dirty++
+		if fnArgs.Policy != "" {
+			s.propagate("FUNCTION", "RESTORE", fnArgs.Code, fnArgs.Policy)
+		} else {
+			s.propagate("FUNCTION", "RESTORE", fnArgs.Code)
+		}
+		return resp.SimpleString("OK"), nil
+	case common.FunctionSubcommandFLUSH:
+		s.functions.Flush()
+		s.dirty++
+		s.propagate("FUNCTION", "FLUSH")
+		return resp.SimpleString("OK"), nil
+	case common.FunctionSubcommandKILL:
+		return s.killScript()
+	default:
+		return "-ERR", fmt.Errorf("unsupported FUNCTION subcommand %v", args)
+	}
+}
+
+// listFunctions replies FUNCTION LIST with the libraries whose name matches pattern
+func (s *server) listFunctions(pattern string, withCode bool) string {
+	bulk := func(str string) string { return resp.BulkString(&str) }
+
+	var libraries []string
+	for _, lib := range s.functions.Libraries() {
+		if pattern != "" && !common.GlobMatch(pattern, lib.Name) {
+			continue
+		}
+		functions := make([]string, 0, len(lib.Functions))
+		for _, f := range lib.Functions {
+			var flags []string
+			if f.NoWrites {
+				flags = append(flags, bulk("no-writes"))
+			}
+			description := resp.BulkString(nil)
+			if f.Description != "" {
+				description = bulk(f.Description)
+			}
+			functions = append(functions, resp.RawArray([]string{
+				bulk("name"), bulk(f.Name),
+				bulk("description"), description,
+				bulk("flags"), resp.RawArray(flags),
+			}))
+		}
+		entry := []string{
+			bulk("library_name"), bulk(lib.Name),
+			bulk("engine"), bulk(lib.Engine),
+			bulk("functions"), resp.RawArray(functions),
+		}
+		if withCode {
+			entry = append(entry, bulk("library_code"), bulk(lib.Code))
+		}
+		libraries = append(libraries, resp.RawArray(entry))
+	}
+	return resp.RawArray(libraries)
+}
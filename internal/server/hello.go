@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+)
+
+var errNoProto = errors.New("NOPROTO unsupported protocol version")
+
+// handleHELLO switches the protocol of the connection, RESP3 clients receive maps and push
+// messages. The rest of the replies use the RESP2 types, which are valid RESP3 too.
+func (s *server) handleHELLO(args common.CommandArguments, c *connectedClient) (string, error) {
+	helloArgs, ok := args.(common.HELLOArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid HELLO argments %v", args)
+	}
+	switch helloArgs.ProtoVer {
+	case 0:
+	case 2, 3:
+		c.protocol = helloArgs.ProtoVer
+	default:
+		return "", errNoProto
+	}
+
+	mode := "standalone"
+	switch {
+	case s.cluster != nil:
+		mode = "cluster"
+	case s.sentinel != nil:
+		mode = "sentinel"
+	}
+	// like redis a replica reports its role even before it is connected to its master
+	role := "master"
+	if s.master != nil {
+		role = "replica"
+	}
+	info := []string{
+		bulkString("server"), bulkString("redis"),
+		bulkString("version"), bulkString(rdb.RedisVersion),
+		bulkString("proto"), resp.Integer(c.protocol),
+		bulkString("id"), resp.Integer(int(c.ID)),
+		bulkString("mode"), bulkString(mode),
+		bulkString("role"), bulkString(role),
+		bulkString("modules"), resp.RawArray(nil),
+	}
+	if c.protocol >= 3 {
+		return resp.Map(info), nil
+	}
+	return resp.RawArray(info), nil
+}
+
+// pubsubReply converts a Pub/Sub array reply to a push message for RESP3 clients, both types
+// share the same encoding except for the type byte
+func (c *connectedClient) pubsubReply(array string) string {
+	if c.protocol < 3 {
+		return array
+	}
+	return ">" + array[1:]
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"net"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// defaultMigrateTimeout is used by MIGRATE when its timeout is not positive
+const defaultMigrateTimeout = time.Second
+
+var (
+	errBusyKey        = errors.New("BUSYKEY Target key name already exists.")
+	errRestoreTTL     = errors.New("ERR keys with a time to live are not supported")
+	errMigrateConnect = errors.New("IOERR error or timeout connecting to the client")
+	errMigrateWriting = errors.New("IOERR error or timeout writing to target instance")
+	errMigrateReading = errors.New("IOERR error or timeout reading to target instance")
+)
+
+func (s *server) handleDUMP(args common.CommandArguments) (string, error) {
+	dumpArgs, ok := args.(common.DUMPArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid DUMP argments %v", args)
+	}
+	value, exists := s.db.Get(dumpArgs.Key)
+	if !exists {
+		return resp.BulkString(nil), nil
+	}
+	payload := string(rdb.Dump(value))
+	return resp.BulkString(&payload), nil
+}
+
+// handleRESTORE creates a key from a DUMP payload, it is propagated as a SET of the value
+func (s *server) handleRESTORE(args common.CommandArguments, c *connectedClient) (string, error) {
+	restoreArgs, ok := args.(common.RESTOREArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid RESTORE argments %v", args)
+	}
+	_, exists := s.db.Get(restoreArgs.Key)
+	if exists && !restoreArgs.Replace {
+		return "", errBusyKey
+	}
+	if restoreArgs.TTL > 0 {
+		return "", errRestoreTTL
+	}
+	value, err := rdb.Restore([]byte(restoreArgs.Payload))
+	if err != nil {
+		return "", err
+	}
+
+	s.db.Set(restoreArgs.Key, value)
+	s.propagate("SET", restoreArgs.Key, value)
+	s.touchKey(restoreArgs.Key, c)
+	s.notifyKeyspaceEvent(notifyGeneric, "restore", restoreArgs.Key)
+	return resp.SimpleString("OK"), nil
+}
+
+// handleMIGRATE moves keys to another instance with RESTORE-ASKING, then deletes them unless
+// COPY is given. Like redis the server blocks until the target replied or the timeout expired.
+func (s *server) handleMIGRATE(args common.CommandArguments, c *connectedClient) (string, error) {
+	migrateArgs, ok := args.(common.MIGRATEArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid MIGRATE argments %v", args)
+	}
+	if s.raft != nil {
+		return "", errMigrateRaft
+	}
+	timeout := time.Duration(migrateArgs.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultMigrateTimeout
+	}
+
+	var keys, values []string
+	for _, key := range migrateArgs.Keys {
+		if value, exists := s.db.Get(key); exists {
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+	}
+	if len(keys) == 0 {
+		return resp.SimpleString("NOKEY"), nil
+	}
+
+	addr := net.JoinHostPort(migrateArgs.Host, strconv.Itoa(migrateArgs.Port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", errMigrateConnect
+	}
+	defer conn.Close()
+
+	var buf []byte
+	preamble := 0
+	if migrateArgs.Password != "" {
+		auth := []string{"AUTH", migrateArgs.Password}
+		if migrateArgs.Username != "" {
+			auth = []string{"AUTH", migrateArgs.Username, migrateArgs.Password}
+		}
+		buf = aof.AppendCommand(buf, auth)
+		preamble++
+	}
+	if migrateArgs.DestinationDB != 0 {
+		buf = aof.AppendCommand(buf, []string{"SELECT", strconv.Itoa(migrateArgs.DestinationDB)})
+		preamble++
+	}
+	for i, key := range keys {
+		restore := []string{"RESTORE-ASKING", key, "0", string(rdb.Dump(values[i]))}
+		if migrateArgs.Replace {
+			restore = append(restore, "REPLACE")
+		}
+		buf = aof.AppendCommand(buf, restore)
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(buf); err != nil {
+		return "", errMigrateWriting
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	readReply := func() (resp.Reply, error) {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		reply, err := resp.ReadReply(reader)
+		if err != nil {
+			return reply, errMigrateReading
+		}
+		return reply, nil
+	}
+	for i := 0; i < preamble; i++ {
+		reply, err := readReply()
+		if err != nil {
+			return "", err
+		}
+		if reply.Kind == resp.KindError {
+			return "", fmt.Errorf("ERR Target instance replied with error: %s", reply.Str)
+		}
+	}
+	var migrated []string
+	var targetErr error
+	for _, key := range keys {
+		reply, err := readReply()
+		if err != nil {
+			// the keys restored so far are kept here, the target may have them too
+			return "", err
+		}
+		if reply.Kind == resp.KindError {
+			if targetErr == nil {
+				targetErr = fmt.Errorf("ERR Target instance replied with error: %s", reply.Str)
+			}
+			continue
+		}
+		migrated = append(migrated, key)
+	}
+
+	if !migrateArgs.Copy && len(migrated) > 0 {
+		for _, key := range migrated {
+			s.db.Delete(key)
+		}
+		s.propagate(append([]string{"DEL"}, migrated...)...)
+		for _, key := range migrated {
+			s.touchKey(key, c)
+			s.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+	}
+	if targetErr != nil {
+		return "", targetErr
+	}
+	return resp.SimpleString("OK"), nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/netpoll"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// In netpoll mode the clients are served by a few I/O goroutines waiting for all the connections
+// with epoll, see the netpoll package, instead of a worker goroutine with its buffered reader and
+// writer per client. The I/O goroutine of a client parses its commands from the bytes received,
+// executes them directly when it can, see direct.go, or sends them to the event loop like the
+// workers. The connection is paused until the event loop writes the reply, so the commands of a
+// client are still executed one after the other. The replies & pushed messages are written to the
+// output buffer of the connection without waiting for the network.
+
+// WithNetpoll serves the clients from ioGoroutines I/O goroutines, it is only supported on Linux
+func WithNetpoll(ioGoroutines int) Option {
+	return func(s *server) {
+		s.ioGoroutines = ioGoroutines
+	}
+}
+
+// pollClient is the context of a connection in netpoll mode
+type pollClient struct {
+	c *connectedClient
+	// killed is set once the client sent CLIENT KILL, the event loop already disconnected it
+	killed bool
+}
+
+// pollHandler handles the connections of the clients in netpoll mode
+type pollHandler struct {
+	s *server
+}
+
+// listenPoll starts the I/O goroutines, they are added to wg
+func (s *server) listenPoll(wg *sync.WaitGroup) *netpoll.Poller {
+	poller, err := netpoll.Listen(s.port, s.ioGoroutines, pollHandler{s: s}, wg)
+	if err != nil {
+		log.Fatalf("ERR Failed to start netpoll listener at :%d, %v", s.port, err)
+	}
+	log.Printf("Server started listening for connections at :%d with %d I/O goroutines", s.port, s.ioGoroutines)
+	s.ready <- true
+	return poller
+}
+
+func (h pollHandler) Open(conn *netpoll.Conn) error {
+	c := &connectedClient{addr: conn.RemoteAddr(), conn: conn, poll: conn}
+	if err := h.s.addClient(c); err != nil {
+		log.Printf("ERR trying to register a new client: %v", err)
+		return err
+	}
+	conn.Context = &pollClient{c: c}
+	log.Printf("client connection from %v", c.addr)
+	return nil
+}
+
+// Data executes the complete commands received, it stops after a command sent to the event loop
+// until the reply is written. GET & SET are executed from their raw arguments when they can, with
+// the reply appended to the output buffer of the connection.
+func (h pollHandler) Data(conn *netpoll.Conn, in []byte) int {
+	pc := conn.Context.(*pollClient)
+	args := resp.GetRawArgs()
+	defer resp.PutRawArgs(args)
+	consumed := 0
+	for !pc.killed {
+		n, err := args.Parse(in[consumed:])
+		if err != nil {
+			log.Printf("ERR  readCommand :%v ", err)
+			if resp.IsProtocolError(err) {
+				_, _ = conn.WriteString(resp.Error(err))
+			}
+			_ = conn.Close()
+			return len(in)
+		}
+		if n == 0 {
+			return consumed
+		}
+		consumed += n
+		if reply, executed := h.s.executeRaw(pc.c, args.Args); executed {
+			_ = conn.Append(reply.appendTo)
+			continue
+		}
+
+		cmd := common.Command{ClientID: pc.c.ID, Args: args.Strings()}
+		cmd.CMD, cmd.Arguments, err = resp.ParseCommand(cmd.Args)
+		var cmdErr *resp.CommandError
+		if errors.As(err, &cmdErr) {
+			// the command was read completely, let the server reply with the error
+			cmd.Err = cmdErr
+		} else if err != nil {
+			log.Printf("ERR  readCommand :%v ", err)
+			_ = conn.Close()
+			return len(in)
+		}
+		if response, executed := h.s.executeDirect(pc.c, cmd); executed {
+			_, _ = conn.WriteString(response)
+			continue
+		}
+		h.s.requests <- cmd
+		if clientArgs, ok := cmd.Arguments.(common.CLIENTArguments); ok && clientArgs.Subcommand == common.ClientSubcommandKILL {
+			log.Printf("client ID %d sent CLIENT KILL, closing the connection", pc.c.ID)
+			pc.killed = true
+			_ = conn.Close()
+			break
+		}
+		if cmd.ExpectsReply() {
+			conn.Pause()
+			return consumed
+		}
+	}
+	return len(in)
+}
+
+// Closed disconnects the client with CLIENT KILL like the workers
+func (h pollHandler) Closed(conn *netpoll.Conn) {
+	pc := conn.Context.(*pollClient)
+	if pc.killed {
+		return
+	}
+	h.s.requests <- common.Command{
+		CMD:       common.CLIENT,
+		Arguments: common.CLIENTArguments{Subcommand: common.ClientSubcommandKILL},
+		ClientID:  pc.c.ID,
+	}
+}
+
+// reply sends the response of the command the client is waiting for
+func (c *connectedClient) reply(response string) {
+	if c.poll == nil {
+		c.response <- response
+		return
+	}
+	_, _ = c.poll.WriteString(response)
+	c.poll.Resume()
+}
+
+// close disconnects the client, the worker or the I/O goroutine send CLIENT KILL once the
+// connection is closed. It can be called again until the client is disconnected.
+func (c *connectedClient) close() {
+	if c.poll == nil {
+		if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+			close(c.quit)
+		}
+		return
+	}
+	_ = c.poll.Close()
+}
+
+// streamWriter returns the writer of the replication stream of c, the writes wait for the network
+// like the ones on the connection of a worker
+func (c *connectedClient) streamWriter() io.Writer {
+	if c.poll == nil {
+		return c.conn
+	}
+	return flushingWriter{c.poll}
+}
+
+type flushingWriter struct {
+	conn *netpoll.Conn
+}
+
+func (w flushingWriter) Write(p []byte) (int, error) {
+	if _, err := w.conn.Write(p); err != nil {
+		return 0, err
+	}
+	if err := w.conn.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestNetpoll serves the clients from 2 I/O goroutines, with the commands executed directly, by the
+// event loop, pipelined, in transactions and Pub/Sub, and streams the writes to a replica
+func TestNetpoll(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const clients, rounds = 8, 100
+	port, replicaPort := uint(10_055), uint(10_056)
+	ctx := context.Background()
+
+	start := func(port uint, opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 64)
+		go Start(port, 2*clients, ready, quit, events, opts...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port), PoolSize: clients}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		quit <- true
+		for event := range events {
+			if event == EventSuccessfulShutdown {
+				return
+			}
+		}
+	}
+	eventually := func(what string, ok func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	rdb, quit, events := start(port, WithNetpoll(2))
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("key:%d:%d", c, i)
+				_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.Set(ctx, key, strings.Repeat("v", i*100), 0)
+					pipe.Incr(ctx, "counter")
+					return nil
+				})
+				if err != nil {
+					t.Errorf("pipeline: %v", err)
+					return
+				}
+				if got := rdb.Get(ctx, key).Val(); len(got) != i*100 {
+					t.Errorf("GET %s has %d bytes, want %d", key, len(got), i*100)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	common.AssertEquals(t, rdb.Get(ctx, "counter").Val(), strconv.Itoa(clients*rounds))
+
+	// the commands the event loop executes get their reply before the next command is read
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, "tx", "1", 0)
+	info := pipe.Info(ctx)
+	pipe.Get(ctx, "tx")
+	_, err := pipe.Exec(ctx)
+	common.ExpectNoError(t, err)
+	if !strings.Contains(info.Val(), "NumConnectedClients") {
+		t.Errorf("INFO in a transaction = %q", info.Val())
+	}
+	common.AssertEquals(t, rdb.Do(ctx, "LPUSH", "x", "a").Err().Error(), "unsupported command [LPUSH x a]")
+	assertInvalidBulkLength(t, port)
+	assertTooBigInline(t, port)
+
+	sub := rdb.Subscribe(ctx, "news")
+	_, err = sub.Receive(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, rdb.Publish(ctx, "news", "hello").Val(), int64(1))
+	msg, err := sub.ReceiveMessage(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, msg.Payload, "hello")
+	assertSlowSubscriberDisconnected(t, port, rdb)
+
+	replica, replicaQuit, replicaEvents := start(replicaPort)
+	common.ExpectNoError(t, replica.Do(ctx, "REPLICAOF", "localhost", port).Err())
+	eventually("the replica to sync", func() bool {
+		return replica.Get(ctx, "tx").Val() == "1"
+	})
+	common.ExpectNoError(t, rdb.Set(ctx, "after", "stream", 0).Err())
+	eventually("the write to be streamed", func() bool {
+		return replica.Get(ctx, "after").Val() == "stream"
+	})
+	stop(replica, replicaQuit, replicaEvents)
+
+	// the subscribed client is still connected, the shutdown closes its connection
+	stop(rdb, quit, events)
+	_ = sub.Close()
+}
+
+// BenchmarkNetpoll sends GET & SET one at a time to an I/O goroutine, the allocations counted are the
+// ones of the server
+func BenchmarkNetpoll(b *testing.B) {
+	benchmarkGETSET(b, 10_058, WithNetpoll(1))
+}
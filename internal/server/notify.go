@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// keyspaceEvents is the notify-keyspace-events bitmask
+type keyspaceEvents int
+
+const (
+	notifyKeyspace keyspaceEvents = 1 << iota // K
+	notifyKeyevent                            // E
+	notifyGeneric                             // g
+	notifyString                              // $
+	notifyList                                // l
+	notifySet                                 // s
+	notifyHash                                // h
+	notifyZset                                // z
+	notifyExpired                             // x
+	notifyEvicted                             // e
+	notifyStream                              // t
+	notifyKeyMiss                             // m
+	notifyModule                              // d
+	notifyNew                                 // n
+
+	// notifyAll is the A alias, it excludes the key miss and new key events like redis does
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset |
+		notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// the server has a single database, notifications are published for db 0
+const notifyDB = 0
+
+// This server has no key expiration or eviction yet, the x & e classes are accepted for
+// compatibility but no expired or evicted events are published.
+
+var errInvalidKeyspaceEvents = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+var keyspaceEventClasses = []struct {
+	flag  byte
+	class keyspaceEvents
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet},
+	{'h', notifyHash}, {'z', notifyZset}, {'x', notifyExpired}, {'e', notifyEvicted},
+	{'t', notifyStream}, {'d', notifyModule}, {'K', notifyKeyspace}, {'E', notifyKeyevent},
+	{'m', notifyKeyMiss}, {'n', notifyNew},
+}
+
+// parseKeyspaceEvents converts the notify-keyspace-events configuration to a bitmask
+func parseKeyspaceEvents(classes string) (keyspaceEvents, error) {
+	var events keyspaceEvents
+next:
+	for i := 0; i < len(classes); i++ {
+		if classes[i] == 'A' {
+			events |= notifyAll
+			continue
+		}
+		for _, c := range keyspaceEventClasses {
+			if c.flag == classes[i] {
+				events |= c.class
+				continue next
+			}
+		}
+		return 0, errInvalidKeyspaceEvents
+	}
+	return events, nil
+}
+
+// publishing returns true when events publishes notifications, the workers execute the commands
+// when it does not. Like redis the classes without K or E, or K & E without a class, are kept but
+// publish nothing.
+func (events keyspaceEvents) publishing() bool {
+	const channels = notifyKeyspace | notifyKeyevent
+	return events&channels != 0 && events&^channels != 0
+}
+
+// String formats the bitmask like redis CONFIG GET notify-keyspace-events does
+func (events keyspaceEvents) String() string {
+	var sb strings.Builder
+	if events&notifyAll == notifyAll {
+		sb.WriteByte('A')
+	}
+	for _, c := range keyspaceEventClasses {
+		if events&notifyAll == notifyAll && c.class&notifyAll != 0 {
+			continue
+		}
+		if events&c.class != 0 {
+			sb.WriteByte(c.flag)
+		}
+	}
+	return sb.String()
+}
+
+// WithNotifyKeyspaceEvents sets the initial notify-keyspace-events classes, like "KEA"
+func WithNotifyKeyspaceEvents(classes string) Option {
+	return func(s *server) {
+		events, err := parseKeyspaceEvents(classes)
+		if err != nil {
+			log.Fatalf("ERR invalid notify-keyspace-events %q: %v", classes, err)
+		}
+		s.notifyKeyspaceEvents = events
+	}
+}
+
+// notifyKeyspaceEvent publishes event for key to the __keyspace@0__:<key> and
+// __keyevent@0__:<event> channels when the class of the event is enabled. Every command
+// modifying the keyspace must call it.
+func (s *server) notifyKeyspaceEvent(class keyspaceEvents, event string, key string) {
+	events := s.notifyKeyspaceEvents
+	if events&class == 0 {
+		return
+	}
+	if events&notifyKeyspace != 0 {
+		s.publish(fmt.Sprintf("__keyspace@%d__:%s", notifyDB, key), event)
+	}
+	if events&notifyKeyevent != 0 {
+		s.publish(fmt.Sprintf("__keyevent@%d__:%s", notifyDB, event), key)
+	}
+}
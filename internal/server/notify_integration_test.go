@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"testing"
+)
+
+func TestKeyspaceNotifications(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_014)
+
+	go Start(port, 2, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+
+	config, err := rdb.ConfigGet(ctx, "notify-*").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(config), "[notify-keyspace-events ]")
+	err = rdb.ConfigSet(ctx, "notify-keyspace-events", "KQ").Err()
+	if err == nil {
+		t.Errorf("want error setting invalid classes")
+	}
+	// a CONFIG SET with an invalid value changes nothing
+	err = rdb.Do(ctx, "CONFIG", "SET", "notify-keyspace-events", "KEA", "busy-reply-threshold", "-1").Err()
+	if err == nil {
+		t.Errorf("want error setting a negative busy-reply-threshold")
+	}
+	config, err = rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(config), "[notify-keyspace-events ]")
+
+	sub := rdb.PSubscribe(ctx, "__key*@0__:*")
+	_, err = sub.Receive(ctx)
+	common.ExpectNoError(t, err)
+
+	// the classes without K or E are kept and publish nothing, like redis
+	common.ExpectNoError(t, rdb.ConfigSet(ctx, "notify-keyspace-events", "g$").Err())
+	config, err = rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(config), "[notify-keyspace-events g$]")
+	common.ExpectNoError(t, rdb.Set(ctx, "user:0", "a", 0).Err())
+
+	common.ExpectNoError(t, rdb.ConfigSet(ctx, "notify-keyspace-events", "KEg$").Err())
+
+	common.ExpectNoError(t, rdb.Set(ctx, "user:1", "a", 0).Err())
+	common.ExpectNoError(t, rdb.Del(ctx, "user:1").Err())
+	common.AssertEquals(t, rdb.Get(ctx, "user:1").Err(), redis.Nil)
+
+	want := []string{
+		"__keyspace@0__:user:1 set",
+		"__keyevent@0__:set user:1",
+		"__keyspace@0__:user:1 del",
+		"__keyevent@0__:del user:1",
+	}
+	for _, w := range want {
+		msg, err := sub.ReceiveMessage(ctx)
+		common.ExpectNoError(t, err)
+		common.AssertEquals(t, msg.Channel+" "+msg.Payload, w)
+	}
+
+	common.ExpectNoError(t, sub.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
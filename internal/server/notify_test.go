@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		classes string
+		want    string
+		wantErr bool
+	}{
+		{classes: "", want: ""},
+		{classes: "KEA", want: "AKE"},
+		{classes: "Eg$", want: "g$E"},
+		{classes: "Kmn", want: "Kmn"},
+		{classes: "Ag$lshzxetd", want: "A"},
+		{classes: "KEQ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.classes, func(t *testing.T) {
+			events, err := parseKeyspaceEvents(tt.classes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyspaceEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := events.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("parseKeyspaceEvents().String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
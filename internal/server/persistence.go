@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"github.com/rilopez/redis-wire-protocol/internal/keyspace"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronInterval is how often the server checks the save rules, like the redis hz default of 10
+const cronInterval = 100 * time.Millisecond
+
+// bgsaveRetryDelay is the time to wait before retrying an automatic BGSAVE that failed
+const bgsaveRetryDelay = 5 * time.Second
+
+var (
+	errBgsaveInProgress = errors.New("ERR Background save already in progress")
+	errRDBDisabled      = errors.New("ERR RDB persistence is not configured, start the server with a dbfilename")
+)
+
+// saveRule triggers a BGSAVE after seconds when at least changes writes happened
+type saveRule struct {
+	seconds int
+	changes int
+}
+
+// parseSaveRules parses the `save` configuration: pairs of seconds and changes like
+// "3600 1 300 100", an empty string disables the automatic snapshots
+func parseSaveRules(config string) ([]saveRule, error) {
+	fields := strings.Fields(config)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+func formatSaveRules(rules []saveRule) string {
+	fields := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		fields = append(fields, strconv.Itoa(rule.seconds), strconv.Itoa(rule.changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+// WithRDB enables RDB snapshots at dir/filename, the file is loaded at startup
+func WithRDB(dir string, filename string) Option {
+	return func(s *server) {
+		s.rdbDir = dir
+		s.rdbFilename = filename
+	}
+}
+
+// WithSaveRules sets the automatic snapshot rules, like "3600 1 300 100 60 10000"
+func WithSaveRules(rules string) Option {
+	return func(s *server) {
+		parsed, err := parseSaveRules(rules)
+		if err != nil {
+			log.Fatalf("ERR invalid save rules %q: %v", rules, err)
+		}
+		s.saveRules = parsed
+	}
+}
+
+// WithEnvelope compresses the RDB and append only files with compression, none or gzip, and
+// encrypts them when key is not nil. The files written without them are still loaded.
+func WithEnvelope(compression string, key *envelope.Key) Option {
+	return func(s *server) {
+		parsed, err := envelope.ParseCompression(compression)
+		if err != nil {
+			log.Fatalf("ERR %v", err)
+		}
+		s.fileEnvelope = envelope.Options{Compression: parsed, Key: key}
+	}
+}
+
+// bgsave keeps the state of the background save in progress
+type bgsave struct {
+	// dirty is the number of changes included in the snapshot
+	dirty int
+	done  chan error
+}
+
+func (s *server) rdbPath() string {
+	return filepath.Join(s.rdbDir, s.rdbFilename)
+}
+
+// snapshot returns a copy-on-write snapshot of the keyspace and the function libraries to be
+// saved, the clients keep modifying the keyspace while it is written. It is taken by the event
+// loop holding exclusive, the workers do not execute commands while it is copied.
+func (s *server) snapshot() (*keyspace.Snapshot, []string) {
+	db := s.db.Snapshot()
+
+	libraries := s.functions.Libraries()
+	functions := make([]string, 0, len(libraries))
+	for _, lib := range libraries {
+		functions = append(functions, lib.Code)
+	}
+	return db, functions
+}
+
+// writeRDB writes the snapshot to a temporary file renamed to the RDB path once it is complete,
+// a crash while saving never leaves a partial RDB file. The file is enveloped when opts are enabled.
+func writeRDB(path string, data rdb.Dataset, functions []string, now time.Time, opts envelope.Options) (err error) {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s: %w", tmp, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	var env *envelope.Writer
+	w := bufio.NewWriter(f)
+	if opts.Enabled() {
+		if env, err = envelope.NewWriter(f, opts); err != nil {
+			return err
+		}
+		w = bufio.NewWriter(env)
+	}
+	if err = rdb.Save(w, data, functions, now); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if env != nil {
+		if err = env.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadRDB loads the snapshot at startup, a missing file means an empty keyspace
+func (s *server) loadRDB() error {
+	if s.rdbFilename == "" {
+		return nil
+	}
+	err := s.loadRDBFile(s.rdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// loadRDBFile adds the keys and the function libraries of the snapshot at path
+func (s *server) loadRDBFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := envelope.NewReader(f, s.fileEnvelope.Key)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", path, err)
+	}
+	return s.loadSnapshot(r, path)
+}
+
+// loadSnapshot adds the keys and the function libraries of the RDB snapshot read from r, source
+// names it in the errors and logs. It runs at startup, before the clients are served, or in the
+// event loop holding exclusive.
+func (s *server) loadSnapshot(r io.Reader, source string) error {
+	start := s.now()
+	loaded, expired := 0, 0
+	err := rdb.Load(r, rdb.Loader{
+		Set: func(key, value string, isExpired bool) {
+			if isExpired {
+				expired++
+				return
+			}
+			s.db.Set(key, value)
+			loaded++
+		},
+		Function: func(code string) error {
+			_, err := s.functions.Load(code, false)
+			return err
+		},
+	}, start)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", source, err)
+	}
+	log.Printf("DB loaded from %s: %d keys, %d expired keys skipped, %v", source, loaded, expired, s.now().Sub(start))
+	return nil
+}
+
+func (s *server) handleSAVE() (string, error) {
+	if s.rdbFilename == "" {
+		return "", errRDBDisabled
+	}
+	if s.bgsave != nil {
+		return "", errBgsaveInProgress
+	}
+	db, functions := s.snapshot()
+	if err := writeRDB(s.rdbPath(), db, functions, s.now(), s.fileEnvelope); err != nil {
+		log.Printf("ERR saving the RDB file: %v", err)
+		return "", fmt.Errorf("ERR %v", err)
+	}
+	s.dirty = 0
+	s.lastSave = s.now()
+	s.lastBgsaveErr = nil
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) handleBGSAVE() (string, error) {
+	if s.rdbFilename == "" {
+		return "", errRDBDisabled
+	}
+	if s.bgsave != nil {
+		return "", errBgsaveInProgress
+	}
+	if s.aof != nil && s.aof.rewrite != nil {
+		return "", errBgsaveDuringRewrite
+	}
+	s.startBgsave()
+	return resp.SimpleString("Background saving started"), nil
+}
+
+// startBgsave copies the keyspace and writes it in a goroutine, the server keeps serving clients
+func (s *server) startBgsave() {
+	db, functions := s.snapshot()
+	save := &bgsave{dirty: s.dirty, done: make(chan error, 1)}
+	s.bgsave = save
+	s.lastBgsaveTry = s.now()
+	path, now, opts := s.rdbPath(), s.now(), s.fileEnvelope
+	go func() {
+		save.done <- writeRDB(path, db, functions, now, opts)
+	}()
+	log.Printf("background saving started")
+}
+
+// bgsaveDone returns the channel receiving the result of the background save, nil when there is
+// none in progress
+func (s *server) bgsaveDone() <-chan error {
+	if s.bgsave == nil {
+		return nil
+	}
+	return s.bgsave.done
+}
+
+func (s *server) bgsaveFinished(err error) {
+	if err != nil {
+		log.Printf("ERR background saving failed: %v", err)
+	} else {
+		log.Printf("background saving terminated with success")
+		s.dirty -= s.bgsave.dirty
+		s.lastSave = s.now()
+	}
+	s.lastBgsaveErr = err
+	s.bgsave = nil
+}
+
+func (s *server) handleLASTSAVE() (string, error) {
+	return resp.Integer(int(s.lastSave.Unix())), nil
+}
+
+// checkSaveRules starts a BGSAVE when a save rule is met
+func (s *server) checkSaveRules() {
+	if s.rdbFilename == "" || s.bgsave != nil || (s.aof != nil && s.aof.rewrite != nil) {
+		return
+	}
+	now := s.now()
+	if s.lastBgsaveErr != nil && now.Sub(s.lastBgsaveTry) < bgsaveRetryDelay {
+		return
+	}
+	for _, rule := range s.saveRules {
+		if s.dirty >= rule.changes && now.Sub(s.lastSave) >= time.Duration(rule.seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...", rule.changes, rule.seconds)
+			s.startBgsave()
+			return
+		}
+	}
+}
+
+// saveOnShutdown writes a final snapshot when save rules are configured, like redis does
+func (s *server) saveOnShutdown() {
+	if s.bgsave != nil {
+		s.bgsaveFinished(<-s.bgsave.done)
+	}
+	if s.rdbFilename == "" || len(s.saveRules) == 0 {
+		return
+	}
+	if _, err := s.handleSAVE(); err != nil {
+		log.Printf("ERR saving before shutdown: %v", err)
+	}
+}
+
+func (s *server) persistenceInfo(sb *strings.Builder) {
+	status := "ok"
+	if s.lastBgsaveErr != nil {
+		status = "err"
+	}
+	inProgress := 0
+	if s.bgsave != nil {
+		inProgress = 1
+	}
+	sb.WriteString("=== Persistence === \n")
+	sb.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\n", s.dirty))
+	sb.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\n", inProgress))
+	sb.WriteString(fmt.Sprintf("rdb_last_save_time:%d\n", s.lastSave.Unix()))
+	sb.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\n", status))
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRDBPersistence(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	port := uint(10_016)
+	ctx := context.Background()
+
+	start := func(opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 2)
+		go Start(port, 2, ready, quit, events, append([]Option{WithRDB(dir, "dump.rdb")}, opts...)...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		common.AssertEquals(t, <-events, EventAfterDisconnect)
+		quit <- true
+		common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+	}
+
+	rdb, quit, events := start(WithSaveRules("1 1"))
+	config, err := rdb.ConfigGet(ctx, "dbfilename").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(config), "[dbfilename dump.rdb]")
+	common.ExpectNoError(t, rdb.Set(ctx, "user:1", "ana", 0).Err())
+	common.ExpectNoError(t, rdb.Set(ctx, "user:2", "bob", 0).Err())
+	common.ExpectNoError(t, rdb.Do(ctx, "FUNCTION", "LOAD",
+		"#!lua name=mylib\nredis.register_function('hello', function() return 'hi' end)").Err())
+	common.ExpectNoError(t, rdb.Do(ctx, "SAVE").Err())
+	lastSave, err := rdb.Do(ctx, "LASTSAVE").Int64()
+	common.ExpectNoError(t, err)
+	if lastSave == 0 {
+		t.Errorf("want LASTSAVE after SAVE")
+	}
+
+	// the save rule triggers a BGSAVE one second after the last save
+	common.ExpectNoError(t, rdb.Del(ctx, "user:2").Err())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := rdb.Info(ctx).Result()
+		common.ExpectNoError(t, err)
+		if strings.Contains(info, "rdb_changes_since_last_save:0\n") {
+			common.AssertEquals(t, strings.Contains(info, "rdb_last_bgsave_status:ok\n"), true)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want a BGSAVE triggered by the save rule, got %s", info)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	stop(rdb, quit, events)
+
+	rdb, quit, events = start()
+	common.AssertEquals(t, rdb.Get(ctx, "user:1").Val(), "ana")
+	common.AssertEquals(t, rdb.Get(ctx, "user:2").Err(), redis.Nil)
+	common.AssertEquals(t, rdb.Do(ctx, "FCALL", "hello", 0).Val(), "hi")
+	common.AssertEquals(t, rdb.Do(ctx, "BGSAVE").Val(), "Background saving started")
+	stop(rdb, quit, events)
+}
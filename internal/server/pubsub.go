@@ -0,0 +1,338 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"log"
+	"sort"
+)
+
+// pushBufferSize is the number of pushed messages a client can have pending, like the pubsub
+// client-output-buffer-limit of redis a slow client filling its buffer is disconnected
+const pushBufferSize = 1024
+
+// pushOutputLimit is the number of bytes a client can have pending in netpoll mode before it is
+// disconnected like a slow client of a worker
+const pushOutputLimit = 1 << 20
+
+var (
+	errSubscribedContext = errors.New("ERR only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT allowed in this context")
+	errCrossSlot         = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+)
+
+// subscribers maps every channel, or pattern, to the clients subscribed to it
+type subscribers map[string]map[uint]*connectedClient
+
+func (subs subscribers) add(name string, c *connectedClient) {
+	clients, exists := subs[name]
+	if !exists {
+		clients = make(map[uint]*connectedClient)
+		subs[name] = clients
+	}
+	clients[c.ID] = c
+}
+
+func (subs subscribers) remove(name string, c *connectedClient) {
+	delete(subs[name], c.ID)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+}
+
+// pushMessage queues msg to be written by the client worker without blocking the server, it
+// returns false when the client is too slow to read its messages: msg is dropped and the client
+// disconnected
+func (c *connectedClient) pushMessage(msg string) bool {
+	if c.poll != nil {
+		if c.poll.Buffered() > pushOutputLimit {
+			log.Printf("ERR client ID %d output buffer is full, disconnecting it", c.ID)
+			c.close()
+			return false
+		}
+		_, err := c.poll.WriteString(msg)
+		return err == nil
+	}
+	select {
+	case c.push <- msg:
+		return true
+	default:
+	}
+	if c.conn != nil {
+		log.Printf("ERR client ID %d push buffer is full, disconnecting it", c.ID)
+		c.close()
+		// the worker can be blocked writing to the connection, closing it stops both its loops
+		_ = c.conn.Close()
+	}
+	return false
+}
+
+func (c *connectedClient) numSubscriptions() int {
+	return len(c.channels) + len(c.patterns) + len(c.shardChannels)
+}
+
+// allowedWhileSubscribed returns true for the commands a RESP2 client can send after subscribing
+func allowedWhileSubscribed(cmd common.Command) bool {
+	switch cmd.CMD {
+	case common.SUBSCRIBE, common.UNSUBSCRIBE, common.PSUBSCRIBE, common.PUNSUBSCRIBE,
+		common.SSUBSCRIBE, common.SUNSUBSCRIBE, common.PING:
+		return true
+	case common.CLIENT:
+		// workers send CLIENT KILL on disconnection
+		clientArgs, ok := cmd.Arguments.(common.CLIENTArguments)
+		return ok && clientArgs.Subcommand == common.ClientSubcommandKILL
+	}
+	return false
+}
+
+func (s *server) handlePING(args common.CommandArguments, c *connectedClient) (string, error) {
+	pingArgs, ok := args.(common.PINGArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid PING argments %v", args)
+	}
+	if c.protocol < 3 && c.numSubscriptions() > 0 {
+		message := ""
+		if pingArgs.Message != nil {
+			message = *pingArgs.Message
+		}
+		return resp.Array([]interface{}{"pong", message}), nil
+	}
+	if pingArgs.Message != nil {
+		return resp.BulkString(pingArgs.Message), nil
+	}
+	return resp.SimpleString("PONG"), nil
+}
+
+// pubsubType describes one family of subscribe commands: channels, patterns or shard channels
+type pubsubType struct {
+	subscribeKind   string
+	unsubscribeKind string
+	// subscriptions returns the client subscriptions of this type
+	subscriptions func(c *connectedClient) *map[string]struct{}
+	subscribers   subscribers
+	// count is the number of subscriptions reported in the subscribe & unsubscribe messages
+	count func(c *connectedClient) int
+}
+
+func (s *server) pubsubType(cmdID common.CommandID) pubsubType {
+	switch cmdID {
+	case common.PSUBSCRIBE, common.PUNSUBSCRIBE:
+		return pubsubType{
+			subscribeKind:   "psubscribe",
+			unsubscribeKind: "punsubscribe",
+			subscriptions:   func(c *connectedClient) *map[string]struct{} { return &c.patterns },
+			subscribers:     s.patterns,
+			count:           func(c *connectedClient) int { return len(c.channels) + len(c.patterns) },
+		}
+	case common.SSUBSCRIBE, common.SUNSUBSCRIBE:
+		return pubsubType{
+			subscribeKind:   "ssubscribe",
+			unsubscribeKind: "sunsubscribe",
+			subscriptions:   func(c *connectedClient) *map[string]struct{} { return &c.shardChannels },
+			subscribers:     s.shardChannels,
+			count:           func(c *connectedClient) int { return len(c.shardChannels) },
+		}
+	}
+	return pubsubType{
+		subscribeKind:   "subscribe",
+		unsubscribeKind: "unsubscribe",
+		subscriptions:   func(c *connectedClient) *map[string]struct{} { return &c.channels },
+		subscribers:     s.channels,
+		count:           func(c *connectedClient) int { return len(c.channels) + len(c.patterns) },
+	}
+}
+
+// checkSameSlot fails when the sharded channels of a command are mapped to different slots
+func checkSameSlot(cmdID common.CommandID, channels []string) error {
+	if cmdID != common.SSUBSCRIBE && cmdID != common.SUNSUBSCRIBE {
+		return nil
+	}
+	for _, channel := range channels[1:] {
+		if common.KeySlot(channel) != common.KeySlot(channels[0]) {
+			return errCrossSlot
+		}
+	}
+	return nil
+}
+
+// handleSUBSCRIBE replies one subscribe message per channel, like redis does
+func (s *server) handleSUBSCRIBE(cmdID common.CommandID, args common.CommandArguments, c *connectedClient) (string, error) {
+	subArgs, ok := args.(common.SUBSCRIBEArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid SUBSCRIBE argments %v", args)
+	}
+	if err := checkSameSlot(cmdID, subArgs.Channels); err != nil {
+		return "", err
+	}
+	t := s.pubsubType(cmdID)
+	subscribed := t.subscriptions(c)
+	if *subscribed == nil {
+		*subscribed = make(map[string]struct{})
+	}
+
+	var response string
+	for _, name := range subArgs.Channels {
+		(*subscribed)[name] = struct{}{}
+		t.subscribers.add(name, c)
+		response += c.pubsubReply(resp.Array([]interface{}{t.subscribeKind, name, t.count(c)}))
+	}
+	return response, nil
+}
+
+// handleUNSUBSCRIBE removes the given subscriptions or all of them when no channel is given
+func (s *server) handleUNSUBSCRIBE(cmdID common.CommandID, args common.CommandArguments, c *connectedClient) (string, error) {
+	subArgs, ok := args.(common.SUBSCRIBEArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid UNSUBSCRIBE argments %v", args)
+	}
+	t := s.pubsubType(cmdID)
+	subscribed := *t.subscriptions(c)
+
+	names := subArgs.Channels
+	if len(names) == 0 {
+		names = sortedNames(subscribed)
+	} else if err := checkSameSlot(cmdID, names); err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return c.pubsubReply(resp.RawArray([]string{resp.BulkString(&t.unsubscribeKind), resp.BulkString(nil), resp.Integer(t.count(c))})), nil
+	}
+	var response string
+	for _, name := range names {
+		delete(subscribed, name)
+		t.subscribers.remove(name, c)
+		response += c.pubsubReply(resp.Array([]interface{}{t.unsubscribeKind, name, t.count(c)}))
+	}
+	return response, nil
+}
+
+// unsubscribeAll removes every subscription of a disconnected client
+func (s *server) unsubscribeAll(c *connectedClient) {
+	for name := range c.channels {
+		s.channels.remove(name, c)
+	}
+	for pattern := range c.patterns {
+		s.patterns.remove(pattern, c)
+	}
+	for name := range c.shardChannels {
+		s.shardChannels.remove(name, c)
+	}
+	c.channels = nil
+	c.patterns = nil
+	c.shardChannels = nil
+}
+
+func (s *server) handlePUBLISH(cmdID common.CommandID, args common.CommandArguments) (string, error) {
+	pubArgs, ok := args.(common.PUBLISHArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid PUBLISH argments %v", args)
+	}
+	if cmdID == common.SPUBLISH {
+		return resp.Integer(s.publishShard(pubArgs.Channel, pubArgs.Message)), nil
+	}
+	if s.cluster != nil {
+		s.broadcastPublish(pubArgs.Channel, pubArgs.Message)
+	}
+	return resp.Integer(s.publish(pubArgs.Channel, pubArgs.Message)), nil
+}
+
+// publish pushes message to the subscribers of channel and to the clients subscribed to a
+// matching pattern, it returns the number of clients receiving the message
+func (s *server) publish(channel, message string) int {
+	receivers := 0
+	if clients, exists := s.channels[channel]; exists {
+		msg := resp.Array([]interface{}{"message", channel, message})
+		for _, c := range clients {
+			if c.pushMessage(c.pubsubReply(msg)) {
+				receivers++
+			}
+		}
+	}
+	for pattern, clients := range s.patterns {
+		if !common.GlobMatch(pattern, channel) {
+			continue
+		}
+		msg := resp.Array([]interface{}{"pmessage", pattern, channel, message})
+		for _, c := range clients {
+			if c.pushMessage(c.pubsubReply(msg)) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// publishShard pushes message to the subscribers of the shard channel, pattern subscriptions do
+// not receive sharded messages
+func (s *server) publishShard(channel, message string) int {
+	receivers := 0
+	msg := resp.Array([]interface{}{"smessage", channel, message})
+	for _, c := range s.shardChannels[channel] {
+		if c.pushMessage(c.pubsubReply(msg)) {
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func (s *server) handlePUBSUB(args common.CommandArguments) (string, error) {
+	pubsubArgs, ok := args.(common.PUBSUBArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid PUBSUB argments %v", args)
+	}
+	switch pubsubArgs.Subcommand {
+	case common.PubSubSubcommandCHANNELS:
+		return listChannels(s.channels, pubsubArgs.Args), nil
+	case common.PubSubSubcommandSHARDCHANNELS:
+		return listChannels(s.shardChannels, pubsubArgs.Args), nil
+	case common.PubSubSubcommandNUMSUB:
+		return countSubscribers(s.channels, pubsubArgs.Args), nil
+	case common.PubSubSubcommandSHARDNUMSUB:
+		return countSubscribers(s.shardChannels, pubsubArgs.Args), nil
+	case common.PubSubSubcommandNUMPAT:
+		return resp.Integer(len(s.patterns)), nil
+	default:
+		return "-ERR", fmt.Errorf("unsupported PUBSUB subcommand %v", args)
+	}
+}
+
+// listChannels replies the channels with subscribers matching the optional pattern
+func listChannels(subs subscribers, args []string) string {
+	var channels []interface{}
+	for _, channel := range subs.names() {
+		if len(args) == 0 || common.GlobMatch(args[0], channel) {
+			channels = append(channels, channel)
+		}
+	}
+	return resp.Array(channels)
+}
+
+// countSubscribers replies every channel followed by its number of subscribers
+func countSubscribers(subs subscribers, channels []string) string {
+	numSub := make([]interface{}, 0, 2*len(channels))
+	for _, channel := range channels {
+		numSub = append(numSub, channel, len(subs[channel]))
+	}
+	return resp.Array(numSub)
+}
+
+// names returns the channels or patterns with subscribers sorted
+func (subs subscribers) names() []string {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedNames returns the subscriptions of a client sorted
+func sortedNames(subscribed map[string]struct{}) []string {
+	names := make([]string, 0, len(subscribed))
+	for name := range subscribed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"go.uber.org/goleak"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_012)
+
+	go Start(port, 2, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+
+	conn := rdb.Conn(ctx)
+	val, err := do(ctx, conn, "SUBSCRIBE", "news").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(val), "[subscribe news 1]")
+	err = do(ctx, conn, "GET", "x").Err()
+	if err == nil || err.Error() != errSubscribedContext.Error() {
+		t.Errorf("want subscribed context error, got %v", err)
+	}
+	val, err = do(ctx, conn, "PING").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(val), "[pong ]")
+	val, err = do(ctx, conn, "UNSUBSCRIBE").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(val), "[unsubscribe news 0]")
+	common.ExpectNoError(t, conn.Close())
+
+	sub := rdb.Subscribe(ctx, "news")
+	subscription, err := sub.Receive(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, subscription.(*redis.Subscription).Count, 1)
+	common.ExpectNoError(t, sub.PSubscribe(ctx, "n*"))
+	subscription, err = sub.Receive(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, subscription.(*redis.Subscription).Count, 2)
+
+	receivers, err := rdb.Publish(ctx, "news", "hello").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, receivers, int64(2))
+	msg, err := sub.ReceiveMessage(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, msg.Channel, "news")
+	common.AssertEquals(t, msg.Payload, "hello")
+	common.AssertEquals(t, msg.Pattern, "")
+	msg, err = sub.ReceiveMessage(ctx)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, msg.Pattern, "n*")
+	common.AssertEquals(t, msg.Payload, "hello")
+
+	channels, err := rdb.PubSubChannels(ctx, "n*").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(channels), "[news]")
+	numSub, err := rdb.PubSubNumSub(ctx, "news", "sports").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, numSub["news"], int64(1))
+	common.AssertEquals(t, numSub["sports"], int64(0))
+	numPat, err := rdb.PubSubNumPat(ctx).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, numPat, int64(1))
+
+	common.ExpectNoError(t, sub.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	receivers, err = rdb.Publish(ctx, "news", "bye").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, receivers, int64(0))
+
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+func TestShardedPubSub(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_013)
+
+	go Start(port, 2, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+
+	// go-redis v8 has no sharded Pub/Sub API, the subscriber uses a plain connection
+	conn := dialRaw(t, port)
+	send := conn.send
+
+	common.AssertEquals(t, send("SSUBSCRIBE", "{user1}.feed", "{user1}.alerts"),
+		resp.Array([]interface{}{"ssubscribe", "{user1}.feed", 1}))
+	common.AssertEquals(t, conn.read(), resp.Array([]interface{}{"ssubscribe", "{user1}.alerts", 2}))
+	common.AssertEquals(t, send("SSUBSCRIBE", "a", "b"), resp.Error(errCrossSlot))
+
+	numSub, err := rdb.Do(ctx, "PUBSUB", "SHARDNUMSUB", "{user1}.feed", "other").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(numSub), "[{user1}.feed 1 other 0]")
+	channels, err := rdb.Do(ctx, "PUBSUB", "SHARDCHANNELS").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(channels), "[{user1}.alerts {user1}.feed]")
+	channels, err = rdb.Do(ctx, "PUBSUB", "CHANNELS").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(channels), "[]")
+
+	receivers, err := rdb.Publish(ctx, "{user1}.feed", "classic").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, receivers, int64(0))
+	receivers, err = rdb.Do(ctx, "SPUBLISH", "{user1}.feed", "sharded").Int64()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, receivers, int64(1))
+	common.AssertEquals(t, conn.read(), resp.Array([]interface{}{"smessage", "{user1}.feed", "sharded"}))
+
+	common.AssertEquals(t, send("SUNSUBSCRIBE", "{user1}.feed"),
+		resp.Array([]interface{}{"sunsubscribe", "{user1}.feed", 1}))
+
+	conn.close()
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+// assertSlowSubscriberDisconnected publishes to a subscriber that stopped reading until it is
+// disconnected, the subscriber is no longer counted once its messages are dropped
+func assertSlowSubscriberDisconnected(t *testing.T, port uint, rdb *redis.Client) {
+	ctx := context.Background()
+	slow := dialRaw(t, port)
+	defer slow.conn.Close()
+	slow.send("SUBSCRIBE", "slow")
+	message := strings.Repeat("m", 16<<10)
+	for i := 0; ; i++ {
+		receivers, err := rdb.Publish(ctx, "slow", message).Result()
+		common.ExpectNoError(t, err)
+		if receivers == 0 {
+			break
+		}
+		if i == 100_000 {
+			t.Fatalf("the subscriber that stopped reading is still receiving messages")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rdb.PubSubNumSub(ctx, "slow").Val()["slow"] != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the subscriber that stopped reading is still subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rawConn is a plain connection used to test the replies go-redis v8 does not support, like
+// sharded Pub/Sub or RESP3 pushes
+type rawConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *textproto.Reader
+}
+
+func dialRaw(t *testing.T, port uint) *rawConn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	common.ExpectNoError(t, err)
+	return &rawConn{t: t, conn: conn, reader: textproto.NewReader(bufio.NewReader(conn))}
+}
+
+// send writes a command and returns its serialized reply
+func (c *rawConn) send(args ...string) string {
+	_, err := c.conn.Write([]byte(resp.Array(stringsToInterfaces(args))))
+	common.ExpectNoError(c.t, err)
+	return c.read()
+}
+
+// read returns the next serialized reply or pushed message
+func (c *rawConn) read() string {
+	reply, err := resp.ReadReply(c.reader)
+	common.ExpectNoError(c.t, err)
+	return reply.Serialize()
+}
+
+func (c *rawConn) close() {
+	common.ExpectNoError(c.t, c.conn.Close())
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	elems := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		elems = append(elems, v)
+	}
+	return elems
+}
@@ -0,0 +1,545 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/cluster"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/raft"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultRaftSnapshotEntries is the number of entries applied after the last snapshot that
+	// triggers the compaction of the raft log
+	defaultRaftSnapshotEntries = 1000
+	raftIDFilename             = "id"
+)
+
+var (
+	errRaftDisabled       = errors.New("ERR This instance has raft support disabled")
+	errRaftNoLeader       = errors.New("TRYAGAIN No raft leader, the members are electing one")
+	errRaftLeadershipLost = errors.New("ERR leadership lost, the command may or may not have been applied")
+	errRaftShuttingDown   = errors.New("ERR the server is shutting down")
+	errRaftBootstrapped   = errors.New("ERR This node is already a member of a raft cluster")
+	errRaftCluster        = errors.New("raft mode is not compatible with cluster mode")
+	errRaftAppendOnly     = errors.New("raft mode does not use the append only file, the raft log keeps the writes")
+	errRaftReplicaOf      = errors.New("raft mode is not compatible with replication, the raft members replicate the writes")
+	errReplicaofRaft      = errors.New("ERR REPLICAOF not allowed in raft mode.")
+	errMigrateRaft        = errors.New("ERR MIGRATE not allowed in raft mode.")
+)
+
+// WithRaft enables the raft mode, the raft log of this node is kept in dirname inside the directory
+// of the RDB file. The write commands are committed by the majority of the members before they
+// are executed, the members are added with RAFT INIT on the first one then RAFT ADD on the leader.
+func WithRaft(dirname string) Option {
+	return func(s *server) {
+		s.raftDirname = dirname
+	}
+}
+
+// raftNode is the state of the server in raft mode. The leader appends the write commands to the
+// log and replies once the entry is committed and executed, the followers redirect the clients to
+// the leader. Every member executes the committed entries in order, the snapshot of the log is
+// the RDB of the keyspace.
+type raftNode struct {
+	node      *raft.Node
+	storage   *raft.Storage
+	transport *busTransport
+	// addrs are the addresses of the senders of messages, a new member answers its leader before
+	// it knows the configuration
+	addrs map[string]string
+	// waiting are the clients waiting for the entries proposed by this leader, by index
+	waiting map[uint64]raftWaiting
+}
+
+// raftWaiting is a client waiting for the entry proposed in term to be applied
+type raftWaiting struct {
+	c    *connectedClient
+	term uint64
+}
+
+func (s *server) raftDir() string {
+	return filepath.Join(s.rdbDir, s.raftDirname)
+}
+
+// loadRaft restores the keyspace from the snapshot & the committed entries of the raft log, the
+// RDB file and the append only file are not loaded
+func (s *server) loadRaft() error {
+	switch {
+	case s.clusterConfigFile != "":
+		return errRaftCluster
+	case s.appendOnly:
+		return errRaftAppendOnly
+	case s.master != nil:
+		return errRaftReplicaOf
+	}
+	dir := s.raftDir()
+	storage, state, err := raft.OpenStorage(dir)
+	if err != nil {
+		return err
+	}
+	id, err := loadRaftID(dir)
+	if err != nil {
+		_ = storage.Close()
+		return err
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", s.port)
+	s.raft = &raftNode{
+		node:    raft.NewNode(id, addr, storage, state, 0),
+		storage: storage,
+		addrs:   make(map[string]string),
+		waiting: make(map[uint64]raftWaiting),
+	}
+	s.loading = true
+	defer func() { s.loading = false }()
+	s.raftReady()
+	status := s.raft.node.Status()
+	log.Printf("raft node %s at term %d, applied %d entries, %d members", id, status.Term, status.Applied,
+		len(status.Config))
+	return nil
+}
+
+// loadRaftID returns the ID of this node saved in dir, it is generated the first time
+func loadRaftID(dir string) (string, error) {
+	path := filepath.Join(dir, raftIDFilename)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id := cluster.NewNodeID()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// stopRaft stops the transport and closes the raft log
+func (s *server) stopRaft() {
+	if s.raft == nil {
+		return
+	}
+	s.stopRaftTransport()
+	if err := s.raft.storage.Close(); err != nil {
+		log.Printf("ERR closing the raft log: %v", err)
+	}
+}
+
+// raftCheck stops the server when the raft log can not be written, the node would otherwise
+// acknowledge entries it lost
+func (s *server) raftCheck(err error) {
+	if err != nil {
+		log.Fatalf("ERR writing the raft log: %v", err)
+	}
+}
+
+func (s *server) raftCron() {
+	if s.raft == nil {
+		return
+	}
+	s.raftCheck(s.raft.node.Tick())
+	s.raftReady()
+}
+
+// raftReady sends the messages of the node, installs its snapshot and applies the committed
+// entries. It is called after every call changing the state of the node.
+func (s *server) raftReady() {
+	r := s.raft
+	for _, m := range r.node.Messages() {
+		s.raftSend(m)
+	}
+	if snapshot := r.node.PendingSnapshot(); snapshot != nil {
+		s.installRaftSnapshot(snapshot)
+	}
+	for _, entry := range r.node.CommittedEntries() {
+		s.applyRaftEntry(entry)
+	}
+	status := r.node.Status()
+	if status.Role != raft.Leader {
+		// the next leader may or may not commit the entries of this one
+		s.failRaftWaiting(errRaftLeadershipLost)
+	}
+	if status.Applied-status.SnapshotIndex >= s.raftSnapshotEntries && !s.loading {
+		s.compactRaftLog(status.Applied)
+	}
+}
+
+// failRaftWaiting replies err to the clients waiting for their entries
+func (s *server) failRaftWaiting(err error) {
+	if s.raft == nil {
+		return
+	}
+	for index, w := range s.raft.waiting {
+		delete(s.raft.waiting, index)
+		w.c.reply(resp.Error(err))
+	}
+}
+
+// installRaftSnapshot replaces the keyspace and the functions with the ones of the snapshot sent
+// by the leader
+func (s *server) installRaftSnapshot(snapshot *raft.Snapshot) {
+	log.Printf("installing the raft snapshot at index %d, %d bytes", snapshot.Index, len(snapshot.Data))
+	s.db = s.newKeyspace()
+	s.functions.Flush()
+	for _, clients := range s.watchedKeys {
+		for _, c := range clients {
+			c.dirtyCAS = true
+		}
+	}
+	if len(snapshot.Data) == 0 {
+		return
+	}
+	if err := s.loadSnapshot(bytes.NewReader(snapshot.Data), "RAFT"); err != nil {
+		log.Fatalf("ERR loading the raft snapshot: %v", err)
+	}
+}
+
+// compactRaftLog replaces the entries up to index with the RDB of the keyspace
+func (s *server) compactRaftLog(index uint64) {
+	db, functions := s.snapshot()
+	var buf bytes.Buffer
+	if err := rdb.Save(&buf, db, functions, s.now()); err != nil {
+		log.Printf("ERR saving the raft snapshot: %v", err)
+		return
+	}
+	s.raftCheck(s.raft.node.Compact(index, buf.Bytes()))
+	log.Printf("raft log compacted up to index %d, snapshot of %d bytes", index, buf.Len())
+}
+
+// applyRaftEntry executes a committed entry and replies to the client waiting for it
+func (s *server) applyRaftEntry(entry raft.Entry) {
+	r := s.raft
+	w, waiting := r.waiting[entry.Index]
+	if waiting {
+		delete(r.waiting, entry.Index)
+		if w.term != entry.Term {
+			// the entry of the client was replaced by the one of another leader
+			w.c.reply(resp.Error(errRaftLeadershipLost))
+			waiting = false
+		}
+	}
+
+	var reply string
+	switch entry.Type {
+	case raft.EntryCommand:
+		c := &connectedClient{protocol: 2}
+		if waiting {
+			c = w.c
+		}
+		reply = s.applyRaftCommands(entry.Data, c)
+	case raft.EntryConfig:
+		s.raftConfigApplied()
+		reply = resp.SimpleString("OK")
+	default:
+		return
+	}
+	if waiting {
+		w.c.reply(reply)
+	}
+}
+
+// raftConfigApplied closes the links to the members removed
+func (s *server) raftConfigApplied() {
+	t := s.raft.transport
+	if t == nil {
+		return
+	}
+	config := s.raft.node.Status().Config
+	for id := range t.links {
+		if _, ok := config.Member(id); !ok {
+			t.closeLink(id)
+		}
+	}
+}
+
+// applyRaftCommands executes the commands of an entry on behalf of c, the commands of a
+// transaction follow MULTI, like in the append only file
+func (s *server) applyRaftCommands(data []byte, c *connectedClient) string {
+	var commands [][]string
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		args, err := resp.ReadArray(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("ERR invalid raft entry: %v", err)
+			return resp.Error(fmt.Errorf("ERR invalid raft entry: %v", err))
+		}
+		commands = append(commands, args)
+	}
+	if len(commands) == 0 || len(commands[0]) == 0 {
+		return resp.Error(errors.New("ERR invalid raft entry: no command"))
+	}
+
+	var reply string
+	if strings.EqualFold(commands[0][0], "MULTI") && len(commands) > 1 {
+		reply = s.applyRaftTransaction(commands[0][1:], commands[1:len(commands)-1], c)
+	} else {
+		reply = s.executeRaftCommand(commands[0], c)
+	}
+	s.flushAOF()
+	return reply
+}
+
+// applyRaftTransaction executes the commands of a transaction unless one of the keys watched by
+// the client changed since EXEC: watched lists the keys followed by 1 and their value at EXEC, or
+// by 0 and an empty value when they did not exist
+func (s *server) applyRaftTransaction(watched []string, commands [][]string, c *connectedClient) string {
+	for i := 0; i+2 < len(watched); i += 3 {
+		key, exists, value := watched[i], watched[i+1] == "1", watched[i+2]
+		current, ok := s.db.Get(key)
+		if ok != exists || current != value {
+			return resp.NullArray()
+		}
+	}
+	s.beginAtomic()
+	defer s.endAtomic()
+	replies := make([]string, 0, len(commands))
+	for _, args := range commands {
+		replies = append(replies, s.executeRaftCommand(args, c))
+	}
+	return resp.RawArray(replies)
+}
+
+func (s *server) executeRaftCommand(args []string, c *connectedClient) string {
+	cmdID, cmdArgs, err := resp.ParseCommand(args)
+	response := ""
+	if err == nil {
+		response, err = s.execute(common.Command{CMD: cmdID, ClientID: c.ID, Arguments: cmdArgs, Args: args}, c)
+	}
+	if err != nil {
+		return resp.Error(err)
+	}
+	return response
+}
+
+// raftReplicated returns true for the commands appended to the raft log: the write commands,
+// the scripts and the functions that can write and the changes of the functions
+func raftReplicated(cmd common.Command) bool {
+	if cmd.CMD.IsWrite() {
+		return true
+	}
+	switch args := cmd.Arguments.(type) {
+	case common.EVALArguments:
+		return !args.ReadOnly
+	case common.FUNCTIONArguments:
+		switch args.Subcommand {
+		case common.FunctionSubcommandLOAD, common.FunctionSubcommandDELETE,
+			common.FunctionSubcommandRESTORE, common.FunctionSubcommandFLUSH:
+			return true
+		}
+	}
+	return false
+}
+
+// raftProposes returns true when cmd is appended to the raft log instead of being executed
+func (s *server) raftProposes(cmd common.Command, c *connectedClient) bool {
+	return s.raft != nil && c.ID != 0 && cmd.Err == nil && cmd.CMD != common.MIGRATE && raftReplicated(cmd)
+}
+
+// raftArgs returns the command appended to the log for cmd, EVALSHA is sent as EVAL since the
+// members do not share their script cache
+func (s *server) raftArgs(cmd common.Command) ([]string, error) {
+	if cmd.CMD != common.EVALSHA {
+		return cmd.Args, nil
+	}
+	evalArgs := cmd.Arguments.(common.EVALArguments)
+	sc, ok := s.scripts[strings.ToLower(evalArgs.Script)]
+	if !ok {
+		return nil, errNoScript
+	}
+	return append([]string{"EVAL", sc.Source}, cmd.Args[2:]...), nil
+}
+
+// proposeCMD appends cmd to the raft log, the client gets its reply once it is committed
+func (s *server) proposeCMD(cmd common.Command, c *connectedClient) (string, error) {
+	args, err := s.raftArgs(cmd)
+	if err != nil {
+		return "", err
+	}
+	return s.raftPropose(c, [][]string{args})
+}
+
+// proposeEXEC appends the queued commands of a transaction to the raft log, with the value of the
+// keys watched by the client: the writes appended before the transaction and not yet applied can
+// still modify them, the members discard the transaction when they did
+func (s *server) proposeEXEC(tx *transaction, watched map[string]struct{}, c *connectedClient) (string, error) {
+	multi := []string{"MULTI"}
+	for key := range watched {
+		if value, exists := s.db.Get(key); exists {
+			multi = append(multi, key, "1", value)
+		} else {
+			multi = append(multi, key, "0", "")
+		}
+	}
+	commands := [][]string{multi}
+	for _, cmd := range tx.commands {
+		args, err := s.raftArgs(cmd)
+		if err != nil {
+			return "", err
+		}
+		commands = append(commands, args)
+	}
+	commands = append(commands, []string{"EXEC"})
+	return s.raftPropose(c, commands)
+}
+
+// raftTransactionProposed returns true when a command of the transaction is appended to the log
+func (s *server) raftTransactionProposed(tx *transaction, c *connectedClient) bool {
+	for _, cmd := range tx.commands {
+		if s.raftProposes(cmd, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) raftPropose(c *connectedClient, commands [][]string) (string, error) {
+	if s.getState() == serverStateShuttingDown {
+		return "", errRaftShuttingDown
+	}
+	var data []byte
+	for _, args := range commands {
+		data = aof.AppendCommand(data, args)
+	}
+	index, term, err := s.raft.node.Propose(data)
+	if errors.Is(err, raft.ErrNotLeader) {
+		return "", s.raftLeaderError(0)
+	}
+	s.raftCheck(err)
+	return s.raftWait(c, index, term)
+}
+
+// raftWait makes c wait for the entry at index, its reply is sent when the entry is applied
+func (s *server) raftWait(c *connectedClient, index, term uint64) (string, error) {
+	s.raft.waiting[index] = raftWaiting{c: c, term: term}
+	s.raftReady()
+	return "", nil
+}
+
+// raftLeaderError redirects to the leader the clients of the followers
+func (s *server) raftLeaderError(slot int) error {
+	addr := s.raft.node.LeaderAddr()
+	if addr == "" || s.raft.node.Status().Role == raft.Leader {
+		// the leader accepts commands once it committed an entry of its term
+		return errRaftNoLeader
+	}
+	return fmt.Errorf("MOVED %d %s", slot, addr)
+}
+
+// raftRedirect returns the MOVED error of the commands with keys and of the commands appended to
+// the log when this node is not the leader, so the clients read what the majority committed
+func (s *server) raftRedirect(cmd common.Command, c *connectedClient) error {
+	if s.raft == nil || c.ID == 0 || cmd.Err != nil {
+		return nil
+	}
+	switch cmd.CMD {
+	case common.SSUBSCRIBE, common.SUNSUBSCRIBE, common.SPUBLISH:
+		return nil
+	}
+	keys := routingKeys(cmd)
+	if len(keys) == 0 && !raftReplicated(cmd) {
+		return nil
+	}
+	if s.raft.node.IsLeader() {
+		return nil
+	}
+	slot := 0
+	if len(keys) > 0 {
+		slot = common.KeySlot(keys[0])
+	}
+	return s.raftLeaderError(slot)
+}
+
+// redirect returns the redirection of the cluster mode or of the raft mode, or the refusal of the
+// sentinel mode
+func (s *server) redirect(cmd common.Command, c *connectedClient) error {
+	if err := s.sentinelRefuse(cmd); err != nil {
+		return err
+	}
+	if err := s.clusterRedirect(cmd, c); err != nil {
+		return err
+	}
+	return s.raftRedirect(cmd, c)
+}
+
+func (s *server) handleRAFT(args common.CommandArguments, c *connectedClient) (string, error) {
+	raftArgs, ok := args.(common.RAFTArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid RAFT argments %v", args)
+	}
+	if s.raft == nil {
+		return "", errRaftDisabled
+	}
+	node := s.raft.node
+	switch raftArgs.Subcommand {
+	case common.RaftSubcommandINIT:
+		err := node.Bootstrap()
+		if errors.Is(err, raft.ErrBootstrapped) {
+			return "", errRaftBootstrapped
+		}
+		s.raftCheck(err)
+		s.raftReady()
+		return resp.SimpleString("OK"), nil
+	case common.RaftSubcommandADD, common.RaftSubcommandREMOVE:
+		var index uint64
+		var err error
+		if raftArgs.Subcommand == common.RaftSubcommandADD {
+			index, err = node.AddMember(raft.Member{ID: raftArgs.NodeID, Addr: raftArgs.Addr})
+		} else {
+			index, err = node.RemoveMember(raftArgs.NodeID)
+		}
+		switch {
+		case errors.Is(err, raft.ErrNotLeader):
+			return "", s.raftLeaderError(0)
+		case err != nil:
+			return "", fmt.Errorf("ERR %v", err)
+		}
+		return s.raftWait(c, index, node.Status().Term)
+	case common.RaftSubcommandINFO:
+		info := s.raftInfo()
+		return resp.BulkString(&info), nil
+	case common.RaftSubcommandMYID:
+		id := node.Status().ID
+		return resp.BulkString(&id), nil
+	case common.RaftSubcommandMEMBERS:
+		config := node.Status().Config
+		members := make([]string, 0, len(config))
+		for _, m := range config {
+			members = append(members, resp.Array([]interface{}{m.ID, m.Addr}))
+		}
+		return resp.RawArray(members), nil
+	}
+	return "", fmt.Errorf("ERR unknown subcommand '%s'", raftArgs.Subcommand)
+}
+
+func (s *server) raftInfo() string {
+	status := s.raft.node.Status()
+	var sb strings.Builder
+	sb.WriteString("raft_enabled:1\r\n")
+	sb.WriteString(fmt.Sprintf("raft_node_id:%s\r\n", status.ID))
+	sb.WriteString(fmt.Sprintf("raft_role:%s\r\n", status.Role))
+	sb.WriteString(fmt.Sprintf("raft_term:%d\r\n", status.Term))
+	sb.WriteString(fmt.Sprintf("raft_leader_id:%s\r\n", status.Leader))
+	sb.WriteString(fmt.Sprintf("raft_leader_addr:%s\r\n", s.raft.node.LeaderAddr()))
+	sb.WriteString(fmt.Sprintf("raft_members:%d\r\n", len(status.Config)))
+	sb.WriteString(fmt.Sprintf("raft_commit_index:%d\r\n", status.Commit))
+	sb.WriteString(fmt.Sprintf("raft_applied_index:%d\r\n", status.Applied))
+	sb.WriteString(fmt.Sprintf("raft_last_index:%d\r\n", status.LastIndex))
+	sb.WriteString(fmt.Sprintf("raft_snapshot_index:%d\r\n", status.SnapshotIndex))
+	return sb.String()
+}
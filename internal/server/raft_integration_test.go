@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"strings"
+	"testing"
+	"time"
+)
+
+// raftInfoField returns a field of RAFT INFO
+func raftInfoField(t *testing.T, rdb *redis.Client, field string) string {
+	t.Helper()
+	info, err := rdb.Do(context.Background(), "RAFT", "INFO").Text()
+	common.ExpectNoError(t, err)
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	t.Fatalf("no %s in RAFT INFO %q", field, info)
+	return ""
+}
+
+// eventually polls condition until it is true, for at most 10 seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRaft(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	ports := []uint{10_035, 10_036, 10_037}
+
+	nodes := make([]*testNode, len(ports))
+	for i, port := range ports {
+		nodes[i] = startTestNode(port, &redis.Options{MaxRetries: -1}, WithRDB(t.TempDir(), ""), WithRaft("raft"))
+	}
+	defer stopTestNodes(t, nodes...)
+	leader := nodes[0]
+
+	common.AssertEquals(t, leader.rdb.Do(ctx, "RAFT", "INIT").Val(), "OK")
+	common.AssertEquals(t, fmt.Sprint(leader.rdb.Do(ctx, "RAFT", "INIT").Err()),
+		"ERR This node is already a member of a raft cluster")
+	eventually(t, "the leader", func() bool {
+		return leader.rdb.Set(ctx, "a", "value of a", 0).Err() == nil
+	})
+	common.ExpectNoError(t, leader.rdb.Do(ctx, "CONFIG", "SET", "raft-snapshot-entries", "5").Err())
+
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		id, err := n.rdb.Do(ctx, "RAFT", "MYID").Text()
+		common.ExpectNoError(t, err)
+		ids[i] = id
+	}
+	common.AssertEquals(t, leader.rdb.Do(ctx, "RAFT", "ADD", ids[1], fmt.Sprintf("127.0.0.1:%d", ports[1])).Val(), "OK")
+
+	keys := []string{"b", "c", "d", "e", "f", "g"}
+	for _, key := range keys {
+		common.ExpectNoError(t, leader.rdb.Set(ctx, key, "value of "+key, 0).Err())
+	}
+	common.AssertEquals(t, leader.rdb.Eval(ctx, "return redis.call('SET', KEYS[1], ARGV[1])", []string{"script"}, "set by a script").Val(), "OK")
+	err := leader.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, "a").Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "a", value+" updated", 0)
+			pipe.Del(ctx, "g")
+			return nil
+		})
+		return err
+	}, "a")
+	common.ExpectNoError(t, err)
+	if index := raftInfoField(t, leader.rdb, "raft_snapshot_index"); index == "0" {
+		t.Errorf("the raft log of the leader was not compacted")
+	}
+
+	// the third member catches up with the snapshot
+	common.AssertEquals(t, leader.rdb.Do(ctx, "RAFT", "ADD", ids[2], fmt.Sprintf("127.0.0.1:%d", ports[2])).Val(), "OK")
+	members, err := leader.rdb.Do(ctx, "RAFT", "MEMBERS").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, len(members.([]interface{})), 3)
+	eventually(t, "the followers", func() bool {
+		applied := raftInfoField(t, leader.rdb, "raft_applied_index")
+		return raftInfoField(t, nodes[1].rdb, "raft_applied_index") == applied &&
+			raftInfoField(t, nodes[2].rdb, "raft_applied_index") == applied
+	})
+	if index := raftInfoField(t, nodes[2].rdb, "raft_snapshot_index"); index == "0" {
+		t.Errorf("the third member did not install a snapshot")
+	}
+
+	// the followers redirect the clients to the leader
+	moved := nodes[1].rdb.Get(ctx, "a").Err()
+	common.AssertEquals(t, fmt.Sprint(moved), fmt.Sprintf("MOVED %d 127.0.0.1:%d", common.KeySlot("a"), ports[0]))
+	moved = nodes[2].rdb.Set(ctx, "h", "value of h", 0).Err()
+	common.AssertEquals(t, fmt.Sprint(moved), fmt.Sprintf("MOVED %d 127.0.0.1:%d", common.KeySlot("h"), ports[0]))
+	common.AssertEquals(t, raftInfoField(t, nodes[1].rdb, "raft_role"), "follower")
+
+	// the remaining members elect a leader that has every committed write
+	stopTestNodes(t, leader)
+	eventually(t, "a new leader", func() bool {
+		for _, n := range nodes[1:] {
+			if n.rdb.Set(ctx, "h", "value of h", 0).Err() == nil {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	for _, key := range keys[:len(keys)-1] {
+		common.AssertEquals(t, leader.rdb.Get(ctx, key).Val(), "value of "+key)
+	}
+	common.AssertEquals(t, leader.rdb.Get(ctx, "a").Val(), "value of a updated")
+	common.AssertEquals(t, leader.rdb.Get(ctx, "g").Err(), redis.Nil)
+	common.AssertEquals(t, leader.rdb.Get(ctx, "script").Val(), "set by a script")
+	common.AssertEquals(t, leader.rdb.Get(ctx, "h").Val(), "value of h")
+
+	common.AssertEquals(t, leader.rdb.Do(ctx, "RAFT", "REMOVE", ids[0]).Val(), "OK")
+	common.AssertEquals(t, raftInfoField(t, leader.rdb, "raft_members"), "2")
+	common.AssertEquals(t, fmt.Sprint(leader.rdb.Do(ctx, "REPLICAOF", "127.0.0.1", "6379").Err()),
+		"ERR REPLICAOF not allowed in raft mode.")
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"github.com/rilopez/redis-wire-protocol/internal/raft"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// raftWriteTimeout bounds the write of a message to a member
+const raftWriteTimeout = time.Second
+
+// raftTransportAddr returns the address of the transport of the member serving the clients at addr
+func raftTransportAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+clusterBusPortOffset)), nil
+}
+
+// startRaftTransport listens to the raft port, the port of the server + 10000 like the cluster bus
+// which is not started in raft mode
+func (s *server) startRaftTransport() error {
+	if s.raft == nil {
+		return nil
+	}
+	t, err := listenBus("raft transport", int(s.port)+clusterBusPortOffset, raftWriteTimeout,
+		func(r *bufio.Reader) (interface{}, error) {
+			return raft.ReadMessage(r)
+		},
+		func(w io.Writer, m interface{}) error {
+			msg := m.(raft.Message)
+			return raft.WriteMessage(w, &msg)
+		})
+	if err != nil {
+		return err
+	}
+	s.raft.transport = t
+	return nil
+}
+
+// stopRaftTransport closes the listener & the connections and waits for their goroutines
+func (s *server) stopRaftTransport() {
+	if s.raft == nil || s.raft.transport == nil {
+		return
+	}
+	s.raft.transport.stop()
+	s.raft.transport = nil
+}
+
+// raftEvents returns the channel of the transport goroutines, nil when there is no transport
+func (s *server) raftEvents() <-chan busEvent {
+	if s.raft == nil || s.raft.transport == nil {
+		return nil
+	}
+	return s.raft.transport.events
+}
+
+// raftSend queues m to its recipient, the message is dropped when the link is full or the address
+// of the recipient is unknown. Raft retries the messages lost.
+func (s *server) raftSend(m raft.Message) {
+	r := s.raft
+	if r.transport == nil {
+		return
+	}
+	addr := r.addrs[m.To]
+	if member, ok := r.node.Status().Config.Member(m.To); ok {
+		addr = member.Addr
+	}
+	transportAddr, err := raftTransportAddr(addr)
+	if err != nil {
+		return
+	}
+	r.transport.queue(m.To, transportAddr, m)
+}
+
+func (s *server) handleRaftEvent(e busEvent) {
+	if e.err != nil {
+		s.raft.transport.linkFailed(e.link)
+		return
+	}
+	m := e.msg.(*raft.Message)
+	if m.Addr != "" {
+		s.raft.addrs[m.From] = m.Addr
+	}
+	s.raftCheck(s.raft.node.Step(*m))
+	s.raftReady()
+}
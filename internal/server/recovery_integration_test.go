@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPointInTimeRecovery(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	port := uint(10_018)
+	ctx := context.Background()
+
+	start := func(opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 2)
+		opts = append([]Option{WithRDB(dir, "dump.rdb"),
+			WithAppendOnly("appendonlydir", "appendonly.aof", "always"), WithAOFTimestamps(true)}, opts...)
+		go Start(port, 2, ready, quit, events, opts...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		common.AssertEquals(t, <-events, EventAfterDisconnect)
+		quit <- true
+		common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+	}
+
+	rdb, quit, events := start()
+	config, err := rdb.ConfigGet(ctx, "aof-timestamp-enabled").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(config), "[aof-timestamp-enabled yes]")
+	common.ExpectNoError(t, rdb.Set(ctx, "a", "1", 0).Err())
+	common.ExpectNoError(t, rdb.Set(ctx, "b", "2", 0).Err())
+	// the bad deploy
+	common.ExpectNoError(t, rdb.Del(ctx, "a", "b").Err())
+	stop(rdb, quit, events)
+
+	incrPath := filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof")
+	incr, err := os.ReadFile(incrPath)
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, strings.HasPrefix(string(incr), "#TS:"), true)
+
+	rdb, quit, events = start(WithRecovery(aof.Limit{Ops: 2}))
+	common.AssertEquals(t, rdb.Get(ctx, "a").Val(), "1")
+	common.AssertEquals(t, rdb.Get(ctx, "b").Val(), "2")
+	stop(rdb, quit, events)
+
+	backup, err := os.ReadFile(incrPath + ".pre-recovery")
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, string(backup), string(incr))
+
+	// the recovery truncated the file, the keys survive a normal restart
+	rdb, quit, events = start()
+	common.AssertEquals(t, rdb.Get(ctx, "a").Val(), "1")
+	common.ExpectNoError(t, rdb.Set(ctx, "c", "3", 0).Err())
+	stop(rdb, quit, events)
+}
@@ -0,0 +1,696 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/rdb"
+	"github.com/rilopez/redis-wire-protocol/internal/replication"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replBacklogSize is the size of the replication backlog, like the redis repl-backlog-size
+	replBacklogSize = 1024 * 1024
+	// replOutputLimit disconnects the replicas not keeping up with the stream, like the redis
+	// client-output-buffer-limit for replicas
+	replOutputLimit = 256 * 1024 * 1024
+	// replPingPeriod is how often the master pings its replicas, like repl-ping-replica-period
+	replPingPeriod = 10 * time.Second
+	// replTimeout drops the link with a master silent for longer, like repl-timeout
+	replTimeout = 60 * time.Second
+	// replAckPeriod is how often a replica acknowledges the offset it processed
+	replAckPeriod = time.Second
+	// replRetryDelay is the time a replica waits before reconnecting to its master
+	replRetryDelay = time.Second
+)
+
+const (
+	linkStateConnect    = "connect"
+	linkStateConnecting = "connecting"
+	linkStateConnected  = "connected"
+)
+
+var (
+	errReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+	errNoMasterLink    = errors.New("NOMASTERLINK Can't SYNC while not connected with my master")
+)
+
+// WithReplicaOf starts the server as a replica of the master at host:port
+func WithReplicaOf(host string, port int) Option {
+	return func(s *server) {
+		s.master = &masterLink{host: host, port: port, state: linkStateConnect}
+	}
+}
+
+// replica is the state of a replica connected to this server
+type replica struct {
+	listeningPort string
+	// stream is nil until the replica sends PSYNC
+	stream    *replication.Stream
+	ackOffset int64
+	ackTime   time.Time
+	// aofAckOffset is the offset the replica has on disk, sent with REPLCONF ACK <offset> FACK
+	aofAckOffset int64
+	// failed is set once the stream failed, the connection is closing
+	failed bool
+}
+
+// masterLink is the connection of a replica to its master. The link goroutine runs the handshake
+// and reads the stream, the commands are applied by the server loop.
+type masterLink struct {
+	host  string
+	port  int
+	state string
+	// retryAt is when the next connection is attempted
+	retryAt time.Time
+	lastIO  time.Time
+	lastAck time.Time
+	// client executes the commands of the stream
+	client *connectedClient
+	// tx buffers the commands between MULTI & EXEC
+	tx      []common.Command
+	inMulti bool
+
+	events chan linkEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conn   net.Conn
+}
+
+// fsyncTarget maps the bytes written to the append only file to the offset of the stream
+type fsyncTarget struct {
+	aof  int64
+	repl int64
+}
+
+// linkEvent is sent by the link goroutine to the server loop
+type linkEvent struct {
+	// sync is the reply of the master to PSYNC
+	sync *replication.Sync
+	// args is a command of the stream
+	args []string
+	err  error
+}
+
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+func (l *masterLink) send(e linkEvent) bool {
+	select {
+	case l.events <- e:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// run connects to the master and forwards the stream to the server loop until the link is stopped
+func (l *masterLink) run(listeningPort uint, replID string, offset int64) {
+	defer l.wg.Done()
+	conn, err := net.DialTimeout("tcp", l.addr(), replTimeout)
+	if err != nil {
+		l.send(linkEvent{err: err})
+		return
+	}
+	l.mu.Lock()
+	l.conn = conn
+	stopped := l.isStopped()
+	l.mu.Unlock()
+	if stopped {
+		_ = conn.Close()
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(replTimeout))
+	sync, err := replication.Handshake(conn, r, listeningPort, replID, offset)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		l.send(linkEvent{err: err})
+		return
+	}
+	if !l.send(linkEvent{sync: &sync}) {
+		return
+	}
+	_, err = aof.Replay(r, func(e aof.Entry) error {
+		if !l.send(linkEvent{args: e.Args}) {
+			return io.EOF
+		}
+		return nil
+	})
+	if err == nil {
+		err = errors.New("connection closed by the master")
+	}
+	l.send(linkEvent{err: err})
+}
+
+func (l *masterLink) isStopped() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// write sends a command to the master, only the server loop writes once the link is connected
+func (l *masterLink) write(args ...string) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(replAckPeriod))
+	_, err := conn.Write(aof.AppendCommand(nil, args))
+	return err
+}
+
+// masterEvents returns the channel of the link goroutine, nil when there is none
+func (s *server) masterEvents() <-chan linkEvent {
+	if s.master == nil || s.master.events == nil {
+		return nil
+	}
+	return s.master.events
+}
+
+// startMasterLink connects to the master, asking for the stream after the offset of this server
+// when it has one
+func (s *server) startMasterLink() {
+	link := s.master
+	link.state = linkStateConnecting
+	link.events = make(chan linkEvent)
+	link.done = make(chan struct{})
+	link.client = &connectedClient{ID: 0, protocol: 2}
+	link.tx, link.inMulti = nil, false
+	replID, offset := "?", int64(-1)
+	if s.backlog != nil {
+		replID, offset = s.replID, s.replOffset+1
+	}
+	log.Printf("connecting to MASTER %s", link.addr())
+	link.wg.Add(1)
+	go link.run(s.port, replID, offset)
+}
+
+// stopMasterLink closes the connection to the master and waits for the link goroutine
+func (s *server) stopMasterLink() {
+	link := s.master
+	if link == nil || link.done == nil {
+		return
+	}
+	close(link.done)
+	link.mu.Lock()
+	if link.conn != nil {
+		_ = link.conn.Close()
+		link.conn = nil
+	}
+	link.mu.Unlock()
+	link.wg.Wait()
+	link.events, link.done = nil, nil
+	link.state = linkStateConnect
+	link.retryAt = s.now().Add(replRetryDelay)
+}
+
+func (s *server) handleMasterEvent(e linkEvent) {
+	link := s.master
+	switch {
+	case e.err != nil:
+		log.Printf("ERR connection with MASTER %s lost: %v", link.addr(), e.err)
+		s.stopMasterLink()
+	case e.sync != nil:
+		if err := s.masterSynced(*e.sync); err != nil {
+			log.Printf("ERR synchronizing with MASTER %s: %v", link.addr(), err)
+			s.stopMasterLink()
+			return
+		}
+		link.state = linkStateConnected
+		link.lastIO = s.now()
+		log.Printf("MASTER <-> REPLICA sync finished, replication ID %s offset %d", s.replID, s.replOffset)
+	default:
+		link.lastIO = s.now()
+		s.applyMasterCommand(e.args)
+	}
+}
+
+// masterSynced loads the snapshot of a full resynchronization or continues the stream after a
+// partial one
+func (s *server) masterSynced(sync replication.Sync) error {
+	if !sync.FullResync {
+		if sync.ID != s.replID {
+			// the master was promoted, its stream continues ours under a new ID
+			s.replID2, s.secondReplOffset, s.replID = s.replID, s.replOffset+1, sync.ID
+		}
+		log.Printf("partial resynchronization accepted by MASTER")
+		return nil
+	}
+
+	log.Printf("full resynchronization from MASTER, loading %d bytes", len(sync.RDB))
+	s.disconnectReplicas()
+	s.db = s.newKeyspace()
+	s.functions.Flush()
+	for _, clients := range s.watchedKeys {
+		for _, c := range clients {
+			c.dirtyCAS = true
+		}
+	}
+	if err := s.loadSnapshot(bytes.NewReader(sync.RDB), "MASTER"); err != nil {
+		return err
+	}
+	s.replID, s.replID2, s.secondReplOffset = sync.ID, "", -1
+	s.replOffset = sync.Offset
+	s.backlog = replication.NewBacklog(replBacklogSize, sync.Offset)
+	// the rewrite puts the snapshot on disk
+	s.fsyncedReplOffset, s.fsyncTarget = sync.Offset, nil
+	return s.resetAOF()
+}
+
+// applyMasterCommand executes a command of the stream, it is added to the backlog as is so the
+// replicas of this server get the stream of the master
+func (s *server) applyMasterCommand(args []string) {
+	link := s.master
+	s.feedStream(aof.AppendCommand(nil, args))
+	cmdID, cmdArgs, err := resp.ParseCommand(args)
+	if err != nil {
+		log.Printf("ERR invalid command %q from MASTER: %v", args[0], err)
+		return
+	}
+	cmd := common.Command{CMD: cmdID, ClientID: link.client.ID, Arguments: cmdArgs}
+	switch cmdID {
+	case common.PING:
+		return
+	case common.REPLCONF:
+		if len(args) > 1 && strings.EqualFold(args[1], "GETACK") {
+			s.sendAck()
+		}
+		return
+	case common.MULTI:
+		link.inMulti = true
+		return
+	case common.EXEC:
+		s.beginAtomic()
+		for _, cmd := range link.tx {
+			if _, err := s.execute(cmd, link.client); err != nil {
+				log.Printf("ERR executing %v from MASTER: %v", cmd.CMD, err)
+			}
+		}
+		s.endAtomic()
+		link.tx, link.inMulti = nil, false
+	default:
+		if link.inMulti {
+			link.tx = append(link.tx, cmd)
+			return
+		}
+		if _, err := s.execute(cmd, link.client); err != nil {
+			log.Printf("ERR executing %q from MASTER: %v", args[0], err)
+		}
+	}
+	s.flushAOF()
+}
+
+// sendAck acknowledges the offset processed to the master and, with the append only file enabled,
+// the offset on disk
+func (s *server) sendAck() {
+	link := s.master
+	args := []string{"REPLCONF", "ACK", strconv.FormatInt(s.replOffset, 10)}
+	if s.aof != nil {
+		s.trackFsyncedOffset()
+		args = append(args, "FACK", strconv.FormatInt(s.fsyncedReplOffset, 10))
+	}
+	if err := link.write(args...); err != nil {
+		log.Printf("ERR sending REPLCONF ACK to MASTER: %v", err)
+		return
+	}
+	link.lastAck = s.now()
+}
+
+// trackFsyncedOffset advances the offset of the stream on disk. One offset at a time waits for
+// the fsync of the bytes written to the append only file when it was taken.
+func (s *server) trackFsyncedOffset() {
+	for {
+		if s.fsyncTarget != nil {
+			if s.aofSynced() < s.fsyncTarget.aof {
+				return
+			}
+			s.fsyncedReplOffset = s.fsyncTarget.repl
+			s.fsyncTarget = nil
+		}
+		if s.replOffset == s.fsyncedReplOffset {
+			return
+		}
+		s.fsyncTarget = &fsyncTarget{aof: s.aofWritten(), repl: s.replOffset}
+	}
+}
+
+// resetAOF rewrites the append only file after a full resynchronization replaced the keyspace
+func (s *server) resetAOF() error {
+	if s.aof == nil {
+		return nil
+	}
+	if s.aof.rewrite != nil {
+		_ = s.aofRewriteFinished(<-s.aof.rewrite.done)
+	}
+	if err := s.startAOFRewrite(); err != nil {
+		return err
+	}
+	return s.aofRewriteFinished(<-s.aof.rewrite.done)
+}
+
+// feedStream adds p to the replication stream: the backlog and every replica
+func (s *server) feedStream(p []byte) {
+	if s.backlog == nil {
+		return
+	}
+	s.backlog.Append(p)
+	s.replOffset = s.backlog.Offset()
+	for _, c := range s.replicas {
+		if c.replica.failed {
+			continue
+		}
+		if err := c.replica.stream.Write(p); err != nil {
+			log.Printf("ERR closing the connection of replica %s: %v", c.addr, err)
+			c.replica.failed = true
+			_ = c.conn.Close()
+		}
+	}
+}
+
+// feedCommand propagates a command to the replicas, the replicas propagate the stream of their
+// master instead
+func (s *server) feedCommand(args []string) {
+	if s.master != nil || s.backlog == nil {
+		return
+	}
+	s.feedStream(aof.AppendCommand(nil, args))
+}
+
+// rejectsWrites returns true when c can not modify the keyspace of this replica, the internal
+// clients, like the one executing the stream of the master, have ID 0
+func (s *server) rejectsWrites(cmd common.Command, c *connectedClient) bool {
+	if s.master == nil || !s.replicaReadOnly || c.ID == 0 {
+		return false
+	}
+	if cmd.CMD.IsWrite() {
+		return true
+	}
+	if fnArgs, ok := cmd.Arguments.(common.FUNCTIONArguments); ok && cmd.CMD == common.FUNCTION {
+		switch fnArgs.Subcommand {
+		case common.FunctionSubcommandLOAD, common.FunctionSubcommandDELETE,
+			common.FunctionSubcommandRESTORE, common.FunctionSubcommandFLUSH:
+			return true
+		}
+	}
+	return false
+}
+
+// handleReplicaCMD runs PSYNC and REPLCONF ACK, the worker of the replica does not wait for a
+// reply. A failed PSYNC gets the error written to the connection, which is closed.
+func (s *server) handleReplicaCMD(cmd common.Command, c *connectedClient, refused error) {
+	err := refused
+	if err == nil {
+		_, err = s.execute(cmd, c)
+	}
+	if err != nil && cmd.CMD == common.PSYNC {
+		log.Printf("ERR PSYNC of replica %s failed: %v", c.addr, err)
+		_, _ = c.conn.Write([]byte(resp.Error(err)))
+		_ = c.conn.Close()
+	}
+}
+
+func (s *server) handleREPLCONF(args common.CommandArguments, c *connectedClient) (string, error) {
+	replconfArgs, ok := args.(common.REPLCONFArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid REPLCONF argments %v", args)
+	}
+	if c.replica == nil {
+		c.replica = &replica{}
+	}
+	acked := false
+	for i := 0; i < len(replconfArgs.Args); i += 2 {
+		value := replconfArgs.Args[i+1]
+		switch strings.ToLower(replconfArgs.Args[i]) {
+		case "listening-port":
+			c.replica.listeningPort = value
+		case "capa":
+		case "ack":
+			if offset, err := strconv.ParseInt(value, 10, 64); err == nil {
+				c.replica.ackOffset, c.replica.ackTime = offset, s.now()
+			}
+			acked = true
+		case "fack":
+			if offset, err := strconv.ParseInt(value, 10, 64); err == nil {
+				c.replica.aofAckOffset = offset
+			}
+		case "getack":
+			if s.master != nil && s.master.state == linkStateConnected {
+				s.sendAck()
+			}
+		default:
+			return "", fmt.Errorf("ERR Unrecognized REPLCONF option: %s", replconfArgs.Args[i])
+		}
+	}
+	if acked {
+		// the acknowledgements are not replied to
+		s.checkWaiting(false)
+		return "", nil
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+// handlePSYNC starts streaming to the replica c. The stream continues from the offset of the
+// replica when the backlog still has it, otherwise it starts with a snapshot of the keyspace.
+func (s *server) handlePSYNC(args common.CommandArguments, c *connectedClient) (string, error) {
+	psyncArgs, ok := args.(common.PSYNCArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid PSYNC argments %v", args)
+	}
+	if s.master != nil && s.master.state != linkStateConnected {
+		return "", errNoMasterLink
+	}
+	if c.replica == nil {
+		c.replica = &replica{}
+	}
+	if c.replica.stream != nil {
+		return "", errors.New("ERR PSYNC already received")
+	}
+
+	if s.backlog != nil && (psyncArgs.ReplID == s.replID ||
+		(psyncArgs.ReplID == s.replID2 && psyncArgs.Offset <= s.secondReplOffset)) {
+		if missed, ok := s.backlog.Since(psyncArgs.Offset); ok {
+			header := fmt.Sprintf("+CONTINUE %s\r\n", s.replID)
+			c.replica.stream = replication.NewStream(c.streamWriter(), replOutputLimit, func(w io.Writer) error {
+				_, err := w.Write(append([]byte(header), missed...))
+				return err
+			})
+			s.replicas[c.ID] = c
+			log.Printf("partial resynchronization of replica %s accepted, sending %d bytes", c.addr, len(missed))
+			return "", nil
+		}
+	}
+
+	if s.backlog == nil {
+		s.backlog = replication.NewBacklog(replBacklogSize, s.replOffset)
+	}
+	header := fmt.Sprintf("+FULLRESYNC %s %d\r\n", s.replID, s.replOffset)
+	db, functions := s.snapshot()
+	now := s.now()
+	c.replica.stream = replication.NewStream(c.streamWriter(), replOutputLimit, func(w io.Writer) error {
+		var snapshot bytes.Buffer
+		if err := rdb.Save(&snapshot, db, functions, now); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s$%d\r\n%s", header, snapshot.Len(), snapshot.Bytes())
+		return err
+	})
+	s.replicas[c.ID] = c
+	log.Printf("full resynchronization of replica %s at offset %d", c.addr, s.replOffset)
+	return "", nil
+}
+
+// dropReplica stops streaming to a disconnected replica
+func (s *server) dropReplica(c *connectedClient) {
+	delete(s.replicas, c.ID)
+	if c.replica.stream != nil {
+		_ = c.conn.Close()
+		c.replica.stream.Close()
+	}
+}
+
+// disconnectReplicas closes the connections of the replicas, they reconnect and resync
+func (s *server) disconnectReplicas() {
+	for _, c := range s.replicas {
+		c.replica.failed = true
+		_ = c.conn.Close()
+	}
+}
+
+func (s *server) handleREPLICAOF(args common.CommandArguments) (string, error) {
+	replicaofArgs, ok := args.(common.REPLICAOFArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid REPLICAOF argments %v", args)
+	}
+	if s.cluster != nil {
+		return "", errReplicaofCluster
+	}
+	if s.raft != nil {
+		return "", errReplicaofRaft
+	}
+	if s.activeActive != nil {
+		return "", errReplicaofActive
+	}
+	if replicaofArgs.NoOne {
+		s.promote()
+		return resp.SimpleString("OK"), nil
+	}
+	if s.master != nil && s.master.host == replicaofArgs.Host && s.master.port == replicaofArgs.Port {
+		return resp.SimpleString("OK Already connected to specified master"), nil
+	}
+	s.replicateFrom(replicaofArgs.Host, replicaofArgs.Port)
+	return resp.SimpleString("OK"), nil
+}
+
+// promote turns this replica into a master, its replicas can continue with a partial resync
+func (s *server) promote() {
+	if s.master == nil {
+		return
+	}
+	s.stopMasterLink()
+	s.master = nil
+	// the replicas of this server can continue with the old ID up to this offset
+	s.replID2, s.secondReplOffset, s.replID = s.replID, s.replOffset+1, replication.NewID()
+	log.Printf("MASTER MODE enabled, replication ID %s", s.replID)
+}
+
+// replicateFrom turns this server into a replica of the master at host:port
+func (s *server) replicateFrom(host string, port int) {
+	s.stopMasterLink()
+	s.disconnectReplicas()
+	s.master = &masterLink{host: host, port: port, state: linkStateConnect}
+	log.Printf("REPLICAOF %s enabled", s.master.addr())
+}
+
+func (s *server) handleROLE() (string, error) {
+	if s.sentinel != nil {
+		return s.sentinelRole(), nil
+	}
+	if s.master != nil {
+		return resp.RawArray([]string{
+			resp.BulkString(strPtr("slave")),
+			resp.BulkString(strPtr(s.master.host)),
+			resp.Integer(s.master.port),
+			resp.BulkString(strPtr(s.master.state)),
+			resp.Integer(int(s.replOffset)),
+		}), nil
+	}
+	replicas := make([]string, 0, len(s.replicas))
+	for _, c := range s.replicas {
+		host, _, _ := net.SplitHostPort(c.addr)
+		replicas = append(replicas, resp.Array([]interface{}{
+			host, c.replica.listeningPort, strconv.FormatInt(c.replica.ackOffset, 10),
+		}))
+	}
+	return resp.RawArray([]string{
+		resp.BulkString(strPtr("master")),
+		resp.Integer(int(s.replOffset)),
+		resp.RawArray(replicas),
+	}), nil
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// replicationCron pings the replicas, reconnects to the master and acknowledges its stream
+func (s *server) replicationCron() {
+	now := s.now()
+	if s.master == nil {
+		if len(s.replicas) > 0 && now.Sub(s.lastReplPing) >= replPingPeriod {
+			s.lastReplPing = now
+			s.feedCommand([]string{"PING"})
+		}
+		return
+	}
+	link := s.master
+	switch link.state {
+	case linkStateConnect:
+		if !now.Before(link.retryAt) {
+			s.startMasterLink()
+		}
+	case linkStateConnected:
+		if now.Sub(link.lastIO) > replTimeout {
+			log.Printf("ERR MASTER timeout, no data nor PING received for %v", replTimeout)
+			s.stopMasterLink()
+			return
+		}
+		if now.Sub(link.lastAck) >= replAckPeriod {
+			s.sendAck()
+		}
+	}
+}
+
+func (s *server) replicationInfo(sb *strings.Builder) {
+	sb.WriteString("=== Replication === \n")
+	if s.master == nil {
+		sb.WriteString("role:master\n")
+	} else {
+		link := s.master
+		status, inProgress := "down", 0
+		if link.state == linkStateConnected {
+			status = "up"
+		} else if link.state == linkStateConnecting {
+			inProgress = 1
+		}
+		readOnly := 0
+		if s.replicaReadOnly {
+			readOnly = 1
+		}
+		sb.WriteString("role:slave\n")
+		sb.WriteString(fmt.Sprintf("master_host:%s\n", link.host))
+		sb.WriteString(fmt.Sprintf("master_port:%d\n", link.port))
+		sb.WriteString(fmt.Sprintf("master_link_status:%s\n", status))
+		sb.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\n", int(s.now().Sub(link.lastIO).Seconds())))
+		sb.WriteString(fmt.Sprintf("master_sync_in_progress:%d\n", inProgress))
+		sb.WriteString(fmt.Sprintf("slave_repl_offset:%d\n", s.replOffset))
+		sb.WriteString(fmt.Sprintf("slave_read_only:%d\n", readOnly))
+	}
+	sb.WriteString(fmt.Sprintf("connected_slaves:%d\n", len(s.replicas)))
+	i := 0
+	for _, c := range s.replicas {
+		host, _, _ := net.SplitHostPort(c.addr)
+		state := "wait_bgsave"
+		if c.replica.stream.Synced() {
+			state = "online"
+		}
+		sb.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\n", i, host,
+			c.replica.listeningPort, state, c.replica.ackOffset, int(s.now().Sub(c.replica.ackTime).Seconds())))
+		i++
+	}
+	replID2 := s.replID2
+	if replID2 == "" {
+		replID2 = strings.Repeat("0", 40)
+	}
+	active, size, firstByte, histlen := 0, replBacklogSize, int64(0), 0
+	if s.backlog != nil {
+		active, size, firstByte, histlen = 1, s.backlog.Size(), s.backlog.FirstByte(), s.backlog.HistLen()
+	}
+	sb.WriteString(fmt.Sprintf("master_replid:%s\n", s.replID))
+	sb.WriteString(fmt.Sprintf("master_replid2:%s\n", replID2))
+	sb.WriteString(fmt.Sprintf("master_repl_offset:%d\n", s.replOffset))
+	sb.WriteString(fmt.Sprintf("second_repl_offset:%d\n", s.secondReplOffset))
+	sb.WriteString(fmt.Sprintf("repl_backlog_active:%d\n", active))
+	sb.WriteString(fmt.Sprintf("repl_backlog_size:%d\n", size))
+	sb.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\n", firstByte))
+	sb.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\n", histlen))
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/replication"
+	"go.uber.org/goleak"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	masterPort, replicaPort := uint(10_021), uint(10_022)
+	ctx := context.Background()
+
+	start := func(port uint, opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 32)
+		go Start(port, 10, ready, quit, events, opts...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		// the connections closed by the clients, the replicas & go-redis on READONLY errors, must
+		// be disconnected before the shutdown
+		for quiet := false; !quiet; {
+			select {
+			case <-events:
+			case <-time.After(200 * time.Millisecond):
+				quiet = true
+			}
+		}
+		quit <- true
+		for event := range events {
+			if event == EventSuccessfulShutdown {
+				return
+			}
+		}
+	}
+	eventually := func(what string, ok func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	master, masterQuit, masterEvents := start(masterPort)
+	common.ExpectNoError(t, master.Set(ctx, "before", "sync", 0).Err())
+
+	replica, replicaQuit, replicaEvents := start(replicaPort)
+	common.ExpectNoError(t, replica.Do(ctx, "REPLICAOF", "localhost", masterPort).Err())
+	eventually("the replica to sync", func() bool {
+		info, err := replica.Info(ctx).Result()
+		return err == nil && strings.Contains(info, "master_link_status:up")
+	})
+	common.AssertEquals(t, replica.Get(ctx, "before").Val(), "sync")
+
+	common.ExpectNoError(t, master.Set(ctx, "after", "stream", 0).Err())
+	eventually("the write to be streamed", func() bool {
+		return replica.Get(ctx, "after").Val() == "stream"
+	})
+	if err := replica.Set(ctx, "local", "value", 0).Err(); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("want READONLY error writing to the replica, got %v", err)
+	}
+
+	role, err := replica.Do(ctx, "ROLE").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(role), fmt.Sprintf("[slave localhost %d connected %d]", masterPort, role.([]interface{})[4]))
+	common.AssertEquals(t, fmt.Sprint(replica.Do(ctx, "HELLO").Val().([]interface{})[8:12]), "[mode standalone role replica]")
+	role, err = master.Do(ctx, "ROLE").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, role.([]interface{})[0], "master")
+	common.AssertEquals(t, len(role.([]interface{})[2].([]interface{})), 1)
+	info, err := master.Info(ctx).Result()
+	common.ExpectNoError(t, err)
+	if !strings.Contains(info, "connected_slaves:1") {
+		t.Errorf("want connected_slaves:1 in %s", info)
+	}
+
+	// a replica disconnected after a full resync continues from its offset
+	psync := func(id string, offset int64) (net.Conn, *bufio.Reader, replication.Sync) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", masterPort))
+		common.ExpectNoError(t, err)
+		r := bufio.NewReader(conn)
+		sync, err := replication.Handshake(conn, r, 0, id, offset)
+		common.ExpectNoError(t, err)
+		return conn, r, sync
+	}
+	conn, _, full := psync("?", -1)
+	common.AssertEquals(t, full.FullResync, true)
+	common.ExpectNoError(t, conn.Close())
+
+	common.ExpectNoError(t, master.Set(ctx, "missed", "while away", 0).Err())
+	conn, r, partial := psync(full.ID, full.Offset+1)
+	common.AssertEquals(t, partial.FullResync, false)
+	common.AssertEquals(t, partial.ID, full.ID)
+	errFirst := errors.New("first command read")
+	var first []string
+	_, err = aof.Replay(r, func(e aof.Entry) error {
+		first = e.Args
+		return errFirst
+	})
+	if !errors.Is(err, errFirst) {
+		t.Fatalf("want the missed command, got %v", err)
+	}
+	common.AssertEquals(t, strings.Join(first, " "), "SET missed while away")
+	common.ExpectNoError(t, conn.Close())
+
+	common.ExpectNoError(t, replica.Do(ctx, "REPLICAOF", "NO", "ONE").Err())
+	common.ExpectNoError(t, replica.Set(ctx, "local", "value", 0).Err())
+	common.AssertEquals(t, replica.Do(ctx, "ROLE").Val().([]interface{})[0], "master")
+
+	stop(replica, replicaQuit, replicaEvents)
+	stop(master, masterQuit, masterEvents)
+}
+
+func TestWait(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	masterPort, replicaPort := uint(10_023), uint(10_024)
+	ctx := context.Background()
+
+	start := func(port uint, opts ...Option) (*redis.Client, chan bool, chan string) {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 32)
+		go Start(port, 10, ready, quit, events, opts...)
+		<-ready
+		return redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", port)}), quit, events
+	}
+	stop := func(rdb *redis.Client, quit chan bool, events chan string) {
+		common.ExpectNoError(t, rdb.Close())
+		for quiet := false; !quiet; {
+			select {
+			case <-events:
+			case <-time.After(200 * time.Millisecond):
+				quiet = true
+			}
+		}
+		quit <- true
+		for event := range events {
+			if event == EventSuccessfulShutdown {
+				return
+			}
+		}
+	}
+	appendOnly := func(dir string) []Option {
+		return []Option{WithRDB(dir, ""), WithAppendOnly("appendonlydir", "appendonly.aof", "always")}
+	}
+
+	master, masterQuit, masterEvents := start(masterPort, appendOnly(t.TempDir())...)
+	replica, replicaQuit, replicaEvents := start(replicaPort,
+		append(appendOnly(t.TempDir()), WithReplicaOf("localhost", int(masterPort)))...)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(replica.Info(ctx).Val(), "master_link_status:up") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the replica to sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	common.ExpectNoError(t, master.Set(ctx, "payment", "42", 0).Err())
+	common.AssertEquals(t, master.Do(ctx, "WAIT", 1, 1000).Val(), int64(1))
+	common.AssertEquals(t, fmt.Sprint(master.Do(ctx, "WAITAOF", 1, 1, 1000).Val()), "[1 1]")
+	common.AssertEquals(t, replica.Get(ctx, "payment").Val(), "42")
+
+	// the server keeps serving the other clients while a client waits
+	began := time.Now()
+	waited := make(chan interface{})
+	go func() {
+		waited <- master.Do(ctx, "WAIT", 2, 300).Val()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	common.AssertEquals(t, master.Get(ctx, "payment").Val(), "42")
+	if elapsed := time.Since(began); elapsed > 250*time.Millisecond {
+		t.Errorf("GET waited for WAIT, took %v", elapsed)
+	}
+	common.AssertEquals(t, <-waited, int64(1))
+	if elapsed := time.Since(began); elapsed < 300*time.Millisecond {
+		t.Errorf("WAIT returned before its timeout, after %v", elapsed)
+	}
+
+	if err := replica.Do(ctx, "WAIT", 1, 0).Err(); err == nil || !strings.Contains(err.Error(), "replica") {
+		t.Errorf("want error running WAIT on a replica, got %v", err)
+	}
+
+	stop(replica, replicaQuit, replicaEvents)
+	stop(master, masterQuit, masterEvents)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"strconv"
+)
+
+// handleSCAN iterates the keyspace in hash order, the cursor is the hash of the next key
+func (s *server) handleSCAN(args common.CommandArguments) (string, error) {
+	scanArgs, ok := args.(common.SCANArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid SCAN argments %v", args)
+	}
+	cursor, keys := s.db.Scan(scanArgs.Cursor, scanArgs.Count)
+
+	matching := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		// every key is a string
+		if scanArgs.Type != "" && scanArgs.Type != "string" {
+			continue
+		}
+		if scanArgs.Match != "" && !common.GlobMatch(scanArgs.Match, key) {
+			continue
+		}
+		matching = append(matching, key)
+	}
+	next := strconv.FormatUint(cursor, 10)
+	return resp.RawArray([]string{resp.BulkString(&next), resp.Array(matching)}), nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"sort"
+	"testing"
+)
+
+func TestScanAndSnapshots(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_019)
+	dir := t.TempDir()
+
+	go Start(port, 2, ready, quit, events, WithRDB(dir, "dump.rdb"))
+
+	<-ready
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		common.ExpectNoError(t, rdb.Set(ctx, fmt.Sprintf("user:%d", i), "v", 0).Err())
+		common.ExpectNoError(t, rdb.Set(ctx, fmt.Sprintf("order:%d", i), "v", 0).Err())
+	}
+
+	var users []string
+	iter := rdb.Scan(ctx, 0, "user:*", 7).Iterator()
+	for iter.Next(ctx) {
+		users = append(users, iter.Val())
+	}
+	common.ExpectNoError(t, iter.Err())
+	sort.Strings(users)
+	common.AssertEquals(t, len(users), 100)
+	common.AssertEquals(t, users[0], "user:0")
+
+	reply, err := rdb.Do(ctx, "SCAN", "0", "COUNT", "1000", "TYPE", "hash").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(reply), "[0 []]")
+
+	// the keys deleted while BGSAVE runs are in the snapshot, the server does not block
+	common.AssertEquals(t, rdb.Do(ctx, "BGSAVE").Val(), "Background saving started")
+	for i := 0; i < 100; i++ {
+		common.ExpectNoError(t, rdb.Del(ctx, fmt.Sprintf("order:%d", i)).Err())
+	}
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+
+	go Start(port, 2, ready, quit, events, WithRDB(dir, "dump.rdb"))
+	<-ready
+	rdb = redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	common.AssertEquals(t, rdb.Get(ctx, "order:99").Val(), "v")
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/script"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBusyScriptTimeout matches the redis lua-time-limit default
+const defaultBusyScriptTimeout = 5 * time.Second
+
+var (
+	errNoScript   = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errBusy       = errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+	errNotBusy    = errors.New("NOTBUSY No scripts in execution right now.")
+	errUnkillable = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	errKilled     = errors.New("ERR Script killed by user with SCRIPT KILL...")
+)
+
+// scriptCall is a redis.call issued by a script, it is executed by the server goroutine
+type scriptCall struct {
+	args  []string
+	reply chan<- scriptCallResult
+}
+
+type scriptCallResult struct {
+	response string
+	err      error
+}
+
+// runningScript keeps the state of the script being executed
+type runningScript struct {
+	calls  chan scriptCall
+	cancel context.CancelFunc
+	// wrote is set after the script executes a write command, such scripts can not be killed
+	wrote bool
+	// slot is the hash slot of the keys accessed by the script in cluster mode, -1 until it
+	// accesses a key
+	slot int
+}
+
+func (r *runningScript) call(args []string) (string, error) {
+	reply := make(chan scriptCallResult)
+	r.calls <- scriptCall{args: args, reply: reply}
+	result := <-reply
+	return result.response, result.err
+}
+
+func (s *server) handleEVAL(cmdID common.CommandID, args common.CommandArguments, c *connectedClient) (string, error) {
+	evalArgs, ok := args.(common.EVALArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid EVAL argments %v", args)
+	}
+
+	var sc *script.Script
+	if cmdID == common.EVALSHA {
+		if sc, ok = s.scripts[strings.ToLower(evalArgs.Script)]; !ok {
+			return "", errNoScript
+		}
+	} else {
+		var err error
+		if sc, err = s.loadScript(evalArgs.Script); err != nil {
+			return "", err
+		}
+	}
+	run := func(ctx context.Context, call script.Caller) (string, error) {
+		return sc.Run(ctx, evalArgs.Keys, evalArgs.Args, call)
+	}
+	return s.runScript("script "+sc.SHA, run, evalArgs.ReadOnly, c)
+}
+
+// loadScript compiles source and adds it to the scripts cache
+func (s *server) loadScript(source string) (*script.Script, error) {
+	if sc, cached := s.scripts[script.SHA1Hex(source)]; cached {
+		return sc, nil
+	}
+	sc, err := script.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	s.scripts[sc.SHA] = sc
+	return sc, nil
+}
+
+// runScript executes run in its own goroutine, the server goroutine keeps serving the commands
+// called by the script or function. Once the busy timeout expires the rest of the clients get BUSY
+// errors until run finishes or is killed with SCRIPT KILL or FUNCTION KILL.
+func (s *server) runScript(name string, run func(ctx context.Context, call script.Caller) (string, error),
+	readOnly bool, c *connectedClient) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running := &runningScript{calls: make(chan scriptCall), cancel: cancel, slot: -1}
+	s.runningScript = running
+	defer func() { s.runningScript = nil }()
+	// the commands of the other clients wait for the script in the event loop, which replies BUSY
+	// once it is busy
+	atomic.StoreInt32(&s.direct, 0)
+	// the write commands of the script are propagated as a transaction
+	s.beginAtomic()
+	defer s.endAtomic()
+
+	done := make(chan scriptCallResult, 1)
+	go func() {
+		response, err := run(ctx, running.call)
+		done <- scriptCallResult{response: response, err: err}
+	}()
+
+	busy := time.NewTimer(s.busyScriptTimeout)
+	defer busy.Stop()
+	// requests stays nil, blocking other clients, until the script is busy
+	var requests chan common.Command
+	for {
+		select {
+		case result := <-done:
+			if errors.Is(result.err, script.ErrInterrupted) {
+				return "", errKilled
+			}
+			return result.response, result.err
+		case call := <-running.calls:
+			response, err := s.executeScriptCall(call.args, readOnly, c)
+			call.reply <- scriptCallResult{response: response, err: err}
+		case <-busy.C:
+			log.Printf("%s is still running after %v, replying BUSY to other clients", name, s.busyScriptTimeout)
+			requests = s.requests
+		case cmd := <-requests:
+			s.handleBusyCMD(cmd)
+		}
+	}
+}
+
+func (s *server) executeScriptCall(args []string, readOnly bool, c *connectedClient) (string, error) {
+	cmdID, cmdArgs, err := resp.ParseCommand(args)
+	if err != nil {
+		return "", err
+	}
+	switch cmdID {
+	case common.UNKNOWN:
+		return "", fmt.Errorf("ERR Unknown Redis command called from script")
+	case common.MULTI, common.EXEC, common.DISCARD, common.WATCH, common.UNWATCH,
+		common.EVAL, common.EVALSHA, common.SCRIPT, common.FUNCTION, common.FCALL, common.CLIENT,
+		common.SUBSCRIBE, common.UNSUBSCRIBE, common.PSUBSCRIBE, common.PUNSUBSCRIBE,
+		common.SSUBSCRIBE, common.SUNSUBSCRIBE, common.SAVE, common.BGSAVE,
+		common.BGREWRITEAOF, common.REPLICAOF, common.REPLCONF, common.PSYNC, common.ROLE,
+		common.WAIT, common.WAITAOF, common.CLUSTER, common.ASKING, common.MIGRATE, common.RAFT,
+		common.CRDT, common.SENTINEL:
+		return "", errors.New("ERR This Redis command is not allowed from script")
+	}
+	if err := s.checkScriptKeys(common.Command{CMD: cmdID, Arguments: cmdArgs}); err != nil {
+		return "", err
+	}
+	if cmdID.IsWrite() {
+		if readOnly {
+			return "", errors.New("ERR Write commands are not allowed from read-only scripts.")
+		}
+		s.runningScript.wrote = true
+	}
+	return s.execute(common.Command{CMD: cmdID, ClientID: c.ID, Arguments: cmdArgs}, c)
+}
+
+// handleBusyCMD replies to the commands received while a script is busy
+func (s *server) handleBusyCMD(cmd common.Command) {
+	c, exists := s.clientByID(cmd.ClientID)
+	if !exists || c == nil {
+		log.Printf("client ID  %d does not exists", cmd.ClientID)
+		return
+	}
+
+	var response string
+	var err error
+	switch {
+	case !cmd.ExpectsReply():
+		// the acknowledgements of the replicas are processed, a PSYNC is refused
+		var refused error
+		if cmd.CMD == common.PSYNC {
+			refused = errBusy
+		}
+		s.handleReplicaCMD(cmd, c, refused)
+		return
+	case !isQueueable(cmd) && cmd.CMD == common.CLIENT:
+		// disconnections are always processed
+		response, err = s.execute(cmd, c)
+	case cmd.CMD == common.SCRIPT && cmd.Err == nil &&
+		cmd.Arguments.(common.SCRIPTArguments).Subcommand == common.ScriptSubcommandKILL:
+		response, err = s.killScript()
+	case cmd.CMD == common.FUNCTION && cmd.Err == nil &&
+		cmd.Arguments.(common.FUNCTIONArguments).Subcommand == common.FunctionSubcommandKILL:
+		response, err = s.killScript()
+	default:
+		err = errBusy
+	}
+	if err != nil {
+		response = resp.Error(err)
+	}
+	if len(response) != 0 {
+		c.reply(response)
+	}
+}
+
+func (s *server) killScript() (string, error) {
+	if s.runningScript == nil {
+		return "", errNotBusy
+	}
+	if s.runningScript.wrote {
+		return "", errUnkillable
+	}
+	s.runningScript.cancel()
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) handleSCRIPT(args common.CommandArguments) (string, error) {
+	scriptArgs, ok := args.(common.SCRIPTArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid SCRIPT argments %v", args)
+	}
+	switch scriptArgs.Subcommand {
+	case common.ScriptSubcommandLOAD:
+		sc, err := s.loadScript(scriptArgs.Args[0])
+		if err != nil {
+			return "", err
+		}
+		return resp.BulkString(&sc.SHA), nil
+	case common.ScriptSubcommandEXISTS:
+		exists := make([]interface{}, 0, len(scriptArgs.Args))
+		for _, sha := range scriptArgs.Args {
+			if _, cached := s.scripts[strings.ToLower(sha)]; cached {
+				exists = append(exists, 1)
+			} else {
+				exists = append(exists, 0)
+			}
+		}
+		return resp.Array(exists), nil
+	case common.ScriptSubcommandFLUSH:
+		s.scripts = make(map[string]*script.Script)
+		return resp.SimpleString("OK"), nil
+	case common.ScriptSubcommandKILL:
+		return s.killScript()
+	default:
+		return "-ERR", fmt.Errorf("unsupported SCRIPT subcommand %v", args)
+	}
+}
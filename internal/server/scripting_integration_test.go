@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_009)
+
+	go Start(port, 1, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+
+	ctx := context.Background()
+	incrBy := redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or 0)
+local next = current + tonumber(ARGV[1])
+redis.call('SET', KEYS[1], next)
+return next`)
+	val, err := incrBy.Run(ctx, rdb, []string{"counter"}, 5).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, val, int64(5))
+	val, err = incrBy.Run(ctx, rdb, []string{"counter"}, 2).Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, val, int64(7))
+
+	exists, err := rdb.ScriptExists(ctx, incrBy.Hash(), "ffffffffffffffffffffffffffffffffffffffff").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, exists[0], true)
+	common.AssertEquals(t, exists[1], false)
+
+	sha, err := rdb.ScriptLoad(ctx, "return {KEYS[1], ARGV[1]}").Result()
+	common.ExpectNoError(t, err)
+	val, err = rdb.EvalSha(ctx, sha, []string{"k"}, "a").Result()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, fmt.Sprint(val), "[k a]")
+
+	err = rdb.Do(ctx, "EVAL_RO", "return redis.call('SET', 'x', 1)", 0).Err()
+	if err == nil || err.Error() != "ERR Write commands are not allowed from read-only scripts." {
+		t.Errorf("want read-only script error, got %v", err)
+	}
+
+	common.ExpectNoError(t, rdb.ScriptFlush(ctx).Err())
+	err = rdb.EvalSha(ctx, sha, nil).Err()
+	if err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		t.Errorf("want NOSCRIPT error, got %v", err)
+	}
+
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+func TestBusyScriptKill(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_010)
+
+	go Start(port, 2, ready, quit, events, WithBusyScriptTimeout(50*time.Millisecond))
+
+	<-ready
+	fmt.Println("server is ready")
+
+	ctx := context.Background()
+	scriptClient := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	common.ExpectNoError(t, rdb.Set(ctx, "x", 1, 0).Err())
+
+	scriptErr := make(chan error)
+	go func() {
+		scriptErr <- scriptClient.Eval(ctx, "while true do end", nil).Err()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	err := rdb.Get(ctx, "x").Err()
+	if err == nil || !strings.HasPrefix(err.Error(), "BUSY") {
+		t.Errorf("want BUSY error, got %v", err)
+	}
+	common.ExpectNoError(t, rdb.ScriptKill(ctx).Err())
+	err = <-scriptErr
+	if err == nil || err.Error() != errKilled.Error() {
+		t.Errorf("want error:%s , got: %s ", errKilled, err)
+	}
+	err = rdb.ScriptKill(ctx).Err()
+	if err == nil || err.Error() != errNotBusy.Error() {
+		t.Errorf("want error:%s , got: %s ", errNotBusy, err)
+	}
+
+	common.ExpectNoError(t, scriptClient.Close())
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
@@ -0,0 +1,1017 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/replication"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/sentinel"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSentinelDownAfter       = 30 * time.Second
+	defaultSentinelFailoverTimeout = 3 * time.Minute
+	// the instances are pinged every sentinelPingPeriod, or every down-after when shorter, and
+	// asked their INFO every sentinelInfoPeriod, every second during a failover
+	sentinelPingPeriod  = time.Second
+	sentinelInfoPeriod  = 10 * time.Second
+	sentinelHelloPeriod = 2 * time.Second
+	// sentinelAskPeriod is how often the other sentinels are asked whether a master is down, their
+	// answers are valid for sentinelAskValidityMult periods
+	sentinelAskPeriod       = time.Second
+	sentinelAskValidityMult = 5
+	// sentinelMaxDesync delays the failovers of the sentinels by up to a second, so they do not
+	// ask for votes at the same time
+	sentinelMaxDesync = time.Second
+	// sentinelElectionTimeout bounds the election of the leader, or failover-timeout when shorter
+	sentinelElectionTimeout = 10 * time.Second
+	// sentinelReconfWaitMult is the number of hello periods a replica with a wrong master is left
+	// alone after a configuration change, so the new configuration can reach every sentinel
+	sentinelReconfWaitMult = 4
+)
+
+// the states of a failover, like redis
+const (
+	failoverNone          = "none"
+	failoverWaitStart     = "wait_start"
+	failoverWaitPromotion = "wait_promotion"
+	failoverReconfSlaves  = "reconf_slaves"
+)
+
+var (
+	errSentinelMode     = errors.New("sentinel mode is not compatible with cluster mode, raft mode, active-active mode, replication or persistence")
+	errNoSuchMaster     = errors.New("ERR No such master with that name")
+	errDuplicatedMaster = errors.New("ERR Duplicated master name")
+	errFailoverInProg   = errors.New("INPROG Failover already in progress")
+	errNoGoodReplica    = errors.New("NOGOODSLAVE No suitable replica to promote")
+)
+
+// WithSentinel starts the server in sentinel mode: it monitors masters and their replicas and
+// promotes a replica when a master is down. downAfter & failoverTimeout are the defaults of the
+// masters monitored.
+func WithSentinel(downAfter, failoverTimeout time.Duration) Option {
+	return func(s *server) {
+		st := s.sentinelConfig()
+		st.downAfter, st.failoverTimeout = downAfter, failoverTimeout
+	}
+}
+
+// WithSentinelMonitor monitors the master at host:port under name, like SENTINEL MONITOR. quorum is
+// the number of sentinels that must agree the master is down to start a failover.
+func WithSentinelMonitor(name, host string, port, quorum int) Option {
+	return func(s *server) {
+		st := s.sentinelConfig()
+		st.monitors = append(st.monitors, common.SENTINELArguments{
+			Subcommand: common.SentinelSubcommandMONITOR, Name: name, Host: host, Port: port, Quorum: quorum,
+		})
+	}
+}
+
+func (s *server) sentinelConfig() *sentinelState {
+	if s.sentinel == nil {
+		s.sentinel = &sentinelState{
+			downAfter:       defaultSentinelDownAfter,
+			failoverTimeout: defaultSentinelFailoverTimeout,
+		}
+	}
+	return s.sentinel
+}
+
+// sentinelState is the state of the sentinel mode. Every master is monitored with its replicas,
+// discovered from its INFO, and with the other sentinels monitoring it, discovered from the hellos
+// published to the instances. A master not answering for down-after is subjectively down, it is
+// objectively down once quorum sentinels agree with SENTINEL IS-MASTER-DOWN-BY-ADDR. A sentinel
+// then asks the others for their vote in a new epoch, the one elected by the majority promotes the
+// best replica, points the other replicas to it and publishes the new configuration with the epoch
+// of its election. The configuration is kept in memory.
+type sentinelState struct {
+	myID         string
+	currentEpoch uint64
+	// downAfter & failoverTimeout are the defaults of the masters monitored
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	// monitors are the masters monitored at startup
+	monitors []common.SENTINELArguments
+	masters  map[string]*monitoredMaster
+
+	events chan sentinelEvent
+	wg     sync.WaitGroup
+}
+
+// monitoredMaster is a master monitored by the sentinel
+type monitoredMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	configEpoch     uint64
+	// configChangedAt is when the master was switched
+	configChangedAt time.Time
+
+	master *sentinelInstance
+	// replicas are by address, sentinels by run ID
+	replicas  map[string]*sentinelInstance
+	sentinels map[string]*sentinelInstance
+	// vote is the leader this sentinel voted for to fail the master over
+	vote  sentinel.Vote
+	odown bool
+
+	failoverState string
+	failoverEpoch uint64
+	// failoverStartTime is also set when voting for another sentinel, a sentinel does not start a
+	// failover for 2 failover timeouts after the last one
+	failoverStartTime  time.Time
+	failoverStateSince time.Time
+	// forced is set by SENTINEL FAILOVER, the failover is started without election
+	forced   bool
+	promoted *sentinelInstance
+}
+
+// sentinelInstance is a master, a replica or another sentinel
+type sentinelInstance struct {
+	master *monitoredMaster
+	addr   string
+	// runID is only known for the sentinels
+	runID     string
+	link      *sentinelLink
+	closed    bool
+	createdAt time.Time
+	// localIP is the address of this sentinel as seen by the instance
+	localIP string
+
+	lastPingAt  time.Time
+	lastPongAt  time.Time
+	pendingPing bool
+	// unansweredSince is when the oldest ping not answered was sent, zero while the instance
+	// answers, like the act_ping_time of redis
+	unansweredSince time.Time
+	// linkDown is set while the commands fail
+	linkDown bool
+	sdown    bool
+
+	infoSentAt     time.Time
+	lastInfoAt     time.Time
+	pendingInfo    bool
+	info           sentinel.Info
+	roleReportedAt time.Time
+
+	lastHelloAt  time.Time
+	pendingHello bool
+
+	// masterDown & vote are the answers of a sentinel to IS-MASTER-DOWN-BY-ADDR
+	lastAskAt   time.Time
+	pendingAsk  bool
+	masterDown  bool
+	downReplyAt time.Time
+	vote        sentinel.Vote
+
+	// reconfSent & reconfDone track a replica pointed to the promoted replica
+	reconfSent bool
+	reconfDone bool
+}
+
+// startSentinel monitors the masters given at startup
+func (s *server) startSentinel() {
+	st := s.sentinel
+	if st == nil {
+		return
+	}
+	st.myID = replication.NewID()
+	st.masters = make(map[string]*monitoredMaster)
+	st.events = make(chan sentinelEvent)
+	for _, monitor := range st.monitors {
+		if err := s.monitor(monitor); err != nil {
+			log.Printf("ERR monitoring %s: %v", monitor.Name, err)
+		}
+	}
+	log.Printf("sentinel %s monitoring %d masters", st.myID, len(st.masters))
+}
+
+// stopSentinel closes the links and waits for their goroutines
+func (s *server) stopSentinel() {
+	st := s.sentinel
+	if st == nil || st.masters == nil {
+		return
+	}
+	for _, m := range st.masters {
+		s.closeMaster(m)
+	}
+	st.wg.Wait()
+}
+
+// sentinelEvents returns the channel of the links, nil when the sentinel mode is disabled
+func (s *server) sentinelEvents() <-chan sentinelEvent {
+	if s.sentinel == nil {
+		return nil
+	}
+	return s.sentinel.events
+}
+
+func (s *server) monitor(args common.SENTINELArguments) error {
+	st := s.sentinel
+	if _, exists := st.masters[args.Name]; exists {
+		return errDuplicatedMaster
+	}
+	m := &monitoredMaster{
+		name:            args.Name,
+		quorum:          args.Quorum,
+		downAfter:       st.downAfter,
+		failoverTimeout: st.failoverTimeout,
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+		failoverState:   failoverNone,
+		configChangedAt: s.now(),
+	}
+	m.master = s.newSentinelInstance(m, net.JoinHostPort(args.Host, strconv.Itoa(args.Port)), "")
+	st.masters[args.Name] = m
+	s.sentinelNotify("+monitor", m, m.master, fmt.Sprintf("quorum %d", m.quorum))
+	return nil
+}
+
+func (s *server) newSentinelInstance(m *monitoredMaster, addr, runID string) *sentinelInstance {
+	inst := &sentinelInstance{master: m, addr: addr, runID: runID, createdAt: s.now()}
+	inst.roleReportedAt, inst.unansweredSince = inst.createdAt, inst.createdAt
+	s.sentinel.openLink(inst, runID == "")
+	return inst
+}
+
+func (s *server) closeInstance(inst *sentinelInstance) {
+	inst.closed = true
+	inst.link.close()
+}
+
+func (s *server) closeMaster(m *monitoredMaster) {
+	s.closeInstance(m.master)
+	for _, inst := range m.replicas {
+		s.closeInstance(inst)
+	}
+	for _, inst := range m.sentinels {
+		s.closeInstance(inst)
+	}
+}
+
+// sentinelCommand queues a command to inst, it is dropped when the queue is full
+func (s *server) sentinelCommand(inst *sentinelInstance, args ...string) bool {
+	select {
+	case inst.link.out <- args:
+		return true
+	default:
+		return false
+	}
+}
+
+// sentinelNotify logs an event of inst and publishes it to the clients of the sentinel
+func (s *server) sentinelNotify(event string, m *monitoredMaster, inst *sentinelInstance, extra string) {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	var msg string
+	if inst == m.master {
+		msg = fmt.Sprintf("master %s %s %s", m.name, host, port)
+	} else {
+		kind := "slave"
+		if inst.runID != "" {
+			kind = "sentinel"
+		}
+		masterHost, masterPort, _ := net.SplitHostPort(m.master.addr)
+		msg = fmt.Sprintf("%s %s %s %s @ %s %s %s", kind, inst.addr, host, port, m.name, masterHost, masterPort)
+	}
+	if extra != "" {
+		msg += " " + extra
+	}
+	log.Printf("%s %s", event, msg)
+	s.publish(event, msg)
+}
+
+// currentMasterAddr is the address of the master, the promoted replica once it was promoted
+func (m *monitoredMaster) currentMasterAddr() string {
+	if m.failoverState == failoverReconfSlaves && m.promoted != nil {
+		return m.promoted.addr
+	}
+	return m.master.addr
+}
+
+// instances returns the master and its replicas
+func (m *monitoredMaster) instances() []*sentinelInstance {
+	instances := make([]*sentinelInstance, 0, len(m.replicas)+1)
+	instances = append(instances, m.master)
+	for _, inst := range m.replicas {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+func (m *monitoredMaster) pingPeriod() time.Duration {
+	if m.downAfter < sentinelPingPeriod {
+		return m.downAfter
+	}
+	return sentinelPingPeriod
+}
+
+// sentinelCron sends the periodic commands, detects the instances down and runs the failovers
+func (s *server) sentinelCron() {
+	st := s.sentinel
+	if st == nil {
+		return
+	}
+	now := s.now()
+	for _, m := range st.masters {
+		for _, inst := range m.instances() {
+			s.sentinelPing(m, inst, now)
+			if !inst.pendingInfo && now.Sub(inst.lastInfoAt) >= s.infoPeriod(m, inst) &&
+				now.Sub(inst.infoSentAt) >= sentinelPingPeriod {
+				inst.pendingInfo = s.sentinelCommand(inst, "INFO")
+				inst.infoSentAt = now
+			}
+			if !inst.pendingHello && now.Sub(inst.lastHelloAt) >= sentinelHelloPeriod && inst.localIP != "" {
+				inst.pendingHello = s.sentinelCommand(inst, "PUBLISH", sentinel.HelloChannel, s.hello(m, inst))
+				inst.lastHelloAt = now
+			}
+			s.checkSubjectivelyDown(m, inst, now)
+		}
+		for _, inst := range m.sentinels {
+			s.sentinelPing(m, inst, now)
+			s.checkSubjectivelyDown(m, inst, now)
+		}
+		s.checkObjectivelyDown(m, now)
+		if m.master.sdown {
+			s.askMasterState(m, now)
+		}
+		s.startFailoverIfNeeded(m, now)
+		s.sentinelFailoverCron(m, now)
+	}
+}
+
+func (s *server) sentinelPing(m *monitoredMaster, inst *sentinelInstance, now time.Time) {
+	if !inst.pendingPing && now.Sub(inst.lastPingAt) >= m.pingPeriod() {
+		inst.pendingPing = s.sentinelCommand(inst, "PING")
+		inst.lastPingAt = now
+		if inst.pendingPing && inst.unansweredSince.IsZero() {
+			inst.unansweredSince = now
+		}
+	}
+}
+
+// infoPeriod is the period of INFO, the replicas are refreshed every second during a failover and
+// while they are not replicating from their master, the master until its replicas are known
+func (s *server) infoPeriod(m *monitoredMaster, inst *sentinelInstance) time.Duration {
+	if inst == m.master && len(m.replicas) == 0 {
+		return time.Second
+	}
+	if inst != m.master && (m.master.sdown || m.failoverState != failoverNone ||
+		inst.info.Role != "slave" || inst.info.MasterAddr != m.master.addr) {
+		return time.Second
+	}
+	return sentinelInfoPeriod
+}
+
+func (s *server) hello(m *monitoredMaster, inst *sentinelInstance) string {
+	return sentinel.Hello{
+		Addr:         net.JoinHostPort(inst.localIP, strconv.Itoa(int(s.port))),
+		RunID:        s.sentinel.myID,
+		CurrentEpoch: s.sentinel.currentEpoch,
+		MasterName:   m.name,
+		MasterAddr:   m.currentMasterAddr(),
+		ConfigEpoch:  m.configEpoch,
+	}.String()
+}
+
+func (s *server) checkSubjectivelyDown(m *monitoredMaster, inst *sentinelInstance, now time.Time) {
+	sdown := !inst.unansweredSince.IsZero() && now.Sub(inst.unansweredSince) > m.downAfter
+	if sdown == inst.sdown {
+		return
+	}
+	inst.sdown = sdown
+	if sdown {
+		s.sentinelNotify("+sdown", m, inst, "")
+	} else {
+		s.sentinelNotify("-sdown", m, inst, "")
+	}
+}
+
+// checkObjectivelyDown counts the sentinels that reported the master down recently
+func (s *server) checkObjectivelyDown(m *monitoredMaster, now time.Time) {
+	odown := false
+	if m.master.sdown {
+		votes := 1
+		for _, sn := range m.sentinels {
+			if sn.masterDown && now.Sub(sn.downReplyAt) < sentinelAskValidityMult*sentinelAskPeriod {
+				votes++
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown == m.odown {
+		return
+	}
+	m.odown = odown
+	if odown {
+		s.sentinelNotify("+odown", m, m.master, fmt.Sprintf("#quorum %d/%d", m.quorum, m.quorum))
+	} else {
+		s.sentinelNotify("-odown", m, m.master, "")
+	}
+}
+
+// askMasterState asks the other sentinels whether the master is down, asking for their vote in the
+// epoch of the failover once this sentinel started it. The votes are asked without waiting for the
+// ask period, the first sentinel asking is elected.
+func (s *server) askMasterState(m *monitoredMaster, now time.Time) {
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	runID, epoch, period := "*", s.sentinel.currentEpoch, sentinelAskPeriod
+	if m.failoverState != failoverNone && !now.Before(m.failoverStartTime) {
+		runID, epoch, period = s.sentinel.myID, m.failoverEpoch, 0
+	}
+	for _, sn := range m.sentinels {
+		if sn.pendingAsk || now.Sub(sn.lastAskAt) < period {
+			continue
+		}
+		sn.pendingAsk = s.sentinelCommand(sn, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port,
+			strconv.FormatUint(epoch, 10), runID)
+		sn.lastAskAt = now
+	}
+}
+
+func (s *server) startFailoverIfNeeded(m *monitoredMaster, now time.Time) {
+	if !m.odown || m.failoverState != failoverNone || now.Before(m.failoverStartTime.Add(2*m.failoverTimeout)) {
+		return
+	}
+	s.startFailover(m, now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync)))), false)
+}
+
+func (s *server) startFailover(m *monitoredMaster, start time.Time, forced bool) {
+	st := s.sentinel
+	st.currentEpoch++
+	m.failoverEpoch = st.currentEpoch
+	m.failoverStartTime = start
+	m.forced = forced
+	s.setFailoverState(m, failoverWaitStart)
+	s.sentinelNotify("+new-epoch", m, m.master, strconv.FormatUint(st.currentEpoch, 10))
+	s.sentinelNotify("+try-failover", m, m.master, "")
+}
+
+func (s *server) setFailoverState(m *monitoredMaster, state string) {
+	m.failoverState = state
+	m.failoverStateSince = s.now()
+}
+
+func (s *server) abortFailover(m *monitoredMaster, reason string) {
+	s.sentinelNotify(reason, m, m.master, "")
+	s.setFailoverState(m, failoverNone)
+	m.promoted, m.forced = nil, false
+}
+
+// sentinelFailoverCron moves the failover in progress to its next state
+func (s *server) sentinelFailoverCron(m *monitoredMaster, now time.Time) {
+	switch m.failoverState {
+	case failoverWaitStart:
+		if now.Before(m.failoverStartTime) {
+			return
+		}
+		if !m.forced && s.failoverLeader(m) != s.sentinel.myID {
+			timeout := sentinelElectionTimeout
+			if m.failoverTimeout < timeout {
+				timeout = m.failoverTimeout
+			}
+			if now.Sub(m.failoverStartTime) > timeout {
+				s.abortFailover(m, "-failover-abort-not-elected")
+			}
+			return
+		}
+		s.sentinelNotify("+elected-leader", m, m.master, "")
+		promoted := s.selectReplica(m, now)
+		if promoted == nil {
+			s.abortFailover(m, "-failover-abort-no-good-slave")
+			return
+		}
+		m.promoted = promoted
+		s.sentinelNotify("+selected-slave", m, promoted, "")
+		s.sentinelCommand(promoted, "REPLICAOF", "NO", "ONE")
+		s.setFailoverState(m, failoverWaitPromotion)
+		s.sentinelNotify("+failover-state-send-slaveof-noone", m, promoted, "")
+	case failoverWaitPromotion:
+		if now.Sub(m.failoverStateSince) > m.failoverTimeout {
+			s.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+	case failoverReconfSlaves:
+		host, port, _ := net.SplitHostPort(m.promoted.addr)
+		done := true
+		for _, inst := range m.replicas {
+			if inst == m.promoted || inst.reconfDone || inst.sdown {
+				continue
+			}
+			done = false
+			if !inst.reconfSent {
+				inst.reconfSent = s.sentinelCommand(inst, "REPLICAOF", host, port)
+				s.sentinelNotify("+slave-reconf-sent", m, inst, "")
+			}
+		}
+		if done || now.Sub(m.failoverStateSince) > m.failoverTimeout {
+			s.sentinelNotify("+failover-end", m, m.master, "")
+			s.switchMaster(m, m.promoted.addr)
+		}
+	}
+}
+
+// failoverLeader counts the votes of the failover epoch, this sentinel votes for the sentinel with
+// the most votes, or for itself. It returns the leader elected, empty when there is none yet.
+func (s *server) failoverLeader(m *monitoredMaster) string {
+	st := s.sentinel
+	votes := make([]sentinel.Vote, 0, len(m.sentinels)+1)
+	for _, sn := range m.sentinels {
+		votes = append(votes, sn.vote)
+	}
+	candidate := sentinel.Winner(votes, m.failoverEpoch, 0, 0)
+	if candidate == "" {
+		candidate = st.myID
+	}
+	votes = append(votes, m.vote.Grant(&st.currentEpoch, m.failoverEpoch, candidate))
+	return sentinel.Winner(votes, m.failoverEpoch, len(m.sentinels)+1, m.quorum)
+}
+
+// selectReplica returns the replica to promote: a replica connected, refreshed recently, with the
+// greatest replication offset
+func (s *server) selectReplica(m *monitoredMaster, now time.Time) *sentinelInstance {
+	var candidates []sentinel.Candidate
+	for addr, inst := range m.replicas {
+		if inst.sdown || inst.linkDown || inst.info.Role != "slave" ||
+			now.Sub(inst.lastPongAt) > 5*m.pingPeriod() ||
+			now.Sub(inst.lastInfoAt) > 3*s.infoPeriod(m, inst) {
+			continue
+		}
+		candidates = append(candidates, sentinel.Candidate{Addr: addr, ReplOffset: inst.info.ReplOffset})
+	}
+	best, ok := sentinel.SelectReplica(candidates)
+	if !ok {
+		return nil
+	}
+	return m.replicas[best.Addr]
+}
+
+// switchMaster makes the instance at addr the master, the other instances become its replicas
+func (s *server) switchMaster(m *monitoredMaster, addr string) {
+	old := m.master
+	if old.addr != addr {
+		promoted, ok := m.replicas[addr]
+		if !ok {
+			promoted = s.newSentinelInstance(m, addr, "")
+		}
+		delete(m.replicas, addr)
+		m.replicas[old.addr] = old
+		m.master = promoted
+	}
+	for _, inst := range m.instances() {
+		inst.reconfSent, inst.reconfDone = false, false
+		inst.roleReportedAt = s.now()
+	}
+	for _, sn := range m.sentinels {
+		sn.masterDown = false
+	}
+	m.odown = false
+	m.configChangedAt = s.now()
+	s.setFailoverState(m, failoverNone)
+	m.promoted, m.forced = nil, false
+	oldHost, oldPort, _ := net.SplitHostPort(old.addr)
+	host, port, _ := net.SplitHostPort(addr)
+	msg := strings.Join([]string{m.name, oldHost, oldPort, host, port}, " ")
+	log.Printf("+switch-master %s", msg)
+	s.publish("+switch-master", msg)
+}
+
+func (s *server) handleSentinelEvent(e sentinelEvent) {
+	inst := e.inst
+	if inst.closed {
+		return
+	}
+	m := inst.master
+	if e.hello != "" {
+		s.processHello(e.hello)
+		return
+	}
+	now := s.now()
+	inst.linkDown = e.err != nil
+	if e.localIP != "" {
+		inst.localIP = e.localIP
+	}
+	switch e.args[0] {
+	case "PING":
+		inst.pendingPing = false
+		if e.err == nil && (e.reply.Kind == resp.KindSimpleString ||
+			strings.HasPrefix(e.reply.Str, "LOADING") || strings.HasPrefix(e.reply.Str, "MASTERDOWN")) {
+			inst.lastPongAt, inst.unansweredSince = now, time.Time{}
+		}
+	case "INFO":
+		inst.pendingInfo = false
+		if e.err == nil && e.reply.Kind == resp.KindBulkString {
+			s.refreshInfo(m, inst, sentinel.ParseInfo(e.reply.Str), now)
+		}
+	case "PUBLISH":
+		inst.pendingHello = false
+	case "SENTINEL":
+		inst.pendingAsk = false
+		if e.err != nil || len(e.reply.Elems) != 3 {
+			return
+		}
+		inst.masterDown = e.reply.Elems[0].Int == 1
+		inst.downReplyAt = now
+		if leader := e.reply.Elems[1].Str; leader != "*" {
+			inst.vote = sentinel.Vote{Leader: leader, Epoch: uint64(e.reply.Elems[2].Int)}
+		}
+	case "REPLICAOF":
+		if e.err != nil || e.reply.Kind == resp.KindError {
+			log.Printf("ERR REPLICAOF %s failed: %v%s", inst.addr, e.err, e.reply.Str)
+		}
+	}
+}
+
+// refreshInfo updates the replicas of a master from its INFO, follows the promotion of the replica
+// of a failover and fixes the replicas replicating from another master
+func (s *server) refreshInfo(m *monitoredMaster, inst *sentinelInstance, info sentinel.Info, now time.Time) {
+	if info.Role != inst.info.Role {
+		inst.roleReportedAt = now
+	}
+	inst.info, inst.lastInfoAt = info, now
+	if inst == m.master && info.Role == "master" {
+		for _, addr := range info.Replicas {
+			if _, ok := m.replicas[addr]; !ok && addr != m.master.addr {
+				m.replicas[addr] = s.newSentinelInstance(m, addr, "")
+				s.sentinelNotify("+slave", m, m.replicas[addr], "")
+			}
+		}
+		return
+	}
+	if m.replicas[inst.addr] != inst {
+		return
+	}
+	switch {
+	case inst == m.promoted && m.failoverState == failoverWaitPromotion && info.Role == "master":
+		m.configEpoch = m.failoverEpoch
+		s.setFailoverState(m, failoverReconfSlaves)
+		s.sentinelNotify("+promoted-slave", m, inst, "")
+		s.sentinelNotify("+failover-state-reconf-slaves", m, m.master, "")
+		// publish the new configuration right away
+		for _, inst := range m.instances() {
+			inst.lastHelloAt = time.Time{}
+		}
+	case m.failoverState == failoverReconfSlaves && inst.reconfSent && !inst.reconfDone:
+		if info.Role == "slave" && info.MasterAddr == m.promoted.addr && info.MasterLinkUp {
+			inst.reconfDone = true
+			s.sentinelNotify("+slave-reconf-done", m, inst, "")
+		}
+	case m.failoverState == failoverNone && !m.master.sdown:
+		wait := sentinelReconfWaitMult * sentinelHelloPeriod
+		if now.Sub(m.configChangedAt) <= wait || now.Sub(inst.roleReportedAt) <= wait {
+			return
+		}
+		host, port, _ := net.SplitHostPort(m.master.addr)
+		if info.Role == "master" {
+			// a former master that came back, or a replica promoted by hand
+			s.sentinelNotify("+convert-to-slave", m, inst, "")
+			s.sentinelCommand(inst, "REPLICAOF", host, port)
+		} else if info.Role == "slave" && info.MasterAddr != m.master.addr {
+			s.sentinelNotify("+fix-slave-config", m, inst, "")
+			s.sentinelCommand(inst, "REPLICAOF", host, port)
+		}
+	}
+}
+
+// processHello adds the sentinels announcing themselves and switches to the configurations of the
+// masters with a greater epoch
+func (s *server) processHello(msg string) {
+	st := s.sentinel
+	h, err := sentinel.ParseHello(msg)
+	if err != nil {
+		log.Printf("ERR %v: %q", err, msg)
+		return
+	}
+	m, ok := st.masters[h.MasterName]
+	if !ok || h.RunID == st.myID {
+		return
+	}
+	if h.CurrentEpoch > st.currentEpoch {
+		st.currentEpoch = h.CurrentEpoch
+		s.sentinelNotify("+new-epoch", m, m.master, strconv.FormatUint(h.CurrentEpoch, 10))
+	}
+	sn, known := m.sentinels[h.RunID]
+	if known && sn.addr != h.Addr {
+		s.closeInstance(sn)
+		delete(m.sentinels, h.RunID)
+		known = false
+	}
+	if !known {
+		// a sentinel restarted at the same address has a new run ID
+		for runID, other := range m.sentinels {
+			if other.addr == h.Addr {
+				s.closeInstance(other)
+				delete(m.sentinels, runID)
+			}
+		}
+		sn = s.newSentinelInstance(m, h.Addr, h.RunID)
+		m.sentinels[h.RunID] = sn
+		s.sentinelNotify("+sentinel", m, sn, "")
+	}
+	sn.lastHelloAt = s.now()
+	if h.ConfigEpoch > m.configEpoch {
+		m.configEpoch = h.ConfigEpoch
+		if h.MasterAddr != m.master.addr {
+			s.sentinelNotify("+config-update-from", m, sn, "")
+			s.switchMaster(m, h.MasterAddr)
+		}
+	}
+}
+
+// sentinelRefuse refuses the commands that are not available in sentinel mode
+func (s *server) sentinelRefuse(cmd common.Command) error {
+	if s.sentinel == nil || cmd.Err != nil {
+		return nil
+	}
+	switch cmd.CMD {
+	case common.PING, common.SENTINEL, common.INFO, common.ROLE, common.CLIENT, common.HELLO,
+		common.COMMAND, common.SUBSCRIBE, common.UNSUBSCRIBE, common.PSUBSCRIBE,
+		common.PUNSUBSCRIBE, common.PUBLISH, common.PUBSUB:
+		return nil
+	}
+	name := ""
+	if len(cmd.Args) > 0 {
+		name = cmd.Args[0]
+	}
+	return fmt.Errorf("ERR unknown command '%s', this instance runs in sentinel mode", name)
+}
+
+func (s *server) handleSENTINEL(args common.CommandArguments) (string, error) {
+	sentinelArgs, ok := args.(common.SENTINELArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid SENTINEL argments %v", args)
+	}
+	st := s.sentinel
+	if st == nil {
+		return "", errors.New("ERR This instance is not running in sentinel mode")
+	}
+	now := s.now()
+	switch sentinelArgs.Subcommand {
+	case common.SentinelSubcommandMYID:
+		return resp.BulkString(&st.myID), nil
+	case common.SentinelSubcommandMASTERS:
+		names := make([]string, 0, len(st.masters))
+		for name := range st.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		masters := make([]string, 0, len(names))
+		for _, name := range names {
+			masters = append(masters, resp.Array(s.masterFields(st.masters[name], now)))
+		}
+		return resp.RawArray(masters), nil
+	case common.SentinelSubcommandMONITOR:
+		if err := s.monitor(sentinelArgs); err != nil {
+			return "", err
+		}
+		return resp.SimpleString("OK"), nil
+	case common.SentinelSubcommandISMASTERDOWN:
+		return s.isMasterDown(sentinelArgs, now), nil
+	}
+
+	m, ok := st.masters[sentinelArgs.Name]
+	if !ok {
+		if sentinelArgs.Subcommand == common.SentinelSubcommandMASTERADDR {
+			return resp.NullArray(), nil
+		}
+		return "", errNoSuchMaster
+	}
+	switch sentinelArgs.Subcommand {
+	case common.SentinelSubcommandMASTER:
+		return resp.Array(s.masterFields(m, now)), nil
+	case common.SentinelSubcommandMASTERADDR:
+		host, port, _ := net.SplitHostPort(m.currentMasterAddr())
+		return resp.Array([]interface{}{host, port}), nil
+	case common.SentinelSubcommandREPLICAS:
+		addrs := make([]string, 0, len(m.replicas))
+		for addr := range m.replicas {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		replicas := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			replicas = append(replicas, resp.Array(s.replicaFields(m, m.replicas[addr], now)))
+		}
+		return resp.RawArray(replicas), nil
+	case common.SentinelSubcommandSENTINELS:
+		runIDs := make([]string, 0, len(m.sentinels))
+		for runID := range m.sentinels {
+			runIDs = append(runIDs, runID)
+		}
+		sort.Strings(runIDs)
+		sentinels := make([]string, 0, len(runIDs))
+		for _, runID := range runIDs {
+			sentinels = append(sentinels, resp.Array(s.sentinelFields(m.sentinels[runID], now)))
+		}
+		return resp.RawArray(sentinels), nil
+	case common.SentinelSubcommandCKQUORUM:
+		usable := 1
+		for _, sn := range m.sentinels {
+			if !sn.sdown {
+				usable++
+			}
+		}
+		voters := len(m.sentinels) + 1
+		if usable < m.quorum {
+			return "", fmt.Errorf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable)
+		}
+		if usable < voters/2+1 {
+			return "", fmt.Errorf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable)
+		}
+		return resp.SimpleString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable)), nil
+	case common.SentinelSubcommandREMOVE:
+		s.closeMaster(m)
+		delete(st.masters, m.name)
+		s.sentinelNotify("-monitor", m, m.master, "")
+		return resp.SimpleString("OK"), nil
+	case common.SentinelSubcommandSET:
+		return s.sentinelSet(m, sentinelArgs.Options)
+	case common.SentinelSubcommandFAILOVER:
+		if m.failoverState != failoverNone {
+			return "", errFailoverInProg
+		}
+		if s.selectReplica(m, now) == nil {
+			return "", errNoGoodReplica
+		}
+		s.startFailover(m, now, true)
+		return resp.SimpleString("OK"), nil
+	}
+	return "", fmt.Errorf("ERR unknown subcommand '%s'", sentinelArgs.Subcommand)
+}
+
+// isMasterDown answers another sentinel asking whether a master is down, with the vote of this
+// sentinel when it asks for it
+func (s *server) isMasterDown(args common.SENTINELArguments, now time.Time) string {
+	st := s.sentinel
+	addr := net.JoinHostPort(args.Host, strconv.Itoa(args.Port))
+	down, vote := 0, sentinel.Vote{Leader: "*"}
+	for _, m := range st.masters {
+		if m.master.addr != addr {
+			continue
+		}
+		if m.master.sdown {
+			down = 1
+		}
+		if args.RunID != "*" {
+			before := m.vote
+			vote = m.vote.Grant(&st.currentEpoch, args.Epoch, args.RunID)
+			if vote != before && vote.Leader != st.myID {
+				s.sentinelNotify("+vote-for-leader", m, m.master, fmt.Sprintf("%s %d", vote.Leader, vote.Epoch))
+				// do not start a failover while the sentinel voted for runs it
+				m.failoverStartTime = now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+			}
+		}
+		break
+	}
+	return resp.Array([]interface{}{down, vote.Leader, int(vote.Epoch)})
+}
+
+func (s *server) sentinelSet(m *monitoredMaster, options []string) (string, error) {
+	for i := 0; i < len(options); i += 2 {
+		option, value := strings.ToLower(options[i]), options[i+1]
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("ERR Invalid argument '%s' for SENTINEL SET '%s'", value, option)
+		}
+		switch option {
+		case "down-after-milliseconds":
+			m.downAfter = time.Duration(n) * time.Millisecond
+		case "failover-timeout":
+			m.failoverTimeout = time.Duration(n) * time.Millisecond
+		case "quorum":
+			m.quorum = n
+		default:
+			return "", fmt.Errorf("ERR Invalid argument '%s' for SENTINEL SET '%s'", option, option)
+		}
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+func instanceFlags(kind string, inst *sentinelInstance) string {
+	flags := []string{kind}
+	if inst.sdown {
+		flags = append(flags, "s_down")
+	}
+	if inst.linkDown {
+		flags = append(flags, "disconnected")
+	}
+	return strings.Join(flags, ",")
+}
+
+func sinceMillis(now, t time.Time) string {
+	if t.IsZero() {
+		return "-1"
+	}
+	return strconv.FormatInt(int64(now.Sub(t)/time.Millisecond), 10)
+}
+
+func (s *server) masterFields(m *monitoredMaster, now time.Time) []interface{} {
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	flags := instanceFlags("master", m.master)
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != failoverNone {
+		flags += ",failover_in_progress"
+	}
+	return []interface{}{
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"last-ping-reply", sinceMillis(now, m.master.lastPongAt),
+		"info-refresh", sinceMillis(now, m.master.lastInfoAt),
+		"role-reported", m.master.info.Role,
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(int64(m.failoverTimeout/time.Millisecond), 10),
+		"down-after-milliseconds", strconv.FormatInt(int64(m.downAfter/time.Millisecond), 10),
+		"failover-state", m.failoverState,
+	}
+}
+
+func (s *server) replicaFields(m *monitoredMaster, inst *sentinelInstance, now time.Time) []interface{} {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	masterHost, masterPort, _ := net.SplitHostPort(inst.info.MasterAddr)
+	linkStatus := "err"
+	if inst.info.MasterLinkUp {
+		linkStatus = "ok"
+	}
+	return []interface{}{
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"flags", instanceFlags("slave", inst),
+		"last-ping-reply", sinceMillis(now, inst.lastPongAt),
+		"info-refresh", sinceMillis(now, inst.lastInfoAt),
+		"role-reported", inst.info.Role,
+		"master-link-status", linkStatus,
+		"master-host", masterHost,
+		"master-port", masterPort,
+		"slave-repl-offset", strconv.FormatInt(inst.info.ReplOffset, 10),
+	}
+}
+
+func (s *server) sentinelFields(inst *sentinelInstance, now time.Time) []interface{} {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	return []interface{}{
+		// the clients use the name as the address of the sentinel
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"runid", inst.runID,
+		"flags", instanceFlags("sentinel", inst),
+		"last-ping-reply", sinceMillis(now, inst.lastPongAt),
+		"last-hello-message", sinceMillis(now, inst.lastHelloAt),
+		"voted-leader", inst.vote.Leader,
+		"voted-leader-epoch", strconv.FormatUint(inst.vote.Epoch, 10),
+	}
+}
+
+// sentinelInfo is the sentinel section of INFO
+func (s *server) sentinelInfo(sb *strings.Builder) {
+	st := s.sentinel
+	sb.WriteString("=== Sentinel === \n")
+	sb.WriteString(fmt.Sprintf("sentinel_masters:%d\n", len(st.masters)))
+	sb.WriteString(fmt.Sprintf("sentinel_current_epoch:%d\n", st.currentEpoch))
+	names := make([]string, 0, len(st.masters))
+	for name := range st.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		m := st.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.master.sdown {
+			status = "sdown"
+		}
+		sb.WriteString(fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\n",
+			i, name, status, m.currentMasterAddr(), len(m.replicas), len(m.sentinels)+1))
+	}
+}
+
+// sentinelRole is the ROLE reply of a sentinel
+func (s *server) sentinelRole() string {
+	names := make([]interface{}, 0, len(s.sentinel.masters))
+	sorted := make([]string, 0, len(s.sentinel.masters))
+	for name := range s.sentinel.masters {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		names = append(names, name)
+	}
+	return resp.RawArray([]string{resp.BulkString(strPtr("sentinel")), resp.Array(names)})
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSentinel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	masterPort, replicaPorts := uint(10_045), []uint{10_046, 10_047}
+	sentinelPorts := []uint{10_050, 10_051, 10_052}
+
+	type instance struct {
+		rdb     *redis.Client
+		quit    chan bool
+		events  chan string
+		stopped bool
+	}
+	start := func(port uint, opts ...Option) *instance {
+		ready := make(chan bool, 1)
+		quit := make(chan bool, 1)
+		events := make(chan string, 32)
+		go Start(port, 100, ready, quit, events, append([]Option{WithRDB(t.TempDir(), "")}, opts...)...)
+		<-ready
+		return &instance{
+			rdb:    redis.NewClient(&redis.Options{Addr: fmt.Sprintf("127.0.0.1:%d", port)}),
+			quit:   quit,
+			events: events,
+		}
+	}
+	stop := func(i *instance) {
+		if i.stopped {
+			return
+		}
+		i.stopped = true
+		common.ExpectNoError(t, i.rdb.Close())
+		for quiet := false; !quiet; {
+			select {
+			case <-i.events:
+			case <-time.After(200 * time.Millisecond):
+				quiet = true
+			}
+		}
+		i.quit <- true
+		for event := range i.events {
+			if event == EventSuccessfulShutdown {
+				break
+			}
+		}
+	}
+
+	// within is eventually with a longer deadline, for the elections split that are retried
+	within := func(what string, timeout time.Duration, condition func() bool) {
+		for deadline := time.Now().Add(timeout); !condition(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	master := start(masterPort)
+	data := []*instance{master}
+	for _, port := range replicaPorts {
+		data = append(data, start(port, WithReplicaOf("127.0.0.1", int(masterPort))))
+	}
+	var sentinels []*instance
+	for _, port := range sentinelPorts {
+		sentinels = append(sentinels, start(port, WithSentinel(time.Second, 2*time.Second),
+			WithSentinelMonitor("mymaster", "127.0.0.1", int(masterPort), 2)))
+	}
+	defer func() {
+		for _, i := range append(sentinels, data...) {
+			stop(i)
+		}
+	}()
+
+	s := sentinels[0].rdb
+	common.AssertEquals(t, s.Get(ctx, "k").Err().Error(), "ERR unknown command 'get', this instance runs in sentinel mode")
+	common.AssertEquals(t, fmt.Sprint(s.Do(ctx, "ROLE").Val()), "[sentinel [mymaster]]")
+	common.AssertEquals(t, fmt.Sprint(s.Do(ctx, "HELLO").Val().([]interface{})[8:12]), "[mode sentinel role master]")
+	common.AssertEquals(t, s.Do(ctx, "SENTINEL", "MONITOR", "mymaster", "127.0.0.1", "10045", "2").Err().Error(),
+		errDuplicatedMaster.Error())
+	common.AssertEquals(t, s.Do(ctx, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "unknown").Err(), redis.Nil)
+	for _, sn := range sentinels {
+		sn := sn
+		eventually(t, "the sentinels to discover the replicas and each other", func() bool {
+			master, err := sn.rdb.Do(ctx, "SENTINEL", "MASTER", "mymaster").Result()
+			if err != nil {
+				return false
+			}
+			fields := fmt.Sprint(master)
+			return strings.Contains(fields, "num-slaves 2") && strings.Contains(fields, "num-other-sentinels 2")
+		})
+	}
+	common.AssertEquals(t, s.Do(ctx, "SENTINEL", "CKQUORUM", "mymaster").Val(),
+		"OK 3 usable Sentinels. Quorum and failover authorization can be reached")
+
+	addrs := make([]string, len(sentinelPorts))
+	for i, port := range sentinelPorts {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	rdb := redis.NewFailoverClient(&redis.FailoverOptions{MasterName: "mymaster", SentinelAddrs: addrs})
+	defer func() { common.ExpectNoError(t, rdb.Close()) }()
+	common.ExpectNoError(t, rdb.Set(ctx, "k", "v", 0).Err())
+	common.AssertEquals(t, rdb.Get(ctx, "k").Val(), "v")
+	eventually(t, "the replicas to replicate the key", func() bool {
+		return data[1].rdb.Get(ctx, "k").Val() == "v" && data[2].rdb.Get(ctx, "k").Val() == "v"
+	})
+
+	stop(master)
+	var promoted string
+	within("the sentinels to fail the master over", 30*time.Second, func() bool {
+		promoted = ""
+		for _, sn := range sentinels {
+			addr, err := sn.rdb.Do(ctx, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster").Result()
+			if err != nil {
+				return false
+			}
+			current := fmt.Sprint(addr)
+			if current == "[127.0.0.1 10045]" || (promoted != "" && current != promoted) {
+				return false
+			}
+			promoted = current
+		}
+		return true
+	})
+	newMaster, other := data[1], data[2]
+	if promoted == "[127.0.0.1 10047]" {
+		newMaster, other = data[2], data[1]
+	}
+	common.AssertEquals(t, fmt.Sprint(newMaster.rdb.Do(ctx, "ROLE").Val().([]interface{})[0]), "master")
+	eventually(t, "the other replica to follow the new master", func() bool {
+		role, err := other.rdb.Do(ctx, "ROLE").Result()
+		return err == nil && fmt.Sprint(role.([]interface{})[:3]) == "[slave "+promoted[1:]
+	})
+	eventually(t, "the client to write to the new master", func() bool {
+		return rdb.Set(ctx, "k2", "v2", 0).Err() == nil
+	})
+	common.AssertEquals(t, rdb.Get(ctx, "k").Val(), "v")
+	eventually(t, "the other replica to replicate the new key", func() bool {
+		return other.rdb.Get(ctx, "k2").Val() == "v2"
+	})
+
+	// the former master is converted to a replica of the new master when it comes back
+	data[0] = start(masterPort)
+	within("the former master to replicate the new master", 30*time.Second, func() bool {
+		return data[0].rdb.Get(ctx, "k2").Val() == "v2"
+	})
+	common.AssertEquals(t, fmt.Sprint(data[0].rdb.Do(ctx, "ROLE").Val().([]interface{})[0]), "slave")
+}
+
+func TestSentinelOversizedReply(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	port := uint(10_062)
+
+	// the fake master answers every command with the header of a 1TB bulk string
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.ExpectNoError(t, err)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer func() { common.ExpectNoError(t, listener.Close()) }()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { _ = conn.Close() }()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte("$1099511627776\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	masterPort := listener.Addr().(*net.TCPAddr).Port
+
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 32)
+	go Start(port, 100, ready, quit, events, WithRDB(t.TempDir(), ""), WithSentinel(time.Second, 2*time.Second),
+		WithSentinelMonitor("mymaster", "127.0.0.1", masterPort, 1))
+	<-ready
+	rdb := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("127.0.0.1:%d", port)})
+	defer func() {
+		common.ExpectNoError(t, rdb.Close())
+		quit <- true
+		for event := range events {
+			if event == EventSuccessfulShutdown {
+				break
+			}
+		}
+	}()
+
+	eventually(t, "the sentinel to drop the link of the master", func() bool {
+		master, err := rdb.Do(ctx, "SENTINEL", "MASTER", "mymaster").Result()
+		return err == nil && strings.Contains(fmt.Sprint(master), "flags master,disconnected")
+	})
+}
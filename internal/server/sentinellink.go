@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/sentinel"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+const (
+	// sentinelLinkBufferSize is the number of commands queued per instance, the next ones are
+	// dropped
+	sentinelLinkBufferSize = 16
+	// sentinelCommandTimeout bounds the connection to an instance and every command
+	sentinelCommandTimeout = time.Second
+)
+
+// sentinelLink connects a sentinel to a monitored instance or to another sentinel. The commands
+// queued by the server loop are sent one at a time on the command connection and their replies are
+// forwarded to the loop, the masters & replicas also have a connection subscribed to the hello
+// channel.
+type sentinelLink struct {
+	inst *sentinelInstance
+	out  chan []string
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	// conns are the connections open, closed with the link
+	conns map[net.Conn]struct{}
+}
+
+// sentinelEvent is the reply to a command sent to an instance, or a hello received from it
+type sentinelEvent struct {
+	inst  *sentinelInstance
+	args  []string
+	reply resp.Reply
+	err   error
+	// localIP is the address of this sentinel on the connection, announced in its hellos
+	localIP string
+	hello   string
+}
+
+// openLink starts the goroutines of the link of inst, subscribed to its hellos when subscribe is set
+func (st *sentinelState) openLink(inst *sentinelInstance, subscribe bool) {
+	l := &sentinelLink{
+		inst:  inst,
+		out:   make(chan []string, sentinelLinkBufferSize),
+		done:  make(chan struct{}),
+		conns: make(map[net.Conn]struct{}),
+	}
+	inst.link = l
+	st.wg.Add(1)
+	go st.command(l)
+	if subscribe {
+		st.wg.Add(1)
+		go st.subscribe(l)
+	}
+}
+
+// close stops the goroutines of the link, their connections are closed to unblock them
+func (l *sentinelLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.done)
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+// dial connects to the instance, the connection is closed with the link
+func (l *sentinelLink) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", l.inst.addr, sentinelCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+	l.conns[conn] = struct{}{}
+	return conn, nil
+}
+
+func (l *sentinelLink) release(conn net.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	l.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (st *sentinelState) send(l *sentinelLink, e sentinelEvent) {
+	select {
+	case st.events <- e:
+	case <-l.done:
+	}
+}
+
+// command sends the commands queued to the instance, a failed connection is opened again by the
+// next command
+func (st *sentinelState) command(l *sentinelLink) {
+	defer st.wg.Done()
+	var conn net.Conn
+	var reader *textproto.Reader
+	defer func() {
+		if conn != nil {
+			l.release(conn)
+		}
+	}()
+	for {
+		var args []string
+		select {
+		case args = <-l.out:
+		case <-l.done:
+			return
+		}
+		e := sentinelEvent{inst: l.inst, args: args}
+		if conn == nil {
+			if conn, e.err = l.dial(); e.err != nil {
+				conn = nil
+				st.send(l, e)
+				continue
+			}
+			reader = textproto.NewReader(bufio.NewReader(conn))
+		}
+		_ = conn.SetDeadline(time.Now().Add(sentinelCommandTimeout))
+		if _, e.err = conn.Write(aof.AppendCommand(nil, args)); e.err == nil {
+			e.reply, e.err = resp.ReadReply(reader)
+		}
+		if e.err != nil {
+			l.release(conn)
+			conn = nil
+		} else if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			e.localIP = addr.IP.String()
+		}
+		st.send(l, e)
+	}
+}
+
+// subscribe forwards the hellos published to the instance, it connects again every second while
+// the instance is unreachable
+func (st *sentinelState) subscribe(l *sentinelLink) {
+	defer st.wg.Done()
+	for {
+		if conn, err := l.dial(); err == nil {
+			st.readHellos(l, conn)
+			l.release(conn)
+		}
+		select {
+		case <-l.done:
+			return
+		case <-time.After(sentinelPingPeriod):
+		}
+	}
+}
+
+func (st *sentinelState) readHellos(l *sentinelLink, conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(sentinelCommandTimeout))
+	if _, err := conn.Write(aof.AppendCommand(nil, []string{"SUBSCRIBE", sentinel.HelloChannel})); err != nil {
+		return
+	}
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		reply, err := resp.ReadReply(reader)
+		if err != nil {
+			return
+		}
+		if len(reply.Elems) == 3 && reply.Elems[0].Str == "message" {
+			st.send(l, sentinelEvent{inst: l.inst, hello: reply.Elems[2].Str})
+		}
+	}
+}
@@ -1,13 +1,25 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/aof"
 	"github.com/rilopez/redis-wire-protocol/internal/client"
+	"github.com/rilopez/redis-wire-protocol/internal/cluster"
 	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/envelope"
+	"github.com/rilopez/redis-wire-protocol/internal/function"
+	"github.com/rilopez/redis-wire-protocol/internal/keyspace"
+	"github.com/rilopez/redis-wire-protocol/internal/netpoll"
+	"github.com/rilopez/redis-wire-protocol/internal/replication"
 	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/script"
+	"io"
 	"log"
+	"math"
 	"net"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,25 +27,41 @@ import (
 
 type serverState int
 
-// used to time out the connection accept loop. default 2 secs will timeout accepting connections and check the quit channel
-const idleTimeout = 2 * time.Second
 const (
 	serverStateListening serverState = iota
 	serverStateShuttingDown
 	serverStateBooting
 )
 
+var (
+	errNotInteger   = errors.New("ERR value is not an integer or out of range")
+	errIncrOverflow = errors.New("ERR increment or decrement would overflow")
+)
+
 const (
 	EventAfterDisconnect    = "AFTER_DISCONNECT"
 	EventSuccessfulShutdown = "SUCCESSFUL_SHUTDOWN"
 )
 
+// Option configures optional server settings
+type Option func(*server)
+
+// WithBusyScriptTimeout sets how long a script can run before other clients get BUSY errors
+func WithBusyScriptTimeout(timeout time.Duration) Option {
+	return func(s *server) {
+		s.busyScriptTimeout = timeout
+	}
+}
+
 // Start creates a tcp connection listener to accept connections at `port`
-func Start(port uint, serverMaxClients uint, ready chan<- bool, quit <-chan bool, events chan<- string) {
+func Start(port uint, serverMaxClients uint, ready chan<- bool, quit <-chan bool, events chan<- string, opts ...Option) {
 	log.Printf("starting server demons  with \n  - port:%d\n - -serverMaxClients: %d\n",
 		port, serverMaxClients)
 
-	core := newServer(time.Now, port, serverMaxClients, ready, quit, events)
+	core := newServer(time.Now, port, serverMaxClients, ready, quit, events, opts...)
+	if err := core.loadData(); err != nil {
+		log.Fatalf("ERR %v", err)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -45,8 +73,20 @@ func Start(port uint, serverMaxClients uint, ready chan<- bool, quit <-chan bool
 
 // server maintains a map of clients and communication channels
 type server struct {
-	clients          map[uint]*connectedClient
-	db               map[string]*string
+	// directDirty counts the changes made by the commands the workers executed directly, the
+	// event loop adds them to dirty, see direct.go
+	directDirty int64
+	// direct is 1 while the workers can execute commands directly
+	direct int32
+	// exclusive is held by the event loop while it handles an event and by the workers, for
+	// reading, while they execute a command directly
+	exclusive sync.RWMutex
+	clients   map[uint]*connectedClient
+	// db is used by the event loop while it holds exclusive and by the workers executing commands
+	// directly, which lock the shards of their keys
+	db *keyspace.Keyspace
+	// watchedKeys maps every watched key to the clients watching it
+	watchedKeys      map[string]map[uint]*connectedClient
 	requests         chan common.Command
 	ready            chan<- bool
 	events           chan<- string
@@ -55,18 +95,141 @@ type server struct {
 	nextClientId     uint
 	serverMaxClients uint
 	now              func() time.Time
-	mux              sync.Mutex
-	state            serverState
+	// mux guards clients & state, which the workers use, the keyspace is guarded by exclusive
+	mux   sync.Mutex
+	state serverState
+	// scripts caches the scripts sent with EVAL or SCRIPT LOAD by SHA1 digest
+	scripts           map[string]*script.Script
+	busyScriptTimeout time.Duration
+	// functions keeps the libraries loaded with FUNCTION LOAD
+	functions *function.Registry
+	// runningScript is not nil while EVAL, EVALSHA or FCALL are executing
+	runningScript *runningScript
+	// channels & patterns keep the Pub/Sub subscriptions
+	channels subscribers
+	patterns subscribers
+	// shardChannels keeps the sharded Pub/Sub subscriptions, channels are mapped to key slots
+	shardChannels subscribers
+	// notifyKeyspaceEvents selects the keyspace notifications published, see notify.go
+	notifyKeyspaceEvents keyspaceEvents
+	// trackingTable maps the keys read by clients with CLIENT TRACKING on to their IDs
+	trackingTable map[string]map[uint]struct{}
+	// trackingPrefixes maps the prefixes of the clients in BCAST tracking mode to the clients
+	trackingPrefixes subscribers
+	// rdbDir & rdbFilename locate the RDB snapshot, persistence is disabled without a filename
+	rdbDir      string
+	rdbFilename string
+	// saveRules trigger a BGSAVE after enough changes, see persistence.go
+	saveRules []saveRule
+	// dirty counts the changes since the last successful save
+	dirty         int
+	lastSave      time.Time
+	lastBgsaveTry time.Time
+	lastBgsaveErr error
+	// bgsave is not nil while a background save is in progress
+	bgsave *bgsave
+	// appendOnly enables the append only file stored in appendDirname inside rdbDir
+	appendOnly     bool
+	appendDirname  string
+	appendFilename string
+	appendFsync    aof.FsyncPolicy
+	// aof is not nil when the append only file is enabled, see aof.go
+	aof *appendOnly
+	// aofTimestamps annotates the append only file with the time of the commands
+	aofTimestamps bool
+	// recovery replays the append only file up to a point in time at startup
+	recovery *aof.Limit
+	// fileEnvelope compresses and encrypts the RDB and append only files, see the envelope package
+	fileEnvelope envelope.Options
+	// loading is set while the append only file is replayed, the commands are not propagated
+	loading bool
+	// atomicDepth is not 0 while EXEC or a script runs, atomicPropagated is set once their first
+	// write command is propagated wrapped in MULTI
+	atomicDepth      int
+	atomicPropagated bool
+	// replID & replOffset identify the replication stream, replID2 is the ID of the previous
+	// master, valid up to secondReplOffset, see replication.go
+	replID           string
+	replID2          string
+	replOffset       int64
+	secondReplOffset int64
+	// backlog keeps the end of the replication stream for partial resynchronizations, it is
+	// created with the first replica
+	backlog *replication.Backlog
+	// replicas are the clients that sent PSYNC
+	replicas     map[uint]*connectedClient
+	lastReplPing time.Time
+	// master is not nil when this server is a replica
+	master          *masterLink
+	replicaReadOnly bool
+	// fsyncedReplOffset is the offset of the stream of the master this replica has on disk,
+	// acknowledged for WAITAOF. fsyncTarget is the offset waiting for the fsync of the append only
+	// file, see trackFsyncedOffset.
+	fsyncedReplOffset int64
+	fsyncTarget       *fsyncTarget
+	// waiting are the clients blocked by WAIT or WAITAOF, see wait.go
+	waiting []*waitingClient
+	// cluster is not nil in cluster mode, its configuration is saved in clusterConfigFile, see
+	// cluster.go
+	cluster           *cluster.State
+	clusterConfigFile string
+	// bus connects this node to the other nodes of the cluster, see clusterbus.go
+	bus                *busTransport
+	clusterNodeTimeout time.Duration
+	failover           clusterFailover
+	// pausedUntil is not zero while the writes of the clients are paused for the manual failover
+	// of the replica pausedFor, the commands held are in paused
+	pausedUntil time.Time
+	pausedFor   string
+	paused      []common.Command
+	// raft is not nil in raft mode, its log is kept in raftDirname inside rdbDir, see raft.go
+	raft        *raftNode
+	raftDirname string
+	// activeActive is not nil in active-active mode, see activeactive.go
+	activeActive *activeActive
+	// sentinel is not nil in sentinel mode, see sentinel.go
+	sentinel *sentinelState
+	// raftSnapshotEntries is the number of entries applied after the last snapshot that triggers
+	// the compaction of the raft log
+	raftSnapshotEntries uint64
+	// ioGoroutines serve the clients in netpoll mode instead of a worker per client, netpoll mode
+	// is off when it is 0
+	ioGoroutines int
 }
 
 type connectedClient struct {
-	ID             uint
-	response       chan<- string
-	lastCMDEpoch   int64
-	lastCMD        common.CommandID
-	quit           chan<- bool
+	ID           uint
+	response     chan<- string
+	push         chan<- string
+	lastCMDEpoch int64
+	lastCMD      common.CommandID
+	quit         chan<- bool
+	// closed is set once quit is closed
+	closed         int32
 	addr           string
 	connectedSince time.Time
+	// multi holds the commands queued after MULTI, it is nil when the client is not in a transaction
+	multi *transaction
+	// watched keeps the keys this client is watching
+	watched map[string]struct{}
+	// dirtyCAS is set when a watched key was modified, the next EXEC will fail
+	dirtyCAS bool
+	// channels, patterns & shardChannels are the Pub/Sub subscriptions of the client
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+	// protocol is the RESP version selected with HELLO
+	protocol int
+	// tracking is nil while CLIENT TRACKING is off
+	tracking *clientTracking
+	// conn is written directly to stream to replicas
+	conn io.WriteCloser
+	// poll is the connection in netpoll mode, response, push & quit are nil, see netpoll.go
+	poll *netpoll.Conn
+	// replica is not nil once the client sent REPLCONF or PSYNC
+	replica *replica
+	// asking is set by ASKING, the next command can use a slot this node is importing
+	asking bool
 }
 
 func (c connectedClient) info(now func() time.Time) string {
@@ -76,20 +239,43 @@ func (c connectedClient) info(now func() time.Time) string {
 }
 
 // NewCore allocates a Core struct
-func newServer(now func() time.Time, port uint, serverMaxClients uint, ready chan<- bool, quit <-chan bool, events chan<- string) *server {
-	return &server{
-		clients:          make(map[uint]*connectedClient),
-		db:               make(map[string]*string),
-		requests:         make(chan common.Command),
-		events:           events,
-		ready:            ready,
-		quit:             quit,
-		now:              now,
-		port:             port,
-		nextClientId:     1,
-		serverMaxClients: serverMaxClients,
-		state:            serverStateBooting,
+func newServer(now func() time.Time, port uint, serverMaxClients uint, ready chan<- bool, quit <-chan bool, events chan<- string, opts ...Option) *server {
+	s := &server{
+		clients:             make(map[uint]*connectedClient),
+		db:                  keyspace.New(),
+		watchedKeys:         make(map[string]map[uint]*connectedClient),
+		requests:            make(chan common.Command),
+		events:              events,
+		ready:               ready,
+		quit:                quit,
+		now:                 now,
+		port:                port,
+		nextClientId:        1,
+		serverMaxClients:    serverMaxClients,
+		state:               serverStateBooting,
+		scripts:             make(map[string]*script.Script),
+		busyScriptTimeout:   defaultBusyScriptTimeout,
+		functions:           function.NewRegistry(),
+		channels:            make(subscribers),
+		patterns:            make(subscribers),
+		shardChannels:       make(subscribers),
+		trackingTable:       make(map[string]map[uint]struct{}),
+		trackingPrefixes:    make(subscribers),
+		lastSave:            now(),
+		appendDirname:       "appendonlydir",
+		appendFilename:      "appendonly.aof",
+		appendFsync:         aof.FsyncEverySec,
+		replID:              replication.NewID(),
+		secondReplOffset:    -1,
+		replicas:            make(map[uint]*connectedClient),
+		replicaReadOnly:     true,
+		clusterNodeTimeout:  defaultClusterNodeTimeout,
+		raftSnapshotEntries: defaultRaftSnapshotEntries,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *server) numConnectedClients() int {
@@ -99,7 +285,8 @@ func (s *server) numConnectedClients() int {
 	return numActiveClients
 }
 
-func (s *server) listenConnections(wg *sync.WaitGroup, quitListening chan bool) {
+// listen opens the listener of the clients
+func (s *server) listen() *net.TCPListener {
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", s.port))
 	if err != nil {
 		log.Fatal(err)
@@ -110,10 +297,12 @@ func (s *server) listenConnections(wg *sync.WaitGroup, quitListening chan bool)
 	if err != nil {
 		log.Fatalf("ERR Failed to start tcp listener at %s,  %v", fmt.Sprintf(":%d", s.port), err)
 	}
+	return ln
+}
+
+// listenConnections accepts the clients until the server loop closes quitListening and the listener
+func (s *server) listenConnections(wg *sync.WaitGroup, ln *net.TCPListener, quitListening <-chan struct{}) {
 	defer func() {
-		if err = ln.Close(); err != nil {
-			log.Fatal(err)
-		}
 		wg.Done()
 		log.Print("listened connections loop stopped")
 	}()
@@ -121,9 +310,6 @@ func (s *server) listenConnections(wg *sync.WaitGroup, quitListening chan bool)
 	log.Printf("Server started listening for connections at %s ", fmt.Sprintf(":%d", s.port))
 	s.ready <- true
 	for {
-		if err := ln.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
-			log.Fatal(err)
-		}
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
@@ -131,13 +317,7 @@ func (s *server) listenConnections(wg *sync.WaitGroup, quitListening chan bool)
 				log.Print("listenConnections got a quit signal ")
 				return
 			default:
-
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					continue
-				} else {
-					panic(err)
-				}
-
+				panic(err)
 			}
 		} else {
 			c, err := s.registerClient(conn)
@@ -159,77 +339,161 @@ func (s *server) listenConnections(wg *sync.WaitGroup, quitListening chan bool)
 }
 
 func (s *server) registerClient(conn net.Conn) (*client.Worker, error) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	numActiveClients := uint(len(s.clients))
-	if numActiveClients >= s.serverMaxClients {
-		// Limit the number of active clients to prevent resource exhaustion
-		return nil, fmt.Errorf("ERR reached serverMaxClients:%d, there are already %d connected clients", s.serverMaxClients, numActiveClients)
-	}
-
-	if _, exists := s.clients[s.nextClientId]; exists {
-		log.Panicf("duplicated client ID %d", s.nextClientId)
-	}
-
 	response := make(chan string)
+	push := make(chan string, pushBufferSize)
 	quit := make(chan bool)
+	c := &connectedClient{
+		addr:     conn.RemoteAddr().String(),
+		response: response,
+		push:     push,
+		quit:     quit,
+		conn:     conn,
+	}
+	if err := s.addClient(c); err != nil {
+		return nil, err
+	}
 	worker, err := client.NewWorker(
 		conn,
-		s.nextClientId,
+		c.ID,
 		s.requests,
 		response,
+		push,
+		func(cmd common.Command) (string, bool) { return s.executeDirect(c, cmd) },
+		func(args [][]byte, out []byte) ([]byte, bool) {
+			reply, executed := s.executeRaw(c, args)
+			if !executed {
+				return out, false
+			}
+			return reply.appendTo(out), true
+		},
 		s.now,
 		quit,
 	)
 	if err != nil {
+		s.mux.Lock()
+		delete(s.clients, c.ID)
+		s.mux.Unlock()
 		return nil, fmt.Errorf("ERR trying to create a client worker for the connection, %v", err)
 	}
+	return worker, nil
+}
+
+// addClient gives c the next client ID and adds it to the connected clients
+func (s *server) addClient(c *connectedClient) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.state == serverStateShuttingDown {
+		return errors.New("ERR the server is shutting down")
+	}
+	numActiveClients := uint(len(s.clients))
+	if numActiveClients >= s.serverMaxClients {
+		// Limit the number of active clients to prevent resource exhaustion
+		return fmt.Errorf("ERR reached serverMaxClients:%d, there are already %d connected clients", s.serverMaxClients, numActiveClients)
+	}
 
-	s.clients[worker.ID] = &connectedClient{
-		connectedSince: s.now(),
-		addr:           conn.RemoteAddr().String(),
-		ID:             worker.ID,
-		response:       response,
-		quit:           quit,
+	if _, exists := s.clients[s.nextClientId]; exists {
+		log.Panicf("duplicated client ID %d", s.nextClientId)
 	}
+	c.ID = s.nextClientId
+	c.connectedSince = s.now()
+	c.protocol = 2
+	s.clients[c.ID] = c
 	s.nextClientId++
-
-	return worker, nil
-
+	return nil
 }
 
 // Run handles channels inbound communications from connected clients
 func (s *server) run(wg *sync.WaitGroup) {
-	wg.Add(1)
-
 	s.setState(serverStateListening)
-	stopListening := make(chan bool)
-	defer func() {
-		wg.Done()
-		close(stopListening)
-	}()
-
-	go s.listenConnections(wg, stopListening)
-
+	stopListening := make(chan struct{})
+	defer wg.Done()
+
+	var ln *net.TCPListener
+	var poller *netpoll.Poller
+	if s.ioGoroutines > 0 {
+		poller = s.listenPoll(wg)
+	} else {
+		ln = s.listen()
+		wg.Add(1)
+		go s.listenConnections(wg, ln, stopListening)
+	}
+	if err := s.startClusterBus(); err != nil {
+		log.Fatalf("unable to start the cluster bus: %v", err)
+	}
+	if err := s.startRaftTransport(); err != nil {
+		log.Fatalf("unable to start the raft transport: %v", err)
+	}
+	// the keyspace is read by the active-active mode, the workers are connected already
+	s.lockExclusive()
+	s.startActiveActive()
+	s.startSentinel()
+	s.unlockExclusive()
+
+	cron := time.NewTicker(cronInterval)
+	defer cron.Stop()
+	// every event blocks the loop until it arrives, quit is only received once. The events are
+	// handled holding exclusive, see direct.go.
+	quit := s.quit
 	for {
 		var err error
 		var response = ""
+		var event func()
 		select {
-		case <-s.quit:
-			log.Print("got quit signal trying to shutdown connected clients")
-			stopListening <- true
-			s.shutdown()
-		default:
-		}
-
-		select {
+		case <-quit:
+			quit = nil
+			event = func() {
+				log.Print("got quit signal trying to shutdown connected clients")
+				close(stopListening)
+				if poller != nil {
+					poller.Close()
+				} else if err := ln.Close(); err != nil {
+					log.Printf("ERR closing the listener %v", err)
+				}
+				s.shutdown()
+			}
 		case cmd := <-s.requests:
-			s.handleCMD(cmd, err, response)
-		default:
+			event = func() { s.handleCMD(cmd, err, response) }
+		case err := <-s.bgsaveDone():
+			event = func() { s.bgsaveFinished(err) }
+		case err := <-s.aofRewriteDone():
+			event = func() { _ = s.aofRewriteFinished(err) }
+		case e := <-s.masterEvents():
+			event = func() { s.handleMasterEvent(e) }
+		case e := <-s.busEvents():
+			event = func() { s.handleBusEvent(e) }
+		case e := <-s.raftEvents():
+			event = func() { s.handleRaftEvent(e) }
+		case e := <-s.peerEvents():
+			event = func() { s.handlePeerEvent(e) }
+		case e := <-s.sentinelEvents():
+			event = func() { s.handleSentinelEvent(e) }
+		case <-cron.C:
+			event = func() {
+				s.checkSaveRules()
+				s.aofCron()
+				s.replicationCron()
+				s.clusterCron()
+				s.raftCron()
+				s.activeActiveCron()
+				s.sentinelCron()
+				s.checkWaiting(false)
+			}
 		}
+		s.lockExclusive()
+		event()
+		s.unlockExclusive()
 
 		if s.getState() == serverStateShuttingDown && s.numConnectedClients() == 0 {
 			log.Print("no more clients connected, exit now")
+			s.stopMasterLink()
+			s.stopClusterBus()
+			s.stopRaft()
+			s.stopActiveActive()
+			s.stopSentinel()
+			s.lockExclusive()
+			s.saveOnShutdown()
+			s.unlockExclusive()
+			s.closeAOF()
 			s.events <- EventSuccessfulShutdown
 			return
 		}
@@ -256,30 +520,140 @@ func (s *server) handleCMD(cmd common.Command, err error, response string) {
 	}
 	c.lastCMD = cmd.CMD
 	c.lastCMDEpoch = s.now().UnixNano()
+	if !cmd.ExpectsReply() {
+		s.handleReplicaCMD(cmd, c, nil)
+		return
+	}
+	if s.pauseCMD(cmd, c) {
+		return
+	}
+
+	if c.protocol < 3 && c.numSubscriptions() > 0 && !allowedWhileSubscribed(cmd) {
+		err = errSubscribedContext
+	} else if err = s.redirect(cmd, c); err != nil {
+		if c.multi != nil {
+			c.multi.aborted = true
+		}
+	} else if c.multi != nil && isQueueable(cmd) {
+		response, err = s.queueCMD(cmd, c)
+	} else if s.raftProposes(cmd, c) {
+		response, err = s.proposeCMD(cmd, c)
+	} else {
+		response, err = s.execute(cmd, c)
+	}
+	c.afterCommand(cmd)
+	if cmd.CMD != common.ASKING {
+		c.asking = false
+	}
+	// the write commands are appended before replying, like redis
+	s.flushAOF()
+	if err != nil {
+		log.Printf("ERR %v", err)
+		response = resp.Error(err)
+	}
+	if len(response) != 0 {
+		c.reply(response)
+	}
+}
+
+// execute runs cmd on behalf of the client c and returns the serialized response
+func (s *server) execute(cmd common.Command, c *connectedClient) (response string, err error) {
+	if cmd.Err != nil {
+		return "", cmd.Err
+	}
+	if s.rejectsWrites(cmd, c) {
+		return "", errReadOnlyReplica
+	}
 
 	switch cmd.CMD {
 	case common.SET:
-		response, err = s.handleSET(cmd.Arguments)
+		response, err = s.handleSET(cmd.Arguments, c)
 	case common.GET:
-		response, err = s.handleGET(cmd.Arguments)
+		response, err = s.handleGET(cmd.Arguments, c)
 	case common.DEL:
-		response, err = s.handleDEL(cmd.Arguments)
+		response, err = s.handleDEL(cmd.Arguments, c)
 	case common.INFO:
 		response, err = s.handleINFO()
 	case common.CLIENT:
 		response, err = s.handleCLIENT(cmd.Arguments, c)
+	case common.MULTI:
+		response, err = s.handleMULTI(c)
+	case common.EXEC:
+		response, err = s.handleEXEC(c)
+	case common.DISCARD:
+		response, err = s.handleDISCARD(c)
+	case common.WATCH:
+		response, err = s.handleWATCH(cmd.Arguments, c)
+	case common.UNWATCH:
+		response, err = s.handleUNWATCH(c)
+	case common.EVAL, common.EVALSHA:
+		response, err = s.handleEVAL(cmd.CMD, cmd.Arguments, c)
+	case common.SCRIPT:
+		response, err = s.handleSCRIPT(cmd.Arguments)
+	case common.FUNCTION:
+		response, err = s.handleFUNCTION(cmd.Arguments)
+	case common.FCALL:
+		response, err = s.handleFCALL(cmd.Arguments, c)
+	case common.PING:
+		response, err = s.handlePING(cmd.Arguments, c)
+	case common.SUBSCRIBE, common.PSUBSCRIBE, common.SSUBSCRIBE:
+		response, err = s.handleSUBSCRIBE(cmd.CMD, cmd.Arguments, c)
+	case common.UNSUBSCRIBE, common.PUNSUBSCRIBE, common.SUNSUBSCRIBE:
+		response, err = s.handleUNSUBSCRIBE(cmd.CMD, cmd.Arguments, c)
+	case common.PUBLISH, common.SPUBLISH:
+		response, err = s.handlePUBLISH(cmd.CMD, cmd.Arguments)
+	case common.PUBSUB:
+		response, err = s.handlePUBSUB(cmd.Arguments)
+	case common.CONFIG:
+		response, err = s.handleCONFIG(cmd.Arguments)
+	case common.HELLO:
+		response, err = s.handleHELLO(cmd.Arguments, c)
+	case common.SAVE:
+		response, err = s.handleSAVE()
+	case common.BGSAVE:
+		response, err = s.handleBGSAVE()
+	case common.LASTSAVE:
+		response, err = s.handleLASTSAVE()
+	case common.SCAN:
+		response, err = s.handleSCAN(cmd.Arguments)
+	case common.BGREWRITEAOF:
+		response, err = s.handleBGREWRITEAOF()
+	case common.REPLICAOF:
+		response, err = s.handleREPLICAOF(cmd.Arguments)
+	case common.REPLCONF:
+		response, err = s.handleREPLCONF(cmd.Arguments, c)
+	case common.PSYNC:
+		response, err = s.handlePSYNC(cmd.Arguments, c)
+	case common.ROLE:
+		response, err = s.handleROLE()
+	case common.WAIT, common.WAITAOF:
+		response, err = s.handleWAIT(cmd.CMD, cmd.Arguments, c)
+	case common.CLUSTER:
+		response, err = s.handleCLUSTER(cmd.Arguments)
+	case common.ASKING:
+		response, err = s.handleASKING(c)
+	case common.COMMAND:
+		response, err = s.handleCOMMAND(cmd.Arguments)
+	case common.DUMP:
+		response, err = s.handleDUMP(cmd.Arguments)
+	case common.RESTORE:
+		response, err = s.handleRESTORE(cmd.Arguments, c)
+	case common.MIGRATE:
+		response, err = s.handleMIGRATE(cmd.Arguments, c)
+	case common.RAFT:
+		response, err = s.handleRAFT(cmd.Arguments, c)
+	case common.INCRBY:
+		response, err = s.handleINCRBY(cmd.Arguments, c)
+	case common.CRDT:
+		response, err = s.handleCRDT(cmd.Arguments)
+	case common.SENTINEL:
+		response, err = s.handleSENTINEL(cmd.Arguments)
 	case common.UNKNOWN:
 		err = fmt.Errorf("unsupported command %v", cmd.Arguments)
 	default:
 		err = fmt.Errorf("invalid server command %d", cmd.CMD)
 	}
-	if err != nil {
-		log.Printf("ERR %v", err)
-		response = resp.Error(err)
-	}
-	if len(response) != 0 {
-		c.response <- response
-	}
+	return
 }
 
 func (s *server) clientByID(ID uint) (*connectedClient, bool) {
@@ -312,86 +686,165 @@ func (s *server) handleCLIENT(args common.CommandArguments, c *connectedClient)
 
 	case common.ClientSubcommandINFO:
 		return resp.SimpleString(fmt.Sprintf("%s\n", c.info(s.now))), nil
+	case common.ClientSubcommandTRACKING:
+		return s.handleTRACKING(clientArgs.Tracking, c)
+	case common.ClientSubcommandCACHING:
+		return s.handleCACHING(clientArgs.Caching, c)
+	case common.ClientSubcommandGETREDIR:
+		return s.handleGETREDIR(c)
 
 	default:
 		return "-ERR", fmt.Errorf("unsupported CLIENT subcommand %v", args)
 	}
 }
 
-func (s *server) handleSET(args common.CommandArguments) (response string, err error) {
+func (s *server) handleSET(args common.CommandArguments, c *connectedClient) (response string, err error) {
 	setArgs, ok := args.(common.SETArguments)
 	if !ok {
 		return "-ERR", fmt.Errorf("invalid SET argments %v", args)
 	}
+	response, set, existed := s.setKey(setArgs)
+	if set {
+		s.propagate("SET", setArgs.Key, setArgs.Value)
+		s.touchKey(setArgs.Key, c)
+		if !existed {
+			s.notifyKeyspaceEvent(notifyNew, "new", setArgs.Key)
+		}
+		s.notifyKeyspaceEvent(notifyString, "set", setArgs.Key)
+	}
+	return response, nil
+}
+
+// setKey applies SET to the keyspace and returns its response, whether the key was set and
+// whether it existed
+func (s *server) setKey(setArgs common.SETArguments) (response string, set bool, existed bool) {
 	var prevValue *string
-	needToSet := false
-	response = resp.BulkString(nil)
-	s.mux.Lock()
-	prevValue, ok = s.db[setArgs.Key]
+	if prev, exists := s.db.Get(setArgs.Key); exists {
+		prevValue, existed = &prev, true
+	}
 
-	if setArgs.OptionNX && !ok {
+	if setArgs.OptionNX && !existed {
 		//Only set the key if it does not already exist.
-		needToSet = true
-	} else if setArgs.OptionXX && ok {
+		set = true
+	} else if setArgs.OptionXX && existed {
 		//Only set the key if it already exist.
-		needToSet = true
+		set = true
 	} else if !setArgs.OptionNX && !setArgs.OptionXX {
-		needToSet = true
+		set = true
 	}
-	if needToSet {
-		s.db[setArgs.Key] = &setArgs.Value
+	response = resp.BulkString(nil)
+	if set {
+		s.db.Set(setArgs.Key, setArgs.Value)
 		response = resp.SimpleString("OK")
 	}
-
-	s.mux.Unlock()
-
 	if setArgs.OptionGET {
 		response = resp.BulkString(prevValue)
 	}
-	return
+	return response, set, existed
 }
 
-func (s *server) handleGET(args common.CommandArguments) (response string, err error) {
+func (s *server) handleGET(args common.CommandArguments, c *connectedClient) (response string, err error) {
 	getArgs, ok := args.(common.GETArguments)
 	if !ok {
 		return "-ERR", fmt.Errorf("invalid GET argments %v", args)
 	}
-	s.mux.Lock()
-	value, _ := s.db[getArgs.Key]
-	s.mux.Unlock()
+	value, exists := s.db.Get(getArgs.Key)
+	if !exists {
+		s.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", getArgs.Key)
+	}
+	s.trackKeyRead(getArgs.Key, c)
 
-	return resp.BulkString(value), nil
+	if !exists {
+		return resp.BulkString(nil), nil
+	}
+	return resp.BulkString(&value), nil
 }
 
-func (s *server) handleDEL(args common.CommandArguments) (response string, err error) {
+func (s *server) handleDEL(args common.CommandArguments, c *connectedClient) (response string, err error) {
 	delArgs, ok := args.(common.DELArguments)
 	if !ok {
 		return "-ERR", fmt.Errorf("invalid GET argments %v", delArgs)
 	}
 
-	s.mux.Lock()
+	deleted := s.deleteKeys(delArgs.Keys)
 	var opStatus = 0
-	for _, k := range delArgs.Keys {
-		_, exists := s.db[k]
-		if exists {
-			opStatus = 1 //del cmd is successful if deletes at least one key
-		}
-		delete(s.db, k)
+	if len(deleted) > 0 {
+		opStatus = 1 //del cmd is successful if deletes at least one key
+		s.propagate(append([]string{"DEL"}, deleted...)...)
+	}
+	for _, k := range deleted {
+		s.touchKey(k, c)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", k)
 	}
-	s.mux.Unlock()
 
 	return resp.Integer(opStatus), nil
 }
 
+// deleteKeys removes keys from the keyspace and returns the ones that existed
+func (s *server) deleteKeys(keys []string) []string {
+	var deleted []string
+	for _, k := range keys {
+		if s.db.Delete(k) {
+			deleted = append(deleted, k)
+		}
+	}
+	return deleted
+}
+
+func (s *server) handleINCRBY(args common.CommandArguments, c *connectedClient) (string, error) {
+	incrArgs, ok := args.(common.INCRBYArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid INCRBY argments %v", args)
+	}
+	current, exists, err := s.incrKey(incrArgs)
+	if err != nil {
+		return "", err
+	}
+
+	s.propagate("INCRBY", incrArgs.Key, strconv.FormatInt(incrArgs.Delta, 10))
+	s.touchKey(incrArgs.Key, c)
+	if !exists {
+		s.notifyKeyspaceEvent(notifyNew, "new", incrArgs.Key)
+	}
+	s.notifyKeyspaceEvent(notifyString, "incrby", incrArgs.Key)
+	return resp.Integer(int(current)), nil
+}
+
+// incrKey applies INCRBY to the keyspace and returns the new value and whether the key existed
+func (s *server) incrKey(incrArgs common.INCRBYArguments) (int64, bool, error) {
+	var current int64
+	prev, exists := s.db.Get(incrArgs.Key)
+	if exists {
+		var err error
+		if current, err = strconv.ParseInt(prev, 10, 64); err != nil {
+			return 0, exists, errNotInteger
+		}
+	}
+	if (incrArgs.Delta > 0 && current > math.MaxInt64-incrArgs.Delta) ||
+		(incrArgs.Delta < 0 && current < math.MinInt64-incrArgs.Delta) {
+		return 0, exists, errIncrOverflow
+	}
+	current += incrArgs.Delta
+	s.db.Set(incrArgs.Key, strconv.FormatInt(current, 10))
+	return current, exists, nil
+}
+
 func (s *server) disconnect(clientID uint) error {
-	_, exists := s.clientByID(clientID)
+	c, exists := s.clientByID(clientID)
 	if !exists {
 		return fmt.Errorf("client ID  %d does not exists", clientID)
 	}
+	s.unwatchAll(c)
+	s.unsubscribeAll(c)
+	s.disableTracking(c)
+	if c.replica != nil {
+		s.dropReplica(c)
+	}
 
 	s.mux.Lock()
 	delete(s.clients, clientID)
 	s.mux.Unlock()
+	s.redirectBroken(c)
 	log.Printf("client with ID %d disconnected succesfuly", clientID)
 
 	s.events <- EventAfterDisconnect
@@ -416,6 +869,12 @@ func (s *server) handleINFO() (string, error) {
 
 	sb.WriteString(fmt.Sprintf("PauseTotalNs:%d\n", memStats.PauseTotalNs))
 	sb.WriteString(fmt.Sprintf("NumGC:%d\n", memStats.NumGC))
+	s.persistenceInfo(&sb)
+	s.aofInfo(&sb)
+	s.replicationInfo(&sb)
+	if s.sentinel != nil {
+		s.sentinelInfo(&sb)
+	}
 
 	str := sb.String()
 	return resp.BulkString(&str), nil
@@ -423,15 +882,17 @@ func (s *server) handleINFO() (string, error) {
 
 func (s *server) shutdown() {
 	s.setState(serverStateShuttingDown)
+	// the workers of the waiting clients only read their reply
+	s.checkWaiting(true)
+	s.failRaftWaiting(errRaftShuttingDown)
+	s.resumeClients()
 	s.mux.Lock()
 	clients := s.clients
 	s.mux.Unlock()
-	log.Printf("trying to kill %d connected clients", len(s.clients))
+	log.Printf("trying to kill %d connected clients", len(clients))
 	for id, c := range clients {
 		log.Printf("sending kill signal to client with ID :%d", id)
-		if c.quit == nil {
-			log.Printf("client callback channel is nil")
-		}
-		c.quit <- true
+		// the worker closes its connection, it disconnects with CLIENT KILL like any client
+		c.close()
 	}
 }
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
 	"go.uber.org/goleak"
+	"io"
+	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -42,6 +47,16 @@ func TestBasicOps(t *testing.T) {
 	val, err = rdb.Get(ctx, "x").Result()
 	common.AssertEquals(t, err, redis.Nil)
 
+	common.AssertEquals(t, rdb.Incr(ctx, "x").Val(), int64(1))
+	common.AssertEquals(t, rdb.IncrBy(ctx, "x", 10).Val(), int64(11))
+	common.AssertEquals(t, rdb.DecrBy(ctx, "x", 20).Val(), int64(-9))
+	common.AssertEquals(t, rdb.Get(ctx, "x").Val(), "-9")
+	common.ExpectNoError(t, rdb.Set(ctx, "x", "a", 0).Err())
+	common.AssertEquals(t, rdb.Incr(ctx, "x").Err().Error(), "ERR value is not an integer or out of range")
+	common.ExpectNoError(t, rdb.Set(ctx, "x", "9223372036854775807", 0).Err())
+	common.AssertEquals(t, rdb.Incr(ctx, "x").Err().Error(), "ERR increment or decrement would overflow")
+	common.ExpectNoError(t, rdb.Del(ctx, "x").Err())
+
 	common.ExpectNoError(t, rdb.Close())
 	common.AssertEquals(t, <-events, EventAfterDisconnect)
 	quit <- true
@@ -66,8 +81,8 @@ func TestUnsupportedCommand(t *testing.T) {
 
 	ctx := context.Background()
 
-	err := rdb.Incr(ctx, "x").Err()
-	wantError := "unsupported command [incr x]"
+	err := rdb.LPush(ctx, "x", "a").Err()
+	wantError := "unsupported command [lpush x a]"
 	if err == nil || err.Error() != wantError {
 		t.Errorf("want error:%s , got: %s ", wantError, err)
 	}
@@ -78,6 +93,59 @@ func TestUnsupportedCommand(t *testing.T) {
 
 }
 
+func TestInvalidBulkLength(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 1)
+	port := uint(10_060)
+	go Start(port, 1, ready, quit, events)
+	<-ready
+
+	assertInvalidBulkLength(t, port)
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	assertTooBigInline(t, port)
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+// assertInvalidBulkLength sends a bulk string header longer than the limit, the server replies
+// with a protocol error and closes the connection without waiting for the bytes
+func assertInvalidBulkLength(t *testing.T, port uint) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	common.ExpectNoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$3\r\nSET\r\n$9999999999\r\n")
+	common.ExpectNoError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"$-1\r\n", "-ERR Protocol error: invalid bulk length\r\n"} {
+		got, err := reader.ReadString('\n')
+		common.ExpectNoError(t, err)
+		common.AssertEquals(t, got, want)
+	}
+	_, err = reader.ReadByte()
+	common.AssertEquals(t, err, io.EOF)
+}
+
+// assertTooBigInline sends an array header without its line ending, the server replies with a
+// protocol error and closes the connection once the line is longer than the limit
+func assertTooBigInline(t *testing.T, port uint) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	common.ExpectNoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "*1\r\n$4\r\nPING\r\n*"+strings.Repeat("1", resp.MaxInlineLen))
+	common.ExpectNoError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"+PONG\r\n", "-ERR Protocol error: too big inline request\r\n"} {
+		got, err := reader.ReadString('\n')
+		common.ExpectNoError(t, err)
+		common.AssertEquals(t, got, want)
+	}
+	_, err = reader.ReadByte()
+	common.AssertEquals(t, err, io.EOF)
+}
+
 func TestClientConnectionsLifeCycle(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -2,7 +2,10 @@ package server
 
 import (
 	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestNewCore(t *testing.T) {
@@ -13,3 +16,103 @@ func TestNewCore(t *testing.T) {
 		t.Errorf("expected len(server.client) to equal %d but got %d", expectedClientsLen, actualClientsLen)
 	}
 }
+
+// TestSlowSubscriber publishes to a subscriber whose worker stopped writing its messages, once its
+// push buffer is full the subscriber is disconnected and no longer counted as a receiver
+func TestSlowSubscriber(t *testing.T) {
+	core := newServer(common.FrozenInTime, uint(1337), 2, nil, nil, nil)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	quit := make(chan bool)
+	slow := &connectedClient{ID: 1, push: make(chan string, pushBufferSize), quit: quit, conn: conn}
+	core.clients[slow.ID] = slow
+	core.channels.add("slow", slow)
+
+	for i := 0; i < pushBufferSize; i++ {
+		common.AssertEquals(t, core.publish("slow", "message"), 1)
+	}
+	common.AssertEquals(t, core.publish("slow", "message"), 0)
+	common.AssertEquals(t, slow.closed, int32(1))
+	_, open := <-quit
+	common.AssertEquals(t, open, false)
+	_, err := peer.Read(make([]byte, 1))
+	common.AssertEquals(t, err, io.EOF)
+}
+
+func TestDirectAllowed(t *testing.T) {
+	s := newServer(common.FrozenInTime, uint(1337), 2, nil, nil, nil)
+	s.setState(serverStateListening)
+	s.lockExclusive()
+	s.unlockExclusive()
+	common.AssertEquals(t, s.direct, int32(1))
+
+	s.lockExclusive()
+	s.watchedKeys["k"] = map[uint]*connectedClient{}
+	s.unlockExclusive()
+	common.AssertEquals(t, s.direct, int32(0))
+}
+
+func TestExecuteRaw(t *testing.T) {
+	s := newServer(common.FrozenInTime, uint(1337), 2, nil, nil, nil)
+	s.setState(serverStateListening)
+	s.lockExclusive()
+	s.unlockExclusive()
+	c := &connectedClient{ID: 1}
+
+	for _, tt := range []struct {
+		args     []string
+		want     string
+		executed bool
+	}{
+		{args: []string{"get", "k"}, want: "$-1\r\n", executed: true},
+		{args: []string{"SET", "k", "v"}, want: "+OK\r\n", executed: true},
+		{args: []string{"Get", "k"}, want: "$1\r\nv\r\n", executed: true},
+		{args: []string{"SET", "k", "v", "NX"}},
+		{args: []string{"GETS", "k"}},
+		{args: []string{"DEL", "k"}},
+	} {
+		args := make([][]byte, len(tt.args))
+		for i, arg := range tt.args {
+			args[i] = []byte(arg)
+		}
+		reply, executed := s.executeRaw(c, args)
+		common.AssertEquals(t, executed, tt.executed)
+		if executed {
+			common.AssertEquals(t, string(reply.appendTo(nil)), tt.want)
+		}
+	}
+	common.AssertEquals(t, s.directDirty, int64(1))
+
+	// the transactions are queued by the event loop
+	c.multi = &transaction{}
+	if _, executed := s.executeRaw(c, [][]byte{[]byte("GET"), []byte("k")}); executed {
+		t.Errorf("GET executed in a transaction")
+	}
+}
+
+func BenchmarkExecuteRaw(b *testing.B) {
+	s := newServer(time.Now, uint(1337), 2, nil, nil, nil)
+	s.setState(serverStateListening)
+	s.lockExclusive()
+	s.unlockExclusive()
+	c := &connectedClient{ID: 1}
+	for _, bm := range []struct {
+		name string
+		args [][]byte
+	}{
+		{name: "SET", args: [][]byte{[]byte("SET"), []byte("key:123"), []byte("0123456789abcdef")}},
+		{name: "GET", args: [][]byte{[]byte("GET"), []byte("key:123")}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			out := make([]byte, 0, 64)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reply, executed := s.executeRaw(c, bm.args)
+				if !executed {
+					b.Fatal("not executed")
+				}
+				out = reply.appendTo(out[:0])
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"strings"
+)
+
+// invalidateChannel is the channel RESP2 clients subscribe to when they receive the invalidation
+// messages of other clients with CLIENT TRACKING on REDIRECT
+const invalidateChannel = "__redis__:invalidate"
+
+var (
+	errTrackingBCASTSwitch = errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	errTrackingOptInOut    = errors.New("ERR You can't use both OPTIN and OPTOUT")
+	errTrackingBCASTOpt    = errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	errTrackingPrefix      = errors.New("ERR PREFIX option requires BCAST mode to be enabled")
+	errTrackingRedirect    = errors.New("ERR The client ID you want redirect to does not exist")
+	errTrackingCaching     = errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+)
+
+// clientTracking keeps the CLIENT TRACKING state of a client
+type clientTracking struct {
+	common.TrackingOptions
+	// caching is set by CLIENT CACHING yes in OPTIN mode or CLIENT CACHING no in OPTOUT mode, it
+	// only applies to the next command
+	caching bool
+}
+
+// tracksReads returns true when the keys read by the client must be remembered
+func (t *clientTracking) tracksReads() bool {
+	switch {
+	case t == nil || t.BCAST:
+		return false
+	case t.OptIn:
+		return t.caching
+	case t.OptOut:
+		return !t.caching
+	}
+	return true
+}
+
+func (s *server) handleTRACKING(opts common.TrackingOptions, c *connectedClient) (string, error) {
+	if !opts.On {
+		s.disableTracking(c)
+		return resp.SimpleString("OK"), nil
+	}
+
+	switch {
+	case opts.OptIn && opts.OptOut:
+		return "", errTrackingOptInOut
+	case opts.BCAST && (opts.OptIn || opts.OptOut):
+		return "", errTrackingBCASTOpt
+	case len(opts.Prefixes) > 0 && !opts.BCAST:
+		return "", errTrackingPrefix
+	case c.tracking != nil && c.tracking.BCAST != opts.BCAST:
+		return "", errTrackingBCASTSwitch
+	}
+	if err := checkPrefixOverlap(opts.Prefixes); err != nil {
+		return "", err
+	}
+	if opts.Redirect != 0 {
+		if _, exists := s.clientByID(opts.Redirect); !exists {
+			return "", errTrackingRedirect
+		}
+	}
+
+	s.disableTracking(c)
+	c.tracking = &clientTracking{TrackingOptions: opts}
+	if opts.BCAST {
+		prefixes := opts.Prefixes
+		if len(prefixes) == 0 {
+			// an empty prefix matches every key
+			prefixes = []string{""}
+		}
+		c.tracking.Prefixes = prefixes
+		for _, prefix := range prefixes {
+			s.trackingPrefixes.add(prefix, c)
+		}
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+// checkPrefixOverlap rejects the BCAST prefixes that are a prefix of one another, like redis: a key
+// matching both would be invalidated twice
+func checkPrefixOverlap(prefixes []string) error {
+	for i, prefix := range prefixes {
+		for _, existing := range prefixes[:i] {
+			if strings.HasPrefix(prefix, existing) || strings.HasPrefix(existing, prefix) {
+				return fmt.Errorf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, existing)
+			}
+		}
+	}
+	return nil
+}
+
+// disableTracking turns tracking off, the keys read by c are left in the tracking table and are
+// skipped once modified
+func (s *server) disableTracking(c *connectedClient) {
+	if c.tracking == nil {
+		return
+	}
+	for _, prefix := range c.tracking.Prefixes {
+		s.trackingPrefixes.remove(prefix, c)
+	}
+	c.tracking = nil
+}
+
+func (s *server) handleCACHING(caching bool, c *connectedClient) (string, error) {
+	if c.tracking == nil || (!c.tracking.OptIn && !c.tracking.OptOut) {
+		return "", errTrackingCaching
+	}
+	if caching && !c.tracking.OptIn {
+		return "", errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	if !caching && !c.tracking.OptOut {
+		return "", errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	c.tracking.caching = true
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) handleGETREDIR(c *connectedClient) (string, error) {
+	if c.tracking == nil {
+		return resp.Integer(-1), nil
+	}
+	return resp.Integer(int(c.tracking.Redirect)), nil
+}
+
+// afterCommand resets the CLIENT CACHING flag once the command following it was executed
+func (c *connectedClient) afterCommand(cmd common.Command) {
+	if c.tracking == nil || c.multi != nil {
+		return
+	}
+	if clientArgs, ok := cmd.Arguments.(common.CLIENTArguments); ok && clientArgs.Subcommand == common.ClientSubcommandCACHING {
+		return
+	}
+	c.tracking.caching = false
+}
+
+// trackKeyRead remembers that c read key, c is invalidated when the key is modified
+func (s *server) trackKeyRead(key string, c *connectedClient) {
+	if !c.tracking.tracksReads() {
+		return
+	}
+	clients, exists := s.trackingTable[key]
+	if !exists {
+		clients = make(map[uint]struct{})
+		s.trackingTable[key] = clients
+	}
+	clients[c.ID] = struct{}{}
+}
+
+// invalidateKey sends invalidation messages to the clients tracking key, by is the client that
+// modified it
+func (s *server) invalidateKey(key string, by *connectedClient) {
+	for prefix, clients := range s.trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, c := range clients {
+			if !c.tracking.NoLoop || c != by {
+				s.sendInvalidation(c, key)
+			}
+		}
+	}
+
+	ids, exists := s.trackingTable[key]
+	if !exists {
+		return
+	}
+	delete(s.trackingTable, key)
+	for id := range ids {
+		c, exists := s.clientByID(id)
+		if !exists || c.tracking == nil || c.tracking.BCAST || (c.tracking.NoLoop && c == by) {
+			continue
+		}
+		s.sendInvalidation(c, key)
+	}
+}
+
+// sendInvalidation pushes the invalidate message to c or to the client it redirects to. Like a
+// disconnected one, a RESP2 target not subscribed to __redis__:invalidate can not receive it, the
+// message is dropped and the redirect reported as broken.
+func (s *server) sendInvalidation(c *connectedClient, key string) {
+	target := c
+	if c.tracking.Redirect != 0 {
+		var exists bool
+		if target, exists = s.clientByID(c.tracking.Redirect); !exists {
+			c.pushRedirectBroken(c.tracking.Redirect)
+			return
+		}
+	}
+	keys := resp.Array([]interface{}{key})
+	switch {
+	case target.protocol >= 3:
+		target.pushMessage(resp.Push([]string{bulkString("invalidate"), keys}))
+	case target.isSubscribed(invalidateChannel):
+		target.pushMessage(resp.RawArray([]string{bulkString("message"), bulkString(invalidateChannel), keys}))
+	case target != c:
+		c.pushRedirectBroken(target.ID)
+	}
+}
+
+func (c *connectedClient) isSubscribed(channel string) bool {
+	_, subscribed := c.channels[channel]
+	return subscribed
+}
+
+// redirectBroken notifies the RESP3 clients redirecting their invalidations to the disconnected
+// client gone
+func (s *server) redirectBroken(gone *connectedClient) {
+	s.mux.Lock()
+	clients := make([]*connectedClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mux.Unlock()
+	for _, c := range clients {
+		if c.tracking != nil && c.tracking.Redirect == gone.ID {
+			c.pushRedirectBroken(gone.ID)
+		}
+	}
+}
+
+// pushRedirectBroken tells a RESP3 client its invalidations can not be redirected to the client
+// id, RESP2 clients can not receive it
+func (c *connectedClient) pushRedirectBroken(id uint) {
+	if c.protocol >= 3 {
+		c.pushMessage(resp.Push([]string{bulkString("tracking-redir-broken"), resp.Integer(int(id))}))
+	}
+}
+
+func bulkString(str string) string {
+	return resp.BulkString(&str)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"go.uber.org/goleak"
+	"strconv"
+	"testing"
+)
+
+func invalidation(key string) string {
+	return resp.Push([]string{bulkString("invalidate"), resp.Array([]interface{}{key})})
+}
+
+// helloField returns the value of a field of the map replied to HELLO
+func helloField(hello resp.Reply, field string) string {
+	for i := 0; i+1 < len(hello.Elems); i += 2 {
+		if hello.Elems[i].Str == field {
+			return hello.Elems[i+1].Str
+		}
+	}
+	return ""
+}
+
+func TestClientTracking(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_015)
+
+	go Start(port, 4, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+	ctx := context.Background()
+	common.ExpectNoError(t, rdb.Set(ctx, "k", "1", 0).Err())
+
+	// default mode with RESP3 pushes
+	cache := dialRaw(t, port)
+	hello, err := resp.ParseReply(cache.send("HELLO", "3"))
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, hello.Kind, resp.KindMap)
+	// the version is the one of the snapshots
+	common.AssertEquals(t, helloField(hello, "version"), "7.2.0")
+	common.AssertEquals(t, helloField(hello, "mode"), "standalone")
+	common.AssertEquals(t, helloField(hello, "role"), "master")
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "on"), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("GET", "k"), bulkString("1"))
+	common.ExpectNoError(t, rdb.Set(ctx, "k", "2", 0).Err())
+	common.AssertEquals(t, cache.read(), invalidation("k"))
+	// the key is no longer tracked until it is read again
+	common.ExpectNoError(t, rdb.Set(ctx, "k", "3", 0).Err())
+
+	// BCAST with NOLOOP skips the keys modified by the tracking client
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "on", "BCAST"), resp.Error(errTrackingBCASTSwitch))
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "off"), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("CLIENT", "GETREDIR"), resp.Integer(-1))
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "on", "BCAST", "PREFIX", "a", "PREFIX", "ab"),
+		"-ERR Prefix 'ab' overlaps with an existing prefix 'a'. Prefixes for a single client must not overlap.\r\n")
+	common.AssertEquals(t, cache.send("CLIENT", "GETREDIR"), resp.Integer(-1))
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "on", "BCAST", "PREFIX", "user:", "NOLOOP"), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("SET", "user:1", "a"), resp.SimpleString("OK"))
+	common.ExpectNoError(t, rdb.Set(ctx, "other", "b", 0).Err())
+	common.ExpectNoError(t, rdb.Set(ctx, "user:2", "c", 0).Err())
+	common.AssertEquals(t, cache.read(), invalidation("user:2"))
+
+	// RESP2 clients redirect the invalidations to a __redis__:invalidate subscriber
+	subscriber := dialRaw(t, port)
+	id, err := resp.ParseReply(subscriber.send("CLIENT", "ID"))
+	common.ExpectNoError(t, err)
+	subscriber.send("SUBSCRIBE", invalidateChannel)
+
+	conn := rdb.Conn(ctx)
+	redirect := strconv.FormatInt(id.Int, 10)
+	common.ExpectNoError(t, do(ctx, conn, "CLIENT", "TRACKING", "on", "REDIRECT", redirect, "OPTIN").Err())
+	getRedir, err := do(ctx, conn, "CLIENT", "GETREDIR").Int64()
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, getRedir, id.Int)
+	common.AssertEquals(t, do(ctx, conn, "GET", "x").Err(), redis.Nil)
+	common.ExpectNoError(t, do(ctx, conn, "CLIENT", "CACHING", "yes").Err())
+	common.AssertEquals(t, do(ctx, conn, "GET", "y").Err(), redis.Nil)
+	common.AssertEquals(t, cache.send("SET", "x", "1"), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("SET", "y", "1"), resp.SimpleString("OK"))
+	common.AssertEquals(t, subscriber.read(),
+		resp.RawArray([]string{bulkString("message"), bulkString(invalidateChannel), resp.Array([]interface{}{"y"})}))
+	common.ExpectNoError(t, do(ctx, conn, "CLIENT", "TRACKING", "off").Err())
+	common.ExpectNoError(t, conn.Close())
+
+	// a redirect to a RESP2 client subscribed to another channel is broken, the invalidations
+	// are dropped
+	news := dialRaw(t, port)
+	newsID, err := resp.ParseReply(news.send("CLIENT", "ID"))
+	common.ExpectNoError(t, err)
+	news.send("SUBSCRIBE", "news")
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "off"), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("CLIENT", "TRACKING", "on", "REDIRECT", strconv.FormatInt(newsID.Int, 10)), resp.SimpleString("OK"))
+	common.AssertEquals(t, cache.send("GET", "k"), bulkString("3"))
+	common.ExpectNoError(t, rdb.Set(ctx, "k", "4", 0).Err())
+	common.AssertEquals(t, cache.read(), resp.Push([]string{bulkString("tracking-redir-broken"), resp.Integer(int(newsID.Int))}))
+	common.ExpectNoError(t, rdb.Publish(ctx, "news", "hello").Err())
+	common.AssertEquals(t, news.read(), resp.RawArray([]string{bulkString("message"), bulkString("news"), bulkString("hello")}))
+	news.close()
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+
+	subscriber.close()
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	cache.close()
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+)
+
+var errExecAbort = errors.New("EXECABORT Transaction discarded because of previous errors.")
+
+// transaction keeps the state of a client between MULTI and EXEC/DISCARD
+type transaction struct {
+	commands []common.Command
+	// aborted is set when a command failed validation while queuing, EXEC will discard the transaction
+	aborted bool
+	// slot is the hash slot of the keys of the queued commands in cluster mode, -1 until a command
+	// with keys is queued
+	slot int
+}
+
+// isQueueable returns false for the commands that are executed right away even inside a transaction
+func isQueueable(cmd common.Command) bool {
+	switch cmd.CMD {
+	case common.MULTI, common.EXEC, common.DISCARD, common.WATCH:
+		return false
+	case common.CLIENT:
+		// workers send CLIENT KILL on disconnection and do not wait for a response
+		clientArgs, ok := cmd.Arguments.(common.CLIENTArguments)
+		return !ok || clientArgs.Subcommand != common.ClientSubcommandKILL
+	}
+	return true
+}
+
+func (s *server) queueCMD(cmd common.Command, c *connectedClient) (string, error) {
+	if cmd.Err != nil {
+		c.multi.aborted = true
+		return "", cmd.Err
+	}
+	if cmd.CMD == common.UNKNOWN {
+		c.multi.aborted = true
+		return "", fmt.Errorf("unsupported command %v", cmd.Arguments)
+	}
+	switch cmd.CMD {
+	case common.SUBSCRIBE, common.UNSUBSCRIBE, common.PSUBSCRIBE, common.PUNSUBSCRIBE,
+		common.SSUBSCRIBE, common.SUNSUBSCRIBE:
+		// their replies are not a single array element
+		c.multi.aborted = true
+		return "", errors.New("ERR Command not allowed inside a transaction")
+	}
+	c.multi.commands = append(c.multi.commands, cmd)
+	return resp.SimpleString("QUEUED"), nil
+}
+
+func (s *server) handleMULTI(c *connectedClient) (string, error) {
+	if c.multi != nil {
+		return "", errors.New("ERR MULTI calls can not be nested")
+	}
+	c.multi = &transaction{slot: -1}
+	return resp.SimpleString("OK"), nil
+}
+
+// handleEXEC runs the queued commands, the server executes one command at a time so no other
+// client command is interleaved with the transaction
+func (s *server) handleEXEC(c *connectedClient) (string, error) {
+	if c.multi == nil {
+		return "", errors.New("ERR EXEC without MULTI")
+	}
+	tx := c.multi
+	c.multi = nil
+	dirtyCAS, watched := c.dirtyCAS, c.watched
+	s.unwatchAll(c)
+	if tx.aborted {
+		return "", errExecAbort
+	}
+	if dirtyCAS {
+		// a watched key was modified, the transaction is not executed
+		return resp.NullArray(), nil
+	}
+	if s.raftTransactionProposed(tx, c) {
+		return s.proposeEXEC(tx, watched, c)
+	}
+
+	s.beginAtomic()
+	defer s.endAtomic()
+	replies := make([]string, 0, len(tx.commands))
+	for _, cmd := range tx.commands {
+		response, err := s.execute(cmd, c)
+		if err != nil {
+			response = resp.Error(err)
+		}
+		replies = append(replies, response)
+	}
+	return resp.RawArray(replies), nil
+}
+
+func (s *server) handleDISCARD(c *connectedClient) (string, error) {
+	if c.multi == nil {
+		return "", errors.New("ERR DISCARD without MULTI")
+	}
+	c.multi = nil
+	s.unwatchAll(c)
+	return resp.SimpleString("OK"), nil
+}
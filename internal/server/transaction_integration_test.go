@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_006)
+
+	go Start(port, 1, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+
+	ctx := context.Background()
+	cmds, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "x", 1, 0)
+		pipe.Get(ctx, "x")
+		pipe.Del(ctx, "x")
+		return nil
+	})
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, len(cmds), 3)
+	common.AssertEquals(t, cmds[1].(*redis.StringCmd).Val(), "1")
+	common.AssertEquals(t, cmds[2].(*redis.IntCmd).Val(), int64(1))
+
+	conn := rdb.Conn(ctx)
+	common.ExpectNoError(t, do(ctx, conn, "MULTI").Err())
+	common.AssertEquals(t, do(ctx, conn, "SET", "y", "2").Val(), "QUEUED")
+	common.ExpectNoError(t, do(ctx, conn, "DISCARD").Err())
+	err = conn.Get(ctx, "y").Err()
+	common.AssertEquals(t, err, redis.Nil)
+
+	err = do(ctx, conn, "EXEC").Err()
+	if err == nil || err.Error() != "ERR EXEC without MULTI" {
+		t.Errorf("want EXEC without MULTI error, got %v", err)
+	}
+
+	common.ExpectNoError(t, conn.Close())
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+func TestExecAbort(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_007)
+
+	go Start(port, 1, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+
+	ctx := context.Background()
+	conn := rdb.Conn(ctx)
+	common.ExpectNoError(t, do(ctx, conn, "MULTI").Err())
+	common.AssertEquals(t, do(ctx, conn, "SET", "x", "1").Val(), "QUEUED")
+	if err := do(ctx, conn, "GET").Err(); err == nil {
+		t.Errorf("expecting error queuing GET without arguments")
+	}
+	err := do(ctx, conn, "EXEC").Err()
+	if err == nil || err.Error() != errExecAbort.Error() {
+		t.Errorf("want error:%s , got: %s ", errExecAbort, err)
+	}
+	err = conn.Get(ctx, "x").Err()
+	common.AssertEquals(t, err, redis.Nil)
+
+	common.ExpectNoError(t, conn.Close())
+	common.ExpectNoError(t, rdb.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
+
+// do sends a raw command using a single connection, *redis.Conn does not expose Do in go-redis v8.4
+func do(ctx context.Context, conn *redis.Conn, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx, args...)
+	_ = conn.Process(ctx, cmd)
+	return cmd
+}
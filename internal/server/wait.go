@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"time"
+)
+
+var (
+	errWaitReplica     = errors.New("ERR WAIT cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	errWaitAOFReplica  = errors.New("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	errWaitAOFDisabled = errors.New("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+)
+
+// waitingClient is a client blocked by WAIT or WAITAOF. Its worker waits for the reply while the
+// server keeps serving the other clients, the reply is sent once enough acknowledgements arrived
+// or the timeout expired.
+type waitingClient struct {
+	c   *connectedClient
+	cmd common.CommandID
+	// offset is the replication offset the replicas must acknowledge
+	offset int64
+	// aofOffset is the number of bytes of the append only file that must be on disk
+	aofOffset   int64
+	numLocal    int
+	numReplicas int
+	// deadline is zero when the client waits forever
+	deadline time.Time
+}
+
+func (s *server) handleWAIT(cmdID common.CommandID, args common.CommandArguments, c *connectedClient) (string, error) {
+	waitArgs, ok := args.(common.WAITArguments)
+	if !ok {
+		return "-ERR", fmt.Errorf("invalid %v argments %v", cmdID, args)
+	}
+	if s.master != nil {
+		if cmdID == common.WAITAOF {
+			return "", errWaitAOFReplica
+		}
+		return "", errWaitReplica
+	}
+	if waitArgs.NumLocal > 0 && s.aof == nil {
+		return "", errWaitAOFDisabled
+	}
+
+	w := &waitingClient{
+		c:           c,
+		cmd:         cmdID,
+		offset:      s.replOffset,
+		numLocal:    waitArgs.NumLocal,
+		numReplicas: waitArgs.NumReplicas,
+	}
+	if s.aof != nil {
+		// the commands of the client were written before their replies, they only need the fsync
+		w.aofOffset = s.aofWritten()
+	}
+	if waitArgs.Timeout > 0 {
+		w.deadline = s.now().Add(time.Duration(waitArgs.Timeout) * time.Millisecond)
+	}
+	local, replicas := s.waitAcks(w)
+	if w.acknowledged(local, replicas) || s.atomicDepth > 0 {
+		// EXEC and scripts can not block, like redis they reply with the current acknowledgements
+		return waitReply(cmdID, local, replicas), nil
+	}
+	if replicas < w.numReplicas && len(s.replicas) > 0 {
+		s.feedCommand([]string{"REPLCONF", "GETACK", "*"})
+	}
+	s.waiting = append(s.waiting, w)
+	return "", nil
+}
+
+// waitAcks returns 1 when the append only file is on disk up to the offset of w and the number
+// of replicas that acknowledged its replication offset
+func (s *server) waitAcks(w *waitingClient) (local int, replicas int) {
+	if s.aof != nil && s.aofSynced() >= w.aofOffset {
+		local = 1
+	}
+	for _, c := range s.replicas {
+		acked := c.replica.ackOffset
+		if w.cmd == common.WAITAOF {
+			acked = c.replica.aofAckOffset
+		}
+		if acked >= w.offset {
+			replicas++
+		}
+	}
+	return local, replicas
+}
+
+func (w *waitingClient) acknowledged(local int, replicas int) bool {
+	return local >= w.numLocal && replicas >= w.numReplicas
+}
+
+func waitReply(cmdID common.CommandID, local int, replicas int) string {
+	if cmdID == common.WAITAOF {
+		return resp.Array([]interface{}{local, replicas})
+	}
+	return resp.Integer(replicas)
+}
+
+// checkWaiting replies to the waiting clients acknowledged or timed out, or to all of them
+func (s *server) checkWaiting(all bool) {
+	if len(s.waiting) == 0 {
+		return
+	}
+	now := s.now()
+	waiting := s.waiting[:0]
+	for _, w := range s.waiting {
+		local, replicas := s.waitAcks(w)
+		timedOut := !w.deadline.IsZero() && !now.Before(w.deadline)
+		if !all && !timedOut && !w.acknowledged(local, replicas) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c.reply(waitReply(w.cmd, local, replicas))
+	}
+	for i := len(waiting); i < len(s.waiting); i++ {
+		s.waiting[i] = nil
+	}
+	s.waiting = waiting
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+)
+
+// touchKey flags every client watching key and invalidates the clients tracking it, it must be
+// called by every command modifying the keyspace. by is the client modifying the key.
+func (s *server) touchKey(key string, by *connectedClient) {
+	s.dirty++
+	for _, c := range s.watchedKeys[key] {
+		c.dirtyCAS = true
+	}
+	s.invalidateKey(key, by)
+}
+
+func (s *server) handleWATCH(args common.CommandArguments, c *connectedClient) (string, error) {
+	watchArgs, ok := args.(common.WATCHArguments)
+	if !ok {
+		return "-ERR", errors.New("invalid WATCH arguments")
+	}
+	if c.multi != nil {
+		return "", errors.New("ERR WATCH inside MULTI is not allowed")
+	}
+
+	if c.watched == nil {
+		c.watched = make(map[string]struct{})
+	}
+	for _, key := range watchArgs.Keys {
+		if _, watching := c.watched[key]; watching {
+			continue
+		}
+		c.watched[key] = struct{}{}
+		watchers, exists := s.watchedKeys[key]
+		if !exists {
+			watchers = make(map[uint]*connectedClient)
+			s.watchedKeys[key] = watchers
+		}
+		watchers[c.ID] = c
+	}
+	return resp.SimpleString("OK"), nil
+}
+
+func (s *server) handleUNWATCH(c *connectedClient) (string, error) {
+	s.unwatchAll(c)
+	return resp.SimpleString("OK"), nil
+}
+
+// unwatchAll removes every watched key of the client c and resets its CAS state
+func (s *server) unwatchAll(c *connectedClient) {
+	for key := range c.watched {
+		watchers := s.watchedKeys[key]
+		delete(watchers, c.ID)
+		if len(watchers) == 0 {
+			delete(s.watchedKeys, key)
+		}
+	}
+	c.watched = nil
+	c.dirtyCAS = false
+}
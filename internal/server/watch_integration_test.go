@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/internal/common"
+	"go.uber.org/goleak"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 2)
+	port := uint(10_008)
+
+	go Start(port, 2, ready, quit, events)
+
+	<-ready
+	fmt.Println("server is ready")
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("localhost:%d", port),
+		PoolSize: 1,
+	})
+	other := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("localhost:%d", port),
+	})
+
+	ctx := context.Background()
+	common.ExpectNoError(t, rdb.Set(ctx, "x", 1, 0).Err())
+
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "x", 2, 0)
+			return nil
+		})
+		return err
+	}, "x")
+	common.ExpectNoError(t, err)
+
+	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+		common.ExpectNoError(t, other.Del(ctx, "x").Err())
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "x", 3, 0)
+			return nil
+		})
+		return err
+	}, "x")
+	common.AssertEquals(t, err, redis.TxFailedErr)
+	common.AssertEquals(t, rdb.Get(ctx, "x").Err(), redis.Nil)
+
+	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+		common.ExpectNoError(t, tx.Unwatch(ctx).Err())
+		common.ExpectNoError(t, other.Set(ctx, "x", 4, 0).Err())
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "x", 5, 0)
+			return nil
+		})
+		return err
+	}, "x")
+	common.ExpectNoError(t, err)
+	common.AssertEquals(t, rdb.Get(ctx, "x").Val(), "5")
+
+	common.ExpectNoError(t, rdb.Close())
+	common.ExpectNoError(t, other.Close())
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	common.AssertEquals(t, <-events, EventAfterDisconnect)
+	quit <- true
+	common.AssertEquals(t, <-events, EventSuccessfulShutdown)
+}
@@ -7,8 +7,65 @@
 #
 #   the following options are available:
 # 
+#        -active-active
+#                accept writes on every peer and replicate the values as CRDTs (default false)
+#        -active-active-peers string
+#                comma separated host:port of the other masters in active-active mode
+#        -aof-timestamp-enabled
+#                annotate the append only file with the time of the commands (default false)
+#        -appenddirname string
+#                directory of the append only files, inside dir (default appendonlydir)
+#        -appendfilename string
+#                base name of the append only files (default appendonly.aof)
+#        -appendfsync string
+#                fsync policy of the append only file: always, everysec or no (default everysec)
+#        -appendonly
+#                log every write command to the append only file (default false)
+#        -busy-script-timeout duration
+#                time a script can run before other clients receive BUSY errors (default 5s)
+#        -cluster-config-file string
+#                configuration file of the cluster, inside dir (default nodes.conf)
+#        -cluster-enabled
+#                start in cluster mode (default false)
+#        -cluster-node-timeout duration
+#                time a node of the cluster can be unreachable before it is considered failing (default 15s)
+#        -compression string
+#                compression of the RDB and append only files: none or gzip (default none)
+#        -dbfilename string
+#                name of the RDB file, like dump.rdb, empty disables the RDB snapshots (default "")
+#        -dir string
+#                directory of the RDB file (default .)
+#        -encryption-key-file string
+#                file with the AES key, in hex or base64, encrypting the RDB and append only files,
+#                REDIS_ENCRYPTION_KEY is used when empty
 #        -max-clients uint
 #                maximum number of active client connections  (default 100_000)
+#        -netpoll int
+#                serve the clients from this number of I/O goroutines with epoll instead of a
+#                goroutine per client, Linux only, 0 disables it (default 0)
+#        -notify-keyspace-events string
+#                keyspace notification classes published, like KEA (default none)
+#        -raft-dir string
+#                directory of the raft log, inside dir (default raft)
+#        -raft-enabled
+#                commit the write commands through a raft log replicated to the members (default false)
+#        -recover-ops int
+#                replay only the first commands appended to the append only file after its base
+#        -recover-until string
+#                replay the append only file up to this time, like 10:42 or 2006-01-02T15:04:05Z07:00
+#        -replicaof string
+#                start as a replica of the master at "<host> <port>"
+#        -save string
+#                save the RDB file, once -dbfilename is set, after <seconds> if there were at least <changes>
+#                (default "3600 1 300 100 60 10000")
+#        -sentinel
+#                start in sentinel mode, monitoring masters and failing them over (default false)
+#        -sentinel-down-after duration
+#                time a monitored instance can be unreachable before it is considered down (default 30s)
+#        -sentinel-failover-timeout duration
+#                time a failover can take before it is aborted (default 3m0s)
+#        -sentinel-monitor string
+#                masters monitored in sentinel mode, "<name> <host> <port> <quorum>" separated by ;
 #        -port uint
 #                port number to listen for TCP connections of clients implementing  (default 6379)#
 set -euo pipefail
@@ -0,0 +1,19 @@
+/*
+Package server embeds the redis protocol server in other programs. It exposes the options an
+embedder needs, like the libraries of server side functions written in Go, on top of the internal
+packages implementing the commands.
+
+	greetings := &server.Function{
+		Name:     "hello",
+		NoWrites: true,
+		Call: func(ctx context.Context, call server.Caller, keys, args []string) (string, error) {
+			return server.BulkString("hello " + args[0]), nil
+		},
+	}
+	go server.Start(6379, 100, ready, quit, events, server.WithGoLibrary("greetings", greetings))
+
+The clients load the library with FUNCTION LOAD "#!go name=greetings" and call it with
+FCALL hello 0 world. Only the code "#!go name=greetings" is persisted with the dataset, so the
+library has to be registered again with the same name when the server restarts.
+*/
+package server
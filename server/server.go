@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/rilopez/redis-wire-protocol/internal/function"
+	"github.com/rilopez/redis-wire-protocol/internal/resp"
+	"github.com/rilopez/redis-wire-protocol/internal/server"
+)
+
+// EventSuccessfulShutdown is sent to the events channel of Start once the server stopped
+const EventSuccessfulShutdown = server.EventSuccessfulShutdown
+
+// Option configures optional server settings
+type Option = server.Option
+
+// Function is a function of a library implemented in Go, Call returns the RESP encoded reply
+type Function = function.Function
+
+// Caller executes a command issued by a function, it returns the RESP encoded reply
+type Caller = function.Caller
+
+// Start listens for clients at port until quit receives a value, ready receives a value once
+// the clients can connect
+func Start(port uint, maxClients uint, ready chan<- bool, quit <-chan bool, events chan<- string, opts ...Option) {
+	server.Start(port, maxClients, ready, quit, events, opts...)
+}
+
+// WithGoLibrary registers the library name implemented by functions, the clients load it with
+// FUNCTION LOAD and the code "#!go name=<name>". It panics if name is registered twice.
+func WithGoLibrary(name string, functions ...*Function) Option {
+	return server.WithGoLibrary(name, functions...)
+}
+
+// WithRDB enables RDB snapshots at dir/filename, the file is loaded at startup
+func WithRDB(dir string, filename string) Option {
+	return server.WithRDB(dir, filename)
+}
+
+// WithSaveRules sets the automatic snapshot rules, like "3600 1 300 100 60 10000"
+func WithSaveRules(rules string) Option {
+	return server.WithSaveRules(rules)
+}
+
+// WithAppendOnly logs every write command to the append only files stored in dirname, inside the
+// directory of the RDB file. fsync is always, everysec or no.
+func WithAppendOnly(dirname string, filename string, fsync string) Option {
+	return server.WithAppendOnly(dirname, filename, fsync)
+}
+
+// BulkString encodes a bulk string reply of a Function
+func BulkString(s string) string {
+	return resp.BulkString(&s)
+}
+
+// Integer encodes an integer reply of a Function
+func Integer(v int) string {
+	return resp.Integer(v)
+}
+
+// SimpleString encodes a status reply of a Function, like OK
+func SimpleString(s string) string {
+	return resp.SimpleString(s)
+}
@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rilopez/redis-wire-protocol/server"
+	"go.uber.org/goleak"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGoLibrary embeds the server with a Go library, its functions are called with FCALL once
+// loaded by a client
+func TestGoLibrary(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx := context.Background()
+	hello := &server.Function{
+		Name:     "hello",
+		NoWrites: true,
+		Call: func(ctx context.Context, call server.Caller, keys, args []string) (string, error) {
+			return server.BulkString("hello " + args[0]), nil
+		},
+	}
+	shout := &server.Function{
+		Name: "shout",
+		Call: func(ctx context.Context, call server.Caller, keys, args []string) (string, error) {
+			if _, err := call([]string{"SET", keys[0], strings.ToUpper(args[0])}); err != nil {
+				return "", err
+			}
+			return server.SimpleString("OK"), nil
+		},
+	}
+
+	ready := make(chan bool, 1)
+	quit := make(chan bool, 1)
+	events := make(chan string, 16)
+	go server.Start(10_059, 10, ready, quit, events, server.WithGoLibrary("greetings", hello, shout))
+	<-ready
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:10059"})
+
+	err := rdb.Do(ctx, "FCALL", "hello", 0, "world").Err()
+	if err == nil || err.Error() != "ERR Function not found" {
+		t.Errorf("want function not found before FUNCTION LOAD, got %v", err)
+	}
+	name, err := rdb.Do(ctx, "FUNCTION", "LOAD", "#!go name=greetings").Text()
+	if err != nil || name != "greetings" {
+		t.Fatalf("FUNCTION LOAD = %q, %v", name, err)
+	}
+	if got, err := rdb.Do(ctx, "FCALL_RO", "hello", 0, "world").Text(); err != nil || got != "hello world" {
+		t.Errorf("FCALL_RO hello = %q, %v", got, err)
+	}
+	if err := rdb.Do(ctx, "FCALL", "shout", 1, "greeting", "hi").Err(); err != nil {
+		t.Errorf("FCALL shout error = %v", err)
+	}
+	if got := rdb.Get(ctx, "greeting").Val(); got != "HI" {
+		t.Errorf("GET greeting = %q, want HI", got)
+	}
+	err = rdb.Do(ctx, "FUNCTION", "LOAD", "#!go name=missing").Err()
+	if want := "ERR Go library 'missing' is not registered in this server"; fmt.Sprint(err) != want {
+		t.Errorf("FUNCTION LOAD of an unregistered library error = %v, want %s", err, want)
+	}
+
+	if err := rdb.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	// the connection of the client must be disconnected before the shutdown
+	for quiet := false; !quiet; {
+		select {
+		case <-events:
+		case <-time.After(200 * time.Millisecond):
+			quiet = true
+		}
+	}
+	quit <- true
+	for event := range events {
+		if event == server.EventSuccessfulShutdown {
+			return
+		}
+	}
+}